@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/actions"
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/power"
+	"github.com/latitudesh/agent/internal/schedule"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// agentStart records when the agent process started, for diagnostics
+var agentStart = time.Now()
+
+// newActionsRunner creates the remote actions runner and registers the
+// actions this agent supports
+func newActionsRunner(cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) (*actions.Runner, error) {
+	timeout, _ := time.ParseDuration(cfg.Actions.Timeout)
+	interval, _ := time.ParseDuration(cfg.Actions.PollInterval)
+
+	runner, err := actions.NewRunner(
+		latitudeClient,
+		cfg.Actions.Endpoint,
+		cfg.Actions.PublicKey,
+		cfg.Actions.Allowed,
+		timeout,
+		interval,
+		log.Logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	runner.SetStateDir(cfg.Agent.StateDir)
+	runner.SetServerID(cfg.Latitude.ServerID)
+	runner.SetAuditLog(cfg.Actions.AuditLog)
+	if eventQueue != nil {
+		runner.SetResultSink(func(result *client.ActionResult) error {
+			return queueEvent(eventActionResult, cfg.Actions.Endpoint, "action-"+result.ActionID, result)
+		})
+	}
+
+	runner.Register("resync_firewall", func(ctx context.Context, action *client.Action) (string, error) {
+		if err := runCollection(ctx, latitudeClient, firewallCollector, cfg, log); err != nil {
+			return "", err
+		}
+		if firewallCollector != nil && firewallCollector.ReadOnly() {
+			return fmt.Sprintf("Firewall compliance reported, %s is not modified in readonly mode", firewallCollector.Backend().Name()), nil
+		}
+		return "Firewall resynchronized", nil
+	})
+
+	runner.Register("collect_diagnostics", func(ctx context.Context, action *client.Action) (string, error) {
+		return collectDiagnostics(ctx, cfg, firewallCollector), nil
+	})
+
+	runner.Register("restart_agent", func(ctx context.Context, action *client.Action) (string, error) {
+		// Give the runner time to report the result before shutting down;
+		// the service manager is expected to start the agent again
+		time.AfterFunc(5*time.Second, func() {
+			log.WithComponent("actions").Info("Restarting agent as requested by remote action")
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		})
+		return "Agent restart scheduled", nil
+	})
+
+	runner.Register("speedtest", func(ctx context.Context, action *client.Action) (string, error) {
+		return runSpeedtest(ctx, cfg, latitudeClient, action.Args["region"], true)
+	})
+
+	runner.Register("disk_benchmark", func(ctx context.Context, action *client.Action) (string, error) {
+		return runDiskBenchmark(ctx, cfg, latitudeClient, action.Args["path"], true)
+	})
+
+	if cfg.BMC.Enabled {
+		bmcCollector := newBMCCollector(cfg, log)
+		runner.Register("bmc_cold_reset", func(ctx context.Context, action *client.Action) (string, error) {
+			if err := bmcCollector.ColdReset(ctx); err != nil {
+				return "", err
+			}
+			return "BMC cold reset issued, the BMC will be unavailable for a few minutes", nil
+		})
+	}
+
+	if cfg.SelfTests.Enabled {
+		selfTestRunner := newSelfTestRunner(cfg, log)
+		runner.Register("smart_self_test", func(ctx context.Context, action *client.Action) (string, error) {
+			test, err := selfTestRunner.Start(ctx, action.Args["disk"], action.Args["type"])
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Started %s self-test on %s, its outcome is reported when it finishes", test.Type, test.Disk), nil
+		})
+	}
+
+	if cfg.MemoryTest.Enabled {
+		runner.Register("memory_test", func(ctx context.Context, action *client.Action) (string, error) {
+			return requestMemoryTest(cfg, action)
+		})
+	}
+
+	windows, _ := schedule.ParseWindows(cfg.Power.Windows)
+	delay, _ := time.ParseDuration(cfg.Power.Delay)
+	powerController := power.NewController(cfg.Agent.StateDir, windows, delay, firewallCollector, log.Logger)
+	powerController.SetCommandWrapper(privilegeWrapper(cfg)...)
+	for _, operation := range []string{power.Reboot, power.Shutdown} {
+		operation := operation
+		runner.Register(operation, func(ctx context.Context, action *client.Action) (string, error) {
+			return powerController.Request(ctx, operation, action.Args)
+		})
+	}
+
+	return runner, nil
+}
+
+// collectDiagnostics gathers agent and host state useful for support
+func collectDiagnostics(ctx context.Context, cfg *config.Config, firewallCollector *collectors.FirewallCollector) string {
+	var b strings.Builder
+
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(&b, "Agent version: %s\n", Version)
+	fmt.Fprintf(&b, "Hostname: %s\n", hostname)
+	fmt.Fprintf(&b, "Agent uptime: %s\n", time.Since(agentStart).Round(time.Second))
+	fmt.Fprintf(&b, "Interval: %s\n", cfg.Agent.Interval)
+	fmt.Fprintf(&b, "Firewall enabled: %t\n", cfg.Firewall.Enabled)
+	fmt.Fprintf(&b, "Container mode: %t\n", cfg.Container.Active())
+
+	if stats, err := collectors.GetSystemStats(); err == nil {
+		fmt.Fprintf(&b, "Host uptime: %s\n", stats.Uptime)
+		fmt.Fprintf(&b, "Load average: %.2f %.2f %.2f\n", stats.Load1, stats.Load5, stats.Load15)
+		fmt.Fprintf(&b, "Memory used: %.1f%% of %d MiB\n", stats.MemUsedPercent(), stats.MemTotalKB/1024)
+	}
+
+	if status, err := state.LoadStatus(cfg.Agent.StateDir); err == nil {
+		fmt.Fprintf(&b, "Last cycle: %s success=%t duration=%s\n", status.Timestamp.Format(time.RFC3339), status.Success, status.Duration)
+		if status.Error != "" {
+			fmt.Fprintf(&b, "Last error: %s\n", status.Error)
+		}
+	}
+
+	if pause, err := state.LoadPause(cfg.Agent.StateDir); err == nil && pause.Active(time.Now()) {
+		fmt.Fprintf(&b, "Paused until: %s\n", pause.Until.Format(time.RFC3339))
+	}
+
+	if firewallCollector != nil {
+		name := firewallCollector.Backend().Name()
+		if status, err := firewallCollector.GetFirewallStatus(ctx); err != nil {
+			fmt.Fprintf(&b, "%s status: unavailable (%v)\n", name, err)
+		} else {
+			fmt.Fprintf(&b, "%s status:\n%s", name, status)
+		}
+	}
+
+	return b.String()
+}
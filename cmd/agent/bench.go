@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/bench"
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// runBench runs an on-demand benchmark and prints the results
+func runBench(args []string) int {
+	if len(args) == 0 {
+		benchUsage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("benchmark "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	region := fs.String("region", "", "Only test the target in this region (network)")
+	path := fs.String("path", "", "Directory or block device to benchmark (disk)")
+	report := fs.Bool("report", false, "Send the results to the Latitude.sh API")
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Keep client logging out of the benchmark output
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	latitudeClient := newLatitudeClient(cfg, quiet)
+
+	switch args[0] {
+	case "network":
+		output, err := runSpeedtest(ctx, cfg, latitudeClient, *region, *report)
+		fmt.Print(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Speedtest failed: %v\n", err)
+			return 1
+		}
+	case "disk":
+		output, err := runDiskBenchmark(ctx, cfg, latitudeClient, *path, *report)
+		fmt.Print(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Disk benchmark failed: %v\n", err)
+			return 1
+		}
+	default:
+		benchUsage()
+		return 2
+	}
+
+	return 0
+}
+
+// benchUsage prints usage for the bench command
+func benchUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lsh-agent benchmark <benchmark> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Benchmarks:")
+	fmt.Fprintln(os.Stderr, "  network [-region <region>] [-report]  Measure latency and throughput to Latitude.sh regions")
+	fmt.Fprintln(os.Stderr, "  disk [-path <dir|device>] [-report]   Measure IOPS, throughput and latency with fio")
+}
+
+// runSpeedtest benchmarks the configured or API-provided speedtest targets,
+// optionally reporting the results, and returns them formatted as a table
+func runSpeedtest(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, region string, report bool) (string, error) {
+	var targets []bench.Target
+	for _, t := range cfg.Speedtest.Targets {
+		targets = append(targets, bench.Target{Region: t.Region, URL: t.URL})
+	}
+	if len(targets) == 0 {
+		targetsJSON, err := latitudeClient.FetchSpeedtestTargets(ctx, cfg.Speedtest.Endpoint)
+		if err != nil {
+			return "", err
+		}
+		if targets, err = bench.ParseTargets(targetsJSON); err != nil {
+			return "", err
+		}
+	}
+
+	if region != "" {
+		var selected []bench.Target
+		for _, t := range targets {
+			if t.Region == region {
+				selected = append(selected, t)
+			}
+		}
+		if len(selected) == 0 {
+			return "", fmt.Errorf("no speedtest target in region %q", region)
+		}
+		targets = selected
+	}
+	if len(targets) == 0 {
+		return "", fmt.Errorf("no speedtest targets available")
+	}
+
+	duration, _ := time.ParseDuration(cfg.Speedtest.Duration)
+	results := bench.RunNetwork(ctx, targets, duration)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-16s %12s %12s %14s\n", "REGION", "LATENCY MIN", "LATENCY AVG", "DOWNLOAD")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(&b, "%-16s error: %s\n", r.Region, r.Error)
+			continue
+		}
+		fmt.Fprintf(&b, "%-16s %9.2f ms %9.2f ms %9.1f Mbps\n", r.Region, r.LatencyMinMs, r.LatencyAvgMs, r.DownloadMbps)
+	}
+
+	if report {
+		if err := latitudeClient.SendReport(ctx, cfg.Speedtest.Endpoint, map[string]interface{}{
+			"timestamp": time.Now(),
+			"results":   results,
+		}); err != nil {
+			return b.String(), err
+		}
+	}
+
+	return b.String(), nil
+}
+
+// runDiskBenchmark runs fio workloads against path, optionally reporting the
+// results, and returns them formatted as a table
+func runDiskBenchmark(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, path string, report bool) (string, error) {
+	if path == "" {
+		path = cfg.DiskBench.Path
+	}
+	if _, err := os.Stat(cfg.Container.HostPath(cfg.DiskBench.FioBinary)); err != nil {
+		return "", fmt.Errorf("fio not found at %s, install fio to run disk benchmarks", cfg.DiskBench.FioBinary)
+	}
+
+	runtime, _ := time.ParseDuration(cfg.DiskBench.Runtime)
+	benchmark := bench.NewDiskBenchmark(cfg.Container.HostPath("/"), cfg.DiskBench.FioBinary, cfg.DiskBench.Size, runtime)
+	benchmark.SetCommandWrapper(privilegeWrapper(cfg)...)
+
+	results, err := benchmark.Run(ctx, path)
+	if err != nil && len(results) == 0 {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Path: %s\n", path)
+	fmt.Fprintf(&b, "%-14s %12s %14s %12s %12s\n", "JOB", "IOPS", "THROUGHPUT", "LAT AVG", "LAT P99")
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			fmt.Fprintf(&b, "%-14s skipped (write to block device)\n", r.Job)
+		case r.Error != "":
+			fmt.Fprintf(&b, "%-14s error: %s\n", r.Job, r.Error)
+		default:
+			fmt.Fprintf(&b, "%-14s %12.0f %9.1f MB/s %9.0f us %9.0f us\n", r.Job, r.IOPS, r.ThroughputMBps, r.LatencyAvgUs, r.LatencyP99Us)
+		}
+	}
+
+	if report {
+		if reportErr := latitudeClient.SendReport(ctx, cfg.DiskBench.Endpoint, map[string]interface{}{
+			"timestamp": time.Now(),
+			"type":      "disk",
+			"path":      path,
+			"results":   results,
+		}); reportErr != nil && err == nil {
+			err = reportErr
+		}
+	}
+
+	return b.String(), err
+}
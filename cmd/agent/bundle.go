@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/latitudesh/agent/internal/bundle"
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// bundleStateFile records when the last applied rule bundle was issued, so
+// an older bundle cannot roll the rules back
+const bundleStateFile = "rule-bundle.json"
+
+// fetchFirewallRules returns the firewall rules to enforce: from the API,
+// or in air-gapped mode from the local rule bundle. In air-gapped mode the
+// API is still pinged so the agent reports in once a relay or route is
+// available, but failing to reach it does not fail the cycle.
+func fetchFirewallRules(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) (string, error) {
+	if !cfg.AirGapped.Enabled {
+		return latitudeClient.PingAndGetFirewallRules(ctx)
+	}
+
+	rulesJSON, err := loadRuleBundle(cfg, log)
+	if err != nil {
+		return "", err
+	}
+	if _, err := latitudeClient.PingAndGetFirewallRules(ctx); err != nil {
+		log.WithComponent("agent").WithError(err).Debug("API unreachable in air-gapped mode, will report later")
+	}
+	return rulesJSON, nil
+}
+
+// loadRuleBundle verifies the local rule bundle and returns its rules. A
+// bundle issued before the last one applied is refused.
+func loadRuleBundle(cfg *config.Config, log *logger.Logger) (string, error) {
+	// Validated when the configuration is loaded
+	publicKey, _ := bundle.ParsePublicKey(cfg.AirGapped.PublicKey)
+	b, err := bundle.Load(cfg.AirGapped.BundlePath, publicKey, cfg.Latitude.FirewallID)
+	if err != nil {
+		return "", err
+	}
+
+	var last bundle.Bundle
+	if err := state.Load(cfg.Agent.StateDir, bundleStateFile, &last); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read last rule bundle: %w", err)
+	}
+	if b.IssuedAt.Before(last.IssuedAt) {
+		return "", fmt.Errorf("rule bundle issued at %s is older than the one applied, issued at %s",
+			b.IssuedAt.Format(time.RFC3339), last.IssuedAt.Format(time.RFC3339))
+	}
+	if !b.IssuedAt.Equal(last.IssuedAt) {
+		log.WithComponent("agent").Infof("Loaded rule bundle issued at %s", b.IssuedAt.Format(time.RFC3339))
+		if err := state.Save(cfg.Agent.StateDir, bundleStateFile, b); err != nil {
+			return "", fmt.Errorf("failed to record rule bundle: %w", err)
+		}
+	}
+	return b.RulesJSON, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// revertedRulesetFile records the API rules last reverted by canary mode,
+// so they are not applied again every cycle
+const revertedRulesetFile = "canary-reverted.json"
+
+// revertedRuleset is the local record of API rules reverted by canary mode
+type revertedRuleset struct {
+	RulesHash  string    `json:"rules_hash"`
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error"`
+	RevertedAt time.Time `json:"reverted_at"`
+}
+
+// syncFirewall synchronizes UFW with the API rules, in canary mode when it
+// is enabled. API rules that canary mode reverted are not applied again
+// until they change.
+func syncFirewall(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, rulesJSON, rulesHash string, log *logger.Logger) (*state.SyncResult, error) {
+	if !cfg.Firewall.Canary.Enabled {
+		return firewallCollector.SyncFirewallRules(ctx, rulesJSON)
+	}
+
+	var reverted revertedRuleset
+	if err := state.Load(cfg.Agent.StateDir, revertedRulesetFile, &reverted); err != nil && !os.IsNotExist(err) {
+		log.WithComponent("firewall").WithError(err).Warn("Failed to read reverted ruleset")
+	}
+	if reverted.RulesHash == rulesHash {
+		return nil, fmt.Errorf("%w at %s (%s), waiting for the API rules to change",
+			collectors.ErrCanaryReverted, reverted.RevertedAt.Format(time.RFC3339), reverted.Error)
+	}
+
+	result, err := firewallCollector.SyncFirewallRulesCanary(ctx, rulesJSON, canaryPolicy(cfg, latitudeClient))
+	if result != nil && result.RolledBack {
+		reverted = revertedRuleset{RulesHash: rulesHash, Reason: result.Canary, Error: err.Error(), RevertedAt: time.Now()}
+		if saveErr := state.Save(cfg.Agent.StateDir, revertedRulesetFile, &reverted); saveErr != nil {
+			log.WithComponent("firewall").WithError(saveErr).Warn("Failed to record reverted ruleset")
+		}
+	} else if err == nil && reverted.RulesHash != "" {
+		if err := os.Remove(filepath.Join(cfg.Agent.StateDir, revertedRulesetFile)); err != nil && !os.IsNotExist(err) {
+			log.WithComponent("firewall").WithError(err).Warn("Failed to clear reverted ruleset")
+		}
+	}
+	return result, err
+}
+
+// canaryPolicy returns the canary verification of risky firewall changes:
+// the API must stay reachable, and SSH listening if it was
+func canaryPolicy(cfg *config.Config, latitudeClient *client.LatitudeClient) *collectors.CanaryPolicy {
+	// The SSH listener is only required afterwards if it is there before, so
+	// a server without sshd on the configured port can still be changed
+	sshPort := cfg.Firewall.Canary.SSHPort
+	sshListening, _ := collectors.TCPListening(sshPort)
+	grace, _ := time.ParseDuration(cfg.Firewall.Canary.Grace)
+	return &collectors.CanaryPolicy{
+		MaxRemovals: cfg.Firewall.Canary.MaxRemovals,
+		SSHPort:     sshPort,
+		Grace:       grace,
+		Verify: func(ctx context.Context) error {
+			if err := latitudeClient.HealthCheck(ctx); err != nil {
+				return fmt.Errorf("API is unreachable: %w", err)
+			}
+			if sshListening {
+				if listening, err := collectors.TCPListening(sshPort); err != nil {
+					return fmt.Errorf("failed to check the SSH listener: %w", err)
+				} else if !listening {
+					return fmt.Errorf("nothing listens on SSH port %d", sshPort)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// syncFirewallPolicy applies the API's default policies and logging level
+// once the rules are in place, so a default deny never lands before the
+// rules allowing traffic through it. Risky changes are verified like rule
+// changes when the canary is enabled.
+func syncFirewallPolicy(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, rulesJSON string, result *state.SyncResult, log *logger.Logger) error {
+	var canary *collectors.CanaryPolicy
+	if cfg.Firewall.Canary.Enabled {
+		canary = canaryPolicy(cfg, latitudeClient)
+	}
+	changes, err := firewallCollector.SyncFirewallPolicy(ctx, rulesJSON, canary)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		result.Policy = append(result.Policy, change.String())
+	}
+	if len(changes) > 0 {
+		log.WithComponent("firewall").Infof("Firewall policy synchronization: changed %s", strings.Join(result.Policy, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/logger"
+)
+
+// capabilityInterval is how often the external tools are checked again,
+// e.g. after someone installs smartctl
+const capabilityInterval = time.Hour
+
+var (
+	capabilitiesMu sync.Mutex
+	capabilities   map[string]collectors.Capability
+)
+
+// refreshCapabilities checks which external tools are available and, when
+// that changed, queues them for the next ping
+func refreshCapabilities(ctx context.Context, hostRoot string, latitudeClient *client.LatitudeClient, log *logger.Logger) error {
+	current := collectors.Capabilities(ctx, hostRoot)
+
+	capabilitiesMu.Lock()
+	changed := !reflect.DeepEqual(current, capabilities)
+	capabilities = current
+	capabilitiesMu.Unlock()
+
+	if changed {
+		var missing []string
+		for name, capability := range current {
+			if !capability.Available {
+				missing = append(missing, name)
+			}
+		}
+		sort.Strings(missing)
+		log.WithComponent("capabilities").Infof("External tools changed, unavailable: %s", strings.Join(missing, ", "))
+		latitudeClient.SetCapabilities(current)
+	}
+	return nil
+}
+
+// currentCapabilities returns the external tools found by the last check
+func currentCapabilities() map[string]collectors.Capability {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	return capabilities
+}
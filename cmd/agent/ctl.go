@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// runCtl handles control commands for a running agent
+func runCtl(args []string) int {
+	if len(args) == 0 {
+		ctlUsage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ctl "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	duration := fs.Duration("for", time.Hour, "How long to pause firewall enforcement")
+	reason := fs.String("reason", "", "Reason for pausing, shown in logs and status")
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "pause":
+		if *duration <= 0 {
+			fmt.Fprintln(os.Stderr, "Pause duration must be positive")
+			return 1
+		}
+		pause := &state.Pause{
+			Until:  time.Now().Add(*duration),
+			Reason: *reason,
+			Source: "ctl",
+		}
+		if err := state.SavePause(cfg.Agent.StateDir, pause); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to pause agent: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Firewall enforcement paused until %s\n", pause.Until.Format(time.RFC3339))
+	case "resume":
+		if err := state.ClearPause(cfg.Agent.StateDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to resume agent: %v\n", err)
+			return 1
+		}
+		fmt.Println("Firewall enforcement resumed")
+	case "status":
+		pause, err := state.LoadPause(cfg.Agent.StateDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read pause state: %v\n", err)
+			return 1
+		}
+		if !pause.Active(time.Now()) {
+			fmt.Println("Firewall enforcement active")
+		} else {
+			fmt.Printf("Firewall enforcement paused until %s", pause.Until.Format(time.RFC3339))
+			if pause.Reason != "" {
+				fmt.Printf(" (%s)", pause.Reason)
+			}
+			fmt.Println()
+		}
+	default:
+		ctlUsage()
+		return 2
+	}
+
+	return 0
+}
+
+// ctlUsage prints usage for the ctl command
+func ctlUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lsh-agent ctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  pause -for <duration> [-reason <text>]  Suspend firewall enforcement")
+	fmt.Fprintln(os.Stderr, "  resume                                  Resume firewall enforcement")
+	fmt.Fprintln(os.Stderr, "  status                                  Show enforcement state")
+}
+
+// activePause returns the pause in effect for this cycle, if any. A pause can
+// be requested locally with "ctl pause" or by the API in the ping response.
+func activePause(cfg *config.Config, latitudeClient *client.LatitudeClient, rulesJSON string, log *logger.Logger) *state.Pause {
+	now := time.Now()
+
+	localPause, err := state.LoadPause(cfg.Agent.StateDir)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read pause state")
+	} else if localPause.Active(now) {
+		return localPause
+	} else if localPause != nil {
+		// Expired pause, clean it up so status reflects enforcement again
+		if err := state.ClearPause(cfg.Agent.StateDir); err != nil {
+			log.WithError(err).Warn("Failed to clear expired pause")
+		}
+	}
+
+	directives, err := latitudeClient.GetAgentDirectives(rulesJSON)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read agent directives")
+		return nil
+	}
+	if directives.Agent.PauseUntil != nil && now.Before(*directives.Agent.PauseUntil) {
+		return &state.Pause{
+			Until:  *directives.Agent.PauseUntil,
+			Reason: directives.Agent.PauseReason,
+			Source: "api",
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/logger"
+)
+
+// cycleSchedule runs a recurring task at fixed offsets from when it started,
+// so long runs do not push later runs back. Slots that pass while a run is
+// still going are skipped rather than run back to back once it ends.
+type cycleSchedule struct {
+	name     string
+	base     time.Time
+	interval time.Duration
+	slot     int64
+	// stretch, when set, returns how many slots to wait between runs, so
+	// the interval can be stretched while the API is under pressure
+	stretch func() int
+	log     *logger.Logger
+}
+
+// minCycleInterval replaces an interval that is not positive. Configuration
+// validation rejects those, so it only guards against a division by zero.
+const minCycleInterval = time.Second
+
+// newCycleSchedule starts a schedule whose first run is due now. The start
+// time carries a monotonic clock reading, so wall clock changes do not move
+// the schedule.
+func newCycleSchedule(name string, interval time.Duration, log *logger.Logger) *cycleSchedule {
+	if interval <= 0 {
+		log.WithComponent(name).Warnf("Invalid %s interval %s, running every %s", name, interval, minCycleInterval)
+		interval = minCycleInterval
+	}
+	return &cycleSchedule{name: name, base: time.Now(), interval: interval, log: log}
+}
+
+// next returns a channel that fires at the next slot after now, counting
+// the slots skipped since the previous run
+func (s *cycleSchedule) next() <-chan time.Time {
+	slot := int64(time.Since(s.base)/s.interval) + 1
+	if skipped := slot - s.slot - 1; skipped > 0 {
+		recordSkippedCycles(s.name, skipped)
+		s.log.WithComponent(s.name).Warnf("Skipped %d %s cycles while the previous one was still running", skipped, s.name)
+	}
+	if s.stretch != nil {
+		slot = max(slot, s.slot+int64(s.stretch()))
+	}
+	s.slot = slot
+	return time.After(time.Until(s.base.Add(time.Duration(slot) * s.interval)))
+}
+
+var (
+	skippedMu     sync.Mutex
+	skippedCycles = make(map[string]int64)
+)
+
+// recordSkippedCycles adds to the count of skipped cycles of a task
+func recordSkippedCycles(name string, n int64) {
+	skippedMu.Lock()
+	defer skippedMu.Unlock()
+	skippedCycles[name] += n
+}
+
+// skippedCycleCounts returns how many cycles of each task were skipped
+// since the agent started
+func skippedCycleCounts() map[string]int64 {
+	skippedMu.Lock()
+	defer skippedMu.Unlock()
+	counts := make(map[string]int64, len(skippedCycles))
+	for name, n := range skippedCycles {
+		counts[name] = n
+	}
+	return counts
+}
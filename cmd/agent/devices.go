@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+)
+
+// deviceSettleDelay batches the uevents of one hot-swap, e.g. a NIC with
+// several ports, into a single report
+const deviceSettleDelay = 2 * time.Second
+
+// watchDevices reports disks and network interfaces that appear or
+// disappear as soon as the kernel announces them, instead of waiting for
+// the next inventory
+func watchDevices(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	var (
+		mu      sync.Mutex
+		pending []collectors.DeviceEvent
+		timer   *time.Timer
+	)
+	err := collectors.WatchDevices(ctx, func(event collectors.DeviceEvent) {
+		log.WithComponent("devices").Debugf("Uevent: %s %s %s", event.Action, event.Type, event.Name)
+		mu.Lock()
+		defer mu.Unlock()
+		pending = append(pending, event)
+		if timer != nil {
+			timer.Reset(deviceSettleDelay)
+			return
+		}
+		timer = time.AfterFunc(deviceSettleDelay, func() {
+			mu.Lock()
+			events := pending
+			pending, timer = nil, nil
+			mu.Unlock()
+			if len(events) > 0 {
+				reportDevices(ctx, cfg, latitudeClient, events, log)
+			}
+		})
+	})
+	mu.Lock()
+	if timer != nil {
+		timer.Stop()
+	}
+	mu.Unlock()
+	if err != nil {
+		log.WithComponent("devices").WithError(err).Error("Stopped watching for device changes")
+	}
+}
+
+// reportDevices sends the device events along with the disks and network
+// interfaces now present, and notifies about removed devices
+func reportDevices(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, events []collectors.DeviceEvent, log *logger.Logger) {
+	report := &collectors.DeviceReport{Timestamp: time.Now(), Events: events}
+	inventory, err := collectors.GetInventory(cfg.Container.HostPath("/"))
+	if err != nil {
+		log.WithComponent("devices").WithError(err).Warn("Failed to read the inventory for the device report")
+	} else {
+		report.Disks, report.Interfaces = inventory.Disks, inventory.Interfaces
+	}
+
+	var removed []string
+	for _, event := range events {
+		log.WithComponent("devices").Infof("Device change: %s %s %s", event.Action, event.Type, event.Name)
+		if event.Action == "remove" {
+			removed = append(removed, event.Type+" "+event.Name)
+		}
+	}
+	if len(removed) > 0 {
+		notifier.Notify(notify.HealthChanged, "Devices disappeared: "+strings.Join(removed, ", "), map[string]string{
+			"removed": fmt.Sprint(len(removed)),
+		})
+	}
+
+	if err := deliverEvent(ctx, latitudeClient, eventInventory, cfg.Devices.Endpoint, eventKey(eventInventory, report.Timestamp), report); err != nil {
+		log.WithComponent("devices").WithError(err).Error("Failed to report device changes")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/latitudesh/agent/internal/timings"
+)
+
+const (
+	durationBaselineFile = "duration-baseline.json"
+	// durationCheckInterval is how often percentiles are compared with the
+	// baseline
+	durationCheckInterval = 5 * time.Minute
+	// minRegressionSamples is how many durations an operation needs within
+	// the window before its percentiles are trusted
+	minRegressionSamples = 20
+	// minRegressionMs ignores regressions too small to matter, such as a
+	// 2ms call taking 4ms
+	minRegressionMs = 50
+)
+
+// durationBaseline holds the percentiles of an agent version, which the
+// next version is compared with
+type durationBaseline struct {
+	Version   string                         `json:"version"`
+	UpdatedAt time.Time                      `json:"updated_at"`
+	Durations map[string]timings.Percentiles `json:"durations"`
+}
+
+// DurationRegression is an operation whose p95 grew after an agent update
+type DurationRegression struct {
+	Name            string    `json:"name"`
+	BaselineVersion string    `json:"baseline_version"`
+	BaselineP95     float64   `json:"baseline_p95_ms"`
+	P95             float64   `json:"p95_ms"`
+	DetectedAt      time.Time `json:"detected_at"`
+}
+
+// DurationReport is the duration percentiles served by the local API
+type DurationReport struct {
+	Window      string                         `json:"window"`
+	Durations   map[string]timings.Percentiles `json:"durations"`
+	Regressions []DurationRegression           `json:"regressions"`
+}
+
+var (
+	regressionsMu       sync.Mutex
+	durationRegressions = make(map[string]DurationRegression)
+)
+
+// runDurationCheck compares duration percentiles with those recorded by the
+// previous agent version and flags operations that got slower. Once this
+// version has run for a full window its percentiles become the baseline.
+func runDurationCheck(cfg *config.Config, started time.Time, log *logger.Logger) error {
+	var baseline durationBaseline
+	if err := state.Load(cfg.Agent.StateDir, durationBaselineFile, &baseline); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read duration baseline: %w", err)
+	}
+
+	current := make(map[string]timings.Percentiles)
+	for name, p := range timings.Summary() {
+		if p.Count >= minRegressionSamples {
+			current[name] = p
+		}
+	}
+
+	if baseline.Version != "" && baseline.Version != Version {
+		for name, p := range current {
+			before, ok := baseline.Durations[name]
+			if !ok || p.P95 < before.P95*cfg.Durations.RegressionFactor || p.P95-before.P95 < minRegressionMs {
+				continue
+			}
+			flagRegression(DurationRegression{
+				Name:            name,
+				BaselineVersion: baseline.Version,
+				BaselineP95:     before.P95,
+				P95:             p.P95,
+				DetectedAt:      time.Now(),
+			}, log)
+		}
+		// Percentiles from before a full window may be skewed by startup
+		window, _ := time.ParseDuration(cfg.Durations.Window)
+		if time.Since(started) < window {
+			return nil
+		}
+	}
+
+	if baseline.Version != Version || baseline.Durations == nil {
+		baseline = durationBaseline{Version: Version, Durations: make(map[string]timings.Percentiles)}
+	}
+	for name, p := range current {
+		baseline.Durations[name] = p
+	}
+	baseline.UpdatedAt = time.Now()
+	return state.Save(cfg.Agent.StateDir, durationBaselineFile, baseline)
+}
+
+// flagRegression records a regression, logging and notifying the first
+// time the operation regresses
+func flagRegression(regression DurationRegression, log *logger.Logger) {
+	regressionsMu.Lock()
+	_, known := durationRegressions[regression.Name]
+	durationRegressions[regression.Name] = regression
+	regressionsMu.Unlock()
+	if known {
+		return
+	}
+
+	message := fmt.Sprintf("%s p95 rose from %.0fms in %s to %.0fms in %s",
+		regression.Name, regression.BaselineP95, regression.BaselineVersion, regression.P95, Version)
+	log.WithComponent("durations").Warn("Duration regression after update: " + message)
+	notifier.Notify(notify.AgentUpdated, "Duration regression after update: "+message, map[string]string{
+		"operation":        regression.Name,
+		"baseline_version": regression.BaselineVersion,
+		"baseline_p95_ms":  fmt.Sprintf("%.0f", regression.BaselineP95),
+		"p95_ms":           fmt.Sprintf("%.0f", regression.P95),
+	})
+}
+
+// durationReport returns the current percentiles and the regressions
+// flagged since the agent started
+func durationReport() DurationReport {
+	report := DurationReport{
+		Window:      timings.Window().String(),
+		Durations:   timings.Summary(),
+		Regressions: []DurationRegression{},
+	}
+	regressionsMu.Lock()
+	for _, regression := range durationRegressions {
+		report.Regressions = append(report.Regressions, regression)
+	}
+	regressionsMu.Unlock()
+	sort.Slice(report.Regressions, func(i, j int) bool { return report.Regressions[i].Name < report.Regressions[j].Name })
+	return report
+}
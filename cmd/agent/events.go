@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/errkind"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/queue"
+)
+
+// Kinds of queued events
+const (
+	eventDrift        = "drift"
+	eventSecurity     = "security"
+	eventInventory    = "inventory"
+	eventActionResult = "action_result"
+)
+
+// eventQueue holds outbound events until the API accepts them. It is nil
+// when the queue is disabled, and events are sent once.
+var eventQueue *queue.Queue
+
+// eventsPending wakes the flush loop when an event is queued
+var eventsPending = make(chan struct{}, 1)
+
+// setupEventQueue opens the event journal and starts delivering queued
+// events, including those left from before a restart
+func setupEventQueue(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) error {
+	if !cfg.EventQueue.Enabled {
+		return nil
+	}
+	maxAge, _ := time.ParseDuration(cfg.EventQueue.MaxAge)
+	q, err := queue.Open(filepath.Join(cfg.Agent.StateDir, queue.FileName), cfg.EventQueue.MaxEvents, maxAge, log.Logger)
+	if err != nil {
+		return err
+	}
+	q.SetMaxAttempts(cfg.EventQueue.MaxAttempts)
+	if pending := q.Len(); pending > 0 {
+		log.WithComponent("events").Infof("Resuming delivery of %d queued events", pending)
+	}
+	eventQueue = q
+
+	interval, _ := time.ParseDuration(cfg.EventQueue.RetryInterval)
+	go runEventFlush(ctx, latitudeClient, interval, log)
+	return nil
+}
+
+// runEventFlush delivers queued events as they are queued, and retries
+// failed deliveries on every interval until the context is cancelled
+func runEventFlush(ctx context.Context, latitudeClient *client.LatitudeClient, interval time.Duration, log *logger.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer eventQueue.Close()
+
+	for {
+		delivered, err := eventQueue.Flush(ctx, func(ctx context.Context, event queue.Event) error {
+			return sendEvent(ctx, latitudeClient, event)
+		})
+		if delivered > 0 {
+			log.WithComponent("events").Debugf("Delivered %d queued events", delivered)
+		}
+		if err != nil {
+			log.WithComponent("events").WithError(err).Warnf("Failed to deliver queued events, %d pending", eventQueue.Len())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-eventsPending:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendEvent delivers a queued event. Errors other than network and
+// credential failures mean the API refused the event itself.
+func sendEvent(ctx context.Context, latitudeClient *client.LatitudeClient, event queue.Event) error {
+	var err error
+	if event.Kind == eventActionResult {
+		var result client.ActionResult
+		if err := json.Unmarshal(event.Payload, &result); err != nil {
+			return queue.Rejected(err)
+		}
+		err = latitudeClient.ReportActionResult(ctx, event.Endpoint, &result)
+	} else {
+		err = latitudeClient.SendEvent(ctx, event.Endpoint, event.Key, event.Payload)
+	}
+	if err != nil && errkind.Of(err) == errkind.Unknown && ctx.Err() == nil {
+		return queue.Rejected(err)
+	}
+	return err
+}
+
+// eventKey returns the deduplication key of an event of kind produced at t
+func eventKey(kind string, t time.Time) string {
+	return fmt.Sprintf("%s-%d", kind, t.UnixNano())
+}
+
+// deliverEvent sends a report to the API, through the event queue when it
+// is enabled. key deduplicates the event; with the queue, a nil error means
+// the event is journaled rather than delivered.
+func deliverEvent(ctx context.Context, latitudeClient *client.LatitudeClient, kind, endpoint, key string, report interface{}) error {
+	if eventQueue == nil {
+		return latitudeClient.SendReport(ctx, endpoint, report)
+	}
+	return queueEvent(kind, endpoint, key, report)
+}
+
+// queueEvent journals an event and wakes the flush loop
+func queueEvent(kind, endpoint, key string, payload interface{}) error {
+	if err := eventQueue.Enqueue(kind, endpoint, key, payload); err != nil {
+		return err
+	}
+	select {
+	case eventsPending <- struct{}{}:
+	default:
+	}
+	return nil
+}
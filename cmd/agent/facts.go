@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+)
+
+// ansibleGroup is the inventory group the host is placed in
+const ansibleGroup = "latitudesh"
+
+// Facts describes the host for configuration management tools
+type Facts struct {
+	AgentVersion string              `json:"agent_version"`
+	ServerID     string              `json:"server_id,omitempty"`
+	CollectedAt  time.Time           `json:"collected_at"`
+	OS           OSFacts             `json:"os"`
+	Hardware     HardwareFacts       `json:"hardware"`
+	Network      NetworkFacts        `json:"network"`
+	Firewall     *FirewallCompliance `json:"firewall"`
+}
+
+// OSFacts describes the operating system
+type OSFacts struct {
+	collectors.InventoryOS
+	Kernel       string `json:"kernel"`
+	Architecture string `json:"architecture"`
+}
+
+// HardwareFacts describes processors, memory and disks
+type HardwareFacts struct {
+	CPU           collectors.InventoryCPU    `json:"cpu"`
+	MemoryTotalKB uint64                     `json:"memory_total_kb"`
+	Disks         []collectors.InventoryDisk `json:"disks"`
+}
+
+// NetworkFacts describes the host's identity and interfaces
+type NetworkFacts struct {
+	Hostname   string                          `json:"hostname"`
+	PublicIP   string                          `json:"public_ip,omitempty"`
+	Interfaces []collectors.InventoryInterface `json:"interfaces"`
+}
+
+// runFacts prints host facts in a format consumable by Ansible
+func runFacts(args []string) int {
+	fs := flag.NewFlagSet("facts", flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	format := fs.String("format", "json", "Output format: json or ansible")
+	fs.Parse(args)
+
+	if *format != "json" && *format != "ansible" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q, expected json or ansible\n", *format)
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	// Log output would corrupt the JSON on stdout
+	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		return 1
+	}
+	log.SetOutput(io.Discard)
+
+	latitudeClient := newLatitudeClient(cfg, log.Logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	facts, err := collectFacts(ctx, cfg, latitudeClient, newFirewallCollector(cfg, log), log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to collect facts: %v\n", err)
+		return 1
+	}
+
+	var output interface{} = facts
+	if *format == "ansible" {
+		output = ansibleInventory(facts)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(output); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write facts: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// collectFacts gathers the inventory and firewall compliance of the host
+func collectFacts(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) (*Facts, error) {
+	inventory, err := collectors.GetInventory(cfg.Container.HostPath("/"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Facts{
+		AgentVersion: Version,
+		ServerID:     cfg.Latitude.ServerID,
+		CollectedAt:  time.Now(),
+		OS: OSFacts{
+			InventoryOS:  inventory.OS,
+			Kernel:       inventory.Kernel,
+			Architecture: inventory.Architecture,
+		},
+		Hardware: HardwareFacts{
+			CPU:           inventory.CPU,
+			MemoryTotalKB: inventory.MemoryTotalKB,
+			Disks:         inventory.Disks,
+		},
+		Network: NetworkFacts{
+			Hostname:   inventory.Hostname,
+			PublicIP:   cfg.Latitude.PublicIP,
+			Interfaces: inventory.Interfaces,
+		},
+		Firewall: checkFirewallCompliance(ctx, cfg, latitudeClient, firewallCollector, log),
+	}, nil
+}
+
+// ansibleInventory wraps facts in the dynamic inventory format returned by
+// `--list`. Host variables are included under _meta so Ansible does not call
+// the script once per host, and the same variables can be stored by fact
+// caching.
+func ansibleInventory(facts *Facts) map[string]interface{} {
+	host := facts.Network.Hostname
+	return map[string]interface{}{
+		ansibleGroup: map[string]interface{}{
+			"hosts": []string{host},
+		},
+		"_meta": map[string]interface{}{
+			"hostvars": map[string]interface{}{
+				host: map[string]interface{}{
+					"lsh_agent_version": facts.AgentVersion,
+					"lsh_os":            facts.OS,
+					"lsh_hardware":      facts.Hardware,
+					"lsh_network":       facts.Network,
+					"lsh_firewall":      facts.Firewall,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+)
+
+// runFirewall runs firewall subcommands
+func runFirewall(args []string) int {
+	if len(args) == 0 {
+		firewallUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "export":
+		return runFirewallExport(args[1:])
+	}
+	firewallUsage()
+	return 2
+}
+
+// firewallUsage prints usage for the firewall command
+func firewallUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lsh-agent firewall <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintf(os.Stderr, "  export [-format %s]  Print the managed rules in another format\n", strings.Join(collectors.ExportFormats, "|"))
+}
+
+// runFirewallExport prints the rules currently applied to UFW in another
+// firewall's format
+func runFirewallExport(args []string) int {
+	fs := flag.NewFlagSet("firewall export", flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	format := fs.String("format", "json", "Output format: "+strings.Join(collectors.ExportFormats, ", "))
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if !cfg.Firewall.Enabled {
+		fmt.Fprintln(os.Stderr, "Firewall synchronization is disabled")
+		return 1
+	}
+
+	// Log output would corrupt the exported rules on stdout
+	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		return 1
+	}
+	log.SetOutput(io.Discard)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rules, err := newFirewallCollector(cfg, log).GetCurrentRules(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	output, err := collectors.ExportRules(rules, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	fmt.Print(output)
+	return 0
+}
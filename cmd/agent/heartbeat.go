@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// heartbeat is the small liveness report sent between collection cycles.
+// It only says the agent is running and how its last cycle went, so the
+// platform can tell a server that is down from one whose health collection
+// is failing.
+type heartbeat struct {
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"started_at"`
+	Timestamp time.Time `json:"timestamp"`
+	// LastCycle is unset until the first collection cycle has finished
+	LastCycle *heartbeatCycle `json:"last_cycle,omitempty"`
+}
+
+// heartbeatCycle summarizes the last collection cycle
+type heartbeatCycle struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Success       bool      `json:"success"`
+	ErrorKind     string    `json:"error_kind,omitempty"`
+	NeedsOperator bool      `json:"needs_operator,omitempty"`
+}
+
+// runHeartbeat sends heartbeats until the context is cancelled. Unlike
+// runPeriodic it only logs when sending starts or stops failing, as it runs
+// far more often.
+func runHeartbeat(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	interval, _ := time.ParseDuration(cfg.Heartbeat.Interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	started := time.Now()
+	failing := false
+	for {
+		beat := &heartbeat{Version: Version, StartedAt: started, Timestamp: time.Now()}
+		if status, err := state.LoadStatus(cfg.Agent.StateDir); err == nil && status != nil {
+			beat.LastCycle = &heartbeatCycle{
+				Timestamp:     status.Timestamp,
+				Success:       status.Success,
+				ErrorKind:     status.ErrorKind,
+				NeedsOperator: status.NeedsOperator,
+			}
+		}
+
+		// A heartbeat that arrives after the next one is due is useless
+		sendCtx, cancel := context.WithTimeout(ctx, interval)
+		err := latitudeClient.SendReport(sendCtx, cfg.Heartbeat.Endpoint, beat)
+		cancel()
+		switch {
+		case err != nil && !failing:
+			log.WithComponent("heartbeat").WithError(err).Warn("Failed to send heartbeat")
+		case err == nil && failing:
+			log.WithComponent("heartbeat").Info("Heartbeats are being delivered again")
+		}
+		failing = err != nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/history"
+	"github.com/latitudesh/agent/internal/logger"
+)
+
+// historyMetrics are the metrics kept in the local history, in file order
+var historyMetrics = append([]string{"load1", "load5", "load15", "memory_used_percent", "uptime_seconds", "disk_used_percent"}, collectors.TCPMetrics...)
+
+// historyPath returns the location of the metrics ring file
+func historyPath(cfg *config.Config) string {
+	return filepath.Join(cfg.Agent.StateDir, history.FileName)
+}
+
+// startHistory samples host metrics into the local history
+func startHistory(ctx context.Context, cfg *config.Config, log *logger.Logger) {
+	interval, _ := time.ParseDuration(cfg.History.Interval)
+	retention, _ := time.ParseDuration(cfg.History.Retention)
+
+	if err := os.MkdirAll(cfg.Agent.StateDir, 0755); err != nil {
+		log.WithComponent("history").WithError(err).Error("Failed to create state directory")
+		return
+	}
+	store, err := history.Open(historyPath(cfg), historyMetrics, int(retention/interval))
+	if err != nil {
+		log.WithComponent("history").WithError(err).Error("Failed to open metrics history")
+		return
+	}
+	context.AfterFunc(ctx, func() { store.Close() })
+
+	hostRoot := cfg.Container.HostPath("/")
+	tcpMetrics := collectors.TCPSampler()
+	go runPeriodic(ctx, "history", interval, nil, log, func(ctx context.Context) error {
+		stats, err := collectors.GetSystemStats()
+		if err != nil {
+			return err
+		}
+		values := stats.Metrics()
+		if used, err := collectors.DiskUsedPercent(hostRoot); err == nil {
+			values["disk_used_percent"] = used
+		}
+		if tcp, err := tcpMetrics(); err == nil {
+			maps.Copy(values, tcp)
+		}
+		return store.Append(history.Sample{Time: time.Now(), Values: values})
+	})
+}
+
+// runMetrics prints samples from the local metrics history
+func runMetrics(args []string) int {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	since := fs.Duration("since", time.Hour, "Show samples from this long ago")
+	metrics := fs.String("metric", "", "Comma-separated metrics to show (default all)")
+	asJSON := fs.Bool("json", false, "Print samples as JSON")
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	names := historyMetrics
+	if *metrics != "" {
+		names = strings.Split(*metrics, ",")
+	}
+	samples, err := history.Query(historyPath(cfg), time.Now().Add(-*since), names)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, "No metrics history recorded; enable the history section of the configuration")
+		} else {
+			fmt.Fprintf(os.Stderr, "Failed to read metrics history: %v\n", err)
+		}
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(samples)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "TIME\t%s\t\n", strings.ToUpper(strings.Join(names, "\t")))
+	for _, sample := range samples {
+		fmt.Fprint(w, sample.Time.Format("2006-01-02 15:04:05"))
+		for _, name := range names {
+			if value, ok := sample.Values[name]; ok {
+				fmt.Fprintf(w, "\t%.2f", value)
+			} else {
+				fmt.Fprint(w, "\t-")
+			}
+		}
+		fmt.Fprintln(w, "\t")
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+const (
+	// instanceFile keeps the instance ID across restarts
+	instanceFile = "instance.json"
+	// attestationFile keeps the certificate the API issued for the
+	// attestation key
+	attestationFile = "attestation.json"
+	// attestationTimeout bounds creating the TPM key, quoting and sending
+	// the attestation
+	attestationTimeout = 2 * time.Minute
+)
+
+// instance identifies this installation of the agent across the fleet
+type instance struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Fingerprint is the hardware the ID was generated on; another
+	// fingerprint means the state directory was cloned to another host
+	Fingerprint string `json:"fingerprint"`
+}
+
+// setupInstance sends the instance ID with every API request, enrolling a
+// new one on first start and when the state directory was cloned from
+// other hardware
+func setupInstance(cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	fingerprint := collectors.HardwareFingerprint()
+
+	var current instance
+	err := state.Load(cfg.Agent.StateDir, instanceFile, &current)
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		log.WithComponent("agent").WithError(err).Warn("Failed to read instance ID, enrolling a new one")
+		current = enrollInstance(cfg, fingerprint, log)
+	case current.ID == "":
+		current = enrollInstance(cfg, fingerprint, log)
+	case current.Fingerprint != fingerprint:
+		log.WithComponent("agent").Warnf("Instance %s was created on other hardware, this host is a clone; enrolling a new instance", current.ID)
+		previous := current.ID
+		current = enrollInstance(cfg, fingerprint, log)
+		notifier.Notify(notify.Identity, "Agent re-enrolled after its state was cloned from another host", map[string]string{
+			"previous_instance_id": previous,
+			"instance_id":          current.ID,
+		})
+	}
+	latitudeClient.SetInstance(current.ID, current.Fingerprint)
+	attestInstance(cfg, latitudeClient, current, log)
+}
+
+// checkInstanceConflict re-enrolls when the API reports that another host
+// uses this instance ID and this host is the clone
+func checkInstanceConflict(cfg *config.Config, latitudeClient *client.LatitudeClient, rulesJSON string, log *logger.Logger) {
+	directives, err := latitudeClient.GetAgentDirectives(rulesJSON)
+	if err != nil || !directives.Agent.InstanceConflict {
+		return
+	}
+
+	var previous instance
+	state.Load(cfg.Agent.StateDir, instanceFile, &previous)
+	log.WithComponent("agent").Warnf("The API reports instance %s on another host, enrolling a new instance", previous.ID)
+	current := enrollInstance(cfg, collectors.HardwareFingerprint(), log)
+	latitudeClient.SetInstance(current.ID, current.Fingerprint)
+	attestInstance(cfg, latitudeClient, current, log)
+	notifier.Notify(notify.Identity, "Agent re-enrolled after the API detected a cloned instance ID", map[string]string{
+		"previous_instance_id": previous.ID,
+		"instance_id":          current.ID,
+	})
+}
+
+// enrollInstance generates and saves a new instance ID
+func enrollInstance(cfg *config.Config, fingerprint string, log *logger.Logger) instance {
+	current := instance{ID: newInstanceID(), CreatedAt: time.Now(), Fingerprint: fingerprint}
+	if err := state.Save(cfg.Agent.StateDir, instanceFile, &current); err != nil {
+		log.WithComponent("agent").WithError(err).Error("Failed to save instance ID, a new one is enrolled on restart")
+	} else {
+		log.WithComponent("agent").Infof("Enrolled instance %s", current.ID)
+	}
+	return current
+}
+
+// attestedInstance is an instance the API verified a TPM quote of
+type attestedInstance struct {
+	InstanceID string    `json:"instance_id"`
+	KeyID      string    `json:"key_id"`
+	AttestedAt time.Time `json:"attested_at"`
+	// Certificate is the PEM certificate the API issued for the
+	// attestation key and instance
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// attestationResponse is the API's verdict on an attestation. Before it
+// verifies the key, the API challenges the instance with Credential, the
+// base64 output of tpm2_makecredential for the EK and the AK's name.
+type attestationResponse struct {
+	Verified    bool   `json:"verified"`
+	Reason      string `json:"reason,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+	Credential  string `json:"credential,omitempty"`
+}
+
+// activationRequest answers the API's credential challenge with the secret
+// the TPM decrypted
+type activationRequest struct {
+	InstanceID string `json:"instance_id"`
+	KeyID      string `json:"key_id"`
+	Secret     string `json:"secret"`
+}
+
+// attestInstance registers the instance with a quote from a TPM-resident
+// key, then activates the credential the API encrypts to the TPM's
+// endorsement key, which proves the key is resident in that TPM. Requests
+// are then signed with the key, so the API can tie the instance's reports
+// to the machine. Without a TPM, or when attestation fails, the agent runs
+// unattested.
+func attestInstance(cfg *config.Config, latitudeClient *client.LatitudeClient, current instance, log *logger.Logger) {
+	latitudeClient.SetSigner(nil)
+	if !cfg.Attestation.Enabled {
+		return
+	}
+	if !collectors.TPMPresent() {
+		log.WithComponent("attestation").Info("No TPM 2.0 found, the instance is not attested")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), attestationTimeout)
+	defer cancel()
+	collector := collectors.NewAttestationCollector(cfg.Container.HostPath("/"), cfg.Attestation.KeyHandle, cfg.Attestation.PCRs, log.Logger)
+	collector.SetCommandWrapper(privilegeWrapper(cfg)...)
+	attestation, err := collector.Attest(ctx, current.ID, current.Fingerprint)
+	if err != nil {
+		log.WithComponent("attestation").WithError(err).Warn("Failed to quote with the TPM, the instance is not attested")
+		return
+	}
+
+	var response attestationResponse
+	if err := latitudeClient.ExchangeReport(ctx, cfg.Attestation.Endpoint, attestation, &response); err != nil {
+		log.WithComponent("attestation").WithError(err).Warn("Failed to send the attestation, the instance is not attested")
+		return
+	}
+	if response.Credential != "" {
+		response, err = activateCredential(ctx, cfg, latitudeClient, collector, attestation, response.Credential)
+		if err != nil {
+			log.WithComponent("attestation").WithError(err).Warn("Failed to activate the attestation credential, the instance is not attested")
+			return
+		}
+	}
+	if !response.Verified {
+		log.WithComponent("attestation").Errorf("The API rejected the attestation of instance %s: %s", current.ID, response.Reason)
+		notifier.Notify(notify.Identity, "The API rejected the TPM attestation of the agent", map[string]string{
+			"instance_id": current.ID,
+			"key_id":      attestation.KeyID,
+			"reason":      response.Reason,
+		})
+		return
+	}
+
+	latitudeClient.SetSigner(collector)
+	attested := attestedInstance{
+		InstanceID:  current.ID,
+		KeyID:       attestation.KeyID,
+		AttestedAt:  attestation.Timestamp,
+		Certificate: response.Certificate,
+	}
+	if err := state.Save(cfg.Agent.StateDir, attestationFile, &attested); err != nil {
+		log.WithComponent("attestation").WithError(err).Warn("Failed to save the attestation certificate")
+	}
+	log.WithComponent("attestation").Infof("Instance %s attested with TPM key %s", current.ID, attestation.KeyID)
+}
+
+// activateCredential decrypts the API's credential challenge with the TPM
+// and sends back the secret, returning the API's verdict
+func activateCredential(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, collector *collectors.AttestationCollector, attestation *collectors.Attestation, credential string) (attestationResponse, error) {
+	var response attestationResponse
+	data, err := base64.StdEncoding.DecodeString(credential)
+	if err != nil {
+		return response, fmt.Errorf("invalid credential: %w", err)
+	}
+	secret, err := collector.Activate(ctx, data)
+	if err != nil {
+		return response, err
+	}
+	activation := activationRequest{
+		InstanceID: attestation.InstanceID,
+		KeyID:      attestation.KeyID,
+		Secret:     base64.StdEncoding.EncodeToString(secret),
+	}
+	if err := latitudeClient.ExchangeReport(ctx, strings.TrimSuffix(cfg.Attestation.Endpoint, "/")+"/activate", activation, &response); err != nil {
+		return response, fmt.Errorf("failed to send the activated credential: %w", err)
+	}
+	return response, nil
+}
+
+// newInstanceID returns a random version 4 UUID
+func newInstanceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/history"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// complianceCacheTTL bounds how often local API requests query the API and
+// UFW for firewall compliance
+const complianceCacheTTL = 30 * time.Second
+
+// HealthSnapshot is the host health served by the local API
+type HealthSnapshot struct {
+	AgentVersion    string             `json:"agent_version"`
+	Timestamp       time.Time          `json:"timestamp"`
+	Metrics         map[string]float64 `json:"metrics"`
+	DiskUsedPercent float64            `json:"disk_used_percent"`
+	LastSync        *state.Status      `json:"last_sync,omitempty"`
+	// SkippedCycles counts runs skipped because the previous one was still
+	// going, by task
+	SkippedCycles map[string]int64 `json:"skipped_cycles"`
+	// Maintenance describes the planned maintenance window in effect, during
+	// which health alerts are suppressed
+	Maintenance string `json:"maintenance,omitempty"`
+	// Firewall tells whether the host is compliant with its firewall, so
+	// one payload answers both whether it is healthy and compliant
+	Firewall FirewallHealth `json:"firewall"`
+	// Capabilities tells which external tools are available, explaining
+	// metrics that are missing on this server
+	Capabilities map[string]collectors.Capability `json:"capabilities,omitempty"`
+	// ScopeMismatches lists the subsystems disabled because the API token
+	// lacks their scope, with the scope
+	ScopeMismatches map[string]string `json:"scope_mismatches,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// Firewall health states
+const (
+	FirewallInSync   = "in_sync"
+	FirewallDrifted  = "drifted"
+	FirewallFailing  = "failing"
+	FirewallDisabled = "disabled"
+)
+
+// FirewallHealth is the firewall component of the health snapshot
+type FirewallHealth struct {
+	State string `json:"state"`
+	// LastSynced is when UFW last matched the API after a synchronization
+	LastSynced  *time.Time `json:"last_synced,omitempty"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// FirewallCompliance reports whether UFW matches the firewall in the API
+type FirewallCompliance struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// Enforced is false when firewall synchronization is disabled, paused or
+	// in readonly mode
+	Enforced    bool       `json:"enforced"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+	// InSync is unset when the comparison could not be made
+	InSync          *bool    `json:"in_sync,omitempty"`
+	MissingRules    []string `json:"missing_rules"`
+	UnexpectedRules []string `json:"unexpected_rules"`
+	// PolicyDrift lists the default policy and logging settings that
+	// differ from the API's
+	PolicyDrift []string `json:"policy_drift,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// checkFirewallCompliance compares UFW with the rules currently in the API
+func checkFirewallCompliance(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) *FirewallCompliance {
+	compliance := &FirewallCompliance{
+		CheckedAt:       time.Now(),
+		Enforced:        firewallCollector != nil && !firewallCollector.ReadOnly(),
+		MissingRules:    []string{},
+		UnexpectedRules: []string{},
+	}
+	if firewallCollector == nil {
+		return compliance
+	}
+
+	rulesJSON, err := fetchFirewallRules(ctx, cfg, latitudeClient, log)
+	if err != nil {
+		compliance.Error = err.Error()
+		return compliance
+	}
+	if pause := activePause(cfg, latitudeClient, rulesJSON, log); pause != nil {
+		compliance.Enforced = false
+		compliance.PausedUntil = &pause.Until
+	}
+
+	toAdd, toRemove, err := firewallCollector.DiffFirewallRules(ctx, rulesJSON)
+	if err != nil {
+		compliance.Error = err.Error()
+		return compliance
+	}
+	for _, rule := range toAdd {
+		compliance.MissingRules = append(compliance.MissingRules, rule.String())
+	}
+	for _, rule := range toRemove {
+		compliance.UnexpectedRules = append(compliance.UnexpectedRules, rule.String())
+	}
+	policyChanges, err := firewallCollector.DiffFirewallPolicy(ctx, rulesJSON)
+	if err != nil {
+		compliance.Error = err.Error()
+		return compliance
+	}
+	for _, change := range policyChanges {
+		compliance.PolicyDrift = append(compliance.PolicyDrift, change.String())
+	}
+	inSync := len(toAdd) == 0 && len(toRemove) == 0 && len(policyChanges) == 0
+	compliance.InSync = &inSync
+	return compliance
+}
+
+// localAPI serves read-only agent data as JSON to tooling on the host
+type localAPI struct {
+	cfg               *config.Config
+	latitudeClient    *client.LatitudeClient
+	firewallCollector *collectors.FirewallCollector
+	log               *logger.Logger
+
+	mu         sync.Mutex
+	compliance *FirewallCompliance
+}
+
+// runLocalAPI serves the local API until the context is cancelled
+func runLocalAPI(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) {
+	api := &localAPI{cfg: cfg, latitudeClient: latitudeClient, firewallCollector: firewallCollector, log: log}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/health", api.handleHealth)
+	mux.HandleFunc("GET /v1/firewall", api.handleFirewall)
+	mux.HandleFunc("GET /v1/inventory", api.handleInventory)
+	mux.HandleFunc("GET /v1/metrics", api.handleMetrics)
+	mux.HandleFunc("GET /v1/metrics/durations", api.handleDurations)
+	if cfg.LocalAPI.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		log.WithComponent("localapi").Info("Serving profiling handlers under /debug/pprof/")
+	}
+
+	server := &http.Server{
+		Addr:              cfg.LocalAPI.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.WithComponent("localapi").Infof("Serving local API on %s", cfg.LocalAPI.Listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.WithComponent("localapi").WithError(err).Error("Local API stopped")
+	}
+}
+
+func (a *localAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
+	snapshot := HealthSnapshot{AgentVersion: Version, Timestamp: time.Now(), SkippedCycles: skippedCycleCounts()}
+	if stats, err := collectors.GetSystemStats(); err != nil {
+		snapshot.Error = err.Error()
+	} else {
+		snapshot.Metrics = stats.Metrics()
+	}
+	if used, err := collectors.DiskUsedPercent(a.cfg.Container.HostPath("/")); err == nil {
+		snapshot.DiskUsedPercent = used
+	}
+	status, err := state.LoadStatus(a.cfg.Agent.StateDir)
+	if err == nil {
+		snapshot.LastSync = status
+	}
+	snapshot.Firewall = a.firewallHealth(status)
+	snapshot.Capabilities = currentCapabilities()
+	snapshot.ScopeMismatches = currentScopeMismatches()
+	snapshot.Maintenance, _ = maintenanceTracker.Active(time.Now())
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// firewallHealth derives the firewall state from the last collection cycle
+// and, when it is more recent, the last compliance check served by
+// /v1/firewall. It never calls the API, so health checks stay cheap.
+func (a *localAPI) firewallHealth(status *state.Status) FirewallHealth {
+	health := FirewallHealth{State: FirewallDisabled}
+	if a.firewallCollector == nil {
+		return health
+	}
+	if status == nil {
+		health.State = FirewallFailing
+		health.Error = "no collection cycle has completed yet"
+		return health
+	}
+
+	health.LastSynced = status.LastSynced
+	switch {
+	case status.PausedUntil != nil && time.Now().Before(*status.PausedUntil):
+		health.PausedUntil = status.PausedUntil
+	case !status.Success:
+		health.State = FirewallFailing
+		health.Error = status.Error
+	case status.Sync != nil && len(status.Sync.Failed) > 0:
+		health.State = FirewallFailing
+		health.Error = fmt.Sprintf("%d rules failed to apply", len(status.Sync.Failed))
+	case status.Drift != nil && len(status.Drift.Missing)+len(status.Drift.Unexpected)+len(status.Drift.Policy) > 0:
+		health.State = FirewallDrifted
+	default:
+		health.State = FirewallInSync
+	}
+
+	a.mu.Lock()
+	compliance := a.compliance
+	a.mu.Unlock()
+	if health.State == FirewallInSync && compliance != nil && compliance.CheckedAt.After(status.Timestamp) &&
+		compliance.InSync != nil && !*compliance.InSync {
+		health.State = FirewallDrifted
+	}
+	return health
+}
+
+func (a *localAPI) handleFirewall(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.compliance == nil || time.Since(a.compliance.CheckedAt) > complianceCacheTTL {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		a.compliance = checkFirewallCompliance(ctx, a.cfg, a.latitudeClient, a.firewallCollector, a.log)
+	}
+	writeJSON(w, http.StatusOK, a.compliance)
+}
+
+func (a *localAPI) handleInventory(w http.ResponseWriter, r *http.Request) {
+	inventory, err := collectors.GetInventory(a.cfg.Container.HostPath("/"))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, inventory)
+}
+
+// handleMetrics serves the local metrics history. The since parameter is a
+// duration, one hour by default; metric is a comma-separated list.
+func (a *localAPI) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	since := time.Hour
+	if value := r.URL.Query().Get("since"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid since: " + err.Error()})
+			return
+		}
+		since = d
+	}
+	var names []string
+	if value := r.URL.Query().Get("metric"); value != "" {
+		names = strings.Split(value, ",")
+	}
+
+	samples, err := history.Query(historyPath(a.cfg), time.Now().Add(-since), names)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "metrics history is not enabled"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
+
+// handleDurations serves the p50, p95 and p99 durations of API calls, UFW
+// commands, collectors and collection cycles, and regressions flagged since
+// the last update
+func (a *localAPI) handleDurations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, durationReport())
+}
+
+// writeJSON writes an indented JSON response
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
@@ -2,27 +2,61 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/latitudesh/agent/internal/client"
 	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/command"
 	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/container"
+	"github.com/latitudesh/agent/internal/errkind"
 	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/relay"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/latitudesh/agent/internal/timings"
+	"github.com/sirupsen/logrus"
 )
 
 const Version = "1.0.0"
 
 func main() {
+	// Dispatch subcommands before parsing daemon flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "top":
+			os.Exit(runTop(os.Args[2:]))
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "benchmark", "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "facts":
+			os.Exit(runFacts(os.Args[2:]))
+		case "metrics":
+			os.Exit(runMetrics(os.Args[2:]))
+		case "sync":
+			os.Exit(runSync(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelfTestCommand(os.Args[2:]))
+		case "firewall":
+			os.Exit(runFirewall(os.Args[2:]))
+		}
+	}
+
 	// Parse command line flags
 	var (
-		configPath = flag.String("config", config.DefaultConfigPath(), "Path to configuration file")
-		version    = flag.Bool("version", false, "Show version and exit")
+		configPath  = flag.String("config", config.DefaultConfigPath(), "Path to configuration file")
+		version     = flag.Bool("version", false, "Show version and exit")
 		checkConfig = flag.Bool("check-config", false, "Check configuration and exit")
+		record      = flag.String("record", "", "Record API requests and responses to this file")
+		replay      = flag.String("replay", "", "Answer API requests from a recording instead of the API")
 	)
 	flag.Parse()
 
@@ -35,7 +69,7 @@ func main() {
 	cfg, err := config.LoadConfig(*configPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
-		os.Exit(1)
+		os.Exit(errkind.ExitCode(err))
 	}
 
 	if *checkConfig {
@@ -43,6 +77,14 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Ensure only one instance manages the firewall at a time
+	lock, err := state.AcquireLock(cfg.Agent.StateDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start agent: %v\n", err)
+		os.Exit(1)
+	}
+	defer lock.Release()
+
 	// Initialize logger
 	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format)
 	if err != nil {
@@ -52,6 +94,15 @@ func main() {
 
 	log.LogAgentStart(Version, *configPath)
 
+	commandTimeout, _ := time.ParseDuration(cfg.Agent.CommandTimeout)
+	command.Configure(cfg.Agent.MaxCommands, commandTimeout)
+	command.Observe(log.Logger, cfg.Agent.ExecAuditLog)
+	pinTools(cfg, log)
+	simulateHost(cfg, log)
+	if cfg.Faults.Enabled {
+		log.WithComponent("agent").Warn("Fault injection is enabled: API requests and UFW commands will fail or slow down on purpose")
+	}
+
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -60,24 +111,104 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Set up webhook notifications
+	setupNotifier(cfg, log)
+
 	// Initialize Latitude.sh API client
-	latitudeClient := client.NewLatitudeClient(
-		cfg.Latitude.BearerToken,
-		cfg.Latitude.APIEndpoint,
-		cfg.Latitude.ProjectID,
-		cfg.Latitude.FirewallID,
-		cfg.Latitude.PublicIP,
-		log.Logger,
-	)
+	latitudeClient := newLatitudeClient(cfg, log.Logger)
+	if err := setupRecording(latitudeClient, *record, *replay, log); err != nil {
+		log.WithError(err).Fatal("Failed to set up API recording")
+	}
+	setupInstance(cfg, latitudeClient, log)
+
+	// Deliver drift, security, inventory and action result events through
+	// the persistent queue
+	if err := setupEventQueue(ctx, cfg, latitudeClient, log); err != nil {
+		log.WithError(err).Fatal("Failed to open the event queue")
+	}
+
+	// Disable subsystems the API token is not allowed to use
+	checkTokenScopes(cfg, latitudeClient, log)
+
+	// Validate container privileges before touching the host firewall
+	if cfg.Container.Active() {
+		log.Infof("Running in container mode with host root %s", cfg.Container.HostRoot)
+		warnings, err := container.Validate(cfg.Container.HostRoot)
+		for _, warning := range warnings {
+			log.WithComponent("container").Warn(warning)
+		}
+		if err != nil {
+			log.WithComponent("container").Fatal(err)
+		}
+	}
 
 	// Initialize firewall collector
-	var firewallCollector *collectors.FirewallCollector
-	if cfg.Firewall.Enabled {
-		firewallCollector = collectors.NewFirewallCollector(
-			cfg.Firewall.UFWBinary,
-			cfg.Firewall.CaseSensitive,
-			log.Logger,
-		)
+	firewallCollector := newFirewallCollector(cfg, log)
+	setupTenants(cfg, firewallCollector, log)
+
+	// Start polling for remote actions if enabled
+	if cfg.Actions.Enabled {
+		runner, err := newActionsRunner(cfg, latitudeClient, firewallCollector, log)
+		if err != nil {
+			log.Fatalf("Failed to initialize remote actions: %v", err)
+		}
+		go runner.Run(ctx)
+	}
+
+	// Revoke temporary rules on schedule, independently of API connectivity
+	if firewallCollector != nil && !firewallCollector.ReadOnly() {
+		go runRuleExpiry(ctx, firewallCollector, log)
+	}
+
+	// Apply scheduled rulesets on time, independently of collection cycles
+	if firewallCollector != nil && cfg.Rulesets.Enabled {
+		go runScheduledRulesets(ctx, cfg, latitudeClient, firewallCollector, log)
+	}
+
+	// Resynchronize right away when UFW is edited by hand
+	resync := make(chan struct{}, 1)
+	if firewallCollector != nil && cfg.Firewall.Watch {
+		if cfg.Firewall.Backend == "ufw" {
+			go watchUFW(ctx, cfg, resync, log)
+		} else {
+			log.WithComponent("firewall").Warnf("firewall.watch is not supported by the %s backend, rules edited by hand are restored at the next interval", cfg.Firewall.Backend)
+		}
+	}
+
+	// Report liveness separately from the heavier collection cycles
+	if cfg.Heartbeat.Enabled {
+		go runHeartbeat(ctx, cfg, latitudeClient, log)
+	}
+
+	// Start optional background subsystems
+	startSubsystems(ctx, cfg, latitudeClient, log)
+
+	// Relay API traffic for agents without internet access
+	if cfg.Relay.Enabled {
+		relayServer, err := relay.NewServer(cfg.Relay.Listen, cfg.Relay.AllowedSources, cfg.Relay.AllowedHosts, log.Logger)
+		if err != nil {
+			log.Fatalf("Failed to initialize relay: %v", err)
+		}
+		go func() {
+			if err := relayServer.Run(ctx); err != nil {
+				log.WithComponent("relay").WithError(err).Error("Relay stopped")
+			}
+		}()
+	}
+
+	// Compare the server with its API record
+	if cfg.Reconcile.Enabled {
+		startReconcile(ctx, cfg, latitudeClient, firewallCollector, log)
+	}
+
+	// Apply workload profiles assigned in the API
+	if cfg.Profiles.Enabled {
+		startProfiles(ctx, cfg, latitudeClient, firewallCollector, log)
+	}
+
+	// Serve agent data to local tooling
+	if cfg.LocalAPI.Enabled {
+		go runLocalAPI(ctx, cfg, latitudeClient, firewallCollector, log)
 	}
 
 	// Perform initial health check
@@ -94,16 +225,41 @@ func main() {
 
 	log.Infof("Starting agent with %s interval", interval)
 
-	// Main execution loop
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	// Main execution loop. cycleMu keeps its syncs from overlapping with
+	// those of remote actions and other subsystems. While the API answers
+	// with 429, 5xx or slowly, cycles are spaced further apart.
+	schedule := newCycleSchedule("agent", interval, log)
+	schedule.stretch = latitudeClient.IntervalFactor
 
-	// Run immediately on startup
-	if err := runCollection(ctx, latitudeClient, firewallCollector, cfg, log); err != nil {
-		log.WithError(err).Error("Initial collection failed")
+	// Track consecutive failures for the configured failure policy
+	consecutiveFailures := 0
+	handleResult := func(err error, message string) {
+		if err == nil {
+			consecutiveFailures = 0
+			return
+		}
+		// Reverted rules wait for the API to change them, which neither
+		// retrying nor exiting speeds up, so they are not counted
+		if errors.Is(err, collectors.ErrCanaryReverted) {
+			log.WithError(err).Warn(message)
+			return
+		}
+		consecutiveFailures++
+		log.WithError(err).WithField("consecutive_failures", consecutiveFailures).Error(message)
+
+		if cfg.Agent.FailurePolicy == "exit" && consecutiveFailures >= cfg.Agent.MaxConsecutiveFailures {
+			log.LogAgentStop(fmt.Sprintf("%d consecutive failed cycles", consecutiveFailures))
+			lock.Release()
+			os.Exit(errkind.ExitCode(err))
+		}
 	}
 
-	// Main loop
+	// Run immediately on startup
+	handleResult(runCollection(ctx, latitudeClient, firewallCollector, cfg, log), "Initial collection failed")
+
+	// Main loop. The next full sync is scheduled once per cycle, so resyncs
+	// in between do not push it back.
+	due := schedule.next()
 	for {
 		select {
 		case <-ctx.Done():
@@ -113,22 +269,291 @@ func main() {
 			log.LogAgentStop(fmt.Sprintf("received signal: %s", sig))
 			cancel()
 			return
+		case <-due:
+			handleResult(runCollection(ctx, latitudeClient, firewallCollector, cfg, log), "Collection cycle failed")
+			due = schedule.next()
+		case <-resync:
+			handleResult(runCollection(ctx, latitudeClient, firewallCollector, cfg, log), "Collection cycle failed")
+		}
+	}
+}
+
+// pinTools pins the external tools to their configured paths and logs the
+// version of each, warning about tools that are missing or refused
+func pinTools(cfg *config.Config, log *logger.Logger) {
+	tools := make(map[string]string, len(cfg.Agent.Tools)+3)
+	for name, path := range cfg.Agent.Tools {
+		tools[name] = path
+	}
+	if cfg.Firewall.Enabled {
+		switch cfg.Firewall.Backend {
+		case "nftables":
+			tools["nft"] = cfg.Firewall.NftBinary
+		case "iptables":
+			tools["iptables"] = cfg.Firewall.IptablesBinary
+			tools["ip6tables"] = cfg.Firewall.Ip6tablesBinary
+		default:
+			tools["ufw"] = cfg.Firewall.UFWBinary
+		}
+	}
+	if cfg.WireGuard.Enabled {
+		tools["wg"] = cfg.WireGuard.WGBinary
+	}
+	if cfg.BMC.Enabled {
+		tools["ipmitool"] = cfg.BMC.IPMIToolBinary
+	}
+	command.Pin(tools, cfg.Agent.ExecAllowlist)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, tool := range command.CheckTools(ctx, cfg.Container.HostPath("/")) {
+		entry := log.WithComponent("agent").WithField("tool", tool.Name).WithField("path", tool.Path)
+		switch {
+		case os.IsNotExist(tool.Err):
+			entry.Warn("External tool not found")
+		case tool.Err != nil:
+			entry.WithError(tool.Err).Error("External tool refused")
+		default:
+			entry.WithField("version", tool.Version).Info("External tool pinned")
+		}
+	}
+}
+
+// simulateHost switches host health data to simulated values with the mock
+// backend. The firewall collector simulates UFW on its own.
+func simulateHost(cfg *config.Config, log *logger.Logger) {
+	if cfg.Agent.Backend != "mock" {
+		return
+	}
+	log.WithComponent("agent").Warn("Using the mock backend: UFW and host health data are simulated")
+	collectors.SimulateHost()
+}
+
+// privilegeWrapper returns the command privileged commands run behind:
+// chroot into the host root in container mode, so the host's tools run
+// against the host's configuration, sudo unless the agent already runs as
+// root or sudo is disabled, or nothing
+func privilegeWrapper(cfg *config.Config) []string {
+	if cfg.Container.Active() {
+		return []string{"chroot", cfg.Container.HostRoot}
+	}
+	switch cfg.Agent.Sudo {
+	case "never":
+		return nil
+	case "auto":
+		if os.Geteuid() == 0 {
+			return nil
+		}
+	}
+	return append([]string{cfg.Agent.SudoPath}, cfg.Agent.SudoArgs...)
+}
+
+// newLatitudeClient creates the API client, connecting through the relay
+// when one is configured
+func newLatitudeClient(cfg *config.Config, logger *logrus.Logger) *client.LatitudeClient {
+	latitudeClient := client.NewLatitudeClient(
+		cfg.Latitude.BearerToken,
+		cfg.Latitude.APIEndpoint,
+		cfg.Latitude.ProjectID,
+		cfg.Latitude.FirewallID,
+		cfg.Latitude.PublicIP,
+		logger,
+	)
+	if cfg.Latitude.RelayURL != "" {
+		// Validated when the configuration is loaded
+		latitudeClient.SetRelay(cfg.Latitude.RelayURL)
+	}
+	if cfg.Faults.Enabled {
+		latitudeClient.InjectFaults(cfg.Faults.APIDropPercent)
+	}
+	return latitudeClient
+}
+
+// setupRecording records the client's API interactions to record, or
+// replays them from replay, when either is set
+func setupRecording(latitudeClient *client.LatitudeClient, record, replay string, log *logger.Logger) error {
+	switch {
+	case record != "" && replay != "":
+		return fmt.Errorf("-record and -replay are mutually exclusive")
+	case record != "":
+		log.WithComponent("agent").Warnf("Recording API interactions to %s", record)
+		return latitudeClient.Record(record)
+	case replay != "":
+		log.WithComponent("agent").Warnf("Replaying API interactions from %s, the API is not contacted", replay)
+		return latitudeClient.Replay(replay)
+	}
+	return nil
+}
+
+// newFirewallCollector creates the firewall collector, or returns nil if
+// firewall synchronization is disabled
+func newFirewallCollector(cfg *config.Config, log *logger.Logger) *collectors.FirewallCollector {
+	if !cfg.Firewall.Enabled {
+		return nil
+	}
+
+	firewallCollector := collectors.NewFirewallCollector(
+		cfg.Firewall.UFWBinary,
+		cfg.Firewall.CaseSensitive,
+		log.Logger,
+	)
+
+	firewallCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+	if cfg.Agent.Backend == "mock" {
+		firewallCollector.SetMock(collectors.NewMockUFW())
+	} else if cfg.Firewall.Backend == "nftables" {
+		backend := collectors.NewNftablesBackend(cfg.Firewall.NftBinary, cfg.Firewall.NftTable, log.Logger)
+		backend.SetCommandWrapper(privilegeWrapper(cfg)...)
+		firewallCollector.SetBackend(backend)
+	} else if cfg.Firewall.Backend == "iptables" {
+		// Hosts without IPv6 support may lack ip6tables; IPv6 rules then
+		// fail to apply instead of the whole backend
+		ip6tables := cfg.Firewall.Ip6tablesBinary
+		if _, err := os.Stat(cfg.Container.HostPath(ip6tables)); err != nil {
+			log.WithComponent("firewall").Warnf("ip6tables not found at %s, IPv6 rules will not be applied", ip6tables)
+			ip6tables = ""
+		}
+		backend := collectors.NewIptablesBackend(cfg.Firewall.IptablesBinary, ip6tables, cfg.Firewall.IptablesChain, log.Logger)
+		backend.SetCommandWrapper(privilegeWrapper(cfg)...)
+		firewallCollector.SetBackend(backend)
+	}
+	if cfg.Faults.Enabled {
+		delay, _ := time.ParseDuration(cfg.Faults.UFWDelay)
+		firewallCollector.SetFaults(collectors.Faults{UFWDelay: delay, CorruptRule: cfg.Faults.CorruptRule})
+	}
+	firewallCollector.SetStateDir(cfg.Agent.StateDir)
+	firewallCollector.SetReadOnly(cfg.Firewall.Mode == "readonly")
+	firewallCollector.SetFacts(func() collectors.RuleFacts { return ruleFacts(cfg, log) })
+
+	return firewallCollector
+}
+
+// ruleExpiryInterval is how often temporary firewall rules are checked for
+// expiration
+const ruleExpiryInterval = 15 * time.Second
+
+// runRuleExpiry removes expired temporary rules until the context is cancelled.
+// Unlike runPeriodic it only logs failures, as it runs far more often.
+func runRuleExpiry(ctx context.Context, firewallCollector *collectors.FirewallCollector, log *logger.Logger) {
+	ticker := time.NewTicker(ruleExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			if err := runCollection(ctx, latitudeClient, firewallCollector, cfg, log); err != nil {
-				log.WithError(err).Error("Collection cycle failed")
-				// Continue running despite errors
+		}
+
+		cycleMu.Lock()
+		err := firewallCollector.ExpireRules(ctx)
+		for _, t := range tenants {
+			if tenantErr := t.collector.ExpireRules(ctx); tenantErr != nil {
+				log.WithComponent("firewall").WithField("firewall_id", t.firewallID).WithError(tenantErr).Error("Failed to expire temporary rules")
 			}
 		}
+		cycleMu.Unlock()
+		if err != nil {
+			log.WithComponent("firewall").WithError(err).Error("Failed to expire temporary rules")
+		}
+	}
+}
+
+// ufwSettleDelay is how long UFW's rules files must stay unchanged before a
+// manual edit triggers a resync, so a burst of edits causes a single one
+const ufwSettleDelay = 2 * time.Second
+
+// watchUFW requests a resync when UFW's rules files change outside the
+// agent. Changes seen while a cycle holds cycleMu are the agent's own and
+// are ignored.
+func watchUFW(ctx context.Context, cfg *config.Config, resync chan<- struct{}, log *logger.Logger) {
+	var timer *time.Timer
+	err := collectors.WatchUFWRules(ctx, cfg.Container.HostPath("/etc/ufw"), func(name string) {
+		if !cycleMu.TryLock() {
+			return
+		}
+		cycleMu.Unlock()
+
+		log.WithComponent("firewall").Debugf("UFW %s changed outside the agent", name)
+		if timer != nil {
+			timer.Reset(ufwSettleDelay)
+			return
+		}
+		timer = time.AfterFunc(ufwSettleDelay, func() {
+			log.WithComponent("firewall").Info("UFW rules were changed outside the agent, resynchronizing")
+			select {
+			case resync <- struct{}{}:
+			default:
+			}
+		})
+	})
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		log.WithComponent("firewall").WithError(err).Error("Stopped watching UFW rules")
 	}
 }
 
-// runCollection performs a single collection cycle
+// cycleMu serializes collection cycles triggered by the scheduler and by
+// remote actions so two synchronizations never modify UFW at once
+var cycleMu sync.Mutex
+
+// runCollection performs a single collection cycle and records its outcome
 func runCollection(ctx context.Context, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, cfg *config.Config, log *logger.Logger) error {
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+
+	start := time.Now()
+	status := &state.Status{Timestamp: start}
+	previous, _ := state.LoadStatus(cfg.Agent.StateDir)
+	if previous != nil {
+		status.RulesHash = previous.RulesHash
+		status.LastSynced = previous.LastSynced
+		for id, t := range previous.Tenants {
+			if status.Tenants == nil {
+				status.Tenants = make(map[string]*state.TenantStatus)
+			}
+			status.Tenants[id] = &state.TenantStatus{LastSynced: t.LastSynced}
+		}
+	}
+
+	err := collect(ctx, latitudeClient, firewallCollector, cfg, log, status)
+	timings.Since("cycle", start)
+
+	status.Success = err == nil
+	status.Duration = time.Since(start).String()
+	if err != nil {
+		status.Error = err.Error()
+		status.ErrorKind = string(errkind.Of(err))
+		status.NeedsOperator = errkind.NeedsOperator(err)
+	}
+	latitudeClient.SetLastError(err)
+	if saveErr := state.SaveStatus(cfg.Agent.StateDir, status); saveErr != nil {
+		log.WithError(saveErr).Warn("Failed to save agent status")
+	}
+
+	if err != nil {
+		notifier.Notify(notify.SyncFailed, "Collection cycle failed", map[string]string{"error": err.Error(), "error_kind": status.ErrorKind})
+	}
+	if previous != nil && previous.Success != status.Success {
+		if status.Success {
+			notifier.Notify(notify.HealthChanged, "Agent recovered, collection cycles are succeeding again", nil)
+		} else {
+			notifier.Notify(notify.HealthChanged, "Agent is unhealthy, collection cycles are failing", map[string]string{"error": err.Error()})
+		}
+	}
+
+	return err
+}
+
+// collect fetches firewall rules from the API and synchronizes them
+func collect(ctx context.Context, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, cfg *config.Config, log *logger.Logger, status *state.Status) error {
 	start := time.Now()
 	log.WithComponent("agent").Info("Starting collection cycle")
 
 	// Fetch firewall rules from API
-	rulesJSON, err := latitudeClient.PingAndGetFirewallRules(ctx)
+	rulesJSON, err := fetchFirewallRules(ctx, cfg, latitudeClient, log)
 	if err != nil {
 		return fmt.Errorf("failed to fetch firewall rules: %w", err)
 	}
@@ -143,6 +568,7 @@ func runCollection(ctx context.Context, latitudeClient *client.LatitudeClient, f
 	if err != nil {
 		log.WithError(err).Warn("Failed to format rules for display")
 	} else {
+		status.APIRules = len(displayRules)
 		log.Info("Firewall rules received from the server:")
 		for _, rule := range displayRules {
 			log.Info(rule)
@@ -154,30 +580,80 @@ func runCollection(ctx context.Context, latitudeClient *client.LatitudeClient, f
 		log.WithError(err).Warn("Failed to save rules to file")
 	}
 
-	// Synchronize firewall rules if firewall collector is enabled
-	if firewallCollector != nil {
+	// Follow maintenance windows announced by the API
+	updateMaintenance(latitudeClient, rulesJSON, log)
+
+	// Re-enroll if the API found this instance ID on another host
+	checkInstanceConflict(cfg, latitudeClient, rulesJSON, log)
+
+	// Suspend enforcement during maintenance windows
+	pause := activePause(cfg, latitudeClient, rulesJSON, log)
+	if pause != nil {
+		status.PausedUntil = &pause.Until
+		log.WithComponent("agent").Infof("Firewall enforcement paused until %s by %s, skipping synchronization",
+			pause.Until.Format(time.RFC3339), pause.Source)
+	}
+
+	// Follow rulesets the API scheduled for later; once due they replace
+	// the current API rules
+	if cfg.Rulesets.Enabled && firewallCollector != nil {
+		rulesJSON = scheduledRules(ctx, cfg, latitudeClient, firewallCollector, rulesJSON, pause != nil, log)
+	}
+
+	// Synchronize firewall rules if firewall collector is enabled, or only
+	// report how UFW differs from them in readonly mode
+	rulesHash, err := collectors.RulesHash(rulesJSON)
+	if err != nil {
+		return err
+	}
+	if firewallCollector != nil && firewallCollector.ReadOnly() {
+		if err := reportFirewallCompliance(ctx, cfg, latitudeClient, firewallCollector, rulesJSON, status, log); err != nil {
+			return err
+		}
+	} else if firewallCollector != nil && pause == nil {
+		// A difference is only drift while the API rules are the ones last
+		// applied; otherwise it is the API change about to be synchronized
+		if notifier.Wants(notify.FirewallDrift) && rulesHash == status.RulesHash {
+			notifyFirewallDrift(ctx, firewallCollector, rulesJSON, log)
+		}
+
 		collectorStart := time.Now()
-		err := firewallCollector.SyncFirewallRules(ctx, rulesJSON)
+		result, err := syncFirewall(ctx, cfg, latitudeClient, firewallCollector, rulesJSON, rulesHash, log)
 		duration := time.Since(collectorStart)
-		
+		timings.Observe("collector:firewall", duration)
+
 		log.LogCollectorRun("firewall", duration.String(), err == nil, err)
-		
+
+		status.Sync = result
 		if err != nil {
 			return fmt.Errorf("firewall synchronization failed: %w", err)
 		}
+		log.WithComponent("firewall").Infof("Firewall synchronization: %s", result)
+		if len(result.Failed) == 0 {
+			if err := syncFirewallPolicy(ctx, cfg, latitudeClient, firewallCollector, rulesJSON, result, log); err != nil {
+				return fmt.Errorf("firewall policy synchronization failed: %w", err)
+			}
+			status.RulesHash = rulesHash
+			synced := time.Now()
+			status.LastSynced = &synced
+		}
+
+		if err := syncTenants(ctx, status, log); err != nil {
+			return err
+		}
 
 		// Display final UFW status
-		status, err := firewallCollector.GetFirewallStatus(ctx)
+		ufwStatus, err := firewallCollector.GetFirewallStatus(ctx)
 		if err != nil {
 			log.WithError(err).Warn("Failed to get final UFW status")
 		} else {
 			log.Info("Final UFW status:")
-			log.Info(status)
+			log.Info(ufwStatus)
 		}
 	}
 
 	duration := time.Since(start)
 	log.WithComponent("agent").Infof("Collection cycle completed successfully in %s", duration)
-	
+
 	return nil
-}
\ No newline at end of file
+}
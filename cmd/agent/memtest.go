@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// memoryTestFile keeps the requested memory test until it ran and was
+// reported
+const memoryTestFile = "memory-test.json"
+
+// Memory test request states
+const (
+	memoryTestPending = "pending"
+	memoryTestRunning = "running"
+	memoryTestDone    = "done"
+)
+
+// memoryTestMu serializes the remote action and the periodic check
+var memoryTestMu sync.Mutex
+
+// memoryTestRequest is a memory test requested by the API
+type memoryTestRequest struct {
+	ActionID    string                       `json:"action_id"`
+	RequestedAt time.Time                    `json:"requested_at"`
+	Loops       int                          `json:"loops"`
+	Status      string                       `json:"status"`
+	Result      *collectors.MemoryTestResult `json:"result,omitempty"`
+}
+
+// requestMemoryTest queues a memory test for the next maintenance window
+func requestMemoryTest(cfg *config.Config, action *client.Action) (string, error) {
+	loops := cfg.MemoryTest.Loops
+	if value := action.Args["loops"]; value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return "", fmt.Errorf("invalid loops %q", value)
+		}
+		loops = n
+	}
+
+	memoryTestMu.Lock()
+	defer memoryTestMu.Unlock()
+
+	var current memoryTestRequest
+	if err := state.Load(cfg.Agent.StateDir, memoryTestFile, &current); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read memory test: %w", err)
+	}
+	if current.Status == memoryTestPending || current.Status == memoryTestRunning {
+		return "", fmt.Errorf("a memory test requested at %s is already %s", current.RequestedAt.Format(time.RFC3339), current.Status)
+	}
+
+	request := memoryTestRequest{ActionID: action.ID, RequestedAt: time.Now(), Loops: loops, Status: memoryTestPending}
+	if err := state.Save(cfg.Agent.StateDir, memoryTestFile, &request); err != nil {
+		return "", fmt.Errorf("failed to save memory test: %w", err)
+	}
+	if window, active := maintenanceTracker.Active(time.Now()); active {
+		return fmt.Sprintf("Memory test queued, it starts shortly during %s", window), nil
+	}
+	return "Memory test queued until the next maintenance window", nil
+}
+
+// runMemoryTestCheck runs a pending memory test when a maintenance window
+// is active and reports its result
+func runMemoryTestCheck(ctx context.Context, cfg *config.Config, tester *collectors.MemoryTester, latitudeClient *client.LatitudeClient, log *logger.Logger) error {
+	memoryTestMu.Lock()
+	var request memoryTestRequest
+	err := state.Load(cfg.Agent.StateDir, memoryTestFile, &request)
+	memoryTestMu.Unlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read memory test: %w", err)
+	}
+
+	switch request.Status {
+	case memoryTestRunning:
+		// The agent stopped while the test ran
+		request.Status = memoryTestDone
+		request.Result = &collectors.MemoryTestResult{StartedAt: request.RequestedAt, Loops: request.Loops, Error: "memory test interrupted by an agent restart"}
+	case memoryTestPending:
+		window, active := maintenanceTracker.Active(time.Now())
+		if !active {
+			return nil
+		}
+		log.WithComponent("memtest").Infof("Starting requested memory test during %s", window)
+		request.Status = memoryTestRunning
+		if err := saveMemoryTest(cfg, &request); err != nil {
+			return err
+		}
+
+		timeout, _ := time.ParseDuration(cfg.MemoryTest.Timeout)
+		testCtx, cancel := context.WithTimeout(ctx, timeout)
+		result := tester.Run(testCtx, request.Loops)
+		cancel()
+		if ctx.Err() != nil {
+			// Shutting down; the test is reported interrupted on restart
+			return ctx.Err()
+		}
+		request.Status, request.Result = memoryTestDone, result
+	case memoryTestDone:
+		// The report failed earlier and is retried below
+	default:
+		return nil
+	}
+	if err := saveMemoryTest(cfg, &request); err != nil {
+		return err
+	}
+
+	result := request.Result
+	switch {
+	case len(result.Failures) > 0:
+		message := fmt.Sprintf("Memory test found errors in %d MiB: %s", result.SizeMB, strings.Join(result.Failures, "; "))
+		log.WithComponent("memtest").Error(message)
+		notifier.Notify(notify.HealthChanged, message, map[string]string{"action_id": request.ActionID})
+	case result.Error != "":
+		log.WithComponent("memtest").Warnf("Memory test did not complete: %s", result.Error)
+	default:
+		log.WithComponent("memtest").Infof("Memory test of %d MiB passed in %s", result.SizeMB, result.Duration.Round(time.Second))
+	}
+
+	if err := latitudeClient.SendReport(ctx, cfg.MemoryTest.Endpoint, map[string]interface{}{
+		"timestamp": time.Now(),
+		"action_id": request.ActionID,
+		"result":    result,
+	}); err != nil {
+		return err
+	}
+
+	memoryTestMu.Lock()
+	defer memoryTestMu.Unlock()
+	if err := state.Remove(cfg.Agent.StateDir, memoryTestFile); err != nil {
+		return fmt.Errorf("failed to clear memory test: %w", err)
+	}
+	return nil
+}
+
+// saveMemoryTest records the memory test request
+func saveMemoryTest(cfg *config.Config, request *memoryTestRequest) error {
+	memoryTestMu.Lock()
+	defer memoryTestMu.Unlock()
+	if err := state.Save(cfg.Agent.StateDir, memoryTestFile, request); err != nil {
+		return fmt.Errorf("failed to save memory test: %w", err)
+	}
+	return nil
+}
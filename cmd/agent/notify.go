@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/maintenance"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/schedule"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// versionFileName records the agent version that last ran on this server
+const versionFileName = "version.json"
+
+// notifier delivers local events to the configured webhooks and notifier
+// plugins. It is nil, and discards events, when neither is configured.
+var notifier *notify.Notifier
+
+// maintenanceTracker knows whether the server is in a planned maintenance
+// window, during which health alerts are suppressed
+var maintenanceTracker *maintenance.Tracker
+
+// setupNotifier creates the maintenance tracker and the notifier from the
+// configuration and reports an agent update if the version changed since the
+// last start
+func setupNotifier(cfg *config.Config, log *logger.Logger) {
+	windows, _ := schedule.ParseWindows(cfg.Maintenance.Windows)
+	maintenanceTracker = maintenance.NewTracker(windows)
+
+	if len(cfg.Notify.Webhooks) == 0 && !cfg.Plugins.Enabled {
+		return
+	}
+
+	var webhooks []notify.Webhook
+	for _, w := range cfg.Notify.Webhooks {
+		webhooks = append(webhooks, notify.Webhook{URL: w.URL, Format: w.Format, Events: w.Events})
+	}
+	repeatInterval, _ := time.ParseDuration(cfg.Notify.RepeatInterval)
+	notifier = notify.NewNotifier(webhooks, repeatInterval, log.Logger)
+	notifier.SetMaintenance(maintenanceTracker.Active)
+
+	var last struct {
+		Version string `json:"version"`
+	}
+	if err := state.Load(cfg.Agent.StateDir, versionFileName, &last); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warn("Failed to read last agent version")
+	}
+	if last.Version != "" && last.Version != Version {
+		notifier.Notify(notify.AgentUpdated, fmt.Sprintf("Agent updated from %s to %s", last.Version, Version), nil)
+	}
+	last.Version = Version
+	if err := state.Save(cfg.Agent.StateDir, versionFileName, last); err != nil {
+		log.WithError(err).Warn("Failed to record agent version")
+	}
+}
+
+// notifyFirewallDrift reports when the host's UFW rules differ from the API
+// before they are synchronized
+func notifyFirewallDrift(ctx context.Context, firewallCollector *collectors.FirewallCollector, rulesJSON string, log *logger.Logger) {
+	toAdd, toRemove, err := firewallCollector.DiffFirewallRules(ctx, rulesJSON)
+	if err != nil {
+		log.WithError(err).Debug("Failed to compute firewall drift")
+		return
+	}
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		return
+	}
+
+	notifier.Notify(notify.FirewallDrift, "UFW rules differ from the Latitude.sh firewall", map[string]string{
+		"missing_rules":    fmt.Sprint(len(toAdd)),
+		"unexpected_rules": fmt.Sprint(len(toRemove)),
+	})
+}
+
+// updateMaintenance records the maintenance window announced by the API in
+// the ping response, logging when one starts or ends
+func updateMaintenance(latitudeClient *client.LatitudeClient, rulesJSON string, log *logger.Logger) {
+	directives, err := latitudeClient.GetAgentDirectives(rulesJSON)
+	if err != nil {
+		log.WithError(err).Debug("Failed to read agent directives")
+		return
+	}
+
+	now := time.Now()
+	_, wasActive := maintenanceTracker.Active(now)
+	maintenanceTracker.SetAPIWindow(directives.Agent.MaintenanceUntil, directives.Agent.MaintenanceReason)
+	window, active := maintenanceTracker.Active(now)
+	switch {
+	case active && !wasActive:
+		log.WithComponent("agent").Infof("Entered %s, suppressing health alerts", window)
+	case !active && wasActive:
+		log.WithComponent("agent").Info("Maintenance ended, health alerts are no longer suppressed")
+	}
+}
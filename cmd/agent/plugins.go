@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/plugins"
+)
+
+// pluginReport is a collector plugin's data as reported to the API
+type pluginReport struct {
+	Plugin    string          `json:"plugin"`
+	Version   string          `json:"version"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// pluginApplyReport is an applier plugin's outcome as reported to the API
+type pluginApplyReport struct {
+	Plugin    string    `json:"plugin"`
+	Version   string    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Changed   bool      `json:"changed"`
+	Message   string    `json:"message,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// startPlugins discovers and starts the plugins, schedules collectors and
+// appliers and subscribes notifiers to agent events. Plugins are shut down
+// when the context is cancelled.
+func startPlugins(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	paths, err := plugins.Discover(cfg.Plugins.Dir, log.Logger)
+	if err != nil {
+		log.WithComponent("plugins").WithError(err).Error("Failed to discover plugins")
+		return
+	}
+
+	timeout, _ := time.ParseDuration(cfg.Plugins.Timeout)
+	defaultInterval, _ := time.ParseDuration(cfg.Plugins.Interval)
+	for _, path := range paths {
+		plugin, err := plugins.Start(path, Version, timeout, log.Logger)
+		if err != nil {
+			log.WithComponent("plugins").WithError(err).Error("Failed to load plugin")
+			continue
+		}
+		if slices.Contains(cfg.Plugins.Disabled, plugin.Name()) {
+			log.WithComponent("plugins").Infof("Plugin %s is disabled", plugin.Name())
+			plugin.Close()
+			continue
+		}
+		log.WithComponent("plugins").Infof("Loaded plugin %s %s (%v)", plugin.Name(), plugin.Manifest.Version, plugin.Manifest.Kinds)
+		context.AfterFunc(ctx, plugin.Close)
+
+		interval := defaultInterval
+		if d, err := time.ParseDuration(plugin.Manifest.Interval); err == nil && d > 0 {
+			interval = d
+		}
+
+		if plugin.Has(plugins.KindNotifier) {
+			notifier.AddSink(plugin)
+		}
+		if plugin.Has(plugins.KindCollector) {
+			go runPeriodic(ctx, "plugin:"+plugin.Name(), interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+				data, err := plugin.Collect(ctx)
+				if err != nil {
+					return err
+				}
+				return latitudeClient.SendReport(ctx, cfg.Plugins.Endpoint, pluginReport{
+					Plugin:    plugin.Name(),
+					Version:   plugin.Manifest.Version,
+					Timestamp: time.Now(),
+					Data:      data,
+				})
+			})
+		}
+		if plugin.Has(plugins.KindApplier) {
+			go runPeriodic(ctx, "plugin:"+plugin.Name()+":apply", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+				return runPluginApply(ctx, cfg, latitudeClient, plugin)
+			})
+		}
+	}
+}
+
+// runPluginApply passes the plugin's configuration from the API to an
+// applier plugin and reports the outcome
+func runPluginApply(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, plugin *plugins.Plugin) error {
+	configJSON, err := latitudeClient.FetchPluginConfig(ctx, cfg.Plugins.Endpoint+"/config", plugin.Name())
+	if err != nil {
+		return err
+	}
+	if !json.Valid([]byte(configJSON)) {
+		return fmt.Errorf("invalid configuration for plugin %s", plugin.Name())
+	}
+
+	report := pluginApplyReport{Plugin: plugin.Name(), Version: plugin.Manifest.Version, Timestamp: time.Now()}
+	result, applyErr := plugin.Apply(ctx, json.RawMessage(configJSON))
+	if applyErr != nil {
+		report.Error = applyErr.Error()
+	} else {
+		report.Changed = result.Changed
+		report.Message = result.Message
+	}
+
+	if err := latitudeClient.SendReport(ctx, cfg.Plugins.Endpoint+"/results", report); err != nil {
+		return err
+	}
+	return applyErr
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/profiles"
+)
+
+// startProfiles periodically applies the workload profiles assigned in the
+// API. The manager is created before returning so the rules of profiles
+// applied by a previous run are known to the first firewall synchronization.
+func startProfiles(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) {
+	manager := profiles.NewManager(firewallCollector, cfg.Agent.StateDir, log.Logger)
+	manager.SetCommandWrapper(privilegeWrapper(cfg)...)
+
+	interval, _ := time.ParseDuration(cfg.Profiles.Interval)
+	go runPeriodic(ctx, "profiles", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+		return runProfiles(ctx, cfg, latitudeClient, manager, log)
+	})
+}
+
+// runProfiles fetches the assigned profiles, applies them and reports the
+// state of each
+func runProfiles(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, manager *profiles.Manager, log *logger.Logger) error {
+	profilesJSON, err := latitudeClient.FetchProfiles(ctx, cfg.Profiles.Endpoint)
+	if err != nil {
+		return err
+	}
+	assigned, err := profiles.Parse(profilesJSON)
+	if err != nil {
+		return err
+	}
+
+	// Profiles change UFW, so they must not interleave with a collection cycle
+	cycleMu.Lock()
+	report := manager.Sync(ctx, assigned)
+	cycleMu.Unlock()
+
+	for _, status := range report.Profiles {
+		if status.State == profiles.StateDegraded {
+			log.WithComponent("profiles").Warnf("Profile %s is degraded: %s", status.Name, status.Error)
+		}
+	}
+
+	return latitudeClient.SendReport(ctx, cfg.Profiles.Endpoint, report)
+}
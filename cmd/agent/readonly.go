@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/latitudesh/agent/internal/timings"
+)
+
+// reportFirewallCompliance compares UFW with the API rules and reports the
+// drift instead of synchronizing, for firewalls in readonly mode. Tenant
+// firewalls are not checked.
+func reportFirewallCompliance(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, rulesJSON string, status *state.Status, log *logger.Logger) error {
+	start := time.Now()
+	toAdd, toRemove, err := firewallCollector.DiffFirewallRules(ctx, rulesJSON)
+	var policyChanges []collectors.PolicyChange
+	if err == nil {
+		policyChanges, err = firewallCollector.DiffFirewallPolicy(ctx, rulesJSON)
+	}
+	timings.Since("collector:firewall_compliance", start)
+	log.LogCollectorRun("firewall_compliance", time.Since(start).String(), err == nil, err)
+	if err != nil {
+		return fmt.Errorf("firewall compliance check failed: %w", err)
+	}
+
+	drift := &state.DriftResult{Missing: []string{}, Unexpected: []string{}}
+	for _, rule := range toAdd {
+		drift.Missing = append(drift.Missing, rule.String())
+	}
+	for _, rule := range toRemove {
+		drift.Unexpected = append(drift.Unexpected, rule.String())
+	}
+	for _, change := range policyChanges {
+		drift.Policy = append(drift.Policy, change.String())
+	}
+	status.Drift = drift
+	inSync := len(toAdd) == 0 && len(toRemove) == 0 && len(policyChanges) == 0
+
+	fwLog := log.WithComponent("firewall")
+	if inSync {
+		fwLog.Info("Firewall compliance: UFW matches the API rules")
+	} else {
+		fwLog.Warnf("Firewall compliance: UFW lacks %d and has %d unexpected rules, not corrected in readonly mode",
+			len(toAdd), len(toRemove))
+		for _, rule := range drift.Missing {
+			fwLog.Infof("Missing: %s", rule)
+		}
+		for _, rule := range drift.Unexpected {
+			fwLog.Infof("Unexpected: %s", rule)
+		}
+		for _, change := range drift.Policy {
+			fwLog.Infof("Policy differs: %s", change)
+		}
+		notifier.Notify(notify.FirewallDrift, "UFW rules differ from the Latitude.sh firewall", map[string]string{
+			"missing_rules":    fmt.Sprint(len(toAdd)),
+			"unexpected_rules": fmt.Sprint(len(toRemove)),
+			"policy_changes":   fmt.Sprint(len(policyChanges)),
+			"mode":             "readonly",
+		})
+	}
+
+	report := &FirewallCompliance{
+		CheckedAt:       time.Now(),
+		InSync:          &inSync,
+		MissingRules:    drift.Missing,
+		UnexpectedRules: drift.Unexpected,
+		PolicyDrift:     drift.Policy,
+	}
+	if err := deliverEvent(ctx, latitudeClient, eventDrift, cfg.Firewall.ComplianceEndpoint, eventKey(eventDrift, report.CheckedAt), map[string]interface{}{
+		"firewall_id": cfg.Latitude.FirewallID,
+		"compliance":  report,
+	}); err != nil {
+		fwLog.WithError(err).Warn("Failed to send firewall compliance report")
+	}
+	return nil
+}
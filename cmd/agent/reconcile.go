@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/reconcile"
+	"github.com/latitudesh/agent/internal/tags"
+)
+
+// startReconcile periodically compares the server with its API record
+func startReconcile(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) {
+	var tagSyncer *tags.Syncer
+	if cfg.Tags.Enabled {
+		configured := tags.Set{Tags: cfg.Tags.Tags, Metadata: cfg.Tags.Metadata}
+		tagSyncer = tags.NewSyncer(latitudeClient, cfg.Tags.Endpoint, configured, cfg.Tags.DropInDir, cfg.Tags.OutputFile, log.Logger)
+	}
+
+	interval, _ := time.ParseDuration(cfg.Reconcile.Interval)
+	go runPeriodic(ctx, "reconcile", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+		return runReconcile(ctx, cfg, latitudeClient, firewallCollector, tagSyncer, log)
+	})
+}
+
+// runReconcile builds a reconciliation report and sends it to the API
+func runReconcile(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, tagSyncer *tags.Syncer, log *logger.Logger) error {
+	recordJSON, err := latitudeClient.FetchServerRecord(ctx, cfg.Reconcile.Endpoint)
+	if err != nil {
+		return err
+	}
+	record, err := reconcile.ParseRecord(recordJSON)
+	if err != nil {
+		return err
+	}
+
+	inventory, err := collectors.GetInventory(cfg.Container.HostPath("/"))
+	if err != nil {
+		return err
+	}
+	observed := &reconcile.Observed{Hostname: inventory.Hostname}
+	for _, iface := range inventory.Interfaces {
+		for _, address := range iface.Addresses {
+			ip, _, err := net.ParseCIDR(address)
+			if err == nil && ip.IsGlobalUnicast() {
+				observed.IPAddresses = append(observed.IPAddresses, ip.String())
+			}
+		}
+	}
+
+	report := &reconcile.Report{Timestamp: time.Now(), Skipped: map[string]string{}}
+
+	if tagSyncer == nil {
+		report.Skipped[reconcile.FieldTags] = "tag sync is disabled"
+	} else if local, err := tagSyncer.Local(); err != nil {
+		report.Skipped[reconcile.FieldTags] = err.Error()
+	} else {
+		observed.Tags = append([]string{}, local.Tags...)
+	}
+
+	// Hold the cycle lock so a synchronization in progress is not seen half done
+	cycleMu.Lock()
+	compliance := checkFirewallCompliance(ctx, cfg, latitudeClient, firewallCollector, log)
+	cycleMu.Unlock()
+	switch {
+	case firewallCollector == nil:
+		report.Skipped[reconcile.FieldFirewall] = "firewall synchronization is disabled"
+	case compliance.Error != "":
+		report.Skipped[reconcile.FieldFirewall] = compliance.Error
+	default:
+		observed.MissingRules = compliance.MissingRules
+		observed.UnexpectedRules = compliance.UnexpectedRules
+	}
+
+	report.Mismatches = reconcile.Compare(observed, record)
+	report.InSync = len(report.Mismatches) == 0
+	if len(report.Skipped) == 0 {
+		report.Skipped = nil
+	}
+
+	if !report.InSync {
+		var fields []string
+		for _, m := range report.Mismatches {
+			fields = append(fields, m.Field)
+		}
+		log.WithComponent("reconcile").Warnf("Server differs from its API record: %s", strings.Join(fields, ", "))
+	}
+
+	if err := latitudeClient.SendReport(ctx, cfg.Reconcile.Endpoint, report); err != nil {
+		return fmt.Errorf("failed to send reconciliation report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// pendingRulesetFile stores the ruleset scheduled by the API, so it is
+// applied on time even if the agent restarts or loses the API
+const pendingRulesetFile = "pending-ruleset.json"
+
+// rulesetCheckInterval is how often the scheduled time of a pending ruleset
+// is checked between collection cycles
+const rulesetCheckInterval = 5 * time.Second
+
+// Ruleset report events
+const (
+	rulesetAcknowledged = "acknowledged"
+	rulesetPreApply     = "pre_apply"
+	rulesetApplied      = "applied"
+	rulesetFailed       = "failed"
+)
+
+// pendingRuleset is the local record of a scheduled ruleset
+type pendingRuleset struct {
+	ID      string    `json:"id"`
+	ApplyAt time.Time `json:"apply_at"`
+	// RulesJSON is the ruleset in the form of a ping response
+	RulesJSON    string     `json:"rules_json"`
+	Acknowledged bool       `json:"acknowledged"`
+	AppliedAt    *time.Time `json:"applied_at,omitempty"`
+}
+
+// due reports whether the ruleset's scheduled time has come
+func (p *pendingRuleset) due(now time.Time) bool {
+	return !now.Before(p.ApplyAt)
+}
+
+// rulesetReport is sent to the API for each step of a scheduled ruleset
+type rulesetReport struct {
+	RulesetID string    `json:"ruleset_id"`
+	Event     string    `json:"event"`
+	ApplyAt   time.Time `json:"apply_at"`
+	Timestamp time.Time `json:"timestamp"`
+	// Rules are the UFW rules at the time of the event
+	Rules []string          `json:"rules,omitempty"`
+	Sync  *state.SyncResult `json:"sync,omitempty"`
+	Error string            `json:"error,omitempty"`
+}
+
+// loadPendingRuleset reads the stored ruleset, nil if there is none
+func loadPendingRuleset(stateDir string) (*pendingRuleset, error) {
+	var pending pendingRuleset
+	if err := state.Load(stateDir, pendingRulesetFile, &pending); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &pending, nil
+}
+
+// scheduledRules records and acknowledges the ruleset the API scheduled in
+// the ping response and returns the rules to synchronize: the scheduled
+// ruleset once it is due, while the API still lists it as pending, and
+// rulesJSON otherwise. A due ruleset that was not applied yet is applied
+// here, with its reports, unless enforcement is paused.
+func scheduledRules(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, rulesJSON string, paused bool, log *logger.Logger) string {
+	scheduled, err := latitudeClient.GetPendingRuleset(rulesJSON)
+	if err != nil {
+		log.WithComponent("rulesets").WithError(err).Warn("Ignoring invalid pending ruleset")
+		return rulesJSON
+	}
+	stored, err := loadPendingRuleset(cfg.Agent.StateDir)
+	if err != nil {
+		log.WithComponent("rulesets").WithError(err).Warn("Failed to read pending ruleset")
+	}
+
+	if scheduled == nil {
+		// Applied or withdrawn; the API rules are current again
+		if stored != nil {
+			if stored.AppliedAt == nil {
+				log.WithComponent("rulesets").Infof("Scheduled ruleset %s was withdrawn", stored.ID)
+			}
+			if err := os.Remove(filepath.Join(cfg.Agent.StateDir, pendingRulesetFile)); err != nil && !os.IsNotExist(err) {
+				log.WithComponent("rulesets").WithError(err).Warn("Failed to remove pending ruleset")
+			}
+		}
+		return rulesJSON
+	}
+
+	if stored == nil || stored.ID != scheduled.ID || !stored.ApplyAt.Equal(scheduled.ApplyAt) {
+		scheduledJSON, err := scheduled.RulesJSON()
+		if err != nil {
+			log.WithComponent("rulesets").WithError(err).Warn("Ignoring pending ruleset")
+			return rulesJSON
+		}
+		stored = &pendingRuleset{ID: scheduled.ID, ApplyAt: scheduled.ApplyAt, RulesJSON: scheduledJSON}
+		log.WithComponent("rulesets").Infof("Ruleset %s with %d rules scheduled for %s",
+			stored.ID, len(scheduled.Rules), stored.ApplyAt.Format(time.RFC3339))
+	}
+
+	if !stored.Acknowledged {
+		err := latitudeClient.SendReport(ctx, cfg.Rulesets.Endpoint, &rulesetReport{
+			RulesetID: stored.ID,
+			Event:     rulesetAcknowledged,
+			ApplyAt:   stored.ApplyAt,
+			Timestamp: time.Now(),
+		})
+		if err != nil {
+			log.WithComponent("rulesets").WithError(err).Warn("Failed to acknowledge scheduled ruleset, retrying next cycle")
+		} else {
+			stored.Acknowledged = true
+		}
+	}
+	if err := state.Save(cfg.Agent.StateDir, pendingRulesetFile, stored); err != nil {
+		log.WithComponent("rulesets").WithError(err).Warn("Failed to save pending ruleset")
+	}
+
+	if !stored.due(time.Now()) {
+		return rulesJSON
+	}
+	if stored.AppliedAt == nil && !paused {
+		applyPendingRuleset(ctx, cfg, latitudeClient, firewallCollector, stored, log)
+	}
+	return stored.RulesJSON
+}
+
+// runScheduledRulesets applies the stored ruleset at its scheduled time
+// until the context is cancelled, without waiting for the next collection
+// cycle or the API
+func runScheduledRulesets(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, log *logger.Logger) {
+	ticker := time.NewTicker(rulesetCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cycleMu.Lock()
+		now := time.Now()
+		pending, err := loadPendingRuleset(cfg.Agent.StateDir)
+		if err != nil {
+			log.WithComponent("rulesets").WithError(err).Error("Failed to read pending ruleset")
+		} else if pending != nil && pending.AppliedAt == nil && pending.due(now) && !enforcementPaused(cfg, now) {
+			applyPendingRuleset(ctx, cfg, latitudeClient, firewallCollector, pending, log)
+		}
+		cycleMu.Unlock()
+	}
+}
+
+// enforcementPaused reports whether the last collection cycle found
+// enforcement paused, locally or by the API
+func enforcementPaused(cfg *config.Config, now time.Time) bool {
+	status, err := state.LoadStatus(cfg.Agent.StateDir)
+	return err == nil && status.PausedUntil != nil && now.Before(*status.PausedUntil)
+}
+
+// applyPendingRuleset synchronizes UFW with a due ruleset, reporting the
+// rules before and after. It is recorded as applied even if rules fail, as
+// collection cycles keep synchronizing it while the API lists it as
+// pending. The caller must hold cycleMu.
+func applyPendingRuleset(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, pending *pendingRuleset, log *logger.Logger) {
+	log.WithComponent("rulesets").Infof("Applying scheduled ruleset %s", pending.ID)
+
+	report := func(event string, result *state.SyncResult, syncErr error) {
+		r := &rulesetReport{
+			RulesetID: pending.ID,
+			Event:     event,
+			ApplyAt:   pending.ApplyAt,
+			Timestamp: time.Now(),
+			Sync:      result,
+		}
+		if rules, err := firewallCollector.GetCurrentRules(ctx); err == nil {
+			for _, rule := range rules {
+				r.Rules = append(r.Rules, rule.String())
+			}
+		}
+		if syncErr != nil {
+			r.Error = syncErr.Error()
+		}
+		// The ruleset applies on schedule even when the API cannot be told
+		if err := latitudeClient.SendReport(ctx, cfg.Rulesets.Endpoint, r); err != nil {
+			log.WithComponent("rulesets").WithError(err).Warnf("Failed to send %s report", event)
+		}
+	}
+
+	report(rulesetPreApply, nil, nil)
+	result, err := firewallCollector.SyncFirewallRules(ctx, pending.RulesJSON)
+	if err == nil && len(result.Failed) > 0 {
+		err = fmt.Errorf("%d rules failed to apply", len(result.Failed))
+	}
+	if err != nil {
+		log.WithComponent("rulesets").WithError(err).Errorf("Failed to apply scheduled ruleset %s", pending.ID)
+		notifier.Notify(notify.SyncFailed, "Scheduled ruleset failed to apply", map[string]string{"ruleset_id": pending.ID, "error": err.Error()})
+		report(rulesetFailed, result, err)
+	} else {
+		log.WithComponent("rulesets").Infof("Applied scheduled ruleset %s: %s", pending.ID, result)
+		report(rulesetApplied, result, nil)
+	}
+
+	applied := time.Now()
+	pending.AppliedAt = &applied
+	if err := state.Save(cfg.Agent.StateDir, pendingRulesetFile, pending); err != nil {
+		log.WithComponent("rulesets").WithError(err).Warn("Failed to save pending ruleset")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+)
+
+// API scopes a token may be granted
+const (
+	scopeMonitoring = "monitoring"
+	scopeManagement = "management"
+	scopeFirewall   = "firewall"
+)
+
+// scopeCheckTimeout bounds the startup scope check
+const scopeCheckTimeout = 10 * time.Second
+
+// scopedSubsystem is a subsystem whose API calls need a scope
+type scopedSubsystem struct {
+	name    string
+	enabled *bool
+	scope   string
+}
+
+// scopedSubsystems lists the subsystems of cfg by the scope they need.
+// Firewall synchronization itself only uses the ping and is always allowed.
+func scopedSubsystems(cfg *config.Config) []scopedSubsystem {
+	return []scopedSubsystem{
+		{"actions", &cfg.Actions.Enabled, scopeManagement},
+		{"users", &cfg.Users.Enabled, scopeManagement},
+		{"patch", &cfg.Patch.Enabled, scopeManagement},
+		{"wireguard", &cfg.WireGuard.Enabled, scopeManagement},
+		{"network", &cfg.Network.Enabled, scopeManagement},
+		{"dns", &cfg.DNS.Enabled, scopeManagement},
+		{"tags", &cfg.Tags.Enabled, scopeManagement},
+		{"tasks", &cfg.Tasks.Enabled, scopeManagement},
+		{"user_data", &cfg.UserData.Enabled, scopeManagement},
+		{"files", &cfg.Files.Enabled, scopeManagement},
+		{"plugins", &cfg.Plugins.Enabled, scopeManagement},
+		{"profiles", &cfg.Profiles.Enabled, scopeManagement},
+		{"alerts", &cfg.Alerts.Enabled, scopeMonitoring},
+		{"bmc", &cfg.BMC.Enabled, scopeMonitoring},
+		{"crash", &cfg.Crash.Enabled, scopeMonitoring},
+		{"security", &cfg.Security.Enabled, scopeMonitoring},
+		{"ddos", &cfg.DDoS.Enabled, scopeMonitoring},
+		{"backup", &cfg.Backup.Enabled, scopeMonitoring},
+		{"bgp", &cfg.BGP.Enabled, scopeMonitoring},
+		{"reconcile", &cfg.Reconcile.Enabled, scopeMonitoring},
+		{"identity", &cfg.Identity.Enabled, scopeMonitoring},
+		{"compliance", &cfg.Compliance.Enabled, scopeMonitoring},
+		{"dns_health", &cfg.DNSHealth.Enabled, scopeMonitoring},
+		{"neighbors", &cfg.Neighbors.Enabled, scopeMonitoring},
+		{"heartbeat", &cfg.Heartbeat.Enabled, scopeMonitoring},
+		{"hardware_trends", &cfg.Trends.Enabled, scopeMonitoring},
+		{"smart_self_tests", &cfg.SelfTests.Enabled, scopeMonitoring},
+		{"memory_test", &cfg.MemoryTest.Enabled, scopeMonitoring},
+		{"scheduled_rulesets", &cfg.Rulesets.Enabled, scopeFirewall},
+	}
+}
+
+var (
+	scopeMu sync.Mutex
+	// scopeMismatches maps the subsystems disabled at startup to the scope
+	// their token lacks
+	scopeMismatches map[string]string
+)
+
+// checkTokenScopes disables the enabled subsystems whose scope the token
+// lacks, so they do not fail with 403 every cycle. When the scopes cannot
+// be determined, e.g. with an API that does not publish them, every
+// subsystem stays enabled.
+func checkTokenScopes(cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	if cfg.Latitude.TokenEndpoint == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scopeCheckTimeout)
+	defer cancel()
+	scopes, err := latitudeClient.TokenScopes(ctx, cfg.Latitude.TokenEndpoint)
+	if err != nil {
+		log.WithComponent("agent").WithError(err).Warn("Could not verify the token's API scopes, keeping all subsystems enabled")
+		return
+	}
+
+	mismatches := make(map[string]string)
+	for _, subsystem := range scopedSubsystems(cfg) {
+		if !*subsystem.enabled || slices.Contains(scopes, subsystem.scope) {
+			continue
+		}
+		*subsystem.enabled = false
+		mismatches[subsystem.name] = subsystem.scope
+	}
+	if len(mismatches) == 0 {
+		log.WithComponent("agent").WithField("scopes", scopes).Info("Token has the API scopes of every enabled subsystem")
+		return
+	}
+
+	names := make([]string, 0, len(mismatches))
+	for name := range mismatches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.WithComponent("agent").WithField("subsystem", name).WithField("missing_scope", mismatches[name]).
+			Error("Subsystem disabled, the API token lacks the scope it needs")
+	}
+
+	scopeMu.Lock()
+	scopeMismatches = mismatches
+	scopeMu.Unlock()
+}
+
+// currentScopeMismatches returns the subsystems disabled for lacking a
+// scope, by name
+func currentScopeMismatches() map[string]string {
+	scopeMu.Lock()
+	defer scopeMu.Unlock()
+	return scopeMismatches
+}
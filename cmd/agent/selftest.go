@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/sirupsen/logrus"
+)
+
+// runSelfTestCommand starts SMART self-tests and shows their progress
+func runSelfTestCommand(args []string) int {
+	if len(args) == 0 {
+		selfTestUsage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("selftest "+args[0], flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	disk := fs.String("disk", "", "Disk to test, e.g. sda or nvme0n1 (start)")
+	testType := fs.String("type", collectors.SelfTestShort, "Self-test type: short or long (start)")
+	wait := fs.Bool("wait", false, "Wait for the test to finish (start)")
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Keep runner logging out of the output
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	runner := collectors.NewSelfTestRunner(cfg.Agent.StateDir, quiet)
+	runner.SetCommandWrapper(privilegeWrapper(cfg)...)
+
+	switch args[0] {
+	case "start":
+		if *disk == "" {
+			fmt.Fprintln(os.Stderr, "-disk is required")
+			return 2
+		}
+		test, err := runner.Start(ctx, *disk, *testType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("Started %s self-test on %s\n", test.Type, test.Disk)
+		if !*wait {
+			return 0
+		}
+		return waitSelfTest(ctx, runner, test.Disk)
+	case "status":
+		tests, err := runner.Poll(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Print(formatSelfTests(tests))
+	default:
+		selfTestUsage()
+		return 2
+	}
+	return 0
+}
+
+// waitSelfTest prints the progress of the self-test on disk until it ends,
+// exiting non-zero unless it passed
+func waitSelfTest(ctx context.Context, runner *collectors.SelfTestRunner, disk string) int {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println("Stopped waiting, the self-test keeps running")
+			return 1
+		case <-ticker.C:
+		}
+		tests, err := runner.Poll(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		for _, test := range tests {
+			if test.Disk != disk {
+				continue
+			}
+			if test.Status == collectors.SelfTestRunning {
+				fmt.Printf("%s: %d%% remaining\n", disk, test.RemainingPercent)
+				break
+			}
+			fmt.Printf("%s: %s (%s)\n", disk, test.Status, test.Result)
+			if test.Status != collectors.SelfTestPassed {
+				return 1
+			}
+			return 0
+		}
+	}
+}
+
+// selfTestUsage prints usage for the selftest command
+func selfTestUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: lsh-agent selftest <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  start -disk <disk> [-type short|long] [-wait]  Start a SMART self-test")
+	fmt.Fprintln(os.Stderr, "  status                                         Show self-tests started by the agent")
+}
+
+// formatSelfTests renders self-tests as a table
+func formatSelfTests(tests []collectors.SelfTest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-10s %-6s %-8s %-20s %s\n", "DISK", "TYPE", "STATUS", "STARTED", "RESULT")
+	for _, test := range tests {
+		result := test.Result
+		if test.Status == collectors.SelfTestRunning {
+			result = fmt.Sprintf("%d%% remaining", test.RemainingPercent)
+		}
+		fmt.Fprintf(&b, "%-10s %-6s %-8s %-20s %s\n", test.Disk, test.Type, test.Status, test.StartedAt.Format("2006-01-02 15:04:05"), result)
+	}
+	return b.String()
+}
+
+// newSelfTestRunner creates the SMART self-test runner
+func newSelfTestRunner(cfg *config.Config, log *logger.Logger) *collectors.SelfTestRunner {
+	runner := collectors.NewSelfTestRunner(cfg.Agent.StateDir, log.Logger)
+	runner.SetCommandWrapper(privilegeWrapper(cfg)...)
+	return runner
+}
+
+// runSelfTestCheck reports running self-tests and the outcome of those not
+// reported yet, announcing failures
+func runSelfTestCheck(ctx context.Context, runner *collectors.SelfTestRunner, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	tests, err := runner.Poll(ctx)
+	if err != nil {
+		return err
+	}
+
+	report := collectors.SelfTestReport{Timestamp: time.Now(), Tests: []collectors.SelfTest{}}
+	for _, test := range tests {
+		if test.Reported {
+			continue
+		}
+		report.Tests = append(report.Tests, test)
+		switch test.Status {
+		case collectors.SelfTestPassed:
+			log.WithComponent("selftest").Infof("%s self-test on %s passed", test.Type, test.Disk)
+		case collectors.SelfTestFailed, collectors.SelfTestAborted:
+			message := fmt.Sprintf("%s self-test on %s %s: %s", test.Type, test.Disk, test.Status, test.Result)
+			log.WithComponent("selftest").Warn(message)
+			notifier.Notify(notify.HealthChanged, message, map[string]string{"disk": test.Disk})
+		}
+	}
+	if len(report.Tests) == 0 {
+		return nil
+	}
+
+	if err := latitudeClient.SendReport(ctx, endpoint, report); err != nil {
+		return err
+	}
+	return runner.MarkReported(report.Tests)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/snmp"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// Scalars served below snmp.base_oid. Each is exposed as <base>.<n>.0;
+// percentages and load averages are multiplied by 100.
+const (
+	snmpAgentVersion   = 1
+	snmpLoad1          = 2
+	snmpLoad5          = 3
+	snmpLoad15         = 4
+	snmpMemUsedPercent = 5
+	snmpDiskUsed       = 6
+	snmpUptime         = 7
+	snmpLastSyncOK     = 8
+	snmpLastSyncAge    = 9
+	snmpFirewallRules  = 10
+)
+
+// startSNMP serves health metrics through the local SNMP master agent
+func startSNMP(ctx context.Context, cfg *config.Config, log *logger.Logger) {
+	base, _ := snmp.ParseOID(cfg.SNMP.BaseOID)
+	// The master agent's unix socket lives on the host filesystem
+	address := cfg.SNMP.AgentXAddress
+	if !strings.HasPrefix(address, "tcp:") {
+		address = cfg.Container.HostPath(strings.TrimPrefix(address, "unix:"))
+	}
+	hostRoot := cfg.Container.HostPath("/")
+
+	subAgent := snmp.NewSubAgent(address, base, "Latitude.sh agent "+Version, func() []snmp.Variable {
+		return snmpVariables(cfg, hostRoot)
+	}, log.Logger)
+	go subAgent.Run(ctx)
+}
+
+// snmpVariables returns the current values of the exposed scalars
+func snmpVariables(cfg *config.Config, hostRoot string) []snmp.Variable {
+	scalar := func(n uint32, typ uint16, value interface{}) snmp.Variable {
+		return snmp.Variable{OID: snmp.OID{n, 0}, Type: typ, Value: value}
+	}
+	hundredths := func(v float64) uint32 {
+		if v < 0 {
+			return 0
+		}
+		return uint32(v * 100)
+	}
+
+	variables := []snmp.Variable{scalar(snmpAgentVersion, snmp.TypeOctetString, Version)}
+
+	if stats, err := collectors.GetSystemStats(); err == nil {
+		variables = append(variables,
+			scalar(snmpLoad1, snmp.TypeGauge32, hundredths(stats.Load1)),
+			scalar(snmpLoad5, snmp.TypeGauge32, hundredths(stats.Load5)),
+			scalar(snmpLoad15, snmp.TypeGauge32, hundredths(stats.Load15)),
+			scalar(snmpMemUsedPercent, snmp.TypeGauge32, hundredths(stats.MemUsedPercent())),
+			scalar(snmpUptime, snmp.TypeTimeTicks, uint32(stats.Uptime/(10*time.Millisecond))),
+		)
+	}
+	if used, err := collectors.DiskUsedPercent(hostRoot); err == nil {
+		variables = append(variables, scalar(snmpDiskUsed, snmp.TypeGauge32, hundredths(used)))
+	}
+
+	if status, err := state.LoadStatus(cfg.Agent.StateDir); err == nil {
+		// TruthValue: 1 is true, 2 is false
+		ok := 2
+		if status.Success {
+			ok = 1
+		}
+		variables = append(variables,
+			scalar(snmpLastSyncOK, snmp.TypeInteger, ok),
+			scalar(snmpLastSyncAge, snmp.TypeGauge32, uint32(time.Since(status.Timestamp).Seconds())),
+			scalar(snmpFirewallRules, snmp.TypeGauge32, uint32(status.APIRules)),
+		)
+	}
+
+	return variables
+}
@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/alerts"
+	"github.com/latitudesh/agent/internal/anomaly"
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/dns"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/reputation"
+	"github.com/latitudesh/agent/internal/schedule"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/latitudesh/agent/internal/tags"
+	"github.com/latitudesh/agent/internal/tasks"
+	"github.com/latitudesh/agent/internal/timings"
+	"github.com/latitudesh/agent/internal/userdata"
+)
+
+// startSubsystems starts the optional background subsystems enabled in the
+// configuration. Each runs on its own interval until the context is cancelled.
+func startSubsystems(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	hostRoot := cfg.Container.HostPath("/")
+
+	// External tool availability, sent with the ping when it changes
+	go runPeriodic(ctx, "capabilities", capabilityInterval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+		return refreshCapabilities(ctx, hostRoot, latitudeClient, log)
+	})
+
+	// Duration percentiles, compared with the previous agent version's
+	window, _ := time.ParseDuration(cfg.Durations.Window)
+	timings.SetWindow(window)
+	if cfg.Durations.Enabled {
+		started := time.Now()
+		go runPeriodic(ctx, "durations", durationCheckInterval, nil, log, func(ctx context.Context) error {
+			return runDurationCheck(cfg, started, log)
+		})
+	}
+
+	// First-boot provisioning
+	if cfg.UserData.Enabled {
+		go runFirstBoot(ctx, cfg, latitudeClient, log)
+	}
+
+	// User provisioning
+	if cfg.Users.Enabled {
+		userCollector := collectors.NewUserCollector(hostRoot, cfg.Agent.StateDir, log.Logger)
+		userCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Users.Interval)
+		go runPeriodic(ctx, "users", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			usersJSON, err := latitudeClient.FetchUsers(ctx, cfg.Users.Endpoint)
+			if err != nil {
+				return err
+			}
+			return userCollector.SyncUsers(ctx, usersJSON)
+		})
+	}
+
+	// OS security patching
+	if cfg.Patch.Enabled {
+		patchCollector := collectors.NewPatchCollector(hostRoot, log.Logger)
+		patchCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Patch.Interval)
+		timeout, _ := time.ParseDuration(cfg.Patch.Timeout)
+		windows, _ := schedule.ParseWindows(cfg.Patch.Windows)
+		go runPeriodic(ctx, "patches", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runPatchCycle(ctx, patchCollector, latitudeClient, cfg.Patch.Endpoint, windows, timeout, log)
+		})
+	}
+
+	// WireGuard tunnels
+	if cfg.WireGuard.Enabled {
+		wireGuardCollector := collectors.NewWireGuardCollector(cfg.WireGuard.WGBinary, cfg.WireGuard.KeyFile, cfg.Agent.StateDir, log.Logger)
+		wireGuardCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.WireGuard.Interval)
+		go runPeriodic(ctx, "wireguard", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runWireGuardCycle(ctx, wireGuardCollector, latitudeClient, cfg.WireGuard.Endpoint, log)
+		})
+	}
+
+	// Network configuration
+	if cfg.Network.Enabled {
+		interval, _ := time.ParseDuration(cfg.Network.Interval)
+		rollbackAfter, _ := time.ParseDuration(cfg.Network.RollbackAfter)
+		networkCollector := collectors.NewNetworkCollector(hostRoot, cfg.Network.ConfigDir, cfg.Agent.StateDir, cfg.Network.DryRun, rollbackAfter, log.Logger)
+		networkCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		go runPeriodic(ctx, "network", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			networkJSON, err := latitudeClient.FetchNetworkConfig(ctx, cfg.Network.Endpoint)
+			if err != nil {
+				return err
+			}
+			return networkCollector.ApplyConfig(ctx, networkJSON, latitudeClient.HealthCheck)
+		})
+	}
+
+	// DNS registration
+	if cfg.DNS.Enabled {
+		var registrar dns.Registrar
+		var stretch func() int
+		if cfg.DNS.Provider == "nsupdate" {
+			registrar = dns.NewNSUpdateRegistrar(cfg.DNS.NSUpdate.Server, cfg.DNS.NSUpdate.Zone, cfg.DNS.NSUpdate.KeyFile)
+		} else {
+			registrar = dns.NewLatitudeRegistrar(latitudeClient, cfg.DNS.Endpoint)
+			stretch = latitudeClient.IntervalFactor
+		}
+		interval, _ := time.ParseDuration(cfg.DNS.Interval)
+		refresh, _ := time.ParseDuration(cfg.DNS.Refresh)
+		updater := dns.NewUpdater(registrar, cfg.DNS.Hostname, cfg.DNS.TTL, refresh, cfg.Latitude.PublicIP, cfg.Agent.StateDir, log.Logger)
+		go runPeriodic(ctx, "dns", interval, stretch, log, updater.Update)
+	}
+
+	// Tag and metadata sync
+	if cfg.Tags.Enabled {
+		configured := tags.Set{Tags: cfg.Tags.Tags, Metadata: cfg.Tags.Metadata}
+		syncer := tags.NewSyncer(latitudeClient, cfg.Tags.Endpoint, configured, cfg.Tags.DropInDir, cfg.Tags.OutputFile, log.Logger)
+		interval, _ := time.ParseDuration(cfg.Tags.Interval)
+		go runPeriodic(ctx, "tags", interval, latitudeClient.IntervalFactor, log, syncer.Sync)
+	}
+
+	// Local alert rules
+	if cfg.Alerts.Enabled {
+		var rules []*alerts.Rule
+		for _, r := range cfg.Alerts.Rules {
+			duration, _ := time.ParseDuration(r.For)
+			rule, _ := alerts.ParseRule(r.Name, r.Expr, duration, r.Severity)
+			rules = append(rules, rule)
+		}
+		engine := alerts.NewEngine(rules,
+			func(ctx context.Context, alert alerts.Alert) error {
+				return latitudeClient.SendReport(ctx, cfg.Alerts.Endpoint, alert)
+			},
+			func(alert alerts.Alert) {
+				notifier.Notify(notify.Alert, alert.String(), map[string]string{"severity": alert.Severity})
+			},
+			log.Logger,
+		)
+		engine.SetMaintenance(maintenanceTracker.Active)
+		interval, _ := time.ParseDuration(cfg.Alerts.Interval)
+		tcpMetrics := collectors.TCPSampler()
+		go runPeriodic(ctx, "alerts", interval, nil, log, func(ctx context.Context) error {
+			stats, err := collectors.GetSystemStats()
+			if err != nil {
+				return err
+			}
+			metrics := stats.Metrics()
+			if used, err := collectors.DiskUsedPercent(hostRoot); err == nil {
+				metrics["disk_used_percent"] = used
+			}
+			if tcp, err := tcpMetrics(); err == nil {
+				maps.Copy(metrics, tcp)
+			}
+			return engine.Evaluate(ctx, metrics)
+		})
+	}
+
+	// BMC health checks
+	if cfg.BMC.Enabled {
+		bmcCollector := newBMCCollector(cfg, log)
+		interval, _ := time.ParseDuration(cfg.BMC.Interval)
+		go runPeriodic(ctx, "bmc", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runBMCCheck(ctx, bmcCollector, latitudeClient, cfg, log)
+		})
+	}
+
+	// Crash dump reporting
+	if cfg.Crash.Enabled {
+		crashCollector := collectors.NewCrashCollector(hostRoot, cfg.Crash.CrashDir, cfg.Agent.StateDir, cfg.Crash.UploadKernelLog, log.Logger)
+		interval, _ := time.ParseDuration(cfg.Crash.Interval)
+		go runPeriodic(ctx, "crash", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runCrashCheck(ctx, crashCollector, latitudeClient, cfg.Crash.Endpoint, log)
+		})
+	}
+
+	// Traffic anomaly detection
+	if cfg.DDoS.Enabled {
+		startTrafficMonitor(ctx, cfg, latitudeClient, log)
+	}
+
+	// SNMP sub-agent
+	if cfg.SNMP.Enabled {
+		startSNMP(ctx, cfg, log)
+	}
+
+	// Hostname and reverse DNS tracking
+	if cfg.Identity.Enabled {
+		identityCollector := collectors.NewIdentityCollector(cfg.Agent.StateDir, cfg.Latitude.PublicIP, log.Logger)
+		interval, _ := time.ParseDuration(cfg.Identity.Interval)
+		go runPeriodic(ctx, "identity", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runIdentityCheck(ctx, identityCollector, latitudeClient, cfg.Identity.Endpoint, log)
+		})
+	}
+
+	// Sysctl and kernel module compliance
+	if cfg.Compliance.Enabled {
+		complianceCollector := collectors.NewComplianceCollector(cfg.Compliance.Enforce, log.Logger)
+		complianceCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Compliance.Interval)
+		go runPeriodic(ctx, "compliance", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runComplianceAudit(ctx, cfg, complianceCollector, latitudeClient, log)
+		})
+	}
+
+	// Local metrics history
+	if cfg.History.Enabled {
+		startHistory(ctx, cfg, log)
+	}
+
+	// Threat intelligence feeds
+	if cfg.Reputation.Enabled {
+		manager := reputation.NewManager(reputationFeeds(cfg, latitudeClient), cfg.Reputation.SetName, cfg.Reputation.Chain, cfg.Reputation.MaxEntries, cfg.Agent.StateDir, log.Logger)
+		manager.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Reputation.Interval)
+		go runPeriodic(ctx, "reputation", interval, latitudeClient.IntervalFactor, log, manager.Refresh)
+	}
+
+	// External plugins
+	if cfg.Plugins.Enabled {
+		startPlugins(ctx, cfg, latitudeClient, log)
+	}
+
+	// BGP session monitoring
+	if cfg.BGP.Enabled {
+		bgpCollector := collectors.NewBGPCollector(hostRoot, log.Logger)
+		bgpCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		// The last health is kept across restarts so a restart does not
+		// announce a degradation that was already announced
+		var degraded bool
+		if err := state.Load(cfg.Agent.StateDir, bgpHealthFile, &degraded); err != nil && !os.IsNotExist(err) {
+			log.WithComponent("bgp").WithError(err).Warn("Failed to read saved BGP health")
+		}
+		interval, _ := time.ParseDuration(cfg.BGP.Interval)
+		go runPeriodic(ctx, "bgp", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runBGPCheck(ctx, bgpCollector, latitudeClient, cfg.BGP.Endpoint, cfg.Agent.StateDir, &degraded, log)
+		})
+	}
+
+	// Per-resolver DNS health
+	if cfg.DNSHealth.Enabled {
+		timeout, _ := time.ParseDuration(cfg.DNSHealth.Timeout)
+		dnsHealthCollector := collectors.NewDNSHealthCollector(hostRoot, cfg.DNSHealth.Query, timeout, cfg.DNSHealth.Probes, log.Logger)
+		dnsHealthCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.DNSHealth.Interval)
+		go runPeriodic(ctx, "dns_health", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runDNSHealthCheck(ctx, dnsHealthCollector, latitudeClient, cfg.DNSHealth.Endpoint, log)
+		})
+	}
+
+	// Gateway MAC and neighbor table monitoring
+	if cfg.Neighbors.Enabled {
+		neighborCollector := collectors.NewNeighborCollector(cfg.Agent.StateDir, cfg.Neighbors.OverflowPercent, log.Logger)
+		var badDrivers []collectors.BadDriver
+		for _, bad := range cfg.Neighbors.KnownBadDrivers {
+			badDrivers = append(badDrivers, collectors.BadDriver{Driver: bad.Driver, Version: bad.Version, Firmware: bad.Firmware, Reason: bad.Reason})
+		}
+		neighborCollector.SetKnownBadDrivers(badDrivers)
+		interval, _ := time.ParseDuration(cfg.Neighbors.Interval)
+		go runPeriodic(ctx, "neighbors", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runNeighborCheck(ctx, neighborCollector, latitudeClient, cfg.Neighbors.Endpoint, log)
+		})
+	}
+
+	// Disk and NIC hot-swap
+	if cfg.Devices.Enabled {
+		go watchDevices(ctx, cfg, latitudeClient, log)
+	}
+
+	// Temperature and SMART counter trends
+	if cfg.Trends.Enabled {
+		window, _ := time.ParseDuration(cfg.Trends.Window)
+		hardwareCollector := collectors.NewHardwareCollector(cfg.Agent.StateDir, window, log.Logger)
+		hardwareCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Trends.Interval)
+		go runPeriodic(ctx, "hardware_trends", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runHardwareCheck(ctx, hardwareCollector, latitudeClient, cfg.Trends.Endpoint, log)
+		})
+	}
+
+	// Filesystem fill projections
+	if cfg.DiskForecast.Enabled {
+		window, _ := time.ParseDuration(cfg.DiskForecast.Window)
+		horizon := time.Duration(cfg.DiskForecast.HorizonDays * float64(24*time.Hour))
+		diskForecastCollector := collectors.NewDiskForecastCollector(hostRoot, cfg.Agent.StateDir, window, horizon, log.Logger)
+		interval, _ := time.ParseDuration(cfg.DiskForecast.Interval)
+		var degraded bool
+		go runPeriodic(ctx, "disk_forecast", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runDiskForecastCheck(ctx, diskForecastCollector, latitudeClient, cfg.DiskForecast.Endpoint, &degraded, log)
+		})
+	}
+
+	// SMART self-test progress and outcome
+	if cfg.SelfTests.Enabled {
+		selfTestRunner := newSelfTestRunner(cfg, log)
+		interval, _ := time.ParseDuration(cfg.SelfTests.PollInterval)
+		go runPeriodic(ctx, "smart_self_tests", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runSelfTestCheck(ctx, selfTestRunner, latitudeClient, cfg.SelfTests.Endpoint, log)
+		})
+	}
+
+	// Memory tests, run in maintenance windows
+	if cfg.MemoryTest.Enabled {
+		memoryTester := collectors.NewMemoryTester(cfg.MemoryTest.MemtesterBinary, cfg.MemoryTest.FreeFraction, log.Logger)
+		memoryTester.SetCommandWrapper(privilegeWrapper(cfg)...)
+		go runPeriodic(ctx, "memory_test", time.Minute, nil, log, func(ctx context.Context) error {
+			return runMemoryTestCheck(ctx, cfg, memoryTester, latitudeClient, log)
+		})
+	}
+
+	// Backup status
+	if cfg.Backup.Enabled {
+		maxAge, _ := time.ParseDuration(cfg.Backup.MaxAge)
+		timeout, _ := time.ParseDuration(cfg.Backup.Timeout)
+		backupCollector := collectors.NewBackupCollector(hostRoot, cfg.Backup.ResticEnvFile, maxAge, log.Logger)
+		backupCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Backup.Interval)
+		go runPeriodic(ctx, "backup", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return runBackupCheck(ctx, backupCollector, latitudeClient, cfg.Backup.Endpoint, log)
+		})
+	}
+
+	// Intrusion detection
+	if cfg.Security.Enabled {
+		signatures := cfg.Security.MinerSignatures
+		if len(signatures) == 0 {
+			signatures = collectors.DefaultMinerSignatures
+		}
+		securityCollector := collectors.NewSecurityCollector(hostRoot, cfg.Agent.StateDir, cfg.Security.ScanPaths, signatures, cfg.Security.AllowedModules, log.Logger)
+		interval, _ := time.ParseDuration(cfg.Security.Interval)
+		go runPeriodic(ctx, "security", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			return runSecurityScan(ctx, securityCollector, latitudeClient, cfg.Security.Endpoint, log)
+		})
+	}
+
+	// Managed files
+	if cfg.Files.Enabled {
+		fileCollector := collectors.NewFileCollector(hostRoot, cfg.Agent.StateDir, cfg.Files.AllowedPaths, cfg.Files.AllowedHooks, log.Logger)
+		fileCollector.SetCommandWrapper(privilegeWrapper(cfg)...)
+		interval, _ := time.ParseDuration(cfg.Files.Interval)
+		go runPeriodic(ctx, "files", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+			filesJSON, err := latitudeClient.FetchFiles(ctx, cfg.Files.Endpoint)
+			if err != nil {
+				return err
+			}
+			return fileCollector.SyncFiles(ctx, filesJSON)
+		})
+	}
+
+	// Scheduled tasks
+	if cfg.Tasks.Enabled {
+		startTasks(ctx, cfg, latitudeClient, log)
+	}
+}
+
+// trafficMitigationFile records the rate limits applied during a traffic
+// anomaly, so they are removed even if the agent restarts mid-attack
+const trafficMitigationFile = "ddos-mitigation.json"
+
+// trafficStateFile keeps the last traffic counters and the anomaly
+// detector's baselines across restarts
+const trafficStateFile = "traffic.json"
+
+// trafficStateMaxAge is how old saved traffic state may be to be resumed;
+// after a longer outage the baselines are learned again
+const trafficStateMaxAge = 10 * time.Minute
+
+// trafficStateSaveInterval bounds how often traffic state is written
+const trafficStateSaveInterval = time.Minute
+
+// trafficState is the traffic monitor state saved in the state directory
+type trafficState struct {
+	Counters *collectors.TrafficCounters `json:"counters"`
+	Detector anomaly.Snapshot            `json:"detector"`
+}
+
+// startTrafficMonitor samples traffic counters and feeds the rates to the
+// anomaly detector, applying the API's mitigation rules when configured
+func startTrafficMonitor(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	warmup, _ := time.ParseDuration(cfg.DDoS.Warmup)
+	cooldown, _ := time.ParseDuration(cfg.DDoS.Cooldown)
+	thresholds := anomaly.Thresholds{
+		Multiplier:  cfg.DDoS.Multiplier,
+		MinPPS:      cfg.DDoS.MinPPS,
+		MinBPS:      cfg.DDoS.MinMbps * 1e6,
+		MinConnRate: cfg.DDoS.MinConnRate,
+		Warmup:      warmup,
+		Cooldown:    cooldown,
+	}
+
+	var mitigate func(ctx context.Context, enable bool) error
+	if cfg.DDoS.Mitigate {
+		firewallCollector := newFirewallCollector(cfg, log)
+		mitigate = func(ctx context.Context, enable bool) error {
+			return updateTrafficMitigation(ctx, cfg, latitudeClient, firewallCollector, enable, log)
+		}
+		// Rules left behind by a previous run are removed before detection
+		// starts over
+		if err := mitigate(ctx, false); err != nil {
+			log.WithComponent("ddos").WithError(err).Warn("Failed to remove stale mitigation rules")
+		}
+	}
+
+	detector := anomaly.NewDetector(thresholds,
+		func(ctx context.Context, event anomaly.Event) error {
+			return latitudeClient.SendReport(ctx, cfg.DDoS.Endpoint, event)
+		},
+		func(event anomaly.Event) {
+			notifier.Notify(notify.Traffic, event.String(), map[string]string{"metric": event.Metric, "state": event.State})
+		},
+		mitigate,
+		log.Logger,
+	)
+
+	// Counters and baselines from before a restart are picked up again, so
+	// a restart or self-update does not repeat the warmup
+	var previous *collectors.TrafficCounters
+	var saved trafficState
+	if err := state.Load(cfg.Agent.StateDir, trafficStateFile, &saved); err != nil && !os.IsNotExist(err) {
+		log.WithComponent("ddos").WithError(err).Warn("Failed to read saved traffic baselines")
+	} else if saved.Counters != nil && time.Since(saved.Counters.Time) < trafficStateMaxAge {
+		previous = saved.Counters
+		detector.Restore(saved.Detector)
+		log.WithComponent("ddos").Infof("Resumed %d traffic baselines from %s", len(saved.Detector.Baselines), saved.Counters.Time.Format(time.RFC3339))
+	}
+
+	var lastSaved time.Time
+	interval, _ := time.ParseDuration(cfg.DDoS.Interval)
+	go runPeriodic(ctx, "ddos", interval, nil, log, func(ctx context.Context) error {
+		counters, err := collectors.ReadTrafficCounters(cfg.DDoS.Interfaces)
+		if err != nil {
+			return err
+		}
+		defer func() { previous = counters }()
+		if previous == nil {
+			return nil
+		}
+		err = detector.Observe(ctx, collectors.TrafficRates(previous, counters))
+
+		if time.Since(lastSaved) >= trafficStateSaveInterval {
+			current := trafficState{Counters: counters, Detector: detector.Snapshot()}
+			if saveErr := state.Save(cfg.Agent.StateDir, trafficStateFile, current); saveErr != nil {
+				log.WithComponent("ddos").WithError(saveErr).Warn("Failed to save traffic baselines")
+			}
+			lastSaved = time.Now()
+		}
+		return err
+	})
+}
+
+// updateTrafficMitigation inserts the API's pre-approved rate limits, or
+// removes the ones recorded as applied
+func updateTrafficMitigation(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, firewallCollector *collectors.FirewallCollector, enable bool, log *logger.Logger) error {
+	// UFW is also modified by collection cycles
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+
+	var applied []collectors.FirewallRule
+	if err := state.Load(cfg.Agent.StateDir, trafficMitigationFile, &applied); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !enable {
+		var remaining []collectors.FirewallRule
+		for _, rule := range applied {
+			if err := firewallCollector.DeleteLimitRule(ctx, rule); err != nil {
+				log.WithComponent("ddos").WithError(err).Errorf("Failed to remove mitigation rule %s", rule)
+				remaining = append(remaining, rule)
+			}
+		}
+		if err := state.Save(cfg.Agent.StateDir, trafficMitigationFile, remaining); err != nil {
+			return err
+		}
+		if len(remaining) > 0 {
+			return fmt.Errorf("%d mitigation rules could not be removed", len(remaining))
+		}
+		return nil
+	}
+
+	rulesJSON, err := latitudeClient.FetchMitigationRules(ctx, cfg.DDoS.Endpoint+"/mitigations")
+	if err != nil {
+		return err
+	}
+	rules, err := collectors.ParseMitigationRules(rulesJSON)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("no mitigation rules are defined for this server")
+	}
+
+	var failed int
+	for _, rule := range rules {
+		if err := firewallCollector.InsertLimitRule(ctx, rule); err != nil {
+			log.WithComponent("ddos").WithError(err).Errorf("Failed to apply mitigation rule %s", rule)
+			failed++
+			continue
+		}
+		applied = append(applied, rule)
+	}
+	if err := state.Save(cfg.Agent.StateDir, trafficMitigationFile, applied); err != nil {
+		return err
+	}
+	if failed == len(rules) {
+		return fmt.Errorf("none of the %d mitigation rules could be applied", len(rules))
+	}
+	return nil
+}
+
+// startTasks starts the task scheduler with the local tasks and periodically
+// merges in the tasks defined in the API
+func startTasks(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	defaultTimeout, _ := time.ParseDuration(cfg.Tasks.DefaultTimeout)
+	var localTasks []*tasks.Task
+	for _, t := range cfg.Tasks.Tasks {
+		task := &tasks.Task{Name: t.Name, Command: t.Command, Args: t.Args, Schedule: t.Schedule, Timeout: t.Timeout}
+		task.Prepare(defaultTimeout)
+		localTasks = append(localTasks, task)
+	}
+
+	scheduler := tasks.NewScheduler(func(ctx context.Context, result tasks.Result) error {
+		return latitudeClient.SendReport(ctx, cfg.Tasks.Endpoint+"/results", result)
+	}, log.Logger)
+	if cfg.Container.Active() {
+		scheduler.SetCommandWrapper("chroot", cfg.Container.HostRoot)
+	}
+	scheduler.SetTasks(localTasks)
+	go scheduler.Run(ctx)
+
+	interval, _ := time.ParseDuration(cfg.Tasks.RefreshInterval)
+	go runPeriodic(ctx, "tasks", interval, latitudeClient.IntervalFactor, log, func(ctx context.Context) error {
+		tasksJSON, err := latitudeClient.FetchTasks(ctx, cfg.Tasks.Endpoint)
+		if err != nil {
+			return err
+		}
+		remoteTasks, err := tasks.ParseTasks(tasksJSON, cfg.Tasks.ScriptDir, defaultTimeout)
+		if err != nil {
+			return err
+		}
+
+		merged := append([]*tasks.Task{}, localTasks...)
+		names := make(map[string]bool)
+		for _, task := range localTasks {
+			names[task.Name] = true
+		}
+		for _, task := range remoteTasks {
+			if names[task.Name] {
+				log.WithComponent("tasks").Warnf("Ignoring API task %s, a local task has the same name", task.Name)
+				continue
+			}
+			names[task.Name] = true
+			merged = append(merged, task)
+		}
+		scheduler.SetTasks(merged)
+		return nil
+	})
+}
+
+// newBMCCollector creates the BMC collector from the configuration
+func newBMCCollector(cfg *config.Config, log *logger.Logger) *collectors.BMCCollector {
+	return collectors.NewBMCCollector(cfg.BMC.IPMIToolBinary, cfg.BMC.Host, cfg.BMC.Username, cfg.BMC.Password, cfg.BMC.Interface, log.Logger)
+}
+
+// runBMCCheck checks the BMC and reports its health to the API
+func runBMCCheck(ctx context.Context, bmcCollector *collectors.BMCCollector, latitudeClient *client.LatitudeClient, cfg *config.Config, log *logger.Logger) error {
+	report := bmcCollector.Check(ctx)
+
+	if report.SELPercentUsed >= cfg.BMC.SELWarnPercent {
+		log.WithComponent("bmc").Warnf("BMC system event log is %d%% full", report.SELPercentUsed)
+	}
+	if report.Reachable && !report.SOLEnabled && !report.WebConsole {
+		log.WithComponent("bmc").Warn("No remote console available on the BMC")
+	}
+
+	if err := latitudeClient.SendReport(ctx, cfg.BMC.Endpoint, report); err != nil {
+		log.WithError(err).Warn("Failed to report BMC health")
+	}
+
+	if !report.Reachable {
+		return fmt.Errorf("BMC unreachable: %s", strings.Join(report.Errors, "; "))
+	}
+	return nil
+}
+
+// runPeriodic runs a background task immediately and then on every interval
+// until the context is cancelled, logging each run like a collector. Runs
+// that would overlap the previous one are skipped. Tasks that call the API
+// pass its IntervalFactor as stretch, so they back off with the main cycle
+// while the API is under pressure; local tasks pass nil.
+func runPeriodic(ctx context.Context, name string, interval time.Duration, stretch func() int, log *logger.Logger, task func(context.Context) error) {
+	schedule := newCycleSchedule(name, interval, log)
+	schedule.stretch = stretch
+
+	for {
+		start := time.Now()
+		err := task(ctx)
+		timings.Since("collector:"+name, start)
+		log.LogCollectorRun(name, time.Since(start).String(), err == nil, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-schedule.next():
+		}
+	}
+}
+
+// runPatchCycle checks for pending security updates, applies them when inside
+// a maintenance window and reports the outcome to the API
+func runPatchCycle(ctx context.Context, patchCollector *collectors.PatchCollector, latitudeClient *client.LatitudeClient, endpoint string, windows []*schedule.Window, timeout time.Duration, log *logger.Logger) error {
+	pending, err := patchCollector.PendingSecurityUpdates(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list pending security updates: %w", err)
+	}
+	log.WithComponent("patches").Infof("Found %d pending security updates", len(pending))
+
+	var report *collectors.PatchReport
+	if len(pending) > 0 && schedule.InAny(windows, time.Now()) {
+		log.WithComponent("patches").Info("Inside maintenance window, applying security updates")
+		applyCtx, cancel := context.WithTimeout(ctx, timeout)
+		report = patchCollector.ApplySecurityUpdates(applyCtx, pending)
+		cancel()
+	} else {
+		report = &collectors.PatchReport{
+			Timestamp:      time.Now(),
+			Pending:        pending,
+			Success:        true,
+			RebootRequired: patchCollector.RebootRequired(ctx),
+		}
+		report.PackageManager, _ = patchCollector.PackageManager()
+	}
+
+	if report.RebootRequired {
+		log.WithComponent("patches").Warn("Reboot required to complete updates, awaiting approval through a reboot action")
+	}
+
+	if err := latitudeClient.SendReport(ctx, endpoint, report); err != nil {
+		log.WithError(err).Warn("Failed to report patch results")
+	}
+
+	if !report.Success {
+		return fmt.Errorf("applying security updates failed: %s", report.Error)
+	}
+	return nil
+}
+
+// runWireGuardCycle fetches the WireGuard configuration, applies it and
+// reports peer handshake health to the API
+func runWireGuardCycle(ctx context.Context, wireGuardCollector *collectors.WireGuardCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	publicKey, err := wireGuardCollector.PublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	configJSON, err := latitudeClient.FetchWireGuardConfig(ctx, endpoint, publicKey)
+	if err != nil {
+		return err
+	}
+	syncErr := wireGuardCollector.SyncInterfaces(ctx, configJSON)
+
+	peers, err := wireGuardCollector.PeerStatus(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Failed to read WireGuard peer status")
+	}
+	for _, peer := range peers {
+		if !peer.Healthy {
+			log.WithComponent("wireguard").Warnf("No recent handshake with peer %s on %s", peer.PublicKey, peer.Interface)
+		}
+	}
+
+	report := map[string]interface{}{
+		"timestamp":  time.Now(),
+		"public_key": publicKey,
+		"peers":      peers,
+	}
+	if syncErr != nil {
+		report["error"] = syncErr.Error()
+	}
+	if err := latitudeClient.SendReport(ctx, endpoint+"/status", report); err != nil {
+		log.WithError(err).Warn("Failed to report WireGuard status")
+	}
+
+	return syncErr
+}
+
+// runCrashCheck reports kdump status and new crash dumps to the API
+func runCrashCheck(ctx context.Context, crashCollector *collectors.CrashCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report, err := crashCollector.Collect()
+	if err != nil {
+		return fmt.Errorf("failed to collect crash dumps: %w", err)
+	}
+
+	if !report.KdumpLoaded {
+		log.WithComponent("crash").Warn("kdump is not armed, kernel crashes will not be captured")
+	}
+	for _, dump := range report.NewDumps {
+		log.WithComponent("crash").Warnf("Found kernel crash dump %s from %s", dump.Name, dump.Time.Format(time.RFC3339))
+	}
+
+	if err := latitudeClient.SendReport(ctx, endpoint, report); err != nil {
+		return err
+	}
+	return crashCollector.MarkReported(report)
+}
+
+// bgpHealthFile records whether network health was last seen degraded
+const bgpHealthFile = "bgp-health.json"
+
+// runBGPCheck reports BGP session state and announces when network health
+// becomes degraded or recovers. degraded holds the previous check's health,
+// which is saved to stateDir when it changes.
+func runBGPCheck(ctx context.Context, bgpCollector *collectors.BGPCollector, latitudeClient *client.LatitudeClient, endpoint, stateDir string, degraded *bool, log *logger.Logger) error {
+	report, collectErr := bgpCollector.Collect(ctx)
+	if collectErr != nil {
+		log.WithComponent("bgp").WithError(collectErr).Warn("Failed to query BGP daemons")
+	}
+	if len(report.Daemons) == 0 {
+		return fmt.Errorf("no supported BGP daemon found (FRR, BIRD)")
+	}
+
+	down := report.DownSessions()
+	for _, session := range down {
+		log.WithComponent("bgp").Warnf("BGP session with %s (%s) is %s", session.Neighbor, session.Name, session.State)
+	}
+	if report.Degraded != *degraded {
+		if report.Degraded {
+			notifier.Notify(notify.HealthChanged, "Network health degraded, BGP sessions are down", map[string]string{"down_sessions": fmt.Sprint(len(down))})
+		} else {
+			notifier.Notify(notify.HealthChanged, "Network health recovered, all BGP sessions are established", nil)
+		}
+		*degraded = report.Degraded
+		if err := state.Save(stateDir, bgpHealthFile, report.Degraded); err != nil {
+			log.WithComponent("bgp").WithError(err).Warn("Failed to save BGP health")
+		}
+	}
+
+	if err := latitudeClient.SendReport(ctx, endpoint, report); err != nil {
+		return err
+	}
+	return collectErr
+}
+
+// runDNSHealthCheck probes each configured resolver and reports their health
+func runDNSHealthCheck(ctx context.Context, dnsHealthCollector *collectors.DNSHealthCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report, err := dnsHealthCollector.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		log.WithComponent("dns_health").Warn(issue)
+	}
+	return latitudeClient.SendReport(ctx, endpoint, report)
+}
+
+// runNeighborCheck reports the gateways and neighbor table, announcing
+// gateway MAC changes and a neighbor table close to overflowing
+func runNeighborCheck(ctx context.Context, neighborCollector *collectors.NeighborCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report, err := neighborCollector.Check(ctx)
+	if err != nil {
+		return err
+	}
+	for _, event := range report.Events {
+		log.WithComponent("neighbors").Warn(event)
+		notifier.Notify(notify.Network, event, nil)
+	}
+
+	if err := latitudeClient.SendReport(ctx, endpoint, report); err != nil {
+		return err
+	}
+	return neighborCollector.MarkReported(report)
+}
+
+// runHardwareCheck reports hardware trends, warning about those hinting at
+// a failing or overheating device
+func runHardwareCheck(ctx context.Context, hardwareCollector *collectors.HardwareCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report, err := hardwareCollector.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, failure := range report.Errors {
+		log.WithComponent("hardware_trends").Debugf("Failed to read SMART attributes of %s", failure)
+	}
+	for _, hint := range report.Hints {
+		log.WithComponent("hardware_trends").Warn(hint)
+	}
+
+	return latitudeClient.SendReport(ctx, endpoint, report)
+}
+
+// runDiskForecastCheck reports when each filesystem is projected to fill
+// up, notifying when one starts or stops being projected to fill up within
+// the horizon. degraded holds the previous check's health.
+func runDiskForecastCheck(ctx context.Context, diskForecastCollector *collectors.DiskForecastCollector, latitudeClient *client.LatitudeClient, endpoint string, degraded *bool, log *logger.Logger) error {
+	report, err := diskForecastCollector.Collect()
+	if err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		log.WithComponent("disk_forecast").Warn(issue)
+	}
+	if report.Degraded != *degraded {
+		if report.Degraded {
+			notifier.Notify(notify.HealthChanged, "Disk health degraded, "+strings.Join(report.Issues, "; "), nil)
+		} else {
+			notifier.Notify(notify.HealthChanged, "Disk health recovered, no filesystem is projected to fill up soon", nil)
+		}
+		*degraded = report.Degraded
+	}
+
+	return latitudeClient.SendReport(ctx, endpoint, report)
+}
+
+// runBackupCheck reports the last successful backup of each detected tool
+func runBackupCheck(ctx context.Context, backupCollector *collectors.BackupCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report := backupCollector.Collect(ctx)
+	if len(report.Backups) == 0 {
+		log.WithComponent("backup").Debug("No supported backup tool found")
+	}
+	for _, backup := range report.Backups {
+		switch {
+		case backup.Error != "":
+			log.WithComponent("backup").Warnf("Failed to check %s backups: %s", backup.Tool, backup.Error)
+		case backup.LastSuccess == nil:
+			log.WithComponent("backup").Warnf("No successful %s backup found", backup.Tool)
+		case backup.Stale:
+			log.WithComponent("backup").Warnf("Last successful %s backup is stale (%s)", backup.Tool, backup.LastSuccess.Format(time.RFC3339))
+		}
+	}
+
+	return latitudeClient.SendReport(ctx, endpoint, report)
+}
+
+// runSecurityScan reports security findings to the API and announces new
+// ones as security events
+func runSecurityScan(ctx context.Context, securityCollector *collectors.SecurityCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report, err := securityCollector.Scan()
+	if err != nil {
+		return fmt.Errorf("failed to run security scan: %w", err)
+	}
+
+	for _, finding := range report.Findings {
+		if !finding.New {
+			continue
+		}
+		log.WithComponent("security").Warnf("Security finding (%s): %s", finding.Severity, finding.Description)
+		fields := map[string]string{"type": finding.Type, "severity": finding.Severity}
+		if finding.Path != "" {
+			fields["path"] = finding.Path
+		}
+		if finding.PID != 0 {
+			fields["pid"] = fmt.Sprint(finding.PID)
+		}
+		notifier.Notify(notify.Security, finding.Description, fields)
+	}
+
+	if err := deliverEvent(ctx, latitudeClient, eventSecurity, endpoint, eventKey(eventSecurity, report.Timestamp), report); err != nil {
+		return err
+	}
+	return securityCollector.MarkReported(report)
+}
+
+// runIdentityCheck reports hostname, FQDN and reverse DNS changes
+func runIdentityCheck(ctx context.Context, identityCollector *collectors.IdentityCollector, latitudeClient *client.LatitudeClient, endpoint string, log *logger.Logger) error {
+	report, err := identityCollector.Check(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check server identity: %w", err)
+	}
+	if report == nil {
+		return nil
+	}
+
+	for _, change := range report.Changes {
+		log.WithComponent("identity").Warnf("Server identity changed: %s", change)
+	}
+	if len(report.Changes) > 0 {
+		notifier.Notify(notify.Identity, "Server identity changed: "+strings.Join(report.Changes, "; "), map[string]string{
+			"hostname": report.Current.Hostname,
+			"fqdn":     report.Current.FQDN,
+		})
+	}
+
+	if err := latitudeClient.SendReport(ctx, endpoint, report); err != nil {
+		return err
+	}
+	return identityCollector.MarkReported(report)
+}
+
+// runComplianceAudit audits the host against the API and local compliance
+// policies and reports violations
+func runComplianceAudit(ctx context.Context, cfg *config.Config, complianceCollector *collectors.ComplianceCollector, latitudeClient *client.LatitudeClient, log *logger.Logger) error {
+	policyJSON, err := latitudeClient.FetchCompliancePolicy(ctx, cfg.Compliance.Endpoint)
+	if err != nil {
+		return err
+	}
+	policy, err := collectors.ParseCompliancePolicy(policyJSON)
+	if err != nil {
+		return err
+	}
+	policy.Merge(&collectors.CompliancePolicy{
+		Sysctls:          cfg.Compliance.Sysctls,
+		ForbiddenModules: cfg.Compliance.ForbiddenModules,
+	})
+
+	report, err := complianceCollector.Audit(ctx, policy)
+	if err != nil {
+		return err
+	}
+	for _, check := range report.Sysctls {
+		if !check.Compliant {
+			log.WithComponent("compliance").Warnf("Sysctl %s is %q, expected %q %s", check.Key, check.Actual, check.Expected, check.Error)
+		}
+	}
+	for _, check := range report.Modules {
+		if check.Loaded {
+			log.WithComponent("compliance").Warnf("Forbidden kernel module %s is loaded", check.Name)
+		}
+	}
+
+	return latitudeClient.SendReport(ctx, cfg.Compliance.Endpoint, report)
+}
+
+// reputationFeedTimeout bounds downloading a custom reputation feed
+const reputationFeedTimeout = time.Minute
+
+// reputationFeeds returns the configured threat intelligence feeds. The
+// Latitude.sh feed is fetched with the agent's credentials; custom feeds are
+// fetched anonymously.
+func reputationFeeds(cfg *config.Config, latitudeClient *client.LatitudeClient) []reputation.Feed {
+	var feeds []reputation.Feed
+	if cfg.Reputation.LatitudeFeed {
+		feeds = append(feeds, reputation.Feed{
+			Name: "latitude",
+			Fetch: func(ctx context.Context, etag string) (string, string, bool, error) {
+				return latitudeClient.FetchFeed(ctx, cfg.Reputation.Endpoint, etag)
+			},
+		})
+	}
+
+	httpClient := &http.Client{Timeout: reputationFeedTimeout}
+	for _, f := range cfg.Reputation.Feeds {
+		feedURL := f.URL
+		feeds = append(feeds, reputation.Feed{
+			Name: f.Name,
+			Fetch: func(ctx context.Context, etag string) (string, string, bool, error) {
+				req, err := http.NewRequestWithContext(ctx, "GET", feedURL, nil)
+				if err != nil {
+					return "", "", false, err
+				}
+				return client.DoFeedRequest(httpClient, req, etag)
+			},
+		})
+	}
+	return feeds
+}
+
+// firstBootRetry is how long to wait before fetching user-data again, e.g.
+// while the network is still coming up on first boot
+const firstBootRetry = 30 * time.Second
+
+// runFirstBoot runs the project's user-data scripts once per server, retrying
+// the fetch until it succeeds
+func runFirstBoot(ctx context.Context, cfg *config.Config, latitudeClient *client.LatitudeClient, log *logger.Logger) {
+	completed, err := userdata.Completed(cfg.Agent.StateDir)
+	if err != nil {
+		log.WithError(err).Error("Failed to read user-data state, not running user-data")
+		return
+	}
+	if completed != nil {
+		log.WithComponent("user-data").Debugf("User-data already ran at %s", completed.CompletedAt.Format(time.RFC3339))
+		return
+	}
+
+	timeout, _ := time.ParseDuration(cfg.UserData.Timeout)
+	runner := userdata.NewRunner(cfg.Container.HostPath("/"), cfg.UserData.ScriptDir, cfg.UserData.LogFile, cfg.Agent.StateDir, timeout, log.Logger)
+	if cfg.Container.Active() {
+		runner.SetCommandWrapper("chroot", cfg.Container.HostRoot)
+	}
+
+	var userDataJSON string
+	for {
+		userDataJSON, err = latitudeClient.FetchUserData(ctx, cfg.UserData.Endpoint)
+		if err == nil {
+			break
+		}
+		log.WithError(err).Warnf("Failed to fetch user-data, retrying in %s", firstBootRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(firstBootRetry):
+		}
+	}
+
+	start := time.Now()
+	report, err := runner.Run(ctx, userDataJSON)
+	timings.Since("collector:user-data", start)
+	if report != nil {
+		log.LogCollectorRun("user-data", time.Since(start).String(), report.Success, err)
+		if sendErr := latitudeClient.SendReport(ctx, cfg.UserData.Endpoint, report); sendErr != nil {
+			log.WithError(sendErr).Warn("Failed to report user-data results")
+		}
+	} else {
+		log.WithError(err).Error("User-data provisioning failed")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// ANSI colors of the diff output
+const (
+	colorReset = "\033[0m"
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorCyan  = "\033[36m"
+)
+
+// runSync runs a single collection cycle, or with -dry-run prints the rule
+// changes it would make as a unified diff or JSON
+func runSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	dryRun := fs.Bool("dry-run", false, "Print the rule changes without applying them")
+	jsonOutput := fs.Bool("json", false, "Print the dry-run changes as JSON")
+	record := fs.String("record", "", "Record API requests and responses to this file")
+	replay := fs.String("replay", "", "Answer API requests from a recording instead of the API")
+	fs.Parse(args)
+
+	if *jsonOutput && !*dryRun {
+		fmt.Fprintln(os.Stderr, "-json requires -dry-run")
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if !cfg.Firewall.Enabled {
+		fmt.Fprintln(os.Stderr, "Firewall synchronization is disabled")
+		return 1
+	}
+
+	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		return 1
+	}
+	if *dryRun {
+		// Log output would get in the way of the diff
+		log.SetOutput(io.Discard)
+	}
+
+	commandTimeout, _ := time.ParseDuration(cfg.Agent.CommandTimeout)
+	command.Configure(cfg.Agent.MaxCommands, commandTimeout)
+	command.Observe(log.Logger, cfg.Agent.ExecAuditLog)
+	pinTools(cfg, log)
+	simulateHost(cfg, log)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	latitudeClient := newLatitudeClient(cfg, log.Logger)
+	if err := setupRecording(latitudeClient, *record, *replay, log); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	setupInstance(cfg, latitudeClient, log)
+	firewallCollector := newFirewallCollector(cfg, log)
+
+	if !*dryRun {
+		// Never modify UFW while the agent is doing the same
+		lock, err := state.AcquireLock(cfg.Agent.StateDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to sync: %v\n", err)
+			return 1
+		}
+		defer lock.Release()
+
+		setupNotifier(cfg, log)
+		setupTenants(cfg, firewallCollector, log)
+		if err := runCollection(ctx, latitudeClient, firewallCollector, cfg, log); err != nil {
+			fmt.Fprintf(os.Stderr, "Sync failed: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	rulesJSON, err := fetchFirewallRules(ctx, cfg, latitudeClient, log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch firewall rules: %v\n", err)
+		return 1
+	}
+	plan, err := firewallCollector.PlanFirewallRules(ctx, rulesJSON)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compute rule changes: %v\n", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Print(unifiedDiff(plan, useColor(os.Stdout)))
+	return 0
+}
+
+// unifiedDiff renders a plan as a unified diff from the UFW rules to the API
+// rules, one rule per line. It is empty when there are no changes.
+func unifiedDiff(plan *collectors.Plan, color bool) string {
+	if len(plan.Add) == 0 && len(plan.Remove) == 0 {
+		return ""
+	}
+
+	type line struct {
+		prefix string
+		rule   string
+	}
+	var lines []line
+	for _, rule := range plan.Keep {
+		lines = append(lines, line{" ", rule.String()})
+	}
+	for _, rule := range plan.Remove {
+		lines = append(lines, line{"-", rule.String()})
+	}
+	for _, rule := range plan.Add {
+		lines = append(lines, line{"+", rule.String()})
+	}
+	// Removals come before additions of the same rule text, as in diff -u
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].rule < lines[j].rule })
+
+	paint := func(s, c string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+
+	var b strings.Builder
+	b.WriteString(paint("--- ufw", colorRed) + "\n")
+	b.WriteString(paint("+++ api", colorGreen) + "\n")
+	oldCount := len(plan.Keep) + len(plan.Remove)
+	newCount := len(plan.Keep) + len(plan.Add)
+	b.WriteString(paint(fmt.Sprintf("@@ -%s +%s @@", hunkRange(oldCount), hunkRange(newCount)), colorCyan) + "\n")
+	for _, l := range lines {
+		switch l.prefix {
+		case "-":
+			b.WriteString(paint("-"+l.rule, colorRed) + "\n")
+		case "+":
+			b.WriteString(paint("+"+l.rule, colorGreen) + "\n")
+		default:
+			b.WriteString(" " + l.rule + "\n")
+		}
+	}
+	return b.String()
+}
+
+// hunkRange formats the start and length of a hunk side; an empty side
+// starts at line 0
+func hunkRange(count int) string {
+	if count == 0 {
+		return "0,0"
+	}
+	return fmt.Sprintf("1,%d", count)
+}
+
+// useColor reports whether output to f should be colorized: when it is a
+// terminal and NO_COLOR is not set
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/tags"
+)
+
+// ruleFacts returns the facts template variables in firewall rules resolve
+// to: those discovered on the host, and tag.<key> for each tag metadata
+// value, split on commas
+func ruleFacts(cfg *config.Config, log *logger.Logger) collectors.RuleFacts {
+	facts := collectors.HostFacts(cfg.Container.HostPath("/"), cfg.Latitude.PublicIP)
+
+	configured := tags.Set{Tags: cfg.Tags.Tags, Metadata: cfg.Tags.Metadata}
+	local, err := tags.NewSyncer(nil, "", configured, cfg.Tags.DropInDir, "", log.Logger).Local()
+	if err != nil {
+		log.WithComponent("firewall").WithError(err).Warn("Failed to read tags for rule templates")
+		return facts
+	}
+	for key, value := range local.Metadata {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				facts["tag."+key] = append(facts["tag."+key], v)
+			}
+		}
+	}
+	return facts
+}
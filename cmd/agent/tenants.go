@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/latitudesh/agent/internal/timings"
+)
+
+// tenant is an additional firewall managed on a shared host, with its own
+// API identity and a collector scoped to its interface or addresses
+type tenant struct {
+	firewallID string
+	client     *client.LatitudeClient
+	collector  *collectors.FirewallCollector
+}
+
+// tenants are the additional firewalls, empty unless firewall.tenants is
+// configured
+var tenants []*tenant
+
+// setupTenants creates a client and scoped collector per configured tenant
+func setupTenants(cfg *config.Config, firewallCollector *collectors.FirewallCollector, log *logger.Logger) {
+	if firewallCollector == nil {
+		return
+	}
+	for _, t := range cfg.Firewall.Tenants {
+		publicIP := t.PublicIP
+		if publicIP == "" {
+			publicIP = cfg.Latitude.PublicIP
+		}
+		tenantClient := client.NewLatitudeClient(
+			cfg.Latitude.BearerToken,
+			cfg.Latitude.APIEndpoint,
+			cfg.Latitude.ProjectID,
+			t.FirewallID,
+			publicIP,
+			log.Logger,
+		)
+		if cfg.Latitude.RelayURL != "" {
+			tenantClient.SetRelay(cfg.Latitude.RelayURL)
+		}
+		tenants = append(tenants, &tenant{
+			firewallID: t.FirewallID,
+			client:     tenantClient,
+			collector:  firewallCollector.ForTenant(t.FirewallID, t.Interface, t.To),
+		})
+		log.WithComponent("firewall").WithField("firewall_id", t.FirewallID).Info("Managing additional firewall")
+	}
+}
+
+// syncTenants synchronizes every tenant firewall, recording each outcome in
+// status. A failing tenant does not stop the others; the returned error
+// names the tenants that failed.
+func syncTenants(ctx context.Context, status *state.Status, log *logger.Logger) error {
+	var failed []string
+	for _, t := range tenants {
+		if status.Tenants == nil {
+			status.Tenants = make(map[string]*state.TenantStatus)
+		}
+		tenantStatus := status.Tenants[t.firewallID]
+		if tenantStatus == nil {
+			tenantStatus = &state.TenantStatus{}
+			status.Tenants[t.firewallID] = tenantStatus
+		}
+
+		err := syncTenant(ctx, t, tenantStatus, log)
+		tenantStatus.Success = err == nil
+		t.client.SetLastError(err)
+		if err != nil {
+			tenantStatus.Error = err.Error()
+			log.WithComponent("firewall").WithField("firewall_id", t.firewallID).WithError(err).Error("Tenant firewall synchronization failed")
+			notifier.Notify(notify.SyncFailed, "Tenant firewall synchronization failed", map[string]string{"firewall_id": t.firewallID, "error": err.Error()})
+			failed = append(failed, t.firewallID)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("firewall synchronization failed for tenants %v", failed)
+	}
+	return nil
+}
+
+// syncTenant fetches one tenant's rules and synchronizes them
+func syncTenant(ctx context.Context, t *tenant, status *state.TenantStatus, log *logger.Logger) error {
+	rulesJSON, err := t.client.PingAndGetFirewallRules(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch firewall rules: %w", err)
+	}
+	if err := t.client.ValidateFirewallResponse(rulesJSON); err != nil {
+		return fmt.Errorf("API response validation failed: %w", err)
+	}
+	if displayRules, err := t.client.GetFirewallRulesForDisplay(rulesJSON); err == nil {
+		status.APIRules = len(displayRules)
+	}
+
+	collectorStart := time.Now()
+	result, err := t.collector.SyncFirewallRules(ctx, rulesJSON)
+	timings.Since("collector:firewall:"+t.firewallID, collectorStart)
+	log.LogCollectorRun("firewall:"+t.firewallID, time.Since(collectorStart).String(), err == nil, err)
+	if err != nil {
+		return fmt.Errorf("firewall synchronization failed: %w", err)
+	}
+	status.Sync = result
+	log.WithComponent("firewall").WithField("firewall_id", t.firewallID).Infof("Firewall synchronization: %s", result)
+	if len(result.Failed) == 0 {
+		synced := time.Now()
+		status.LastSynced = &synced
+	}
+	return nil
+}
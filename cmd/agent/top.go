@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/config"
+	"github.com/latitudesh/agent/internal/logger"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// runTop renders a live status view of the agent until interrupted
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	configPath := fs.String("config", config.DefaultConfigPath(), "Path to configuration file")
+	refresh := fs.Duration("refresh", 5*time.Second, "Screen refresh interval")
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+
+	// Regular log output would scroll the screen, so discard it
+	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		return 1
+	}
+	log.SetOutput(io.Discard)
+
+	firewallCollector := newFirewallCollector(cfg, log)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	ticker := time.NewTicker(*refresh)
+	defer ticker.Stop()
+
+	for {
+		screen := renderTop(ctx, cfg, firewallCollector)
+		// Move the cursor home and clear the screen before redrawing
+		fmt.Print("\033[H\033[2J" + screen)
+
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// renderTop builds a single frame of the status view. It never calls the
+// API: that would add load and overwrite the running agent's status, so the
+// rules are those the agent last fetched.
+func renderTop(ctx context.Context, cfg *config.Config, firewallCollector *collectors.FirewallCollector) string {
+	var b strings.Builder
+	now := time.Now()
+
+	fmt.Fprintf(&b, "Latitude.sh Agent v%s - %s\n\n", Version, now.Format("2006-01-02 15:04:05"))
+
+	// Host health
+	b.WriteString("Host\n")
+	if stats, err := collectors.GetSystemStats(); err != nil {
+		fmt.Fprintf(&b, "  unavailable: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "  Uptime: %s  Load: %.2f %.2f %.2f  Memory: %.1f%% used of %d MiB\n",
+			stats.Uptime, stats.Load1, stats.Load5, stats.Load15,
+			stats.MemUsedPercent(), stats.MemTotalKB/1024)
+	}
+
+	// Rules last fetched by the running agent
+	b.WriteString("\nAPI\n")
+	fmt.Fprintf(&b, "  Endpoint: %s\n", cfg.Latitude.APIEndpoint)
+	var rulesJSON string
+	if firewallCollector != nil {
+		rules, updated, err := firewallCollector.LoadRulesFile(cfg.Firewall.OutputFile)
+		if err != nil {
+			b.WriteString("  Rules:    none fetched yet\n")
+		} else {
+			rulesJSON = rules
+			fmt.Fprintf(&b, "  Rules:    fetched %s (%s ago)\n", updated.Format("2006-01-02 15:04:05"), now.Sub(updated).Round(time.Second))
+		}
+	}
+
+	// Last sync performed by the running agent
+	b.WriteString("\nLast sync\n")
+	if status, err := state.LoadStatus(cfg.Agent.StateDir); err != nil {
+		b.WriteString("  no sync recorded yet\n")
+	} else {
+		result := "success"
+		if !status.Success {
+			result = "failed"
+		}
+		fmt.Fprintf(&b, "  Time:     %s (%s ago)\n", status.Timestamp.Format("2006-01-02 15:04:05"), now.Sub(status.Timestamp).Round(time.Second))
+		fmt.Fprintf(&b, "  Result:   %s in %s, %d API rules\n", result, status.Duration, status.APIRules)
+		if status.Error != "" {
+			fmt.Fprintf(&b, "  Error:    %s\n", status.Error)
+		}
+		if status.PausedUntil != nil && now.Before(*status.PausedUntil) {
+			fmt.Fprintf(&b, "  Paused:   until %s\n", status.PausedUntil.Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	// Pending rule diff
+	b.WriteString("\nPending rule diff\n")
+	switch {
+	case firewallCollector == nil:
+		b.WriteString("  firewall synchronization disabled\n")
+	case rulesJSON == "":
+		b.WriteString("  unknown (no rules fetched yet)\n")
+	default:
+		toAdd, toRemove, err := firewallCollector.DiffFirewallRules(ctx, rulesJSON)
+		if err != nil {
+			fmt.Fprintf(&b, "  unavailable: %v\n", err)
+			break
+		}
+		if len(toAdd) == 0 && len(toRemove) == 0 {
+			b.WriteString("  in sync\n")
+		}
+		for _, rule := range toAdd {
+			fmt.Fprintf(&b, "  + %s\n", rule.String())
+		}
+		for _, rule := range toRemove {
+			fmt.Fprintf(&b, "  - %s\n", rule.String())
+		}
+	}
+
+	b.WriteString("\nPress Ctrl+C to exit\n")
+	return b.String()
+}
@@ -2,7 +2,8 @@
 
 # Function to display usage
 usage() {
-    echo "Usage: $0 -firewall <firewall_id> -project <project_id> [-extra_parameters <extra_parameters>] [-public_ip <public_ip>]"
+    echo "Usage: $0 [-firewall <firewall_id>] [-project <project_id>] [-extra_parameters <extra_parameters>] [-public_ip <public_ip>]"
+    echo "On Latitude.sh hardware the IDs are discovered from the metadata service when omitted."
     exit 1
 }
 
@@ -36,10 +37,14 @@ while [[ $# -gt 0 ]]; do
     esac
 done
 
-# Check if firewall ID and project ID are provided
+# Without IDs, the agent discovers them from the metadata service
+METADATA_URL="http://169.254.169.254/latitude/v1/metadata"
 if [ -z "$FIREWALL_ID" ] || [ -z "$PROJECT_ID" ]; then
-    echo "Error: Both Firewall ID and Project ID are required."
-    usage
+    if ! curl -sf --max-time 3 "$METADATA_URL" > /dev/null; then
+        echo "Error: Firewall ID and Project ID are required off Latitude.sh hardware."
+        usage
+    fi
+    echo "Firewall and project IDs will be discovered from the metadata service"
 fi
 
 # Check if running as root
@@ -146,15 +151,18 @@ User=root
 WantedBy=multi-user.target
 EOF
 
-# Get public IP address if PUBLIC_IP was not provided
-if [ -z "$PUBLIC_IP" ]; then
+# Get public IP address if PUBLIC_IP was not provided. When the IDs are
+# discovered, the metadata service provides it too.
+if [ -z "$PUBLIC_IP" ] && [ -n "$FIREWALL_ID" ] && [ -n "$PROJECT_ID" ]; then
     PUBLIC_IP=$(hostname -I | awk '{print $1}')
 fi
 
-# Create environment file for Go agent (backward compatibility)
-echo "FIREWALL_ID=$FIREWALL_ID" > /etc/lsh-agent/env
-echo "PROJECT_ID=$PROJECT_ID" >> /etc/lsh-agent/env
-echo "PUBLIC_IP=$PUBLIC_IP" >> /etc/lsh-agent/env
+# Create environment file for Go agent (backward compatibility). Values left
+# empty are discovered from the metadata service.
+: > /etc/lsh-agent/env
+[ -n "$FIREWALL_ID" ] && echo "FIREWALL_ID=$FIREWALL_ID" >> /etc/lsh-agent/env
+[ -n "$PROJECT_ID" ] && echo "PROJECT_ID=$PROJECT_ID" >> /etc/lsh-agent/env
+[ -n "$PUBLIC_IP" ] && echo "PUBLIC_IP=$PUBLIC_IP" >> /etc/lsh-agent/env
 
 # Note: LATITUDESH_AUTH_TOKEN token will be set via systemctl edit command after installation
 
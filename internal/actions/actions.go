@@ -0,0 +1,324 @@
+package actions
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/latitudesh/agent/internal/audit"
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLifetime bounds how long after it was fetched an action may run;
+	// actions without an expiry or expiring later are rejected
+	maxLifetime = 15 * time.Minute
+	// seenFile keeps the IDs of executed actions until they expire, so a
+	// replay is rejected across restarts
+	seenFile = "actions_seen.json"
+)
+
+// Handler executes an action and returns its output
+type Handler func(ctx context.Context, action *client.Action) (string, error)
+
+// Runner polls the API for queued actions, verifies their signatures and
+// executes the allow-listed ones with a timeout
+type Runner struct {
+	client    *client.LatitudeClient
+	endpoint  string
+	publicKey ed25519.PublicKey
+	allowed   map[string]bool
+	handlers  map[string]Handler
+	timeout   time.Duration
+	interval  time.Duration
+	seen      map[string]time.Time
+	stateDir  string
+	serverID  string
+	auditLog  string
+	sink      func(result *client.ActionResult) error
+	logger    *logrus.Logger
+}
+
+// auditEntry is an action as written to the audit log
+type auditEntry struct {
+	*client.ActionResult
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// NewRunner creates a new actions runner. publicKey is the base64-encoded
+// ed25519 key used to verify that actions were issued by Latitude.sh.
+func NewRunner(latitudeClient *client.LatitudeClient, endpoint, publicKey string, allowed []string, timeout, interval time.Duration, logger *logrus.Logger) (*Runner, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid actions public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid actions public key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid actions poll interval %s: expected a positive duration", interval)
+	}
+
+	allowedSet := make(map[string]bool)
+	for _, actionType := range allowed {
+		allowedSet[actionType] = true
+	}
+
+	return &Runner{
+		client:    latitudeClient,
+		endpoint:  endpoint,
+		publicKey: ed25519.PublicKey(key),
+		allowed:   allowedSet,
+		handlers:  make(map[string]Handler),
+		timeout:   timeout,
+		interval:  interval,
+		seen:      make(map[string]time.Time),
+		logger:    logger,
+	}, nil
+}
+
+// Register adds a handler for an action type
+func (r *Runner) Register(actionType string, handler Handler) {
+	r.handlers[actionType] = handler
+}
+
+// SetStateDir keeps the IDs of executed actions in stateDir until they
+// expire, loading those saved by a previous run
+func (r *Runner) SetStateDir(stateDir string) {
+	r.stateDir = stateDir
+	var seen map[string]time.Time
+	if err := state.Load(stateDir, seenFile, &seen); err != nil && !os.IsNotExist(err) {
+		r.logger.WithError(err).Warn("Failed to read executed remote actions")
+	}
+	for id, expiresAt := range seen {
+		r.seen[id] = expiresAt
+	}
+	r.forgetExpired()
+}
+
+// SetServerID sets the Latitude.sh server of this host. Actions must name
+// it or the instance ID of this agent to run.
+func (r *Runner) SetServerID(serverID string) {
+	r.serverID = serverID
+}
+
+// SetAuditLog sets the file every executed or rejected action is appended
+// to, together with the commands it ran
+func (r *Runner) SetAuditLog(path string) {
+	r.auditLog = path
+}
+
+// SetResultSink hands action results to sink instead of reporting them to
+// the API directly, e.g. to queue them until the API is reachable
+func (r *Runner) SetResultSink(sink func(result *client.ActionResult) error) {
+	r.sink = sink
+}
+
+// Run polls for actions until the context is cancelled
+func (r *Runner) Run(ctx context.Context) {
+	r.logger.Infof("Polling for remote actions every %s", r.interval)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches pending actions and executes them in order
+func (r *Runner) poll(ctx context.Context) {
+	signedActions, err := r.client.FetchActions(ctx, r.endpoint)
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to fetch remote actions")
+		return
+	}
+
+	r.forgetExpired()
+
+	for _, signed := range signedActions {
+		result := r.execute(ctx, signed)
+		if result == nil {
+			continue
+		}
+		report := func() error { return r.client.ReportActionResult(ctx, r.endpoint, result) }
+		if r.sink != nil {
+			report = func() error { return r.sink(result) }
+		}
+		if err := report(); err != nil {
+			r.logger.WithError(err).Warnf("Failed to report result of action %s", result.ActionID)
+		}
+	}
+}
+
+// execute verifies and runs a single action. It returns nil for actions that
+// were already executed so duplicates are not reported twice.
+func (r *Runner) execute(ctx context.Context, signed client.SignedAction) *client.ActionResult {
+	result := &client.ActionResult{StartedAt: time.Now()}
+	action, err := r.verify(signed)
+	if err != nil {
+		// Without a verified payload there is no trustworthy ID to report against
+		r.logger.WithError(err).Warn("Discarding remote action with invalid signature")
+		return nil
+	}
+	result.ActionID = action.ID
+	result.Type = action.Type
+
+	if _, done := r.seen[action.ID]; done {
+		return nil
+	}
+	// Remember the action for as long as it could be accepted
+	now := time.Now()
+	remember := action.ExpiresAt
+	if remember.IsZero() || remember.After(now.Add(maxLifetime)) {
+		remember = now.Add(maxLifetime)
+	}
+	r.seen[action.ID] = remember
+	r.saveSeen()
+
+	reject := func(format string, args ...interface{}) *client.ActionResult {
+		result.Status = client.ActionRejected
+		result.Error = fmt.Sprintf(format, args...)
+		result.FinishedAt = time.Now()
+		r.logger.Warnf("Rejected remote action %s: %s", result.ActionID, result.Error)
+		r.writeAudit(result, action)
+		return result
+	}
+
+	if action.ExpiresAt.IsZero() {
+		return reject("action has no expiry")
+	}
+	if now.After(action.ExpiresAt) {
+		return reject("action expired at %s", action.ExpiresAt.Format(time.RFC3339))
+	}
+	if action.ExpiresAt.After(now.Add(maxLifetime)) {
+		return reject("action expires at %s, more than %s ahead", action.ExpiresAt.Format(time.RFC3339), maxLifetime)
+	}
+	if err := r.checkHost(action); err != nil {
+		return reject("%v", err)
+	}
+	if !r.allowed[action.Type] {
+		return reject("action type %q is not allowed by agent configuration", action.Type)
+	}
+	handler, ok := r.handlers[action.Type]
+	if !ok {
+		return reject("action type %q is not supported by this agent", action.Type)
+	}
+
+	r.logger.WithFields(logrus.Fields{
+		"component":   "actions",
+		"action_id":   action.ID,
+		"action_type": action.Type,
+	}).Info("Executing remote action")
+
+	actionCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	actionCtx, session := audit.WithSession(actionCtx)
+
+	output, err := handler(actionCtx, action)
+	result.Output = output
+	result.FinishedAt = time.Now()
+	result.Commands, result.DroppedCommands = session.Commands()
+	if err != nil {
+		result.Status = client.ActionFailed
+		result.Error = err.Error()
+		r.logger.WithError(err).Errorf("Remote action %s (%s) failed", action.ID, action.Type)
+	} else {
+		result.Status = client.ActionSucceeded
+		r.logger.Infof("Remote action %s (%s) completed in %s", action.ID, action.Type, result.FinishedAt.Sub(result.StartedAt))
+	}
+	r.writeAudit(result, action)
+
+	return result
+}
+
+// checkHost checks that an action was issued for this host. It must name
+// the server or the instance, and every ID it names must match.
+func (r *Runner) checkHost(action *client.Action) error {
+	instanceID := r.client.InstanceID()
+	if action.ServerID == "" && action.InstanceID == "" {
+		return fmt.Errorf("action names neither a server nor an instance")
+	}
+	if action.ServerID != "" && action.ServerID != r.serverID {
+		return fmt.Errorf("action was issued for server %q, not this one", action.ServerID)
+	}
+	if action.InstanceID != "" && action.InstanceID != instanceID {
+		return fmt.Errorf("action was issued for instance %q, not this one", action.InstanceID)
+	}
+	return nil
+}
+
+// writeAudit appends the result of an action to the audit log
+func (r *Runner) writeAudit(result *client.ActionResult, action *client.Action) {
+	if r.auditLog == "" {
+		return
+	}
+	entry := auditEntry{ActionResult: result, Args: action.Args}
+	if err := audit.AppendLog(r.auditLog, entry); err != nil {
+		r.logger.WithError(err).Warnf("Failed to write audit log for action %s", result.ActionID)
+	}
+}
+
+// verify checks the action signature and decodes its payload
+func (r *Runner) verify(signed client.SignedAction) (*client.Action, error) {
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload encoding: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(r.publicKey, payload, signature) {
+		return nil, fmt.Errorf("signature verification failed")
+	}
+
+	var action client.Action
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return nil, fmt.Errorf("invalid action payload: %w", err)
+	}
+	if action.ID == "" || action.Type == "" {
+		return nil, fmt.Errorf("action payload missing id or type")
+	}
+
+	return &action, nil
+}
+
+// forgetExpired drops executed action IDs whose expiry has passed, since the
+// expiry check alone rejects any replay of them
+func (r *Runner) forgetExpired() {
+	now := time.Now()
+	forgotten := false
+	for id, expiresAt := range r.seen {
+		if now.After(expiresAt) {
+			delete(r.seen, id)
+			forgotten = true
+		}
+	}
+	if forgotten {
+		r.saveSeen()
+	}
+}
+
+// saveSeen saves the executed action IDs to the state directory
+func (r *Runner) saveSeen() {
+	if r.stateDir == "" {
+		return
+	}
+	if err := state.Save(r.stateDir, seenFile, r.seen); err != nil {
+		r.logger.WithError(err).Warn("Failed to save executed remote actions")
+	}
+}
@@ -0,0 +1,214 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Alert states
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// maxPending bounds the alerts kept for retry while the API is unreachable
+const maxPending = 100
+
+// Metrics lists the metric names rules can refer to
+var Metrics = []string{
+	"load1", "load5", "load15", "memory_used_percent", "uptime_seconds", "disk_used_percent",
+	"tcp_retrans_percent", "tcp_listen_overflows", "tcp_listen_drops", "tcp_established", "tcp_time_wait", "tcp_orphans",
+}
+
+// operators maps comparison operators to their evaluation
+var operators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Rule is a threshold on a metric that must hold for a duration to fire,
+// written as "<metric> <op> <threshold>", e.g. "load5 > 8"
+type Rule struct {
+	Name      string
+	Expr      string
+	Metric    string
+	Operator  string
+	Threshold float64
+	For       time.Duration
+	Severity  string
+}
+
+// ParseRule parses a rule expression
+func ParseRule(name, expr string, duration time.Duration, severity string) (*Rule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid alert expression %q: expected \"<metric> <op> <threshold>\"", expr)
+	}
+	if _, ok := operators[fields[1]]; !ok {
+		return nil, fmt.Errorf("invalid alert expression %q: unknown operator %q", expr, fields[1])
+	}
+	if !slices.Contains(Metrics, fields[0]) {
+		return nil, fmt.Errorf("invalid alert expression %q: unknown metric %q (must be one of %s)", expr, fields[0], strings.Join(Metrics, ", "))
+	}
+	threshold, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert expression %q: invalid threshold %q", expr, fields[2])
+	}
+
+	return &Rule{
+		Name:      name,
+		Expr:      expr,
+		Metric:    fields[0],
+		Operator:  fields[1],
+		Threshold: threshold,
+		For:       duration,
+		Severity:  severity,
+	}, nil
+}
+
+// Alert is a state change of a rule
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Expr      string    `json:"expr"`
+	Severity  string    `json:"severity"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Since     time.Time `json:"since"`
+	Timestamp time.Time `json:"timestamp"`
+	// Suppressed is set for alerts raised during a maintenance window
+	Suppressed bool `json:"suppressed,omitempty"`
+}
+
+// String describes the alert for logs and notifications
+func (a Alert) String() string {
+	if a.Suppressed {
+		return fmt.Sprintf("%s %s: %s (value %.2f, suppressed)", a.Rule, a.State, a.Expr, a.Value)
+	}
+	return fmt.Sprintf("%s %s: %s (value %.2f)", a.Rule, a.State, a.Expr, a.Value)
+}
+
+// ruleState tracks how long a rule's condition has held
+type ruleState struct {
+	activeSince time.Time
+	firing      bool
+}
+
+// Engine evaluates alert rules locally and delivers state changes. Alerts
+// that cannot be reported to the API are retried on later evaluations, so
+// alerting keeps working while the API is slow or unreachable.
+type Engine struct {
+	rules   []*Rule
+	states  map[string]*ruleState
+	report  func(context.Context, Alert) error
+	notify  func(Alert)
+	pending []Alert
+	logger  *logrus.Logger
+
+	maintenance func(time.Time) (string, bool)
+}
+
+// NewEngine creates an alert engine. report sends an alert to the API and
+// notify delivers it locally, e.g. to webhooks.
+func NewEngine(rules []*Rule, report func(context.Context, Alert) error, notify func(Alert), logger *logrus.Logger) *Engine {
+	return &Engine{
+		rules:  rules,
+		states: make(map[string]*ruleState),
+		report: report,
+		notify: notify,
+		logger: logger,
+	}
+}
+
+// SetMaintenance registers a check for planned maintenance. Alerts raised
+// while it reports a window are still delivered, flagged as suppressed.
+func (e *Engine) SetMaintenance(active func(time.Time) (string, bool)) {
+	e.maintenance = active
+}
+
+// Evaluate checks every rule against the metrics and delivers alerts for
+// rules that start firing or resolve
+func (e *Engine) Evaluate(ctx context.Context, metrics map[string]float64) error {
+	now := time.Now()
+
+	for _, rule := range e.rules {
+		value, ok := metrics[rule.Metric]
+		if !ok {
+			e.logger.Debugf("Metric %s for alert rule %s is unavailable", rule.Metric, rule.Name)
+			continue
+		}
+
+		st := e.states[rule.Name]
+		if st == nil {
+			st = &ruleState{}
+			e.states[rule.Name] = st
+		}
+
+		if operators[rule.Operator](value, rule.Threshold) {
+			if st.activeSince.IsZero() {
+				st.activeSince = now
+			}
+			if !st.firing && now.Sub(st.activeSince) >= rule.For {
+				st.firing = true
+				e.emit(rule, Firing, value, st.activeSince, now)
+			}
+			continue
+		}
+
+		if st.firing {
+			e.emit(rule, Resolved, value, now, now)
+		}
+		st.activeSince = time.Time{}
+		st.firing = false
+	}
+
+	return e.flush(ctx)
+}
+
+// emit logs and notifies an alert and queues it for the API
+func (e *Engine) emit(rule *Rule, alertState string, value float64, since, now time.Time) {
+	alert := Alert{
+		Rule:      rule.Name,
+		Expr:      rule.Expr,
+		Severity:  rule.Severity,
+		State:     alertState,
+		Value:     value,
+		Since:     since,
+		Timestamp: now,
+	}
+	if e.maintenance != nil {
+		_, alert.Suppressed = e.maintenance(now)
+	}
+
+	if alertState == Firing && !alert.Suppressed {
+		e.logger.Warnf("Alert %s", alert)
+	} else {
+		e.logger.Infof("Alert %s", alert)
+	}
+	e.notify(alert)
+
+	e.pending = append(e.pending, alert)
+	if len(e.pending) > maxPending {
+		e.pending = e.pending[len(e.pending)-maxPending:]
+	}
+}
+
+// flush reports queued alerts to the API in order, keeping the rest on failure
+func (e *Engine) flush(ctx context.Context) error {
+	for len(e.pending) > 0 {
+		if err := e.report(ctx, e.pending[0]); err != nil {
+			return fmt.Errorf("failed to report %d alerts: %w", len(e.pending), err)
+		}
+		e.pending = e.pending[1:]
+	}
+	return nil
+}
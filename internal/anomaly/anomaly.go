@@ -0,0 +1,232 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Anomaly states
+const (
+	Started = "started"
+	Ended   = "ended"
+)
+
+const (
+	// baselineWeight is how much each normal sample moves the baseline
+	baselineWeight = 0.02
+	// maxPending bounds the events kept for retry while the API is unreachable
+	maxPending = 100
+)
+
+// Thresholds configure when a traffic rate counts as anomalous: it must
+// exceed its baseline by Multiplier and also exceed the metric's floor, so
+// idle interfaces do not trigger on small bursts
+type Thresholds struct {
+	Multiplier  float64
+	MinPPS      float64
+	MinBPS      float64
+	MinConnRate float64
+	// Warmup is how long baselines are learned before anything is detected
+	Warmup time.Duration
+	// Cooldown is how long a rate must stay below its threshold to end
+	Cooldown time.Duration
+}
+
+// floor returns the minimum anomalous value for a metric
+func (t Thresholds) floor(metric string) float64 {
+	switch {
+	case strings.HasSuffix(metric, ":rx_pps"):
+		return t.MinPPS
+	case strings.HasSuffix(metric, ":rx_bps"):
+		return t.MinBPS
+	default:
+		return t.MinConnRate
+	}
+}
+
+// Event is the start or end of a traffic anomaly on a metric
+type Event struct {
+	Metric    string    `json:"metric"`
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Baseline  float64   `json:"baseline"`
+	Threshold float64   `json:"threshold"`
+	Mitigated bool      `json:"mitigated"`
+	Since     time.Time `json:"since"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// String describes the event for logs and notifications
+func (e Event) String() string {
+	return fmt.Sprintf("Traffic anomaly %s on %s: %.0f/s (baseline %.0f/s, threshold %.0f/s)", e.State, e.Metric, e.Value, e.Baseline, e.Threshold)
+}
+
+// metricState tracks the baseline and anomaly state of a single metric
+type metricState struct {
+	baseline  float64
+	active    bool
+	since     time.Time
+	lastAbove time.Time
+}
+
+// Detector learns a baseline for each traffic rate and reports spikes.
+// Mitigation is applied when the first anomaly starts and removed once all
+// anomalies have ended.
+type Detector struct {
+	thresholds Thresholds
+	started    time.Time
+	metrics    map[string]*metricState
+	mitigated  bool
+	report     func(context.Context, Event) error
+	notify     func(Event)
+	mitigate   func(ctx context.Context, enable bool) error
+	pending    []Event
+	logger     *logrus.Logger
+}
+
+// NewDetector creates an anomaly detector. report sends an event to the API
+// and notify delivers it locally. mitigate applies or removes mitigation and
+// may be nil to only detect.
+func NewDetector(thresholds Thresholds, report func(context.Context, Event) error, notify func(Event), mitigate func(ctx context.Context, enable bool) error, logger *logrus.Logger) *Detector {
+	return &Detector{
+		thresholds: thresholds,
+		started:    time.Now(),
+		metrics:    make(map[string]*metricState),
+		report:     report,
+		notify:     notify,
+		mitigate:   mitigate,
+		logger:     logger,
+	}
+}
+
+// Snapshot is the learned state of a detector that outlives a restart
+type Snapshot struct {
+	Started   time.Time          `json:"started"`
+	Baselines map[string]float64 `json:"baselines"`
+}
+
+// Snapshot returns the detector's warmup start and baselines
+func (d *Detector) Snapshot() Snapshot {
+	baselines := make(map[string]float64, len(d.metrics))
+	for name, st := range d.metrics {
+		baselines[name] = st.baseline
+	}
+	return Snapshot{Started: d.started, Baselines: baselines}
+}
+
+// Restore resumes from a snapshot taken before a restart, so baselines are
+// not learned again from scratch. Anomalies that were active are not
+// restored; they are detected again if they persist.
+func (d *Detector) Restore(snapshot Snapshot) {
+	d.started = snapshot.Started
+	for name, baseline := range snapshot.Baselines {
+		d.metrics[name] = &metricState{baseline: baseline}
+	}
+}
+
+// Observe compares the current rates with their baselines, emits events for
+// anomalies that start or end, and updates the baselines with normal samples
+func (d *Detector) Observe(ctx context.Context, rates map[string]float64) error {
+	now := time.Now()
+	warmedUp := now.Sub(d.started) >= d.thresholds.Warmup
+
+	// Sorted so events for a multi-metric attack are delivered in a stable order
+	names := make([]string, 0, len(rates))
+	for name := range rates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var events []Event
+	active := 0
+	for _, name := range names {
+		value := rates[name]
+		st := d.metrics[name]
+		if st == nil {
+			d.metrics[name] = &metricState{baseline: value}
+			continue
+		}
+
+		threshold := math.Max(st.baseline*d.thresholds.Multiplier, d.thresholds.floor(name))
+		above := warmedUp && value > threshold
+
+		switch {
+		case above && !st.active:
+			st.active = true
+			st.since = now
+			st.lastAbove = now
+			events = append(events, Event{Metric: name, State: Started, Value: value, Baseline: st.baseline, Threshold: threshold, Since: now, Timestamp: now})
+		case above:
+			st.lastAbove = now
+		case st.active && now.Sub(st.lastAbove) >= d.thresholds.Cooldown:
+			st.active = false
+			events = append(events, Event{Metric: name, State: Ended, Value: value, Baseline: st.baseline, Threshold: threshold, Since: st.since, Timestamp: now})
+		case !st.active:
+			// Attack traffic is kept out of the baseline so it cannot
+			// raise the threshold it is measured against
+			st.baseline += baselineWeight * (value - st.baseline)
+		}
+
+		if st.active {
+			active++
+		}
+	}
+
+	d.updateMitigation(ctx, active > 0)
+	for _, event := range events {
+		event.Mitigated = d.mitigated
+		d.emit(event)
+	}
+
+	return d.flush(ctx)
+}
+
+// updateMitigation applies mitigation while anomalies are active and removes
+// it once they have all ended
+func (d *Detector) updateMitigation(ctx context.Context, active bool) {
+	if d.mitigate == nil || active == d.mitigated {
+		return
+	}
+	if err := d.mitigate(ctx, active); err != nil {
+		d.logger.Errorf("Failed to update traffic mitigation: %v", err)
+		return
+	}
+	d.mitigated = active
+	if active {
+		d.logger.Warn("Applied traffic mitigation rules")
+	} else {
+		d.logger.Info("Removed traffic mitigation rules")
+	}
+}
+
+// emit logs and notifies an event and queues it for the API
+func (d *Detector) emit(event Event) {
+	if event.State == Started {
+		d.logger.Warn(event.String())
+	} else {
+		d.logger.Info(event.String())
+	}
+	d.notify(event)
+
+	d.pending = append(d.pending, event)
+	if len(d.pending) > maxPending {
+		d.pending = d.pending[len(d.pending)-maxPending:]
+	}
+}
+
+// flush reports queued events to the API in order, keeping the rest on failure
+func (d *Detector) flush(ctx context.Context) error {
+	for len(d.pending) > 0 {
+		if err := d.report(ctx, d.pending[0]); err != nil {
+			return fmt.Errorf("failed to report %d traffic anomalies: %w", len(d.pending), err)
+		}
+		d.pending = d.pending[1:]
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package audit records the commands the agent runs on behalf of the
+// platform.
+//
+// A Session is attached to the context of a remote action. While it is
+// attached, every command run through the command package is recorded with
+// its output, exit code and timing.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MaxCapture is how much of each output stream is recorded per command
+const MaxCapture = 64 * 1024
+
+// maxCommands bounds how many commands a session records
+const maxCommands = 256
+
+// Command is a command run during a session
+type Command struct {
+	Argv            []string  `json:"argv"`
+	Stdout          string    `json:"stdout,omitempty"`
+	Stderr          string    `json:"stderr,omitempty"`
+	OutputTruncated bool      `json:"output_truncated,omitempty"`
+	ExitCode        int       `json:"exit_code"`
+	Error           string    `json:"error,omitempty"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+}
+
+// Session collects the commands run under a context
+type Session struct {
+	mu       sync.Mutex
+	commands []Command
+	dropped  int
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context that records commands into a new session
+func WithSession(ctx context.Context) (context.Context, *Session) {
+	session := &Session{}
+	return context.WithValue(ctx, sessionKey{}, session), session
+}
+
+// Commands returns the commands recorded so far and how many were dropped
+// after the session reached its limit
+func (s *Session) Commands() ([]Command, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Command(nil), s.commands...), s.dropped
+}
+
+// Active reports whether ctx carries a session
+func Active(ctx context.Context) bool {
+	_, ok := ctx.Value(sessionKey{}).(*Session)
+	return ok
+}
+
+// Record adds a finished command to the session of ctx, if there is one.
+// The exit code is taken from err.
+func Record(ctx context.Context, command Command, err error) {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	if session == nil {
+		return
+	}
+	if err != nil {
+		command.Error = err.Error()
+		command.ExitCode = ExitCode(err)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if len(session.commands) >= maxCommands {
+		session.dropped++
+		return
+	}
+	session.commands = append(session.commands, command)
+}
+
+// ExitCode returns the exit code of a command that returned err, or -1 for a
+// command that did not run to completion
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// AppendLog appends v as a JSON line to the audit log at path. The log is
+// only readable by root since commands may print sensitive data.
+func AppendLog(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,175 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+)
+
+// DiskJob is a single fio workload
+type DiskJob struct {
+	Name      string
+	RW        string
+	BlockSize string
+	IODepth   int
+}
+
+// DiskJobs are the workloads run by the disk benchmark
+var DiskJobs = []DiskJob{
+	{Name: "randread-4k", RW: "randread", BlockSize: "4k", IODepth: 32},
+	{Name: "randwrite-4k", RW: "randwrite", BlockSize: "4k", IODepth: 32},
+	{Name: "seqread-1m", RW: "read", BlockSize: "1m", IODepth: 8},
+	{Name: "seqwrite-1m", RW: "write", BlockSize: "1m", IODepth: 8},
+}
+
+// DiskResult is the outcome of one fio workload
+type DiskResult struct {
+	Job            string  `json:"job"`
+	IOPS           float64 `json:"iops"`
+	ThroughputMBps float64 `json:"throughput_mbps"`
+	LatencyAvgUs   float64 `json:"latency_avg_us"`
+	LatencyP99Us   float64 `json:"latency_p99_us"`
+	Skipped        bool    `json:"skipped,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// fioOutput is the subset of fio's JSON output used here
+type fioOutput struct {
+	Jobs []struct {
+		Read  fioStats `json:"read"`
+		Write fioStats `json:"write"`
+	} `json:"jobs"`
+}
+
+type fioStats struct {
+	IOPS    float64 `json:"iops"`
+	BWBytes float64 `json:"bw_bytes"`
+	ClatNs  struct {
+		Mean       float64            `json:"mean"`
+		Percentile map[string]float64 `json:"percentile"`
+	} `json:"clat_ns"`
+}
+
+// DiskBenchmark runs bounded fio workloads against a directory or block device
+type DiskBenchmark struct {
+	rootDir        string
+	fioBinary      string
+	size           string
+	runtime        time.Duration
+	commandWrapper []string
+}
+
+// NewDiskBenchmark creates a disk benchmark. Each workload runs for at most
+// runtime against a test file of the given size (e.g. "1G"). rootDir is the
+// root of the host filesystem, "/" unless running in a container.
+func NewDiskBenchmark(rootDir, fioBinary, size string, runtime time.Duration) *DiskBenchmark {
+	return &DiskBenchmark{
+		rootDir:        rootDir,
+		fioBinary:      fioBinary,
+		size:           size,
+		runtime:        runtime,
+		commandWrapper: []string{"sudo"},
+	}
+}
+
+// SetCommandWrapper sets the command used to run fio with privileges
+func (db *DiskBenchmark) SetCommandWrapper(wrapper ...string) {
+	db.commandWrapper = wrapper
+}
+
+// Run benchmarks path. A directory gets a temporary test file that is removed
+// afterwards; a block device is only read from, so write workloads are skipped
+// to protect its data.
+func (db *DiskBenchmark) Run(ctx context.Context, path string) ([]DiskResult, error) {
+	info, err := os.Stat(filepath.Join(db.rootDir, path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid benchmark path: %w", err)
+	}
+
+	target := path
+	device := info.Mode()&os.ModeDevice != 0
+	if info.IsDir() {
+		target = filepath.Join(path, fmt.Sprintf("lsh-agent-bench-%d.tmp", os.Getpid()))
+		defer os.Remove(filepath.Join(db.rootDir, target))
+	} else if !device {
+		return nil, fmt.Errorf("%s is neither a directory nor a block device", path)
+	}
+
+	var results []DiskResult
+	for _, job := range DiskJobs {
+		if device && strings.Contains(job.RW, "write") {
+			results = append(results, DiskResult{Job: job.Name, Skipped: true})
+			continue
+		}
+		result, err := db.runJob(ctx, job, target)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+	}
+	return results, nil
+}
+
+// runJob runs a single fio workload and parses its JSON output
+func (db *DiskBenchmark) runJob(ctx context.Context, job DiskJob, target string) (DiskResult, error) {
+	result := DiskResult{Job: job.Name}
+
+	args := []string{
+		"--name=" + job.Name,
+		"--filename=" + target,
+		"--rw=" + job.RW,
+		"--bs=" + job.BlockSize,
+		fmt.Sprintf("--iodepth=%d", job.IODepth),
+		"--size=" + db.size,
+		fmt.Sprintf("--runtime=%d", int(db.runtime.Seconds())),
+		"--time_based",
+		"--direct=1",
+		"--ioengine=libaio",
+		"--output-format=json",
+	}
+	if target != "" && !strings.HasPrefix(target, "/dev/") {
+		// fio runs privileged, so let it remove the test file it created
+		args = append(args, "--unlink=1")
+	}
+	argv := append(append(append([]string{}, db.commandWrapper...), db.fioBinary), args...)
+
+	// Allow time for fio to lay out the test file on top of the runtime
+	jobCtx, cancel := context.WithTimeout(ctx, db.runtime+5*time.Minute)
+	defer cancel()
+
+	output, err := command.Output(jobCtx, command.Cmd{Argv: argv})
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return result, fmt.Errorf("fio failed: %w, output: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return result, fmt.Errorf("fio failed: %w", err)
+	}
+
+	var parsed fioOutput
+	if err := json.Unmarshal(output, &parsed); err != nil || len(parsed.Jobs) == 0 {
+		return result, fmt.Errorf("failed to parse fio output")
+	}
+
+	stats := parsed.Jobs[0].Read
+	if strings.Contains(job.RW, "write") {
+		stats = parsed.Jobs[0].Write
+	}
+	result.IOPS = stats.IOPS
+	result.ThroughputMBps = stats.BWBytes / 1e6
+	result.LatencyAvgUs = stats.ClatNs.Mean / 1000
+	result.LatencyP99Us = stats.ClatNs.Percentile["99.000000"] / 1000
+
+	return result, nil
+}
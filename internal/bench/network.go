@@ -0,0 +1,127 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// latencySamples is the number of TCP connects used to measure latency
+const latencySamples = 5
+
+// Target is a speedtest server in a Latitude.sh region
+type Target struct {
+	Region string `json:"region"`
+	// URL serves a large file for the download test
+	URL string `json:"url"`
+}
+
+// TargetsResponse represents the API response listing speedtest targets
+type TargetsResponse struct {
+	Targets []Target `json:"targets"`
+}
+
+// ParseTargets parses the speedtest target list returned by the API
+func ParseTargets(targetsJSON string) ([]Target, error) {
+	var response TargetsResponse
+	if err := json.Unmarshal([]byte(targetsJSON), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse speedtest targets: %w", err)
+	}
+	return response.Targets, nil
+}
+
+// NetworkResult is the outcome of a benchmark against one target
+type NetworkResult struct {
+	Region       string  `json:"region"`
+	URL          string  `json:"url"`
+	LatencyMinMs float64 `json:"latency_min_ms"`
+	LatencyAvgMs float64 `json:"latency_avg_ms"`
+	DownloadMbps float64 `json:"download_mbps"`
+	Bytes        int64   `json:"bytes"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// RunNetwork measures TCP connect latency and download throughput to each
+// target, downloading for at most duration per target
+func RunNetwork(ctx context.Context, targets []Target, duration time.Duration) []NetworkResult {
+	results := make([]NetworkResult, 0, len(targets))
+	for _, target := range targets {
+		result := NetworkResult{Region: target.Region, URL: target.URL}
+		if err := measureNetwork(ctx, target, duration, &result); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// measureNetwork fills in latency and throughput for a single target
+func measureNetwork(ctx context.Context, target Target, duration time.Duration, result *NetworkResult) error {
+	u, err := url.Parse(target.URL)
+	if err != nil {
+		return fmt.Errorf("invalid target URL: %w", err)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	// Latency: time to establish a TCP connection
+	var total, lowest time.Duration
+	var dialer net.Dialer
+	for i := 0; i < latencySamples; i++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", address, err)
+		}
+		elapsed := time.Since(start)
+		conn.Close()
+
+		total += elapsed
+		if lowest == 0 || elapsed < lowest {
+			lowest = elapsed
+		}
+	}
+	result.LatencyMinMs = float64(lowest.Microseconds()) / 1000
+	result.LatencyAvgMs = float64(total.Microseconds()) / 1000 / latencySamples
+
+	// Throughput: download until the file ends or the duration elapses
+	downloadCtx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(downloadCtx, "GET", target.URL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create download request: %w", err)
+	}
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed with status %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && downloadCtx.Err() == nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+
+	result.Bytes = n
+	if elapsed > 0 {
+		result.DownloadMbps = float64(n) * 8 / elapsed.Seconds() / 1e6
+	}
+	return nil
+}
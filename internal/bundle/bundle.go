@@ -0,0 +1,85 @@
+// Package bundle reads signed firewall rule bundles delivered as local
+// files, for servers without a route to the API.
+//
+// A bundle is a JSON envelope with a base64-encoded payload and its base64
+// ed25519 signature, like remote actions. The payload names the firewall
+// and carries the rules in the form of a ping response:
+//
+//	{"firewall_id": "fw_123", "issued_at": "2024-01-01T00:00:00Z",
+//	 "firewall": {"rules": [{"from": "10.0.0.0/8", "protocol": "tcp", "port": "22"}]}}
+package bundle
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// envelope is a bundle file as delivered
+type envelope struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// Bundle is a verified rule bundle
+type Bundle struct {
+	FirewallID string    `json:"firewall_id"`
+	IssuedAt   time.Time `json:"issued_at"`
+	// RulesJSON is the payload, which the firewall collector reads like a
+	// ping response
+	RulesJSON string `json:"-"`
+}
+
+// ParsePublicKey decodes a base64-encoded ed25519 public key
+func ParsePublicKey(publicKey string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid bundle public key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Load reads the bundle at path and verifies it was signed with publicKey
+// for firewallID
+func Load(path string, publicKey ed25519.PublicKey, firewallID string) (*Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule bundle: %w", err)
+	}
+	var signed envelope
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("invalid rule bundle: %w", err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule bundle payload encoding: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule bundle signature encoding: %w", err)
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return nil, fmt.Errorf("rule bundle signature verification failed")
+	}
+
+	var bundle Bundle
+	if err := json.Unmarshal(payload, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid rule bundle payload: %w", err)
+	}
+	// A bundle signed for another server's firewall must not apply here
+	if bundle.FirewallID != firewallID {
+		return nil, fmt.Errorf("rule bundle is for firewall %q, not %q", bundle.FirewallID, firewallID)
+	}
+	if bundle.IssuedAt.IsZero() {
+		return nil, fmt.Errorf("rule bundle payload missing issued_at")
+	}
+	bundle.RulesJSON = string(payload)
+	return &bundle, nil
+}
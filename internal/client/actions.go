@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/audit"
+)
+
+// SignedAction represents an action queued in the Latitude console. Payload is
+// the base64-encoded JSON of an Action and Signature is the base64-encoded
+// ed25519 signature of the decoded payload bytes.
+type SignedAction struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// ActionsResponse represents the pending actions response
+type ActionsResponse struct {
+	Actions []SignedAction `json:"actions"`
+}
+
+// Action represents a single verified command for the agent to run
+type Action struct {
+	ID   string            `json:"id"`
+	Type string            `json:"type"`
+	Args map[string]string `json:"args,omitempty"`
+	// ServerID and InstanceID name the host the action was issued for, so
+	// a signed action cannot be replayed against another server
+	ServerID   string    `json:"server_id,omitempty"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	IssuedAt   time.Time `json:"issued_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ActionResult represents the outcome of an action reported back to the API
+type ActionResult struct {
+	ActionID   string    `json:"action_id"`
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Commands is the session recording of the host commands the action ran
+	Commands        []audit.Command `json:"commands,omitempty"`
+	DroppedCommands int             `json:"dropped_commands,omitempty"`
+}
+
+// Action result statuses
+const (
+	ActionSucceeded = "succeeded"
+	ActionFailed    = "failed"
+	ActionRejected  = "rejected"
+)
+
+// FetchActions retrieves actions queued for this server
+func (lc *LatitudeClient) FetchActions(ctx context.Context, endpoint string) ([]SignedAction, error) {
+	query := url.Values{}
+	query.Set("ip_address", lc.publicIP)
+	query.Set("firewall_id", lc.firewallID)
+
+	var response ActionsResponse
+	if err := lc.doJSON(ctx, "GET", endpoint+"?"+query.Encode(), nil, &response); err != nil {
+		return nil, fmt.Errorf("failed to fetch actions: %w", err)
+	}
+
+	return response.Actions, nil
+}
+
+// ReportActionResult sends the outcome of an action to the API
+func (lc *LatitudeClient) ReportActionResult(ctx context.Context, endpoint string, result *ActionResult) error {
+	resultURL := fmt.Sprintf("%s/%s/result", strings.TrimSuffix(endpoint, "/"), url.PathEscape(result.ActionID))
+	if err := lc.doJSON(ctx, "POST", resultURL, result, nil); err != nil {
+		return fmt.Errorf("failed to report action result: %w", err)
+	}
+	return nil
+}
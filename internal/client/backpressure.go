@@ -0,0 +1,78 @@
+package client
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/timings"
+	"github.com/sirupsen/logrus"
+)
+
+// maxBackoffFactor bounds how far intervals are stretched while the API is
+// under pressure
+const maxBackoffFactor = 8
+
+// slowResponse is how long the API may take to answer before it is
+// considered under pressure
+const slowResponse = 10 * time.Second
+
+// backpressure tracks whether the API is rejecting or slow to answer
+// requests. Each 429, 5xx or slow response doubles the factor periodic work
+// should stretch its interval by, and each normal response halves it.
+type backpressure struct {
+	mu     sync.Mutex
+	factor int
+	logger *logrus.Logger
+}
+
+// observe updates the factor from the outcome of a request
+func (b *backpressure) observe(statusCode int, elapsed time.Duration) {
+	pressured := statusCode == http.StatusTooManyRequests || statusCode >= 500 || elapsed >= slowResponse
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := b.factor
+	if pressured {
+		b.factor = min(b.factor*2, maxBackoffFactor)
+	} else {
+		b.factor = max(b.factor/2, 1)
+	}
+
+	switch {
+	case b.factor > previous:
+		b.logger.Warnf("API is under pressure (status %d after %s), stretching intervals %dx", statusCode, elapsed.Round(time.Millisecond), b.factor)
+	case b.factor == 1 && previous > 1:
+		b.logger.Info("API recovered, intervals are back to normal")
+	}
+}
+
+// transport observes every API response before handing it back
+type transport struct {
+	base     http.RoundTripper
+	pressure *backpressure
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	timings.Since("api", start)
+	if err != nil {
+		// Failures to connect say more about this server's network than
+		// about the API's load, unless the request timed out waiting
+		if time.Since(start) >= slowResponse {
+			t.pressure.observe(0, time.Since(start))
+		}
+		return nil, err
+	}
+	t.pressure.observe(resp.StatusCode, time.Since(start))
+	return resp, nil
+}
+
+// IntervalFactor returns how many times longer periodic API work should
+// wait between runs, 1 while the API is healthy
+func (lc *LatitudeClient) IntervalFactor() int {
+	lc.pressure.mu.Lock()
+	defer lc.pressure.mu.Unlock()
+	return lc.pressure.factor
+}
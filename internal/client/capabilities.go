@@ -0,0 +1,33 @@
+package client
+
+import (
+	"github.com/latitudesh/agent/internal/collectors"
+)
+
+// SetCapabilities queues the external tools available on the server to be
+// sent with the next ping
+func (lc *LatitudeClient) SetCapabilities(capabilities map[string]collectors.Capability) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.capabilities = capabilities
+}
+
+// clearCapabilities stops sending capabilities once the API received them,
+// unless newer ones were queued meanwhile
+func (lc *LatitudeClient) clearCapabilities(sent map[string]collectors.Capability) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if sameCapabilities(lc.capabilities, sent) {
+		lc.capabilities = nil
+	}
+}
+
+// sameCapabilities reports whether two capability maps are equal
+func sameCapabilities(a, b map[string]collectors.Capability) bool {
+	for name, capability := range a {
+		if other, ok := b[name]; !ok || other != capability {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// FetchUsers retrieves the local user accounts defined for this server
+func (lc *LatitudeClient) FetchUsers(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch users: %w", err)
+	}
+	return body, nil
+}
+
+// FetchWireGuardConfig retrieves the WireGuard interfaces and peers for this
+// server, announcing the server's own public key
+func (lc *LatitudeClient) FetchWireGuardConfig(ctx context.Context, endpoint, publicKey string) (string, error) {
+	query := url.Values{}
+	query.Set("public_key", publicKey)
+
+	body, err := lc.fetchRaw(ctx, endpoint, query)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch WireGuard configuration: %w", err)
+	}
+	return body, nil
+}
+
+// FetchNetworkConfig retrieves the additional IPs, VLANs and routes for this server
+func (lc *LatitudeClient) FetchNetworkConfig(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch network configuration: %w", err)
+	}
+	return body, nil
+}
+
+// FetchSpeedtestTargets retrieves the Latitude.sh speedtest targets by region
+func (lc *LatitudeClient) FetchSpeedtestTargets(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch speedtest targets: %w", err)
+	}
+	return body, nil
+}
+
+// FetchTasks retrieves the scheduled tasks defined for this server
+func (lc *LatitudeClient) FetchTasks(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch tasks: %w", err)
+	}
+	return body, nil
+}
+
+// FetchUserData retrieves the first-boot provisioning scripts for this server
+func (lc *LatitudeClient) FetchUserData(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch user-data: %w", err)
+	}
+	return body, nil
+}
+
+// FetchFiles retrieves the managed files defined for this server
+func (lc *LatitudeClient) FetchFiles(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch managed files: %w", err)
+	}
+	return body, nil
+}
+
+// FetchMitigationRules retrieves the pre-approved traffic mitigation rules
+// for this server
+func (lc *LatitudeClient) FetchMitigationRules(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch mitigation rules: %w", err)
+	}
+	return body, nil
+}
+
+// FetchPluginConfig retrieves the configuration for an applier plugin
+func (lc *LatitudeClient) FetchPluginConfig(ctx context.Context, endpoint, plugin string) (string, error) {
+	query := url.Values{}
+	query.Set("plugin", plugin)
+
+	body, err := lc.fetchRaw(ctx, endpoint, query)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch configuration for plugin %s: %w", plugin, err)
+	}
+	return body, nil
+}
+
+// FetchServerRecord retrieves the hostname, IP addresses and tags the API has
+// recorded for this server
+func (lc *LatitudeClient) FetchServerRecord(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch server record: %w", err)
+	}
+	return body, nil
+}
+
+// FetchCompliancePolicy retrieves the expected sysctl values and forbidden
+// kernel modules for this server
+func (lc *LatitudeClient) FetchCompliancePolicy(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch compliance policy: %w", err)
+	}
+	return body, nil
+}
+
+// FetchProfiles retrieves the workload profiles assigned to this server
+func (lc *LatitudeClient) FetchProfiles(ctx context.Context, endpoint string) (string, error) {
+	body, err := lc.fetchRaw(ctx, endpoint, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch profiles: %w", err)
+	}
+	return body, nil
+}
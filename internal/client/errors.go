@@ -0,0 +1,30 @@
+package client
+
+import (
+	"github.com/latitudesh/agent/internal/errkind"
+)
+
+// AgentError describes the error of the agent's last collection cycle to
+// the API, so it can tell errors that need an operator from those that
+// will pass on their own
+type AgentError struct {
+	Kind          string `json:"kind"`
+	Message       string `json:"message"`
+	NeedsOperator bool   `json:"needs_operator"`
+}
+
+// SetLastError records the outcome of a collection cycle. The error is sent
+// with the following pings until a cycle succeeds.
+func (lc *LatitudeClient) SetLastError(err error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if err == nil {
+		lc.lastError = nil
+		return
+	}
+	lc.lastError = &AgentError{
+		Kind:          string(errkind.Of(err)),
+		Message:       err.Error(),
+		NeedsOperator: errkind.NeedsOperator(err),
+	}
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+)
+
+// errDropped is the cause of requests failed by fault injection
+var errDropped = errors.New("connection dropped by fault injection")
+
+// InjectFaults fails dropPercent percent of API requests as if the
+// connection dropped, to exercise retries and alerting. It should be called
+// after SetRelay.
+func (lc *LatitudeClient) InjectFaults(dropPercent int) {
+	if dropPercent <= 0 {
+		return
+	}
+	lc.httpClient.Transport = &faultTransport{base: lc.httpClient.Transport, dropPercent: dropPercent}
+}
+
+// faultTransport fails a share of the requests it passes on to base
+type faultTransport struct {
+	base        http.RoundTripper
+	dropPercent int
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rand.IntN(100) < t.dropPercent {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: errDropped}
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxFeedSize bounds a downloaded feed
+const maxFeedSize = 64 << 20
+
+// FetchFeed downloads a plain-text feed from the API. When etag matches the
+// current version the API answers 304 and notModified is set.
+func (lc *LatitudeClient) FetchFeed(ctx context.Context, endpoint, etag string) (body, newETag string, notModified bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	lc.setAuthHeader(req)
+	return DoFeedRequest(lc.httpClient, req, etag)
+}
+
+// DoFeedRequest performs a conditional GET for a feed with the given client
+func DoFeedRequest(httpClient *http.Client, req *http.Request, etag string) (body, newETag string, notModified bool, err error) {
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", "", false, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return "", etag, true, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize))
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", false, fmt.Errorf("feed request failed with status %d", resp.StatusCode)
+	}
+	return string(data), resp.Header.Get("ETag"), false, nil
+}
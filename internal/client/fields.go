@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// pingFieldsHeader negotiates the optional ping fields. The agent sends the
+// fields it knows in the request; the API answers with those it accepts, so
+// an agent newer than the API leaves out what the API would reject.
+const pingFieldsHeader = "X-Agent-Ping-Fields"
+
+// Optional ping fields, by their JSON name
+const (
+	fieldLastError    = "last_error"
+	fieldCapabilities = "capabilities"
+)
+
+// pingFields are the optional ping fields this agent can send
+var pingFields = []string{fieldLastError, fieldCapabilities}
+
+// acceptFields records the optional ping fields the API accepts, as listed
+// in a response header. Responses without the header leave the fields as
+// they were.
+func (lc *LatitudeClient) acceptFields(header http.Header) {
+	values := header.Values(pingFieldsHeader)
+	if len(values) == 0 {
+		return
+	}
+	accepted := make(map[string]bool)
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				accepted[field] = true
+			}
+		}
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.acceptedFields = accepted
+}
+
+// rejectOptionalFields handles the API rejecting a ping that was sent with
+// optional fields. Unless the API said which fields it accepts, it falls
+// back to sending none. It reports whether a retry would send fewer fields
+// and so may succeed.
+func (lc *LatitudeClient) rejectOptionalFields(sent PingRequest) bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.acceptedFields == nil {
+		lc.acceptedFields = map[string]bool{}
+	}
+	return (sent.LastError != nil && !lc.acceptedFields[fieldLastError]) ||
+		(sent.Capabilities != nil && !lc.acceptedFields[fieldCapabilities])
+}
+
+// withAcceptedFields clears the optional fields of a ping the API does not
+// accept and logs the ones dropped, once per change. All fields are sent
+// until the API tells which it accepts.
+func (lc *LatitudeClient) withAcceptedFields(req PingRequest) PingRequest {
+	lc.mu.Lock()
+	accepted := lc.acceptedFields
+	lc.mu.Unlock()
+	if accepted == nil {
+		return req
+	}
+
+	var dropped []string
+	if req.LastError != nil && !accepted[fieldLastError] {
+		req.LastError = nil
+		dropped = append(dropped, fieldLastError)
+	}
+	if req.Capabilities != nil && !accepted[fieldCapabilities] {
+		req.Capabilities = nil
+		dropped = append(dropped, fieldCapabilities)
+	}
+
+	sort.Strings(dropped)
+	summary := strings.Join(dropped, ", ")
+	lc.mu.Lock()
+	changed := summary != lc.droppedFields
+	lc.droppedFields = summary
+	lc.mu.Unlock()
+	if changed && summary != "" {
+		lc.logger.Infof("The API does not accept ping fields %s, omitting them", summary)
+	}
+	return req
+}
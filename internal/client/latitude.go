@@ -7,8 +7,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/errkind"
 	"github.com/sirupsen/logrus"
 )
 
@@ -20,12 +26,42 @@ type LatitudeClient struct {
 	projectID   string
 	firewallID  string
 	publicIP    string
+	pressure    *backpressure
 	logger      *logrus.Logger
+
+	mu        sync.Mutex
+	lastError *AgentError
+	// capabilities are sent with the next ping after they change
+	capabilities map[string]collectors.Capability
+	// acceptedFields are the optional ping fields the API accepts, nil
+	// until it tells; droppedFields are those last left out
+	acceptedFields map[string]bool
+	droppedFields  string
+	// instanceID and fingerprint identify this installation of the agent,
+	// so the API can tell hosts cloned from the same image apart
+	instanceID  string
+	fingerprint string
+	// signer signs every request with the TPM key the instance was
+	// attested with, nil without attestation
+	signer RequestSigner
+}
+
+// RequestSigner signs requests with a key the API verified
+type RequestSigner interface {
+	// KeyID returns the ID of the key
+	KeyID() string
+	// Sign returns the signature of message
+	Sign(ctx context.Context, message []byte) ([]byte, error)
 }
 
 // PingRequest represents the request structure for the ping endpoint
 type PingRequest struct {
 	IPAddress string `json:"ip_address"`
+	// LastError is the error of the previous collection cycle, if it failed
+	LastError *AgentError `json:"last_error,omitempty"`
+	// Capabilities lists the external tools available on the server. It
+	// is only sent when it changed.
+	Capabilities map[string]collectors.Capability `json:"capabilities,omitempty"`
 }
 
 // FirewallResponse represents the firewall rules response
@@ -37,72 +73,180 @@ type FirewallResponse struct {
 
 // FirewallRule represents a single firewall rule from the API
 type FirewallRule struct {
-	From     string `json:"from"`
-	Protocol string `json:"protocol"`
-	Port     string `json:"port"`
+	From      string     `json:"from"`
+	Protocol  string     `json:"protocol"`
+	Port      string     `json:"port"`
+	Direction string     `json:"direction,omitempty"`
+	Action    string     `json:"action,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`
+}
+
+// AgentDirectives represents agent-level instructions included in the ping response
+type AgentDirectives struct {
+	Agent struct {
+		PauseUntil  *time.Time `json:"pause_until"`
+		PauseReason string     `json:"pause_reason"`
+		// MaintenanceUntil announces a planned maintenance window during
+		// which health alerts are suppressed
+		MaintenanceUntil  *time.Time `json:"maintenance_until"`
+		MaintenanceReason string     `json:"maintenance_reason"`
+		// InstanceConflict is set when another host reported the instance
+		// ID of this request and this host is the clone
+		InstanceConflict bool `json:"instance_conflict"`
+	} `json:"agent"`
 }
 
 // NewLatitudeClient creates a new Latitude.sh API client
 func NewLatitudeClient(bearerToken, apiEndpoint, projectID, firewallID, publicIP string, logger *logrus.Logger) *LatitudeClient {
+	pressure := &backpressure{factor: 1, logger: logger}
 	return &LatitudeClient{
-		httpClient:  &http.Client{},
+		httpClient:  &http.Client{Transport: &transport{base: http.DefaultTransport, pressure: pressure}},
 		apiEndpoint: apiEndpoint,
 		bearerToken: bearerToken,
 		projectID:   projectID,
 		firewallID:  firewallID,
 		publicIP:    publicIP,
+		pressure:    pressure,
 		logger:      logger,
 	}
 }
 
+// SetRelay sends all API requests through a relay agent, for servers
+// without direct internet access. relayURL is the relay's address, e.g.
+// http://10.0.0.1:8480.
+func (lc *LatitudeClient) SetRelay(relayURL string) error {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return fmt.Errorf("invalid relay URL: %w", err)
+	}
+	proxied := http.DefaultTransport.(*http.Transport).Clone()
+	proxied.Proxy = http.ProxyURL(u)
+	lc.httpClient.Transport = &transport{base: proxied, pressure: lc.pressure}
+	return nil
+}
+
+// SetInstance sets the instance ID and hardware fingerprint sent with every
+// request
+func (lc *LatitudeClient) SetInstance(instanceID, fingerprint string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.instanceID = instanceID
+	lc.fingerprint = fingerprint
+}
+
+// InstanceID returns the instance ID sent with every request
+func (lc *LatitudeClient) InstanceID() string {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.instanceID
+}
+
+// SetSigner sets the signer of the TPM key the API verified the instance
+// with, nil to stop signing. Every request then carries a signature over
+// its method, path, a timestamp, a nonce and the SHA-256 of its body, each
+// followed by a newline, so the API can tie reports to the machine and
+// reject replayed or copied requests.
+func (lc *LatitudeClient) SetSigner(signer RequestSigner) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.signer = signer
+}
+
+// setAuthHeader adds the bearer token to a request, falling back to the
+// LATITUDESH_AUTH_TOKEN environment variable, along with the instance
+// headers
+func (lc *LatitudeClient) setAuthHeader(req *http.Request) {
+	lc.mu.Lock()
+	instanceID, fingerprint, signer := lc.instanceID, lc.fingerprint, lc.signer
+	lc.mu.Unlock()
+	if instanceID != "" {
+		req.Header.Set("X-Agent-Instance-ID", instanceID)
+		req.Header.Set("X-Agent-Instance-Fingerprint", fingerprint)
+	}
+	if signer != nil {
+		if err := signRequest(req, signer); err != nil {
+			lc.logger.WithError(err).Warn("Failed to sign the request with the attestation key, sending it unsigned")
+		}
+	}
+
+	if lc.bearerToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", lc.bearerToken))
+	} else if token := os.Getenv("LATITUDESH_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+}
+
 // PingAndGetFirewallRules sends a ping to the API and retrieves firewall rules
 func (lc *LatitudeClient) PingAndGetFirewallRules(ctx context.Context) (string, error) {
 	lc.logger.Infof("Pinging Latitude.sh API at %s", lc.apiEndpoint)
 
+	body, pingReq, statusCode, err := lc.ping(ctx)
+	if statusCode == http.StatusUnprocessableEntity && lc.rejectOptionalFields(pingReq) {
+		// The API predates some of the fields; retry with those it accepts
+		lc.logger.Warn("The API rejected the ping, retrying without the fields it does not accept")
+		body, pingReq, _, err = lc.ping(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if pingReq.Capabilities != nil {
+		lc.clearCapabilities(pingReq.Capabilities)
+	}
+
+	lc.logger.Info("Successfully retrieved firewall rules from API")
+	return body, nil
+}
+
+// ping sends a single ping with the optional fields the API accepts and
+// returns the response body and status along with the request that was sent
+func (lc *LatitudeClient) ping(ctx context.Context) (string, PingRequest, int, error) {
 	// Prepare request body
+	lc.mu.Lock()
 	pingReq := PingRequest{
-		IPAddress: lc.publicIP,
+		IPAddress:    lc.publicIP,
+		LastError:    lc.lastError,
+		Capabilities: lc.capabilities,
 	}
+	lc.mu.Unlock()
+	pingReq = lc.withAcceptedFields(pingReq)
 
 	reqBody, err := json.Marshal(pingReq)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal ping request: %w", err)
+		return "", pingReq, 0, fmt.Errorf("failed to marshal ping request: %w", err)
 	}
 
 	// Create HTTP request
 	req, err := http.NewRequestWithContext(ctx, "GET", lc.apiEndpoint, bytes.NewBuffer(reqBody))
 	if err != nil {
-		return "", fmt.Errorf("failed to create HTTP request: %w", err)
+		return "", pingReq, 0, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
-	if lc.bearerToken != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", lc.bearerToken))
-	} else if token := os.Getenv("LATITUDESH_AUTH_TOKEN"); token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	}
+	req.Header.Set(pingFieldsHeader, strings.Join(pingFields, ","))
+	lc.setAuthHeader(req)
 
 	// Execute request
 	resp, err := lc.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("HTTP request failed: %w", err)
+		return "", pingReq, 0, fmt.Errorf("HTTP request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	lc.acceptFields(resp.Header)
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		return "", pingReq, resp.StatusCode, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	// Check HTTP status
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return "", pingReq, resp.StatusCode, statusError(resp.StatusCode, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body)))
 	}
-
-	lc.logger.Info("Successfully retrieved firewall rules from API")
-	return string(body), nil
+	return string(body), pingReq, resp.StatusCode, nil
 }
 
 // ValidateFirewallResponse validates that the API response contains expected firewall data
@@ -137,20 +281,18 @@ func (lc *LatitudeClient) HealthCheck(ctx context.Context) error {
 		return fmt.Errorf("failed to create health check request: %w", err)
 	}
 
-	if lc.bearerToken != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", lc.bearerToken))
-	} else if token := os.Getenv("LATITUDESH_AUTH_TOKEN"); token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	}
+	req.Header.Set(pingFieldsHeader, strings.Join(pingFields, ","))
+	lc.setAuthHeader(req)
 
 	resp, err := lc.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("health check request failed: %w", err)
 	}
 	defer resp.Body.Close()
+	lc.acceptFields(resp.Header)
 
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("health check failed with status %d", resp.StatusCode)
+		return statusError(resp.StatusCode, fmt.Errorf("health check failed with status %d", resp.StatusCode))
 	}
 
 	lc.logger.Info("Health check passed")
@@ -180,8 +322,110 @@ func (lc *LatitudeClient) GetFirewallRulesForDisplay(responseBody string) ([]str
 		}
 
 		displayRule := fmt.Sprintf("From: %s, To: any, Protocol: %s, Port: %s", from, protocol, port)
+		if strings.EqualFold(rule.Direction, "out") {
+			// The remote address of an outbound rule is its destination
+			displayRule = fmt.Sprintf("From: any, To: %s, Protocol: %s, Port: %s, Direction: out", from, protocol, port)
+		}
+		if strings.EqualFold(rule.Action, "deny") {
+			displayRule += ", Action: deny"
+		}
+		if rule.ExpiresAt != nil {
+			displayRule += fmt.Sprintf(", Expires: %s", rule.ExpiresAt.Format(time.RFC3339))
+		} else if rule.TTL != "" {
+			displayRule += fmt.Sprintf(", TTL: %s", rule.TTL)
+		}
 		displayRules = append(displayRules, displayRule)
 	}
 
 	return displayRules, nil
-}
\ No newline at end of file
+}
+
+// GetAgentDirectives extracts agent-level directives from the ping response
+func (lc *LatitudeClient) GetAgentDirectives(responseBody string) (*AgentDirectives, error) {
+	var directives AgentDirectives
+	if err := json.Unmarshal([]byte(responseBody), &directives); err != nil {
+		return nil, fmt.Errorf("failed to parse agent directives: %w", err)
+	}
+	return &directives, nil
+}
+
+// doJSON sends an authenticated request with an optional JSON body and
+// decodes the JSON response into out when it is not nil
+func (lc *LatitudeClient) doJSON(ctx context.Context, method, url string, body interface{}, out interface{}) error {
+	return lc.doJSONWithHeader(ctx, method, url, nil, body, out)
+}
+
+// doJSONWithHeader is doJSON with extra request headers
+func (lc *LatitudeClient) doJSONWithHeader(ctx context.Context, method, url string, header http.Header, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	lc.setAuthHeader(req)
+
+	resp, err := lc.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp.StatusCode, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(respBody)))
+	}
+
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("invalid JSON response: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// statusError tags the error for a failed API response with its kind: the
+// API rejecting the agent's credentials needs an operator, while rate limits
+// and server errors pass on their own
+func statusError(statusCode int, err error) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return errkind.Wrap(errkind.APIAuth, err)
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return errkind.Wrap(errkind.Network, err)
+	}
+	return err
+}
+
+// fetchRaw GETs a server-scoped agent endpoint and returns the raw JSON body
+func (lc *LatitudeClient) fetchRaw(ctx context.Context, endpoint string, query url.Values) (string, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("ip_address", lc.publicIP)
+	query.Set("project_id", lc.projectID)
+
+	var response json.RawMessage
+	if err := lc.doJSON(ctx, "GET", endpoint+"?"+query.Encode(), nil, &response); err != nil {
+		return "", err
+	}
+	return string(response), nil
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interaction is an API request and the response it got, as recorded to
+// and replayed from a recording
+type Interaction struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	RequestBody string    `json:"request_body,omitempty"`
+	// StatusCode, Header and ResponseBody are the response; Error is set
+	// instead when the request failed without one
+	StatusCode   int         `json:"status_code,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	ResponseBody string      `json:"response_body,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// Record appends every API request and its response to the file at path
+// as JSON lines, so a session can be replayed later. Credentials are not
+// recorded. It should be called after SetRelay.
+func (lc *LatitudeClient) Record(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	lc.httpClient.Transport = &recorder{base: lc.httpClient.Transport, file: f}
+	return nil
+}
+
+// Replay answers API requests from a recording made by Record instead of
+// the API. Requests are matched by method and URL, path and query, so a
+// recording replays against any endpoint host; matching responses are
+// served in recorded order, and the last one repeats once they run out.
+func (lc *LatitudeClient) Replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	player := &replayer{responses: make(map[string][]Interaction)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return fmt.Errorf("invalid recording %s, line %d: %w", path, line, err)
+		}
+		key := interaction.Method + " " + interaction.URL
+		player.responses[key] = append(player.responses[key], interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	lc.httpClient.Transport = &transport{base: player, pressure: lc.pressure}
+	return nil
+}
+
+// recorder records each request it passes on to base
+type recorder struct {
+	base http.RoundTripper
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	interaction := Interaction{Time: time.Now(), Method: req.Method, URL: req.URL.RequestURI()}
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			body.Close()
+			interaction.RequestBody = string(data)
+		}
+	}
+
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		r.write(interaction)
+		return nil, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	interaction.StatusCode = resp.StatusCode
+	interaction.Header = resp.Header
+	interaction.ResponseBody = string(data)
+	r.write(interaction)
+	return resp, nil
+}
+
+// write appends an interaction to the recording. A failure to record must
+// not fail the request, so it is ignored.
+func (r *recorder) write(interaction Interaction) {
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.file.Write(append(data, '\n'))
+}
+
+// replayer answers requests from recorded interactions
+type replayer struct {
+	mu        sync.Mutex
+	responses map[string][]Interaction
+}
+
+func (p *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	key := req.Method + " " + req.URL.RequestURI()
+	p.mu.Lock()
+	queue := p.responses[key]
+	if len(queue) == 0 {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s", key)
+	}
+	interaction := queue[0]
+	if len(queue) > 1 {
+		p.responses[key] = queue[1:]
+	}
+	p.mu.Unlock()
+
+	if interaction.Error != "" {
+		return nil, errors.New(interaction.Error)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.StatusCode, http.StatusText(interaction.StatusCode)),
+		StatusCode:    interaction.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        interaction.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader([]byte(interaction.ResponseBody))),
+		ContentLength: int64(len(interaction.ResponseBody)),
+		Request:       req,
+	}, nil
+}
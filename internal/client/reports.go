@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// SendReport posts a JSON report for this server to an agent API endpoint
+func (lc *LatitudeClient) SendReport(ctx context.Context, endpoint string, report interface{}) error {
+	return lc.ExchangeReport(ctx, endpoint, report, nil)
+}
+
+// ExchangeReport posts a JSON report like SendReport and decodes the JSON
+// response into out when it is not nil
+func (lc *LatitudeClient) ExchangeReport(ctx context.Context, endpoint string, report interface{}, out interface{}) error {
+	return lc.postReport(ctx, endpoint, nil, report, out)
+}
+
+// SendEvent posts a report like SendReport with an Idempotency-Key header,
+// so the API can drop a redelivery of an event it already accepted
+func (lc *LatitudeClient) SendEvent(ctx context.Context, endpoint, key string, report interface{}) error {
+	header := http.Header{}
+	if key != "" {
+		header.Set("Idempotency-Key", key)
+	}
+	return lc.postReport(ctx, endpoint, header, report, nil)
+}
+
+// postReport wraps report with this server's identifiers and posts it
+func (lc *LatitudeClient) postReport(ctx context.Context, endpoint string, header http.Header, report interface{}, out interface{}) error {
+	body := map[string]interface{}{
+		"ip_address":  lc.publicIP,
+		"project_id":  lc.projectID,
+		"firewall_id": lc.firewallID,
+		"report":      report,
+	}
+
+	if err := lc.doJSONWithHeader(ctx, "POST", endpoint, header, body, out); err != nil {
+		return fmt.Errorf("failed to send report to %s: %w", endpoint, err)
+	}
+	return nil
+}
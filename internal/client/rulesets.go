@@ -0,0 +1,51 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PendingRuleset is a ruleset the API scheduled to replace the firewall
+// rules at ApplyAt, so a change can take effect on a whole fleet at once
+type PendingRuleset struct {
+	ID      string         `json:"id"`
+	ApplyAt time.Time      `json:"apply_at"`
+	Rules   []FirewallRule `json:"rules"`
+}
+
+// RulesJSON returns the ruleset in the form of a ping response, as taken by
+// the firewall collector
+func (p *PendingRuleset) RulesJSON() (string, error) {
+	var response FirewallResponse
+	response.Firewall.Rules = p.Rules
+	if response.Firewall.Rules == nil {
+		response.Firewall.Rules = []FirewallRule{}
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode pending ruleset: %w", err)
+	}
+	return string(data), nil
+}
+
+// GetPendingRuleset extracts the ruleset scheduled for later from the ping
+// response. It returns nil without error when none is scheduled.
+func (lc *LatitudeClient) GetPendingRuleset(responseBody string) (*PendingRuleset, error) {
+	var response struct {
+		Firewall struct {
+			Pending *PendingRuleset `json:"pending"`
+		} `json:"firewall"`
+	}
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse pending ruleset: %w", err)
+	}
+	pending := response.Firewall.Pending
+	if pending == nil {
+		return nil, nil
+	}
+	if pending.ID == "" || pending.ApplyAt.IsZero() {
+		return nil, fmt.Errorf("pending ruleset requires an id and apply_at")
+	}
+	return pending, nil
+}
@@ -0,0 +1,17 @@
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// TokenScopes returns the API scopes granted to the configured token
+func (lc *LatitudeClient) TokenScopes(ctx context.Context, endpoint string) ([]string, error) {
+	var response struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := lc.doJSON(ctx, "GET", endpoint, nil, &response); err != nil {
+		return nil, fmt.Errorf("failed to fetch token scopes: %w", err)
+	}
+	return response.Scopes, nil
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// signRequest adds the attestation headers to a request, signing its
+// method, path, a timestamp, a random nonce and the SHA-256 of its body
+func signRequest(req *http.Request, signer RequestSigner) error {
+	bodyHash := sha256.New()
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+		_, err = io.Copy(bodyHash, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read request body: %w", err)
+		}
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	message := strings.Join([]string{
+		req.Method,
+		req.URL.RequestURI(),
+		timestamp,
+		hex.EncodeToString(nonce[:]),
+		hex.EncodeToString(bodyHash.Sum(nil)),
+	}, "\n") + "\n"
+	signature, err := signer.Sign(req.Context(), []byte(message))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Agent-Attestation-Key", signer.KeyID())
+	req.Header.Set("X-Agent-Attestation-Timestamp", timestamp)
+	req.Header.Set("X-Agent-Attestation-Nonce", hex.EncodeToString(nonce[:]))
+	req.Header.Set("X-Agent-Attestation-Signature", base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
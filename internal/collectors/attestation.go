@@ -0,0 +1,334 @@
+package collectors
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/sirupsen/logrus"
+)
+
+// TPMQuote is a TPM-signed statement of the PCR values
+type TPMQuote struct {
+	// PCRs is the quoted selection, e.g. "sha256:0,1,2,3,4,5,6,7"
+	PCRs string `json:"pcrs"`
+	// Nonce is the hex qualifying data signed into the quote
+	Nonce string `json:"nonce"`
+	// Message is the base64 TPMS_ATTEST structure that was signed
+	Message string `json:"message"`
+	// Signature is the base64 TPMT_SIGNATURE over the message
+	Signature string `json:"signature"`
+	// PCRValues are the base64 PCR digests the message's digest covers
+	PCRValues string `json:"pcr_values"`
+}
+
+// Attestation binds the instance identity to an attestation key (AK)
+// resident in the TPM. The API checks the endorsement key (EK) against its
+// manufacturer certificate, then proves the AK lives in the same TPM by
+// encrypting a credential to the EK for the AK's name, which only that TPM
+// can activate. The quote's nonce is the SHA-256 of the instance ID,
+// fingerprint and timestamp, each followed by a newline, so the quote
+// vouches for this instance.
+type Attestation struct {
+	Timestamp   time.Time `json:"timestamp"`
+	InstanceID  string    `json:"instance_id"`
+	Fingerprint string    `json:"fingerprint"`
+	// EKPublic is the PEM public endorsement key, and EKCertificate its
+	// base64 DER certificate from the TPM's NV storage, empty for TPMs
+	// shipped without one
+	EKPublic      string `json:"ek_public"`
+	EKCertificate string `json:"ek_certificate,omitempty"`
+	KeyHandle     string `json:"key_handle"`
+	// PublicKey is the PEM public AK, KeyPublic its base64 TPM2B_PUBLIC
+	// structure, whose attributes show it is restricted and fixed to the
+	// TPM, and KeyName the hex name credentials are made for
+	PublicKey string `json:"public_key"`
+	KeyPublic string `json:"key_public"`
+	KeyName   string `json:"key_name"`
+	// KeyID is the hex SHA-256 of the DER public AK
+	KeyID string   `json:"key_id"`
+	Quote TPMQuote `json:"quote"`
+}
+
+// TPMPresent reports whether the host has a TPM 2.0. The kernel only
+// creates a resource manager device for TPM 2.0 chips.
+func TPMPresent() bool {
+	devices, _ := filepath.Glob("/sys/class/tpmrm/tpmrm[0-9]*")
+	return len(devices) > 0
+}
+
+// AttestationCollector creates the attestation key, quotes with it, and
+// signs API requests with it through tpm2-tools
+type AttestationCollector struct {
+	rootDir        string
+	keyHandle      string
+	pcrs           string
+	commandWrapper []string
+	mu             sync.Mutex
+	keyID          string
+	logger         *logrus.Logger
+}
+
+// NewAttestationCollector creates a new attestation collector using the AK
+// at the persistent handle keyHandle. rootDir is the root of the host
+// filesystem, where the TPM commands' files are written.
+func NewAttestationCollector(rootDir, keyHandle, pcrs string, logger *logrus.Logger) *AttestationCollector {
+	return &AttestationCollector{
+		rootDir:        rootDir,
+		keyHandle:      keyHandle,
+		pcrs:           pcrs,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command prefix for TPM commands, "sudo" by
+// default
+func (ac *AttestationCollector) SetCommandWrapper(wrapper ...string) {
+	ac.commandWrapper = wrapper
+}
+
+// Attest quotes the PCRs with the AK over the instance identity, creating
+// the AK under the EK at its handle when it does not exist yet
+func (ac *AttestationCollector) Attest(ctx context.Context, instanceID, fingerprint string) (*Attestation, error) {
+	dir, err := ac.tempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	attestation := &Attestation{
+		Timestamp:   time.Now().UTC(),
+		InstanceID:  instanceID,
+		Fingerprint: fingerprint,
+		KeyHandle:   ac.keyHandle,
+	}
+	ekPublic, err := ac.createEK(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	attestation.EKPublic = string(ekPublic)
+	if _, err := ac.run(ctx, "tpm2_getekcertificate", "-o", ac.hostPath(filepath.Join(dir, "ek.crt"))); err != nil {
+		ac.logger.Debugf("No EK certificate in the TPM: %v", err)
+	} else if cert, err := ac.readFile(ctx, filepath.Join(dir, "ek.crt")); err == nil {
+		attestation.EKCertificate = base64.StdEncoding.EncodeToString(cert)
+	}
+
+	if _, err := ac.run(ctx, "tpm2_readpublic", "-c", ac.keyHandle); err != nil {
+		ac.logger.Infof("No attestation key at TPM handle %s, creating one", ac.keyHandle)
+		if err := ac.createAK(ctx, dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := ac.readAK(ctx, dir, attestation); err != nil {
+		return nil, err
+	}
+
+	nonce := sha256.Sum256([]byte(instanceID + "\n" + fingerprint + "\n" + attestation.Timestamp.Format(time.RFC3339Nano) + "\n"))
+	attestation.Quote, err = ac.quote(ctx, dir, hex.EncodeToString(nonce[:]))
+	if err != nil {
+		return nil, err
+	}
+	ac.mu.Lock()
+	ac.keyID = attestation.KeyID
+	ac.mu.Unlock()
+	return attestation, nil
+}
+
+// createEK creates the EK from its standard template, which yields the same
+// key every time, saves its context to the directory and returns it in PEM
+func (ac *AttestationCollector) createEK(ctx context.Context, dir string) ([]byte, error) {
+	if _, err := ac.run(ctx, "tpm2_createek", "-G", "rsa",
+		"-c", ac.hostPath(filepath.Join(dir, "ek.ctx")),
+		"-u", ac.hostPath(filepath.Join(dir, "ek.pem")), "-f", "pem"); err != nil {
+		return nil, err
+	}
+	return ac.readFile(ctx, filepath.Join(dir, "ek.pem"))
+}
+
+// createAK creates a restricted ECDSA signing key under the EK, which the
+// EK's credential activation vouches for, and persists it at its handle
+func (ac *AttestationCollector) createAK(ctx context.Context, dir string) error {
+	akContext := ac.hostPath(filepath.Join(dir, "ak.ctx"))
+	if _, err := ac.run(ctx, "tpm2_createak", "-C", ac.hostPath(filepath.Join(dir, "ek.ctx")),
+		"-c", akContext, "-G", "ecc", "-g", "sha256", "-s", "ecdsa"); err != nil {
+		return err
+	}
+	_, err := ac.run(ctx, "tpm2_evictcontrol", "-C", "o", "-c", akContext, ac.keyHandle)
+	return err
+}
+
+// readAK reads the AK's public key, public area and name
+func (ac *AttestationCollector) readAK(ctx context.Context, dir string, attestation *Attestation) error {
+	pemPath, tssPath, namePath := filepath.Join(dir, "ak.pem"), filepath.Join(dir, "ak.pub"), filepath.Join(dir, "ak.name")
+	if _, err := ac.run(ctx, "tpm2_readpublic", "-c", ac.keyHandle, "-f", "pem", "-o", ac.hostPath(pemPath)); err != nil {
+		return err
+	}
+	if _, err := ac.run(ctx, "tpm2_readpublic", "-c", ac.keyHandle, "-o", ac.hostPath(tssPath), "-n", ac.hostPath(namePath)); err != nil {
+		return err
+	}
+	publicKey, err := ac.readFile(ctx, pemPath)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(publicKey)
+	if block == nil {
+		return fmt.Errorf("TPM returned an invalid public key for handle %s", ac.keyHandle)
+	}
+	keyPublic, err := ac.readFile(ctx, tssPath)
+	if err != nil {
+		return err
+	}
+	name, err := ac.readFile(ctx, namePath)
+	if err != nil {
+		return err
+	}
+	keyID := sha256.Sum256(block.Bytes)
+	attestation.PublicKey = string(publicKey)
+	attestation.KeyPublic = base64.StdEncoding.EncodeToString(keyPublic)
+	attestation.KeyName = hex.EncodeToString(name)
+	attestation.KeyID = hex.EncodeToString(keyID[:])
+	return nil
+}
+
+// quote signs the PCR values and nonce with the AK
+func (ac *AttestationCollector) quote(ctx context.Context, dir, nonce string) (TPMQuote, error) {
+	if _, err := ac.run(ctx, "tpm2_quote", "-c", ac.keyHandle, "-l", ac.pcrs, "-q", nonce, "-g", "sha256",
+		"-m", ac.hostPath(filepath.Join(dir, "quote.msg")),
+		"-s", ac.hostPath(filepath.Join(dir, "quote.sig")),
+		"-o", ac.hostPath(filepath.Join(dir, "quote.pcrs"))); err != nil {
+		return TPMQuote{}, err
+	}
+
+	quote := TPMQuote{PCRs: ac.pcrs, Nonce: nonce}
+	fields := map[string]*string{"quote.msg": &quote.Message, "quote.sig": &quote.Signature, "quote.pcrs": &quote.PCRValues}
+	for name, field := range fields {
+		data, err := ac.readFile(ctx, filepath.Join(dir, name))
+		if err != nil {
+			return TPMQuote{}, err
+		}
+		*field = base64.StdEncoding.EncodeToString(data)
+	}
+	return quote, nil
+}
+
+// Activate decrypts a credential the API made with tpm2_makecredential for
+// the EK and the AK's name, and returns its secret. Only the TPM holding
+// both keys can, which proves the AK is resident in a genuine TPM.
+func (ac *AttestationCollector) Activate(ctx context.Context, credential []byte) ([]byte, error) {
+	dir, err := ac.tempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ac.createEK(ctx, dir); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "credential"), credential, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write credential: %w", err)
+	}
+	// Using the EK takes a policy session satisfied by the endorsement
+	// hierarchy's authorization
+	session := ac.hostPath(filepath.Join(dir, "session.ctx"))
+	if _, err := ac.run(ctx, "tpm2_startauthsession", "--policy-session", "-S", session); err != nil {
+		return nil, err
+	}
+	defer ac.run(context.WithoutCancel(ctx), "tpm2_flushcontext", session)
+	if _, err := ac.run(ctx, "tpm2_policysecret", "-S", session, "-c", "e"); err != nil {
+		return nil, err
+	}
+	if _, err := ac.run(ctx, "tpm2_activatecredential", "-c", ac.keyHandle,
+		"-C", ac.hostPath(filepath.Join(dir, "ek.ctx")),
+		"-i", ac.hostPath(filepath.Join(dir, "credential")),
+		"-o", ac.hostPath(filepath.Join(dir, "secret")),
+		"-P", "session:"+session); err != nil {
+		return nil, err
+	}
+	return ac.readFile(ctx, filepath.Join(dir, "secret"))
+}
+
+// KeyID returns the ID of the AK, empty until Attest succeeded
+func (ac *AttestationCollector) KeyID() string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.keyID
+}
+
+// Sign signs message with the AK and returns the DER ECDSA signature. A
+// restricted key only signs digests the TPM hashed itself, which shows
+// they are not forged TPM attestation structures.
+func (ac *AttestationCollector) Sign(ctx context.Context, message []byte) ([]byte, error) {
+	dir, err := ac.tempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.WriteFile(filepath.Join(dir, "message"), message, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write message: %w", err)
+	}
+	digest, ticket := ac.hostPath(filepath.Join(dir, "digest")), ac.hostPath(filepath.Join(dir, "ticket"))
+	// The AK lives in the endorsement hierarchy, whose ticket it requires
+	if _, err := ac.run(ctx, "tpm2_hash", "-C", "e", "-g", "sha256", "-o", digest, "-t", ticket,
+		ac.hostPath(filepath.Join(dir, "message"))); err != nil {
+		return nil, err
+	}
+	if _, err := ac.run(ctx, "tpm2_sign", "-c", ac.keyHandle, "-g", "sha256", "-d", "-t", ticket, "-f", "plain",
+		"-o", ac.hostPath(filepath.Join(dir, "signature")), digest); err != nil {
+		return nil, err
+	}
+	return ac.readFile(ctx, filepath.Join(dir, "signature"))
+}
+
+// tempDir creates a temporary directory on the host filesystem, where the
+// TPM tools run
+func (ac *AttestationCollector) tempDir() (string, error) {
+	dir, err := os.MkdirTemp(filepath.Join(ac.rootDir, "tmp"), "lsh-attestation-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return dir, nil
+}
+
+// run runs a privileged tpm2-tools command
+func (ac *AttestationCollector) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	argv := append(append(append([]string{}, ac.commandWrapper...), name), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// readFile reads a file written by a TPM command, which may only be
+// readable by root
+func (ac *AttestationCollector) readFile(ctx context.Context, path string) ([]byte, error) {
+	if len(ac.commandWrapper) == 0 {
+		return os.ReadFile(path)
+	}
+	argv := append(append([]string{}, ac.commandWrapper...), "cat", ac.hostPath(path))
+	data, err := command.Output(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// hostPath returns the path of a file under rootDir on the host
+func (ac *AttestationCollector) hostPath(path string) string {
+	rel, err := filepath.Rel(ac.rootDir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
@@ -0,0 +1,230 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported backup tools
+const (
+	BackupRestic    = "restic"
+	BackupBorgmatic = "borgmatic"
+	BackupVeeam     = "veeam"
+)
+
+// backupBinaries maps each tool to the binary that identifies it
+var backupBinaries = map[string]string{
+	BackupRestic:    "restic",
+	BackupBorgmatic: "borgmatic",
+	BackupVeeam:     "veeamconfig",
+}
+
+// BackupStatus describes the most recent successful backup of one tool
+type BackupStatus struct {
+	Tool        string     `json:"tool"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	AgeSeconds  int64      `json:"age_seconds,omitempty"`
+	// Stale is set when the last success is older than the maximum age, or
+	// when no successful backup was found at all
+	Stale bool   `json:"stale"`
+	Error string `json:"error,omitempty"`
+}
+
+// BackupReport represents the backup status reported to the API
+type BackupReport struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Backups   []BackupStatus `json:"backups"`
+}
+
+// BackupCollector detects restic, borgmatic and Veeam Agent for Linux and
+// reports when each last completed a backup
+type BackupCollector struct {
+	rootDir        string
+	resticEnvFile  string
+	maxAge         time.Duration
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewBackupCollector creates a new backup collector. rootDir is the root of
+// the host filesystem, "/" unless running in a container. restic needs its
+// repository settings, which are sourced from resticEnvFile.
+func NewBackupCollector(rootDir, resticEnvFile string, maxAge time.Duration, logger *logrus.Logger) *BackupCollector {
+	return &BackupCollector{
+		rootDir:        rootDir,
+		resticEnvFile:  resticEnvFile,
+		maxAge:         maxAge,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run backup tools with privileges
+func (bc *BackupCollector) SetCommandWrapper(wrapper ...string) {
+	bc.commandWrapper = wrapper
+}
+
+// Collect reports the last successful backup of every installed tool
+func (bc *BackupCollector) Collect(ctx context.Context) *BackupReport {
+	report := &BackupReport{Timestamp: time.Now(), Backups: []BackupStatus{}}
+
+	for _, tool := range []string{BackupRestic, BackupBorgmatic, BackupVeeam} {
+		if !bc.installed(backupBinaries[tool]) {
+			continue
+		}
+
+		status := BackupStatus{Tool: tool}
+		last, err := bc.lastSuccess(ctx, tool)
+		if err != nil {
+			status.Error = err.Error()
+		}
+		if last != nil {
+			status.LastSuccess = last
+			status.AgeSeconds = int64(report.Timestamp.Sub(*last).Seconds())
+		}
+		status.Stale = last == nil || report.Timestamp.Sub(*last) > bc.maxAge
+		report.Backups = append(report.Backups, status)
+	}
+
+	return report
+}
+
+// installed reports whether a binary exists in one of the usual locations
+func (bc *BackupCollector) installed(binary string) bool {
+	for _, dir := range []string{"/usr/bin", "/usr/local/bin", "/bin", "/usr/sbin"} {
+		if _, err := os.Stat(filepath.Join(bc.rootDir, dir, binary)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSuccess returns the time of a tool's most recent successful backup,
+// or nil if there is none
+func (bc *BackupCollector) lastSuccess(ctx context.Context, tool string) (*time.Time, error) {
+	switch tool {
+	case BackupRestic:
+		if _, err := os.Stat(filepath.Join(bc.rootDir, bc.resticEnvFile)); err != nil {
+			return nil, fmt.Errorf("restic is installed but %s is missing; it must set RESTIC_REPOSITORY and RESTIC_PASSWORD_FILE", bc.resticEnvFile)
+		}
+		// The environment file is sourced by a shell so repository
+		// credentials never appear on a command line
+		output, err := bc.run(ctx, "sh", "-c", `set -a; . "$0"; exec restic snapshots --json --latest 1 --no-lock`, bc.resticEnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list restic snapshots: %w", err)
+		}
+		return parseResticSnapshots(output)
+	case BackupBorgmatic:
+		output, err := bc.run(ctx, "borgmatic", "list", "--last", "1", "--json")
+		if err != nil {
+			return nil, err
+		}
+		return parseBorgmaticList(output)
+	default:
+		output, err := bc.run(ctx, "veeamconfig", "session", "list")
+		if err != nil {
+			return nil, err
+		}
+		return parseVeeamSessions(output), nil
+	}
+}
+
+// parseResticSnapshots returns the newest snapshot time. restic only creates
+// a snapshot when a backup completes.
+func parseResticSnapshots(output string) (*time.Time, error) {
+	var snapshots []struct {
+		Time time.Time `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(output), &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse restic snapshots: %w", err)
+	}
+
+	var last *time.Time
+	for _, s := range snapshots {
+		if last == nil || s.Time.After(*last) {
+			t := s.Time
+			last = &t
+		}
+	}
+	return last, nil
+}
+
+// parseBorgmaticList returns the newest archive time across repositories,
+// ignoring checkpoints left by interrupted runs. borg prints times without a
+// zone, in local time.
+func parseBorgmaticList(output string) (*time.Time, error) {
+	var repositories []struct {
+		Archives []struct {
+			Name string `json:"name"`
+			Time string `json:"time"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal([]byte(output), &repositories); err != nil {
+		return nil, fmt.Errorf("failed to parse borgmatic list: %w", err)
+	}
+
+	var last *time.Time
+	for _, repository := range repositories {
+		for _, archive := range repository.Archives {
+			if strings.HasSuffix(archive.Name, ".checkpoint") {
+				continue
+			}
+			t, err := time.ParseInLocation("2006-01-02T15:04:05.999999", archive.Time, time.Local)
+			if err != nil {
+				continue
+			}
+			if last == nil || t.After(*last) {
+				last = &t
+			}
+		}
+	}
+	return last, nil
+}
+
+// parseVeeamSessions returns the finish time of the newest successful session
+// from `veeamconfig session list`, whose lines end with the state and the
+// start and finish times:
+// backup  Backup  {id}  Success  2024-01-01 10:00  2024-01-01 10:05
+func parseVeeamSessions(output string) *time.Time {
+	var last *time.Time
+	lines.Scan(strings.NewReader(output), func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[len(fields)-5] != "Success" {
+			return
+		}
+		finished := fields[len(fields)-2] + " " + fields[len(fields)-1]
+		t, err := time.ParseInLocation("2006-01-02 15:04", finished, time.Local)
+		if err != nil {
+			return
+		}
+		if last == nil || t.After(*last) {
+			last = &t
+		}
+	})
+	return last
+}
+
+// run executes a privileged command and returns its output
+func (bc *BackupCollector) run(ctx context.Context, name string, args ...string) (string, error) {
+	argv := append(append(append([]string{}, bc.commandWrapper...), name), args...)
+	output, err := command.Output(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s failed: %w", name, err)
+	}
+	return string(output), nil
+}
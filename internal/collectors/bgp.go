@@ -0,0 +1,269 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported BGP daemons
+const (
+	BGPDaemonFRR  = "frr"
+	BGPDaemonBird = "bird"
+)
+
+// BGPSession describes the state of a single BGP session
+type BGPSession struct {
+	Daemon        string `json:"daemon"`
+	Name          string `json:"name,omitempty"`
+	Neighbor      string `json:"neighbor"`
+	RemoteAS      int64  `json:"remote_as,omitempty"`
+	AddressFamily string `json:"address_family,omitempty"`
+	State         string `json:"state"`
+	Established   bool   `json:"established"`
+	// AdminDown sessions were shut down on purpose and do not degrade health
+	AdminDown        bool  `json:"admin_down"`
+	PrefixesReceived int64 `json:"prefixes_received"`
+	PrefixesSent     int64 `json:"prefixes_sent"`
+	UptimeSeconds    int64 `json:"uptime_seconds,omitempty"`
+}
+
+// BGPReport represents the BGP session state reported to the API
+type BGPReport struct {
+	Timestamp time.Time    `json:"timestamp"`
+	Daemons   []string     `json:"daemons"`
+	Sessions  []BGPSession `json:"sessions"`
+	// Degraded is set when any session that is not shut down is not established
+	Degraded bool `json:"degraded"`
+}
+
+// DownSessions returns the sessions that degrade network health
+func (r *BGPReport) DownSessions() []BGPSession {
+	var down []BGPSession
+	for _, session := range r.Sessions {
+		if !session.Established && !session.AdminDown {
+			down = append(down, session)
+		}
+	}
+	return down
+}
+
+// BGPCollector reports BGP session state from FRR (vtysh) and BIRD (birdc)
+type BGPCollector struct {
+	rootDir        string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewBGPCollector creates a new BGP collector. rootDir is the root of the
+// host filesystem, "/" unless running in a container.
+func NewBGPCollector(rootDir string, logger *logrus.Logger) *BGPCollector {
+	return &BGPCollector{
+		rootDir:        rootDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to query the routing daemons
+func (bc *BGPCollector) SetCommandWrapper(wrapper ...string) {
+	bc.commandWrapper = wrapper
+}
+
+// Collect queries every installed BGP daemon for its sessions
+func (bc *BGPCollector) Collect(ctx context.Context) (*BGPReport, error) {
+	report := &BGPReport{Timestamp: time.Now(), Daemons: []string{}, Sessions: []BGPSession{}}
+
+	var errs []string
+	if bc.installed("vtysh") {
+		report.Daemons = append(report.Daemons, BGPDaemonFRR)
+		err := bc.stream(ctx, func(stdout io.Reader) error {
+			sessions, err := parseFRRSummary(stdout)
+			report.Sessions = append(report.Sessions, sessions...)
+			return err
+		}, "vtysh", "-c", "show bgp summary json")
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if bc.installed("birdc") {
+		report.Daemons = append(report.Daemons, BGPDaemonBird)
+		err := bc.stream(ctx, func(stdout io.Reader) error {
+			sessions, err := parseBirdProtocols(stdout)
+			report.Sessions = append(report.Sessions, sessions...)
+			return err
+		}, "birdc", "show", "protocols", "all")
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	report.Degraded = len(report.DownSessions()) > 0
+	if len(errs) > 0 {
+		// A daemon that cannot be queried may have dropped every session
+		report.Degraded = true
+		return report, fmt.Errorf("failed to query BGP daemons: %s", strings.Join(errs, "; "))
+	}
+	return report, nil
+}
+
+// installed reports whether a binary exists in one of the usual locations
+func (bc *BGPCollector) installed(binary string) bool {
+	for _, dir := range []string{"/usr/bin", "/usr/sbin", "/usr/local/bin", "/usr/local/sbin"} {
+		if _, err := os.Stat(filepath.Join(bc.rootDir, dir, binary)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFRRSummary parses `show bgp summary json`, which has one object per
+// address family keyed like "ipv4Unicast", each with its peers
+func parseFRRSummary(output io.Reader) ([]BGPSession, error) {
+	var families map[string]struct {
+		Peers map[string]struct {
+			Hostname       string `json:"hostname"`
+			RemoteAS       int64  `json:"remoteAs"`
+			State          string `json:"state"`
+			PfxRcd         int64  `json:"pfxRcd"`
+			PfxSnt         int64  `json:"pfxSnt"`
+			PeerUptimeMsec int64  `json:"peerUptimeMsec"`
+		} `json:"peers"`
+	}
+	if err := json.NewDecoder(output).Decode(&families); err != nil {
+		return nil, fmt.Errorf("failed to parse FRR BGP summary: %w", err)
+	}
+
+	var sessions []BGPSession
+	for family, summary := range families {
+		for neighbor, peer := range summary.Peers {
+			session := BGPSession{
+				Daemon:           BGPDaemonFRR,
+				Name:             peer.Hostname,
+				Neighbor:         neighbor,
+				RemoteAS:         peer.RemoteAS,
+				AddressFamily:    family,
+				State:            peer.State,
+				Established:      peer.State == "Established",
+				AdminDown:        strings.Contains(peer.State, "(Admin)"),
+				PrefixesReceived: peer.PfxRcd,
+				PrefixesSent:     peer.PfxSnt,
+			}
+			if session.Established {
+				session.UptimeSeconds = peer.PeerUptimeMsec / 1000
+			}
+			sessions = append(sessions, session)
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].AddressFamily != sessions[j].AddressFamily {
+			return sessions[i].AddressFamily < sessions[j].AddressFamily
+		}
+		return sessions[i].Neighbor < sessions[j].Neighbor
+	})
+	return sessions, nil
+}
+
+// parseBirdProtocols parses `birdc show protocols all`. Each BGP protocol
+// starts with an unindented summary line followed by indented details:
+//
+//	upstream1  BGP  ---  up  2024-01-01 10:00:00  Established
+//	  BGP state:          Established
+//	    Neighbor address: 192.0.2.1
+//	    Neighbor AS:      64500
+//	    Routes:         10 imported, 1 exported, 10 preferred
+func parseBirdProtocols(output io.Reader) ([]BGPSession, error) {
+	var sessions []BGPSession
+	var current *BGPSession
+
+	err := lines.Scan(output, func(line string) {
+		if line == "" {
+			return
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			if current != nil {
+				sessions = append(sessions, *current)
+				current = nil
+			}
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "BGP" {
+				current = &BGPSession{Daemon: BGPDaemonBird, Name: fields[0], State: fields[3]}
+				// Failing sessions cycle through "start"; BIRD only shows
+				// a BGP protocol as "down" once it has been disabled
+				current.AdminDown = fields[3] == "down"
+			}
+			return
+		}
+		if current == nil {
+			return
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			return
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "BGP state":
+			current.State = value
+			current.Established = value == "Established"
+		case "Neighbor address":
+			current.Neighbor = value
+		case "Neighbor AS":
+			current.RemoteAS, _ = strconv.ParseInt(value, 10, 64)
+		case "Routes":
+			// "10 imported, 1 exported, 10 preferred", once per channel
+			for _, part := range strings.Split(value, ",") {
+				fields := strings.Fields(part)
+				if len(fields) != 2 {
+					continue
+				}
+				count, _ := strconv.ParseInt(fields[0], 10, 64)
+				switch fields[1] {
+				case "imported":
+					current.PrefixesReceived += count
+				case "exported":
+					current.PrefixesSent += count
+				}
+			}
+		}
+	})
+	if current != nil {
+		sessions = append(sessions, *current)
+	}
+	return sessions, err
+}
+
+// stream executes a privileged command, passing its output to parse as it
+// is produced
+func (bc *BGPCollector) stream(ctx context.Context, parse func(io.Reader) error, name string, args ...string) error {
+	argv := append(append(append([]string{}, bc.commandWrapper...), name), args...)
+	var parseErr error
+	err := command.Stream(ctx, command.Cmd{Argv: argv}, func(stdout io.Reader) error {
+		parseErr = parse(stdout)
+		return parseErr
+	})
+	if err != nil && err != parseErr {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/sirupsen/logrus"
+)
+
+// bmcWebPort is where BMCs serve their web UI and HTML5 remote console
+const bmcWebPort = "443"
+
+// BMCReport represents the BMC health reported to the API
+type BMCReport struct {
+	Timestamp        time.Time `json:"timestamp"`
+	Reachable        bool      `json:"reachable"`
+	FirmwareRevision string    `json:"firmware_revision,omitempty"`
+	Manufacturer     string    `json:"manufacturer,omitempty"`
+	SOLEnabled       bool      `json:"sol_enabled"`
+	WebConsole       bool      `json:"web_console"`
+	SELEntries       int       `json:"sel_entries"`
+	SELPercentUsed   int       `json:"sel_percent_used"`
+	Errors           []string  `json:"errors,omitempty"`
+}
+
+// BMCCollector checks the server's BMC over IPMI with ipmitool
+type BMCCollector struct {
+	ipmitoolBinary string
+	host           string
+	username       string
+	password       string
+	iface          string
+	logger         *logrus.Logger
+}
+
+// NewBMCCollector creates a new BMC collector for the BMC at host
+func NewBMCCollector(ipmitoolBinary, host, username, password, iface string, logger *logrus.Logger) *BMCCollector {
+	return &BMCCollector{
+		ipmitoolBinary: ipmitoolBinary,
+		host:           host,
+		username:       username,
+		password:       password,
+		iface:          iface,
+		logger:         logger,
+	}
+}
+
+// Check verifies BMC reachability, remote console availability, SEL space
+// and firmware version. Individual check failures are recorded in the report.
+func (bc *BMCCollector) Check(ctx context.Context) *BMCReport {
+	report := &BMCReport{Timestamp: time.Now()}
+
+	mcInfo, err := bc.ipmitool(ctx, "mc", "info")
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	report.Reachable = true
+	info := parseIPMIFields(mcInfo)
+	report.FirmwareRevision = info["Firmware Revision"]
+	report.Manufacturer = info["Manufacturer Name"]
+
+	if selInfo, err := bc.ipmitool(ctx, "sel", "info"); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		sel := parseIPMIFields(selInfo)
+		report.SELEntries, _ = strconv.Atoi(sel["Entries"])
+		report.SELPercentUsed, _ = strconv.Atoi(strings.TrimSuffix(sel["Percent Used"], "%"))
+	}
+
+	if solInfo, err := bc.ipmitool(ctx, "sol", "info"); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else {
+		report.SOLEnabled = parseIPMIFields(solInfo)["Enabled"] == "true"
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	if conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(bc.host, bmcWebPort)); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("web console unreachable: %v", err))
+	} else {
+		conn.Close()
+		report.WebConsole = true
+	}
+
+	return report
+}
+
+// ColdReset restarts the BMC controller. The host keeps running, but the BMC
+// is unreachable for a few minutes while it boots.
+func (bc *BMCCollector) ColdReset(ctx context.Context) error {
+	_, err := bc.ipmitool(ctx, "mc", "reset", "cold")
+	return err
+}
+
+// ipmitool runs an ipmitool command against the BMC. The password is passed
+// in the environment so it does not appear in the process list.
+func (bc *BMCCollector) ipmitool(ctx context.Context, args ...string) (string, error) {
+	argv := append([]string{"-I", bc.iface, "-H", bc.host, "-U", bc.username, "-E"}, args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{
+		Argv: append([]string{bc.ipmitoolBinary}, argv...),
+		Env:  []string{"IPMI_PASSWORD=" + bc.password},
+	})
+	if err != nil {
+		return "", fmt.Errorf("ipmitool %s failed: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// parseIPMIFields parses "Key : Value" lines printed by ipmitool
+func parseIPMIFields(output string) map[string]string {
+	fields := make(map[string]string)
+	lines.Scan(strings.NewReader(output), func(line string) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		key = strings.TrimSpace(key)
+		if _, exists := fields[key]; !exists {
+			fields[key] = strings.TrimSpace(value)
+		}
+	})
+	return fields
+}
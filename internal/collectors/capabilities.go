@@ -0,0 +1,58 @@
+package collectors
+
+import (
+	"context"
+	"os"
+
+	"github.com/latitudesh/agent/internal/command"
+)
+
+// capabilityTools maps the optional external tools the agent works with to
+// what they provide, so a missing tool explains missing data
+var capabilityTools = map[string]string{
+	"ufw":         "firewall",
+	"ipmitool":    "bmc",
+	"smartctl":    "disk health",
+	"nvme":        "nvme health",
+	"sensors":     "temperatures",
+	"wg":          "wireguard",
+	"fio":         "disk benchmarks",
+	"vtysh":       "bgp (frr)",
+	"birdc":       "bgp (bird)",
+	"ipset":       "reputation feeds",
+	"restic":      "backup",
+	"borgmatic":   "backup",
+	"veeamconfig": "backup",
+	"apt-get":     "patches",
+}
+
+// Capability tells whether an external tool is available on the server
+type Capability struct {
+	Available bool   `json:"available"`
+	Path      string `json:"path,omitempty"`
+	Version   string `json:"version,omitempty"`
+	// Provides is what the agent uses the tool for
+	Provides string `json:"provides"`
+	// Error explains why a tool that is installed cannot be used
+	Error string `json:"error,omitempty"`
+}
+
+// Capabilities checks which external tools are installed under rootDir,
+// keyed by tool name
+func Capabilities(ctx context.Context, rootDir string) map[string]Capability {
+	capabilities := make(map[string]Capability, len(capabilityTools))
+	for name, provides := range capabilityTools {
+		tool := command.Probe(ctx, rootDir, name)
+		capability := Capability{Provides: provides, Path: tool.Path, Version: tool.Version}
+		switch {
+		case tool.Err == nil:
+			capability.Available = true
+		case os.IsNotExist(tool.Err):
+			capability.Path = ""
+		default:
+			capability.Error = tool.Err.Error()
+		}
+		capabilities[name] = capability
+	}
+	return capabilities
+}
@@ -0,0 +1,214 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// validSysctlKey matches sysctl names like net.ipv4.ip_forward; VLAN
+	// interfaces put dots in names, which sysctl writes as slashes
+	validSysctlKey = regexp.MustCompile(`^[a-zA-Z0-9_-]+(\.[a-zA-Z0-9_/-]+)+$`)
+	// validModuleName matches kernel module names
+	validModuleName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+)
+
+// ValidSysctlKey reports whether a sysctl name is well formed
+func ValidSysctlKey(key string) bool {
+	return validSysctlKey.MatchString(key) && !strings.Contains(key, "..")
+}
+
+// ValidModuleName reports whether a kernel module name is well formed
+func ValidModuleName(name string) bool {
+	return validModuleName.MatchString(name)
+}
+
+// CompliancePolicy lists the expected sysctl values and forbidden modules
+type CompliancePolicy struct {
+	Sysctls          map[string]string `json:"sysctls"`
+	ForbiddenModules []string          `json:"forbidden_modules"`
+}
+
+// ParseCompliancePolicy parses the compliance policy returned by the API
+func ParseCompliancePolicy(policyJSON string) (*CompliancePolicy, error) {
+	var policy CompliancePolicy
+	if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse compliance policy: %w", err)
+	}
+	return &policy, nil
+}
+
+// Merge adds the entries of other to the policy. Sysctl values in other win.
+func (p *CompliancePolicy) Merge(other *CompliancePolicy) {
+	if p.Sysctls == nil {
+		p.Sysctls = make(map[string]string)
+	}
+	for key, value := range other.Sysctls {
+		p.Sysctls[key] = value
+	}
+	for _, module := range other.ForbiddenModules {
+		if !slices.Contains(p.ForbiddenModules, module) {
+			p.ForbiddenModules = append(p.ForbiddenModules, module)
+		}
+	}
+}
+
+// SysctlCheck is the audit result of one sysctl
+type SysctlCheck struct {
+	Key       string `json:"key"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+	Compliant bool   `json:"compliant"`
+	// Enforced is set when the agent wrote the expected value
+	Enforced bool   `json:"enforced,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ModuleCheck is the audit result of one forbidden kernel module
+type ModuleCheck struct {
+	Name   string `json:"name"`
+	Loaded bool   `json:"loaded"`
+}
+
+// ComplianceReport represents the compliance audit reported to the API
+type ComplianceReport struct {
+	Timestamp  time.Time     `json:"timestamp"`
+	Sysctls    []SysctlCheck `json:"sysctls"`
+	Modules    []ModuleCheck `json:"modules"`
+	Violations int           `json:"violations"`
+}
+
+// ComplianceCollector audits sysctl values and loaded kernel modules
+type ComplianceCollector struct {
+	enforce        bool
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewComplianceCollector creates a new compliance collector. With enforce
+// set, sysctls that differ from the policy are set to the expected value.
+func NewComplianceCollector(enforce bool, logger *logrus.Logger) *ComplianceCollector {
+	return &ComplianceCollector{
+		enforce:        enforce,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run sysctl with privileges
+func (cc *ComplianceCollector) SetCommandWrapper(wrapper ...string) {
+	cc.commandWrapper = wrapper
+}
+
+// Audit checks the host against the policy, enforcing sysctls if enabled.
+// Malformed entries are reported as violations rather than read.
+func (cc *ComplianceCollector) Audit(ctx context.Context, policy *CompliancePolicy) (*ComplianceReport, error) {
+	report := &ComplianceReport{Timestamp: time.Now(), Sysctls: []SysctlCheck{}, Modules: []ModuleCheck{}}
+
+	keys := make([]string, 0, len(policy.Sysctls))
+	for key := range policy.Sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		check := SysctlCheck{Key: key, Expected: normalizeSysctl(policy.Sysctls[key])}
+		if !ValidSysctlKey(key) {
+			check.Error = "invalid sysctl name"
+			report.Sysctls = append(report.Sysctls, check)
+			report.Violations++
+			continue
+		}
+
+		check.Actual, check.Error = readSysctl(key)
+		check.Compliant = check.Error == "" && check.Actual == check.Expected
+		if !check.Compliant && check.Error == "" && cc.enforce {
+			if _, err := cc.run(ctx, "sysctl", "-w", key+"="+check.Expected); err != nil {
+				check.Error = err.Error()
+			} else {
+				cc.logger.Infof("Set sysctl %s from %q to %q", key, check.Actual, check.Expected)
+				check.Enforced = true
+				check.Actual, check.Error = readSysctl(key)
+				check.Compliant = check.Error == "" && check.Actual == check.Expected
+			}
+		}
+		if !check.Compliant {
+			report.Violations++
+		}
+		report.Sysctls = append(report.Sysctls, check)
+	}
+
+	// Kernels built without module support have no /proc/modules
+	loaded, err := loadedModules()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read loaded modules: %w", err)
+	}
+	modules := append([]string{}, policy.ForbiddenModules...)
+	sort.Strings(modules)
+	for _, name := range modules {
+		// The kernel reports modules with underscores, modprobe accepts both
+		check := ModuleCheck{Name: name, Loaded: slices.Contains(loaded, strings.ReplaceAll(name, "-", "_"))}
+		if check.Loaded {
+			report.Violations++
+		}
+		report.Modules = append(report.Modules, check)
+	}
+
+	return report, nil
+}
+
+// ReadSysctl returns the current value of a sysctl
+func ReadSysctl(key string) (string, error) {
+	value, errMsg := readSysctl(key)
+	if errMsg != "" {
+		return "", fmt.Errorf("sysctl %s: %s", key, errMsg)
+	}
+	return value, nil
+}
+
+// readSysctl reads a sysctl value from /proc/sys, returning an error message
+// rather than an error so it can be reported per entry
+func readSysctl(key string) (string, string) {
+	// Dots separate path components; slashes stand for dots within a name
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(part, "/", ".")
+	}
+	path := filepath.Join(append([]string{"/proc/sys"}, parts...)...)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "unknown sysctl"
+		}
+		return "", err.Error()
+	}
+	return normalizeSysctl(string(data)), ""
+}
+
+// normalizeSysctl collapses whitespace, as multi-value sysctls are read back
+// separated by tabs
+func normalizeSysctl(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// run executes a privileged command and returns its output
+func (cc *ComplianceCollector) run(ctx context.Context, name string, args ...string) (string, error) {
+	argv := append(append(append([]string{}, cc.commandWrapper...), name), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
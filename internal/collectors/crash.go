@@ -0,0 +1,192 @@
+package collectors
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	reportedCrashesFile = "crashes.json"
+	// maxCrashLog limits how much of a dump's kernel log is uploaded
+	maxCrashLog = 64 * 1024
+)
+
+// CrashDump describes a kernel crash dump found in the crash directory
+type CrashDump struct {
+	Name      string    `json:"name"`
+	Time      time.Time `json:"time"`
+	SizeBytes int64     `json:"size_bytes"`
+	Files     []string  `json:"files"`
+	// KernelLog is the gzipped, base64-encoded tail of the dump's dmesg
+	KernelLog string `json:"kernel_log,omitempty"`
+}
+
+// CrashReport represents kdump status and new crash dumps reported to the API
+type CrashReport struct {
+	Timestamp      time.Time   `json:"timestamp"`
+	KdumpLoaded    bool        `json:"kdump_loaded"`
+	CrashKernelArg string      `json:"crashkernel,omitempty"`
+	NewDumps       []CrashDump `json:"new_dumps"`
+	TotalDumps     int         `json:"total_dumps"`
+
+	// dumps names every dump present, recorded once the report is delivered
+	dumps []string
+}
+
+// CrashCollector reports kdump readiness and kernel crash dumps
+type CrashCollector struct {
+	rootDir   string
+	crashDir  string
+	stateDir  string
+	uploadLog bool
+	logger    *logrus.Logger
+}
+
+// NewCrashCollector creates a new crash collector. rootDir is the root of the
+// host filesystem, "/" unless running in a container. When uploadLog is set,
+// the tail of each new dump's kernel log is included in the report.
+func NewCrashCollector(rootDir, crashDir, stateDir string, uploadLog bool, logger *logrus.Logger) *CrashCollector {
+	return &CrashCollector{
+		rootDir:   rootDir,
+		crashDir:  crashDir,
+		stateDir:  stateDir,
+		uploadLog: uploadLog,
+		logger:    logger,
+	}
+}
+
+// Collect checks kdump status and looks for crash dumps not reported yet
+func (cc *CrashCollector) Collect() (*CrashReport, error) {
+	report := &CrashReport{Timestamp: time.Now(), NewDumps: []CrashDump{}}
+
+	// The crash kernel is loaded by kexec once kdump is set up; this is the
+	// same check kdump-config and kdumpctl use
+	if data, err := os.ReadFile("/sys/kernel/kexec_crash_loaded"); err == nil {
+		report.KdumpLoaded = strings.TrimSpace(string(data)) == "1"
+	}
+	if cmdline, err := os.ReadFile("/proc/cmdline"); err == nil {
+		for _, arg := range strings.Fields(string(cmdline)) {
+			if value, ok := strings.CutPrefix(arg, "crashkernel="); ok {
+				report.CrashKernelArg = value
+			}
+		}
+	}
+
+	var reported []string
+	if err := state.Load(cc.stateDir, reportedCrashesFile, &reported); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, name := range reported {
+		seen[name] = true
+	}
+
+	// Both kdump-tools (Debian/Ubuntu) and kexec-tools (RHEL) write each
+	// dump to its own subdirectory of the crash directory
+	dir := filepath.Join(cc.rootDir, cc.crashDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dump, ok := cc.inspectDump(filepath.Join(dir, entry.Name()))
+		if !ok {
+			continue
+		}
+		report.TotalDumps++
+		report.dumps = append(report.dumps, dump.Name)
+		if !seen[dump.Name] {
+			report.NewDumps = append(report.NewDumps, *dump)
+		}
+	}
+
+	sort.Slice(report.NewDumps, func(i, j int) bool {
+		return report.NewDumps[i].Time.Before(report.NewDumps[j].Time)
+	})
+	return report, nil
+}
+
+// MarkReported records the dumps in the report so they are not reported again
+func (cc *CrashCollector) MarkReported(report *CrashReport) error {
+	return state.Save(cc.stateDir, reportedCrashesFile, report.dumps)
+}
+
+// inspectDump describes a dump directory, returning false if it holds no dump
+func (cc *CrashCollector) inspectDump(path string) (*CrashDump, bool) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, false
+	}
+
+	dump := &CrashDump{Name: filepath.Base(path)}
+	var logFile string
+	hasCore := false
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		dump.Files = append(dump.Files, name)
+		dump.SizeBytes += info.Size()
+		if info.ModTime().After(dump.Time) {
+			dump.Time = info.ModTime()
+		}
+		switch {
+		case strings.HasPrefix(name, "vmcore") && !strings.Contains(name, "dmesg"), strings.HasPrefix(name, "dump."):
+			hasCore = true
+		case strings.HasPrefix(name, "dmesg.") || name == "vmcore-dmesg.txt":
+			logFile = filepath.Join(path, name)
+		}
+	}
+	if !hasCore && logFile == "" {
+		return nil, false
+	}
+
+	if cc.uploadLog && logFile != "" {
+		if encoded, err := compressTail(logFile, maxCrashLog); err != nil {
+			cc.logger.WithError(err).Warnf("Failed to read kernel log of crash dump %s", dump.Name)
+		} else {
+			dump.KernelLog = encoded
+		}
+	}
+	return dump, true
+}
+
+// compressTail gzips the last limit bytes of a file and encodes them as base64
+func compressTail(path string, limit int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Size() > limit {
+		if _, err := f.Seek(-limit, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gz, f); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,115 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Device subsystems reported by WatchDevices
+const (
+	DeviceDisk      = "disk"
+	DeviceInterface = "interface"
+)
+
+// DeviceEvent is a disk or network interface that appeared or disappeared
+type DeviceEvent struct {
+	Time time.Time `json:"time"`
+	// Action is "add" or "remove"
+	Action string `json:"action"`
+	// Type is DeviceDisk or DeviceInterface
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// DeviceReport is sent when disks or network interfaces change, with the
+// events and the devices present afterwards
+type DeviceReport struct {
+	Timestamp  time.Time            `json:"timestamp"`
+	Events     []DeviceEvent        `json:"events"`
+	Disks      []InventoryDisk      `json:"disks"`
+	Interfaces []InventoryInterface `json:"interfaces"`
+}
+
+// ueventKernelGroup is the netlink multicast group of the kernel's uevents,
+// as opposed to those udev rebroadcasts after processing them
+const ueventKernelGroup = 1
+
+// WatchDevices calls changed for each physical disk or network interface
+// added or removed, as announced by kernel uevents, until the context is
+// cancelled
+func WatchDevices(ctx context.Context, changed func(DeviceEvent)) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("failed to open uevent socket: %w", err)
+	}
+	// A non-blocking descriptor is served by the runtime poller, so closing
+	// the file interrupts a pending read
+	file := os.NewFile(uintptr(fd), "uevent")
+	defer file.Close()
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventKernelGroup}); err != nil {
+		return fmt.Errorf("failed to subscribe to uevents: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read uevents: %w", err)
+		}
+		if event, ok := parseUevent(buf[:n]); ok {
+			changed(event)
+		}
+	}
+}
+
+// parseUevent parses a kernel uevent, a header such as
+// "add@/devices/pci0000:00/.../block/sdb" followed by NUL-separated
+// KEY=value pairs. Only the addition and removal of physical disks and
+// network interfaces are reported.
+func parseUevent(data []byte) (DeviceEvent, bool) {
+	fields := bytes.Split(data, []byte{0})
+	env := make(map[string]string, len(fields))
+	for _, field := range fields[1:] {
+		if key, value, ok := strings.Cut(string(field), "="); ok {
+			env[key] = value
+		}
+	}
+
+	event := DeviceEvent{Time: time.Now(), Action: env["ACTION"]}
+	if event.Action != "add" && event.Action != "remove" {
+		return event, false
+	}
+	// Loop devices, device mapper targets, bridges, veths and the like
+	// come and go on their own
+	if strings.Contains(env["DEVPATH"], "/virtual/") {
+		return event, false
+	}
+
+	switch env["SUBSYSTEM"] {
+	case "block":
+		if env["DEVTYPE"] != "disk" {
+			return event, false
+		}
+		event.Type, event.Name = DeviceDisk, env["DEVNAME"]
+	case "net":
+		event.Type, event.Name = DeviceInterface, env["INTERFACE"]
+	default:
+		return event, false
+	}
+	return event, event.Name != ""
+}
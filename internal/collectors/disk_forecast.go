@@ -0,0 +1,207 @@
+package collectors
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const diskHistoryFileName = "disk-history.json"
+
+// forecastFilesystems are the filesystem types whose growth is tracked;
+// virtual and memory-backed filesystems are left out
+var forecastFilesystems = []string{"ext2", "ext3", "ext4", "xfs", "btrfs", "zfs", "f2fs", "jfs", "reiserfs"}
+
+// DiskForecast is the use of a filesystem and when it is projected to fill
+// up at its recent growth rate
+type DiskForecast struct {
+	Mount          string  `json:"mount"`
+	Device         string  `json:"device"`
+	FSType         string  `json:"fs_type"`
+	SizeBytes      uint64  `json:"size_bytes"`
+	UsedBytes      uint64  `json:"used_bytes"`
+	AvailableBytes uint64  `json:"available_bytes"`
+	UsedPercent    float64 `json:"used_percent"`
+	// GrowthBytesPerDay is the least squares growth over the history, zero
+	// until it spans a day
+	GrowthBytesPerDay float64 `json:"growth_bytes_per_day"`
+	// DaysUntilFull is unset while the filesystem is not growing
+	DaysUntilFull *float64 `json:"days_until_full,omitempty"`
+	Samples       int      `json:"samples"`
+}
+
+// DiskForecastReport represents the filesystem fill projections reported
+// to the API
+type DiskForecastReport struct {
+	Timestamp   time.Time      `json:"timestamp"`
+	Filesystems []DiskForecast `json:"filesystems"`
+	// Degraded is set when a filesystem is projected to fill up within the
+	// horizon
+	Degraded bool     `json:"degraded"`
+	Issues   []string `json:"issues"`
+}
+
+// DiskForecastCollector samples the space used on each filesystem and
+// keeps a local history of it to project when they fill up
+type DiskForecastCollector struct {
+	rootDir  string
+	stateDir string
+	window   time.Duration
+	horizon  time.Duration
+	logger   *logrus.Logger
+}
+
+// NewDiskForecastCollector creates a new disk forecast collector keeping
+// window of history. rootDir is the root of the host filesystem; a
+// filesystem projected to fill up within horizon degrades the report.
+func NewDiskForecastCollector(rootDir, stateDir string, window, horizon time.Duration, logger *logrus.Logger) *DiskForecastCollector {
+	return &DiskForecastCollector{
+		rootDir:  rootDir,
+		stateDir: stateDir,
+		window:   window,
+		horizon:  horizon,
+		logger:   logger,
+	}
+}
+
+// Collect samples the filesystems, adds the samples to the history and
+// returns the projections
+func (dc *DiskForecastCollector) Collect() (*DiskForecastReport, error) {
+	now := time.Now()
+	report := &DiskForecastReport{Timestamp: now, Filesystems: []DiskForecast{}, Issues: []string{}}
+
+	filesystems, err := dc.readFilesystems()
+	if err != nil {
+		return nil, err
+	}
+
+	history := map[string][]hardwarePoint{}
+	if err := state.Load(dc.stateDir, diskHistoryFileName, &history); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read disk history: %w", err)
+	}
+	present := make(map[string]bool)
+	for _, fs := range filesystems {
+		present[fs.Mount] = true
+	}
+	for mount, points := range history {
+		// Drop samples past the window, and filesystems no longer mounted
+		start := sort.Search(len(points), func(i int) bool { return now.Sub(points[i].Time) <= dc.window })
+		if !present[mount] || start == len(points) {
+			delete(history, mount)
+			continue
+		}
+		history[mount] = points[start:]
+	}
+	for _, fs := range filesystems {
+		history[fs.Mount] = append(history[fs.Mount], hardwarePoint{Time: now, Value: float64(fs.UsedBytes)})
+	}
+	if err := state.Save(dc.stateDir, diskHistoryFileName, history); err != nil {
+		return nil, fmt.Errorf("failed to save disk history: %w", err)
+	}
+
+	for _, fs := range filesystems {
+		points := history[fs.Mount]
+		fs.Samples = len(points)
+		fs.GrowthBytesPerDay = weeklySlope(points) / 7
+		if fs.GrowthBytesPerDay > 0 {
+			days := float64(fs.AvailableBytes) / fs.GrowthBytesPerDay
+			fs.DaysUntilFull = &days
+			if time.Duration(days*float64(24*time.Hour)) < dc.horizon {
+				report.Issues = append(report.Issues, fmt.Sprintf("%s is %.0f%% full and projected to fill up in %.1f days at %s per day",
+					fs.Mount, fs.UsedPercent, days, formatBytes(fs.GrowthBytesPerDay)))
+			}
+		}
+		report.Filesystems = append(report.Filesystems, fs)
+	}
+	report.Degraded = len(report.Issues) > 0
+	return report, nil
+}
+
+// readFilesystems returns the use of each disk-backed filesystem, once per
+// device even when it is mounted several times
+func (dc *DiskForecastCollector) readFilesystems() ([]DiskForecast, error) {
+	var filesystems []DiskForecast
+	seen := make(map[string]bool)
+	err := lines.ScanFile("/proc/self/mounts", func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !slices.Contains(forecastFilesystems, fields[2]) || seen[fields[0]] {
+			return
+		}
+		// In a container the host's filesystems are mounted under rootDir
+		path := unescapeMount(fields[1])
+		mount := path
+		if dc.rootDir != "/" {
+			rel, err := filepath.Rel(dc.rootDir, path)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				return
+			}
+			mount = filepath.Join("/", rel)
+		}
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(path, &stat); err != nil {
+			dc.logger.Debugf("Failed to stat filesystem %s: %v", path, err)
+			return
+		}
+		size := stat.Blocks * uint64(stat.Bsize)
+		if size == 0 {
+			return
+		}
+		seen[fields[0]] = true
+		fs := DiskForecast{
+			Mount:          mount,
+			Device:         fields[0],
+			FSType:         fields[2],
+			SizeBytes:      size,
+			UsedBytes:      (stat.Blocks - stat.Bfree) * uint64(stat.Bsize),
+			AvailableBytes: stat.Bavail * uint64(stat.Bsize),
+		}
+		// Like df, space reserved for root counts as neither used nor free
+		if total := fs.UsedBytes + fs.AvailableBytes; total > 0 {
+			fs.UsedPercent = float64(fs.UsedBytes) / float64(total) * 100
+		}
+		filesystems = append(filesystems, fs)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %w", err)
+	}
+	return filesystems, nil
+}
+
+// unescapeMount decodes the octal escapes /proc/mounts uses for spaces and
+// other special characters in paths
+func unescapeMount(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			var c byte
+			if _, err := fmt.Sscanf(path[i+1:i+4], "%o", &c); err == nil {
+				b.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// formatBytes formats a byte count with a binary unit, e.g. "1.5 GiB"
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
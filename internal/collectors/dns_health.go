@@ -0,0 +1,261 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/sirupsen/logrus"
+)
+
+// resolvedStub is the address of the systemd-resolved stub listener. When
+// resolv.conf points at it, the upstream servers are read from resolved.
+const resolvedStub = "127.0.0.53"
+
+// Sources of a resolver address
+const (
+	ResolverSourceResolvConf = "resolv.conf"
+	ResolverSourceResolved   = "systemd-resolved"
+	ResolverSourceDnsmasq    = "dnsmasq"
+)
+
+// ResolverStatus is the health of one configured DNS resolver
+type ResolverStatus struct {
+	Address string `json:"address"`
+	Source  string `json:"source"`
+	// Primary is the resolver tried first by lookups from its source
+	Primary bool `json:"primary"`
+	Healthy bool `json:"healthy"`
+	// AvgLatencyMs is the mean latency of this check's answered probes
+	AvgLatencyMs float64 `json:"avg_latency_ms,omitempty"`
+	MaxLatencyMs float64 `json:"max_latency_ms,omitempty"`
+	// Probes, Failures and Timeouts count this check's queries
+	Probes   int `json:"probes"`
+	Failures int `json:"failures"`
+	Timeouts int `json:"timeouts"`
+	// ConsecutiveFailedChecks counts checks in a row in which the resolver
+	// answered no probe
+	ConsecutiveFailedChecks int    `json:"consecutive_failed_checks"`
+	Error                   string `json:"error,omitempty"`
+}
+
+// DNSHealthReport represents the resolver health reported to the API
+type DNSHealthReport struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Resolvers []ResolverStatus `json:"resolvers"`
+	// Degraded is set when any resolver is not answering, even if lookups
+	// still succeed through a fallback
+	Degraded bool `json:"degraded"`
+	// LocalCache is the caching resolver lookups go through, if any
+	LocalCache *LocalResolverStatus `json:"local_cache,omitempty"`
+	Issues     []string             `json:"issues"`
+}
+
+// DNSHealthCollector probes each configured resolver individually, so a
+// dead primary resolver is found even while fallback resolvers hide it
+type DNSHealthCollector struct {
+	rootDir        string
+	query          string
+	timeout        time.Duration
+	probes         int
+	commandWrapper []string
+	logger         *logrus.Logger
+
+	mu     sync.Mutex
+	failed map[string]int
+	cache  map[string]cacheCounters
+}
+
+// NewDNSHealthCollector creates a new DNS health collector. rootDir is the
+// root of the host filesystem; query is the name each probe looks up.
+func NewDNSHealthCollector(rootDir, query string, timeout time.Duration, probes int, logger *logrus.Logger) *DNSHealthCollector {
+	return &DNSHealthCollector{
+		rootDir:        rootDir,
+		query:          query,
+		timeout:        timeout,
+		probes:         probes,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+		failed:         make(map[string]int),
+		cache:          make(map[string]cacheCounters),
+	}
+}
+
+// SetCommandWrapper sets the command used to run resolvectl with
+// privileges, e.g. "sudo" (the default) or "chroot /host" in container mode
+func (dc *DNSHealthCollector) SetCommandWrapper(wrapper ...string) {
+	dc.commandWrapper = wrapper
+}
+
+// Collect probes every resolver from resolv.conf and, when the host uses
+// the systemd-resolved stub or dnsmasq, their upstream servers and cache
+// statistics
+func (dc *DNSHealthCollector) Collect(ctx context.Context) (*DNSHealthReport, error) {
+	report := &DNSHealthReport{Timestamp: time.Now(), Resolvers: []ResolverStatus{}, Issues: []string{}}
+
+	servers, err := readNameservers(filepath.Join(dc.rootDir, "etc", "resolv.conf"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolv.conf: %w", err)
+	}
+	if len(servers) == 0 {
+		report.Degraded = true
+		report.Issues = append(report.Issues, "no nameservers configured in /etc/resolv.conf")
+		return report, nil
+	}
+	sources := map[string][]string{ResolverSourceResolvConf: servers}
+	if servers[0] == resolvedStub {
+		upstream, err := readNameservers(filepath.Join(dc.rootDir, "run", "systemd", "resolve", "resolv.conf"))
+		if err != nil {
+			dc.logger.Debugf("Failed to read systemd-resolved upstream servers: %v", err)
+		}
+		sources[ResolverSourceResolved] = upstream
+	}
+	report.LocalCache = dc.detectLocalResolver(servers)
+	if report.LocalCache != nil {
+		upstream := dc.collectLocalStats(ctx, report.LocalCache)
+		if report.LocalCache.Service == LocalResolverDnsmasq {
+			sources[ResolverSourceDnsmasq] = upstream
+		}
+	}
+
+	for _, source := range []string{ResolverSourceResolvConf, ResolverSourceResolved, ResolverSourceDnsmasq} {
+		for i, server := range sources[source] {
+			status := dc.probe(ctx, server)
+			status.Source = source
+			status.Primary = i == 0
+			report.Resolvers = append(report.Resolvers, status)
+		}
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	seen := make(map[string]bool)
+	for i := range report.Resolvers {
+		status := &report.Resolvers[i]
+		seen[status.Address] = true
+		if status.Healthy {
+			dc.failed[status.Address] = 0
+		} else {
+			dc.failed[status.Address]++
+		}
+		status.ConsecutiveFailedChecks = dc.failed[status.Address]
+	}
+	for address := range dc.failed {
+		if !seen[address] {
+			delete(dc.failed, address)
+		}
+	}
+
+	if local := report.LocalCache; local != nil {
+		report.Issues = append(report.Issues, localResolverIssues(report.Resolvers, local)...)
+	} else {
+		report.Issues = append(report.Issues, resolverIssues(report.Resolvers)...)
+	}
+	report.Degraded = len(report.Issues) > 0
+	return report, nil
+}
+
+// probe queries a single resolver several times and summarizes the answers.
+// A negative answer such as NXDOMAIN still shows the resolver is working.
+func (dc *DNSHealthCollector) probe(ctx context.Context, server string) ResolverStatus {
+	status := ResolverStatus{Address: server}
+	address := net.JoinHostPort(server, "53")
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	var total time.Duration
+	answered := 0
+	for i := 0; i < dc.probes; i++ {
+		probeCtx, cancel := context.WithTimeout(ctx, dc.timeout)
+		start := time.Now()
+		_, err := resolver.LookupHost(probeCtx, dc.query)
+		elapsed := time.Since(start)
+		cancel()
+
+		status.Probes++
+		var dnsErr *net.DNSError
+		switch {
+		case err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound):
+			answered++
+			total += elapsed
+			status.MaxLatencyMs = max(status.MaxLatencyMs, milliseconds(elapsed))
+		case errors.As(err, &dnsErr) && dnsErr.IsTimeout, errors.Is(err, context.DeadlineExceeded):
+			status.Timeouts++
+			status.Failures++
+			status.Error = fmt.Sprintf("timed out after %s", dc.timeout)
+		case errors.As(err, &dnsErr):
+			// The lookup error names the system resolver rather than the
+			// one dialed, so only the underlying cause is kept
+			status.Failures++
+			status.Error = dnsErr.Err
+		default:
+			status.Failures++
+			status.Error = err.Error()
+		}
+	}
+
+	if answered > 0 {
+		status.AvgLatencyMs = milliseconds(total / time.Duration(answered))
+	}
+	status.Healthy = status.Failures == 0
+	return status
+}
+
+// resolverIssues describes resolvers that failed, calling out a dead
+// primary that lookups only survive by falling back to the next resolver
+func resolverIssues(resolvers []ResolverStatus) []string {
+	var issues []string
+	for _, status := range resolvers {
+		if status.Healthy {
+			continue
+		}
+		switch {
+		case status.Primary && status.Failures == status.Probes && fallbackHealthy(resolvers, status.Source):
+			issues = append(issues, fmt.Sprintf("primary %s resolver %s is not answering; lookups are falling back to the next resolver after a timeout", status.Source, status.Address))
+		case status.Failures == status.Probes:
+			issues = append(issues, fmt.Sprintf("%s resolver %s is not answering", status.Source, status.Address))
+		default:
+			issues = append(issues, fmt.Sprintf("%s resolver %s failed %d of %d probes", status.Source, status.Address, status.Failures, status.Probes))
+		}
+	}
+	return issues
+}
+
+// fallbackHealthy reports whether a non-primary resolver of source answers
+func fallbackHealthy(resolvers []ResolverStatus, source string) bool {
+	for _, status := range resolvers {
+		if status.Source == source && !status.Primary && status.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// readNameservers returns the nameserver addresses of a resolv.conf file in
+// order
+func readNameservers(path string) ([]string, error) {
+	var servers []string
+	err := lines.ScanFile(path, func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	})
+	return servers, err
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,352 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// Caching resolvers running on the host
+const (
+	LocalResolverResolved = "systemd-resolved"
+	LocalResolverDnsmasq  = "dnsmasq"
+)
+
+// LocalResolverStatus is the health of a caching resolver on the host,
+// reported apart from the upstream resolvers it forwards to: a dead cache
+// breaks lookups even while upstream DNS is reachable
+type LocalResolverStatus struct {
+	Service string `json:"service"`
+	Address string `json:"address"`
+	// Healthy is set when the cache answered every probe
+	Healthy bool `json:"healthy"`
+	// UpstreamHealthy is set when an upstream resolver of the cache
+	// answers, and unset when they are unknown
+	UpstreamHealthy *bool `json:"upstream_healthy,omitempty"`
+	CacheSize       int64 `json:"cache_size"`
+	// CacheHits and CacheMisses count lookups since the cache started
+	CacheHits   int64 `json:"cache_hits"`
+	CacheMisses int64 `json:"cache_misses"`
+	// HitRate is the share of lookups answered from the cache since the
+	// previous check, or since the cache started on the first check
+	HitRate *float64 `json:"hit_rate,omitempty"`
+	// UpstreamFailures counts failed queries to upstream servers since
+	// dnsmasq started
+	UpstreamFailures int64 `json:"upstream_failures,omitempty"`
+	// DNSSECBogus counts answers systemd-resolved rejected as bogus since
+	// it started
+	DNSSECBogus int64  `json:"dnssec_bogus,omitempty"`
+	StatsError  string `json:"stats_error,omitempty"`
+}
+
+// cacheCounters are the counters a hit rate is computed from
+type cacheCounters struct {
+	hits, misses int64
+}
+
+// detectLocalResolver returns the caching resolver behind the first
+// loopback nameserver of resolv.conf, or nil if lookups do not go through
+// one
+func (dc *DNSHealthCollector) detectLocalResolver(servers []string) *LocalResolverStatus {
+	for _, server := range servers {
+		ip := net.ParseIP(server)
+		if ip == nil || !ip.IsLoopback() {
+			continue
+		}
+		if server == resolvedStub {
+			return &LocalResolverStatus{Service: LocalResolverResolved, Address: server}
+		}
+		if processRunning(LocalResolverDnsmasq) {
+			return &LocalResolverStatus{Service: LocalResolverDnsmasq, Address: server}
+		}
+	}
+	return nil
+}
+
+// processRunning reports whether a process with the given command name runs
+func processRunning(name string) bool {
+	comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, comm := range comms {
+		data, err := os.ReadFile(comm)
+		if err == nil && strings.TrimSpace(string(data)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// collectLocalStats reads the cache statistics of the local resolver and,
+// for dnsmasq, returns its upstream servers
+func (dc *DNSHealthCollector) collectLocalStats(ctx context.Context, local *LocalResolverStatus) []string {
+	var upstream []string
+	var err error
+	switch local.Service {
+	case LocalResolverResolved:
+		err = dc.resolvedStats(ctx, local)
+	case LocalResolverDnsmasq:
+		upstream, err = dc.dnsmasqStats(ctx, local)
+	}
+	if err != nil {
+		local.StatsError = err.Error()
+		dc.logger.Debugf("Failed to read %s statistics: %v", local.Service, err)
+		return upstream
+	}
+
+	dc.mu.Lock()
+	previous, ok := dc.cache[local.Service]
+	dc.cache[local.Service] = cacheCounters{hits: local.CacheHits, misses: local.CacheMisses}
+	dc.mu.Unlock()
+	hits, misses := local.CacheHits, local.CacheMisses
+	// Counters that went down mean the resolver restarted
+	if ok && hits >= previous.hits && misses >= previous.misses {
+		hits, misses = hits-previous.hits, misses-previous.misses
+	}
+	if hits+misses > 0 {
+		rate := float64(hits) / float64(hits+misses)
+		local.HitRate = &rate
+	}
+	return upstream
+}
+
+// resolvedStats reads the cache statistics of systemd-resolved from
+// `resolvectl statistics`, whose lines are "Label: value"
+func (dc *DNSHealthCollector) resolvedStats(ctx context.Context, local *LocalResolverStatus) error {
+	argv := append(append([]string{}, dc.commandWrapper...), "resolvectl", "statistics")
+	output, err := command.Output(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return fmt.Errorf("resolvectl statistics failed: %w", err)
+	}
+
+	found := false
+	err = lines.Scan(bytes.NewReader(output), func(line string) {
+		label, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return
+		}
+		switch strings.TrimSpace(label) {
+		case "Current Cache Size":
+			local.CacheSize = n
+		case "Cache Hits":
+			local.CacheHits, found = n, true
+		case "Cache Misses":
+			local.CacheMisses = n
+		case "Bogus":
+			local.DNSSECBogus = n
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read resolvectl statistics: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("no cache statistics in resolvectl output")
+	}
+	return nil
+}
+
+// dnsmasqStats reads the cache statistics of dnsmasq, which it answers to
+// CHAOS TXT queries, and returns its upstream servers
+func (dc *DNSHealthCollector) dnsmasqStats(ctx context.Context, local *LocalResolverStatus) ([]string, error) {
+	counters := map[string]*int64{
+		"cachesize.bind": &local.CacheSize,
+		"hits.bind":      &local.CacheHits,
+		"misses.bind":    &local.CacheMisses,
+	}
+	for name, counter := range counters {
+		values, err := chaosTXT(ctx, local.Address, name, dc.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query dnsmasq %s: %w", name, err)
+		}
+		if len(values) > 0 {
+			*counter, _ = strconv.ParseInt(values[0], 10, 64)
+		}
+	}
+
+	// Each server is "address#port queries failed"
+	servers, err := chaosTXT(ctx, local.Address, "servers.bind", dc.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dnsmasq servers.bind: %w", err)
+	}
+	var upstream []string
+	for _, server := range servers {
+		fields := strings.Fields(server)
+		if len(fields) < 3 {
+			continue
+		}
+		address, _, _ := strings.Cut(fields[0], "#")
+		if net.ParseIP(address) != nil {
+			upstream = append(upstream, address)
+		}
+		failed, _ := strconv.ParseInt(fields[2], 10, 64)
+		local.UpstreamFailures += failed
+	}
+	return upstream, nil
+}
+
+// chaosTXT sends a CHAOS class TXT query, which caching resolvers such as
+// dnsmasq answer with their statistics, and returns the answer's strings
+func chaosTXT(ctx context.Context, server, name string, timeout time.Duration) ([]string, error) {
+	var id [2]byte
+	rand.Read(id[:])
+	query := append([]byte{id[0], id[1], 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}, encodeDNSName(name)...)
+	// QTYPE TXT, QCLASS CH
+	query = append(query, 0, 16, 0, 3)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 4096)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	return parseTXTResponse(response[:n], id)
+}
+
+// encodeDNSName encodes a domain name as DNS labels
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+// errShortDNSResponse is returned for a response that ends mid-record
+var errShortDNSResponse = errors.New("truncated DNS response")
+
+// parseTXTResponse returns the strings of the TXT records answering the
+// query with the given ID
+func parseTXTResponse(msg []byte, id [2]byte) ([]string, error) {
+	if len(msg) < 12 {
+		return nil, errShortDNSResponse
+	}
+	if msg[0] != id[0] || msg[1] != id[1] {
+		return nil, errors.New("DNS response ID does not match the query")
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return nil, fmt.Errorf("DNS query failed with rcode %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	answers := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	offset := 12
+	for i := 0; i < questions; i++ {
+		end, err := skipDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = end + 4
+	}
+
+	var values []string
+	for i := 0; i < answers; i++ {
+		end, err := skipDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if end+10 > len(msg) {
+			return nil, errShortDNSResponse
+		}
+		recordType := binary.BigEndian.Uint16(msg[end : end+2])
+		length := int(binary.BigEndian.Uint16(msg[end+8 : end+10]))
+		data := end + 10
+		if data+length > len(msg) {
+			return nil, errShortDNSResponse
+		}
+		if recordType == 16 {
+			for j := data; j < data+length; {
+				size := int(msg[j])
+				if j+1+size > data+length {
+					return nil, errShortDNSResponse
+				}
+				values = append(values, string(msg[j+1:j+1+size]))
+				j += 1 + size
+			}
+		}
+		offset = data + length
+	}
+	return values, nil
+}
+
+// skipDNSName returns the offset after the possibly compressed name at
+// offset
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errShortDNSResponse
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			return offset + 2, nil
+		}
+		offset += 1 + length
+	}
+}
+
+// localResolverIssues describes the local cache apart from the resolvers
+// behind it, so a dead cache is not mistaken for unreachable upstream DNS,
+// and sets the cache's health from the probes of its address
+func localResolverIssues(resolvers []ResolverStatus, local *LocalResolverStatus) []string {
+	var others []ResolverStatus
+	var probe *ResolverStatus
+	upstreamKnown, upstreamHealthy := false, false
+	for i, status := range resolvers {
+		switch {
+		case status.Source == ResolverSourceResolvConf && status.Address == local.Address && probe == nil:
+			probe = &resolvers[i]
+			continue
+		case status.Source == local.Service:
+			upstreamKnown = true
+			upstreamHealthy = upstreamHealthy || status.Healthy
+		}
+		others = append(others, status)
+	}
+	if upstreamKnown {
+		local.UpstreamHealthy = &upstreamHealthy
+	}
+	local.Healthy = probe != nil && probe.Healthy
+
+	var issues []string
+	switch {
+	case probe != nil && !probe.Healthy && probe.Failures < probe.Probes:
+		issues = append(issues, fmt.Sprintf("local %s cache at %s failed %d of %d probes", local.Service, local.Address, probe.Failures, probe.Probes))
+	case !local.Healthy && upstreamHealthy:
+		issues = append(issues, fmt.Sprintf("local %s cache at %s is not answering although its upstream resolvers are", local.Service, local.Address))
+	case !local.Healthy:
+		issues = append(issues, fmt.Sprintf("local %s cache at %s is not answering", local.Service, local.Address))
+	case upstreamKnown && !upstreamHealthy:
+		issues = append(issues, fmt.Sprintf("no upstream resolver of the local %s cache is answering; only cached names resolve", local.Service))
+	}
+	return append(issues, resolverIssues(others)...)
+}
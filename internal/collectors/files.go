@@ -0,0 +1,325 @@
+package collectors
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const managedFilesFile = "files.json"
+
+// ManagedFile represents a file pushed by the API
+type ManagedFile struct {
+	Path string `json:"path"`
+	// Content is base64 encoded so binary files can be distributed
+	Content string `json:"content"`
+	SHA256  string `json:"sha256"`
+	Mode    string `json:"mode"`
+	Owner   string `json:"owner"`
+	Group   string `json:"group"`
+	// Hook is a command run after the file changes, e.g. reloading a service
+	Hook []string `json:"hook"`
+}
+
+// FilesResponse represents the API response structure for managed files
+type FilesResponse struct {
+	Files []ManagedFile `json:"files"`
+}
+
+// FileCollector installs files pushed by the API, such as TLS certificates
+// and application configs, and runs their post-update hooks
+type FileCollector struct {
+	rootDir        string
+	stateDir       string
+	allowedPaths   []string
+	allowedHooks   []string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewFileCollector creates a new file collector. rootDir is the root of the
+// host filesystem, "/" unless running in a container. Files may only be
+// installed below one of allowedPaths, and hooks may only run the programs
+// listed in allowedHooks.
+func NewFileCollector(rootDir, stateDir string, allowedPaths, allowedHooks []string, logger *logrus.Logger) *FileCollector {
+	return &FileCollector{
+		rootDir:        rootDir,
+		stateDir:       stateDir,
+		allowedPaths:   allowedPaths,
+		allowedHooks:   allowedHooks,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run hooks with privileges
+func (fc *FileCollector) SetCommandWrapper(wrapper ...string) {
+	fc.commandWrapper = wrapper
+}
+
+// SyncFiles installs changed files, removes files the API no longer manages
+// and runs the hooks of changed files once each
+func (fc *FileCollector) SyncFiles(ctx context.Context, filesJSON string) error {
+	var response FilesResponse
+	if err := json.Unmarshal([]byte(filesJSON), &response); err != nil {
+		return fmt.Errorf("failed to parse files JSON: %w", err)
+	}
+
+	var managed []string
+	if err := state.Load(fc.stateDir, managedFilesFile, &managed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load managed files: %w", err)
+	}
+
+	desired := make(map[string]bool)
+	var current []string
+	var hooks [][]string
+	hookSeen := make(map[string]bool)
+	var failed int
+
+	for _, file := range response.Files {
+		changed, err := fc.installFile(file)
+		if err != nil {
+			fc.logger.Errorf("Failed to install %s: %v", file.Path, err)
+			failed++
+		}
+		desired[file.Path] = true
+		// Only installed files are recorded, so a rejected path is never
+		// removed later; a file installed earlier stays recorded
+		if err == nil || (slices.Contains(managed, file.Path) && fc.validPath(file.Path)) {
+			current = append(current, file.Path)
+		}
+
+		key := strings.Join(file.Hook, "\x00")
+		if changed && len(file.Hook) > 0 && !hookSeen[key] {
+			hookSeen[key] = true
+			hooks = append(hooks, file.Hook)
+		}
+	}
+
+	// Remove files the API no longer manages
+	for _, path := range managed {
+		if desired[path] {
+			continue
+		}
+		if !fc.validPath(path) {
+			fc.logger.Errorf("Not removing %s, it is outside the allowed directories", path)
+			continue
+		}
+		if err := fc.checkDir(filepath.Join(fc.rootDir, path)); err != nil {
+			fc.logger.Errorf("Not removing %s: %v", path, err)
+			current = append(current, path)
+			failed++
+			continue
+		}
+		if err := os.Remove(filepath.Join(fc.rootDir, path)); err != nil && !os.IsNotExist(err) {
+			fc.logger.Errorf("Failed to remove %s: %v", path, err)
+			current = append(current, path)
+			failed++
+		} else {
+			fc.logger.Infof("Removed managed file %s", path)
+		}
+	}
+
+	if err := state.Save(fc.stateDir, managedFilesFile, current); err != nil {
+		return fmt.Errorf("failed to save managed files: %w", err)
+	}
+
+	for _, hook := range hooks {
+		if !slices.Contains(fc.allowedHooks, hook[0]) {
+			fc.logger.Errorf("Post-update hook %q is not allowed, skipping", strings.Join(hook, " "))
+			failed++
+			continue
+		}
+		argv := append(append([]string{}, fc.commandWrapper...), hook...)
+		output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+		if err != nil {
+			fc.logger.Errorf("Post-update hook %q failed: %v, output: %s", strings.Join(hook, " "), err, strings.TrimSpace(string(output)))
+			failed++
+		} else {
+			fc.logger.Infof("Ran post-update hook %q", strings.Join(hook, " "))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d file operations failed", failed)
+	}
+	return nil
+}
+
+// validPath reports whether a file may be installed or removed at path: an
+// absolute, clean path below one of the allowed directories
+func (fc *FileCollector) validPath(path string) bool {
+	return filepath.IsAbs(path) && filepath.Clean(path) == path && fc.allowed(path)
+}
+
+// installFile atomically installs a file if its content, mode or ownership
+// differ from what is on disk, reporting whether anything changed
+func (fc *FileCollector) installFile(file ManagedFile) (bool, error) {
+	if !fc.validPath(file.Path) {
+		return false, fmt.Errorf("path must be absolute, clean and inside the allowed directories")
+	}
+
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return false, fmt.Errorf("invalid content encoding: %w", err)
+	}
+	sum := sha256.Sum256(content)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), file.SHA256) {
+		return false, fmt.Errorf("checksum mismatch, refusing to install")
+	}
+
+	mode := os.FileMode(0644)
+	if file.Mode != "" {
+		parsed, err := strconv.ParseUint(file.Mode, 8, 32)
+		if err != nil || parsed > 0777 {
+			return false, fmt.Errorf("invalid mode %q", file.Mode)
+		}
+		mode = os.FileMode(parsed)
+	}
+
+	uid, gid := 0, 0
+	if file.Owner != "" {
+		entry, err := lookupPasswd(fc.rootDir, file.Owner)
+		if err != nil {
+			return false, err
+		}
+		if entry == nil {
+			return false, fmt.Errorf("user %s does not exist", file.Owner)
+		}
+		uid, gid = entry.UID, entry.GID
+	}
+	if file.Group != "" {
+		if gid, err = lookupGroupID(fc.rootDir, file.Group); err != nil {
+			return false, err
+		}
+	}
+
+	hostPath := filepath.Join(fc.rootDir, file.Path)
+	if err := fc.checkDir(hostPath); err != nil {
+		return false, err
+	}
+	if fileMatches(hostPath, content, mode, uid, gid) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+		return false, fmt.Errorf("failed to create directory: %w", err)
+	}
+	// Check again now that the whole directory exists, in case one was
+	// swapped for a symlink in the meantime
+	if err := fc.checkDir(hostPath); err != nil {
+		return false, err
+	}
+
+	// Write next to the target and rename so readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(hostPath), "."+filepath.Base(hostPath)+".lsh-agent-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return false, fmt.Errorf("failed to set mode: %w", err)
+	}
+	if err := os.Chown(tmp.Name(), uid, gid); err != nil {
+		return false, fmt.Errorf("failed to set owner: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), hostPath); err != nil {
+		return false, fmt.Errorf("failed to install file: %w", err)
+	}
+
+	fc.logger.Infof("Installed %s", file.Path)
+	return true, nil
+}
+
+// allowed reports whether path lies below one of the allowed directories
+func (fc *FileCollector) allowed(path string) bool {
+	for _, dir := range fc.allowedPaths {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != "." && !escapes(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapes reports whether a relative path leads out of its base directory
+func escapes(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, "../")
+}
+
+// checkDir returns an error if the directory of hostPath is reached
+// through a symlink leading out of the allowed directories. The path checks
+// in validPath are lexical, while creating, renaming and removing files
+// follow symlinks in the directories above them.
+func (fc *FileCollector) checkDir(hostPath string) error {
+	dir := filepath.Dir(hostPath)
+	resolved, err := resolvePath(dir)
+	if err != nil {
+		return err
+	}
+	if resolved == dir {
+		return nil
+	}
+	for _, allowed := range fc.allowedPaths {
+		root, err := resolvePath(filepath.Join(fc.rootDir, allowed))
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, resolved); err == nil && !escapes(rel) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s resolves to %s, outside the allowed directories", dir, resolved)
+}
+
+// resolvePath resolves the symlinks in the part of path that exists; the
+// rest will be created as real directories
+func resolvePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) && path != filepath.Dir(path) {
+		parent, err := resolvePath(filepath.Dir(path))
+		return filepath.Join(parent, filepath.Base(path)), err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	return resolved, nil
+}
+
+// fileMatches reports whether the file on disk is a regular file that
+// already has the given content, mode and ownership. A symlink never
+// matches, so it is replaced rather than followed.
+func fileMatches(path string, content []byte, mode os.FileMode, uid, gid int) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != mode {
+		return false
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != uid || int(stat.Gid) != gid {
+		return false
+	}
+	existing, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return sha256.Sum256(existing) == sha256.Sum256(content)
+}
@@ -0,0 +1,71 @@
+package collectors
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileAllowed(t *testing.T) {
+	fc := NewFileCollector("/", "", []string{"/etc/app"}, nil, testLogger())
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/etc/app/app.conf", true},
+		{"/etc/app/..app.conf", true},
+		{"/etc/app/conf.d/tls.pem", true},
+		{"/etc/app", false},
+		{"/etc/app/../passwd", false},
+		{"/etc/application.conf", false},
+		{"etc/app/app.conf", false},
+	}
+	for _, tt := range tests {
+		if got := fc.validPath(tt.path); got != tt.want {
+			t.Errorf("validPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFileCheckDir(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"etc/app/conf.d", "etc/shared", "outside"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"etc/app/escape": filepath.Join(root, "outside"),
+		"etc/app/inside": filepath.Join(root, "etc/app/conf.d"),
+		"etc/run":        filepath.Join(root, "etc/shared"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fc := NewFileCollector(root, "", []string{"/etc/app", "/etc/run/app"}, nil, testLogger())
+
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{"/etc/app/app.conf", true},
+		{"/etc/app/conf.d/tls.pem", true},
+		{"/etc/app/new/dir/app.conf", true},
+		{"/etc/app/inside/app.conf", true},
+		{"/etc/app/escape/app.conf", false},
+		{"/etc/app/escape/new/app.conf", false},
+		// The allowed directory itself is below a symlink and missing
+		{"/etc/run/app/app.pid", true},
+	}
+	for _, tt := range tests {
+		err := fc.checkDir(filepath.Join(root, tt.path))
+		if tt.valid && err != nil {
+			t.Errorf("checkDir(%q) error = %v, want none", tt.path, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("checkDir(%q) accepted a path leading outside", tt.path)
+		}
+	}
+}
@@ -2,22 +2,55 @@ package collectors
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/latitudesh/agent/internal/state"
 	"github.com/sirupsen/logrus"
 )
 
+// Rule directions and actions
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+	ActionAllow  = "allow"
+	ActionDeny   = "deny"
+)
+
 // FirewallRule represents a firewall rule
 type FirewallRule struct {
+	// From is the remote address: the source of inbound traffic, or the
+	// destination of outbound traffic
 	From     string `json:"from"`
 	Protocol string `json:"protocol"`
-	Port     string `json:"port"`
+	// Port is the local port of inbound traffic, or the remote port of
+	// outbound traffic
+	Port string `json:"port"`
+	// Direction is "in" (the default) or "out", and Action "allow" (the
+	// default) or "deny"
+	Direction string `json:"direction,omitempty"`
+	Action    string `json:"action,omitempty"`
+	// ExpiresAt or TTL make the rule temporary, e.g. just-in-time SSH
+	// access; it is removed on schedule even without API connectivity
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`
+	// Interface and To limit the rule to traffic through an interface or
+	// from or to a local IP or CIDR. They are set by the collector's tenant
+	// scope, never by the API.
+	Interface string `json:"-"`
+	To        string `json:"-"`
+	// Foreign is set on firewall rules the agent did not add, e.g. rules
+	// added by hand; they are never removed
+	Foreign bool `json:"-"`
 }
 
 // String returns a normalized string representation of the rule
@@ -26,15 +59,112 @@ func (r FirewallRule) String() string {
 	if from == "" {
 		from = "any"
 	}
-	protocol := r.Protocol
-	if protocol == "" {
-		protocol = "any"
+	s := fmt.Sprintf("From: %s, Protocol: %s, Port: %s", from, r.protocol(), r.port())
+	if r.direction() == DirectionOut {
+		s += ", Direction: out"
+	}
+	if r.action() == ActionDeny {
+		s += ", Action: deny"
+	}
+	if r.To != "" {
+		s += ", To: " + r.To
+	}
+	if r.Interface != "" {
+		s += ", Interface: " + r.Interface
+	}
+	return s
+}
+
+// direction returns the rule's lowercase direction, "in" by default
+func (r FirewallRule) direction() string {
+	if r.Direction == "" {
+		return DirectionIn
+	}
+	return strings.ToLower(r.Direction)
+}
+
+// action returns the rule's lowercase action, "allow" by default
+func (r FirewallRule) action() string {
+	if r.Action == "" {
+		return ActionAllow
+	}
+	return strings.ToLower(r.Action)
+}
+
+// validDirection reports whether the rule's direction and action are ones
+// the agent applies
+func (r FirewallRule) validDirection() bool {
+	return slices.Contains([]string{DirectionIn, DirectionOut}, r.direction()) &&
+		slices.Contains([]string{ActionAllow, ActionDeny}, r.action())
+}
+
+// ruleProtocols are the protocols a rule may name
+var ruleProtocols = []string{"any", "tcp", "udp", "icmp", "icmpv6", "ipv6-icmp", "esp", "ah", "gre"}
+
+// interfaceNameRegex matches a network interface name, which Linux limits
+// to 15 characters
+var interfaceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// validate checks every field of the rule, so backends only ever see
+// values they can pass to their tools as-is. An address with a newline
+// would otherwise add statements to an nft script.
+func (r FirewallRule) validate() error {
+	for _, address := range []struct{ name, value string }{{"from", r.From}, {"to", r.To}} {
+		if address.value == "" || address.value == "any" {
+			continue
+		}
+		if net.ParseIP(address.value) == nil {
+			if _, _, err := net.ParseCIDR(address.value); err != nil {
+				return fmt.Errorf("invalid %s address %q", address.name, address.value)
+			}
+		}
+	}
+	if port := r.port(); port != "any" && !ufwPortRegex.MatchString(port) {
+		return fmt.Errorf("invalid port %q", r.Port)
+	}
+	if !slices.Contains(ruleProtocols, r.protocol()) {
+		return fmt.Errorf("unsupported protocol %q", r.Protocol)
+	}
+	if r.Interface != "" && !interfaceNameRegex.MatchString(r.Interface) {
+		return fmt.Errorf("invalid interface %q", r.Interface)
+	}
+	return nil
+}
+
+// inboundAllow reports whether the rule allows inbound traffic, the only
+// kind of rule some backends apply
+func (r FirewallRule) inboundAllow() bool {
+	return r.direction() == DirectionIn && r.action() == ActionAllow
+}
+
+// protocol returns the rule's lowercase protocol, "any" when the rule
+// applies to every protocol
+func (r FirewallRule) protocol() string {
+	protocol := strings.ToLower(r.Protocol)
+	if protocol == "" || protocol == "all" {
+		return "any"
+	}
+	return protocol
+}
+
+// port returns the rule's port, "any" for a rule without ports such as an
+// allow-all from a CIDR
+func (r FirewallRule) port() string {
+	if r.Port == "" || strings.EqualFold(r.Port, "all") {
+		return "any"
 	}
-	port := r.Port
-	if port == "" {
-		port = "any"
+	return r.Port
+}
+
+// IsICMP reports whether the rule allows ICMP. UFW has no command for ICMP
+// rules; its built-in rules accept ICMP echo and error messages from
+// anywhere, which already covers any ICMP rule from the API.
+func (r FirewallRule) IsICMP() bool {
+	switch r.protocol() {
+	case "icmp", "icmpv6", "ipv6-icmp":
+		return true
 	}
-	return fmt.Sprintf("From: %s, Protocol: %s, Port: %s", from, protocol, port)
+	return false
 }
 
 // FirewallResponse represents the API response structure
@@ -46,255 +176,348 @@ type FirewallResponse struct {
 
 // FirewallCollector handles firewall rule collection and synchronization
 type FirewallCollector struct {
-	ufwBinary     string
 	caseSensitive bool
-	logger        *logrus.Logger
+	// ufw is the default backend, kept to apply UFW settings such as the
+	// command wrapper whichever backend is in use
+	ufw        *ufwBackend
+	backend    FirewallBackend
+	stateDir   string
+	localMu    sync.Mutex
+	localRules []FirewallRule
+	scope      ruleScope
+	faults     Faults
+	readOnly   bool
+	facts      func() RuleFacts
+	logger     *logrus.Logger
 }
 
-// NewFirewallCollector creates a new firewall collector
+// NewFirewallCollector creates a new firewall collector applying rules
+// with UFW
 func NewFirewallCollector(ufwBinary string, caseSensitive bool, logger *logrus.Logger) *FirewallCollector {
+	ufw := newUFWBackend(ufwBinary, logger)
 	return &FirewallCollector{
-		ufwBinary:     ufwBinary,
 		caseSensitive: caseSensitive,
+		ufw:           ufw,
+		backend:       ufw,
 		logger:        logger,
 	}
 }
 
-// GetCurrentUFWRules retrieves current UFW rules from the system
-func (fc *FirewallCollector) GetCurrentUFWRules(ctx context.Context) ([]FirewallRule, error) {
-	cmd := exec.CommandContext(ctx, "sudo", fc.ufwBinary, "status")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get UFW status: %w", err)
-	}
+// SetCommandWrapper sets the command used to run UFW with privileges,
+// e.g. "sudo" (the default) or "chroot /host" in container mode
+func (fc *FirewallCollector) SetCommandWrapper(wrapper ...string) {
+	fc.ufw.commandWrapper = wrapper
+}
+
+// SetStateDir sets the directory where expirations of temporary rules are
+// tracked. Temporary rules are ignored until it is set.
+func (fc *FirewallCollector) SetStateDir(stateDir string) {
+	fc.stateDir = stateDir
+}
 
-	return fc.parseUFWRules(string(output))
+// SetMock makes the collector run UFW commands against a simulated UFW
+// instead of the host's
+func (fc *FirewallCollector) SetMock(mock *MockUFW) {
+	fc.ufw.mock = mock
 }
 
-// parseUFWRules parses UFW status output into FirewallRule structs
-func (fc *FirewallCollector) parseUFWRules(output string) ([]FirewallRule, error) {
-	var rules []FirewallRule
-	lines := strings.Split(output, "\n")
+// RulesHash returns a hash of the firewall rules in an API response
+func RulesHash(apiRulesJSON string) (string, error) {
+	var response FirewallResponse
+	if err := json.Unmarshal([]byte(apiRulesJSON), &response); err != nil {
+		return "", fmt.Errorf("failed to parse API rules JSON: %w", err)
+	}
+	data, err := json.Marshal(response.Firewall.Rules)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	// Regular expression to match UFW rules
-	// Example: "22/tcp                     ALLOW       Anywhere"
-	ruleRegex := regexp.MustCompile(`^([0-9]+/[a-z]+)\s+ALLOW\s+(.+)$`)
+// SyncFirewallRules synchronizes the firewall with API rules. Rules that
+// fail to apply are reported in the result rather than as an error; the
+// error is only set when the synchronization could not run.
+func (fc *FirewallCollector) SyncFirewallRules(ctx context.Context, apiRulesJSON string) (*state.SyncResult, error) {
+	start := time.Now()
+	fc.logger.Info("Starting firewall rule synchronization")
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.Contains(line, "ALLOW") && !strings.Contains(line, "(v6)") {
-			matches := ruleRegex.FindStringSubmatch(line)
-			if len(matches) >= 3 {
-				portProto := matches[1]
-				from := strings.TrimSpace(matches[2])
+	diff, err := fc.diffRules(ctx, apiRulesJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := fc.saveTemporaryRules(diff.temporary); err != nil {
+		return nil, err
+	}
 
-				// Parse port and protocol
-				parts := strings.Split(portProto, "/")
-				if len(parts) != 2 {
-					continue
-				}
+	result, _ := fc.applyDiff(ctx, diff.add, diff.remove, diff.unchanged)
+	result.Duration = time.Since(start).String()
+	return result, nil
+}
 
-				port := parts[0]
-				protocol := parts[1]
+// applyDiff adds and removes rules in a single batch. Besides the result it
+// returns the changes that undo those that succeeded.
+func (fc *FirewallCollector) applyDiff(ctx context.Context, rulesToAdd, rulesToRemove []FirewallRule, unchanged int) (*state.SyncResult, []RuleChange) {
+	fc.logger.Infof("Rules to add: %d", len(rulesToAdd))
+	fc.logger.Infof("Rules to remove: %d", len(rulesToRemove))
 
-				// Normalize "from" field
-				if from == "Anywhere" {
-					from = "any"
-				}
+	result := &state.SyncResult{
+		Added:     []string{},
+		Removed:   []string{},
+		Failed:    []state.SyncFailure{},
+		Unchanged: unchanged,
+	}
 
-				rules = append(rules, FirewallRule{
-					From:     from,
-					Protocol: protocol,
-					Port:     port,
-				})
-			}
+	// Add new rules and remove obsolete ones in a single batch
+	var changes []RuleChange
+	for _, rule := range rulesToAdd {
+		changes = append(changes, RuleChange{Rule: rule})
+	}
+	for _, rule := range rulesToRemove {
+		changes = append(changes, RuleChange{Rule: rule, Remove: true})
+	}
+	fc.corrupt(changes)
+	errs := fc.applyChanges(ctx, changes, false)
+
+	var undo []RuleChange
+	for i, rule := range rulesToAdd {
+		if err := errs[i]; err != nil {
+			fc.logger.Errorf("Failed to add rule %s: %v", rule.String(), err)
+			result.Failed = append(result.Failed, state.SyncFailure{Rule: rule.String(), Operation: "add", Error: err.Error()})
+		} else {
+			fc.logger.Infof("Added rule: %s", rule.String())
+			result.Added = append(result.Added, rule.String())
+			undo = append(undo, changes[i].undo())
+		}
+	}
+	for i, rule := range rulesToRemove {
+		if err := errs[len(rulesToAdd)+i]; err != nil {
+			fc.logger.Errorf("Failed to remove rule %s: %v", rule.String(), err)
+			result.Failed = append(result.Failed, state.SyncFailure{Rule: rule.String(), Operation: "remove", Error: err.Error()})
+		} else {
+			fc.logger.Infof("Removed rule: %s", rule.String())
+			result.Removed = append(result.Removed, rule.String())
+			undo = append(undo, changes[len(rulesToAdd)+i].undo())
 		}
 	}
 
-	return rules, nil
+	// Backends apply changes to the running chains directly, so no reload
+	// is needed; reloading would reset connection tracking and is slow on
+	// large rulesets
+	return result, undo
 }
 
-// SyncFirewallRules synchronizes UFW rules with API rules
-func (fc *FirewallCollector) SyncFirewallRules(ctx context.Context, apiRulesJSON string) error {
-	fc.logger.Info("Starting firewall rule synchronization")
+// DiffFirewallRules compares API rules with the current rules and returns
+// the rules that need to be added and removed, without applying them
+func (fc *FirewallCollector) DiffFirewallRules(ctx context.Context, apiRulesJSON string) ([]FirewallRule, []FirewallRule, error) {
+	diff, err := fc.diffRules(ctx, apiRulesJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	return diff.add, diff.remove, nil
+}
 
+// ruleDiff is the difference between the API rules and the current rules
+type ruleDiff struct {
+	add, remove []FirewallRule
+	// unchanged counts the current rules that already match the API
+	unchanged int
+	// temporary are the expirations of the API's temporary rules, saved
+	// only when the diff is applied
+	temporary []temporaryRule
+}
+
+// diffRules compares the API rules with the current rules. It changes
+// neither the firewall nor the state directory, so it is safe for dry runs
+// and read-only mode.
+func (fc *FirewallCollector) diffRules(ctx context.Context, apiRulesJSON string) (*ruleDiff, error) {
 	// Parse API rules
 	var response FirewallResponse
 	if err := json.Unmarshal([]byte(apiRulesJSON), &response); err != nil {
-		return fmt.Errorf("failed to parse API rules JSON: %w", err)
+		return nil, fmt.Errorf("failed to parse API rules JSON: %w", err)
 	}
 
-	apiRules := response.Firewall.Rules
+	// A rule with an unknown direction or action is never guessed at, e.g.
+	// applied as an inbound allow
+	rules := slices.DeleteFunc(response.Firewall.Rules, func(rule FirewallRule) bool {
+		if !rule.validDirection() {
+			fc.logger.Errorf("Ignoring rule %s with invalid direction %q or action %q", rule, rule.Direction, rule.Action)
+			return true
+		}
+		return false
+	})
+	apiRules, temporary, err := fc.activeRules(rules, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	apiRules = fc.expandTemplates(fc.withLocalRules(apiRules))
+	for i := range apiRules {
+		apiRules[i] = fc.scoped(apiRules[i])
+	}
+	// Rules are checked once expanded and scoped, before any backend turns
+	// them into commands
+	apiRules = slices.DeleteFunc(apiRules, func(rule FirewallRule) bool {
+		if err := rule.validate(); err != nil {
+			fc.logger.Errorf("Ignoring rule %q: %v", rule.String(), err)
+			return true
+		}
+		return false
+	})
+	// A tenant scope has a single local address, which IPv4 or IPv6 rules
+	// cannot be combined with
+	apiRules = slices.DeleteFunc(apiRules, func(rule FirewallRule) bool {
+		from, to := addressFamily(rule.From), addressFamily(rule.To)
+		if from != "" && to != "" && from != to {
+			fc.logger.Debugf("Skipping rule %s: its addresses are of different families", rule)
+			return true
+		}
+		return false
+	})
 	fc.logger.Infof("Found %d API rules", len(apiRules))
 
-	// Get current UFW rules
-	currentRules, err := fc.GetCurrentUFWRules(ctx)
+	// ICMP rules are covered by the firewall's built-in rules, e.g. UFW's,
+	// and never appear in its rule list, so they are left out of the
+	// comparison
+	var builtIn int
+	apiRules = slices.DeleteFunc(apiRules, func(rule FirewallRule) bool {
+		if rule.IsICMP() {
+			fc.logger.Debugf("Rule %s is covered by UFW's built-in ICMP rules", rule)
+			builtIn++
+			return true
+		}
+		return false
+	})
+
+	// Get current rules
+	currentRules, err := fc.GetCurrentRules(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get current UFW rules: %w", err)
+		return nil, fmt.Errorf("failed to get current %s rules: %w", fc.backend.Name(), err)
 	}
-	fc.logger.Infof("Found %d current UFW rules", len(currentRules))
+	// Rules of other scopes belong to other firewalls on the host
+	currentRules = slices.DeleteFunc(currentRules, func(rule FirewallRule) bool {
+		return !fc.inScope(rule)
+	})
+	fc.logger.Infof("Found %d current %s rules", len(currentRules), fc.backend.Name())
 
-	// Convert to string sets for comparison
-	currentRuleStrings := fc.rulesToStringSet(currentRules)
-	apiRuleStrings := fc.rulesToStringSet(apiRules)
+	// Convert to sets for comparison
+	currentRuleSet := fc.rulesToSet(currentRules)
+	apiRuleSet := fc.rulesToSet(apiRules)
 
 	// Find rules to add and remove
-	rulesToAdd := fc.findRulesToAdd(currentRuleStrings, apiRuleStrings, apiRules)
-	rulesToRemove := fc.findRulesToRemove(currentRuleStrings, apiRuleStrings, currentRules)
-
-	fc.logger.Infof("Rules to add: %d", len(rulesToAdd))
-	fc.logger.Infof("Rules to remove: %d", len(rulesToRemove))
-
-	changesMade := false
-
-	// Add new rules
-	if len(rulesToAdd) > 0 {
-		fc.logger.Info("Adding new UFW rules")
-		for _, rule := range rulesToAdd {
-			if err := fc.addUFWRule(ctx, rule); err != nil {
-				fc.logger.Errorf("Failed to add rule %s: %v", rule.String(), err)
-			} else {
-				fc.logger.Infof("Added rule: %s", rule.String())
-				changesMade = true
-			}
+	rulesToAdd := fc.findMissingRules(apiRules, currentRuleSet)
+	rulesToRemove := fc.findMissingRules(currentRules, apiRuleSet)
+	unchanged := len(currentRules) - len(rulesToRemove) + builtIn
+
+	// Only rules the agent added are removed; others, e.g. added by hand,
+	// are not the API's to remove
+	rulesToRemove = slices.DeleteFunc(rulesToRemove, func(rule FirewallRule) bool {
+		if rule.Foreign {
+			fc.logger.Debugf("Keeping rule %s, it was not added by the agent", rule)
+			return true
 		}
-	}
-
-	// Remove obsolete rules
-	if len(rulesToRemove) > 0 {
-		fc.logger.Info("Removing obsolete UFW rules")
-		for _, rule := range rulesToRemove {
-			if err := fc.removeUFWRule(ctx, rule); err != nil {
-				fc.logger.Errorf("Failed to remove rule %s: %v", rule.String(), err)
-			} else {
-				fc.logger.Infof("Removed rule: %s", rule.String())
-				changesMade = true
+		// The IPv4 or IPv6 half of an API rule from anywhere is completed
+		// by adding the API rule, which adds the missing half only
+		if from := normalizeAddress(rule.From); from == "0.0.0.0/0" || from == "::/0" {
+			rule.From = "any"
+			if _, ok := apiRuleSet[fc.keyFor(rule)]; ok {
+				return true
 			}
 		}
-	}
-
-	// Reload UFW if changes were made
-	if changesMade {
-		fc.logger.Info("Reloading UFW to apply changes")
-		if err := fc.reloadUFW(ctx); err != nil {
-			return fmt.Errorf("failed to reload UFW: %w", err)
-		}
-	} else {
-		fc.logger.Info("No changes made, skipping UFW reload")
-	}
+		return false
+	})
 
-	return nil
+	return &ruleDiff{add: rulesToAdd, remove: rulesToRemove, unchanged: unchanged, temporary: temporary}, nil
 }
 
-// rulesToStringSet converts rules to a set of normalized strings
-func (fc *FirewallCollector) rulesToStringSet(rules []FirewallRule) map[string]FirewallRule {
-	ruleSet := make(map[string]FirewallRule)
-	for _, rule := range rules {
-		key := rule.String()
-		if !fc.caseSensitive {
-			key = strings.ToLower(key)
-		}
-		ruleSet[key] = rule
-	}
-	return ruleSet
+// ruleKey identifies a rule by its normalized fields. Comparing keys
+// instead of formatted strings keeps large rule sets cheap to diff.
+type ruleKey struct {
+	from, protocol, port, iface, to, direction, action string
 }
 
-// findRulesToAdd finds rules that exist in API but not in current UFW
-func (fc *FirewallCollector) findRulesToAdd(currentSet, apiSet map[string]FirewallRule, apiRules []FirewallRule) []FirewallRule {
-	var rulesToAdd []FirewallRule
-	for _, rule := range apiRules {
-		key := rule.String()
-		if !fc.caseSensitive {
-			key = strings.ToLower(key)
-		}
-		if _, exists := currentSet[key]; !exists {
-			rulesToAdd = append(rulesToAdd, rule)
-		}
+// keyFor returns the key used to compare a rule, honoring case sensitivity
+func (fc *FirewallCollector) keyFor(rule FirewallRule) ruleKey {
+	key := baseKey(rule)
+	if !fc.caseSensitive {
+		// ToLower returns the string itself when there is nothing to lower
+		key.from = strings.ToLower(key.from)
+		key.port = strings.ToLower(key.port)
+		key.to = strings.ToLower(key.to)
 	}
-	return rulesToAdd
+	return key
 }
 
-// findRulesToRemove finds rules that exist in current UFW but not in API
-func (fc *FirewallCollector) findRulesToRemove(currentSet, apiSet map[string]FirewallRule, currentRules []FirewallRule) []FirewallRule {
-	var rulesToRemove []FirewallRule
-	for _, rule := range currentRules {
-		key := rule.String()
-		if !fc.caseSensitive {
-			key = strings.ToLower(key)
-		}
-		if _, exists := apiSet[key]; !exists {
-			rulesToRemove = append(rulesToRemove, rule)
-		}
+// baseKey returns the case-sensitive key of a rule, its addresses in
+// canonical form
+func baseKey(rule FirewallRule) ruleKey {
+	key := ruleKey{
+		from:      normalizeAddress(rule.From),
+		protocol:  rule.protocol(),
+		port:      rule.port(),
+		iface:     rule.Interface,
+		to:        normalizeAddress(rule.To),
+		direction: rule.direction(),
+		action:    rule.action(),
+	}
+	if key.from == "" {
+		key.from = "any"
 	}
-	return rulesToRemove
+	return key
 }
 
-// addUFWRule adds a single UFW rule
-func (fc *FirewallCollector) addUFWRule(ctx context.Context, rule FirewallRule) error {
-	from := rule.From
-	if from == "any" {
-		from = "any"
+// normalizeAddress returns an IP or CIDR in canonical form, so rules match
+// however their addresses are written, e.g. "2001:DB8:0::/32" and
+// "2001:db8::/32". A CIDR of a single address is the address, as UFW shows
+// it. Other values are returned unchanged.
+func normalizeAddress(address string) string {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
 	}
-
-	// UFW requires lowercase protocol names
-	protocol := strings.ToLower(rule.Protocol)
-
-	cmd := exec.CommandContext(ctx, "sudo", fc.ufwBinary, "allow", 
-		"proto", protocol, 
-		"from", from, 
-		"to", "any", 
-		"port", rule.Port)
-
-	output, err := cmd.CombinedOutput()
+	_, ipNet, err := net.ParseCIDR(address)
 	if err != nil {
-		return fmt.Errorf("UFW command failed: %w, output: %s", err, string(output))
+		return address
 	}
-
-	return nil
-}
-
-// removeUFWRule removes a single UFW rule
-func (fc *FirewallCollector) removeUFWRule(ctx context.Context, rule FirewallRule) error {
-	from := rule.From
-	if from == "any" {
-		from = "any"
+	if ones, bits := ipNet.Mask.Size(); ones == bits {
+		return ipNet.IP.String()
 	}
+	return ipNet.String()
+}
 
-	// UFW requires lowercase protocol names
-	protocol := strings.ToLower(rule.Protocol)
-
-	cmd := exec.CommandContext(ctx, "sudo", fc.ufwBinary, "delete", "allow",
-		"from", from,
-		"to", "any",
-		"port", rule.Port,
-		"proto", protocol)
-
-	output, err := cmd.CombinedOutput()
+// addressFamily returns "ip6" for an IPv6 address or CIDR, "ip" for IPv4
+// and "" for anything else, such as "any"
+func addressFamily(address string) string {
+	ip, _, err := net.ParseCIDR(address)
 	if err != nil {
-		return fmt.Errorf("UFW delete command failed: %w, output: %s", err, string(output))
+		ip = net.ParseIP(address)
 	}
-
-	return nil
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() == nil:
+		return "ip6"
+	}
+	return "ip"
 }
 
-// reloadUFW reloads the UFW firewall
-func (fc *FirewallCollector) reloadUFW(ctx context.Context) error {
-	cmd := exec.CommandContext(ctx, "sudo", fc.ufwBinary, "reload")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("UFW reload failed: %w, output: %s", err, string(output))
+// rulesToSet indexes rules by their comparison key
+func (fc *FirewallCollector) rulesToSet(rules []FirewallRule) map[ruleKey]FirewallRule {
+	ruleSet := make(map[ruleKey]FirewallRule, len(rules))
+	for _, rule := range rules {
+		ruleSet[fc.keyFor(rule)] = rule
 	}
-	return nil
+	return ruleSet
 }
 
-// GetFirewallStatus returns the current UFW status
-func (fc *FirewallCollector) GetFirewallStatus(ctx context.Context) (string, error) {
-	cmd := exec.CommandContext(ctx, "sudo", fc.ufwBinary, "status", "numbered")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get UFW status: %w", err)
+// findMissingRules returns the rules that are not in set, e.g. API rules
+// missing from the firewall or firewall rules the API no longer has
+func (fc *FirewallCollector) findMissingRules(rules []FirewallRule, set map[ruleKey]FirewallRule) []FirewallRule {
+	var missing []FirewallRule
+	for _, rule := range rules {
+		if _, exists := set[fc.keyFor(rule)]; !exists {
+			missing = append(missing, rule)
+		}
 	}
-	return string(output), nil
+	return missing
 }
 
 // SaveRulesToFile saves firewall rules to a JSON file with timestamp
@@ -303,4 +526,32 @@ func (fc *FirewallCollector) SaveRulesToFile(rules string, outputFile string) er
 	rulesWithTimestamp := rules + fmt.Sprintf("\nLast updated: %s", time.Now().Format(time.RFC3339))
 	
 	return os.WriteFile(outputFile, []byte(rulesWithTimestamp), 0644)
-}
\ No newline at end of file
+}
+
+// LoadRulesFile reads the rules saved by SaveRulesToFile, and when they
+// were saved
+func (fc *FirewallCollector) LoadRulesFile(outputFile string) (string, time.Time, error) {
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	i := strings.LastIndex(string(data), "\nLast updated: ")
+	if i < 0 {
+		return "", time.Time{}, fmt.Errorf("%s has no timestamp", outputFile)
+	}
+	updated, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data[i+len("\nLast updated: "):])))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid timestamp in %s: %w", outputFile, err)
+	}
+	return string(data[:i]), updated, nil
+}
+
+// removeRule removes a single rule
+func (fc *FirewallCollector) removeRule(ctx context.Context, rule FirewallRule) error {
+	if rule.IsICMP() {
+		// Never added; the firewall's built-in rules cover it
+		return nil
+	}
+	// Records of temporary rules do not keep the scope
+	return fc.applyChanges(ctx, []RuleChange{{Rule: fc.scoped(rule), Remove: true}}, false)[0]
+}
@@ -0,0 +1,218 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// FirewallBackend applies rules to the host's packet filter. The
+// collector diffs the API rules against GetRules and applies the difference
+// through AddRule and RemoveRule, so a backend only translates single rules.
+// UFW is the default backend.
+type FirewallBackend interface {
+	// Name identifies the backend in logs and errors, e.g. "UFW"
+	Name() string
+	// GetRules returns the rules currently applied
+	GetRules(ctx context.Context) ([]FirewallRule, error)
+	// AddRule allows or denies the traffic rule matches. Adding a rule
+	// that is already applied is not an error.
+	AddRule(ctx context.Context, rule FirewallRule) error
+	// RemoveRule removes a rule returned by GetRules or added by AddRule
+	RemoveRule(ctx context.Context, rule FirewallRule) error
+	// Reload reapplies the backend's configuration. Rule changes must be
+	// live without it.
+	Reload(ctx context.Context) error
+}
+
+// inboundOnly returns an error for rules other than inbound allow rules,
+// the only ones backends without outbound or deny support apply
+func inboundOnly(backend string, rule FirewallRule) error {
+	if rule.inboundAllow() {
+		return nil
+	}
+	return fmt.Errorf("the %s backend only applies inbound allow rules, not %s", backend, rule)
+}
+
+// RuleChange is a rule to add, or to remove when Remove is set
+type RuleChange struct {
+	Rule   FirewallRule
+	Remove bool
+}
+
+// undo returns the change that reverts c
+func (c RuleChange) undo() RuleChange {
+	return RuleChange{Rule: c.Rule, Remove: !c.Remove}
+}
+
+// String describes the change for logging
+func (c RuleChange) String() string {
+	if c.Remove {
+		return "removal of " + c.Rule.String()
+	}
+	return "addition of " + c.Rule.String()
+}
+
+// errSkipped is returned for changes that were not applied because an
+// earlier one failed
+var errSkipped = errors.New("skipped after an earlier change failed")
+
+// BatchBackend is implemented by backends that apply many changes at once
+// more cheaply than one by one. ApplyBatch returns an error per change, nil
+// for those that succeeded; with stopOnError the changes after the first
+// failure are skipped. UFW is not one: it has no command applying several
+// rules, and running its commands through a privileged shell or helper
+// would grant more than the ufw binary itself.
+type BatchBackend interface {
+	ApplyBatch(ctx context.Context, changes []RuleChange, stopOnError bool) []error
+}
+
+// StatusBackend is implemented by backends with a native status output,
+// shown in logs and diagnostics instead of the rule list
+type StatusBackend interface {
+	Status(ctx context.Context) (string, error)
+}
+
+// RateLimitBackend is implemented by backends that can rate-limit new
+// connections, which DDoS mitigation relies on
+type RateLimitBackend interface {
+	InsertLimitRule(ctx context.Context, rule FirewallRule) error
+	DeleteLimitRule(ctx context.Context, rule FirewallRule) error
+}
+
+// SetBackend replaces UFW with another firewall backend, for hosts where
+// UFW is not installed
+func (fc *FirewallCollector) SetBackend(backend FirewallBackend) {
+	fc.backend = backend
+}
+
+// Backend returns the firewall backend rules are applied with
+func (fc *FirewallCollector) Backend() FirewallBackend {
+	return fc.backend
+}
+
+// applyChanges applies rule changes through the backend, in one batch when
+// it supports batches. It returns an error per change like ApplyBatch.
+func (fc *FirewallCollector) applyChanges(ctx context.Context, changes []RuleChange, stopOnError bool) []error {
+	errs := make([]error, len(changes))
+	if len(changes) == 0 {
+		return errs
+	}
+	failAll := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	if fc.readOnly {
+		return failAll(ErrReadOnly)
+	}
+	// A batch counts as a single invocation for injected delays
+	if err := fc.delay(ctx); err != nil {
+		return failAll(fmt.Errorf("%s batch failed: %w", fc.backend.Name(), err))
+	}
+	if batch, ok := fc.backend.(BatchBackend); ok {
+		return batch.ApplyBatch(ctx, changes, stopOnError)
+	}
+
+	for i, change := range changes {
+		if change.Remove {
+			errs[i] = fc.backend.RemoveRule(ctx, change.Rule)
+		} else {
+			errs[i] = fc.backend.AddRule(ctx, change.Rule)
+		}
+		if errs[i] != nil && stopOnError {
+			for j := i + 1; j < len(changes); j++ {
+				errs[j] = errSkipped
+			}
+			break
+		}
+	}
+	return errs
+}
+
+// revert undoes changes that were applied, logging those that fail
+func (fc *FirewallCollector) revert(ctx context.Context, undo []RuleChange) {
+	for i, err := range fc.applyChanges(ctx, undo, false) {
+		if err != nil {
+			fc.logger.Errorf("Failed to revert %s: %v", undo[i], err)
+		}
+	}
+}
+
+// GetCurrentRules returns the rules currently applied by the backend
+func (fc *FirewallCollector) GetCurrentRules(ctx context.Context) ([]FirewallRule, error) {
+	if err := fc.delay(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get %s rules: %w", fc.backend.Name(), err)
+	}
+	return fc.backend.GetRules(ctx)
+}
+
+// reload reloads the backend. Rule changes are live without it; it is only
+// needed for structural changes such as default policies.
+func (fc *FirewallCollector) reload(ctx context.Context) error {
+	if fc.readOnly {
+		return ErrReadOnly
+	}
+	if err := fc.delay(ctx); err != nil {
+		return err
+	}
+	return fc.backend.Reload(ctx)
+}
+
+// GetFirewallStatus returns the backend's status output, or the applied
+// rules for backends without one
+func (fc *FirewallCollector) GetFirewallStatus(ctx context.Context) (string, error) {
+	if status, ok := fc.backend.(StatusBackend); ok {
+		return status.Status(ctx)
+	}
+	rules, err := fc.GetCurrentRules(ctx)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d rules\n", fc.backend.Name(), len(rules))
+	for _, rule := range rules {
+		b.WriteString(rule.String() + "\n")
+	}
+	return b.String(), nil
+}
+
+// rateLimiter returns the backend's rate limiting, refusing changes in
+// read-only mode
+func (fc *FirewallCollector) rateLimiter() (RateLimitBackend, error) {
+	if fc.readOnly {
+		return nil, ErrReadOnly
+	}
+	limiter, ok := fc.backend.(RateLimitBackend)
+	if !ok {
+		return nil, fmt.Errorf("firewall backend %s does not support rate limits", fc.backend.Name())
+	}
+	return limiter, nil
+}
+
+// InsertLimitRule inserts a rate-limit rule ahead of the allow rules, so it
+// applies to traffic they would otherwise accept
+func (fc *FirewallCollector) InsertLimitRule(ctx context.Context, rule FirewallRule) error {
+	limiter, err := fc.rateLimiter()
+	if err != nil {
+		return err
+	}
+	if err := fc.delay(ctx); err != nil {
+		return err
+	}
+	return limiter.InsertLimitRule(ctx, rule)
+}
+
+// DeleteLimitRule removes a rate-limit rule added by InsertLimitRule
+func (fc *FirewallCollector) DeleteLimitRule(ctx context.Context, rule FirewallRule) error {
+	limiter, err := fc.rateLimiter()
+	if err != nil {
+		return err
+	}
+	if err := fc.delay(ctx); err != nil {
+		return err
+	}
+	return limiter.DeleteLimitRule(ctx, rule)
+}
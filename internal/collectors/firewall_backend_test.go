@@ -0,0 +1,251 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// fakeBackend is an in-memory FirewallBackend that records its calls and
+// fails the changes of the rules in fail
+type fakeBackend struct {
+	rules []FirewallRule
+	fail  map[string]bool
+	calls []string
+}
+
+func (b *fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) GetRules(ctx context.Context) ([]FirewallRule, error) {
+	return slices.Clone(b.rules), nil
+}
+
+func (b *fakeBackend) AddRule(ctx context.Context, rule FirewallRule) error {
+	b.calls = append(b.calls, "add "+rule.String())
+	if b.fail[rule.String()] {
+		return errors.New("add failed")
+	}
+	if !slices.Contains(b.rules, rule) {
+		b.rules = append(b.rules, rule)
+	}
+	return nil
+}
+
+func (b *fakeBackend) RemoveRule(ctx context.Context, rule FirewallRule) error {
+	b.calls = append(b.calls, "remove "+rule.String())
+	if b.fail[rule.String()] {
+		return errors.New("remove failed")
+	}
+	b.rules = slices.DeleteFunc(b.rules, func(r FirewallRule) bool { return r == rule })
+	return nil
+}
+
+func (b *fakeBackend) Reload(ctx context.Context) error { return nil }
+
+// newFakeCollector returns a collector applying rules through backend
+func newFakeCollector(backend *fakeBackend) *FirewallCollector {
+	fc := NewFirewallCollector("ufw", false, testLogger())
+	fc.SetBackend(backend)
+	return fc
+}
+
+var (
+	ruleSSH   = FirewallRule{From: "any", Protocol: "tcp", Port: "22"}
+	ruleHTTP  = FirewallRule{From: "any", Protocol: "tcp", Port: "80"}
+	ruleHTTPS = FirewallRule{From: "any", Protocol: "tcp", Port: "443"}
+)
+
+func TestDiffRules(t *testing.T) {
+	tests := []struct {
+		name          string
+		current       []FirewallRule
+		api           string
+		wantAdd       []string
+		wantRemove    []string
+		wantUnchanged int
+	}{
+		{
+			name:          "in sync",
+			current:       []FirewallRule{ruleSSH},
+			api:           `[{"from": "any", "protocol": "tcp", "port": "22"}]`,
+			wantUnchanged: 1,
+		},
+		{
+			name:    "missing rule is added",
+			current: nil,
+			api:     `[{"from": "any", "protocol": "tcp", "port": "22"}]`,
+			wantAdd: []string{ruleSSH.String()},
+		},
+		{
+			name:       "rule the API dropped is removed",
+			current:    []FirewallRule{ruleSSH, ruleHTTP},
+			api:        `[{"from": "any", "protocol": "tcp", "port": "22"}]`,
+			wantRemove: []string{ruleHTTP.String()},
+			// The kept rule
+			wantUnchanged: 1,
+		},
+		{
+			name:          "fields compare case-insensitively",
+			current:       []FirewallRule{{From: "2001:db8::/32", Protocol: "tcp", Port: "22"}},
+			api:           `[{"from": "2001:DB8::/32", "protocol": "TCP", "port": "22"}]`,
+			wantUnchanged: 1,
+		},
+		{
+			name:          "foreign rule is kept",
+			current:       []FirewallRule{{From: "any", Protocol: "tcp", Port: "23", Action: ActionDeny, Foreign: true}},
+			api:           `[]`,
+			wantUnchanged: 0,
+		},
+		{
+			name:    "rule with an invalid direction is ignored",
+			current: nil,
+			api:     `[{"from": "any", "protocol": "tcp", "port": "22", "direction": "sideways"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := newFakeCollector(&fakeBackend{rules: tt.current})
+			diff, err := fc.diffRules(context.Background(), `{"firewall": {"rules": `+tt.api+`}}`)
+			if err != nil {
+				t.Fatalf("diffRules() error = %v", err)
+			}
+			if got := ruleStrings(diff.add); !reflect.DeepEqual(got, tt.wantAdd) {
+				t.Errorf("add = %v, want %v", got, tt.wantAdd)
+			}
+			if got := ruleStrings(diff.remove); !reflect.DeepEqual(got, tt.wantRemove) {
+				t.Errorf("remove = %v, want %v", got, tt.wantRemove)
+			}
+			if diff.unchanged != tt.wantUnchanged {
+				t.Errorf("unchanged = %d, want %d", diff.unchanged, tt.wantUnchanged)
+			}
+		})
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name        string
+		current     []FirewallRule
+		changes     []RuleChange
+		fail        []FirewallRule
+		stopOnError bool
+		// wantErrs holds nil, errSkipped, or errFailed for any other error
+		wantErrs  []error
+		wantRules []FirewallRule
+	}{
+		{
+			name:      "add and remove",
+			current:   []FirewallRule{ruleHTTP},
+			changes:   []RuleChange{{Rule: ruleSSH}, {Rule: ruleHTTP, Remove: true}},
+			wantErrs:  []error{nil, nil},
+			wantRules: []FirewallRule{ruleSSH},
+		},
+		{
+			name:      "failure without stopOnError applies the rest",
+			changes:   []RuleChange{{Rule: ruleSSH}, {Rule: ruleHTTP}, {Rule: ruleHTTPS}},
+			fail:      []FirewallRule{ruleHTTP},
+			wantErrs:  []error{nil, errFailed, nil},
+			wantRules: []FirewallRule{ruleSSH, ruleHTTPS},
+		},
+		{
+			name:        "failure with stopOnError skips the rest",
+			changes:     []RuleChange{{Rule: ruleSSH}, {Rule: ruleHTTP}, {Rule: ruleHTTPS}},
+			fail:        []FirewallRule{ruleHTTP},
+			stopOnError: true,
+			wantErrs:    []error{nil, errFailed, errSkipped},
+			wantRules:   []FirewallRule{ruleSSH},
+		},
+		{
+			name:     "no changes",
+			wantErrs: []error{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &fakeBackend{rules: tt.current, fail: make(map[string]bool)}
+			for _, rule := range tt.fail {
+				backend.fail[rule.String()] = true
+			}
+			fc := newFakeCollector(backend)
+
+			errs := fc.applyChanges(context.Background(), tt.changes, tt.stopOnError)
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("got %d errors, want %d", len(errs), len(tt.wantErrs))
+			}
+			for i, err := range errs {
+				switch want := tt.wantErrs[i]; {
+				case want == nil && err != nil, want == errSkipped && err != errSkipped:
+					t.Errorf("change %d: error = %v, want %v", i, err, want)
+				case want == errFailed && (err == nil || err == errSkipped):
+					t.Errorf("change %d: error = %v, want a failure", i, err)
+				}
+			}
+			if !reflect.DeepEqual(backend.rules, tt.wantRules) {
+				t.Errorf("rules = %v, want %v", backend.rules, tt.wantRules)
+			}
+		})
+	}
+}
+
+func TestApplyChangesReadOnly(t *testing.T) {
+	backend := &fakeBackend{rules: []FirewallRule{ruleHTTP}}
+	fc := newFakeCollector(backend)
+	fc.SetReadOnly(true)
+
+	errs := fc.applyChanges(context.Background(), []RuleChange{{Rule: ruleSSH}, {Rule: ruleHTTP, Remove: true}}, true)
+	for i, err := range errs {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("change %d: error = %v, want ErrReadOnly", i, err)
+		}
+	}
+	if len(backend.calls) != 0 {
+		t.Errorf("backend was called in read-only mode: %v", backend.calls)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	backend := &fakeBackend{rules: []FirewallRule{ruleHTTP}}
+	fc := newFakeCollector(backend)
+
+	changes := []RuleChange{{Rule: ruleSSH}, {Rule: ruleHTTP, Remove: true}}
+	undo := make([]RuleChange, 0, len(changes))
+	for i, err := range fc.applyChanges(context.Background(), changes, false) {
+		if err != nil {
+			t.Fatalf("change %d: %v", i, err)
+		}
+		undo = append(undo, changes[i].undo())
+	}
+	fc.revert(context.Background(), undo)
+
+	if want := []FirewallRule{ruleHTTP}; !reflect.DeepEqual(backend.rules, want) {
+		t.Errorf("rules after revert = %v, want %v", backend.rules, want)
+	}
+}
+
+func TestDiffRulesWritesNoState(t *testing.T) {
+	stateDir := t.TempDir()
+	fc := newFakeCollector(&fakeBackend{})
+	fc.SetStateDir(stateDir)
+	api := `{"firewall": {"rules": [{"from": "any", "protocol": "tcp", "port": "22", "ttl": "1h"}]}}`
+
+	if _, _, err := fc.DiffFirewallRules(context.Background(), api); err != nil {
+		t.Fatalf("DiffFirewallRules() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(stateDir); len(entries) != 0 {
+		t.Errorf("diff wrote to the state directory: %v", entries)
+	}
+
+	if _, err := fc.SyncFirewallRules(context.Background(), api); err != nil {
+		t.Fatalf("SyncFirewallRules() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, temporaryRulesFile)); err != nil {
+		t.Errorf("sync did not record the temporary rule: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// ErrCanaryReverted is returned when risky rule changes were reverted after
+// failing verification
+var ErrCanaryReverted = errors.New("rule changes reverted")
+
+// canaryRetryInterval is how often a failed canary verification is retried
+// within the grace window
+const canaryRetryInterval = 5 * time.Second
+
+// CanaryPolicy decides which rule changes are risky enough to be verified
+// after applying, and how
+type CanaryPolicy struct {
+	// MaxRemovals is how many rules a change may remove before it is risky
+	MaxRemovals int
+	// SSHPort makes any change to rules covering it risky
+	SSHPort int
+	// Grace is how long verification may keep failing before the change is
+	// reverted
+	Grace time.Duration
+	// Verify checks the server is still reachable and manageable
+	Verify func(ctx context.Context) error
+}
+
+// risk returns why a change is risky, or "" if it is not
+func (p *CanaryPolicy) risk(add, remove []FirewallRule) string {
+	if len(remove) > p.MaxRemovals {
+		return fmt.Sprintf("removes %d rules, more than %d", len(remove), p.MaxRemovals)
+	}
+	for _, rule := range append(append([]FirewallRule(nil), add...), remove...) {
+		if rule.direction() == DirectionIn && rule.coversPort(p.SSHPort) {
+			return fmt.Sprintf("touches rule %s covering SSH port %d", rule, p.SSHPort)
+		}
+	}
+	// Outbound traffic stops being allowed, which may include the agent's
+	// own connection to the API
+	for _, rule := range add {
+		if rule.direction() == DirectionOut && rule.action() == ActionDeny {
+			return fmt.Sprintf("adds outbound deny rule %s", rule)
+		}
+	}
+	for _, rule := range remove {
+		if rule.direction() == DirectionOut && rule.action() == ActionAllow {
+			return fmt.Sprintf("removes outbound allow rule %s", rule)
+		}
+	}
+	return ""
+}
+
+// coversPort reports whether the rule applies to a TCP port
+func (r FirewallRule) coversPort(port int) bool {
+	if protocol := r.protocol(); protocol != "any" && protocol != "tcp" {
+		return false
+	}
+	if r.port() == "any" {
+		return true
+	}
+	for _, part := range strings.Split(r.port(), ",") {
+		low, high, isRange := strings.Cut(part, ":")
+		if !isRange {
+			high = low
+		}
+		lo, err1 := strconv.Atoi(low)
+		hi, err2 := strconv.Atoi(high)
+		if err1 == nil && err2 == nil && lo <= port && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncFirewallRulesCanary synchronizes UFW with API rules like
+// SyncFirewallRules, but applies risky changes in canary mode: once applied
+// they are verified until verification passes or the grace window ends, in
+// which case they are reverted and an error is returned.
+func (fc *FirewallCollector) SyncFirewallRulesCanary(ctx context.Context, apiRulesJSON string, policy *CanaryPolicy) (*state.SyncResult, error) {
+	start := time.Now()
+	fc.logger.Info("Starting firewall rule synchronization")
+
+	diff, err := fc.diffRules(ctx, apiRulesJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := fc.saveTemporaryRules(diff.temporary); err != nil {
+		return nil, err
+	}
+	rulesToAdd, rulesToRemove := diff.add, diff.remove
+	reason := policy.risk(rulesToAdd, rulesToRemove)
+	if reason != "" {
+		fc.logger.Warnf("Applying rule changes in canary mode as the change %s", reason)
+	}
+
+	result, undo := fc.applyDiff(ctx, rulesToAdd, rulesToRemove, diff.unchanged)
+	result.Canary = reason
+	if reason == "" || len(undo) == 0 {
+		result.Duration = time.Since(start).String()
+		return result, nil
+	}
+
+	verifyErr := fc.verifyCanary(ctx, policy)
+	if verifyErr == nil {
+		fc.logger.Info("Canary verification passed, keeping rule changes")
+		result.Duration = time.Since(start).String()
+		return result, nil
+	}
+
+	fc.logger.Errorf("Canary verification failed, reverting rule changes: %v", verifyErr)
+	fc.revert(context.WithoutCancel(ctx), undo)
+	result.RolledBack = true
+	result.Duration = time.Since(start).String()
+	return result, fmt.Errorf("%w after canary verification failed: %w", ErrCanaryReverted, verifyErr)
+}
+
+// verifyCanary retries the policy's verification until it passes or the
+// grace window ends, returning the last failure
+func (fc *FirewallCollector) verifyCanary(ctx context.Context, policy *CanaryPolicy) error {
+	deadline := time.Now().Add(policy.Grace)
+	for {
+		err := policy.Verify(ctx)
+		if err == nil || !time.Now().Add(canaryRetryInterval).Before(deadline) {
+			return err
+		}
+		fc.logger.Debugf("Canary verification failed, retrying: %v", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(canaryRetryInterval):
+		}
+	}
+}
+
+// TCPListening reports whether a socket listens on a TCP port, over IPv4 or
+// IPv6
+func TCPListening(port int) (bool, error) {
+	// Lines are "sl local_address rem_address st ...", with addresses in
+	// hex as ADDR:PORT and st 0A for LISTEN
+	want := fmt.Sprintf(":%04X", port)
+	found := false
+	var readErr error
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		err := lines.ScanFile(file, func(line string) {
+			fields := strings.Fields(line)
+			if len(fields) > 3 && fields[3] == "0A" && strings.HasSuffix(fields[1], want) {
+				found = true
+			}
+		})
+		// tcp6 is missing when IPv6 is disabled
+		if err != nil && !os.IsNotExist(err) {
+			readErr = err
+		}
+	}
+	if found {
+		return true, nil
+	}
+	return false, readErr
+}
@@ -0,0 +1,139 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// temporaryRulesFile tracks when temporary rules expire
+const temporaryRulesFile = "temporary-rules.json"
+
+// temporaryRule is the local record of a rule with an expiration
+type temporaryRule struct {
+	Rule      FirewallRule `json:"rule"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	// Removed is set once the rule has been deleted from UFW on expiry
+	Removed bool `json:"removed"`
+}
+
+// activeRules drops expired temporary rules from the API rules, and returns
+// the expirations of the temporary ones for saveTemporaryRules. A TTL
+// counts from when the agent first saw the rule, so it is not extended by
+// later synchronizations. Nothing is saved, so diffs stay read-only.
+func (fc *FirewallCollector) activeRules(rules []FirewallRule, now time.Time) ([]FirewallRule, []temporaryRule, error) {
+	if fc.stateDir == "" {
+		return rules, nil, nil
+	}
+
+	var tracked []temporaryRule
+	if err := state.Load(fc.stateDir, temporaryRulesFile, &tracked); err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to load temporary rules: %w", err)
+	}
+	known := make(map[ruleKey]temporaryRule)
+	for _, t := range tracked {
+		known[fc.keyFor(t.Rule)] = t
+	}
+
+	var active []FirewallRule
+	var current []temporaryRule
+	for _, rule := range rules {
+		if rule.ExpiresAt == nil && rule.TTL == "" {
+			active = append(active, rule)
+			continue
+		}
+
+		key := fc.keyFor(rule)
+		t, ok := known[key]
+		switch {
+		case rule.ExpiresAt != nil:
+			t.ExpiresAt = *rule.ExpiresAt
+		case !ok:
+			ttl, err := time.ParseDuration(rule.TTL)
+			if err != nil || ttl <= 0 {
+				// Never open access for longer than intended
+				fc.logger.Errorf("Ignoring rule %s with invalid TTL %q", rule, rule.TTL)
+				continue
+			}
+			t.ExpiresAt = now.Add(ttl)
+		}
+		if now.Before(t.ExpiresAt) {
+			// The API extended a rule that already expired; it is added back
+			t.Removed = false
+		}
+		t.Rule = rule
+		current = append(current, t)
+		delete(known, key)
+
+		if now.Before(t.ExpiresAt) {
+			active = append(active, rule)
+		}
+	}
+
+	return active, current, nil
+}
+
+// saveTemporaryRules records the expirations activeRules returned, when the
+// rules are applied. Temporary rules the API no longer sends are removed by
+// the regular synchronization, so their records are dropped.
+func (fc *FirewallCollector) saveTemporaryRules(temporary []temporaryRule) error {
+	if fc.stateDir == "" || fc.readOnly {
+		return nil
+	}
+	if err := state.Save(fc.stateDir, temporaryRulesFile, temporary); err != nil {
+		return fmt.Errorf("failed to save temporary rules: %w", err)
+	}
+	return nil
+}
+
+// ExpireRules removes temporary rules whose expiration has passed from UFW.
+// It only uses local state, so access is revoked on schedule even while the
+// API is unreachable.
+func (fc *FirewallCollector) ExpireRules(ctx context.Context) error {
+	if fc.stateDir == "" {
+		return nil
+	}
+
+	var tracked []temporaryRule
+	if err := state.Load(fc.stateDir, temporaryRulesFile, &tracked); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to load temporary rules: %w", err)
+	}
+
+	now := time.Now()
+	changed := false
+	var failed int
+	for i, t := range tracked {
+		if t.Removed || now.Before(t.ExpiresAt) {
+			continue
+		}
+		if err := fc.removeRule(ctx, t.Rule); err != nil {
+			fc.logger.Errorf("Failed to remove expired rule %s: %v", t.Rule, err)
+			failed++
+			continue
+		}
+		fc.logger.Infof("Removed expired rule: %s", t.Rule)
+		tracked[i].Removed = true
+		changed = true
+	}
+
+	if !changed {
+		if failed > 0 {
+			return fmt.Errorf("%d expired rules could not be removed", failed)
+		}
+		return nil
+	}
+
+	if err := state.Save(fc.stateDir, temporaryRulesFile, tracked); err != nil {
+		return fmt.Errorf("failed to save temporary rules: %w", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d expired rules could not be removed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ExportFormats lists the formats ExportRules renders
+var ExportFormats = []string{"json", "nft", "iptables", "terraform"}
+
+// exportedRule is a rule as exported to JSON and Terraform, including the
+// tenant scope the API format leaves out
+type exportedRule struct {
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Protocol  string `json:"protocol"`
+	Port      string `json:"port"`
+	Direction string `json:"direction,omitempty"`
+	Action    string `json:"action,omitempty"`
+}
+
+// ExportRules renders rules in another firewall's format, so they can be
+// migrated off UFW or kept in infrastructure as code. The nft and iptables
+// rule sets accept established traffic, loopback and the inbound rules, and
+// drop everything else, like UFW's default incoming policy. Outbound rules
+// apply to traffic the host sends, which is otherwise accepted.
+func ExportRules(rules []FirewallRule, format string) (string, error) {
+	switch format {
+	case "json":
+		return exportJSON(rules)
+	case "nft":
+		return exportNft(rules), nil
+	case "iptables":
+		return exportIptables(rules), nil
+	case "terraform":
+		return exportTerraform(rules), nil
+	}
+	return "", fmt.Errorf("unknown export format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+}
+
+// exported returns the rule with its defaults filled in, except direction
+// and action which are only set on outbound and deny rules
+func exported(rule FirewallRule) exportedRule {
+	from := rule.From
+	if from == "" {
+		from = "any"
+	}
+	r := exportedRule{From: from, To: rule.To, Interface: rule.Interface, Protocol: rule.protocol(), Port: rule.port()}
+	if rule.direction() == DirectionOut {
+		r.Direction = DirectionOut
+	}
+	if rule.action() == ActionDeny {
+		r.Action = ActionDeny
+	}
+	return r
+}
+
+// outbound reports whether the rule applies to traffic the host sends
+func (r exportedRule) outbound() bool {
+	return r.Direction == DirectionOut
+}
+
+// exportJSON renders the rules in the API's rule format
+func exportJSON(rules []FirewallRule) (string, error) {
+	out := struct {
+		Rules []exportedRule `json:"rules"`
+	}{Rules: []exportedRule{}}
+	for _, rule := range rules {
+		out.Rules = append(out.Rules, exported(rule))
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal rules: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// ruleFamily returns "ip6" for a rule limited to IPv6 addresses, "ip" for
+// IPv4 and "" for a rule that applies to both
+func ruleFamily(rule exportedRule) string {
+	for _, address := range []string{rule.From, rule.To} {
+		if family := addressFamily(address); family != "" {
+			return family
+		}
+	}
+	return ""
+}
+
+// exportProtocols returns the transport protocols a rule covers: a rule
+// with ports but no protocol applies to both TCP and UDP, like in UFW
+func exportProtocols(rule exportedRule) []string {
+	if rule.Protocol == "any" && rule.Port != "any" {
+		return []string{"tcp", "udp"}
+	}
+	return []string{rule.Protocol}
+}
+
+// exportNft renders the rules as an nftables ruleset for `nft -f`
+func exportNft(rules []FirewallRule) string {
+	var b strings.Builder
+	b.WriteString("#!/usr/sbin/nft -f\n\n")
+	b.WriteString("table inet lsh_firewall\ndelete table inet lsh_firewall\n\n")
+	b.WriteString("table inet lsh_firewall {\n")
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter; policy drop;\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tct state invalid drop\n")
+	b.WriteString("\t\tiifname \"lo\" accept\n")
+	b.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+	var outbound []exportedRule
+	for _, rule := range rules {
+		r := exported(rule)
+		if r.outbound() {
+			outbound = append(outbound, r)
+			continue
+		}
+		fmt.Fprintf(&b, "\t\t%s\n", strings.TrimSpace(nftMatch(r)+" "+nftVerdict(r)))
+	}
+	b.WriteString("\t}\n")
+	if len(outbound) > 0 {
+		b.WriteString("\n\tchain output {\n")
+		b.WriteString("\t\ttype filter hook output priority filter; policy accept;\n")
+		for _, r := range outbound {
+			fmt.Fprintf(&b, "\t\t%s\n", strings.TrimSpace(nftMatch(r)+" "+nftVerdict(r)))
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// nftVerdict returns the nftables verdict of a rule
+func nftVerdict(r exportedRule) string {
+	if r.Action == ActionDeny {
+		return "drop"
+	}
+	return "accept"
+}
+
+// nftMatch renders the nftables match expression of a rule. The remote
+// address of an outbound rule is its destination.
+func nftMatch(r exportedRule) string {
+	iface, remote, local := "iifname", "saddr", "daddr"
+	if r.outbound() {
+		iface, remote, local = "oifname", "daddr", "saddr"
+	}
+	var match []string
+	if r.Interface != "" {
+		match = append(match, fmt.Sprintf("%s %q", iface, r.Interface))
+	}
+	family := ruleFamily(r)
+	if family == "" {
+		family = "ip"
+	}
+	if r.From != "any" {
+		match = append(match, family+" "+remote+" "+r.From)
+	}
+	if r.To != "" {
+		match = append(match, family+" "+local+" "+r.To)
+	}
+	switch {
+	case r.Port != "any":
+		ports := strings.ReplaceAll(r.Port, ":", "-")
+		if strings.Contains(ports, ",") {
+			ports = "{ " + strings.ReplaceAll(ports, ",", ", ") + " }"
+		}
+		protocols := exportProtocols(r)
+		if len(protocols) == 1 {
+			match = append(match, protocols[0]+" dport "+ports)
+		} else {
+			match = append(match, "meta l4proto { "+strings.Join(protocols, ", ")+" } th dport "+ports)
+		}
+	case r.Protocol != "any":
+		match = append(match, "meta l4proto "+r.Protocol)
+	}
+	return strings.Join(match, " ")
+}
+
+// exportIptables renders the rules for iptables-restore, followed by the
+// IPv6 rules for ip6tables-restore
+func exportIptables(rules []FirewallRule) string {
+	var v4, v6 []string
+	for _, rule := range rules {
+		r := exported(rule)
+		family := ruleFamily(r)
+		for _, protocol := range exportProtocols(r) {
+			if family != "ip6" {
+				v4 = append(v4, iptablesRule(r, protocol))
+			}
+			if family != "ip" {
+				if protocol == "icmp" {
+					protocol = "ipv6-icmp"
+				}
+				v6 = append(v6, iptablesRule(r, protocol))
+			}
+		}
+	}
+
+	var b strings.Builder
+	write := func(tool, icmp string, lines []string) {
+		fmt.Fprintf(&b, "# %s\n", tool)
+		b.WriteString("*filter\n:INPUT DROP [0:0]\n:FORWARD DROP [0:0]\n:OUTPUT ACCEPT [0:0]\n")
+		b.WriteString("-A INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT\n")
+		b.WriteString("-A INPUT -m conntrack --ctstate INVALID -j DROP\n")
+		b.WriteString("-A INPUT -i lo -j ACCEPT\n")
+		fmt.Fprintf(&b, "-A INPUT -p %s -j ACCEPT\n", icmp)
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+		b.WriteString("COMMIT\n")
+	}
+	write("iptables-restore", "icmp", v4)
+	b.WriteString("\n")
+	write("ip6tables-restore", "ipv6-icmp", v6)
+	return b.String()
+}
+
+// iptablesRule renders an iptables-restore line accepting or dropping the
+// rule's traffic of one protocol
+func iptablesRule(r exportedRule, protocol string) string {
+	chain, target := "INPUT", "ACCEPT"
+	if r.outbound() {
+		chain = "OUTPUT"
+	}
+	if r.Action == ActionDeny {
+		target = "DROP"
+	}
+	args := append([]string{"-A", chain}, iptablesMatch(r, protocol)...)
+	return strings.Join(append(args, "-j", target), " ")
+}
+
+// iptablesMatch returns the iptables match arguments of the rule's traffic
+// of one protocol. The remote address of an outbound rule is its
+// destination.
+func iptablesMatch(r exportedRule, protocol string) []string {
+	iface, remote, local := "-i", "-s", "-d"
+	if r.outbound() {
+		iface, remote, local = "-o", "-d", "-s"
+	}
+	var args []string
+	if r.Interface != "" {
+		args = append(args, iface, r.Interface)
+	}
+	if r.From != "any" {
+		args = append(args, remote, r.From)
+	}
+	if r.To != "" {
+		args = append(args, local, r.To)
+	}
+	if protocol != "any" {
+		args = append(args, "-p", protocol)
+	}
+	if r.Port != "any" {
+		if strings.Contains(r.Port, ",") {
+			args = append(args, "-m", "multiport", "--dports", r.Port)
+		} else {
+			args = append(args, "--dport", r.Port)
+		}
+	}
+	return args
+}
+
+// exportTerraform renders the rules as a Terraform local value, to be fed
+// to whichever firewall resource manages them
+func exportTerraform(rules []FirewallRule) string {
+	var b strings.Builder
+	b.WriteString("locals {\n  firewall_rules = [\n")
+	for _, rule := range rules {
+		r := exported(rule)
+		b.WriteString("    {\n")
+		field := func(name, value string) {
+			fmt.Fprintf(&b, "      %-9s = %q\n", name, value)
+		}
+		field("from", r.From)
+		if r.To != "" {
+			field("to", r.To)
+		}
+		if r.Interface != "" {
+			field("interface", r.Interface)
+		}
+		field("protocol", r.Protocol)
+		field("port", r.Port)
+		if r.Direction != "" {
+			field("direction", r.Direction)
+		}
+		if r.Action != "" {
+			field("action", r.Action)
+		}
+		b.WriteString("    },\n")
+	}
+	b.WriteString("  ]\n}\n")
+	return b.String()
+}
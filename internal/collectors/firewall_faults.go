@@ -0,0 +1,47 @@
+package collectors
+
+import (
+	"context"
+	"time"
+)
+
+// corruptSource is an address UFW refuses, used to make a rule fail
+const corruptSource = "999.999.999.999"
+
+// Faults are failures injected into firewall synchronization to exercise
+// retry, rollback and alerting
+type Faults struct {
+	// UFWDelay is added before every firewall backend invocation; a batch
+	// of rule changes counts as one
+	UFWDelay time.Duration
+	// CorruptRule makes the first added rule of every sync fail
+	CorruptRule bool
+}
+
+// SetFaults injects faults into the collector's UFW commands
+func (fc *FirewallCollector) SetFaults(faults Faults) {
+	fc.faults = faults
+}
+
+// delay waits for the injected UFW delay, if any
+func (fc *FirewallCollector) delay(ctx context.Context) error {
+	if fc.faults.UFWDelay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(fc.faults.UFWDelay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// corrupt replaces the source of the first added rule with an invalid
+// address when rule corruption is injected
+func (fc *FirewallCollector) corrupt(changes []RuleChange) {
+	if !fc.faults.CorruptRule || len(changes) == 0 || changes[0].Remove {
+		return
+	}
+	fc.logger.Warnf("Fault injection: corrupting the source of %s", changes[0].Rule)
+	changes[0].Rule.From = corruptSource
+}
@@ -0,0 +1,330 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/timings"
+	"github.com/sirupsen/logrus"
+)
+
+// iptablesBaseRules is how many rules the agent's chain starts with, ahead
+// of the allow rules: established, invalid, loopback and ICMP
+const iptablesBaseRules = 4
+
+// iptablesCommentRegex matches the comment of a rule added by the agent in
+// `iptables -S` output
+var iptablesCommentRegex = regexp.MustCompile(`--comment "?` + ruleCommentPrefix + `([^"]*)"?`)
+
+// iptablesFamily is an address family and the tool that manages it
+type iptablesFamily struct {
+	name   string
+	binary string
+	icmp   string
+}
+
+// IptablesBackend applies rules with iptables and ip6tables, for minimal
+// distributions with neither UFW nor the nft tool. Rules live in a chain of
+// their own, jumped to first from INPUT, which ends by dropping what the
+// rules do not allow, like UFW's default incoming policy. Established
+// connections, loopback and ICMP are always accepted. Since accepting or
+// dropping in the agent's chain is final, other INPUT rules only see
+// traffic that does not reach it, i.e. rules inserted ahead of the jump.
+// The chain is only created, and jumped to, once rules are added to it.
+type IptablesBackend struct {
+	families       []iptablesFamily
+	chain          string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewIptablesBackend creates an iptables backend managing chain. IPv6 rules
+// are applied with ip6tables, and rejected when it is empty.
+func NewIptablesBackend(iptables, ip6tables, chain string, logger *logrus.Logger) *IptablesBackend {
+	families := []iptablesFamily{{name: "ip", binary: iptables, icmp: "icmp"}}
+	if ip6tables != "" {
+		families = append(families, iptablesFamily{name: "ip6", binary: ip6tables, icmp: "ipv6-icmp"})
+	}
+	return &IptablesBackend{
+		families:       families,
+		chain:          chain,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run iptables with privileges,
+// e.g. "sudo" (the default) or "chroot /host" in container mode
+func (b *IptablesBackend) SetCommandWrapper(wrapper ...string) {
+	b.commandWrapper = wrapper
+}
+
+// Name identifies the backend
+func (b *IptablesBackend) Name() string {
+	return "iptables"
+}
+
+// run runs an iptables command of a family, waiting for the xtables lock
+// held by other tools
+func (b *IptablesBackend) run(ctx context.Context, family iptablesFamily, args ...string) ([]byte, error) {
+	defer timings.Since("iptables", time.Now())
+	argv := append(append(append([]string{}, b.commandWrapper...), family.binary, "-w"), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv, Priority: true})
+	if err != nil {
+		return output, fmt.Errorf("%s command failed: %w, output: %s", family.binary, err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// iptablesMissing reports whether iptables failed because the chain does
+// not exist
+func iptablesMissing(err error) bool {
+	return strings.Contains(err.Error(), "No chain/target/match by that name")
+}
+
+// createChain creates the agent's chain with its base rules and final drop
+// in a family, without jumping to it. A chain left half-created by a
+// failure is removed.
+func (b *IptablesBackend) createChain(ctx context.Context, family iptablesFamily) error {
+	base := [][]string{
+		{"-N", b.chain},
+		{"-A", b.chain, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		{"-A", b.chain, "-m", "conntrack", "--ctstate", "INVALID", "-j", "DROP"},
+		{"-A", b.chain, "-i", "lo", "-j", "ACCEPT"},
+		{"-A", b.chain, "-p", family.icmp, "-j", "ACCEPT"},
+		{"-A", b.chain, "-j", "DROP"},
+	}
+	for i, args := range base {
+		if _, err := b.run(ctx, family, args...); err != nil {
+			if i > 0 {
+				b.run(ctx, family, "-F", b.chain)
+				b.run(ctx, family, "-X", b.chain)
+			}
+			return fmt.Errorf("failed to create %s chain %s: %w", family.binary, b.chain, err)
+		}
+	}
+	b.logger.Infof("Created %s chain %s", family.binary, b.chain)
+	return nil
+}
+
+// ensureJump jumps to the agent's chain first from INPUT in a family,
+// unless it already does. It runs after the allow rules are in the chain.
+func (b *IptablesBackend) ensureJump(ctx context.Context, family iptablesFamily) error {
+	if _, err := b.run(ctx, family, "-C", "INPUT", "-j", b.chain); err == nil {
+		return nil
+	}
+	if _, err := b.run(ctx, family, "-I", "INPUT", "1", "-j", b.chain); err != nil {
+		return fmt.Errorf("failed to jump to %s chain %s: %w", family.binary, b.chain, err)
+	}
+	return nil
+}
+
+// iptablesSpec is an iptables rule of the agent's chain, as the arguments
+// that follow the chain name
+type iptablesSpec struct {
+	family iptablesFamily
+	args   []string
+}
+
+// list returns the rules added by the agent, the iptables rules that make
+// them up keyed by their comment, and the families whose chain exists. It
+// never creates the chain, so reads do not change the firewall.
+func (b *IptablesBackend) list(ctx context.Context) (map[string][]iptablesSpec, []FirewallRule, map[string]bool, error) {
+	byComment := make(map[string][]iptablesSpec)
+	present := make(map[string]bool)
+	var rules []FirewallRule
+	for _, family := range b.families {
+		output, err := b.run(ctx, family, "-S", b.chain)
+		if err != nil {
+			// The chain is only created along with the first rules, and
+			// may have been removed, e.g. by a flush
+			if iptablesMissing(err) {
+				continue
+			}
+			return nil, nil, nil, fmt.Errorf("failed to list iptables rules: %w", err)
+		}
+		present[family.name] = true
+		found, err := parseIptablesRules(family, bytes.NewReader(output), byComment)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read %s rules: %w", family.binary, err)
+		}
+		rules = append(rules, found...)
+	}
+	return byComment, rules, present, nil
+}
+
+// parseIptablesRules adds the rules added by the agent in the `iptables -S`
+// output of a family to byComment, and returns those not in it yet
+func parseIptablesRules(family iptablesFamily, output io.Reader, byComment map[string][]iptablesSpec) ([]FirewallRule, error) {
+	var rules []FirewallRule
+	err := lines.Scan(output, func(line string) {
+		m := iptablesCommentRegex.FindStringSubmatch(line)
+		args := splitIptablesLine(line)
+		if m == nil || len(args) < 2 || args[0] != "-A" {
+			return
+		}
+		rule := parseRuleComment(m[1])
+		comment := ruleComment(rule)
+		if len(byComment[comment]) == 0 {
+			rules = append(rules, rule)
+		}
+		byComment[comment] = append(byComment[comment], iptablesSpec{family: family, args: args[2:]})
+	})
+	return rules, err
+}
+
+// splitIptablesLine splits a line of `iptables -S` output into arguments;
+// only comments are quoted
+func splitIptablesLine(line string) []string {
+	var args []string
+	var current strings.Builder
+	quoted, inArg := false, false
+	for _, c := range strings.TrimSpace(line) {
+		switch {
+		case c == '"':
+			quoted, inArg = !quoted, true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// GetRules returns the rules added by the agent
+func (b *IptablesBackend) GetRules(ctx context.Context) ([]FirewallRule, error) {
+	_, rules, _, err := b.list(ctx)
+	return rules, err
+}
+
+// specs returns the iptables rules that make up rule: one per protocol for
+// a rule with ports but no protocol, in each family its addresses allow
+func (b *IptablesBackend) specs(rule FirewallRule) ([]iptablesSpec, error) {
+	if err := inboundOnly(b.Name(), rule); err != nil {
+		return nil, err
+	}
+	r := exported(rule)
+	only := ruleFamily(r)
+	comment := ruleComment(rule)
+
+	var specs []iptablesSpec
+	for _, family := range b.families {
+		if only != "" && only != family.name {
+			continue
+		}
+		for _, protocol := range exportProtocols(r) {
+			args := append(iptablesMatch(r, protocol), "-m", "comment", "--comment", comment, "-j", "ACCEPT")
+			specs = append(specs, iptablesSpec{family: family, args: args})
+		}
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("cannot apply IPv6 rule %s without ip6tables", rule)
+	}
+	return specs, nil
+}
+
+// AddRule adds a rule unless it is already applied. Its iptables rules go
+// after the chain's base rules, ahead of the final drop. A missing chain is
+// created first, and only jumped to once the rule is in it.
+func (b *IptablesBackend) AddRule(ctx context.Context, rule FirewallRule) error {
+	byComment, _, present, err := b.list(ctx)
+	if err != nil {
+		return err
+	}
+	if len(byComment[ruleComment(rule)]) > 0 {
+		return nil
+	}
+	specs, err := b.specs(rule)
+	if err != nil {
+		return err
+	}
+
+	for i, spec := range specs {
+		if !present[spec.family.name] {
+			if err := b.createChain(ctx, spec.family); err != nil {
+				return err
+			}
+			present[spec.family.name] = true
+		}
+		position := fmt.Sprint(iptablesBaseRules + 1)
+		if _, err := b.run(ctx, spec.family, append([]string{"-I", b.chain, position}, spec.args...)...); err != nil {
+			// Leave no half-applied rule behind
+			for _, added := range specs[:i] {
+				b.run(ctx, added.family, append([]string{"-D", b.chain}, added.args...)...)
+			}
+			return err
+		}
+	}
+	for _, spec := range specs {
+		if err := b.ensureJump(ctx, spec.family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveRule removes a rule; removing a rule that is not applied is not an
+// error
+func (b *IptablesBackend) RemoveRule(ctx context.Context, rule FirewallRule) error {
+	byComment, _, _, err := b.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, applied := range byComment[ruleComment(rule)] {
+		if _, err := b.run(ctx, applied.family, append([]string{"-D", b.chain}, applied.args...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload restores the jump to the agent's chain where the chain exists. A
+// chain that was removed, e.g. by a flush, is recreated along with its
+// rules by the next sync.
+func (b *IptablesBackend) Reload(ctx context.Context) error {
+	_, _, present, err := b.list(ctx)
+	if err != nil {
+		return err
+	}
+	for _, family := range b.families {
+		if present[family.name] {
+			if err := b.ensureJump(ctx, family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Status returns the agent's chain in each family with packet counters
+func (b *IptablesBackend) Status(ctx context.Context) (string, error) {
+	var status strings.Builder
+	for _, family := range b.families {
+		output, err := b.run(ctx, family, "-L", b.chain, "-n", "-v")
+		if err != nil && iptablesMissing(err) {
+			fmt.Fprintf(&status, "%s:\nchain %s not created, no rule applied\n", family.binary, b.chain)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get iptables status: %w", err)
+		}
+		fmt.Fprintf(&status, "%s:\n%s\n", family.binary, output)
+	}
+	return status.String(), nil
+}
@@ -0,0 +1,114 @@
+package collectors
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitIptablesLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{
+			name: "unquoted",
+			line: "-A LSH-AGENT -p tcp -m tcp --dport 22 -j ACCEPT",
+			want: []string{"-A", "LSH-AGENT", "-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "ACCEPT"},
+		},
+		{
+			name: "quoted comment",
+			line: `-A LSH-AGENT -m comment --comment "lsh-agent from=any proto=tcp port=22" -j ACCEPT`,
+			want: []string{"-A", "LSH-AGENT", "-m", "comment", "--comment", "lsh-agent from=any proto=tcp port=22", "-j", "ACCEPT"},
+		},
+		{
+			name: "surrounding and repeated spaces",
+			line: "  -N   LSH-AGENT  ",
+			want: []string{"-N", "LSH-AGENT"},
+		},
+		{
+			name: "empty quoted argument",
+			line: `-A LSH-AGENT -m comment --comment "" -j ACCEPT`,
+			want: []string{"-A", "LSH-AGENT", "-m", "comment", "--comment", "", "-j", "ACCEPT"},
+		},
+		{
+			name: "empty line",
+			line: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitIptablesLine(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitIptablesLine(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIptablesRules(t *testing.T) {
+	ip := iptablesFamily{name: "ip", binary: "iptables", icmp: "icmp"}
+	ip6 := iptablesFamily{name: "ip6", binary: "ip6tables", icmp: "ipv6-icmp"}
+
+	v4 := `-N LSH-AGENT
+-A LSH-AGENT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A LSH-AGENT -m conntrack --ctstate INVALID -j DROP
+-A LSH-AGENT -i lo -j ACCEPT
+-A LSH-AGENT -p icmp -j ACCEPT
+-A LSH-AGENT -p tcp -m tcp --dport 22 -m comment --comment "lsh-agent from=any proto=tcp port=22" -j ACCEPT
+-A LSH-AGENT -s 10.0.0.0/8 -p udp -m comment --comment "lsh-agent from=10.0.0.0/8 proto=udp port=any" -j ACCEPT
+-A LSH-AGENT -d 10.1.0.1/32 -i eth1 -p tcp -m multiport --dports 53,6000:6007 -m comment --comment "lsh-agent from=any proto=tcp port=53,6000:6007 iface=eth1 to=10.1.0.1" -j ACCEPT
+-A LSH-AGENT -p tcp -m tcp --dport 80 -m comment --comment "added by hand" -j ACCEPT
+-A LSH-AGENT -p tcp -m tcp --dport 443 -j ACCEPT
+-A LSH-AGENT -j DROP
+`
+	v6 := `-N LSH-AGENT
+-A LSH-AGENT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A LSH-AGENT -p tcp -m tcp --dport 22 -m comment --comment "lsh-agent from=any proto=tcp port=22" -j ACCEPT
+-A LSH-AGENT -s 2001:db8::/32 -p tcp -m tcp --dport 6000 -m comment --comment "lsh-agent from=2001:db8::/32 proto=any port=6000" -j ACCEPT
+-A LSH-AGENT -s 2001:db8::/32 -p udp -m udp --dport 6000 -m comment --comment "lsh-agent from=2001:db8::/32 proto=any port=6000" -j ACCEPT
+-A LSH-AGENT -p ipv6-icmp -m comment --comment "managed elsewhere" -j ACCEPT
+-A LSH-AGENT -j DROP
+`
+
+	byComment := make(map[string][]iptablesSpec)
+	rules, err := parseIptablesRules(ip, strings.NewReader(v4), byComment)
+	if err != nil {
+		t.Fatalf("parseIptablesRules(v4) error = %v", err)
+	}
+	wantV4 := []FirewallRule{
+		{From: "any", Protocol: "tcp", Port: "22"},
+		{From: "10.0.0.0/8", Protocol: "udp", Port: "any"},
+		{From: "any", Protocol: "tcp", Port: "53,6000:6007", Interface: "eth1", To: "10.1.0.1"},
+	}
+	if !reflect.DeepEqual(rules, wantV4) {
+		t.Errorf("v4 rules = %+v, want %+v", rules, wantV4)
+	}
+
+	// A rule already found in IPv4 is not returned again, but its IPv6
+	// copy is kept so removing it removes both
+	rules, err = parseIptablesRules(ip6, strings.NewReader(v6), byComment)
+	if err != nil {
+		t.Fatalf("parseIptablesRules(v6) error = %v", err)
+	}
+	wantV6 := []FirewallRule{{From: "2001:db8::/32", Protocol: "any", Port: "6000"}}
+	if !reflect.DeepEqual(rules, wantV6) {
+		t.Errorf("v6 rules = %+v, want %+v", rules, wantV6)
+	}
+
+	ssh := "lsh-agent from=any proto=tcp port=22"
+	wantSSH := []iptablesSpec{
+		{family: ip, args: []string{"-p", "tcp", "-m", "tcp", "--dport", "22", "-m", "comment", "--comment", ssh, "-j", "ACCEPT"}},
+		{family: ip6, args: []string{"-p", "tcp", "-m", "tcp", "--dport", "22", "-m", "comment", "--comment", ssh, "-j", "ACCEPT"}},
+	}
+	if !reflect.DeepEqual(byComment[ssh], wantSSH) {
+		t.Errorf("specs of %q = %+v, want %+v", ssh, byComment[ssh], wantSSH)
+	}
+	if specs := byComment["lsh-agent from=2001:db8::/32 proto=any port=6000"]; len(specs) != 2 {
+		t.Errorf("got %d specs for the rule split by protocol, want 2", len(specs))
+	}
+	if len(byComment) != 4 {
+		t.Errorf("got %d comments, want 4: foreign rules must be left out", len(byComment))
+	}
+}
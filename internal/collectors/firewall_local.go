@@ -0,0 +1,64 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetLocalRules sets rules the agent manages itself, such as those of
+// workload profiles. Synchronization keeps them in addition to the API rules
+// instead of removing them as unknown.
+func (fc *FirewallCollector) SetLocalRules(rules []FirewallRule) {
+	fc.localMu.Lock()
+	defer fc.localMu.Unlock()
+	fc.localRules = append([]FirewallRule(nil), rules...)
+}
+
+// withLocalRules appends the local rules missing from rules
+func (fc *FirewallCollector) withLocalRules(rules []FirewallRule) []FirewallRule {
+	fc.localMu.Lock()
+	defer fc.localMu.Unlock()
+
+	seen := fc.rulesToSet(rules)
+	for _, rule := range fc.localRules {
+		key := fc.keyFor(rule)
+		if _, ok := seen[key]; !ok {
+			seen[key] = rule
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ApplyRules adds and removes rules as a single change. If any fails, the
+// changes already made are reverted so the firewall is left as it was.
+// The changes take effect without reloading.
+func (fc *FirewallCollector) ApplyRules(ctx context.Context, add, remove []FirewallRule) error {
+	var changes []RuleChange
+	for _, rule := range add {
+		changes = append(changes, RuleChange{Rule: rule})
+	}
+	for _, rule := range remove {
+		changes = append(changes, RuleChange{Rule: rule, Remove: true})
+	}
+	errs := fc.applyChanges(ctx, changes, true)
+
+	var cause error
+	var undo []RuleChange
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			undo = append(undo, changes[i].undo())
+		case cause == nil && i < len(add):
+			cause = fmt.Errorf("failed to add rule %s: %w", add[i], err)
+		case cause == nil:
+			cause = fmt.Errorf("failed to remove rule %s: %w", remove[i-len(add)], err)
+		}
+	}
+	if cause == nil {
+		return nil
+	}
+
+	fc.revert(ctx, undo)
+	return cause
+}
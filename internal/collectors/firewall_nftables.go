@@ -0,0 +1,352 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/timings"
+	"github.com/sirupsen/logrus"
+)
+
+// ruleCommentPrefix starts the comment of every rule the agent adds with
+// nftables or iptables, which carries the rule's fields so they are read
+// back without parsing match expressions
+const ruleCommentPrefix = "lsh-agent"
+
+// nftRuleRegex matches a rule added by the agent in `nft -a list` output:
+// its comment fields and handle
+var nftRuleRegex = regexp.MustCompile(`comment "` + ruleCommentPrefix + `([^"]*)" # handle ([0-9]+)$`)
+
+// NftablesBackend applies rules with the nft CLI, in a table of its own
+// whose input chain drops what the rules do not allow, like UFW's default
+// incoming policy. Established connections, loopback and ICMP are always
+// accepted. Other tables are left alone, but since a drop in any table is
+// final, they cannot allow traffic this table drops.
+type NftablesBackend struct {
+	binary         string
+	table          string
+	commandWrapper []string
+	mu             sync.Mutex
+	ready          bool
+	logger         *logrus.Logger
+}
+
+// NewNftablesBackend creates an nftables backend managing table in the inet
+// family
+func NewNftablesBackend(binary, table string, logger *logrus.Logger) *NftablesBackend {
+	return &NftablesBackend{
+		binary:         binary,
+		table:          table,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run nft with privileges, e.g.
+// "sudo" (the default) or "chroot /host" in container mode
+func (n *NftablesBackend) SetCommandWrapper(wrapper ...string) {
+	n.commandWrapper = wrapper
+}
+
+// Name identifies the backend
+func (n *NftablesBackend) Name() string {
+	return "nftables"
+}
+
+// nft runs an nft command, with script on standard input when set
+func (n *NftablesBackend) nft(ctx context.Context, script string, args ...string) ([]byte, error) {
+	defer timings.Since("nft", time.Now())
+	argv := append(append(append([]string{}, n.commandWrapper...), n.binary), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv, Stdin: script, Priority: true})
+	if err != nil {
+		return output, fmt.Errorf("nft command failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// nftMissing reports whether nft failed because the table or chain does
+// not exist
+func nftMissing(err error) bool {
+	return strings.Contains(err.Error(), "No such file or directory")
+}
+
+// setReady records whether the table and its input chain exist
+func (n *NftablesBackend) setReady(ready bool) {
+	n.mu.Lock()
+	n.ready = ready
+	n.mu.Unlock()
+}
+
+// tableScript returns the nft commands that create the table and its input
+// chain with the given policy, or nothing when they exist. They are only
+// run in the same transaction as the rules added to them, so the drop
+// policy never goes live without its allow rules.
+func (n *NftablesBackend) tableScript(policy string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", n.table)
+	b.WriteString("\tchain input {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook input priority filter; policy %s;\n", policy)
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tct state invalid drop\n")
+	b.WriteString("\t\tiifname \"lo\" accept\n")
+	b.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// apply runs an nft script, which creates the table first if it does not
+// exist
+func (n *NftablesBackend) apply(ctx context.Context, script string) error {
+	create := n.tableScript("drop")
+	if _, err := n.nft(ctx, create+script, "-f", "-"); err != nil {
+		return err
+	}
+	if create != "" {
+		n.logger.Infof("Created nftables table inet %s", n.table)
+		n.setReady(true)
+	}
+	return nil
+}
+
+// ruleComment encodes a rule's fields in its comment
+func ruleComment(rule FirewallRule) string {
+	r := exported(rule)
+	comment := ruleCommentPrefix + " from=" + r.From + " proto=" + r.Protocol + " port=" + r.Port
+	if r.Interface != "" {
+		comment += " iface=" + r.Interface
+	}
+	if r.To != "" {
+		comment += " to=" + r.To
+	}
+	return comment
+}
+
+// parseRuleComment decodes the rule from the fields of its comment, after
+// the prefix
+func parseRuleComment(fields string) FirewallRule {
+	var rule FirewallRule
+	for _, field := range strings.Fields(fields) {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "from":
+			rule.From = value
+		case "proto":
+			rule.Protocol = value
+		case "port":
+			rule.Port = value
+		case "iface":
+			rule.Interface = value
+		case "to":
+			rule.To = value
+		}
+	}
+	return rule
+}
+
+// list returns the rules added by the agent, and their handles keyed by
+// their comment. It never creates the table, so reads do not change the
+// firewall.
+func (n *NftablesBackend) list(ctx context.Context) (map[string][]string, []FirewallRule, error) {
+	output, err := n.nft(ctx, "", "-a", "list", "chain", "inet", n.table, "input")
+	if err != nil {
+		n.setReady(false)
+		// The table is only created along with the first rules, and may
+		// have been removed, e.g. by a flush of the ruleset; without it no
+		// rule is applied
+		if nftMissing(err) {
+			return map[string][]string{}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to list nftables rules: %w", err)
+	}
+	n.setReady(true)
+
+	byComment, rules := parseNftRules(string(output))
+	return byComment, rules, nil
+}
+
+// parseNftRules returns the rules added by the agent in `nft -a list`
+// output, and their handles keyed by their comment
+func parseNftRules(output string) (map[string][]string, []FirewallRule) {
+	byComment := make(map[string][]string)
+	var rules []FirewallRule
+	lines.Scan(strings.NewReader(output), func(line string) {
+		m := nftRuleRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			return
+		}
+		rule := parseRuleComment(m[1])
+		comment := ruleComment(rule)
+		if len(byComment[comment]) == 0 {
+			rules = append(rules, rule)
+		}
+		byComment[comment] = append(byComment[comment], m[2])
+	})
+	return byComment, rules
+}
+
+// GetRules returns the rules added by the agent
+func (n *NftablesBackend) GetRules(ctx context.Context) ([]FirewallRule, error) {
+	_, rules, err := n.list(ctx)
+	return rules, err
+}
+
+// addCommand returns the nft command that adds rule
+func (n *NftablesBackend) addCommand(rule FirewallRule) string {
+	return fmt.Sprintf("add rule inet %s input %s accept comment %q", n.table, nftMatch(exported(rule)), ruleComment(rule))
+}
+
+// deleteCommands returns the nft commands that delete every copy of rule
+func (n *NftablesBackend) deleteCommands(rule FirewallRule, byComment map[string][]string) []string {
+	var commands []string
+	for _, handle := range byComment[ruleComment(rule)] {
+		commands = append(commands, fmt.Sprintf("delete rule inet %s input handle %s", n.table, handle))
+	}
+	return commands
+}
+
+// AddRule adds a rule unless it is already applied
+func (n *NftablesBackend) AddRule(ctx context.Context, rule FirewallRule) error {
+	byComment, _, err := n.list(ctx)
+	if err != nil {
+		return err
+	}
+	if len(byComment[ruleComment(rule)]) > 0 {
+		return nil
+	}
+	if err := inboundOnly(n.Name(), rule); err != nil {
+		return err
+	}
+	return n.apply(ctx, n.addCommand(rule)+"\n")
+}
+
+// RemoveRule removes a rule; removing a rule that is not applied is not an
+// error
+func (n *NftablesBackend) RemoveRule(ctx context.Context, rule FirewallRule) error {
+	byComment, _, err := n.list(ctx)
+	if err != nil {
+		return err
+	}
+	commands := n.deleteCommands(rule, byComment)
+	if len(commands) == 0 {
+		return nil
+	}
+	_, err = n.nft(ctx, strings.Join(commands, "\n")+"\n", "-f", "-")
+	return err
+}
+
+// ApplyBatch applies the changes as a single atomic nft transaction. If
+// the transaction fails, the changes are applied one by one to find which
+// ones fail.
+func (n *NftablesBackend) ApplyBatch(ctx context.Context, changes []RuleChange, stopOnError bool) []error {
+	errs := make([]error, len(changes))
+	byComment, _, err := n.list(ctx)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	var script strings.Builder
+	wasReady := n.tableScript("drop") == ""
+	for i, change := range changes {
+		if change.Remove {
+			for _, line := range n.deleteCommands(change.Rule, byComment) {
+				script.WriteString(line + "\n")
+			}
+			delete(byComment, ruleComment(change.Rule))
+			continue
+		}
+		errs[i] = inboundOnly(n.Name(), change.Rule)
+		if errs[i] == nil && len(byComment[ruleComment(change.Rule)]) == 0 {
+			script.WriteString(n.addCommand(change.Rule) + "\n")
+		}
+	}
+	if script.Len() == 0 {
+		return errs
+	}
+	if err = n.apply(ctx, script.String()); err == nil {
+		return errs
+	}
+	n.logger.Warnf("nftables transaction failed, applying changes one by one: %v", err)
+
+	// A new table accepts until the rules that succeed are in, so one
+	// failing rule does not leave it dropping everything
+	if !wasReady {
+		if _, err := n.nft(ctx, n.tableScript("accept"), "-f", "-"); err != nil {
+			for i := range errs {
+				errs[i] = fmt.Errorf("failed to create nftables table %s: %w", n.table, err)
+			}
+			return errs
+		}
+		n.setReady(true)
+	}
+	added := false
+	for i, change := range changes {
+		if change.Remove {
+			errs[i] = n.RemoveRule(ctx, change.Rule)
+		} else {
+			errs[i] = n.AddRule(ctx, change.Rule)
+			added = added || errs[i] == nil
+		}
+		if errs[i] != nil && stopOnError {
+			for j := i + 1; j < len(changes); j++ {
+				errs[j] = errSkipped
+			}
+			break
+		}
+	}
+	if !wasReady {
+		n.finishTable(ctx, added)
+	}
+	return errs
+}
+
+// finishTable switches a table created to accept to the drop policy once
+// rules were added to it, and removes it when none were
+func (n *NftablesBackend) finishTable(ctx context.Context, added bool) {
+	script := fmt.Sprintf("chain inet %s input { type filter hook input priority filter; policy drop; }\n", n.table)
+	if !added {
+		script = fmt.Sprintf("delete table inet %s\n", n.table)
+	}
+	if _, err := n.nft(ctx, script, "-f", "-"); err != nil {
+		n.logger.Errorf("Failed to finish nftables table %s: %v", n.table, err)
+		return
+	}
+	if added {
+		n.logger.Infof("Created nftables table inet %s", n.table)
+	} else {
+		n.setReady(false)
+	}
+}
+
+// Reload checks whether the table still exists. If it was removed, e.g. by
+// a flush of the ruleset, no rule is applied and the next sync recreates
+// it along with its rules.
+func (n *NftablesBackend) Reload(ctx context.Context) error {
+	_, _, err := n.list(ctx)
+	return err
+}
+
+// Status returns the agent's nftables table
+func (n *NftablesBackend) Status(ctx context.Context) (string, error) {
+	output, err := n.nft(ctx, "", "list", "table", "inet", n.table)
+	if err != nil && nftMissing(err) {
+		return fmt.Sprintf("table inet %s not created, no rule applied\n", n.table), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get nftables status: %w", err)
+	}
+	return string(output), nil
+}
@@ -0,0 +1,145 @@
+package collectors
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNftRules(t *testing.T) {
+	output := `table inet lsh_firewall {
+	chain input { # handle 1
+		type filter hook input priority filter; policy drop;
+		ct state established,related accept # handle 2
+		ct state invalid drop # handle 3
+		iifname "lo" accept # handle 4
+		meta l4proto { icmp, ipv6-icmp } accept # handle 5
+		tcp dport 22 accept comment "lsh-agent from=any proto=tcp port=22" # handle 7
+		ip saddr 10.0.0.0/8 meta l4proto udp accept comment "lsh-agent from=10.0.0.0/8 proto=udp port=any" # handle 8
+		iifname "eth1" ip6 saddr 2001:db8::/32 ip6 daddr 2001:db8:1::1 meta l4proto { tcp, udp } th dport 6000-6007 accept comment "lsh-agent from=2001:db8::/32 proto=any port=6000:6007 iface=eth1 to=2001:db8:1::1" # handle 9
+		tcp dport 22 accept comment "lsh-agent from=any proto=tcp port=22" # handle 12
+		tcp dport 80 accept comment "added by hand" # handle 13
+		tcp dport 443 accept # handle 14
+	}
+}
+`
+	byComment, rules := parseNftRules(output)
+
+	wantRules := []FirewallRule{
+		{From: "any", Protocol: "tcp", Port: "22"},
+		{From: "10.0.0.0/8", Protocol: "udp", Port: "any"},
+		{From: "2001:db8::/32", Protocol: "any", Port: "6000:6007", Interface: "eth1", To: "2001:db8:1::1"},
+	}
+	if !reflect.DeepEqual(rules, wantRules) {
+		t.Errorf("rules = %+v, want %+v", rules, wantRules)
+	}
+	wantHandles := map[string][]string{
+		"lsh-agent from=any proto=tcp port=22":                                              {"7", "12"},
+		"lsh-agent from=10.0.0.0/8 proto=udp port=any":                                      {"8"},
+		"lsh-agent from=2001:db8::/32 proto=any port=6000:6007 iface=eth1 to=2001:db8:1::1": {"9"},
+	}
+	if !reflect.DeepEqual(byComment, wantHandles) {
+		t.Errorf("handles = %v, want %v", byComment, wantHandles)
+	}
+}
+
+func TestRuleCommentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rule FirewallRule
+		want FirewallRule
+	}{
+		{
+			name: "port from anywhere",
+			rule: FirewallRule{From: "any", Protocol: "tcp", Port: "22"},
+			want: FirewallRule{From: "any", Protocol: "tcp", Port: "22"},
+		},
+		{
+			name: "defaults are spelled out",
+			rule: FirewallRule{Protocol: "TCP", Port: "all"},
+			want: FirewallRule{From: "any", Protocol: "tcp", Port: "any"},
+		},
+		{
+			name: "port list and range",
+			rule: FirewallRule{From: "10.0.0.0/8", Protocol: "udp", Port: "53,6000:6007"},
+			want: FirewallRule{From: "10.0.0.0/8", Protocol: "udp", Port: "53,6000:6007"},
+		},
+		{
+			name: "tenant scope",
+			rule: FirewallRule{From: "2001:db8::/32", Protocol: "any", Port: "any", Interface: "eth1", To: "2001:db8:1::1"},
+			want: FirewallRule{From: "2001:db8::/32", Protocol: "any", Port: "any", Interface: "eth1", To: "2001:db8:1::1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comment := ruleComment(tt.rule)
+			fields, ok := strings.CutPrefix(comment, ruleCommentPrefix)
+			if !ok {
+				t.Fatalf("comment %q lacks the prefix", comment)
+			}
+			got := parseRuleComment(fields)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRuleComment(%q) = %+v, want %+v", fields, got, tt.want)
+			}
+			if again := ruleComment(got); again != comment {
+				t.Errorf("comment changed on round trip: %q, want %q", again, comment)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  FirewallRule
+		valid bool
+	}{
+		{name: "port from anywhere", rule: FirewallRule{From: "any", Protocol: "tcp", Port: "22"}, valid: true},
+		{name: "defaults", rule: FirewallRule{}, valid: true},
+		{name: "IPv4 CIDR and port list", rule: FirewallRule{From: "10.0.0.0/8", Protocol: "udp", Port: "53,6000:6007"}, valid: true},
+		{name: "IPv6 address", rule: FirewallRule{From: "2001:db8::1", Protocol: "TCP", Port: "all"}, valid: true},
+		{name: "scoped", rule: FirewallRule{From: "any", Interface: "eth1.100", To: "10.1.0.1"}, valid: true},
+		{name: "newline in the address", rule: FirewallRule{From: "10.0.0.1\nflush ruleset\n", Protocol: "tcp", Port: "22"}},
+		{name: "space in the address", rule: FirewallRule{From: "10.0.0.1 proto=udp", Protocol: "tcp", Port: "22"}},
+		{name: "hostname", rule: FirewallRule{From: "example.com", Protocol: "tcp", Port: "22"}},
+		{name: "newline in the port", rule: FirewallRule{From: "any", Protocol: "tcp", Port: "22\nflush ruleset"}},
+		{name: "named port", rule: FirewallRule{From: "any", Protocol: "tcp", Port: "ssh"}},
+		{name: "unknown protocol", rule: FirewallRule{From: "any", Protocol: "tcp accept", Port: "22"}},
+		{name: "local address", rule: FirewallRule{From: "any", To: "10.1.0.1;"}},
+		{name: "interface with a quote", rule: FirewallRule{From: "any", Interface: `eth0" accept`}},
+		{name: "interface too long", rule: FirewallRule{From: "any", Interface: "abcdefghijklmnop"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if tt.valid && err != nil {
+				t.Errorf("validate() error = %v, want none", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("validate() accepted an invalid rule")
+			}
+		})
+	}
+}
+
+func TestDiffRulesRejectsInvalidRules(t *testing.T) {
+	fc := newFakeCollector(&fakeBackend{})
+	api := `[
+		{"from": "10.0.0.1\nflush ruleset\n", "protocol": "tcp", "port": "22"},
+		{"from": "any", "protocol": "tcp", "port": "22 accept"},
+		{"from": "any", "protocol": "tcp", "port": "443"}
+	]`
+	diff, err := fc.diffRules(context.Background(), `{"firewall": {"rules": `+api+`}}`)
+	if err != nil {
+		t.Fatalf("diffRules() error = %v", err)
+	}
+	if want := []string{"From: any, Protocol: tcp, Port: 443"}; !reflect.DeepEqual(ruleStrings(diff.add), want) {
+		t.Errorf("add = %v, want %v", ruleStrings(diff.add), want)
+	}
+	if len(diff.remove) != 0 {
+		t.Errorf("remove = %v, want none", ruleStrings(diff.remove))
+	}
+}
@@ -0,0 +1,49 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Plan is what synchronizing with the API rules would change, computed
+// without touching UFW
+type Plan struct {
+	Add    []FirewallRule `json:"add"`
+	Remove []FirewallRule `json:"remove"`
+	// Keep are the current UFW rules that already match the API
+	Keep []FirewallRule `json:"keep"`
+}
+
+// PlanFirewallRules returns the changes SyncFirewallRules would make, along
+// with the rules it would keep. Each list is sorted by the rules' string
+// form.
+func (fc *FirewallCollector) PlanFirewallRules(ctx context.Context, apiRulesJSON string) (*Plan, error) {
+	diff, err := fc.diffRules(ctx, apiRulesJSON)
+	if err != nil {
+		return nil, err
+	}
+	add, remove := diff.add, diff.remove
+	current, err := fc.GetCurrentRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current UFW rules: %w", err)
+	}
+
+	removed := fc.rulesToSet(remove)
+	plan := &Plan{Add: add, Remove: remove, Keep: []FirewallRule{}}
+	for _, rule := range current {
+		if _, ok := removed[fc.keyFor(rule)]; !ok && fc.inScope(rule) {
+			plan.Keep = append(plan.Keep, rule)
+		}
+	}
+	if plan.Add == nil {
+		plan.Add = []FirewallRule{}
+	}
+	if plan.Remove == nil {
+		plan.Remove = []FirewallRule{}
+	}
+	for _, rules := range [][]FirewallRule{plan.Add, plan.Remove, plan.Keep} {
+		sort.Slice(rules, func(i, j int) bool { return rules[i].String() < rules[j].String() })
+	}
+	return plan, nil
+}
@@ -0,0 +1,197 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// policySettings lists the settings of a firewall policy in the order
+// they are applied
+var policySettings = []string{"logging", "incoming", "outgoing", "routed"}
+
+// policyValues lists the values each setting accepts
+var policyValues = map[string][]string{
+	"logging":  {"off", "on", "low", "medium", "high", "full"},
+	"incoming": {"allow", "deny", "reject"},
+	"outgoing": {"allow", "deny", "reject"},
+	"routed":   {"allow", "deny", "reject"},
+}
+
+// FirewallPolicy is the firewall's default policy for each direction of
+// traffic and its logging level. Empty settings are left as they are.
+type FirewallPolicy struct {
+	Incoming string `json:"incoming,omitempty"`
+	Outgoing string `json:"outgoing,omitempty"`
+	Routed   string `json:"routed,omitempty"`
+	Logging  string `json:"logging,omitempty"`
+}
+
+// get returns a setting of the policy
+func (p FirewallPolicy) get(setting string) string {
+	switch setting {
+	case "incoming":
+		return p.Incoming
+	case "outgoing":
+		return p.Outgoing
+	case "routed":
+		return p.Routed
+	case "logging":
+		return normalizeLogging(p.Logging)
+	}
+	return ""
+}
+
+// normalizeLogging returns a UFW logging level as UFW reports it: "on" is
+// the low level
+func normalizeLogging(level string) string {
+	if level == "on" {
+		return "low"
+	}
+	return level
+}
+
+// PolicyChange is a policy setting to change
+type PolicyChange struct {
+	Setting string `json:"setting"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// String describes the change for logging
+func (c PolicyChange) String() string {
+	from := c.From
+	if from == "" {
+		from = "unknown"
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Setting, from, c.To)
+}
+
+// risky reports whether the change can cut off access to the server: a
+// direction of traffic no longer allowed by default
+func (c PolicyChange) risky() bool {
+	return c.Setting != "logging" && c.To != "allow"
+}
+
+// PolicyBackend is implemented by backends whose default policies and
+// logging level can be changed
+type PolicyBackend interface {
+	GetPolicy(ctx context.Context) (FirewallPolicy, error)
+	// SetPolicy changes a setting: "logging", "incoming", "outgoing" or
+	// "routed"
+	SetPolicy(ctx context.Context, setting, value string) error
+}
+
+// apiPolicy returns the policy in an API response, or nil when it has none
+func apiPolicy(apiRulesJSON string) (*FirewallPolicy, error) {
+	var response struct {
+		Firewall struct {
+			Policy *FirewallPolicy `json:"policy"`
+		} `json:"firewall"`
+	}
+	if err := json.Unmarshal([]byte(apiRulesJSON), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse API rules JSON: %w", err)
+	}
+	policy := response.Firewall.Policy
+	if policy == nil {
+		return nil, nil
+	}
+	for _, setting := range policySettings {
+		value := policy.get(setting)
+		if value != "" && !slices.Contains(policyValues[setting], value) {
+			return nil, fmt.Errorf("invalid firewall policy %s %q, expected one of %s",
+				setting, value, strings.Join(policyValues[setting], ", "))
+		}
+	}
+	return policy, nil
+}
+
+// DiffFirewallPolicy returns the changes that make the firewall's policy
+// match the API's. It returns no changes when the API sets no policy or the
+// backend has none.
+func (fc *FirewallCollector) DiffFirewallPolicy(ctx context.Context, apiRulesJSON string) ([]PolicyChange, error) {
+	desired, err := apiPolicy(apiRulesJSON)
+	if err != nil || desired == nil {
+		return nil, err
+	}
+	backend, ok := fc.backend.(PolicyBackend)
+	if !ok {
+		fc.logger.Debugf("Ignoring the API firewall policy, %s has no default policies", fc.backend.Name())
+		return nil, nil
+	}
+	if err := fc.delay(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get %s policy: %w", fc.backend.Name(), err)
+	}
+	current, err := backend.GetPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []PolicyChange
+	for _, setting := range policySettings {
+		want, have := desired.get(setting), current.get(setting)
+		if want != "" && want != have {
+			changes = append(changes, PolicyChange{Setting: setting, From: have, To: want})
+		}
+	}
+	return changes, nil
+}
+
+// SyncFirewallPolicy makes the firewall's default policies and logging
+// level match the API's. If a change fails, those already made are
+// reverted. With a canary policy, changes that stop allowing a direction
+// of traffic are verified like risky rule changes and reverted when
+// verification fails. It returns the changes applied.
+func (fc *FirewallCollector) SyncFirewallPolicy(ctx context.Context, apiRulesJSON string, canary *CanaryPolicy) ([]PolicyChange, error) {
+	changes, err := fc.DiffFirewallPolicy(ctx, apiRulesJSON)
+	if err != nil || len(changes) == 0 {
+		return nil, err
+	}
+	if fc.readOnly {
+		return nil, ErrReadOnly
+	}
+	backend := fc.backend.(PolicyBackend)
+
+	var applied []PolicyChange
+	for _, change := range changes {
+		fc.logger.Infof("Changing firewall policy %s", change)
+		err := fc.delay(ctx)
+		if err == nil {
+			err = backend.SetPolicy(ctx, change.Setting, change.To)
+		}
+		if err != nil {
+			fc.revertPolicy(context.WithoutCancel(ctx), applied)
+			return nil, fmt.Errorf("failed to change firewall policy %s: %w", change, err)
+		}
+		applied = append(applied, change)
+	}
+
+	if canary != nil && slices.ContainsFunc(applied, PolicyChange.risky) {
+		fc.logger.Warn("Verifying firewall policy changes in canary mode as they stop allowing traffic by default")
+		if err := fc.verifyCanary(ctx, canary); err != nil {
+			fc.logger.Errorf("Canary verification failed, reverting firewall policy changes: %v", err)
+			fc.revertPolicy(context.WithoutCancel(ctx), applied)
+			return nil, fmt.Errorf("firewall policy changes reverted after canary verification failed: %w", err)
+		}
+		fc.logger.Info("Canary verification passed, keeping firewall policy changes")
+	}
+	return applied, nil
+}
+
+// revertPolicy undoes applied policy changes in reverse order, logging
+// those that fail. Settings whose previous value is unknown are left.
+func (fc *FirewallCollector) revertPolicy(ctx context.Context, applied []PolicyChange) {
+	backend := fc.backend.(PolicyBackend)
+	for i := len(applied) - 1; i >= 0; i-- {
+		change := applied[i]
+		if change.From == "" {
+			fc.logger.Warnf("Cannot revert firewall policy %s, its previous value is unknown", change)
+			continue
+		}
+		if err := backend.SetPolicy(ctx, change.Setting, change.From); err != nil {
+			fc.logger.Errorf("Failed to revert firewall policy %s: %v", change, err)
+		}
+	}
+}
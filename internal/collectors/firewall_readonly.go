@@ -0,0 +1,18 @@
+package collectors
+
+import "errors"
+
+// ErrReadOnly is returned for firewall changes attempted in read-only mode
+var ErrReadOnly = errors.New("firewall is in read-only mode, rules are not modified")
+
+// SetReadOnly makes the collector refuse every rule change, leaving only
+// status queries. It backs the compliance-only mode, where drift is
+// reported but never corrected.
+func (fc *FirewallCollector) SetReadOnly(readOnly bool) {
+	fc.readOnly = readOnly
+}
+
+// ReadOnly reports whether the collector refuses to change rules
+func (fc *FirewallCollector) ReadOnly() bool {
+	return fc.readOnly
+}
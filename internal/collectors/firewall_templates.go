@@ -0,0 +1,166 @@
+package collectors
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ruleVariableRegex matches a template variable in a rule value, e.g.
+// "{{private_vlan_cidr}}" or "{{ tag.office_cidr }}"
+var ruleVariableRegex = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_.-]+)\s*\}\}`)
+
+// RuleFacts are the values of the template variables rules can refer to,
+// discovered on the server. A variable may have several values, such as
+// the CIDRs of several private VLANs.
+type RuleFacts map[string][]string
+
+// SetFacts sets the source of the facts template variables in rule values
+// resolve to. It is called on every synchronization, so rules follow facts
+// that change, such as a VLAN being added. Without it, rules with template
+// variables are skipped.
+func (fc *FirewallCollector) SetFacts(facts func() RuleFacts) {
+	fc.facts = facts
+}
+
+// expandTemplates resolves the template variables in the From and Port of
+// rules. A rule is repeated for each value of its variables, and skipped
+// when one has no value on this server, so a single API ruleset can carry
+// rules that only apply to some servers.
+func (fc *FirewallCollector) expandTemplates(rules []FirewallRule) []FirewallRule {
+	var facts RuleFacts
+	expanded := make([]FirewallRule, 0, len(rules))
+	for _, rule := range rules {
+		if !ruleVariableRegex.MatchString(rule.From) && !ruleVariableRegex.MatchString(rule.Port) {
+			expanded = append(expanded, rule)
+			continue
+		}
+		if facts == nil {
+			facts = RuleFacts{}
+			if fc.facts != nil {
+				facts = fc.facts()
+			}
+		}
+
+		froms, missing := expandValue(rule.From, facts)
+		if missing == "" {
+			var ports []string
+			ports, missing = expandValue(rule.Port, facts)
+			for _, from := range froms {
+				for _, port := range ports {
+					resolved := rule
+					resolved.From, resolved.Port = from, port
+					expanded = append(expanded, resolved)
+				}
+			}
+		}
+		if missing != "" {
+			fc.logger.Debugf("Skipping rule %s: template variable %s has no value on this server", rule, missing)
+		}
+	}
+	return expanded
+}
+
+// expandValue returns the values a rule value with template variables
+// resolves to, or the name of a variable without a value
+func expandValue(value string, facts RuleFacts) ([]string, string) {
+	m := ruleVariableRegex.FindStringSubmatchIndex(value)
+	if m == nil {
+		return []string{value}, ""
+	}
+	name := value[m[2]:m[3]]
+	if len(facts[name]) == 0 {
+		return nil, name
+	}
+
+	// Expand the rest of the value once, then combine it with each value of
+	// the first variable
+	rests, missing := expandValue(value[m[1]:], facts)
+	if missing != "" {
+		return nil, missing
+	}
+	var values []string
+	for _, fact := range facts[name] {
+		for _, rest := range rests {
+			values = append(values, value[:m[0]]+fact+rest)
+		}
+	}
+	return values, ""
+}
+
+// HostFacts discovers the facts about this server that rules can refer to:
+//
+//   - hostname: the server's hostname
+//   - public_ip: the server's public IP
+//   - private_ip, private_cidr: private addresses on any interface, and
+//     their networks
+//   - private_vlan_cidr: the networks of private addresses on VLAN
+//     interfaces, e.g. Latitude.sh private networks
+//
+// rootDir is the host's root filesystem, "/" unless running in a container.
+func HostFacts(rootDir, publicIP string) RuleFacts {
+	facts := RuleFacts{}
+	if hostname := readHostname(rootDir); hostname != "" {
+		facts["hostname"] = []string{hostname}
+	}
+	if ip := net.ParseIP(publicIP); ip != nil {
+		facts["public_ip"] = []string{ip.String()}
+	}
+
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		vlan := isVLANInterface(iface.Name)
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsPrivate() {
+				continue
+			}
+			cidr := (&net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}).String()
+			facts["private_ip"] = appendFact(facts["private_ip"], ipNet.IP.String())
+			facts["private_cidr"] = appendFact(facts["private_cidr"], cidr)
+			if vlan {
+				facts["private_vlan_cidr"] = appendFact(facts["private_vlan_cidr"], cidr)
+			}
+		}
+	}
+	return facts
+}
+
+// appendFact adds value to a fact's values unless already present
+func appendFact(values []string, value string) []string {
+	if slices.Contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+// readHostname returns the host's hostname from /etc/hostname, falling back
+// to the kernel's when running on the host itself
+func readHostname(rootDir string) string {
+	if data, err := os.ReadFile(filepath.Join(rootDir, "etc/hostname")); err == nil {
+		if hostname := strings.TrimSpace(string(data)); hostname != "" {
+			return hostname
+		}
+	}
+	if rootDir == "/" {
+		hostname, _ := os.Hostname()
+		return hostname
+	}
+	return ""
+}
+
+// isVLANInterface reports whether the kernel reports an interface as a VLAN
+func isVLANInterface(name string) bool {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", name, "uevent"))
+	if err != nil {
+		return false
+	}
+	return slices.Contains(strings.Split(string(data), "\n"), "DEVTYPE=vlan")
+}
@@ -0,0 +1,42 @@
+package collectors
+
+import "path/filepath"
+
+// ruleScope limits the rules a collector manages to an interface, a
+// destination address or both. The zero scope manages unscoped rules.
+type ruleScope struct {
+	iface, to string
+}
+
+// ForTenant returns a collector for another firewall on a shared host. Its
+// rules are limited to traffic arriving on iface or addressed to to, which
+// may be an IP or CIDR, and it only diffs and removes UFW rules with that
+// scope, so firewalls do not touch each other's rules. Temporary rules are
+// tracked under the tenant's own state directory.
+func (fc *FirewallCollector) ForTenant(firewallID, iface, to string) *FirewallCollector {
+	tenant := &FirewallCollector{
+		caseSensitive: fc.caseSensitive,
+		ufw:           fc.ufw,
+		backend:       fc.backend,
+		scope:         ruleScope{iface: iface, to: to},
+		faults:        fc.faults,
+		readOnly:      fc.readOnly,
+		facts:         fc.facts,
+		logger:        fc.logger,
+	}
+	if fc.stateDir != "" {
+		tenant.stateDir = filepath.Join(fc.stateDir, "tenants", firewallID)
+	}
+	return tenant
+}
+
+// scoped returns rule limited to the collector's scope
+func (fc *FirewallCollector) scoped(rule FirewallRule) FirewallRule {
+	rule.Interface, rule.To = fc.scope.iface, fc.scope.to
+	return rule
+}
+
+// inScope reports whether a UFW rule belongs to the collector's scope
+func (fc *FirewallCollector) inScope(rule FirewallRule) bool {
+	return fc.keyFor(fc.scoped(rule)) == fc.keyFor(rule)
+}
@@ -0,0 +1,350 @@
+package collectors
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/timings"
+	"github.com/sirupsen/logrus"
+)
+
+// ufwBackend applies rules with UFW, or with a simulated UFW in mock mode
+type ufwBackend struct {
+	binary         string
+	commandWrapper []string
+	mock           *MockUFW
+	logger         *logrus.Logger
+}
+
+// newUFWBackend creates a UFW backend run through sudo
+func newUFWBackend(binary string, logger *logrus.Logger) *ufwBackend {
+	return &ufwBackend{
+		binary:         binary,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// Name identifies the backend
+func (u *ufwBackend) Name() string {
+	return "UFW"
+}
+
+// command builds a privileged UFW command with the given arguments
+func (u *ufwBackend) command(args ...string) command.Cmd {
+	argv := append(append(append([]string{}, u.commandWrapper...), u.binary), args...)
+	return command.Cmd{Argv: argv, Priority: true}
+}
+
+// run runs a UFW command and returns its combined output
+func (u *ufwBackend) run(ctx context.Context, args ...string) ([]byte, error) {
+	defer timings.Since("ufw", time.Now())
+	if u.mock != nil {
+		output, err := u.mock.Run(args)
+		return []byte(output), err
+	}
+	return command.CombinedOutput(ctx, u.command(args...))
+}
+
+// GetRules retrieves the current UFW rules
+func (u *ufwBackend) GetRules(ctx context.Context) ([]FirewallRule, error) {
+	defer timings.Since("ufw", time.Now())
+	if u.mock != nil {
+		output, _ := u.mock.Run([]string{"status"})
+		return parseUFWRules(strings.NewReader(output))
+	}
+
+	var rules []FirewallRule
+	err := command.Stream(ctx, u.command("status"), func(stdout io.Reader) error {
+		var err error
+		rules, err = parseUFWRules(stdout)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get UFW status: %w", err)
+	}
+	return rules, nil
+}
+
+// AddRule adds a single UFW rule
+func (u *ufwBackend) AddRule(ctx context.Context, rule FirewallRule) error {
+	output, err := u.run(ctx, addArgs(rule)...)
+	if err != nil {
+		return fmt.Errorf("UFW command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// RemoveRule removes a single UFW rule
+func (u *ufwBackend) RemoveRule(ctx context.Context, rule FirewallRule) error {
+	output, err := u.run(ctx, deleteArgs(rule)...)
+	if err != nil {
+		return fmt.Errorf("UFW delete command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// Reload reloads UFW. Rule changes made through allow and delete are live
+// without it.
+func (u *ufwBackend) Reload(ctx context.Context) error {
+	output, err := u.run(ctx, "reload")
+	if err != nil {
+		return fmt.Errorf("UFW reload failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// Status returns the numbered UFW status
+func (u *ufwBackend) Status(ctx context.Context) (string, error) {
+	if u.mock != nil {
+		return u.mock.Run([]string{"status", "numbered"})
+	}
+	output, err := command.Output(ctx, u.command("status", "numbered"))
+	if err != nil {
+		return "", fmt.Errorf("failed to get UFW status: %w", err)
+	}
+	return string(output), nil
+}
+
+// InsertLimitRule inserts a UFW rate-limit rule ahead of the allow rules.
+// UFW denies a source that opens 6 or more connections within 30 seconds.
+// UFW numbers IPv6 rules after all IPv4 rules, so a rule from an IPv6
+// source is prepended to the IPv6 rules instead.
+func (u *ufwBackend) InsertLimitRule(ctx context.Context, rule FirewallRule) error {
+	position := []string{"insert", "1"}
+	if addressFamily(rule.From) == "ip6" {
+		position = []string{"prepend"}
+	}
+	output, err := u.run(ctx, append(position, "limit",
+		"proto", strings.ToLower(rule.Protocol),
+		"from", rule.From,
+		"to", "any",
+		"port", rule.Port)...)
+	if err != nil {
+		return fmt.Errorf("UFW limit command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// DeleteLimitRule removes a UFW rate-limit rule added by InsertLimitRule
+func (u *ufwBackend) DeleteLimitRule(ctx context.Context, rule FirewallRule) error {
+	output, err := u.run(ctx, "delete", "limit",
+		"proto", strings.ToLower(rule.Protocol),
+		"from", rule.From,
+		"to", "any",
+		"port", rule.Port)
+	if err != nil {
+		return fmt.Errorf("UFW delete limit command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// ufwPortRegex matches the ports of a UFW rule: a port, a range or a list
+var ufwPortRegex = regexp.MustCompile(`^[0-9]+([:,][0-9]+)*$`)
+
+// parseUFWRules parses UFW status output into FirewallRule structs. Rules
+// may lack a port or protocol, and may be limited to an interface or a
+// local address. Outbound rules show their remote address and ports in the
+// "To" column, and their interface in the "From" column, e.g.:
+//
+//	22/tcp                     ALLOW       Anywhere                   # lsh-agent
+//	Anywhere                   ALLOW       10.0.0.0/8
+//	Anywhere/udp               ALLOW       10.0.0.0/8
+//	10.1.0.0/24 22/tcp on eth1 ALLOW IN    Anywhere
+//	10.2.0.0/16 443/tcp        ALLOW OUT   Anywhere
+//	Anywhere                   DENY OUT    Anywhere on eth0
+//	22/tcp                     ALLOW       2001:db8::/32
+//	22/tcp (v6)                ALLOW       Anywhere (v6)              # lsh-agent
+//
+// Rules the agent adds carry its comment. Other rules are Foreign, except
+// inbound allow rules to a port without a comment, which earlier agent
+// versions added untagged. UFW shows a rule from anywhere as an IPv4 and an
+// IPv6 rule, the latter marked "(v6)"; they are returned as a single rule.
+// An IPv6 rule from anywhere without its IPv4 twin is returned from "::/0".
+func parseUFWRules(output io.Reader) ([]FirewallRule, error) {
+	var rules, v6Any []FirewallRule
+	err := lines.Scan(output, func(line string) {
+		line, comment, _ := strings.Cut(line, " # ")
+		fields := strings.Fields(line)
+		v6 := slices.Contains(fields, "(v6)")
+		fields = slices.DeleteFunc(fields, func(field string) bool {
+			return field == "(v6)"
+		})
+		action := slices.IndexFunc(fields, func(field string) bool {
+			return field == "ALLOW" || field == "DENY"
+		})
+		if action < 1 || action == len(fields)-1 {
+			return
+		}
+		// Defaults are left empty, as in API rules
+		var rule FirewallRule
+		if fields[action] == "DENY" {
+			rule.Action = ActionDeny
+		}
+		target, source := fields[:action], fields[action+1:]
+		switch source[0] {
+		case "IN":
+			source = source[1:]
+		case "OUT":
+			rule.Direction = DirectionOut
+			source = source[1:]
+		}
+		if len(source) == 0 || source[0] == "FWD" {
+			return
+		}
+
+		// The interface of an inbound rule is shown after its destination,
+		// and that of an outbound rule after its source
+		withInterface := &target
+		if rule.Direction == DirectionOut {
+			withInterface = &source
+		}
+		if n := len(*withInterface); n >= 3 && (*withInterface)[n-2] == "on" {
+			rule.Interface = (*withInterface)[n-1]
+			*withInterface = (*withInterface)[:n-2]
+		}
+
+		// The destination is only shown when the rule has one, so a single
+		// field is either the ports or an address with all ports
+		address, portProto := "", ""
+		switch {
+		case len(target) == 2:
+			address, portProto = target[0], target[1]
+		case len(target) == 1 && isAddress(target[0]):
+			address, portProto = target[0], "Anywhere"
+		case len(target) == 1:
+			portProto = target[0]
+		default:
+			return
+		}
+
+		// Parse port and protocol; either may be absent, e.g. "Anywhere"
+		// for all ports of all protocols. Application profiles such as
+		// "OpenSSH" are not managed by the agent.
+		port, protocol, _ := strings.Cut(portProto, "/")
+		if port == "Anywhere" {
+			port = "any"
+		} else if !ufwPortRegex.MatchString(port) {
+			return
+		}
+		if protocol == "" {
+			protocol = "any"
+		}
+		rule.Port, rule.Protocol = port, protocol
+
+		// From is the remote address: the source of inbound rules and the
+		// destination of outbound ones
+		from, to := strings.Join(source, " "), address
+		if rule.Direction == DirectionOut {
+			from, to = to, from
+		}
+		if from == "Anywhere" || from == "" {
+			from = "any"
+		}
+		if to == "Anywhere" {
+			to = ""
+		}
+		rule.From, rule.To = from, to
+		comment = strings.TrimSpace(comment)
+		rule.Foreign = comment != ruleCommentPrefix && (comment != "" || !rule.inboundAllow() || rule.port() == "any")
+
+		// With an IPv6 local address, anywhere can only be IPv6
+		if v6 && rule.From == "any" && rule.To == "" {
+			v6Any = append(v6Any, rule)
+			return
+		}
+		rules = append(rules, rule)
+	})
+
+	// Twins are matched by key, so they merge however UFW writes their
+	// addresses
+	twins := make(map[ruleKey]bool, len(rules))
+	for _, rule := range rules {
+		twins[baseKey(rule)] = true
+	}
+	for _, rule := range v6Any {
+		if !twins[baseKey(rule)] {
+			rule.From = "::/0"
+			rules = append(rules, rule)
+		}
+	}
+	return rules, err
+}
+
+// isAddress reports whether s is an IP address or CIDR
+func isAddress(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// ufwDefaultRegex matches a default policy in `ufw status verbose`, e.g.
+// "deny (incoming)"
+var ufwDefaultRegex = regexp.MustCompile(`([a-z]+) \((incoming|outgoing|routed)\)`)
+
+// GetPolicy returns UFW's default policies and logging level from its
+// verbose status. Settings UFW does not report, e.g. while inactive, are
+// empty.
+func (u *ufwBackend) GetPolicy(ctx context.Context) (FirewallPolicy, error) {
+	output, err := u.run(ctx, "status", "verbose")
+	if err != nil {
+		return FirewallPolicy{}, fmt.Errorf("failed to get UFW status: %w, output: %s", err, string(output))
+	}
+
+	var policy FirewallPolicy
+	err = lines.Scan(bytes.NewReader(output), func(line string) {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		value = strings.TrimSpace(value)
+		switch name {
+		case "Logging":
+			// "on (low)" or "off"
+			policy.Logging = value
+			if level, ok := strings.CutPrefix(value, "on ("); ok {
+				policy.Logging = strings.TrimSuffix(level, ")")
+			}
+		case "Default":
+			for _, m := range ufwDefaultRegex.FindAllStringSubmatch(value, -1) {
+				switch m[2] {
+				case "incoming":
+					policy.Incoming = m[1]
+				case "outgoing":
+					policy.Outgoing = m[1]
+				case "routed":
+					policy.Routed = m[1]
+				}
+			}
+		}
+	})
+	if err != nil {
+		return FirewallPolicy{}, fmt.Errorf("failed to read UFW status: %w", err)
+	}
+	return policy, nil
+}
+
+// SetPolicy changes a default policy with `ufw default`, or the logging
+// level with `ufw logging`
+func (u *ufwBackend) SetPolicy(ctx context.Context, setting, value string) error {
+	args := []string{"default", value, setting}
+	if setting == "logging" {
+		args = []string{"logging", value}
+	}
+	output, err := u.run(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("UFW command failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
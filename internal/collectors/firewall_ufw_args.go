@@ -0,0 +1,48 @@
+package collectors
+
+// ruleArgs returns the UFW arguments that match rule. The remote address of
+// an outbound rule is its destination, and its local address the source.
+func ruleArgs(rule FirewallRule) []string {
+	direction := rule.direction()
+	args := []string{rule.action()}
+	if direction == DirectionOut || rule.Interface != "" {
+		args = append(args, direction)
+	}
+	if rule.Interface != "" {
+		args = append(args, "on", rule.Interface)
+	}
+	// UFW requires lowercase protocol names, and applies a rule without
+	// one to every protocol
+	if protocol := rule.protocol(); protocol != "any" {
+		args = append(args, "proto", protocol)
+	}
+	remote := rule.From
+	if remote == "" {
+		remote = "any"
+	}
+	local := rule.To
+	if local == "" {
+		local = "any"
+	}
+	if direction == DirectionOut {
+		args = append(args, "from", local, "to", remote)
+	} else {
+		args = append(args, "from", remote, "to", local)
+	}
+	if port := rule.port(); port != "any" {
+		args = append(args, "port", port)
+	}
+	return args
+}
+
+// addArgs returns the UFW arguments that add rule, tagged with the agent's
+// comment so it is told apart from rules added by hand
+func addArgs(rule FirewallRule) []string {
+	return append(ruleArgs(rule), "comment", ruleCommentPrefix)
+}
+
+// deleteArgs returns the UFW arguments that remove rule. UFW matches the
+// rule to delete regardless of its comment.
+func deleteArgs(rule FirewallRule) []string {
+	return append([]string{"delete"}, ruleArgs(rule)...)
+}
@@ -0,0 +1,286 @@
+package collectors
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ufwStatusHeader starts the output of `ufw status`
+const ufwStatusHeader = `Status: active
+
+To                         Action      From
+--                         ------      ----
+`
+
+func TestParseUFWRules(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []FirewallRule
+	}{
+		{
+			name: "port from anywhere",
+			line: "22/tcp                     ALLOW       Anywhere                   # lsh-agent",
+			want: []FirewallRule{{From: "any", Protocol: "tcp", Port: "22"}},
+		},
+		{
+			name: "port without protocol",
+			line: "8080                       ALLOW IN    Anywhere",
+			want: []FirewallRule{{From: "any", Protocol: "any", Port: "8080"}},
+		},
+		{
+			name: "all traffic from a CIDR",
+			line: "Anywhere                   ALLOW       10.0.0.0/8                 # lsh-agent",
+			want: []FirewallRule{{From: "10.0.0.0/8", Protocol: "any", Port: "any"}},
+		},
+		{
+			name: "all ports of a protocol",
+			line: "Anywhere/udp               ALLOW       10.0.0.0/8                 # lsh-agent",
+			want: []FirewallRule{{From: "10.0.0.0/8", Protocol: "udp", Port: "any"}},
+		},
+		{
+			name: "local address and interface",
+			line: "10.1.0.0/24 22/tcp on eth1 ALLOW IN    Anywhere                   # lsh-agent",
+			want: []FirewallRule{{From: "any", Protocol: "tcp", Port: "22", Interface: "eth1", To: "10.1.0.0/24"}},
+		},
+		{
+			name: "outbound allow",
+			line: "10.2.0.0/16 443/tcp        ALLOW OUT   Anywhere                   # lsh-agent",
+			want: []FirewallRule{{From: "10.2.0.0/16", Protocol: "tcp", Port: "443", Direction: DirectionOut}},
+		},
+		{
+			name: "outbound deny on an interface",
+			line: "Anywhere                   DENY OUT    Anywhere on eth0           # lsh-agent",
+			want: []FirewallRule{{From: "any", Protocol: "any", Port: "any", Direction: DirectionOut, Action: ActionDeny, Interface: "eth0"}},
+		},
+		{
+			name: "IPv6 source",
+			line: "22/tcp                     ALLOW       2001:db8::/32              # lsh-agent",
+			want: []FirewallRule{{From: "2001:db8::/32", Protocol: "tcp", Port: "22"}},
+		},
+		{
+			name: "port range and list",
+			line: "6000:6007/tcp              ALLOW       Anywhere\n80,443/tcp                 ALLOW       Anywhere",
+			want: []FirewallRule{
+				{From: "any", Protocol: "tcp", Port: "6000:6007"},
+				{From: "any", Protocol: "tcp", Port: "80,443"},
+			},
+		},
+		{
+			name: "all traffic from a CIDR added by hand",
+			line: "Anywhere                   ALLOW IN    10.0.0.0/8\nAnywhere/udp               ALLOW IN    192.168.0.0/16",
+			want: []FirewallRule{
+				{From: "10.0.0.0/8", Protocol: "any", Port: "any", Foreign: true},
+				{From: "192.168.0.0/16", Protocol: "udp", Port: "any", Foreign: true},
+			},
+		},
+		{
+			name: "deny added by hand",
+			line: "23/tcp                     DENY IN     Anywhere",
+			want: []FirewallRule{{From: "any", Protocol: "tcp", Port: "23", Action: ActionDeny, Foreign: true}},
+		},
+		{
+			name: "outbound rule added by hand",
+			line: "Anywhere                   ALLOW OUT   Anywhere on eth0",
+			want: []FirewallRule{{From: "any", Protocol: "any", Port: "any", Direction: DirectionOut, Interface: "eth0", Foreign: true}},
+		},
+		{
+			name: "rule with an operator's comment",
+			line: "22/tcp                     ALLOW IN    10.0.0.0/8                 # office VPN",
+			want: []FirewallRule{{From: "10.0.0.0/8", Protocol: "tcp", Port: "22", Foreign: true}},
+		},
+		{
+			name: "application profiles, limits and forwarding are skipped",
+			line: "OpenSSH                    ALLOW       Anywhere\n22/tcp                     LIMIT       Anywhere\nAnywhere on eth1           ALLOW FWD   Anywhere on eth0",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUFWRules(strings.NewReader(ufwStatusHeader + tt.line + "\n"))
+			if err != nil {
+				t.Fatalf("parseUFWRules() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUFWRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMockUFWRoundTrip(t *testing.T) {
+	mock := NewMockUFW()
+	rules := []FirewallRule{
+		{From: "any", Protocol: "tcp", Port: "22"},
+		{From: "10.2.0.0/16", Protocol: "tcp", Port: "443", Direction: DirectionOut},
+		{From: "any", Protocol: "any", Port: "any", Direction: DirectionOut, Action: ActionDeny, Interface: "eth0"},
+	}
+	for _, rule := range rules {
+		if _, err := mock.Run(addArgs(rule)); err != nil {
+			t.Fatalf("adding %s: %v", rule, err)
+		}
+	}
+	// Added by hand, without the agent's comment
+	if _, err := mock.Run([]string{"deny", "proto", "tcp", "from", "any", "to", "any", "port", "23"}); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := mock.Run([]string{"status"})
+	got, err := parseUFWRules(strings.NewReader(status))
+	if err != nil {
+		t.Fatalf("parseUFWRules() error = %v", err)
+	}
+	want := append(rules, FirewallRule{From: "any", Protocol: "tcp", Port: "23", Action: ActionDeny, Foreign: true})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+}
+
+func TestParseUFWRulesAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []FirewallRule
+	}{
+		{
+			name:  "IPv4 only",
+			lines: []string{"22/tcp                     ALLOW IN    Anywhere                   # lsh-agent"},
+			want:  []FirewallRule{{From: "any", Protocol: "tcp", Port: "22"}},
+		},
+		{
+			name:  "IPv6 only",
+			lines: []string{"22/tcp (v6)                ALLOW IN    Anywhere (v6)              # lsh-agent"},
+			want:  []FirewallRule{{From: "::/0", Protocol: "tcp", Port: "22"}},
+		},
+		{
+			name: "dual stack",
+			lines: []string{
+				"22/tcp                     ALLOW IN    Anywhere                   # lsh-agent",
+				"22/tcp (v6)                ALLOW IN    Anywhere (v6)              # lsh-agent",
+			},
+			want: []FirewallRule{{From: "any", Protocol: "tcp", Port: "22"}},
+		},
+		{
+			name: "dual stack on an interface",
+			lines: []string{
+				"Anywhere on eth1           ALLOW IN    Anywhere                   # lsh-agent",
+				"Anywhere (v6) on eth1      ALLOW IN    Anywhere (v6)              # lsh-agent",
+			},
+			want: []FirewallRule{{From: "any", Protocol: "any", Port: "any", Interface: "eth1"}},
+		},
+		{
+			name: "dual stack of different rules",
+			lines: []string{
+				"22/tcp                     ALLOW IN    Anywhere                   # lsh-agent",
+				"80/tcp (v6)                ALLOW IN    Anywhere (v6)              # lsh-agent",
+			},
+			want: []FirewallRule{
+				{From: "any", Protocol: "tcp", Port: "22"},
+				{From: "::/0", Protocol: "tcp", Port: "80"},
+			},
+		},
+		{
+			name: "IPv6 source",
+			lines: []string{
+				"22/tcp                     ALLOW IN    10.0.0.0/8                 # lsh-agent",
+				"22/tcp (v6)                ALLOW IN    2001:db8::/32              # lsh-agent",
+			},
+			want: []FirewallRule{
+				{From: "10.0.0.0/8", Protocol: "tcp", Port: "22"},
+				{From: "2001:db8::/32", Protocol: "tcp", Port: "22"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUFWRules(strings.NewReader(ufwStatusHeader + strings.Join(tt.lines, "\n") + "\n"))
+			if err != nil {
+				t.Fatalf("parseUFWRules() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUFWRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffRulesAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    []FirewallRule
+		api        string
+		wantAdd    []string
+		wantRemove []string
+	}{
+		{
+			name:    "dual stack matches",
+			current: []FirewallRule{{From: "any", Protocol: "tcp", Port: "22"}},
+			api:     `[{"from": "any", "protocol": "tcp", "port": "22"}]`,
+		},
+		{
+			name:    "IPv6 half is completed, not removed",
+			current: []FirewallRule{{From: "::/0", Protocol: "tcp", Port: "22"}},
+			api:     `[{"from": "any", "protocol": "tcp", "port": "22"}]`,
+			wantAdd: []string{"From: any, Protocol: tcp, Port: 22"},
+		},
+		{
+			name:    "IPv6 rule matches in any notation",
+			current: []FirewallRule{{From: "::/0", Protocol: "tcp", Port: "22"}},
+			api:     `[{"from": "0::0/0", "protocol": "TCP", "port": "22"}]`,
+		},
+		{
+			name:       "IPv6 rule the API dropped is removed",
+			current:    []FirewallRule{{From: "::/0", Protocol: "tcp", Port: "22"}},
+			api:        `[{"from": "any", "protocol": "tcp", "port": "80"}]`,
+			wantAdd:    []string{"From: any, Protocol: tcp, Port: 80"},
+			wantRemove: []string{"From: ::/0, Protocol: tcp, Port: 22"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := NewMockUFW()
+			for _, rule := range tt.current {
+				if _, err := mock.Run(addArgs(rule)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fc := NewFirewallCollector("ufw", false, testLogger())
+			fc.SetMock(mock)
+
+			diff, err := fc.diffRules(context.Background(), `{"firewall": {"rules": `+tt.api+`}}`)
+			if err != nil {
+				t.Fatalf("diffRules() error = %v", err)
+			}
+			if got := ruleStrings(diff.add); !reflect.DeepEqual(got, tt.wantAdd) {
+				t.Errorf("add = %v, want %v", got, tt.wantAdd)
+			}
+			if got := ruleStrings(diff.remove); !reflect.DeepEqual(got, tt.wantRemove) {
+				t.Errorf("remove = %v, want %v", got, tt.wantRemove)
+			}
+		})
+	}
+}
+
+// ruleStrings returns the string form of rules, nil for none
+func ruleStrings(rules []FirewallRule) []string {
+	var strs []string
+	for _, rule := range rules {
+		strs = append(strs, rule.String())
+	}
+	return strs
+}
+
+// testLogger returns a logger that discards its output
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
@@ -0,0 +1,62 @@
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ufwWatchMask selects the inotify events that mean a file in the UFW
+// configuration directory was written, replaced or removed. UFW rewrites
+// its rules files by renaming a temporary file over them.
+const ufwWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE
+
+// WatchUFWRules calls changed with the name of each rules file in dir, e.g.
+// /etc/ufw, that is modified, until the context is cancelled. Changes made
+// by the agent itself are reported too.
+func WatchUFWRules(ctx context.Context, dir string, changed func(name string)) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+	// A non-blocking descriptor is served by the runtime poller, so closing
+	// the file interrupts a pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+
+	if _, err := syscall.InotifyAddWatch(fd, dir, ufwWatchMask); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read inotify events: %w", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := min(nameStart+int(event.Len), n)
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if strings.HasSuffix(name, ".rules") {
+				changed(name)
+			}
+		}
+	}
+}
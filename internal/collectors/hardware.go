@@ -0,0 +1,280 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const hardwareHistoryFileName = "hardware-history.json"
+
+// Hardware metrics, per device
+const (
+	MetricTemperature          = "temperature_celsius"
+	MetricReallocatedSectors   = "reallocated_sectors"
+	MetricPendingSectors       = "pending_sectors"
+	MetricOfflineUncorrectable = "offline_uncorrectable"
+	MetricMediaErrors          = "media_errors"
+	MetricPercentageUsed       = "percentage_used"
+)
+
+// smartAttributes maps the ATA SMART attribute IDs tracked to their metrics
+var smartAttributes = map[int]string{
+	5:   MetricReallocatedSectors,
+	197: MetricPendingSectors,
+	198: MetricOfflineUncorrectable,
+}
+
+// failureCounters are the metrics that only grow as a drive degrades
+var failureCounters = []string{MetricReallocatedSectors, MetricPendingSectors, MetricOfflineUncorrectable, MetricMediaErrors}
+
+// minTrendSpan is how much history a slope needs before it is reported
+const minTrendSpan = 24 * time.Hour
+
+// hotDisk and temperatureRise are the disk temperature, in °C, and its
+// weekly rise that are worth a hint
+const (
+	hotDisk         = 60
+	temperatureRise = 3
+)
+
+// HardwareTrend is the current value of a hardware metric and how fast it
+// changes
+type HardwareTrend struct {
+	// Device is "cpu" or a disk name
+	Device  string  `json:"device"`
+	Metric  string  `json:"metric"`
+	Current float64 `json:"current"`
+	// SlopePerWeek is the least squares slope over the history, zero until
+	// it spans a day
+	SlopePerWeek float64 `json:"slope_per_week"`
+	Samples      int     `json:"samples"`
+}
+
+// HardwareReport represents hardware trends reported to the API
+type HardwareReport struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Trends    []HardwareTrend `json:"trends"`
+	// Hints suggest proactive action, e.g. replacing a drive whose
+	// reallocated sectors keep increasing
+	Hints  []string `json:"hints"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// hardwarePoint is a sample in the local history
+type hardwarePoint struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// HardwareCollector samples CPU and disk temperatures and SMART failure
+// counters, and keeps a short local history of them to derive trends
+type HardwareCollector struct {
+	stateDir       string
+	window         time.Duration
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewHardwareCollector creates a new hardware collector keeping window of
+// history
+func NewHardwareCollector(stateDir string, window time.Duration, logger *logrus.Logger) *HardwareCollector {
+	return &HardwareCollector{
+		stateDir:       stateDir,
+		window:         window,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run smartctl with privileges
+func (hc *HardwareCollector) SetCommandWrapper(wrapper ...string) {
+	hc.commandWrapper = wrapper
+}
+
+// Collect samples the hardware, adds the samples to the history and
+// returns the trends
+func (hc *HardwareCollector) Collect(ctx context.Context) (*HardwareReport, error) {
+	now := time.Now()
+	report := &HardwareReport{Timestamp: now, Trends: []HardwareTrend{}, Hints: []string{}}
+
+	samples := map[string]float64{}
+	if temperature, ok := cpuTemperature(); ok {
+		samples["cpu/"+MetricTemperature] = temperature
+	}
+	for _, disk := range readDisks() {
+		metrics, err := hc.smart(ctx, disk.Name)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", disk.Name, err))
+			continue
+		}
+		for metric, value := range metrics {
+			samples[disk.Name+"/"+metric] = value
+		}
+	}
+
+	history := map[string][]hardwarePoint{}
+	if err := state.Load(hc.stateDir, hardwareHistoryFileName, &history); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read hardware history: %w", err)
+	}
+	for key, points := range history {
+		// Drop samples past the window, and devices no longer present
+		start := sort.Search(len(points), func(i int) bool { return now.Sub(points[i].Time) <= hc.window })
+		if _, present := samples[key]; !present || start == len(points) {
+			delete(history, key)
+			continue
+		}
+		history[key] = points[start:]
+	}
+	for key, value := range samples {
+		history[key] = append(history[key], hardwarePoint{Time: now, Value: value})
+	}
+	if err := state.Save(hc.stateDir, hardwareHistoryFileName, history); err != nil {
+		return nil, fmt.Errorf("failed to save hardware history: %w", err)
+	}
+
+	keys := make([]string, 0, len(history))
+	for key := range history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		device, metric, _ := strings.Cut(key, "/")
+		points := history[key]
+		trend := HardwareTrend{
+			Device:       device,
+			Metric:       metric,
+			Current:      points[len(points)-1].Value,
+			SlopePerWeek: weeklySlope(points),
+			Samples:      len(points),
+		}
+		report.Trends = append(report.Trends, trend)
+		if hint := hardwareHint(trend); hint != "" {
+			report.Hints = append(report.Hints, hint)
+		}
+	}
+	return report, nil
+}
+
+// hardwareHint returns a suggestion for a trend that points to a failing
+// or overheating device, or ""
+func hardwareHint(trend HardwareTrend) string {
+	switch {
+	case slices.Contains(failureCounters, trend.Metric) && trend.SlopePerWeek > 0 && trend.Current > 0:
+		return fmt.Sprintf("%s: %s increasing by %.1f per week (now %.0f), consider replacing the drive",
+			trend.Device, strings.ReplaceAll(trend.Metric, "_", " "), trend.SlopePerWeek, trend.Current)
+	case trend.Metric == MetricTemperature && trend.Device != "cpu" && trend.Current >= hotDisk:
+		return fmt.Sprintf("%s: running at %.0f°C, check cooling", trend.Device, trend.Current)
+	case trend.Metric == MetricTemperature && trend.SlopePerWeek >= temperatureRise:
+		return fmt.Sprintf("%s: temperature rising by %.1f°C per week, check cooling", trend.Device, trend.SlopePerWeek)
+	}
+	return ""
+}
+
+// weeklySlope returns the least squares slope of the points per week, or
+// zero while they span less than minTrendSpan
+func weeklySlope(points []hardwarePoint) float64 {
+	if len(points) < 2 || points[len(points)-1].Time.Sub(points[0].Time) < minTrendSpan {
+		return 0
+	}
+	week := 7 * 24 * time.Hour
+	var sumX, sumY, sumXY, sumXX float64
+	for _, point := range points {
+		x := float64(point.Time.Sub(points[0].Time)) / float64(week)
+		sumX += x
+		sumY += point.Value
+		sumXY += x * point.Value
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// cpuTemperature returns the hottest CPU package or core temperature from
+// hwmon
+func cpuTemperature() (float64, bool) {
+	dirs, _ := filepath.Glob("/sys/class/hwmon/hwmon*")
+	hottest, found := 0.0, false
+	for _, dir := range dirs {
+		switch readSysString(filepath.Join(dir, "name")) {
+		case "coretemp", "k10temp", "zenpower":
+		default:
+			continue
+		}
+		inputs, _ := filepath.Glob(filepath.Join(dir, "temp*_input"))
+		for _, input := range inputs {
+			millidegrees, err := strconv.ParseFloat(readSysString(input), 64)
+			if err != nil {
+				continue
+			}
+			if celsius := millidegrees / 1000; !found || celsius > hottest {
+				hottest, found = celsius, true
+			}
+		}
+	}
+	return hottest, found
+}
+
+// smartOutput is the part of `smartctl -j` output read for trends
+type smartOutput struct {
+	Temperature struct {
+		Current *float64 `json:"current"`
+	} `json:"temperature"`
+	ATAAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value float64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMeHealth *struct {
+		MediaErrors    float64 `json:"media_errors"`
+		PercentageUsed float64 `json:"percentage_used"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// smart reads the temperature and failure counters of a disk with smartctl
+func (hc *HardwareCollector) smart(ctx context.Context, disk string) (map[string]float64, error) {
+	argv := append(append([]string{}, hc.commandWrapper...), "smartctl", "-j", "-A", "/dev/"+disk)
+	// smartctl sets bits of its exit status for disk problems while still
+	// printing the attributes, so the output is parsed regardless
+	output, runErr := command.Output(ctx, command.Cmd{Argv: argv})
+	var smart smartOutput
+	if err := json.Unmarshal(output, &smart); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("smartctl failed: %w", runErr)
+		}
+		return nil, fmt.Errorf("failed to parse smartctl output: %w", err)
+	}
+
+	metrics := map[string]float64{}
+	if smart.Temperature.Current != nil {
+		metrics[MetricTemperature] = *smart.Temperature.Current
+	}
+	for _, attribute := range smart.ATAAttributes.Table {
+		if metric, ok := smartAttributes[attribute.ID]; ok {
+			metrics[metric] = attribute.Raw.Value
+		}
+	}
+	if smart.NVMeHealth != nil {
+		metrics[MetricMediaErrors] = smart.NVMeHealth.MediaErrors
+		metrics[MetricPercentageUsed] = smart.NVMeHealth.PercentageUsed
+	}
+	return metrics, nil
+}
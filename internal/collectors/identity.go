@@ -0,0 +1,228 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const identityFileName = "identity.json"
+
+// PTRRecord is the reverse DNS of one public address
+type PTRRecord struct {
+	Address string   `json:"address"`
+	Names   []string `json:"names"`
+	// ForwardConfirmed is set when a PTR name resolves back to the address,
+	// which mail servers commonly require
+	ForwardConfirmed bool   `json:"forward_confirmed"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Identity is the server's name as seen by itself and by DNS
+type Identity struct {
+	Hostname string      `json:"hostname"`
+	FQDN     string      `json:"fqdn"`
+	PTR      []PTRRecord `json:"ptr"`
+}
+
+// IdentityReport represents an identity change reported to the API
+type IdentityReport struct {
+	Timestamp time.Time `json:"timestamp"`
+	Current   Identity  `json:"current"`
+	// Previous is nil on the first report
+	Previous *Identity `json:"previous,omitempty"`
+	Changes  []string  `json:"changes"`
+}
+
+// IdentityCollector tracks the hostname, FQDN and reverse DNS of the
+// server's public addresses
+type IdentityCollector struct {
+	stateDir string
+	staticIP string
+	resolver *net.Resolver
+	logger   *logrus.Logger
+}
+
+// NewIdentityCollector creates a new identity collector. staticIP, when set,
+// is checked in addition to the public addresses on local interfaces.
+func NewIdentityCollector(stateDir, staticIP string, logger *logrus.Logger) *IdentityCollector {
+	return &IdentityCollector{
+		stateDir: stateDir,
+		staticIP: staticIP,
+		resolver: net.DefaultResolver,
+		logger:   logger,
+	}
+}
+
+// Check reads the current identity and compares it with the last reported
+// one. It returns nil when nothing changed.
+func (ic *IdentityCollector) Check(ctx context.Context) (*IdentityReport, error) {
+	current, err := ic.identity(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous Identity
+	if err := state.Load(ic.stateDir, identityFileName, &previous); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read identity state: %w", err)
+		}
+		return &IdentityReport{Timestamp: time.Now(), Current: *current, Changes: []string{}}, nil
+	}
+
+	// Keep the last known PTR when a lookup fails, so a flaky resolver does
+	// not look like a change
+	for i, record := range current.PTR {
+		if record.Error == "" {
+			continue
+		}
+		for _, old := range previous.PTR {
+			if old.Address == record.Address {
+				current.PTR[i] = old
+			}
+		}
+	}
+
+	changes := diffIdentity(&previous, current)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	return &IdentityReport{Timestamp: time.Now(), Current: *current, Previous: &previous, Changes: changes}, nil
+}
+
+// MarkReported records the identity once the API has received the report,
+// so a failed report is retried on the next check
+func (ic *IdentityCollector) MarkReported(report *IdentityReport) error {
+	return state.Save(ic.stateDir, identityFileName, report.Current)
+}
+
+// identity resolves the hostname, FQDN and PTR records
+func (ic *IdentityCollector) identity(ctx context.Context) (*Identity, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hostname: %w", err)
+	}
+
+	identity := &Identity{Hostname: hostname, FQDN: hostname, PTR: []PTRRecord{}}
+	// Like hostname -f, the canonical name comes from /etc/hosts or DNS
+	if cname, err := ic.resolver.LookupCNAME(ctx, hostname); err == nil && cname != "" {
+		identity.FQDN = strings.TrimSuffix(cname, ".")
+	}
+
+	for _, address := range ic.publicAddresses() {
+		identity.PTR = append(identity.PTR, ic.lookupPTR(ctx, address))
+	}
+	return identity, nil
+}
+
+// publicAddresses returns the public unicast addresses on local interfaces
+func (ic *IdentityCollector) publicAddresses() []string {
+	seen := make(map[string]bool)
+	if ip := net.ParseIP(ic.staticIP); ip != nil {
+		seen[ip.String()] = true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		ic.logger.WithError(err).Warn("Failed to list interface addresses")
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+		seen[ipNet.IP.String()] = true
+	}
+
+	addresses := make([]string, 0, len(seen))
+	for address := range seen {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// lookupPTR resolves an address's PTR names and checks they resolve back
+func (ic *IdentityCollector) lookupPTR(ctx context.Context, address string) PTRRecord {
+	record := PTRRecord{Address: address, Names: []string{}}
+
+	names, err := ic.resolver.LookupAddr(ctx, address)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return record
+		}
+		record.Error = err.Error()
+		return record
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		record.Names = append(record.Names, name)
+
+		ips, err := ic.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.IP.String() == address {
+				record.ForwardConfirmed = true
+			}
+		}
+	}
+	sort.Strings(record.Names)
+	return record
+}
+
+// diffIdentity describes how the identity changed
+func diffIdentity(previous, current *Identity) []string {
+	var changes []string
+	if previous.Hostname != current.Hostname {
+		changes = append(changes, fmt.Sprintf("hostname changed from %s to %s", previous.Hostname, current.Hostname))
+	}
+	if previous.FQDN != current.FQDN {
+		changes = append(changes, fmt.Sprintf("FQDN changed from %s to %s", previous.FQDN, current.FQDN))
+	}
+
+	before := make(map[string]PTRRecord)
+	for _, record := range previous.PTR {
+		before[record.Address] = record
+	}
+	for _, record := range current.PTR {
+		old, ok := before[record.Address]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("new address %s with PTR %s", record.Address, ptrNames(record)))
+		case ptrNames(old) != ptrNames(record):
+			changes = append(changes, fmt.Sprintf("PTR for %s changed from %s to %s", record.Address, ptrNames(old), ptrNames(record)))
+		case old.ForwardConfirmed && !record.ForwardConfirmed:
+			changes = append(changes, fmt.Sprintf("PTR for %s no longer resolves back to the address", record.Address))
+		case !old.ForwardConfirmed && record.ForwardConfirmed:
+			changes = append(changes, fmt.Sprintf("PTR for %s now resolves back to the address", record.Address))
+		}
+		delete(before, record.Address)
+	}
+	var removed []string
+	for address := range before {
+		removed = append(removed, address)
+	}
+	sort.Strings(removed)
+	for _, address := range removed {
+		changes = append(changes, fmt.Sprintf("address %s removed", address))
+	}
+	return changes
+}
+
+// ptrNames formats the PTR names of a record for change descriptions
+func ptrNames(record PTRRecord) string {
+	if len(record.Names) == 0 {
+		return "(none)"
+	}
+	return strings.Join(record.Names, ",")
+}
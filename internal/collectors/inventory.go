@@ -0,0 +1,256 @@
+package collectors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// Inventory describes the host's operating system, hardware and network
+// interfaces
+type Inventory struct {
+	Hostname      string               `json:"hostname"`
+	OS            InventoryOS          `json:"os"`
+	Kernel        string               `json:"kernel"`
+	Architecture  string               `json:"architecture"`
+	CPU           InventoryCPU         `json:"cpu"`
+	MemoryTotalKB uint64               `json:"memory_total_kb"`
+	Interfaces    []InventoryInterface `json:"interfaces"`
+	Disks         []InventoryDisk      `json:"disks"`
+}
+
+// InventoryOS identifies the distribution from os-release
+type InventoryOS struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	PrettyName string `json:"pretty_name"`
+}
+
+// InventoryCPU summarizes the processors
+type InventoryCPU struct {
+	Model   string `json:"model"`
+	Sockets int    `json:"sockets"`
+	Cores   int    `json:"cores"`
+	Threads int    `json:"threads"`
+}
+
+// InventoryInterface is a network interface and its addresses
+type InventoryInterface struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac,omitempty"`
+	MTU       int      `json:"mtu"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+}
+
+// InventoryDisk is a whole block device
+type InventoryDisk struct {
+	Name       string `json:"name"`
+	Model      string `json:"model,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	SizeBytes  uint64 `json:"size_bytes"`
+	Rotational bool   `json:"rotational"`
+}
+
+// GetInventory reads the host inventory. rootDir is the root of the host
+// filesystem, "/" unless running in a container; /proc and /sys are read
+// directly, as the agent shares the host's namespaces.
+func GetInventory(rootDir string) (*Inventory, error) {
+	inventory := &Inventory{
+		Architecture: runtime.GOARCH,
+		Interfaces:   []InventoryInterface{},
+		Disks:        []InventoryDisk{},
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hostname: %w", err)
+	}
+	inventory.Hostname = hostname
+
+	inventory.Kernel = readSysString("/proc/sys/kernel/osrelease")
+
+	inventory.OS = readOSRelease(rootDir)
+	inventory.CPU = readCPUInfo()
+	if stats, err := GetSystemStats(); err == nil {
+		inventory.MemoryTotalKB = stats.MemTotalKB
+	}
+
+	interfaces, err := readInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	inventory.Interfaces = interfaces
+	inventory.Disks = readDisks()
+
+	return inventory, nil
+}
+
+// readOSRelease parses /etc/os-release, falling back to /usr/lib/os-release
+func readOSRelease(rootDir string) InventoryOS {
+	var release InventoryOS
+	parse := func(line string) {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			release.ID = value
+		case "NAME":
+			release.Name = value
+		case "VERSION_ID":
+			release.Version = value
+		case "PRETTY_NAME":
+			release.PrettyName = value
+		}
+	}
+
+	if err := lines.ScanFile(filepath.Join(rootDir, "/etc/os-release"), parse); err != nil {
+		lines.ScanFile(filepath.Join(rootDir, "/usr/lib/os-release"), parse)
+	}
+	return release
+}
+
+// readCPUInfo counts sockets, cores and threads in /proc/cpuinfo
+func readCPUInfo() InventoryCPU {
+	var cpu InventoryCPU
+	sockets := map[string]bool{}
+	cores := map[string]bool{}
+	var physicalID string
+	err := lines.ScanFile("/proc/cpuinfo", func(line string) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "processor":
+			cpu.Threads++
+		case "model name":
+			if cpu.Model == "" {
+				cpu.Model = value
+			}
+		case "physical id":
+			physicalID = value
+			sockets[value] = true
+		case "core id":
+			cores[physicalID+":"+value] = true
+		}
+	})
+	if err != nil {
+		return cpu
+	}
+	cpu.Sockets = len(sockets)
+	cpu.Cores = len(cores)
+	// Virtual machines and some architectures omit the topology fields
+	if cpu.Sockets == 0 {
+		cpu.Sockets = 1
+	}
+	if cpu.Cores == 0 {
+		cpu.Cores = cpu.Threads
+	}
+	return cpu
+}
+
+// readInterfaces lists network interfaces other than loopback
+func readInterfaces() ([]InventoryInterface, error) {
+	links, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+
+	interfaces := []InventoryInterface{}
+	for _, link := range links {
+		if link.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		iface := InventoryInterface{
+			Name:      link.Name,
+			MAC:       link.HardwareAddr.String(),
+			MTU:       link.MTU,
+			Up:        link.Flags&net.FlagUp != 0,
+			Addresses: []string{},
+		}
+		addrs, err := link.Addrs()
+		if err == nil {
+			for _, addr := range addrs {
+				iface.Addresses = append(iface.Addresses, addr.String())
+			}
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+// readDisks lists whole disks from /sys/block, skipping virtual devices
+func readDisks() []InventoryDisk {
+	disks := []InventoryDisk{}
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return disks
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") || strings.HasPrefix(name, "dm-") || strings.HasPrefix(name, "md") {
+			continue
+		}
+		dir := filepath.Join("/sys/block", name)
+		disk := InventoryDisk{
+			Name:       name,
+			Model:      readSysString(filepath.Join(dir, "device", "model")),
+			Serial:     readSysString(filepath.Join(dir, "device", "serial")),
+			Rotational: readSysString(filepath.Join(dir, "queue", "rotational")) == "1",
+		}
+		// The size is always in 512-byte sectors
+		if sectors, err := strconv.ParseUint(readSysString(filepath.Join(dir, "size")), 10, 64); err == nil {
+			disk.SizeBytes = sectors * 512
+		}
+		if disk.SizeBytes == 0 {
+			continue
+		}
+		disks = append(disks, disk)
+	}
+	sort.Slice(disks, func(i, j int) bool { return disks[i].Name < disks[j].Name })
+	return disks
+}
+
+// HardwareFingerprint returns a hash of the host's hardware identity: the
+// system UUID, when readable, and the MAC addresses of its physical network
+// interfaces. It changes when a disk image is booted on other hardware.
+func HardwareFingerprint() string {
+	parts := []string{readSysString("/sys/class/dmi/id/product_uuid")}
+	entries, _ := os.ReadDir("/sys/class/net")
+	for _, entry := range entries {
+		dir := filepath.Join("/sys/class/net", entry.Name())
+		// Only physical interfaces have a device
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			continue
+		}
+		parts = append(parts, readSysString(filepath.Join(dir, "address")))
+	}
+	sort.Strings(parts[1:])
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// readSysString reads a sysfs attribute, returning "" if it is missing
+func readSysString(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,119 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/sirupsen/logrus"
+)
+
+// minMemoryTestMB is the smallest region worth testing
+const minMemoryTestMB = 16
+
+// MemoryTestResult is the outcome of a memtester run
+type MemoryTestResult struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	SizeMB    uint64        `json:"size_mb"`
+	Loops     int           `json:"loops"`
+	Passed    bool          `json:"passed"`
+	// Failures are the tests that found errors, with memtester's
+	// description, e.g. "Random Value: FAILURE: 0x... != 0x... at offset
+	// 0x..."
+	Failures []string `json:"failures,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// MemoryTester runs memtester on a share of the free memory. Only memory
+// the kernel can spare is tested, so the host keeps running, but faulty
+// DIMMs usually show up without taking the server offline.
+type MemoryTester struct {
+	binary         string
+	fraction       float64
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewMemoryTester creates a new memory tester testing fraction of the
+// available memory
+func NewMemoryTester(binary string, fraction float64, logger *logrus.Logger) *MemoryTester {
+	return &MemoryTester{
+		binary:         binary,
+		fraction:       fraction,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run memtester with
+// privileges, which it needs to lock the tested memory
+func (mt *MemoryTester) SetCommandWrapper(wrapper ...string) {
+	mt.commandWrapper = wrapper
+}
+
+// Run tests the configured share of the available memory for loops
+// passes, until done or the context ends
+func (mt *MemoryTester) Run(ctx context.Context, loops int) *MemoryTestResult {
+	result := &MemoryTestResult{StartedAt: time.Now(), Loops: loops}
+	defer func() { result.Duration = time.Since(result.StartedAt) }()
+
+	stats, err := GetSystemStats()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.SizeMB = uint64(float64(stats.MemAvailKB)*mt.fraction) / 1024
+	if result.SizeMB < minMemoryTestMB {
+		result.Error = fmt.Sprintf("only %d MiB available to test", result.SizeMB)
+		return result
+	}
+
+	mt.logger.Infof("Testing %d MiB of memory with memtester, %d loops", result.SizeMB, loops)
+	argv := append(append([]string{}, mt.commandWrapper...), mt.binary, fmt.Sprintf("%dM", result.SizeMB), strconv.Itoa(loops))
+	output, runErr := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	result.Failures = parseMemtester(string(output))
+	switch {
+	case len(result.Failures) > 0:
+	case ctx.Err() != nil:
+		result.Error = "memory test did not finish in time"
+	case runErr != nil:
+		result.Error = fmt.Sprintf("memtester failed: %v: %s", runErr, lastLine(string(output)))
+	default:
+		result.Passed = true
+	}
+	return result
+}
+
+// parseMemtester returns the failures memtester reported. Each test prints
+// a line like "  Random Value        : ok" or, when it found errors,
+// "  Random Value        : FAILURE: 0x... != 0x... at offset 0x...".
+// The progress drawn with backspaces before the status is skipped.
+func parseMemtester(output string) []string {
+	var failures []string
+	lines.Scan(strings.NewReader(output), func(line string) {
+		name, status, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		if i := strings.Index(status, "FAILURE"); i >= 0 {
+			failures = append(failures, strings.TrimSpace(name)+": "+strings.TrimSpace(status[i:]))
+		}
+	})
+	return failures
+}
+
+// lastLine returns the last non-empty line of output
+func lastLine(output string) string {
+	var last string
+	lines.Scan(strings.NewReader(output), func(line string) {
+		if line = strings.TrimSpace(line); line != "" {
+			last = line
+		}
+	})
+	return last
+}
@@ -0,0 +1,331 @@
+package collectors
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockUFW simulates UFW in memory. It accepts the commands the firewall
+// collector runs and prints status in UFW's format, so the collector's
+// parsing and diffing run unchanged without root or a real firewall.
+type MockUFW struct {
+	mu       sync.Mutex
+	rules    []mockRule
+	limits   []FirewallRule
+	defaults map[string]string
+	logging  string
+}
+
+// mockRule is a simulated rule and its comment
+type mockRule struct {
+	rule    FirewallRule
+	comment string
+}
+
+// index returns the position of rule, -1 if it does not exist
+func (m *MockUFW) index(rule FirewallRule) int {
+	return slices.IndexFunc(m.rules, func(r mockRule) bool { return r.rule == rule })
+}
+
+// NewMockUFW returns a simulated UFW without rules, with Ubuntu's default
+// policies
+func NewMockUFW() *MockUFW {
+	return &MockUFW{
+		defaults: map[string]string{"incoming": "deny", "outgoing": "allow", "routed": "disabled"},
+		logging:  "low",
+	}
+}
+
+// Run runs a UFW command against the simulated state and returns its output
+func (m *MockUFW) Run(args []string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(args) == 0 {
+		return "", fmt.Errorf("ERROR: not enough args")
+	}
+	switch args[0] {
+	case "status":
+		if len(args) > 1 && args[1] == "verbose" {
+			return strings.Replace(m.status(false), "Status: active\n", "Status: active\n"+m.verbose(), 1), nil
+		}
+		return m.status(len(args) > 1 && args[1] == "numbered"), nil
+	case "default":
+		if len(args) != 3 || !slices.Contains(policyValues["incoming"], args[1]) || m.defaults[args[2]] == "" {
+			return "", fmt.Errorf("ERROR: Invalid syntax")
+		}
+		m.defaults[args[2]] = args[1]
+		return fmt.Sprintf("Default %s policy changed to '%s'\n", args[2], args[1]), nil
+	case "logging":
+		if len(args) != 2 || !slices.Contains(policyValues["logging"], args[1]) {
+			return "", fmt.Errorf("ERROR: Invalid syntax")
+		}
+		m.logging = normalizeLogging(args[1])
+		return "Logging " + args[1] + "\n", nil
+	case "reload":
+		return "Firewall reloaded\n", nil
+	case "allow", "deny":
+		rule, comment, err := parseMockRule(args)
+		if err != nil {
+			return "", err
+		}
+		if i := m.index(rule); i >= 0 {
+			if comment != "" && comment != m.rules[i].comment {
+				m.rules[i].comment = comment
+				return "Rule updated\n", nil
+			}
+			return "Skipping adding existing rule\n", nil
+		}
+		m.rules = append(m.rules, mockRule{rule: rule, comment: comment})
+		return "Rule added\n", nil
+	case "insert", "prepend":
+		limit := args[1:]
+		if args[0] == "insert" && len(args) > 1 {
+			limit = args[2:]
+		}
+		if len(limit) == 0 || limit[0] != "limit" {
+			return "", fmt.Errorf("ERROR: unsupported command: ufw %s", strings.Join(args, " "))
+		}
+		rule, _, err := parseMockRule(limit)
+		if err != nil {
+			return "", err
+		}
+		// IPv6 rules are numbered after the IPv4 ones
+		if args[0] == "insert" && args[1] == "1" && addressFamily(rule.From) == "ip6" {
+			return "", fmt.Errorf("ERROR: Invalid position '1'")
+		}
+		if !slices.Contains(m.limits, rule) {
+			m.limits = append(m.limits, rule)
+		}
+		return "Rule inserted\n", nil
+	case "delete":
+		if len(args) < 2 {
+			return "", fmt.Errorf("ERROR: not enough args")
+		}
+		rule, _, err := parseMockRule(args[1:])
+		if err != nil {
+			return "", err
+		}
+		if args[1] == "limit" {
+			i := slices.Index(m.limits, rule)
+			if i < 0 {
+				return "Could not delete non-existent rule\n", nil
+			}
+			m.limits = slices.Delete(m.limits, i, i+1)
+			return "Rule deleted\n", nil
+		}
+		i := m.index(rule)
+		if i < 0 {
+			return "Could not delete non-existent rule\n", nil
+		}
+		m.rules = slices.Delete(m.rules, i, i+1)
+		return "Rule deleted\n", nil
+	}
+	return "", fmt.Errorf("ERROR: unsupported command: ufw %s", strings.Join(args, " "))
+}
+
+// parseMockRule parses the arguments addArgs builds, from the action, and
+// returns the rule and its comment:
+// ACTION [in|out] [on IFACE] [proto P] from F to T [port X] [comment C]
+func parseMockRule(args []string) (FirewallRule, string, error) {
+	rule := FirewallRule{Protocol: "any", Port: "any"}
+	switch args[0] {
+	case "allow", "limit":
+	case "deny":
+		rule.Action = ActionDeny
+	default:
+		return rule, "", fmt.Errorf("ERROR: invalid token '%s'", args[0])
+	}
+	src, dst, comment := "any", "any", ""
+	for i := 1; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return rule, "", fmt.Errorf("ERROR: wrong number of arguments")
+		}
+		switch args[i] {
+		case "in", "out":
+			if args[i] == "out" {
+				rule.Direction = DirectionOut
+			}
+			if args[i+1] == "on" {
+				if i+2 >= len(args) {
+					return rule, "", fmt.Errorf("ERROR: wrong number of arguments")
+				}
+				rule.Interface = args[i+2]
+				i += 2
+			}
+		case "proto":
+			rule.Protocol = args[i+1]
+			i++
+		case "from":
+			if args[i+1] != "any" && !isAddress(args[i+1]) {
+				return rule, "", fmt.Errorf("ERROR: Bad source address")
+			}
+			src = args[i+1]
+			i++
+		case "to":
+			if args[i+1] != "any" && !isAddress(args[i+1]) {
+				return rule, "", fmt.Errorf("ERROR: Bad destination address")
+			}
+			dst = args[i+1]
+			i++
+		case "port":
+			rule.Port = args[i+1]
+			i++
+		case "comment":
+			comment = args[i+1]
+			i++
+		default:
+			return rule, "", fmt.Errorf("ERROR: invalid token '%s'", args[i])
+		}
+	}
+	// From is the remote address, To the local one
+	if rule.Direction == DirectionOut {
+		src, dst = dst, src
+	}
+	rule.From = src
+	if dst != "any" {
+		rule.To = dst
+	}
+	return rule, comment, nil
+}
+
+// verbose renders the header `ufw status verbose` adds: the logging level
+// and default policies
+func (m *MockUFW) verbose() string {
+	logging := "off"
+	if m.logging != "off" {
+		logging = "on (" + m.logging + ")"
+	}
+	return fmt.Sprintf("Logging: %s\nDefault: %s (incoming), %s (outgoing), %s (routed)\n",
+		logging, m.defaults["incoming"], m.defaults["outgoing"], m.defaults["routed"])
+}
+
+// status renders the rules like `ufw status`, optionally numbered: the
+// IPv4 rules, then the IPv6 ones, rules for both families appearing twice
+func (m *MockUFW) status(numbered bool) string {
+	var b strings.Builder
+	b.WriteString("Status: active\n\n")
+	fmt.Fprintf(&b, "%-26s %-11s %s\n", "To", "Action", "From")
+	fmt.Fprintf(&b, "%-26s %-11s %s\n", "--", "------", "----")
+	n := 0
+	write := func(rule FirewallRule, action, comment string, v6 bool) {
+		family := ruleFamily(exported(rule))
+		if (v6 && family == "ip") || (!v6 && family == "ip6") {
+			return
+		}
+		n++
+		if numbered {
+			fmt.Fprintf(&b, "[%2d] ", n)
+		}
+		target, source := mockColumns(rule, v6)
+		line := fmt.Sprintf("%-26s %-11s %s", target, action+" "+strings.ToUpper(rule.direction()), source)
+		if comment != "" {
+			line = fmt.Sprintf("%-52s # %s", line, comment)
+		}
+		b.WriteString(line + "\n")
+	}
+	for _, v6 := range []bool{false, true} {
+		for _, rule := range m.limits {
+			write(rule, "LIMIT", "", v6)
+		}
+		for _, r := range m.rules {
+			write(r.rule, strings.ToUpper(r.rule.action()), r.comment, v6)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// mockColumns renders the "To" and "From" columns of a rule. "To" holds
+// the destination, ports and protocol; the interface follows the
+// destination of inbound rules and the source of outbound ones. The IPv6
+// rule marks addresses from anywhere with "(v6)".
+func mockColumns(rule FirewallRule, v6 bool) (string, string) {
+	destination, source := rule.To, rule.From
+	if rule.direction() == DirectionOut {
+		destination, source = rule.From, rule.To
+	}
+	if destination == "any" || destination == "::/0" {
+		destination = ""
+	}
+	if source == "any" || source == "::/0" || source == "" {
+		source = "Anywhere"
+		if v6 {
+			source += " (v6)"
+		}
+	}
+
+	var target string
+	switch {
+	case rule.Port != "any" && rule.Protocol != "any":
+		target = rule.Port + "/" + rule.Protocol
+	case rule.Port != "any":
+		target = rule.Port
+	case rule.Protocol != "any":
+		target = "Anywhere/" + rule.Protocol
+	case destination == "":
+		target = "Anywhere"
+	}
+	if destination != "" {
+		target = strings.TrimSpace(destination + " " + target)
+	} else if v6 {
+		target += " (v6)"
+	}
+	if rule.Interface != "" {
+		if rule.direction() == DirectionOut {
+			source += " on " + rule.Interface
+		} else {
+			target += " on " + rule.Interface
+		}
+	}
+	return target, source
+}
+
+var (
+	simulateMu sync.Mutex
+	// simulatedSince is when host simulation started, zero when the real
+	// host is read
+	simulatedSince time.Time
+)
+
+// SimulateHost makes GetSystemStats and DiskUsedPercent return fake data
+// that drifts slowly over time, for demos and testing without real
+// hardware
+func SimulateHost() {
+	simulateMu.Lock()
+	defer simulateMu.Unlock()
+	simulatedSince = time.Now()
+}
+
+// simulatedHost returns when host simulation started and whether it is on
+func simulatedHost() (time.Time, bool) {
+	simulateMu.Lock()
+	defer simulateMu.Unlock()
+	return simulatedSince, !simulatedSince.IsZero()
+}
+
+// mockSystemStats returns fake stats of a 64 GiB, 16 core host whose load
+// and memory use follow a ten minute wave
+func mockSystemStats(since time.Time) *SystemStats {
+	elapsed := time.Since(since)
+	wave := math.Sin(2 * math.Pi * elapsed.Minutes() / 10)
+	const memTotalKB = 64 * 1024 * 1024
+	return &SystemStats{
+		Load1:      4 + 3*wave,
+		Load5:      4 + 2*wave,
+		Load15:     4 + wave,
+		MemTotalKB: memTotalKB,
+		MemAvailKB: uint64(memTotalKB * (0.5 - 0.15*wave)),
+		Uptime:     elapsed + 72*time.Hour,
+	}
+}
+
+// mockDiskUsedPercent returns a fake disk use that grows by one percent
+// per hour from 40%
+func mockDiskUsedPercent(since time.Time) float64 {
+	return min(40+time.Since(since).Hours(), 100)
+}
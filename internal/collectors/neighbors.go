@@ -0,0 +1,207 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const gatewayFileName = "gateway.json"
+
+// arpFlagComplete marks a resolved entry in /proc/net/arp
+const arpFlagComplete = 0x2
+
+// GatewayStatus is the default IPv4 gateway of an interface and the MAC
+// address it currently resolves to
+type GatewayStatus struct {
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+	// MAC is empty while the gateway's neighbor entry is unresolved
+	MAC string `json:"mac,omitempty"`
+	// PreviousMAC is set when the MAC changed since the last report, e.g.
+	// after a switch failover or because of ARP spoofing
+	PreviousMAC string `json:"previous_mac,omitempty"`
+}
+
+// NeighborReport represents gateway and neighbor table state reported to
+// the API
+type NeighborReport struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Gateways  []GatewayStatus `json:"gateways"`
+	// NeighborEntries is the size of the IPv4 neighbor table and
+	// NeighborLimit the kernel's hard limit (gc_thresh3)
+	NeighborEntries int `json:"neighbor_entries"`
+	NeighborLimit   int `json:"neighbor_limit,omitempty"`
+	// NearOverflow is set when the table is close to its limit, past which
+	// the kernel drops new neighbors and traffic to them fails
+	NearOverflow bool `json:"near_overflow"`
+	// NICs are the physical network interfaces' drivers and offloads
+	NICs   []NICStatus  `json:"nics"`
+	Routes RouteSummary `json:"routes"`
+	Events []string     `json:"events"`
+}
+
+// GatewayChanged reports whether any gateway MAC changed
+func (r *NeighborReport) GatewayChanged() bool {
+	for _, gateway := range r.Gateways {
+		if gateway.PreviousMAC != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NeighborCollector tracks the MAC address of the default gateways and the
+// fill level of the neighbor table
+type NeighborCollector struct {
+	stateDir        string
+	overflowPercent float64
+	badDrivers      []BadDriver
+	// announced are the NIC and route problems already announced as
+	// events
+	announced map[string]bool
+	logger    *logrus.Logger
+}
+
+// NewNeighborCollector creates a new neighbor collector. The table is
+// reported as near overflow once it reaches overflowPercent of its limit.
+func NewNeighborCollector(stateDir string, overflowPercent float64, logger *logrus.Logger) *NeighborCollector {
+	return &NeighborCollector{
+		stateDir:        stateDir,
+		overflowPercent: overflowPercent,
+		announced:       make(map[string]bool),
+		logger:          logger,
+	}
+}
+
+// Check reads the gateways, neighbor table, NICs and routing table and
+// compares the gateway MACs with the last reported ones
+func (nc *NeighborCollector) Check(ctx context.Context) (*NeighborReport, error) {
+	gateways, err := defaultGateways()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %w", err)
+	}
+	neighbors, entries, err := arpTable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read neighbor table: %w", err)
+	}
+
+	known := make(map[string]string)
+	if err := state.Load(nc.stateDir, gatewayFileName, &known); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read gateway state: %w", err)
+	}
+
+	report := &NeighborReport{Timestamp: time.Now(), Gateways: []GatewayStatus{}, NeighborEntries: entries, Events: []string{}}
+	for _, gateway := range gateways {
+		gateway.MAC = neighbors[gateway.Interface+"/"+gateway.Address]
+		previous := known[gateway.Interface+"/"+gateway.Address]
+		if gateway.MAC != "" && previous != "" && gateway.MAC != previous {
+			gateway.PreviousMAC = previous
+			report.Events = append(report.Events, fmt.Sprintf("gateway %s on %s changed MAC address from %s to %s", gateway.Address, gateway.Interface, previous, gateway.MAC))
+		}
+		report.Gateways = append(report.Gateways, gateway)
+	}
+
+	if limit, err := readIntFile("/proc/sys/net/ipv4/neigh/default/gc_thresh3"); err == nil && limit > 0 {
+		report.NeighborLimit = limit
+		if float64(report.NeighborEntries) >= float64(limit)*nc.overflowPercent/100 {
+			report.NearOverflow = true
+			report.Events = append(report.Events, fmt.Sprintf("neighbor table has %d of at most %d entries", report.NeighborEntries, limit))
+		}
+	}
+
+	if report.Routes, err = checkRoutes(); err != nil {
+		return nil, err
+	}
+	report.NICs = nc.checkNICs(ctx)
+
+	// NIC and route problems persist, so each is announced once
+	var problems []string
+	for _, nic := range report.NICs {
+		for _, problem := range nic.Problems {
+			problems = append(problems, nic.Interface+": "+problem)
+		}
+	}
+	problems = append(problems, report.Routes.Findings...)
+	announced := make(map[string]bool)
+	for _, problem := range problems {
+		announced[problem] = true
+		if !nc.announced[problem] {
+			report.Events = append(report.Events, problem)
+		}
+	}
+	nc.announced = announced
+	return report, nil
+}
+
+// MarkReported records the gateway MACs once the API has received the
+// report, so a change is reported until it is delivered. Unresolved
+// gateways keep their last known MAC.
+func (nc *NeighborCollector) MarkReported(report *NeighborReport) error {
+	known := make(map[string]string)
+	if err := state.Load(nc.stateDir, gatewayFileName, &known); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read gateway state: %w", err)
+	}
+	for _, gateway := range report.Gateways {
+		if gateway.MAC != "" {
+			known[gateway.Interface+"/"+gateway.Address] = gateway.MAC
+		}
+	}
+	return state.Save(nc.stateDir, gatewayFileName, known)
+}
+
+// defaultGateways reads the IPv4 default routes from /proc/net/route, where
+// addresses are little-endian hex, e.g. 010200C0 for 192.0.2.1
+func defaultGateways() ([]GatewayStatus, error) {
+	var gateways []GatewayStatus
+	err := lines.ScanFile("/proc/net/route", func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			return
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gw == 0 {
+			return
+		}
+		address := fmt.Sprintf("%d.%d.%d.%d", byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24))
+		gateways = append(gateways, GatewayStatus{Interface: fields[0], Address: address})
+	})
+	return gateways, err
+}
+
+// arpTable returns the resolved IPv4 neighbors from /proc/net/arp, keyed by
+// "<device>/<address>", and the number of entries including unresolved ones
+func arpTable() (map[string]string, int, error) {
+	neighbors := make(map[string]string)
+	entries := 0
+	err := lines.ScanFile("/proc/net/arp", func(line string) {
+		// IP address  HW type  Flags  HW address  Mask  Device
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[0] == "IP" {
+			return
+		}
+		entries++
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		if err != nil || flags&arpFlagComplete == 0 {
+			return
+		}
+		neighbors[fields[5]+"/"+fields[0]] = fields[3]
+	})
+	return neighbors, entries, err
+}
+
+// readIntFile reads a file holding a single integer, e.g. a sysctl
+func readIntFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
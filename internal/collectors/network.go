@@ -0,0 +1,420 @@
+package collectors
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	managedNetworkFile = "network.json"
+	// networkFilePrefix marks systemd-networkd files owned by the agent
+	networkFilePrefix = "90-lsh-agent"
+)
+
+// validLinkName matches kernel network interface names
+var validLinkName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// NetworkAddress is an additional IP address assigned to an existing interface
+type NetworkAddress struct {
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+}
+
+// NetworkVLAN is a VLAN interface created on top of an existing interface
+type NetworkVLAN struct {
+	ID        int      `json:"id"`
+	Link      string   `json:"link"`
+	Addresses []string `json:"addresses"`
+	MTU       int      `json:"mtu"`
+}
+
+// Name returns the interface name of the VLAN, e.g. eth1.100
+func (v NetworkVLAN) Name() string {
+	return fmt.Sprintf("%s.%d", v.Link, v.ID)
+}
+
+// NetworkRoute is a static route pushed by the API
+type NetworkRoute struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway"`
+	Interface   string `json:"interface"`
+	Metric      int    `json:"metric"`
+}
+
+// NetworkResponse represents the API response structure for network configuration
+type NetworkResponse struct {
+	Addresses []NetworkAddress `json:"addresses"`
+	VLANs     []NetworkVLAN    `json:"vlans"`
+	Routes    []NetworkRoute   `json:"routes"`
+}
+
+// NetworkCollector applies additional IPs, VLANs and routes pushed by the API
+// as systemd-networkd drop-ins. Netplan systems using the networkd renderer
+// pick the drop-ins up as well, since they extend the generated .network files.
+type NetworkCollector struct {
+	rootDir        string
+	configDir      string
+	stateDir       string
+	dryRun         bool
+	settleTime     time.Duration
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewNetworkCollector creates a new network collector. rootDir is the root of
+// the host filesystem, "/" unless running in a container.
+func NewNetworkCollector(rootDir, configDir, stateDir string, dryRun bool, settleTime time.Duration, logger *logrus.Logger) *NetworkCollector {
+	return &NetworkCollector{
+		rootDir:        rootDir,
+		configDir:      configDir,
+		stateDir:       stateDir,
+		dryRun:         dryRun,
+		settleTime:     settleTime,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run networkctl with privileges
+func (nc *NetworkCollector) SetCommandWrapper(wrapper ...string) {
+	nc.commandWrapper = wrapper
+}
+
+// ApplyConfig renders the network configuration and applies it. After
+// applying, checkConnectivity is called; if it fails the previous files are
+// restored so a bad configuration cannot cut the server off from the API.
+func (nc *NetworkCollector) ApplyConfig(ctx context.Context, networkJSON string, checkConnectivity func(context.Context) error) error {
+	var response NetworkResponse
+	if err := json.Unmarshal([]byte(networkJSON), &response); err != nil {
+		return fmt.Errorf("failed to parse network JSON: %w", err)
+	}
+	if err := validateNetworkConfig(&response); err != nil {
+		return err
+	}
+
+	desired, err := nc.renderFiles(ctx, &response)
+	if err != nil {
+		return err
+	}
+
+	var managed []string
+	if err := state.Load(nc.stateDir, managedNetworkFile, &managed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load managed network files: %w", err)
+	}
+
+	// Snapshot every file that may change so it can be restored on rollback
+	previous := make(map[string]string)
+	for _, path := range append(managed, sortedKeys(desired)...) {
+		if data, err := os.ReadFile(nc.hostPath(path)); err == nil {
+			previous[path] = string(data)
+		}
+	}
+
+	changes := diffNetworkFiles(previous, desired)
+	if len(changes) == 0 {
+		nc.logger.Debug("Network configuration is up to date")
+		return nil
+	}
+
+	if nc.dryRun {
+		for _, change := range changes {
+			nc.logger.Infof("[dry-run] Would %s", change)
+		}
+		for _, path := range sortedKeys(desired) {
+			if desired[path] != previous[path] {
+				nc.logger.Infof("[dry-run] %s:\n%s", path, desired[path])
+			}
+		}
+		return nil
+	}
+
+	for _, change := range changes {
+		nc.logger.Infof("Network change: %s", change)
+	}
+
+	if err := nc.writeFiles(ctx, desired, managed); err != nil {
+		nc.rollback(ctx, previous, desired)
+		return err
+	}
+
+	// Give links and routes time to come up before judging connectivity
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(nc.settleTime):
+	}
+
+	if err := checkConnectivity(ctx); err != nil {
+		nc.logger.Errorf("Connectivity lost after applying network configuration, rolling back: %v", err)
+		nc.rollback(ctx, previous, desired)
+		return fmt.Errorf("network configuration rolled back after connectivity check failed: %w", err)
+	}
+
+	if err := state.Save(nc.stateDir, managedNetworkFile, sortedKeys(desired)); err != nil {
+		return fmt.Errorf("failed to save managed network files: %w", err)
+	}
+	nc.logger.Infof("Applied network configuration (%d changes)", len(changes))
+	return nil
+}
+
+// validateNetworkConfig rejects malformed entries before anything is written
+func validateNetworkConfig(response *NetworkResponse) error {
+	for _, addr := range response.Addresses {
+		if !validLinkName.MatchString(addr.Interface) {
+			return fmt.Errorf("invalid interface name %q", addr.Interface)
+		}
+		if _, _, err := net.ParseCIDR(addr.Address); err != nil {
+			return fmt.Errorf("invalid address %q: %w", addr.Address, err)
+		}
+	}
+
+	for _, vlan := range response.VLANs {
+		if vlan.ID < 1 || vlan.ID > 4094 {
+			return fmt.Errorf("invalid VLAN id %d", vlan.ID)
+		}
+		if !validLinkName.MatchString(vlan.Link) || !validLinkName.MatchString(vlan.Name()) {
+			return fmt.Errorf("invalid VLAN link %q", vlan.Link)
+		}
+		for _, address := range vlan.Addresses {
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				return fmt.Errorf("invalid address %q on VLAN %d: %w", address, vlan.ID, err)
+			}
+		}
+	}
+
+	for _, route := range response.Routes {
+		if route.Destination != "default" {
+			if _, _, err := net.ParseCIDR(route.Destination); err != nil {
+				return fmt.Errorf("invalid route destination %q: %w", route.Destination, err)
+			}
+		}
+		if route.Gateway != "" && net.ParseIP(route.Gateway) == nil {
+			return fmt.Errorf("invalid route gateway %q", route.Gateway)
+		}
+		if !validLinkName.MatchString(route.Interface) {
+			return fmt.Errorf("invalid route interface %q", route.Interface)
+		}
+	}
+
+	return nil
+}
+
+// renderFiles builds the systemd-networkd files for the configuration, keyed
+// by path relative to the host root
+func (nc *NetworkCollector) renderFiles(ctx context.Context, response *NetworkResponse) (map[string]string, error) {
+	// Settings added to interfaces that already have a .network file
+	extra := make(map[string]*strings.Builder)
+	section := func(iface string) *strings.Builder {
+		if b, ok := extra[iface]; ok {
+			return b
+		}
+		b := &strings.Builder{}
+		b.WriteString("[Network]\n")
+		extra[iface] = b
+		return b
+	}
+
+	// Interfaces created by the agent get their own .network file
+	vlanNetworks := make(map[string]*strings.Builder)
+
+	files := make(map[string]string)
+	for _, vlan := range response.VLANs {
+		name := vlan.Name()
+		fmt.Fprintf(section(vlan.Link), "VLAN=%s\n", name)
+
+		var netdev strings.Builder
+		fmt.Fprintf(&netdev, "[NetDev]\nName=%s\nKind=vlan\n", name)
+		if vlan.MTU > 0 {
+			fmt.Fprintf(&netdev, "MTUBytes=%d\n", vlan.MTU)
+		}
+		fmt.Fprintf(&netdev, "\n[VLAN]\nId=%d\n", vlan.ID)
+		files[filepath.Join(nc.configDir, fmt.Sprintf("%s-%s.netdev", networkFilePrefix, name))] = netdev.String()
+
+		network := &strings.Builder{}
+		fmt.Fprintf(network, "[Match]\nName=%s\n\n[Network]\n", name)
+		for _, address := range vlan.Addresses {
+			fmt.Fprintf(network, "Address=%s\n", address)
+		}
+		vlanNetworks[name] = network
+	}
+
+	for _, addr := range response.Addresses {
+		if network, ok := vlanNetworks[addr.Interface]; ok {
+			fmt.Fprintf(network, "Address=%s\n", addr.Address)
+			continue
+		}
+		fmt.Fprintf(section(addr.Interface), "Address=%s\n", addr.Address)
+	}
+
+	var routeOrder []string
+	routes := make(map[string]*strings.Builder)
+	for _, route := range response.Routes {
+		b, ok := routes[route.Interface]
+		if !ok {
+			b = &strings.Builder{}
+			routes[route.Interface] = b
+			routeOrder = append(routeOrder, route.Interface)
+		}
+		b.WriteString("\n[Route]\n")
+		destination := route.Destination
+		if destination == "default" {
+			destination = "0.0.0.0/0"
+			if ip := net.ParseIP(route.Gateway); ip != nil && ip.To4() == nil {
+				destination = "::/0"
+			}
+		}
+		fmt.Fprintf(b, "Destination=%s\n", destination)
+		if route.Gateway != "" {
+			fmt.Fprintf(b, "Gateway=%s\n", route.Gateway)
+		}
+		if route.Metric > 0 {
+			fmt.Fprintf(b, "Metric=%d\n", route.Metric)
+		}
+	}
+
+	for _, iface := range routeOrder {
+		if network, ok := vlanNetworks[iface]; ok {
+			network.WriteString(routes[iface].String())
+			continue
+		}
+		section(iface).WriteString(routes[iface].String())
+	}
+
+	for name, network := range vlanNetworks {
+		files[filepath.Join(nc.configDir, fmt.Sprintf("%s-%s.network", networkFilePrefix, name))] = network.String()
+	}
+
+	for iface, b := range extra {
+		networkFile, err := nc.networkFileFor(ctx, iface)
+		if err != nil {
+			return nil, err
+		}
+		dropIn := filepath.Join(nc.configDir, filepath.Base(networkFile)+".d", networkFilePrefix+".conf")
+		files[dropIn] = b.String()
+	}
+
+	return files, nil
+}
+
+// networkFileFor returns the .network file systemd-networkd uses for an interface
+func (nc *NetworkCollector) networkFileFor(ctx context.Context, iface string) (string, error) {
+	output, err := nc.run(ctx, "networkctl", "status", "--no-pager", iface)
+	if err != nil {
+		return "", fmt.Errorf("interface %s is not managed by systemd-networkd: %w", iface, err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if ok && key == "Network File" && strings.TrimSpace(value) != "n/a" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("interface %s has no systemd-networkd .network file", iface)
+}
+
+// writeFiles writes the desired files, removes stale ones and reloads networkd
+func (nc *NetworkCollector) writeFiles(ctx context.Context, desired map[string]string, managed []string) error {
+	for _, path := range sortedKeys(desired) {
+		hostPath := nc.hostPath(path)
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0755); err != nil {
+			return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(hostPath, []byte(desired[path]), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
+	for _, path := range managed {
+		if _, ok := desired[path]; ok {
+			continue
+		}
+		if err := os.Remove(nc.hostPath(path)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	return nc.reload(ctx)
+}
+
+// rollback restores the files captured before applying and reloads networkd
+func (nc *NetworkCollector) rollback(ctx context.Context, previous, desired map[string]string) {
+	for path := range desired {
+		if _, ok := previous[path]; !ok {
+			os.Remove(nc.hostPath(path))
+		}
+	}
+	for path, content := range previous {
+		if err := os.WriteFile(nc.hostPath(path), []byte(content), 0644); err != nil {
+			nc.logger.Errorf("Failed to restore %s: %v", path, err)
+		}
+	}
+	if err := nc.reload(ctx); err != nil {
+		nc.logger.Errorf("Failed to reload network configuration during rollback: %v", err)
+	}
+}
+
+// reload makes systemd-networkd pick up changed files; interfaces whose
+// configuration changed are reconfigured by networkd itself
+func (nc *NetworkCollector) reload(ctx context.Context) error {
+	_, err := nc.run(ctx, "networkctl", "reload")
+	return err
+}
+
+// hostPath maps an absolute host path into the agent's view of the filesystem
+func (nc *NetworkCollector) hostPath(path string) string {
+	return filepath.Join(nc.rootDir, path)
+}
+
+// run executes a privileged command and returns its output
+func (nc *NetworkCollector) run(ctx context.Context, name string, args ...string) (string, error) {
+	argv := append(append(append([]string{}, nc.commandWrapper...), name), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// diffNetworkFiles describes which files will be created, updated or removed
+func diffNetworkFiles(previous, desired map[string]string) []string {
+	var changes []string
+	for _, path := range sortedKeys(desired) {
+		current, exists := previous[path]
+		switch {
+		case !exists:
+			changes = append(changes, "create "+path)
+		case current != desired[path]:
+			changes = append(changes, "update "+path)
+		}
+	}
+	for _, path := range sortedKeys(previous) {
+		if _, ok := desired[path]; !ok {
+			changes = append(changes, "remove "+path)
+		}
+	}
+	return changes
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
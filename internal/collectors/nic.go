@@ -0,0 +1,151 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// NICStatus is the driver, firmware and offload settings of a physical
+// network interface, with the problems found in them
+type NICStatus struct {
+	Interface       string `json:"interface"`
+	Driver          string `json:"driver"`
+	DriverVersion   string `json:"driver_version,omitempty"`
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	BusInfo         string `json:"bus_info,omitempty"`
+	// Offloads maps the offload features to whether they are on, e.g.
+	// "large-receive-offload": true
+	Offloads map[string]bool `json:"offloads,omitempty"`
+	Problems []string        `json:"problems"`
+}
+
+// BadDriver is a driver version known to misbehave. Version and Firmware
+// match as a prefix, so empty ones match any.
+type BadDriver struct {
+	Driver   string
+	Version  string
+	Firmware string
+	Reason   string
+}
+
+// matches reports whether the NIC runs the bad driver
+func (b BadDriver) matches(nic NICStatus) bool {
+	return b.Driver == nic.Driver &&
+		strings.HasPrefix(nic.DriverVersion, b.Version) &&
+		strings.HasPrefix(nic.FirmwareVersion, b.Firmware)
+}
+
+// reportedOffloads are the offload features included in NICStatus
+var reportedOffloads = []string{
+	"rx-checksumming",
+	"tx-checksumming",
+	"scatter-gather",
+	"tcp-segmentation-offload",
+	"generic-segmentation-offload",
+	"generic-receive-offload",
+	"large-receive-offload",
+	"rx-gro-hw",
+}
+
+// SetKnownBadDrivers sets the driver versions flagged as problems
+func (nc *NeighborCollector) SetKnownBadDrivers(drivers []BadDriver) {
+	nc.badDrivers = drivers
+}
+
+// checkNICs reads the driver and offload settings of the physical network
+// interfaces with ethtool and flags known-bad drivers and offload
+// combinations that break forwarding
+func (nc *NeighborCollector) checkNICs(ctx context.Context) []NICStatus {
+	forwarding := readSysString("/proc/sys/net/ipv4/ip_forward") == "1"
+
+	nics := []NICStatus{}
+	entries, _ := os.ReadDir("/sys/class/net")
+	for _, entry := range entries {
+		dir := filepath.Join("/sys/class/net", entry.Name())
+		// Only physical interfaces have a device
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			continue
+		}
+		nic := NICStatus{Interface: entry.Name(), Problems: []string{}}
+		if output, err := command.Output(ctx, command.Cmd{Argv: []string{"ethtool", "-i", nic.Interface}}); err == nil {
+			parseEthtoolInfo(string(output), &nic)
+		} else {
+			nc.logger.WithError(err).Debugf("Failed to read driver of %s", nic.Interface)
+			if driver, err := os.Readlink(filepath.Join(dir, "device", "driver")); err == nil {
+				nic.Driver = filepath.Base(driver)
+			}
+		}
+		if output, err := command.Output(ctx, command.Cmd{Argv: []string{"ethtool", "-k", nic.Interface}}); err == nil {
+			nic.Offloads = parseEthtoolFeatures(string(output))
+		}
+
+		// The kernel turns LRO and hardware GRO off when forwarding is
+		// enabled, but not on every stacked device, and a driver may ignore
+		// it; bridge and bond members also forward frames as received
+		_, bridged := os.Stat(filepath.Join(dir, "brport"))
+		_, bonded := os.Stat(filepath.Join(dir, "bonding_slave"))
+		if forwarding || bridged == nil || bonded == nil {
+			for _, offload := range []string{"large-receive-offload", "rx-gro-hw"} {
+				if nic.Offloads[offload] {
+					nic.Problems = append(nic.Problems, fmt.Sprintf("%s is on while the interface forwards packets, which breaks forwarded traffic", offload))
+				}
+			}
+		}
+		for _, bad := range nc.badDrivers {
+			if bad.matches(nic) {
+				problem := fmt.Sprintf("driver %s %s (firmware %s) is known to be faulty", nic.Driver, nic.DriverVersion, nic.FirmwareVersion)
+				if bad.Reason != "" {
+					problem += ": " + bad.Reason
+				}
+				nic.Problems = append(nic.Problems, problem)
+			}
+		}
+		nics = append(nics, nic)
+	}
+	sort.Slice(nics, func(i, j int) bool { return nics[i].Interface < nics[j].Interface })
+	return nics
+}
+
+// parseEthtoolInfo reads the output of `ethtool -i`, lines like
+// "driver: i40e" and "firmware-version: 8.50 0x8000b6c7 1.3082.0"
+func parseEthtoolInfo(output string, nic *NICStatus) {
+	lines.Scan(strings.NewReader(output), func(line string) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "driver":
+			nic.Driver = value
+		case "version":
+			nic.DriverVersion = value
+		case "firmware-version":
+			nic.FirmwareVersion = value
+		case "bus-info":
+			nic.BusInfo = value
+		}
+	})
+}
+
+// parseEthtoolFeatures reads the reported offloads from the output of
+// `ethtool -k`, lines like "large-receive-offload: off [fixed]"
+func parseEthtoolFeatures(output string) map[string]bool {
+	offloads := make(map[string]bool)
+	lines.Scan(strings.NewReader(output), func(line string) {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok || !slices.Contains(reportedOffloads, key) {
+			return
+		}
+		offloads[key] = strings.HasPrefix(strings.TrimSpace(value), "on")
+	})
+	return offloads
+}
@@ -0,0 +1,209 @@
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPatchOutput limits how much package manager output is kept in reports
+const maxPatchOutput = 8 * 1024
+
+// PatchReport represents the outcome of a patch run reported to the API
+type PatchReport struct {
+	Timestamp      time.Time `json:"timestamp"`
+	PackageManager string    `json:"package_manager"`
+	Pending        []string  `json:"pending"`
+	Applied        bool      `json:"applied"`
+	Success        bool      `json:"success"`
+	Error          string    `json:"error,omitempty"`
+	Output         string    `json:"output,omitempty"`
+	RebootRequired bool      `json:"reboot_required"`
+}
+
+// PatchCollector detects and applies pending security updates with apt or dnf
+type PatchCollector struct {
+	rootDir        string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewPatchCollector creates a new patch collector. rootDir is the root of the
+// host filesystem, "/" unless running in a container.
+func NewPatchCollector(rootDir string, logger *logrus.Logger) *PatchCollector {
+	return &PatchCollector{
+		rootDir:        rootDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run the package manager with privileges
+func (pc *PatchCollector) SetCommandWrapper(wrapper ...string) {
+	pc.commandWrapper = wrapper
+}
+
+// PackageManager returns the supported package manager found on the host
+func (pc *PatchCollector) PackageManager() (string, error) {
+	for _, candidate := range []string{"apt-get", "dnf", "yum"} {
+		for _, dir := range []string{"/usr/bin", "/bin", "/usr/sbin"} {
+			if _, err := os.Stat(filepath.Join(pc.rootDir, dir, candidate)); err == nil {
+				return candidate, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no supported package manager found (apt-get, dnf, yum)")
+}
+
+// PendingSecurityUpdates lists packages with pending security updates
+func (pc *PatchCollector) PendingSecurityUpdates(ctx context.Context) ([]string, error) {
+	manager, err := pc.PackageManager()
+	if err != nil {
+		return nil, err
+	}
+
+	switch manager {
+	case "apt-get":
+		if _, err := pc.run(ctx, "apt-get", "update", "-qq"); err != nil {
+			return nil, err
+		}
+		// Simulated upgrade lines look like:
+		// Inst openssl [3.0.2-0ubuntu1.10] (3.0.2-0ubuntu1.12 Ubuntu:22.04/jammy-security [amd64])
+		var packages []string
+		err := pc.stream(ctx, func(stdout io.Reader) (err error) {
+			packages, err = parseAptSecurityUpdates(stdout)
+			return err
+		}, "apt-get", "-s", "dist-upgrade")
+		return packages, err
+	default:
+		// ADVISORY  TYPE  PACKAGE, e.g. "RHSA-2024:1234 Important/Sec. openssl-3.0.7-25.el9.x86_64"
+		var packages []string
+		err := pc.stream(ctx, func(stdout io.Reader) (err error) {
+			packages, err = parseDnfSecurityUpdates(stdout)
+			return err
+		}, manager, "-q", "updateinfo", "list", "--security")
+		return packages, err
+	}
+}
+
+// ApplySecurityUpdates installs pending security updates and reports the outcome
+func (pc *PatchCollector) ApplySecurityUpdates(ctx context.Context, pending []string) *PatchReport {
+	report := &PatchReport{Timestamp: time.Now(), Pending: pending, Applied: true}
+
+	manager, err := pc.PackageManager()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.PackageManager = manager
+
+	var output string
+	switch manager {
+	case "apt-get":
+		args := []string{"install", "-y", "--only-upgrade", "-o", "Dpkg::Options::=--force-confold"}
+		output, err = pc.run(ctx, "apt-get", append(args, pending...)...)
+	default:
+		output, err = pc.run(ctx, manager, "-y", "upgrade", "--security")
+	}
+
+	report.Output = truncateOutput(output, maxPatchOutput)
+	report.Success = err == nil
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.RebootRequired = pc.RebootRequired(ctx)
+
+	return report
+}
+
+// RebootRequired reports whether installed updates need a reboot to take effect
+func (pc *PatchCollector) RebootRequired(ctx context.Context) bool {
+	// Debian/Ubuntu
+	if _, err := os.Stat(filepath.Join(pc.rootDir, "var", "run", "reboot-required")); err == nil {
+		return true
+	}
+
+	// RHEL family: needs-restarting -r exits 1 when a reboot is needed
+	if _, err := os.Stat(filepath.Join(pc.rootDir, "usr", "bin", "needs-restarting")); err == nil {
+		if _, err := pc.run(ctx, "needs-restarting", "-r"); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run executes a package manager command non-interactively
+func (pc *PatchCollector) run(ctx context.Context, name string, args ...string) (string, error) {
+	argv := append(append([]string{}, pc.commandWrapper...), "env", "DEBIAN_FRONTEND=noninteractive", name)
+	argv = append(argv, args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return string(output), fmt.Errorf("%s failed: %w", name, err)
+	}
+	return string(output), nil
+}
+
+// stream executes a package manager command non-interactively, passing its
+// output to parse as it is produced
+func (pc *PatchCollector) stream(ctx context.Context, parse func(io.Reader) error, name string, args ...string) error {
+	argv := append(append([]string{}, pc.commandWrapper...), "env", "DEBIAN_FRONTEND=noninteractive", name)
+	argv = append(argv, args...)
+
+	var parseErr error
+	err := command.Stream(ctx, command.Cmd{Argv: argv}, func(stdout io.Reader) error {
+		parseErr = parse(stdout)
+		return parseErr
+	})
+	if err != nil && err != parseErr {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return err
+}
+
+// parseAptSecurityUpdates extracts package names from simulated upgrade
+// output for updates coming from a security pocket
+func parseAptSecurityUpdates(output io.Reader) ([]string, error) {
+	var packages []string
+	err := lines.Scan(output, func(line string) {
+		if !strings.HasPrefix(line, "Inst ") || !strings.Contains(line, "-security") {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			packages = append(packages, fields[1])
+		}
+	})
+	return packages, err
+}
+
+// parseDnfSecurityUpdates extracts package names from updateinfo output
+func parseDnfSecurityUpdates(output io.Reader) ([]string, error) {
+	seen := make(map[string]bool)
+	var packages []string
+	err := lines.Scan(output, func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || seen[fields[2]] {
+			return
+		}
+		seen[fields[2]] = true
+		packages = append(packages, fields[2])
+	})
+	return packages, err
+}
+
+// truncateOutput keeps the last limit bytes of command output
+func truncateOutput(output string, limit int) string {
+	if len(output) <= limit {
+		return output
+	}
+	return "...(truncated)\n" + output[len(output)-limit:]
+}
@@ -0,0 +1,145 @@
+package collectors
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// rp_filter modes
+const (
+	rpFilterStrict = 1
+	rpFilterLoose  = 2
+)
+
+// DefaultRoute is a default route of the main routing table
+type DefaultRoute struct {
+	Family    string `json:"family"`
+	Interface string `json:"interface"`
+	// Gateway is empty for a default route without next hop, e.g. over a
+	// point-to-point link
+	Gateway string `json:"gateway,omitempty"`
+	Metric  int    `json:"metric"`
+}
+
+// RouteSummary summarizes the main routing table
+type RouteSummary struct {
+	IPv4Routes    int            `json:"ipv4_routes"`
+	IPv6Routes    int            `json:"ipv6_routes"`
+	DefaultRoutes []DefaultRoute `json:"default_routes"`
+	// RPFilter maps interfaces with default routes to their effective
+	// reverse path filter: 0 off, 1 strict, 2 loose
+	RPFilter map[string]int `json:"rp_filter"`
+	Findings []string       `json:"findings"`
+}
+
+// checkRoutes summarizes the routing table and finds missing and
+// conflicting default routes and reverse path filtering that drops
+// legitimate traffic
+func checkRoutes() (RouteSummary, error) {
+	summary := RouteSummary{DefaultRoutes: []DefaultRoute{}, RPFilter: map[string]int{}, Findings: []string{}}
+
+	err := lines.ScanFile("/proc/net/route", func(line string) {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[0] == "Iface" {
+			return
+		}
+		summary.IPv4Routes++
+		if fields[1] != "00000000" || fields[7] != "00000000" {
+			return
+		}
+		route := DefaultRoute{Family: "ipv4", Interface: fields[0]}
+		route.Metric, _ = strconv.Atoi(fields[6])
+		if gw, err := strconv.ParseUint(fields[2], 16, 32); err == nil && gw != 0 {
+			route.Gateway = fmt.Sprintf("%d.%d.%d.%d", byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24))
+		}
+		summary.DefaultRoutes = append(summary.DefaultRoutes, route)
+	})
+	if err != nil {
+		return summary, fmt.Errorf("failed to read IPv4 routes: %w", err)
+	}
+
+	// IPv6 may be disabled, leaving the table absent
+	lines.ScanFile("/proc/net/ipv6_route", func(line string) {
+		// dest dest_len src src_len next_hop metric refcnt use flags iface
+		fields := strings.Fields(line)
+		if len(fields) < 10 || fields[9] == "lo" {
+			return
+		}
+		summary.IPv6Routes++
+		if fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+			return
+		}
+		route := DefaultRoute{Family: "ipv6", Interface: fields[9]}
+		if metric, err := strconv.ParseUint(fields[5], 16, 32); err == nil {
+			route.Metric = int(metric)
+		}
+		if strings.Trim(fields[4], "0") != "" {
+			route.Gateway = formatIPv6Hex(fields[4])
+		}
+		summary.DefaultRoutes = append(summary.DefaultRoutes, route)
+	})
+
+	byFamily := map[string][]DefaultRoute{}
+	for _, route := range summary.DefaultRoutes {
+		byFamily[route.Family] = append(byFamily[route.Family], route)
+	}
+	if len(byFamily["ipv4"]) == 0 {
+		summary.Findings = append(summary.Findings, "no IPv4 default route")
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		metrics := map[int][]string{}
+		for _, route := range byFamily[family] {
+			label := route.Interface
+			if route.Gateway != "" {
+				label += " via " + route.Gateway
+			}
+			metrics[route.Metric] = append(metrics[route.Metric], label)
+		}
+		for metric, routes := range metrics {
+			if len(routes) > 1 {
+				sort.Strings(routes)
+				summary.Findings = append(summary.Findings, fmt.Sprintf("%d %s default routes share metric %d (%s), which one is used is unpredictable", len(routes), family, metric, strings.Join(routes, ", ")))
+			}
+		}
+	}
+
+	// With default routes over several interfaces, replies may leave on
+	// another interface than the request came in, which strict reverse
+	// path filtering drops
+	interfaces := map[string]bool{}
+	for _, route := range byFamily["ipv4"] {
+		interfaces[route.Interface] = true
+	}
+	all, _ := readIntFile("/proc/sys/net/ipv4/conf/all/rp_filter")
+	for iface := range interfaces {
+		value, err := readIntFile(filepath.Join("/proc/sys/net/ipv4/conf", iface, "rp_filter"))
+		if err != nil {
+			continue
+		}
+		// The kernel applies the higher of the interface and "all" values
+		summary.RPFilter[iface] = max(value, all)
+		if len(interfaces) > 1 && summary.RPFilter[iface] == rpFilterStrict {
+			summary.Findings = append(summary.Findings, fmt.Sprintf("strict rp_filter on %s with default routes over %d interfaces drops asymmetrically routed traffic; use loose mode (%d)", iface, len(interfaces), rpFilterLoose))
+		}
+	}
+	sort.Strings(summary.Findings)
+	return summary, nil
+}
+
+// formatIPv6Hex formats an address from /proc/net/ipv6_route, 32 hex
+// digits, in the usual notation
+func formatIPv6Hex(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != net.IPv6len {
+		return s
+	}
+	return net.IP(b).String()
+}
@@ -0,0 +1,284 @@
+package collectors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	securityStateFile = "security.json"
+	// maxSecurityFindings bounds a report on a badly compromised host
+	maxSecurityFindings = 500
+	// maxFindingCommand limits how much of a process command line is reported
+	maxFindingCommand = 200
+)
+
+// Security finding types
+const (
+	FindingWritableSetuid   = "world_writable_setuid"
+	FindingTempSetuid       = "setuid_in_temp_dir"
+	FindingTempProcess      = "process_from_temp_dir"
+	FindingDeletedProcess   = "process_binary_deleted"
+	FindingMinerProcess     = "miner_process"
+	FindingUnexpectedModule = "unexpected_kernel_module"
+)
+
+// tempDirs are world-writable directories binaries should not run from
+var tempDirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+
+// DefaultMinerSignatures are command-line fragments of common cryptocurrency
+// miners and the malware that drops them
+var DefaultMinerSignatures = []string{
+	"xmrig", "minerd", "cpuminer", "cgminer", "ethminer", "nbminer",
+	"stratum+tcp://", "stratum+ssl://", "cryptonight", "kdevtmpfsi", "kinsing",
+}
+
+// SecurityFinding is a single suspicious item found by a scan
+type SecurityFinding struct {
+	// ID identifies the finding across scans so repeats are not re-announced
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	Path        string `json:"path,omitempty"`
+	PID         int    `json:"pid,omitempty"`
+	New         bool   `json:"new"`
+}
+
+// SecurityReport represents the findings of a security scan
+type SecurityReport struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Findings  []SecurityFinding `json:"findings"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// securityState records what previous scans have seen
+type securityState struct {
+	// Modules is the kernel module baseline taken on the first scan
+	Modules []string `json:"modules"`
+	// Reported lists the IDs of findings already delivered to the API
+	Reported []string `json:"reported"`
+}
+
+// SecurityCollector scans the host for signs of compromise: setuid binaries
+// anyone can modify, processes running from temporary directories, known
+// miner processes and kernel modules loaded since the baseline was taken
+type SecurityCollector struct {
+	rootDir         string
+	stateDir        string
+	scanPaths       []string
+	minerSignatures []string
+	allowedModules  []string
+	logger          *logrus.Logger
+}
+
+// NewSecurityCollector creates a new security collector. rootDir is the root
+// of the host filesystem, "/" unless running in a container. scanPaths are
+// searched for setuid files; allowedModules may be loaded without being part
+// of the baseline.
+func NewSecurityCollector(rootDir, stateDir string, scanPaths, minerSignatures, allowedModules []string, logger *logrus.Logger) *SecurityCollector {
+	return &SecurityCollector{
+		rootDir:         rootDir,
+		stateDir:        stateDir,
+		scanPaths:       scanPaths,
+		minerSignatures: minerSignatures,
+		allowedModules:  allowedModules,
+		logger:          logger,
+	}
+}
+
+// Scan runs every check and marks findings not reported before as new
+func (sc *SecurityCollector) Scan() (*SecurityReport, error) {
+	var st securityState
+	if err := state.Load(sc.stateDir, securityStateFile, &st); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var findings []SecurityFinding
+	findings = append(findings, sc.scanSetuid()...)
+	findings = append(findings, sc.scanProcesses()...)
+
+	modules, err := loadedModules()
+	if err != nil {
+		sc.logger.Debugf("Failed to read kernel modules: %v", err)
+	} else if st.Modules == nil {
+		// The first scan records what is loaded now; only later additions
+		// are suspicious
+		st.Modules = modules
+		if err := state.Save(sc.stateDir, securityStateFile, st); err != nil {
+			return nil, err
+		}
+		sc.logger.Infof("Recorded kernel module baseline with %d modules", len(modules))
+	} else {
+		for _, module := range modules {
+			if slices.Contains(st.Modules, module) || slices.Contains(sc.allowedModules, module) {
+				continue
+			}
+			findings = append(findings, newFinding(FindingUnexpectedModule, "warning", "Kernel module "+module+" was loaded after the baseline was taken", module, 0))
+		}
+	}
+
+	report := &SecurityReport{Timestamp: time.Now(), Findings: []SecurityFinding{}}
+	seen := make(map[string]bool)
+	for _, finding := range findings {
+		if seen[finding.ID] {
+			continue
+		}
+		seen[finding.ID] = true
+		if len(report.Findings) == maxSecurityFindings {
+			report.Truncated = true
+			break
+		}
+		finding.New = !slices.Contains(st.Reported, finding.ID)
+		report.Findings = append(report.Findings, finding)
+	}
+	return report, nil
+}
+
+// MarkReported records the findings of a delivered report so they are not
+// announced as new again. Findings that have gone away are forgotten.
+func (sc *SecurityCollector) MarkReported(report *SecurityReport) error {
+	var st securityState
+	if err := state.Load(sc.stateDir, securityStateFile, &st); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	st.Reported = st.Reported[:0]
+	for _, finding := range report.Findings {
+		st.Reported = append(st.Reported, finding.ID)
+	}
+	return state.Save(sc.stateDir, securityStateFile, st)
+}
+
+// scanSetuid looks for setuid/setgid files that are world-writable anywhere,
+// or that live in a temporary directory at all
+func (sc *SecurityCollector) scanSetuid() []SecurityFinding {
+	var findings []SecurityFinding
+	for _, scanPath := range append(slices.Clone(sc.scanPaths), tempDirs...) {
+		root := filepath.Join(sc.rootDir, scanPath)
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				// Stay on the host filesystem; /proc and /sys are not scanned
+				if rel := strings.TrimPrefix(path, strings.TrimSuffix(sc.rootDir, "/")); rel == "/proc" || rel == "/sys" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil || info.Mode()&(fs.ModeSetuid|fs.ModeSetgid) == 0 {
+				return nil
+			}
+
+			hostPath := "/" + strings.TrimPrefix(strings.TrimPrefix(path, sc.rootDir), "/")
+			switch {
+			case inTempDir(hostPath):
+				findings = append(findings, newFinding(FindingTempSetuid, "critical", "Setuid/setgid file in a temporary directory", hostPath, 0))
+			case info.Mode().Perm()&0002 != 0:
+				findings = append(findings, newFinding(FindingWritableSetuid, "critical", "Setuid/setgid file is world-writable", hostPath, 0))
+			}
+			return nil
+		})
+	}
+	return findings
+}
+
+// scanProcesses inspects every running process for binaries in temporary
+// directories, deleted binaries and miner signatures
+func (sc *SecurityCollector) scanProcesses() []SecurityFinding {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		sc.logger.Debugf("Failed to list processes: %v", err)
+		return nil
+	}
+
+	var findings []SecurityFinding
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		procDir := filepath.Join("/proc", entry.Name())
+
+		// Kernel threads have no executable and are skipped
+		exe, err := os.Readlink(filepath.Join(procDir, "exe"))
+		if err != nil {
+			continue
+		}
+		cmdline, _ := os.ReadFile(filepath.Join(procDir, "cmdline"))
+		command := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		if len(command) > maxFindingCommand {
+			command = command[:maxFindingCommand] + "..."
+		}
+
+		binary, deleted := strings.CutSuffix(exe, " (deleted)")
+		switch {
+		case inTempDir(binary):
+			findings = append(findings, newFinding(FindingTempProcess, "critical", "Process running from a temporary directory: "+command, binary, pid))
+		case deleted:
+			findings = append(findings, newFinding(FindingDeletedProcess, "info", "Process binary was deleted after it started: "+command, binary, pid))
+		}
+
+		lowered := strings.ToLower(command + " " + filepath.Base(binary))
+		for _, signature := range sc.minerSignatures {
+			if strings.Contains(lowered, strings.ToLower(signature)) {
+				findings = append(findings, newFinding(FindingMinerProcess, "critical", "Process matches miner signature "+signature+": "+command, binary, pid))
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// loadedModules returns the names of the loaded kernel modules
+func loadedModules() ([]string, error) {
+	modules := []string{}
+	err := lines.ScanFile("/proc/modules", func(line string) {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			modules = append(modules, fields[0])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return modules, nil
+}
+
+// inTempDir reports whether a host path is inside a temporary directory
+func inTempDir(path string) bool {
+	for _, dir := range tempDirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newFinding builds a finding with an ID derived from what was found, so the
+// same process or file keeps its ID across scans
+func newFinding(findingType, severity, description, path string, pid int) SecurityFinding {
+	sum := sha256.Sum256([]byte(findingType + "\x00" + path + "\x00" + strconv.Itoa(pid)))
+	return SecurityFinding{
+		ID:          hex.EncodeToString(sum[:8]),
+		Type:        findingType,
+		Severity:    severity,
+		Description: description,
+		Path:        path,
+		PID:         pid,
+	}
+}
@@ -0,0 +1,339 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const selfTestsFileName = "smart-self-tests.json"
+
+// SMART self-test types
+const (
+	SelfTestShort = "short"
+	SelfTestLong  = "long"
+)
+
+// SMART self-test states
+const (
+	SelfTestRunning = "running"
+	SelfTestPassed  = "passed"
+	SelfTestFailed  = "failed"
+	// SelfTestAborted is a test that ended without a result, e.g. because
+	// the disk was reset or disappeared
+	SelfTestAborted = "aborted"
+)
+
+// smartctl exit status bits for a command line error, a device that could
+// not be opened and a failed SMART command; the higher bits report the
+// disk's health
+const smartctlCommandFailed = 0x7
+
+// SelfTest is a SMART self-test the agent started on a disk
+type SelfTest struct {
+	Disk      string     `json:"disk"`
+	Type      string     `json:"type"`
+	Status    string     `json:"status"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	// RemainingPercent is the share of the test left, while it runs
+	RemainingPercent int `json:"remaining_percent"`
+	// Result is the drive's description of the outcome, e.g. "Completed:
+	// read failure"
+	Result string `json:"result,omitempty"`
+	// LifetimeHours is the power-on hours the test ended at
+	LifetimeHours int `json:"lifetime_hours,omitempty"`
+	// Reported is set once the outcome was sent to the API
+	Reported bool `json:"reported"`
+}
+
+// SelfTestReport represents SMART self-test outcomes reported to the API
+type SelfTestReport struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Tests     []SelfTest `json:"tests"`
+}
+
+// selfTestsMu serializes access to the tracked tests, shared by the
+// runners of remote actions and of the periodic check
+var selfTestsMu sync.Mutex
+
+// SelfTestRunner starts SMART self-tests and tracks them to completion.
+// Tests are kept in the state directory so their outcome is reported even
+// when the agent restarts while a long test runs.
+type SelfTestRunner struct {
+	stateDir       string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewSelfTestRunner creates a new SMART self-test runner
+func NewSelfTestRunner(stateDir string, logger *logrus.Logger) *SelfTestRunner {
+	return &SelfTestRunner{
+		stateDir:       stateDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run smartctl with privileges
+func (r *SelfTestRunner) SetCommandWrapper(wrapper ...string) {
+	r.commandWrapper = wrapper
+}
+
+// Start starts a short or long self-test on a disk, e.g. "sda" or
+// "nvme0n1"
+func (r *SelfTestRunner) Start(ctx context.Context, disk, testType string) (*SelfTest, error) {
+	if testType == "" {
+		testType = SelfTestShort
+	}
+	if testType != SelfTestShort && testType != SelfTestLong {
+		return nil, fmt.Errorf("invalid self-test type %q, expected %s or %s", testType, SelfTestShort, SelfTestLong)
+	}
+	disk = strings.TrimPrefix(disk, "/dev/")
+	if !hasDisk(disk) {
+		return nil, fmt.Errorf("no disk named %q", disk)
+	}
+
+	selfTestsMu.Lock()
+	defer selfTestsMu.Unlock()
+
+	tests, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	if test, ok := tests[disk]; ok && test.Status == SelfTestRunning {
+		return nil, fmt.Errorf("a %s self-test is already running on %s", test.Type, disk)
+	}
+
+	if _, err := r.smartctl(ctx, "-t", testType, "/dev/"+disk); err != nil {
+		return nil, fmt.Errorf("failed to start %s self-test on %s: %w", testType, disk, err)
+	}
+	test := SelfTest{Disk: disk, Type: testType, Status: SelfTestRunning, StartedAt: time.Now(), RemainingPercent: 100}
+	tests[disk] = test
+	if err := r.save(tests); err != nil {
+		return nil, err
+	}
+	r.logger.Infof("Started %s SMART self-test on %s", testType, disk)
+	return &test, nil
+}
+
+// Poll updates the progress of running self-tests and returns every test
+// tracked, most recently started first
+func (r *SelfTestRunner) Poll(ctx context.Context) ([]SelfTest, error) {
+	selfTestsMu.Lock()
+	defer selfTestsMu.Unlock()
+
+	tests, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	for disk, test := range tests {
+		if test.Status != SelfTestRunning {
+			continue
+		}
+		if !hasDisk(disk) {
+			test.Status, test.Result = SelfTestAborted, "disk disappeared"
+			now := time.Now()
+			test.EndedAt = &now
+			tests[disk] = test
+			continue
+		}
+		progress, err := r.progress(ctx, disk)
+		if err != nil {
+			r.logger.WithError(err).Warnf("Failed to read SMART self-test progress of %s", disk)
+			continue
+		}
+		tests[disk] = progress.apply(test)
+	}
+	if err := r.save(tests); err != nil {
+		return nil, err
+	}
+
+	list := make([]SelfTest, 0, len(tests))
+	for _, test := range tests {
+		list = append(list, test)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return list, nil
+}
+
+// MarkReported records that the outcome of the given tests was sent to the
+// API
+func (r *SelfTestRunner) MarkReported(reported []SelfTest) error {
+	selfTestsMu.Lock()
+	defer selfTestsMu.Unlock()
+
+	tests, err := r.load()
+	if err != nil {
+		return err
+	}
+	for _, test := range reported {
+		if current, ok := tests[test.Disk]; ok && current.StartedAt.Equal(test.StartedAt) && current.Status != SelfTestRunning {
+			current.Reported = true
+			tests[test.Disk] = current
+		}
+	}
+	return r.save(tests)
+}
+
+// load reads the tracked tests, keyed by disk
+func (r *SelfTestRunner) load() (map[string]SelfTest, error) {
+	tests := map[string]SelfTest{}
+	if err := state.Load(r.stateDir, selfTestsFileName, &tests); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read SMART self-tests: %w", err)
+	}
+	return tests, nil
+}
+
+// save writes the tracked tests
+func (r *SelfTestRunner) save(tests map[string]SelfTest) error {
+	if err := state.Save(r.stateDir, selfTestsFileName, tests); err != nil {
+		return fmt.Errorf("failed to save SMART self-tests: %w", err)
+	}
+	return nil
+}
+
+// selfTestProgress is the self-test state of a disk as smartctl reports it
+// for ATA and NVMe drives
+type selfTestProgress struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+		Messages   []struct {
+			String string `json:"string"`
+		} `json:"messages"`
+	} `json:"smartctl"`
+	ATAData struct {
+		SelfTest struct {
+			Status struct {
+				Value            int  `json:"value"`
+				RemainingPercent *int `json:"remaining_percent"`
+			} `json:"status"`
+		} `json:"self_test"`
+	} `json:"ata_smart_data"`
+	ATALog struct {
+		Standard struct {
+			Table []struct {
+				Status struct {
+					String string `json:"string"`
+					Passed bool   `json:"passed"`
+				} `json:"status"`
+				LifetimeHours int `json:"lifetime_hours"`
+			} `json:"table"`
+		} `json:"standard"`
+	} `json:"ata_smart_self_test_log"`
+	NVMeLog *struct {
+		CurrentOperation struct {
+			Value int `json:"value"`
+		} `json:"current_self_test_operation"`
+		CompletionPercent int `json:"current_self_test_completion_percent"`
+		Table             []struct {
+			Result struct {
+				Value  int    `json:"value"`
+				String string `json:"string"`
+			} `json:"self_test_result"`
+			PowerOnHours int `json:"power_on_hours"`
+		} `json:"table"`
+	} `json:"nvme_self_test_log"`
+}
+
+// apply updates a running test with the progress read from the disk. The
+// newest log entry is taken as the test's outcome once none is running.
+func (p *selfTestProgress) apply(test SelfTest) SelfTest {
+	if p.NVMeLog != nil {
+		if p.NVMeLog.CurrentOperation.Value != 0 {
+			test.RemainingPercent = 100 - p.NVMeLog.CompletionPercent
+			return test
+		}
+		if len(p.NVMeLog.Table) == 0 {
+			return test
+		}
+		entry := p.NVMeLog.Table[0]
+		test.Result, test.LifetimeHours = entry.Result.String, entry.PowerOnHours
+		test.Status = SelfTestFailed
+		switch entry.Result.Value {
+		case 0:
+			test.Status = SelfTestPassed
+		case 1, 2, 3:
+			// Aborted by a command, a reset or a namespace removal
+			test.Status = SelfTestAborted
+		}
+	} else {
+		// The upper nibble of the status is 15 while a test runs
+		if p.ATAData.SelfTest.Status.Value>>4 == 15 {
+			if remaining := p.ATAData.SelfTest.Status.RemainingPercent; remaining != nil {
+				test.RemainingPercent = *remaining
+			}
+			return test
+		}
+		if len(p.ATALog.Standard.Table) == 0 {
+			return test
+		}
+		entry := p.ATALog.Standard.Table[0]
+		test.Result, test.LifetimeHours = entry.Status.String, entry.LifetimeHours
+		test.Status = SelfTestFailed
+		switch {
+		case entry.Status.Passed:
+			test.Status = SelfTestPassed
+		case strings.Contains(strings.ToLower(entry.Status.String), "abort"),
+			strings.Contains(strings.ToLower(entry.Status.String), "interrupted"):
+			test.Status = SelfTestAborted
+		}
+	}
+	now := time.Now()
+	test.RemainingPercent, test.EndedAt = 0, &now
+	return test
+}
+
+// progress reads the self-test state and log of a disk
+func (r *SelfTestRunner) progress(ctx context.Context, disk string) (*selfTestProgress, error) {
+	output, err := r.smartctl(ctx, "-c", "-l", "selftest", "/dev/"+disk)
+	if err != nil {
+		return nil, err
+	}
+	var progress selfTestProgress
+	if err := json.Unmarshal(output, &progress); err != nil {
+		return nil, fmt.Errorf("failed to parse smartctl output: %w", err)
+	}
+	return &progress, nil
+}
+
+// smartctl runs smartctl with JSON output. Its exit status also reports the
+// disk's health, so only the bits of a failed command are errors.
+func (r *SelfTestRunner) smartctl(ctx context.Context, args ...string) ([]byte, error) {
+	argv := append(append([]string{}, r.commandWrapper...), "smartctl", "-j")
+	output, runErr := command.Output(ctx, command.Cmd{Argv: append(argv, args...)})
+	var result selfTestProgress
+	if err := json.Unmarshal(output, &result); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("smartctl failed: %w", runErr)
+		}
+		return nil, fmt.Errorf("failed to parse smartctl output: %w", err)
+	}
+	if result.Smartctl.ExitStatus&smartctlCommandFailed != 0 {
+		var messages []string
+		for _, message := range result.Smartctl.Messages {
+			messages = append(messages, message.String)
+		}
+		return nil, fmt.Errorf("smartctl failed: %s", strings.Join(messages, "; "))
+	}
+	return output, nil
+}
+
+// hasDisk reports whether a physical disk of that name is present
+func hasDisk(name string) bool {
+	for _, disk := range readDisks() {
+		if disk.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package collectors
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// SystemStats represents basic host health metrics read from /proc
+type SystemStats struct {
+	Load1      float64
+	Load5      float64
+	Load15     float64
+	MemTotalKB uint64
+	MemAvailKB uint64
+	Uptime     time.Duration
+}
+
+// MemUsedPercent returns the percentage of memory in use
+func (s SystemStats) MemUsedPercent() float64 {
+	if s.MemTotalKB == 0 {
+		return 0
+	}
+	return float64(s.MemTotalKB-s.MemAvailKB) / float64(s.MemTotalKB) * 100
+}
+
+// GetSystemStats reads load average, memory and uptime from /proc, or
+// returns simulated stats after SimulateHost
+func GetSystemStats() (*SystemStats, error) {
+	if since, ok := simulatedHost(); ok {
+		return mockSystemStats(since), nil
+	}
+	stats := &SystemStats{}
+
+	loadavg, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read load average: %w", err)
+	}
+	fields := strings.Fields(string(loadavg))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+	stats.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	stats.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	stats.Load15, _ = strconv.ParseFloat(fields[2], 64)
+
+	err = lines.ScanFile("/proc/meminfo", func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			stats.MemTotalKB = value
+		case "MemAvailable:":
+			stats.MemAvailKB = value
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read memory info: %w", err)
+	}
+
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uptime: %w", err)
+	}
+	fields = strings.Fields(string(uptime))
+	if len(fields) > 0 {
+		if seconds, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			stats.Uptime = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return stats, nil
+}
+
+// DiskUsedPercent returns the percentage of space in use on the filesystem
+// containing path, as shown by df, or a simulated value after SimulateHost
+func DiskUsedPercent(path string) (float64, error) {
+	if since, ok := simulatedHost(); ok {
+		return mockDiskUsedPercent(since), nil
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, fmt.Errorf("failed to stat filesystem %s: %w", path, err)
+	}
+	used := fs.Blocks - fs.Bfree
+	total := used + fs.Bavail
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(used) / float64(total) * 100, nil
+}
+
+// Metrics returns the stats as named metrics for alert rule evaluation
+func (s SystemStats) Metrics() map[string]float64 {
+	return map[string]float64{
+		"load1":               s.Load1,
+		"load5":               s.Load5,
+		"load15":              s.Load15,
+		"memory_used_percent": s.MemUsedPercent(),
+		"uptime_seconds":      s.Uptime.Seconds(),
+	}
+}
@@ -0,0 +1,139 @@
+package collectors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// TCPCounters is a snapshot of the kernel's TCP stack counters and socket
+// counts
+type TCPCounters struct {
+	Time time.Time `json:"time"`
+	// OutSegs and RetransSegs count segments sent and retransmitted
+	OutSegs     uint64 `json:"out_segs"`
+	RetransSegs uint64 `json:"retrans_segs"`
+	// ListenOverflows counts connections dropped because an accept queue
+	// was full, ListenDrops those dropped for any reason
+	ListenOverflows uint64 `json:"listen_overflows"`
+	ListenDrops     uint64 `json:"listen_drops"`
+	Established     uint64 `json:"established"`
+	TimeWait        uint64 `json:"time_wait"`
+	// Orphans are sockets closed by their process with data left to send
+	Orphans uint64 `json:"orphans"`
+}
+
+// ReadTCPCounters reads TCP counters from /proc/net/snmp, /proc/net/netstat
+// and /proc/net/sockstat
+func ReadTCPCounters() (*TCPCounters, error) {
+	counters := &TCPCounters{Time: time.Now()}
+
+	snmp, err := readProcCounters("/proc/net/snmp", "Tcp:")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TCP counters: %w", err)
+	}
+	counters.OutSegs = snmp["OutSegs"]
+	counters.RetransSegs = snmp["RetransSegs"]
+	counters.Established = snmp["CurrEstab"]
+
+	netstat, err := readProcCounters("/proc/net/netstat", "TcpExt:")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TCP extended counters: %w", err)
+	}
+	counters.ListenOverflows = netstat["ListenOverflows"]
+	counters.ListenDrops = netstat["ListenDrops"]
+
+	// "TCP: inuse 6 orphan 0 tw 0 alloc 6 mem 0"
+	err = lines.ScanFile("/proc/net/sockstat", func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "TCP:" {
+			return
+		}
+		for i := 1; i+1 < len(fields); i += 2 {
+			value, _ := strconv.ParseUint(fields[i+1], 10, 64)
+			switch fields[i] {
+			case "orphan":
+				counters.Orphans = value
+			case "tw":
+				counters.TimeWait = value
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read socket counts: %w", err)
+	}
+	return counters, nil
+}
+
+// readProcCounters reads a section of /proc/net/snmp or /proc/net/netstat,
+// a header line of names followed by a line of values, both starting with
+// prefix
+func readProcCounters(path, prefix string) (map[string]uint64, error) {
+	counters := make(map[string]uint64)
+	var header []string
+	err := lines.ScanFile(path, func(line string) {
+		if !strings.HasPrefix(line, prefix) {
+			return
+		}
+		fields := strings.Fields(line)
+		if header == nil {
+			header = fields
+			return
+		}
+		for i := 1; i < len(fields) && i < len(header); i++ {
+			counters[header[i]], _ = strconv.ParseUint(fields[i], 10, 64)
+		}
+	})
+	return counters, err
+}
+
+// TCPMetrics lists the metrics TCPStackMetrics returns
+var TCPMetrics = []string{"tcp_retrans_percent", "tcp_listen_overflows", "tcp_listen_drops", "tcp_established", "tcp_time_wait", "tcp_orphans"}
+
+// TCPStackMetrics returns the TCP metrics between two snapshots: the share
+// of segments retransmitted in percent, the listen queue overflows and
+// drops per minute, and the current socket counts. Without a previous
+// snapshot, or when counters went backwards, only the counts are returned.
+func TCPStackMetrics(prev, cur *TCPCounters) map[string]float64 {
+	metrics := map[string]float64{
+		"tcp_established": float64(cur.Established),
+		"tcp_time_wait":   float64(cur.TimeWait),
+		"tcp_orphans":     float64(cur.Orphans),
+	}
+	if prev == nil {
+		return metrics
+	}
+	minutes := cur.Time.Sub(prev.Time).Minutes()
+	if minutes <= 0 {
+		return metrics
+	}
+
+	if cur.OutSegs > prev.OutSegs && cur.RetransSegs >= prev.RetransSegs {
+		metrics["tcp_retrans_percent"] = float64(cur.RetransSegs-prev.RetransSegs) / float64(cur.OutSegs-prev.OutSegs) * 100
+	}
+	if cur.ListenOverflows >= prev.ListenOverflows {
+		metrics["tcp_listen_overflows"] = float64(cur.ListenOverflows-prev.ListenOverflows) / minutes
+	}
+	if cur.ListenDrops >= prev.ListenDrops {
+		metrics["tcp_listen_drops"] = float64(cur.ListenDrops-prev.ListenDrops) / minutes
+	}
+	return metrics
+}
+
+// TCPSampler returns the TCP metrics since its previous call, for periodic
+// samplers that each keep their own baseline
+func TCPSampler() func() (map[string]float64, error) {
+	var prev *TCPCounters
+	return func() (map[string]float64, error) {
+		cur, err := ReadTCPCounters()
+		if err != nil {
+			return nil, err
+		}
+		metrics := TCPStackMetrics(prev, cur)
+		prev = cur
+		return metrics, nil
+	}
+}
@@ -0,0 +1,136 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// InterfaceCounters are the cumulative receive counters of an interface
+type InterfaceCounters struct {
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+}
+
+// TrafficCounters is a snapshot of the kernel's traffic counters
+type TrafficCounters struct {
+	Time       time.Time                    `json:"time"`
+	Interfaces map[string]InterfaceCounters `json:"interfaces"`
+	// PassiveOpens counts TCP connections accepted by the host
+	PassiveOpens uint64 `json:"passive_opens"`
+}
+
+// ReadTrafficCounters reads receive counters from /proc/net/dev and accepted
+// TCP connections from /proc/net/snmp. When interfaces is empty every
+// interface except loopback is included.
+func ReadTrafficCounters(interfaces []string) (*TrafficCounters, error) {
+	counters := &TrafficCounters{Time: time.Now(), Interfaces: make(map[string]InterfaceCounters)}
+
+	// Each line is "iface: rx_bytes rx_packets rx_errs ... tx_bytes ..."
+	err := lines.ScanFile("/proc/net/dev", func(line string) {
+		name, values, ok := strings.Cut(line, ":")
+		if !ok {
+			return
+		}
+		name = strings.TrimSpace(name)
+		if name == "lo" || (len(interfaces) > 0 && !slices.Contains(interfaces, name)) {
+			return
+		}
+		fields := strings.Fields(values)
+		if len(fields) < 2 {
+			return
+		}
+		var c InterfaceCounters
+		c.RxBytes, _ = strconv.ParseUint(fields[0], 10, 64)
+		c.RxPackets, _ = strconv.ParseUint(fields[1], 10, 64)
+		counters.Interfaces[name] = c
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read interface counters: %w", err)
+	}
+
+	// The Tcp section is a header line followed by a value line
+	var header []string
+	err = lines.ScanFile("/proc/net/snmp", func(line string) {
+		if !strings.HasPrefix(line, "Tcp:") {
+			return
+		}
+		fields := strings.Fields(line)
+		if header == nil {
+			header = fields
+			return
+		}
+		if i := slices.Index(header, "PassiveOpens"); i > 0 && i < len(fields) {
+			counters.PassiveOpens, _ = strconv.ParseUint(fields[i], 10, 64)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TCP counters: %w", err)
+	}
+
+	return counters, nil
+}
+
+// TrafficRates returns per-second rates between two snapshots, keyed as
+// "<iface>:rx_pps", "<iface>:rx_bps" and "tcp_conn_rate". Counters that went
+// backwards, e.g. after an interface was recreated, are skipped.
+func TrafficRates(prev, cur *TrafficCounters) map[string]float64 {
+	rates := make(map[string]float64)
+	seconds := cur.Time.Sub(prev.Time).Seconds()
+	if seconds <= 0 {
+		return rates
+	}
+
+	for name, c := range cur.Interfaces {
+		p, ok := prev.Interfaces[name]
+		if !ok || c.RxPackets < p.RxPackets || c.RxBytes < p.RxBytes {
+			continue
+		}
+		rates[name+":rx_pps"] = float64(c.RxPackets-p.RxPackets) / seconds
+		rates[name+":rx_bps"] = float64(c.RxBytes-p.RxBytes) * 8 / seconds
+	}
+	if cur.PassiveOpens >= prev.PassiveOpens {
+		rates["tcp_conn_rate"] = float64(cur.PassiveOpens-prev.PassiveOpens) / seconds
+	}
+	return rates
+}
+
+// MitigationResponse represents the pre-approved mitigation rules pushed by
+// the API, applied as UFW rate limits while a traffic anomaly is active
+type MitigationResponse struct {
+	Rules []FirewallRule `json:"rules"`
+}
+
+// ParseMitigationRules parses and validates mitigation rules. Each must name
+// a tcp or udp port and a source of "any", an IP address or a CIDR.
+func ParseMitigationRules(rulesJSON string) ([]FirewallRule, error) {
+	var response MitigationResponse
+	if err := json.Unmarshal([]byte(rulesJSON), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse mitigation rules JSON: %w", err)
+	}
+
+	for i, rule := range response.Rules {
+		if rule.From == "" {
+			rule.From = "any"
+			response.Rules[i].From = "any"
+		}
+		if protocol := strings.ToLower(rule.Protocol); protocol != "tcp" && protocol != "udp" {
+			return nil, fmt.Errorf("invalid mitigation rule %s: protocol must be tcp or udp", rule)
+		}
+		if port, err := strconv.Atoi(rule.Port); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid mitigation rule %s: invalid port", rule)
+		}
+		if rule.From != "any" && net.ParseIP(rule.From) == nil {
+			if _, _, err := net.ParseCIDR(rule.From); err != nil {
+				return nil, fmt.Errorf("invalid mitigation rule %s: invalid source", rule)
+			}
+		}
+	}
+	return response.Rules, nil
+}
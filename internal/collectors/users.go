@@ -0,0 +1,370 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const managedUsersFile = "users.json"
+
+// validName matches usernames and group names accepted by useradd/groupadd
+var validName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// ManagedUser represents a local user account defined via the API
+type ManagedUser struct {
+	Username          string   `json:"username"`
+	Shell             string   `json:"shell"`
+	Groups            []string `json:"groups"`
+	Sudo              bool     `json:"sudo"`
+	Disabled          bool     `json:"disabled"`
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys"`
+}
+
+// UsersResponse represents the API response structure for managed users
+type UsersResponse struct {
+	Users []ManagedUser `json:"users"`
+}
+
+// passwdEntry represents a line of /etc/passwd
+type passwdEntry struct {
+	UID  int
+	GID  int
+	Home string
+}
+
+// UserCollector creates, updates and disables local accounts defined via the
+// API. It only ever modifies accounts it created itself, which are tracked in
+// the state directory, so existing system and operator accounts are never
+// touched. Users removed from the API are disabled rather than deleted.
+type UserCollector struct {
+	rootDir        string
+	stateDir       string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewUserCollector creates a new user collector. rootDir is the root of the
+// filesystem holding /etc/passwd and home directories, "/" unless running in
+// a container.
+func NewUserCollector(rootDir, stateDir string, logger *logrus.Logger) *UserCollector {
+	return &UserCollector{
+		rootDir:        rootDir,
+		stateDir:       stateDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run account tools with privileges
+func (uc *UserCollector) SetCommandWrapper(wrapper ...string) {
+	uc.commandWrapper = wrapper
+}
+
+// SyncUsers reconciles local accounts with the users defined by the API
+func (uc *UserCollector) SyncUsers(ctx context.Context, usersJSON string) error {
+	var response UsersResponse
+	if err := json.Unmarshal([]byte(usersJSON), &response); err != nil {
+		return fmt.Errorf("failed to parse users JSON: %w", err)
+	}
+
+	managed := make(map[string]bool)
+	if err := state.Load(uc.stateDir, managedUsersFile, &managed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load managed users: %w", err)
+	}
+
+	uc.logger.Infof("Synchronizing %d managed users", len(response.Users))
+
+	desired := make(map[string]bool)
+	var failed int
+	for _, user := range response.Users {
+		desired[user.Username] = true
+		if err := uc.syncUser(ctx, user, managed); err != nil {
+			uc.logger.Errorf("Failed to synchronize user %s: %v", user.Username, err)
+			failed++
+		}
+	}
+
+	// Offboard users that are no longer defined by the API
+	for username := range managed {
+		if desired[username] {
+			continue
+		}
+		if err := uc.disableUser(ctx, username); err != nil {
+			uc.logger.Errorf("Failed to disable removed user %s: %v", username, err)
+			failed++
+		} else {
+			uc.logger.Infof("Disabled user %s removed from the API", username)
+		}
+	}
+
+	if err := state.Save(uc.stateDir, managedUsersFile, managed); err != nil {
+		return fmt.Errorf("failed to save managed users: %w", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d user operations failed", failed)
+	}
+	return nil
+}
+
+// syncUser creates or updates a single account
+func (uc *UserCollector) syncUser(ctx context.Context, user ManagedUser, managed map[string]bool) error {
+	if !validName.MatchString(user.Username) {
+		return fmt.Errorf("invalid username %q", user.Username)
+	}
+	for _, group := range user.Groups {
+		if !validName.MatchString(group) {
+			return fmt.Errorf("invalid group name %q", group)
+		}
+	}
+
+	shell := user.Shell
+	if shell == "" {
+		shell = "/bin/bash"
+	}
+
+	entry, err := uc.lookupUser(user.Username)
+	if err != nil {
+		return err
+	}
+
+	if entry != nil && !managed[user.Username] {
+		uc.logger.Warnf("User %s already exists and is not managed by the agent, skipping", user.Username)
+		return nil
+	}
+
+	if err := uc.ensureGroups(ctx, user.Groups); err != nil {
+		return err
+	}
+
+	groups := strings.Join(user.Groups, ",")
+	if entry == nil {
+		args := []string{"--create-home", "--shell", shell}
+		if groups != "" {
+			args = append(args, "--groups", groups)
+		}
+		if err := uc.run(ctx, "useradd", append(args, user.Username)...); err != nil {
+			return err
+		}
+		uc.logger.Infof("Created user %s", user.Username)
+
+		// Record ownership right away so a crash can't orphan the account
+		managed[user.Username] = true
+		if err := state.Save(uc.stateDir, managedUsersFile, managed); err != nil {
+			return fmt.Errorf("failed to save managed users: %w", err)
+		}
+
+		if entry, err = uc.lookupUser(user.Username); err != nil || entry == nil {
+			return fmt.Errorf("user %s not found after creation", user.Username)
+		}
+	} else if err := uc.run(ctx, "usermod", "--shell", shell, "--groups", groups, user.Username); err != nil {
+		return err
+	}
+
+	// Expiring the account blocks every login method, including SSH keys
+	expiry := ""
+	if user.Disabled {
+		expiry = "1"
+	}
+	if err := uc.run(ctx, "usermod", "--expiredate", expiry, user.Username); err != nil {
+		return err
+	}
+
+	if err := uc.setSudo(user.Username, user.Sudo && !user.Disabled); err != nil {
+		return err
+	}
+
+	return uc.writeAuthorizedKeys(entry, user.SSHAuthorizedKeys)
+}
+
+// disableUser expires an account and revokes its sudo access
+func (uc *UserCollector) disableUser(ctx context.Context, username string) error {
+	entry, err := uc.lookupUser(username)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+
+	if err := uc.run(ctx, "usermod", "--expiredate", "1", username); err != nil {
+		return err
+	}
+	return uc.setSudo(username, false)
+}
+
+// ensureGroups creates any groups that do not exist yet
+func (uc *UserCollector) ensureGroups(ctx context.Context, groups []string) error {
+	existing, err := uc.readGroups()
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if existing[group] {
+			continue
+		}
+		if err := uc.run(ctx, "groupadd", group); err != nil {
+			return err
+		}
+		uc.logger.Infof("Created group %s", group)
+	}
+	return nil
+}
+
+// setSudo grants or revokes passwordless sudo through a sudoers drop-in
+func (uc *UserCollector) setSudo(username string, enabled bool) error {
+	path := filepath.Join(uc.rootDir, "etc", "sudoers.d", "lsh-agent-"+username)
+
+	if !enabled {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to revoke sudo for %s: %w", username, err)
+		}
+		return nil
+	}
+
+	content := fmt.Sprintf("# Managed by the Latitude.sh agent\n%s ALL=(ALL:ALL) NOPASSWD: ALL\n", username)
+	if err := os.WriteFile(path, []byte(content), 0440); err != nil {
+		return fmt.Errorf("failed to grant sudo for %s: %w", username, err)
+	}
+	return nil
+}
+
+// writeAuthorizedKeys replaces the user's authorized_keys file. The user
+// owns ~/.ssh, so it is opened relative to the home directory without
+// following symlinks, and the file is written under a temporary name and
+// renamed over authorized_keys: a symlink planted by the user cannot make
+// the agent write or chown another file.
+func (uc *UserCollector) writeAuthorizedKeys(entry *passwdEntry, keys []string) error {
+	var content strings.Builder
+	content.WriteString("# Managed by the Latitude.sh agent\n")
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" || strings.ContainsAny(key, "\r\n") {
+			continue
+		}
+		content.WriteString(key + "\n")
+	}
+
+	home := filepath.Join(uc.rootDir, entry.Home)
+	homeFd, err := syscall.Open(home, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", home, err)
+	}
+	defer syscall.Close(homeFd)
+
+	sshDir := filepath.Join(home, ".ssh")
+	if err := syscall.Mkdirat(homeFd, ".ssh", 0700); err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to create %s: %w", sshDir, err)
+	}
+	sshFd, err := syscall.Openat(homeFd, ".ssh", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s, refusing to follow a symlink: %w", sshDir, err)
+	}
+	defer syscall.Close(sshFd)
+	if err := syscall.Fchown(sshFd, entry.UID, entry.GID); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %w", sshDir, err)
+	}
+
+	const tmpName = "authorized_keys.lsh-agent"
+	syscall.Unlinkat(sshFd, tmpName)
+	fd, err := syscall.Openat(sshFd, tmpName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Join(sshDir, tmpName), err)
+	}
+	file := os.NewFile(uintptr(fd), filepath.Join(sshDir, tmpName))
+	_, err = file.WriteString(content.String())
+	if err == nil {
+		err = file.Chown(entry.UID, entry.GID)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	path := filepath.Join(sshDir, "authorized_keys")
+	if err == nil {
+		err = syscall.Renameat(sshFd, tmpName, sshFd, "authorized_keys")
+	}
+	if err != nil {
+		syscall.Unlinkat(sshFd, tmpName)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// lookupUser finds a user in /etc/passwd, returning nil if it does not exist
+func (uc *UserCollector) lookupUser(username string) (*passwdEntry, error) {
+	return lookupPasswd(uc.rootDir, username)
+}
+
+// lookupPasswd finds a user in the /etc/passwd below rootDir, returning nil
+// if it does not exist
+func lookupPasswd(rootDir, username string) (*passwdEntry, error) {
+	var entry *passwdEntry
+	err := lines.ScanFile(filepath.Join(rootDir, "etc", "passwd"), func(line string) {
+		fields := strings.Split(line, ":")
+		if entry != nil || len(fields) < 7 || fields[0] != username {
+			return
+		}
+		uid, _ := strconv.Atoi(fields[2])
+		gid, _ := strconv.Atoi(fields[3])
+		entry = &passwdEntry{UID: uid, GID: gid, Home: fields[5]}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passwd: %w", err)
+	}
+	return entry, nil
+}
+
+// readGroups returns the set of group names in /etc/group
+func (uc *UserCollector) readGroups() (map[string]bool, error) {
+	groups := make(map[string]bool)
+	err := lines.ScanFile(filepath.Join(uc.rootDir, "etc", "group"), func(line string) {
+		if name, _, ok := strings.Cut(line, ":"); ok {
+			groups[name] = true
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups: %w", err)
+	}
+	return groups, nil
+}
+
+// lookupGroupID finds a group's GID in the /etc/group below rootDir
+func lookupGroupID(rootDir, name string) (int, error) {
+	gid := -1
+	err := lines.ScanFile(filepath.Join(rootDir, "etc", "group"), func(line string) {
+		fields := strings.Split(line, ":")
+		if gid < 0 && len(fields) >= 3 && fields[0] == name {
+			gid, _ = strconv.Atoi(fields[2])
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read groups: %w", err)
+	}
+	if gid < 0 {
+		return 0, fmt.Errorf("group %s does not exist", name)
+	}
+	return gid, nil
+}
+
+// run executes a privileged account management command
+func (uc *UserCollector) run(ctx context.Context, name string, args ...string) error {
+	argv := append(append(append([]string{}, uc.commandWrapper...), name), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	managedWireGuardFile = "wireguard.json"
+	// handshakeTimeout is how old a peer's last handshake may be before the
+	// peer is considered down; WireGuard re-handshakes every two minutes
+	handshakeTimeout = 3 * time.Minute
+)
+
+// validInterfaceName restricts managed interfaces to a recognizable prefix
+var validInterfaceName = regexp.MustCompile(`^wg[a-z0-9-]{0,13}$`)
+
+// WireGuardPeer represents a peer pushed by the API
+type WireGuardPeer struct {
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive"`
+}
+
+// WireGuardInterface represents a WireGuard interface pushed by the API
+type WireGuardInterface struct {
+	Name       string          `json:"name"`
+	Address    string          `json:"address"`
+	ListenPort int             `json:"listen_port"`
+	Peers      []WireGuardPeer `json:"peers"`
+}
+
+// WireGuardResponse represents the API response structure for WireGuard
+type WireGuardResponse struct {
+	Interfaces []WireGuardInterface `json:"interfaces"`
+}
+
+// WireGuardPeerStatus represents the handshake health of a single peer
+type WireGuardPeerStatus struct {
+	Interface     string     `json:"interface"`
+	PublicKey     string     `json:"public_key"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	LastHandshake *time.Time `json:"last_handshake,omitempty"`
+	RxBytes       uint64     `json:"rx_bytes"`
+	TxBytes       uint64     `json:"tx_bytes"`
+	Healthy       bool       `json:"healthy"`
+}
+
+// WireGuardCollector manages WireGuard interfaces and peers pushed by the API
+type WireGuardCollector struct {
+	wgBinary       string
+	keyFile        string
+	stateDir       string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewWireGuardCollector creates a new WireGuard collector
+func NewWireGuardCollector(wgBinary, keyFile, stateDir string, logger *logrus.Logger) *WireGuardCollector {
+	return &WireGuardCollector{
+		wgBinary:       wgBinary,
+		keyFile:        keyFile,
+		stateDir:       stateDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run wg and ip with privileges
+func (wc *WireGuardCollector) SetCommandWrapper(wrapper ...string) {
+	wc.commandWrapper = wrapper
+}
+
+// PublicKey returns the server's WireGuard public key, generating a private
+// key on first use
+func (wc *WireGuardCollector) PublicKey(ctx context.Context) (string, error) {
+	privateKey, err := wc.privateKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	publicKey, err := wc.run(ctx, privateKey, wc.wgBinary, "pubkey")
+	if err != nil {
+		return "", fmt.Errorf("failed to derive WireGuard public key: %w", err)
+	}
+	return strings.TrimSpace(publicKey), nil
+}
+
+// privateKey loads the private key from the key file, generating it with
+// `wg genkey` when it does not exist yet
+func (wc *WireGuardCollector) privateKey(ctx context.Context) (string, error) {
+	data, err := os.ReadFile(wc.keyFile)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read WireGuard key: %w", err)
+	}
+
+	generated, err := wc.run(ctx, "", wc.wgBinary, "genkey")
+	if err != nil {
+		return "", fmt.Errorf("failed to generate WireGuard key: %w", err)
+	}
+	generated = strings.TrimSpace(generated)
+	if err := os.MkdirAll(filepath.Dir(wc.keyFile), 0700); err != nil {
+		return "", fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(wc.keyFile, []byte(generated+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to save WireGuard key: %w", err)
+	}
+	wc.logger.Infof("Generated WireGuard private key at %s", wc.keyFile)
+
+	return generated, nil
+}
+
+// SyncInterfaces creates, updates and removes managed WireGuard interfaces to
+// match the configuration pushed by the API
+func (wc *WireGuardCollector) SyncInterfaces(ctx context.Context, configJSON string) error {
+	var response WireGuardResponse
+	if err := json.Unmarshal([]byte(configJSON), &response); err != nil {
+		return fmt.Errorf("failed to parse WireGuard JSON: %w", err)
+	}
+
+	var managed []string
+	if err := state.Load(wc.stateDir, managedWireGuardFile, &managed); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load managed WireGuard interfaces: %w", err)
+	}
+
+	desired := make(map[string]bool)
+	var current []string
+	var failed int
+	for _, iface := range response.Interfaces {
+		if err := wc.syncInterface(ctx, iface); err != nil {
+			wc.logger.Errorf("Failed to configure WireGuard interface %s: %v", iface.Name, err)
+			failed++
+		}
+		desired[iface.Name] = true
+		current = append(current, iface.Name)
+	}
+
+	// Remove interfaces the API no longer defines
+	for _, name := range managed {
+		if desired[name] {
+			continue
+		}
+		if _, err := wc.run(ctx, "", "ip", "link", "delete", "dev", name); err != nil {
+			wc.logger.Errorf("Failed to remove WireGuard interface %s: %v", name, err)
+			current = append(current, name)
+			failed++
+		} else {
+			wc.logger.Infof("Removed WireGuard interface %s", name)
+		}
+	}
+
+	if err := state.Save(wc.stateDir, managedWireGuardFile, current); err != nil {
+		return fmt.Errorf("failed to save managed WireGuard interfaces: %w", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d WireGuard interface operations failed", failed)
+	}
+	return nil
+}
+
+// syncInterface brings a single interface in line with its configuration
+func (wc *WireGuardCollector) syncInterface(ctx context.Context, iface WireGuardInterface) error {
+	if !validInterfaceName.MatchString(iface.Name) {
+		return fmt.Errorf("invalid interface name %q (must start with wg)", iface.Name)
+	}
+	for _, peer := range iface.Peers {
+		// Values are written into a wg(8) config, so a newline could inject settings
+		if strings.ContainsAny(peer.PublicKey+peer.Endpoint+strings.Join(peer.AllowedIPs, ""), "\r\n") {
+			return fmt.Errorf("invalid peer %q: values must not contain newlines", peer.PublicKey)
+		}
+	}
+
+	privateKey, err := wc.privateKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join("/sys/class/net", iface.Name)); os.IsNotExist(err) {
+		if _, err := wc.run(ctx, "", "ip", "link", "add", "dev", iface.Name, "type", "wireguard"); err != nil {
+			return err
+		}
+		wc.logger.Infof("Created WireGuard interface %s", iface.Name)
+	}
+
+	// syncconf applies peer changes without disrupting existing sessions; the
+	// configuration is passed on stdin so the private key never hits disk twice
+	if _, err := wc.run(ctx, renderWireGuardConfig(iface, privateKey), wc.wgBinary, "syncconf", iface.Name, "/dev/stdin"); err != nil {
+		return err
+	}
+
+	if iface.Address != "" {
+		if _, err := wc.run(ctx, "", "ip", "address", "replace", iface.Address, "dev", iface.Name); err != nil {
+			return err
+		}
+	}
+
+	_, err = wc.run(ctx, "", "ip", "link", "set", "up", "dev", iface.Name)
+	return err
+}
+
+// renderWireGuardConfig builds a wg(8) configuration for an interface
+func renderWireGuardConfig(iface WireGuardInterface, privateKey string) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	if iface.ListenPort > 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", iface.ListenPort)
+	}
+
+	for _, peer := range iface.Peers {
+		b.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", peer.PublicKey)
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	return b.String()
+}
+
+// PeerStatus reports handshake health for every peer of the managed interfaces
+func (wc *WireGuardCollector) PeerStatus(ctx context.Context) ([]WireGuardPeerStatus, error) {
+	var managed []string
+	if err := state.Load(wc.stateDir, managedWireGuardFile, &managed); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var statuses []WireGuardPeerStatus
+	for _, name := range managed {
+		output, err := wc.run(ctx, "", wc.wgBinary, "show", name, "dump")
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, parseWireGuardDump(name, output, time.Now())...)
+	}
+	return statuses, nil
+}
+
+// parseWireGuardDump parses `wg show <iface> dump` output. The first line
+// describes the interface; each following line is a tab-separated peer:
+// public-key preshared-key endpoint allowed-ips latest-handshake rx tx keepalive
+func parseWireGuardDump(iface, output string, now time.Time) []WireGuardPeerStatus {
+	var statuses []WireGuardPeerStatus
+	first := true
+	lines.Scan(strings.NewReader(output), func(line string) {
+		if first {
+			first = false
+			return
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			return
+		}
+
+		status := WireGuardPeerStatus{Interface: iface, PublicKey: fields[0]}
+		if fields[2] != "(none)" {
+			status.Endpoint = fields[2]
+		}
+		if seconds, err := strconv.ParseInt(fields[4], 10, 64); err == nil && seconds > 0 {
+			handshake := time.Unix(seconds, 0)
+			status.LastHandshake = &handshake
+			status.Healthy = now.Sub(handshake) < handshakeTimeout
+		}
+		status.RxBytes, _ = strconv.ParseUint(fields[5], 10, 64)
+		status.TxBytes, _ = strconv.ParseUint(fields[6], 10, 64)
+
+		statuses = append(statuses, status)
+	})
+	return statuses
+}
+
+// run executes a privileged command, optionally feeding it stdin
+func (wc *WireGuardCollector) run(ctx context.Context, stdin string, name string, args ...string) (string, error) {
+	argv := append(append(append([]string{}, wc.commandWrapper...), name), args...)
+	output, err := command.Output(ctx, command.Cmd{Argv: argv, Stdin: stdin})
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%s failed: %w, output: %s", filepath.Base(name), err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s failed: %w", filepath.Base(name), err)
+	}
+	return string(output), nil
+}
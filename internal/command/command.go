@@ -0,0 +1,280 @@
+// Package command runs the external commands of the agent's collectors.
+//
+// Commands share a pool that bounds how many run at once, so a slow binary
+// cannot pile up processes across cycles. Firewall commands take slots from
+// a pool of their own, so rule changes never queue behind long jobs such
+// as benchmarks or backups. Each command runs with a
+// timeout, captures at most maxOutput bytes per stream and gets a scrubbed
+// environment, so the agent's API token and other secrets in its own
+// environment never reach child processes. Tools can be pinned to absolute
+// paths, and executables anyone could have replaced are refused. Commands
+// run under a remote action are recorded in the action's audit session, and
+// every command can be logged, with those that change the host appended to
+// an audit log.
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/audit"
+	"github.com/latitudesh/agent/internal/errkind"
+)
+
+// maxOutput bounds how much output is kept per stream
+const maxOutput = 8 * 1024 * 1024
+
+// errOutputLimit is returned when a command prints more than maxOutput
+var errOutputLimit = fmt.Errorf("output exceeded %d bytes", maxOutput)
+
+// waitDelay bounds how long a killed command may keep its output open, e.g.
+// through a child process that inherited it
+const waitDelay = 5 * time.Second
+
+// baseEnv is the environment every command starts from
+var baseEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"LC_ALL=C",
+}
+
+// prioritySlots is how many priority commands may run at once. Firewall
+// backends run one command at a time per backend, so a couple suffice.
+const prioritySlots = 2
+
+var (
+	mu             sync.Mutex
+	slots          = make(chan struct{}, 8)
+	priority       = make(chan struct{}, prioritySlots)
+	defaultTimeout = 2 * time.Minute
+)
+
+// Env returns the scrubbed environment commands run with, plus extra, for
+// processes started outside this package such as long-running plugins
+func Env(extra ...string) []string {
+	return append(append([]string{}, baseEnv...), extra...)
+}
+
+// Configure sets how many commands may run at once and the timeout of
+// commands whose context has no deadline. It should be called before any
+// command runs. Priority commands are not counted against limit.
+func Configure(limit int, timeout time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	slots = make(chan struct{}, limit)
+	defaultTimeout = timeout
+}
+
+// Cmd describes a command to run
+type Cmd struct {
+	Argv []string
+	// Stdin is written to the command's standard input when not empty
+	Stdin string
+	// Env adds variables to the scrubbed environment
+	Env []string
+	// Priority runs the command from the priority pool, for short
+	// commands that must not wait behind long ones, like firewall changes
+	Priority bool
+}
+
+// Output runs c and returns its standard output. Like exec.Cmd.Output, the
+// standard error of a failed command is available on the *exec.ExitError.
+func Output(ctx context.Context, c Cmd) ([]byte, error) {
+	stdout, stderr := &limitedBuffer{limit: maxOutput}, &limitedBuffer{limit: maxOutput}
+	err := run(ctx, c, stdout, stderr)
+	if err == nil && (stdout.truncated || stderr.truncated) {
+		err = errOutputLimit
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.buf.Bytes()
+	}
+	return stdout.buf.Bytes(), classify(err, stderr.buf.Bytes())
+}
+
+// CombinedOutput runs c and returns its standard output and standard error
+// interleaved
+func CombinedOutput(ctx context.Context, c Cmd) ([]byte, error) {
+	combined := &limitedBuffer{limit: maxOutput}
+	err := run(ctx, c, combined, combined)
+	if err == nil && combined.truncated {
+		err = errOutputLimit
+	}
+	return combined.buf.Bytes(), classify(err, combined.buf.Bytes())
+}
+
+// Stream runs c and passes its standard output to parse while the command
+// is still running, so large outputs are never held in memory. Output parse
+// does not read is discarded. The command's error takes precedence over the
+// error returned by parse.
+func Stream(ctx context.Context, c Cmd, parse func(stdout io.Reader) error) error {
+	reader, writer := io.Pipe()
+	stderr := &limitedBuffer{limit: maxOutput}
+
+	done := make(chan error, 1)
+	go func() {
+		err := run(ctx, c, writer, stderr)
+		writer.CloseWithError(err)
+		done <- err
+	}()
+
+	parseErr := parse(reader)
+	io.Copy(io.Discard, reader)
+	err := <-done
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.buf.Bytes()
+	}
+	if err != nil {
+		return classify(err, stderr.buf.Bytes())
+	}
+	return parseErr
+}
+
+// privilegeMessages are printed by sudo, and by tools run without the
+// privileges they need
+var privilegeMessages = []string{
+	"a password is required",
+	"is not in the sudoers file",
+	"is not allowed to execute",
+	"need to be root",
+	"must be root",
+	"permission denied",
+	"operation not permitted",
+}
+
+// classify tags the error of a command that failed for lack of privileges,
+// judging by its output. A missing executable is recognized by errkind
+// without a tag.
+func classify(err error, output []byte) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	lower := strings.ToLower(string(output))
+	for _, message := range privilegeMessages {
+		if strings.Contains(lower, message) {
+			return errkind.Wrap(errkind.Privilege, err)
+		}
+	}
+	return err
+}
+
+// run waits for a slot in c's pool and runs c. When stdout and stderr are
+// the same writer it receives both streams.
+func run(ctx context.Context, c Cmd, stdout, stderr io.Writer) error {
+	if len(c.Argv) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	argv, err := resolve(c.Argv)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	pool, timeout := slots, defaultTimeout
+	if c.Priority {
+		pool = priority
+	}
+	log, auditLog := execLog, execAuditLog
+	mu.Unlock()
+
+	select {
+	case pool <- struct{}{}:
+		defer func() { <-pool }()
+	case <-ctx.Done():
+		return fmt.Errorf("%s not started: %w", argv[0], ctx.Err())
+	}
+
+	runCtx := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(runCtx, argv[0], argv[1:]...)
+	cmd.Env = Env(c.Env...)
+	cmd.WaitDelay = waitDelay
+	if c.Stdin != "" {
+		cmd.Stdin = strings.NewReader(c.Stdin)
+	}
+
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	// A remote action's audit session keeps the start of each stream, and
+	// so do the exec log and audit log
+	recording := audit.Active(ctx)
+	observing := log != nil || auditLog != ""
+	capture := logOutput
+	if recording {
+		capture = audit.MaxCapture
+	}
+	auditStdout := &limitedBuffer{limit: capture}
+	auditStderr := &limitedBuffer{limit: capture}
+	if recording || observing {
+		cmd.Stdout = &teeWriter{stdout, auditStdout}
+		cmd.Stderr = &teeWriter{stderr, auditStderr}
+	}
+
+	startedAt := time.Now()
+	err = cmd.Run()
+	if err != nil && runCtx != ctx && runCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	command := audit.Command{
+		Argv:            cmd.Args,
+		Stdout:          auditStdout.buf.String(),
+		Stderr:          auditStderr.buf.String(),
+		OutputTruncated: auditStdout.truncated || auditStderr.truncated,
+		StartedAt:       startedAt,
+		FinishedAt:      time.Now(),
+	}
+	if recording {
+		audit.Record(ctx, command, err)
+	}
+	if observing {
+		observe(log, auditLog, command, err)
+	}
+	return err
+}
+
+// limitedBuffer keeps the first limit bytes written to it. It is safe for
+// concurrent writes from the stdout and stderr copying goroutines.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// teeWriter copies everything written to w into a limited buffer
+type teeWriter struct {
+	w    io.Writer
+	copy *limitedBuffer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	t.copy.Write(p)
+	return t.w.Write(p)
+}
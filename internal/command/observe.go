@@ -0,0 +1,166 @@
+package command
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/audit"
+	"github.com/sirupsen/logrus"
+)
+
+// logOutput bounds how much of each output stream a log line or exec audit
+// entry carries
+const logOutput = 4 * 1024
+
+var (
+	// execLog receives a debug line for every command
+	execLog *logrus.Logger
+	// execAuditLog is the file commands that change the host are appended to
+	execAuditLog string
+)
+
+// readOnlyArgs lists, per tool, arguments that only appear in commands that
+// leave the host as it is. Commands of other tools, and commands without
+// any of these arguments, are taken to change the host.
+var readOnlyArgs = map[string][]string{
+	"apt-get":          {"-s", "--simulate"},
+	"birdc":            {"show"},
+	"borgmatic":        {"list", "info"},
+	"dnf":              {"updateinfo", "check-update"},
+	"ip6tables":        {"-C", "-L", "-S"},
+	"ipmitool":         {"info", "list", "print", "sdr", "sensor", "fru"},
+	"ipset":            {"list", "test"},
+	"iptables":         {"-C", "-L", "-S"},
+	"needs-restarting": {"-r"},
+	"networkctl":       {"status", "list"},
+	"systemctl":        {"is-active", "is-enabled", "status", "show"},
+	"ufw":              {"status", "version"},
+	"veeamconfig":      {"list"},
+	"vtysh":            {"show"},
+	"wg":               {"show", "showconf", "genkey", "pubkey"},
+	"yum":              {"updateinfo", "check-update"},
+}
+
+// secretArgs lists, per tool, arguments of commands whose output holds
+// secrets, such as WireGuard private keys, and is never logged
+var secretArgs = map[string][]string{
+	"wg": {"genkey", "show", "showconf"},
+}
+
+// versionArgs print a tool's version
+var versionArgs = []string{"--version", "-V", "-v", "version"}
+
+// Observe logs every command at debug level to log, with its arguments,
+// duration, exit code and the start of its output, and appends the commands
+// that change the host to the audit log at auditLog unless it is empty.
+// Standard input is never logged as it may carry keys. It should be called
+// before any command runs.
+func Observe(log *logrus.Logger, auditLog string) {
+	mu.Lock()
+	defer mu.Unlock()
+	execLog = log
+	execAuditLog = auditLog
+}
+
+// toolArgs splits argv into the name of the tool it runs, past any sudo,
+// chroot or env wrapper, and the tool's arguments
+func toolArgs(argv []string) (string, []string) {
+	for i := 0; i < len(argv); {
+		switch name := filepath.Base(argv[i]); name {
+		case "sudo":
+			i = skipSudoOptions(argv, i+1)
+		case "chroot":
+			i += 2
+		case "env":
+			i++
+			for i < len(argv) && strings.Contains(argv[i], "=") {
+				i++
+			}
+		default:
+			return name, argv[i+1:]
+		}
+	}
+	return "", nil
+}
+
+// hasArg reports whether any argument is one of words, or starts with one
+// of them followed by a space, like the commands vtysh -c runs
+func hasArg(args, words []string) bool {
+	for _, arg := range args {
+		first, _, _ := strings.Cut(arg, " ")
+		if slices.Contains(words, first) {
+			return true
+		}
+	}
+	return false
+}
+
+// mutates reports whether the command may change the host
+func mutates(argv []string) bool {
+	tool, args := toolArgs(argv)
+	if len(args) == 1 && slices.Contains(versionArgs, args[0]) {
+		return false
+	}
+	return !hasArg(args, readOnlyArgs[tool])
+}
+
+// secret reports whether the command's output must not be logged
+func secret(argv []string) bool {
+	tool, args := toolArgs(argv)
+	return hasArg(args, secretArgs[tool])
+}
+
+// clip returns the first logOutput bytes of s and whether it was cut
+func clip(s string) (string, bool) {
+	if len(s) <= logOutput {
+		return s, false
+	}
+	return s[:logOutput], true
+}
+
+// observe logs a finished command and appends it to the exec audit log if
+// it may have changed the host
+func observe(log *logrus.Logger, auditLog string, command audit.Command, err error) {
+	if err != nil {
+		command.Error = err.Error()
+		command.ExitCode = audit.ExitCode(err)
+	}
+	if secret(command.Argv) {
+		command.Stdout, command.Stderr = "", ""
+	} else {
+		var stdoutCut, stderrCut bool
+		command.Stdout, stdoutCut = clip(command.Stdout)
+		command.Stderr, stderrCut = clip(command.Stderr)
+		command.OutputTruncated = command.OutputTruncated || stdoutCut || stderrCut
+	}
+
+	if log != nil && log.IsLevelEnabled(logrus.DebugLevel) {
+		entry := log.WithFields(logrus.Fields{
+			"component": "exec",
+			"argv":      strings.Join(command.Argv, " "),
+			"duration":  command.FinishedAt.Sub(command.StartedAt).Round(time.Millisecond).String(),
+			"exit_code": command.ExitCode,
+		})
+		if command.Stdout != "" {
+			entry = entry.WithField("stdout", command.Stdout)
+		}
+		if command.Stderr != "" {
+			entry = entry.WithField("stderr", command.Stderr)
+		}
+		if command.OutputTruncated {
+			entry = entry.WithField("output_truncated", true)
+		}
+		if command.Error != "" {
+			entry = entry.WithField("error", command.Error)
+		}
+		entry.Debug("Ran command")
+	}
+
+	if auditLog != "" && mutates(command.Argv) {
+		if err := audit.AppendLog(auditLog, command); err != nil && log != nil {
+			log.WithField("component", "exec").Warnf("Failed to write exec audit log: %v", err)
+		}
+	}
+}
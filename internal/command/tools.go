@@ -0,0 +1,223 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/latitudesh/agent/internal/errkind"
+)
+
+// versionFlags are the flags that print a tool's version, for tools that do
+// not accept --version. An empty flag means the tool has none.
+var versionFlags = map[string]string{
+	"ip":       "-V",
+	"ipmitool": "-V",
+	"ipset":    "-v",
+	"restic":   "version",
+	"sensors":  "-v",
+	"sh":       "",
+}
+
+var (
+	// pinned maps tool names to the absolute paths commands run them from
+	pinned = map[string]string{}
+	// allowlist refuses tools that are not pinned
+	allowlist bool
+)
+
+// Tool is an external tool as found and checked on the host
+type Tool struct {
+	Name    string
+	Path    string
+	Version string
+	// Err is set when the tool is missing or refused
+	Err error
+}
+
+// Pin resolves the named tools to absolute paths: a command naming a pinned
+// tool, directly or behind a wrapper such as sudo, runs that path instead of
+// searching PATH. With strict set, commands may only name pinned tools;
+// executables given by their path are still allowed. It should be called
+// before any command runs.
+func Pin(tools map[string]string, strict bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	pinned = make(map[string]string, len(tools))
+	for name, path := range tools {
+		pinned[name] = path
+	}
+	allowlist = strict
+}
+
+// CheckTools checks that every pinned tool exists under root, the root of
+// the host filesystem, and is safe to run, and reads its version
+func CheckTools(ctx context.Context, root string) []Tool {
+	mu.Lock()
+	names := make([]string, 0, len(pinned))
+	for name := range pinned {
+		names = append(names, name)
+	}
+	paths := pinned
+	mu.Unlock()
+	sort.Strings(names)
+
+	var tools []Tool
+	for _, name := range names {
+		tools = append(tools, checkTool(ctx, root, name, paths[name]))
+	}
+	return tools
+}
+
+// Probe looks a tool up the way commands naming it would find it, pinned or
+// in PATH under root, and checks it like CheckTools
+func Probe(ctx context.Context, root, name string) Tool {
+	mu.Lock()
+	path, ok := pinned[name]
+	mu.Unlock()
+	if ok {
+		return checkTool(ctx, root, name, path)
+	}
+
+	for _, dir := range searchPath() {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(filepath.Join(root, path)); err == nil {
+			return checkTool(ctx, root, name, path)
+		}
+	}
+	return Tool{Name: name, Err: &os.PathError{Op: "lookup", Path: name, Err: os.ErrNotExist}}
+}
+
+// checkTool checks that a tool exists and is safe to run, and reads its
+// version
+func checkTool(ctx context.Context, root, name, path string) Tool {
+	tool := Tool{Name: name, Path: path}
+	if tool.Err = checkExecutable(root, path); tool.Err == nil {
+		tool.Version = toolVersion(ctx, root, name, path)
+	}
+	return tool
+}
+
+// searchPath returns the directories of the PATH commands run with
+func searchPath() []string {
+	for _, v := range baseEnv {
+		if value, ok := strings.CutPrefix(v, "PATH="); ok {
+			return filepath.SplitList(value)
+		}
+	}
+	return nil
+}
+
+// toolVersion returns the first line a tool prints for its version flag
+func toolVersion(ctx context.Context, root, name, path string) string {
+	flag, ok := versionFlags[name]
+	if !ok {
+		flag = "--version"
+	}
+	if flag == "" {
+		return ""
+	}
+
+	var argv []string
+	if root != "" && root != "/" {
+		argv = []string{"chroot", root}
+	}
+	output, err := CombinedOutput(ctx, Cmd{Argv: append(argv, path, flag)})
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return first
+}
+
+// resolve replaces each executable argv names, the command and any sudo,
+// chroot or env wrapper before it, with its pinned path and checks it is
+// safe to run. Options given to sudo are skipped. Executables after chroot are checked inside its directory.
+func resolve(argv []string) ([]string, error) {
+	mu.Lock()
+	paths, strict := pinned, allowlist
+	mu.Unlock()
+
+	resolved := append([]string(nil), argv...)
+	root := ""
+	for i := 0; i < len(resolved); {
+		name := resolved[i]
+		path := name
+		if !strings.Contains(name, "/") {
+			if pinnedPath, ok := paths[name]; ok {
+				path = pinnedPath
+			} else if strict {
+				return nil, errkind.Wrap(errkind.Config, fmt.Errorf("%s is not an allowed tool, pin it in agent.tools", name))
+			}
+		}
+		if strings.Contains(path, "/") {
+			if err := checkExecutable(root, path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		resolved[i] = path
+
+		switch filepath.Base(path) {
+		case "sudo":
+			i = skipSudoOptions(resolved, i+1)
+		case "chroot":
+			if i+1 < len(resolved) {
+				root = resolved[i+1]
+			}
+			i += 2
+		case "env":
+			i++
+			for i < len(resolved) && strings.Contains(resolved[i], "=") {
+				i++
+			}
+		default:
+			return resolved, nil
+		}
+	}
+	return resolved, nil
+}
+
+// sudoValueOptions are the sudo options followed by a value
+var sudoValueOptions = []string{"-C", "-D", "-g", "-h", "-p", "-R", "-r", "-T", "-t", "-U", "-u"}
+
+// skipSudoOptions returns the index of the command sudo runs, skipping the
+// options that start at argv[i]
+func skipSudoOptions(argv []string, i int) int {
+	for i < len(argv) && strings.HasPrefix(argv[i], "-") {
+		if argv[i] == "--" {
+			return i + 1
+		}
+		if slices.Contains(sudoValueOptions, argv[i]) {
+			i++
+		}
+		i++
+	}
+	return i
+}
+
+// checkExecutable refuses an executable that anyone could have replaced:
+// one that is world-writable or in a world-writable directory without the
+// sticky bit. A missing executable returns an error satisfying
+// os.IsNotExist.
+func checkExecutable(root, path string) error {
+	full := filepath.Join(root, path)
+	info, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o002 != 0 {
+		return errkind.Wrap(errkind.Privilege, fmt.Errorf("refusing to run %s: it is world-writable", path))
+	}
+	dir, err := os.Stat(filepath.Dir(full))
+	if err != nil {
+		return err
+	}
+	if dir.Mode().Perm()&0o002 != 0 && dir.Mode()&os.ModeSticky == 0 {
+		return errkind.Wrap(errkind.Privilege, fmt.Errorf("refusing to run %s: its directory is world-writable", path))
+	}
+	return nil
+}
@@ -2,26 +2,134 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/latitudesh/agent/internal/alerts"
+	"github.com/latitudesh/agent/internal/bundle"
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/container"
+	"github.com/latitudesh/agent/internal/errkind"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/latitudesh/agent/internal/schedule"
+	"github.com/latitudesh/agent/internal/snmp"
+	"github.com/latitudesh/agent/internal/tasks"
 	"gopkg.in/yaml.v3"
 )
 
+// validHostname matches fully qualified domain names
+var validHostname = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// validInterface matches a Linux network interface name
+var validInterface = regexp.MustCompile(`^[a-zA-Z0-9_.:@-]{1,15}$`)
+
+// validIptablesChain matches an iptables chain name, at most 28 characters
+var validIptablesChain = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,28}$`)
+
+// validNftTable matches an nftables table name usable unquoted
+var validNftTable = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,63}$`)
+
+// validPCRSelection matches a tpm2-tools PCR selection of one bank, e.g.
+// "sha256:0,1,7"
+var validPCRSelection = regexp.MustCompile(`^(sha1|sha256|sha384|sha512):([0-9]|1[0-9]|2[0-3])(,([0-9]|1[0-9]|2[0-3]))*$`)
+
 // Config represents the agent configuration
 type Config struct {
-	Agent    AgentConfig    `yaml:"agent"`
-	Latitude LatitudeConfig `yaml:"latitude"`
-	Firewall FirewallConfig `yaml:"firewall"`
-	Logging  LoggingConfig  `yaml:"logging"`
+	Agent        AgentConfig        `yaml:"agent"`
+	Latitude     LatitudeConfig     `yaml:"latitude"`
+	Firewall     FirewallConfig     `yaml:"firewall"`
+	Logging      LoggingConfig      `yaml:"logging"`
+	Container    ContainerConfig    `yaml:"container"`
+	Actions      ActionsConfig      `yaml:"actions"`
+	Users        UsersConfig        `yaml:"users"`
+	Power        PowerConfig        `yaml:"power"`
+	Patch        PatchConfig        `yaml:"patch"`
+	WireGuard    WireGuardConfig    `yaml:"wireguard"`
+	Network      NetworkConfig      `yaml:"network"`
+	DNS          DNSConfig          `yaml:"dns"`
+	Tags         TagsConfig         `yaml:"tags"`
+	Notify       NotifyConfig       `yaml:"notify"`
+	Alerts       AlertsConfig       `yaml:"alerts"`
+	Speedtest    SpeedtestConfig    `yaml:"speedtest"`
+	DiskBench    DiskBenchConfig    `yaml:"disk_benchmark"`
+	BMC          BMCConfig          `yaml:"bmc"`
+	Crash        CrashConfig        `yaml:"crash"`
+	Tasks        TasksConfig        `yaml:"tasks"`
+	UserData     UserDataConfig     `yaml:"user_data"`
+	Files        FilesConfig        `yaml:"files"`
+	Security     SecurityConfig     `yaml:"security"`
+	DDoS         DDoSConfig         `yaml:"ddos"`
+	Backup       BackupConfig       `yaml:"backup"`
+	BGP          BGPConfig          `yaml:"bgp"`
+	SNMP         SNMPConfig         `yaml:"snmp"`
+	Plugins      PluginsConfig      `yaml:"plugins"`
+	LocalAPI     LocalAPIConfig     `yaml:"local_api"`
+	Reconcile    ReconcileConfig    `yaml:"reconcile"`
+	Identity     IdentityConfig     `yaml:"identity"`
+	Compliance   ComplianceConfig   `yaml:"compliance"`
+	History      HistoryConfig      `yaml:"history"`
+	Relay        RelayConfig        `yaml:"relay"`
+	Reputation   ReputationConfig   `yaml:"reputation"`
+	Profiles     ProfilesConfig     `yaml:"profiles"`
+	DNSHealth    DNSHealthConfig    `yaml:"dns_health"`
+	Neighbors    NeighborsConfig    `yaml:"neighbors"`
+	Maintenance  MaintenanceConfig  `yaml:"maintenance"`
+	Rulesets     RulesetsConfig     `yaml:"scheduled_rulesets"`
+	Heartbeat    HeartbeatConfig    `yaml:"heartbeat"`
+	AirGapped    AirGappedConfig    `yaml:"air_gapped"`
+	Faults       FaultsConfig       `yaml:"fault_injection"`
+	Devices      DevicesConfig      `yaml:"device_events"`
+	Trends       TrendsConfig       `yaml:"hardware_trends"`
+	SelfTests    SelfTestsConfig    `yaml:"smart_self_tests"`
+	MemoryTest   MemoryTestConfig   `yaml:"memory_test"`
+	Durations    DurationsConfig    `yaml:"duration_slo"`
+	EventQueue   EventQueueConfig   `yaml:"event_queue"`
+	DiskForecast DiskForecastConfig `yaml:"disk_forecast"`
+	Attestation  AttestationConfig  `yaml:"attestation"`
 }
 
 // AgentConfig contains general agent settings
 type AgentConfig struct {
 	Interval string `yaml:"interval" default:"30s"`
 	LogLevel string `yaml:"log_level" default:"info"`
+	StateDir string `yaml:"state_dir" default:"/var/lib/lsh-agent"`
+	// FailurePolicy controls what happens after repeated failed cycles:
+	// "retry" keeps running forever, "exit" exits non-zero once
+	// MaxConsecutiveFailures is reached so systemd can restart or alert
+	FailurePolicy          string `yaml:"failure_policy" default:"retry"`
+	MaxConsecutiveFailures int    `yaml:"max_consecutive_failures" default:"5"`
+	// MaxCommands bounds how many external commands run at once across all
+	// collectors, and CommandTimeout how long each may run unless the
+	// collector sets its own limit
+	MaxCommands    int    `yaml:"max_commands" default:"8"`
+	CommandTimeout string `yaml:"command_timeout" default:"2m"`
+	// Tools pins external tools to absolute paths, so commands never find
+	// them through PATH. The ufw, wg and ipmitool binaries of enabled
+	// features are pinned as well. With ExecAllowlist set, commands may only
+	// run pinned tools.
+	Tools         map[string]string `yaml:"tools"`
+	ExecAllowlist bool              `yaml:"exec_allowlist" default:"false"`
+	// ExecAuditLog is the file every external command that may change the
+	// host is appended to. Empty disables it; all commands are still logged
+	// at debug level.
+	ExecAuditLog string `yaml:"exec_audit_log" default:"/var/log/lsh-agent-exec.log"`
+	// Sudo controls whether privileged commands run through sudo: "auto"
+	// uses it unless the agent runs as root, "always" and "never" force
+	// it. SudoPath and SudoArgs set the sudo command, e.g. to pass -n.
+	Sudo     string   `yaml:"sudo" default:"auto"`
+	SudoPath string   `yaml:"sudo_path" default:"sudo"`
+	SudoArgs []string `yaml:"sudo_args"`
+	// Backend is "host" to manage the real host, or "mock" to simulate UFW
+	// and host health data in-process, e.g. for demos and trying
+	// configurations without root or real hardware
+	Backend string `yaml:"backend" default:"host"`
 }
 
 // LatitudeConfig contains Latitude.sh API configuration
@@ -31,15 +139,74 @@ type LatitudeConfig struct {
 	ProjectID   string `yaml:"project_id"`
 	FirewallID  string `yaml:"firewall_id"`
 	PublicIP    string `yaml:"public_ip"`
+	// RelayURL routes API requests through a relay agent, e.g. http://10.0.0.1:8480
+	RelayURL string `yaml:"relay_url"`
+	// ServerID is the Latitude.sh server, discovered from the metadata
+	// service when not set
+	ServerID string `yaml:"server_id"`
+	// MetadataURL is the provisioning metadata service used to discover
+	// identifiers left unset; empty disables discovery
+	MetadataURL string `yaml:"metadata_url" default:"http://169.254.169.254/latitude/v1/metadata"`
+	// TokenEndpoint lists the API scopes of the bearer token, checked at
+	// startup; empty skips the check
+	TokenEndpoint string `yaml:"token_endpoint" default:"https://api.latitude.sh/agent/token"`
 }
 
 // FirewallConfig contains firewall-specific settings
 type FirewallConfig struct {
-	Enabled         bool   `yaml:"enabled" default:"true"`
-	UFWBinary       string `yaml:"ufw_binary" default:"/usr/sbin/ufw"`
-	CaseSensitive   bool   `yaml:"case_sensitive" default:"false"`
-	TempFile        string `yaml:"temp_file" default:"/tmp/lsh_firewall_temp.json"`
-	OutputFile      string `yaml:"output_file" default:"/tmp/lsh_firewall.json"`
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Backend is the tool rules are applied with: "ufw", "nftables" or
+	// "iptables"
+	Backend   string `yaml:"backend" default:"ufw"`
+	UFWBinary string `yaml:"ufw_binary" default:"/usr/sbin/ufw"`
+	NftBinary string `yaml:"nft_binary" default:"/usr/sbin/nft"`
+	// NftTable is the inet table the nftables backend manages
+	NftTable        string `yaml:"nft_table" default:"lsh_agent"`
+	IptablesBinary  string `yaml:"iptables_binary" default:"/usr/sbin/iptables"`
+	Ip6tablesBinary string `yaml:"ip6tables_binary" default:"/usr/sbin/ip6tables"`
+	// IptablesChain is the chain the iptables backend manages
+	IptablesChain string `yaml:"iptables_chain" default:"LSH-AGENT"`
+	CaseSensitive bool   `yaml:"case_sensitive" default:"false"`
+	TempFile      string `yaml:"temp_file" default:"/tmp/lsh_firewall_temp.json"`
+	OutputFile    string `yaml:"output_file" default:"/tmp/lsh_firewall.json"`
+	// Mode is "enforce" to apply the API's rules to UFW, or "readonly" to
+	// leave UFW untouched and only report drift from the API's rules
+	Mode string `yaml:"mode" default:"enforce"`
+	// ComplianceEndpoint receives the drift reports of readonly mode
+	ComplianceEndpoint string `yaml:"compliance_endpoint" default:"https://api.latitude.sh/agent/firewall-compliance"`
+	// Watch resynchronizes as soon as UFW's rules files are edited outside
+	// the agent, instead of at the next interval
+	Watch bool `yaml:"watch" default:"false"`
+	// Tenants are additional firewalls managed on a shared host, each
+	// limited to an interface or destination addresses
+	Tenants []FirewallTenantConfig `yaml:"tenants"`
+	// Canary verifies risky rule changes after applying them and reverts
+	// them if verification fails
+	Canary FirewallCanaryConfig `yaml:"canary"`
+}
+
+// FirewallCanaryConfig contains settings for applying risky rule changes in
+// canary mode
+type FirewallCanaryConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// MaxRemovals is how many rules a change may remove without canary mode
+	MaxRemovals int `yaml:"max_removals" default:"10"`
+	// SSHPort puts any change to rules covering it in canary mode
+	SSHPort int `yaml:"ssh_port" default:"22"`
+	// Grace is how long verification may fail before changes are reverted
+	Grace string `yaml:"grace" default:"60s"`
+}
+
+// FirewallTenantConfig maps another firewall ID to the traffic it governs
+type FirewallTenantConfig struct {
+	FirewallID string `yaml:"firewall_id"`
+	// PublicIP identifies the tenant to the API; the host's public_ip
+	// when empty
+	PublicIP string `yaml:"public_ip"`
+	// Interface limits the firewall's rules to traffic arriving on it
+	Interface string `yaml:"interface"`
+	// To limits the firewall's rules to traffic addressed to an IP or CIDR
+	To string `yaml:"to"`
 }
 
 // LoggingConfig contains logging configuration
@@ -48,6 +215,594 @@ type LoggingConfig struct {
 	Format string `yaml:"format" default:"text"`
 }
 
+// ContainerConfig contains settings for running the agent inside a container
+type ContainerConfig struct {
+	// Mode is "auto" (detect), "enabled" or "disabled"
+	Mode     string `yaml:"mode" default:"auto"`
+	HostRoot string `yaml:"host_root" default:"/host"`
+}
+
+// Active reports whether the agent should operate in container mode
+func (c ContainerConfig) Active() bool {
+	switch c.Mode {
+	case "enabled":
+		return true
+	case "disabled":
+		return false
+	default:
+		return container.Detect()
+	}
+}
+
+// HostPath returns the path at which a host file is visible to the agent
+func (c ContainerConfig) HostPath(path string) string {
+	if c.Active() {
+		return filepath.Join(c.HostRoot, path)
+	}
+	return path
+}
+
+// ActionsConfig contains settings for remote actions queued from the Latitude console
+type ActionsConfig struct {
+	Enabled      bool     `yaml:"enabled" default:"false"`
+	Endpoint     string   `yaml:"endpoint" default:"https://api.latitude.sh/agent/actions"`
+	PublicKey    string   `yaml:"public_key"`
+	Allowed      []string `yaml:"allowed"`
+	Timeout      string   `yaml:"timeout" default:"5m"`
+	PollInterval string   `yaml:"poll_interval" default:"30s"`
+	AuditLog     string   `yaml:"audit_log" default:"/var/log/lsh-agent-actions.log"`
+}
+
+// UsersConfig contains settings for local user account provisioning
+type UsersConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/users"`
+	Interval string `yaml:"interval" default:"5m"`
+}
+
+// PowerConfig contains safety settings for API-initiated reboots and shutdowns
+type PowerConfig struct {
+	// Windows restricts when power actions may run, e.g. "Sat,Sun 02:00-06:00".
+	// Empty allows them at any time.
+	Windows []string `yaml:"windows"`
+	Delay   string   `yaml:"delay" default:"1m"`
+}
+
+// PatchConfig contains settings for automatic OS security patching
+type PatchConfig struct {
+	Enabled  bool     `yaml:"enabled" default:"false"`
+	Endpoint string   `yaml:"endpoint" default:"https://api.latitude.sh/agent/patches"`
+	Windows  []string `yaml:"windows"`
+	Interval string   `yaml:"interval" default:"1h"`
+	Timeout  string   `yaml:"timeout" default:"30m"`
+}
+
+// WireGuardConfig contains settings for API-managed WireGuard tunnels
+type WireGuardConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/wireguard"`
+	Interval string `yaml:"interval" default:"1m"`
+	WGBinary string `yaml:"wg_binary" default:"/usr/bin/wg"`
+	KeyFile  string `yaml:"key_file" default:"/etc/lsh-agent/wireguard.key"`
+}
+
+// NetworkConfig contains settings for syncing additional IPs, VLANs and routes
+type NetworkConfig struct {
+	Enabled   bool   `yaml:"enabled" default:"false"`
+	Endpoint  string `yaml:"endpoint" default:"https://api.latitude.sh/agent/network"`
+	Interval  string `yaml:"interval" default:"5m"`
+	ConfigDir string `yaml:"config_dir" default:"/etc/systemd/network"`
+	// DryRun logs the changes that would be made without applying them
+	DryRun bool `yaml:"dry_run" default:"false"`
+	// RollbackAfter is how long to wait after applying before checking API
+	// connectivity; the previous configuration is restored if it fails
+	RollbackAfter string `yaml:"rollback_after" default:"30s"`
+}
+
+// DNSConfig contains settings for registering the server's A/AAAA records
+type DNSConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Provider is "latitude" (register through the API) or "nsupdate"
+	Provider string `yaml:"provider" default:"latitude"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/dns"`
+	// Hostname is the fully qualified name to register; defaults to the system hostname
+	Hostname string         `yaml:"hostname"`
+	TTL      int            `yaml:"ttl" default:"300"`
+	Interval string         `yaml:"interval" default:"1m"`
+	Refresh  string         `yaml:"refresh" default:"24h"`
+	NSUpdate NSUpdateConfig `yaml:"nsupdate"`
+}
+
+// NSUpdateConfig contains settings for RFC 2136 dynamic DNS updates
+type NSUpdateConfig struct {
+	Server  string `yaml:"server"`
+	Zone    string `yaml:"zone"`
+	KeyFile string `yaml:"key_file"`
+}
+
+// TagsConfig contains settings for syncing server tags and metadata with the API
+type TagsConfig struct {
+	Enabled  bool              `yaml:"enabled" default:"false"`
+	Endpoint string            `yaml:"endpoint" default:"https://api.latitude.sh/agent/tags"`
+	Interval string            `yaml:"interval" default:"5m"`
+	Tags     []string          `yaml:"tags"`
+	Metadata map[string]string `yaml:"metadata"`
+	// DropInDir holds additional YAML files with tags and metadata
+	DropInDir string `yaml:"drop_in_dir" default:"/etc/lsh-agent/tags.d"`
+	// OutputFile is where local and API-side tags are written for local tooling
+	OutputFile string `yaml:"output_file" default:"/run/lsh-agent/tags.json"`
+}
+
+// NotifyConfig contains webhook notification settings
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// RepeatInterval suppresses identical notifications within this period
+	RepeatInterval string `yaml:"repeat_interval" default:"1h"`
+}
+
+// WebhookConfig describes a single webhook target
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Format is "generic" (event JSON) or "slack" (incoming webhook message)
+	Format string `yaml:"format" default:"generic"`
+	// Events limits the webhook to the listed events; empty means all
+	Events []string `yaml:"events"`
+}
+
+// AlertsConfig contains settings for local alert rule evaluation
+type AlertsConfig struct {
+	Enabled  bool              `yaml:"enabled" default:"false"`
+	Endpoint string            `yaml:"endpoint" default:"https://api.latitude.sh/agent/alerts"`
+	Interval string            `yaml:"interval" default:"30s"`
+	Rules    []AlertRuleConfig `yaml:"rules"`
+}
+
+// AlertRuleConfig describes a threshold alert, e.g. expr "load5 > 8" for "10m"
+type AlertRuleConfig struct {
+	Name     string `yaml:"name"`
+	Expr     string `yaml:"expr"`
+	For      string `yaml:"for" default:"5m"`
+	Severity string `yaml:"severity" default:"warning"`
+}
+
+// SpeedtestConfig contains settings for on-demand network benchmarks
+type SpeedtestConfig struct {
+	// Endpoint lists speedtest targets and receives results
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/speedtest"`
+	// Targets overrides the targets provided by the API
+	Targets []SpeedtestTarget `yaml:"targets"`
+	// Duration limits the download test per target
+	Duration string `yaml:"duration" default:"10s"`
+}
+
+// SpeedtestTarget is a download URL used to benchmark a region
+type SpeedtestTarget struct {
+	Region string `yaml:"region"`
+	URL    string `yaml:"url"`
+}
+
+// DiskBenchConfig contains settings for on-demand disk benchmarks
+type DiskBenchConfig struct {
+	// Endpoint receives benchmark results
+	Endpoint  string `yaml:"endpoint" default:"https://api.latitude.sh/agent/benchmarks"`
+	FioBinary string `yaml:"fio_binary" default:"/usr/bin/fio"`
+	// Path is the default directory or block device to benchmark
+	Path string `yaml:"path" default:"/var/tmp"`
+	// Size of the test file written in a directory
+	Size string `yaml:"size" default:"1G"`
+	// Runtime limits each workload
+	Runtime string `yaml:"runtime" default:"30s"`
+}
+
+// BMCConfig contains settings for BMC health checks over IPMI
+type BMCConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/bmc"`
+	Interval string `yaml:"interval" default:"15m"`
+	Host     string `yaml:"host"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Interface is the ipmitool interface, usually "lanplus"
+	Interface      string `yaml:"interface" default:"lanplus"`
+	IPMIToolBinary string `yaml:"ipmitool_binary" default:"/usr/bin/ipmitool"`
+	// SELWarnPercent logs a warning when the SEL is fuller than this
+	SELWarnPercent int `yaml:"sel_warn_percent" default:"80"`
+}
+
+// CrashConfig contains settings for kdump and crash dump reporting
+type CrashConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/crashes"`
+	Interval string `yaml:"interval" default:"10m"`
+	CrashDir string `yaml:"crash_dir" default:"/var/crash"`
+	// UploadKernelLog includes the compressed tail of each dump's dmesg
+	UploadKernelLog bool `yaml:"upload_kernel_log" default:"false"`
+}
+
+// TasksConfig contains settings for recurring tasks run by the agent
+type TasksConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Endpoint provides API-defined tasks and receives task results
+	Endpoint        string `yaml:"endpoint" default:"https://api.latitude.sh/agent/tasks"`
+	RefreshInterval string `yaml:"refresh_interval" default:"5m"`
+	// ScriptDir is the only directory API-defined tasks may run scripts from
+	ScriptDir      string       `yaml:"script_dir" default:"/etc/lsh-agent/tasks.d"`
+	DefaultTimeout string       `yaml:"default_timeout" default:"10m"`
+	Tasks          []TaskConfig `yaml:"tasks"`
+}
+
+// TaskConfig describes a locally defined recurring task
+type TaskConfig struct {
+	Name     string   `yaml:"name"`
+	Command  string   `yaml:"command"`
+	Args     []string `yaml:"args"`
+	Schedule string   `yaml:"schedule"`
+	Timeout  string   `yaml:"timeout"`
+}
+
+// UserDataConfig contains settings for first-boot provisioning scripts
+type UserDataConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/user-data"`
+	// ScriptDir is where scripts are written on the host before running
+	ScriptDir string `yaml:"script_dir" default:"/var/lib/lsh-agent/user-data"`
+	// LogFile receives the output of every script on the host
+	LogFile string `yaml:"log_file" default:"/var/log/lsh-agent-user-data.log"`
+	// Timeout limits each script
+	Timeout string `yaml:"timeout" default:"30m"`
+}
+
+// FilesConfig contains settings for API-managed files such as certificates
+type FilesConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/files"`
+	Interval string `yaml:"interval" default:"5m"`
+	// AllowedPaths lists the directories managed files may be installed in
+	AllowedPaths []string `yaml:"allowed_paths"`
+	// AllowedHooks lists the programs post-update hooks may run
+	AllowedHooks []string `yaml:"allowed_hooks"`
+}
+
+// SecurityConfig contains settings for the intrusion detection scanner
+type SecurityConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/security"`
+	Interval string `yaml:"interval" default:"1h"`
+	// ScanPaths are searched for world-writable setuid/setgid files
+	ScanPaths []string `yaml:"scan_paths"`
+	// MinerSignatures are matched against process command lines; empty uses
+	// the built-in list
+	MinerSignatures []string `yaml:"miner_signatures"`
+	// AllowedModules may be loaded without being part of the module baseline
+	AllowedModules []string `yaml:"allowed_modules"`
+}
+
+// DDoSConfig contains settings for traffic anomaly detection
+type DDoSConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Endpoint receives anomaly events; mitigation rules are fetched from
+	// Endpoint + "/mitigations"
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/ddos"`
+	Interval string `yaml:"interval" default:"10s"`
+	// Interfaces to watch; empty watches every interface except loopback
+	Interfaces []string `yaml:"interfaces"`
+	// Multiplier is how far above its baseline a rate must be to be anomalous
+	Multiplier  float64 `yaml:"multiplier" default:"5"`
+	MinPPS      float64 `yaml:"min_pps" default:"50000"`
+	MinMbps     float64 `yaml:"min_mbps" default:"500"`
+	MinConnRate float64 `yaml:"min_conn_rate" default:"500"`
+	Warmup      string  `yaml:"warmup" default:"15m"`
+	Cooldown    string  `yaml:"cooldown" default:"5m"`
+	// Mitigate applies the API's pre-approved rate limits during anomalies
+	Mitigate bool `yaml:"mitigate" default:"false"`
+}
+
+// BackupConfig contains settings for backup status reporting
+type BackupConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/backups"`
+	Interval string `yaml:"interval" default:"1h"`
+	// MaxAge is how old the last successful backup may be before it is stale
+	MaxAge string `yaml:"max_age" default:"26h"`
+	// ResticEnvFile sets RESTIC_REPOSITORY and RESTIC_PASSWORD_FILE for restic
+	ResticEnvFile string `yaml:"restic_env_file" default:"/etc/lsh-agent/restic.env"`
+	Timeout       string `yaml:"timeout" default:"5m"`
+}
+
+// BGPConfig contains settings for BGP session monitoring
+type BGPConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/bgp"`
+	Interval string `yaml:"interval" default:"1m"`
+}
+
+// SNMPConfig contains settings for the SNMP AgentX sub-agent
+type SNMPConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// AgentXAddress is the master agent's unix socket or "tcp:host:port"
+	AgentXAddress string `yaml:"agentx_address" default:"/var/agentx/master"`
+	// BaseOID is the subtree the health metrics are served under
+	BaseOID string `yaml:"base_oid" default:".1.3.6.1.4.1.8072.9999.9999.1"`
+}
+
+// PluginsConfig contains settings for external plugins
+type PluginsConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Dir is searched for plugin executables
+	Dir      string `yaml:"dir" default:"/usr/lib/lsh-agent/plugins"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/plugins"`
+	// Interval applies to plugins whose manifest does not set one
+	Interval string `yaml:"interval" default:"1m"`
+	// Timeout bounds every call to a plugin
+	Timeout string `yaml:"timeout" default:"30s"`
+	// Disabled lists plugin names not to load
+	Disabled []string `yaml:"disabled"`
+}
+
+// LocalAPIConfig contains settings for the local read-only REST API
+type LocalAPIConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Listen must be a loopback address, as the API is unauthenticated
+	Listen string `yaml:"listen" default:"127.0.0.1:9390"`
+	// Pprof serves the Go profiling handlers under /debug/pprof/
+	Pprof bool `yaml:"pprof" default:"false"`
+}
+
+// ReconcileConfig contains settings for the API reconciliation report
+type ReconcileConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/reconcile"`
+	Interval string `yaml:"interval" default:"1h"`
+}
+
+// IdentityConfig contains settings for hostname and reverse DNS tracking
+type IdentityConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/identity"`
+	Interval string `yaml:"interval" default:"15m"`
+}
+
+// ComplianceConfig contains settings for sysctl and kernel module audits
+type ComplianceConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/compliance"`
+	Interval string `yaml:"interval" default:"5m"`
+	// Sysctls and ForbiddenModules are combined with the policy from the
+	// API; local sysctl values take precedence
+	Sysctls          map[string]string `yaml:"sysctls"`
+	ForbiddenModules []string          `yaml:"forbidden_modules"`
+	// Enforce sets sysctls that differ from the policy
+	Enforce bool `yaml:"enforce" default:"false"`
+}
+
+// HistoryConfig contains settings for the local metrics history
+type HistoryConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Interval string `yaml:"interval" default:"1m"`
+	// Retention is how far back samples are kept
+	Retention string `yaml:"retention" default:"24h"`
+}
+
+// RelayConfig contains settings for relaying API traffic for other agents
+type RelayConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Listen is the address peers connect to, on the private network
+	Listen string `yaml:"listen"`
+	// AllowedSources lists the networks peers may connect from
+	AllowedSources []string `yaml:"allowed_sources"`
+	// AllowedHosts lists the "host:port" upstreams peers may reach
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// ReputationConfig contains settings for blocking threat intelligence feeds
+type ReputationConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Interval string `yaml:"interval" default:"1h"`
+	// LatitudeFeed subscribes to the feed published by Latitude.sh at Endpoint
+	LatitudeFeed bool   `yaml:"latitude_feed" default:"true"`
+	Endpoint     string `yaml:"endpoint" default:"https://api.latitude.sh/agent/reputation"`
+	// Feeds are additional plain-text feeds with one IP or CIDR per line
+	Feeds []ReputationFeed `yaml:"feeds"`
+	// SetName is the ipset holding IPv4 entries; IPv6 uses <name>-v6
+	SetName string `yaml:"set_name" default:"lsh-reputation"`
+	// Chain is where the deny rule is inserted
+	Chain      string `yaml:"chain" default:"ufw-before-input"`
+	MaxEntries int    `yaml:"max_entries" default:"262144"`
+}
+
+// ReputationFeed is a custom threat intelligence feed
+type ReputationFeed struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+// ProfilesConfig contains settings for workload profiles, API-defined
+// bundles of firewall rules, sysctls and service checks
+type ProfilesConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/profiles"`
+	Interval string `yaml:"interval" default:"5m"`
+}
+
+// DNSHealthConfig contains settings for per-resolver DNS health checks
+type DNSHealthConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/dns-health"`
+	Interval string `yaml:"interval" default:"5m"`
+	// Query is the name each probe looks up
+	Query string `yaml:"query" default:"api.latitude.sh"`
+	// Timeout bounds a single probe
+	Timeout string `yaml:"timeout" default:"2s"`
+	// Probes is how many queries are sent to each resolver per check
+	Probes int `yaml:"probes" default:"3"`
+}
+
+// NeighborsConfig contains settings for gateway MAC and neighbor table
+// monitoring
+type NeighborsConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/neighbors"`
+	Interval string `yaml:"interval" default:"1m"`
+	// OverflowPercent is how full the neighbor table may get, relative to
+	// gc_thresh3, before it is reported
+	OverflowPercent float64 `yaml:"overflow_percent" default:"90"`
+	// KnownBadDrivers are NIC driver and firmware versions reported as
+	// problems
+	KnownBadDrivers []BadDriverConfig `yaml:"known_bad_drivers"`
+}
+
+// BadDriverConfig is a NIC driver version known to misbehave. Versions
+// match as a prefix; an empty version or firmware matches any.
+type BadDriverConfig struct {
+	Driver   string `yaml:"driver"`
+	Version  string `yaml:"version"`
+	Firmware string `yaml:"firmware"`
+	Reason   string `yaml:"reason"`
+}
+
+// MaintenanceConfig contains the planned maintenance windows during which
+// health alerts are suppressed
+type MaintenanceConfig struct {
+	// Windows are recurring windows, e.g. "Sat,Sun 02:00-06:00". The API can
+	// announce further one-off windows.
+	Windows []string `yaml:"windows"`
+}
+
+// RulesetsConfig contains settings for rulesets the API schedules to apply
+// at a later time
+type RulesetsConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// Endpoint receives acknowledgments and the firewall state before and
+	// after a scheduled ruleset is applied
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/rulesets"`
+}
+
+// HeartbeatConfig contains settings for the liveness heartbeat
+type HeartbeatConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/heartbeat"`
+	// Interval between heartbeats, from 10s to 30s
+	Interval string `yaml:"interval" default:"15s"`
+}
+
+// AirGappedConfig contains settings for servers that take their firewall
+// rules from a signed local bundle instead of the API
+type AirGappedConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// BundlePath is the signed rule bundle, delivered by configuration
+	// management
+	BundlePath string `yaml:"bundle_path" default:"/etc/lsh-agent/rules.bundle"`
+	// PublicKey is the base64 ed25519 key bundles are signed with
+	PublicKey string `yaml:"public_key"`
+}
+
+// FaultsConfig injects failures so retry, rollback and alerting can be
+// verified before the agent is trusted in production. It must never be
+// enabled on production servers.
+type FaultsConfig struct {
+	Enabled bool `yaml:"enabled" default:"false"`
+	// APIDropPercent is the share of API requests that fail as if the
+	// connection dropped
+	APIDropPercent int `yaml:"api_drop_percent" default:"0"`
+	// UFWDelay is added before every UFW command
+	UFWDelay string `yaml:"ufw_delay" default:"0s"`
+	// CorruptRule makes one added rule of every firewall sync fail
+	CorruptRule bool `yaml:"corrupt_rule" default:"false"`
+}
+
+// DevicesConfig contains settings for reporting disks and network
+// interfaces as soon as they are added or removed
+type DevicesConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/devices"`
+}
+
+// TrendsConfig contains settings for disk and CPU temperature and SMART
+// counter trends
+type TrendsConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/hardware-trends"`
+	Interval string `yaml:"interval" default:"1h"`
+	// Window is how much history trends are computed over
+	Window string `yaml:"window" default:"336h"`
+}
+
+// SelfTestsConfig contains settings for SMART self-tests requested by the
+// API or the CLI
+type SelfTestsConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/smart-self-tests"`
+	// PollInterval is how often running tests are checked for completion
+	PollInterval string `yaml:"poll_interval" default:"1m"`
+}
+
+// MemoryTestConfig contains settings for memory tests requested by the API,
+// which only run during maintenance windows
+type MemoryTestConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/memory-tests"`
+	// MemtesterBinary is the path to memtester
+	MemtesterBinary string `yaml:"memtester_binary" default:"/usr/bin/memtester"`
+	// FreeFraction is the share of the available memory tested
+	FreeFraction float64 `yaml:"free_fraction" default:"0.5"`
+	// Loops is the number of passes, unless the request sets one
+	Loops int `yaml:"loops" default:"1"`
+	// Timeout bounds a test; it is stopped and reported unfinished after
+	Timeout string `yaml:"timeout" default:"2h"`
+}
+
+// DurationsConfig contains settings for the percentiles of API call, UFW
+// and collector durations, and for flagging regressions after updates
+type DurationsConfig struct {
+	// Enabled flags regressions; percentiles are always tracked
+	Enabled bool `yaml:"enabled" default:"true"`
+	// Window is how long durations count towards percentiles
+	Window string `yaml:"window" default:"1h"`
+	// RegressionFactor is how many times its p95 before the update an
+	// operation's p95 must reach to be flagged
+	RegressionFactor float64 `yaml:"regression_factor" default:"1.5"`
+}
+
+// EventQueueConfig contains settings for the persistent queue of outbound
+// events: drift, security, inventory and action results
+type EventQueueConfig struct {
+	// Enabled journals events in the state directory until the API accepts
+	// them, instead of sending them once
+	Enabled bool `yaml:"enabled" default:"false"`
+	// MaxEvents bounds the queue; the oldest events are dropped past it
+	MaxEvents int `yaml:"max_events" default:"10000"`
+	// MaxAge drops events still undelivered after it
+	MaxAge string `yaml:"max_age" default:"168h"`
+	// RetryInterval is how often delivery of queued events is retried
+	RetryInterval string `yaml:"retry_interval" default:"30s"`
+	// MaxAttempts drops an event the API rejected this many times
+	MaxAttempts int `yaml:"max_attempts" default:"5"`
+}
+
+// DiskForecastConfig contains settings for projecting when filesystems
+// fill up from their growth rate
+type DiskForecastConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/disk-forecast"`
+	Interval string `yaml:"interval" default:"15m"`
+	// Window is how much history growth rates are computed over
+	Window string `yaml:"window" default:"168h"`
+	// HorizonDays flags a filesystem projected to fill up within it
+	HorizonDays float64 `yaml:"horizon_days" default:"14"`
+}
+
+// AttestationConfig contains settings for binding the instance identity to
+// a TPM-resident key
+type AttestationConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Endpoint string `yaml:"endpoint" default:"https://api.latitude.sh/agent/attestation"`
+	// KeyHandle is the persistent TPM handle of the attestation key, which
+	// is created there when missing
+	KeyHandle string `yaml:"key_handle" default:"0x81010002"`
+	// PCRs are the PCR bank and indexes quoted, in tpm2-tools syntax
+	PCRs string `yaml:"pcrs" default:"sha256:0,1,2,3,4,5,6,7"`
+}
+
 // LoadConfig loads configuration from file and environment variables
 func LoadConfig(configPath string) (*Config, error) {
 	config := &Config{}
@@ -55,33 +810,254 @@ func LoadConfig(configPath string) (*Config, error) {
 	// Set defaults
 	config.Agent.Interval = "30s"
 	config.Agent.LogLevel = "info"
+	config.Agent.StateDir = "/var/lib/lsh-agent"
+	config.Agent.FailurePolicy = "retry"
+	config.Agent.MaxConsecutiveFailures = 5
+	config.Agent.MaxCommands = 8
+	config.Agent.CommandTimeout = "2m"
+	config.Agent.ExecAuditLog = "/var/log/lsh-agent-exec.log"
+	config.Agent.Sudo = "auto"
+	config.Agent.SudoPath = "sudo"
+	config.Agent.Backend = "host"
+	config.Agent.Tools = map[string]string{
+		"sudo": "/usr/bin/sudo",
+		"sh":   "/bin/sh",
+		"ip":   "/sbin/ip",
+	}
+	config.Agent.ExecAllowlist = false
 	config.Latitude.APIEndpoint = "https://api.latitude.sh/agent/ping"
+	config.Latitude.MetadataURL = "http://169.254.169.254/latitude/v1/metadata"
+	config.Latitude.TokenEndpoint = "https://api.latitude.sh/agent/token"
 	config.Firewall.Enabled = true
+	config.Firewall.Backend = "ufw"
 	config.Firewall.UFWBinary = "/usr/sbin/ufw"
+	config.Firewall.NftBinary = "/usr/sbin/nft"
+	config.Firewall.NftTable = "lsh_agent"
+	config.Firewall.IptablesBinary = "/usr/sbin/iptables"
+	config.Firewall.Ip6tablesBinary = "/usr/sbin/ip6tables"
+	config.Firewall.IptablesChain = "LSH-AGENT"
 	config.Firewall.CaseSensitive = false
 	config.Firewall.TempFile = "/tmp/lsh_firewall_temp.json"
 	config.Firewall.OutputFile = "/tmp/lsh_firewall.json"
+	config.Firewall.Mode = "enforce"
+	config.Firewall.ComplianceEndpoint = "https://api.latitude.sh/agent/firewall-compliance"
+	config.Firewall.Watch = false
+	config.Firewall.Canary.Enabled = false
+	config.Firewall.Canary.MaxRemovals = 10
+	config.Firewall.Canary.SSHPort = 22
+	config.Firewall.Canary.Grace = "60s"
 	config.Logging.Level = "info"
 	config.Logging.Format = "text"
+	config.Container.Mode = "auto"
+	config.Container.HostRoot = "/host"
+	config.Actions.Enabled = false
+	config.Actions.Endpoint = "https://api.latitude.sh/agent/actions"
+	config.Actions.Allowed = []string{"resync_firewall", "collect_diagnostics"}
+	config.Actions.Timeout = "5m"
+	config.Actions.PollInterval = "30s"
+	config.Actions.AuditLog = "/var/log/lsh-agent-actions.log"
+	config.Users.Enabled = false
+	config.Users.Endpoint = "https://api.latitude.sh/agent/users"
+	config.Users.Interval = "5m"
+	config.Power.Delay = "1m"
+	config.Patch.Enabled = false
+	config.Patch.Endpoint = "https://api.latitude.sh/agent/patches"
+	config.Patch.Interval = "1h"
+	config.Patch.Timeout = "30m"
+	config.WireGuard.Enabled = false
+	config.WireGuard.Endpoint = "https://api.latitude.sh/agent/wireguard"
+	config.WireGuard.Interval = "1m"
+	config.WireGuard.WGBinary = "/usr/bin/wg"
+	config.WireGuard.KeyFile = "/etc/lsh-agent/wireguard.key"
+	config.Network.Enabled = false
+	config.Network.Endpoint = "https://api.latitude.sh/agent/network"
+	config.Network.Interval = "5m"
+	config.Network.ConfigDir = "/etc/systemd/network"
+	config.Network.DryRun = false
+	config.Network.RollbackAfter = "30s"
+	config.DNS.Enabled = false
+	config.DNS.Provider = "latitude"
+	config.DNS.Endpoint = "https://api.latitude.sh/agent/dns"
+	config.DNS.TTL = 300
+	config.DNS.Interval = "1m"
+	config.DNS.Refresh = "24h"
+	config.Tags.Enabled = false
+	config.Tags.Endpoint = "https://api.latitude.sh/agent/tags"
+	config.Tags.Interval = "5m"
+	config.Tags.DropInDir = "/etc/lsh-agent/tags.d"
+	config.Tags.OutputFile = "/run/lsh-agent/tags.json"
+	config.Notify.RepeatInterval = "1h"
+	config.Alerts.Enabled = false
+	config.Alerts.Endpoint = "https://api.latitude.sh/agent/alerts"
+	config.Alerts.Interval = "30s"
+	config.Speedtest.Endpoint = "https://api.latitude.sh/agent/speedtest"
+	config.Speedtest.Duration = "10s"
+	config.DiskBench.Endpoint = "https://api.latitude.sh/agent/benchmarks"
+	config.DiskBench.FioBinary = "/usr/bin/fio"
+	config.DiskBench.Path = "/var/tmp"
+	config.DiskBench.Size = "1G"
+	config.DiskBench.Runtime = "30s"
+	config.BMC.Enabled = false
+	config.BMC.Endpoint = "https://api.latitude.sh/agent/bmc"
+	config.BMC.Interval = "15m"
+	config.BMC.Interface = "lanplus"
+	config.BMC.IPMIToolBinary = "/usr/bin/ipmitool"
+	config.BMC.SELWarnPercent = 80
+	config.Crash.Enabled = false
+	config.Crash.Endpoint = "https://api.latitude.sh/agent/crashes"
+	config.Crash.Interval = "10m"
+	config.Crash.CrashDir = "/var/crash"
+	config.Crash.UploadKernelLog = false
+	config.Tasks.Enabled = false
+	config.Tasks.Endpoint = "https://api.latitude.sh/agent/tasks"
+	config.Tasks.RefreshInterval = "5m"
+	config.Tasks.ScriptDir = "/etc/lsh-agent/tasks.d"
+	config.Tasks.DefaultTimeout = "10m"
+	config.UserData.Enabled = false
+	config.UserData.Endpoint = "https://api.latitude.sh/agent/user-data"
+	config.UserData.ScriptDir = "/var/lib/lsh-agent/user-data"
+	config.UserData.LogFile = "/var/log/lsh-agent-user-data.log"
+	config.UserData.Timeout = "30m"
+	config.Files.Enabled = false
+	config.Files.Endpoint = "https://api.latitude.sh/agent/files"
+	config.Files.Interval = "5m"
+	config.Files.AllowedPaths = []string{"/etc/lsh-agent/files", "/etc/ssl/lsh-agent"}
+	config.Files.AllowedHooks = []string{"/usr/bin/systemctl", "/bin/systemctl"}
+	config.Security.Enabled = false
+	config.Security.Endpoint = "https://api.latitude.sh/agent/security"
+	config.Security.Interval = "1h"
+	config.Security.ScanPaths = []string{"/usr", "/bin", "/sbin", "/opt", "/home", "/root"}
+	config.DDoS.Enabled = false
+	config.DDoS.Endpoint = "https://api.latitude.sh/agent/ddos"
+	config.DDoS.Interval = "10s"
+	config.DDoS.Multiplier = 5
+	config.DDoS.MinPPS = 50000
+	config.DDoS.MinMbps = 500
+	config.DDoS.MinConnRate = 500
+	config.DDoS.Warmup = "15m"
+	config.DDoS.Cooldown = "5m"
+	config.DDoS.Mitigate = false
+	config.Backup.Enabled = false
+	config.Backup.Endpoint = "https://api.latitude.sh/agent/backups"
+	config.Backup.Interval = "1h"
+	config.Backup.MaxAge = "26h"
+	config.Backup.ResticEnvFile = "/etc/lsh-agent/restic.env"
+	config.Backup.Timeout = "5m"
+	config.BGP.Enabled = false
+	config.BGP.Endpoint = "https://api.latitude.sh/agent/bgp"
+	config.BGP.Interval = "1m"
+	config.SNMP.Enabled = false
+	config.SNMP.AgentXAddress = "/var/agentx/master"
+	config.SNMP.BaseOID = ".1.3.6.1.4.1.8072.9999.9999.1"
+	config.Plugins.Enabled = false
+	config.Plugins.Dir = "/usr/lib/lsh-agent/plugins"
+	config.Plugins.Endpoint = "https://api.latitude.sh/agent/plugins"
+	config.Plugins.Interval = "1m"
+	config.Plugins.Timeout = "30s"
+	config.LocalAPI.Enabled = false
+	config.LocalAPI.Listen = "127.0.0.1:9390"
+	config.Reconcile.Enabled = false
+	config.Reconcile.Endpoint = "https://api.latitude.sh/agent/reconcile"
+	config.Reconcile.Interval = "1h"
+	config.Identity.Enabled = false
+	config.Identity.Endpoint = "https://api.latitude.sh/agent/identity"
+	config.Identity.Interval = "15m"
+	config.Compliance.Enabled = false
+	config.Compliance.Endpoint = "https://api.latitude.sh/agent/compliance"
+	config.Compliance.Interval = "5m"
+	config.Compliance.Enforce = false
+	config.History.Enabled = false
+	config.History.Interval = "1m"
+	config.History.Retention = "24h"
+	config.Relay.Enabled = false
+	config.Relay.AllowedHosts = []string{"api.latitude.sh:443"}
+	config.Reputation.Enabled = false
+	config.Reputation.Interval = "1h"
+	config.Reputation.LatitudeFeed = true
+	config.Reputation.Endpoint = "https://api.latitude.sh/agent/reputation"
+	config.Reputation.SetName = "lsh-reputation"
+	config.Reputation.Chain = "ufw-before-input"
+	config.Reputation.MaxEntries = 262144
+	config.Profiles.Enabled = false
+	config.Profiles.Endpoint = "https://api.latitude.sh/agent/profiles"
+	config.Profiles.Interval = "5m"
+	config.DNSHealth.Enabled = false
+	config.DNSHealth.Endpoint = "https://api.latitude.sh/agent/dns-health"
+	config.DNSHealth.Interval = "5m"
+	config.DNSHealth.Query = "api.latitude.sh"
+	config.DNSHealth.Timeout = "2s"
+	config.DNSHealth.Probes = 3
+	config.Neighbors.Enabled = false
+	config.Neighbors.Endpoint = "https://api.latitude.sh/agent/neighbors"
+	config.Neighbors.Interval = "1m"
+	config.Neighbors.OverflowPercent = 90
+	config.Rulesets.Enabled = false
+	config.Rulesets.Endpoint = "https://api.latitude.sh/agent/rulesets"
+	config.Heartbeat.Enabled = false
+	config.Heartbeat.Endpoint = "https://api.latitude.sh/agent/heartbeat"
+	config.Heartbeat.Interval = "15s"
+	config.AirGapped.Enabled = false
+	config.AirGapped.BundlePath = "/etc/lsh-agent/rules.bundle"
+	config.Faults.Enabled = false
+	config.Faults.UFWDelay = "0s"
+	config.Devices.Enabled = false
+	config.Devices.Endpoint = "https://api.latitude.sh/agent/devices"
+	config.Trends.Enabled = false
+	config.Trends.Endpoint = "https://api.latitude.sh/agent/hardware-trends"
+	config.Trends.Interval = "1h"
+	config.Trends.Window = "336h"
+	config.SelfTests.Enabled = false
+	config.SelfTests.Endpoint = "https://api.latitude.sh/agent/smart-self-tests"
+	config.SelfTests.PollInterval = "1m"
+	config.MemoryTest.Enabled = false
+	config.MemoryTest.Endpoint = "https://api.latitude.sh/agent/memory-tests"
+	config.MemoryTest.MemtesterBinary = "/usr/bin/memtester"
+	config.MemoryTest.FreeFraction = 0.5
+	config.MemoryTest.Loops = 1
+	config.MemoryTest.Timeout = "2h"
+	config.Durations.Enabled = true
+	config.Durations.Window = "1h"
+	config.Durations.RegressionFactor = 1.5
+	config.EventQueue.MaxEvents = 10000
+	config.EventQueue.MaxAge = "168h"
+	config.EventQueue.RetryInterval = "30s"
+	config.EventQueue.MaxAttempts = 5
+	config.DiskForecast.Enabled = false
+	config.DiskForecast.Endpoint = "https://api.latitude.sh/agent/disk-forecast"
+	config.DiskForecast.Interval = "15m"
+	config.DiskForecast.Window = "168h"
+	config.DiskForecast.HorizonDays = 14
+
+	config.Attestation.Enabled = false
+	config.Attestation.Endpoint = "https://api.latitude.sh/agent/attestation"
+	config.Attestation.KeyHandle = "0x81010002"
+	config.Attestation.PCRs = "sha256:0,1,2,3,4,5,6,7"
 
 	// Load from YAML file if it exists
 	if configPath != "" {
 		if err := loadFromYAML(config, configPath); err != nil {
-			return nil, fmt.Errorf("failed to load YAML config: %w", err)
+			return nil, errkind.Wrap(errkind.Config, fmt.Errorf("failed to load YAML config: %w", err))
 		}
 	}
 
 	// Override with legacy environment file if it exists
 	if err := loadFromLegacyEnv(config); err != nil {
-		return nil, fmt.Errorf("failed to load legacy env config: %w", err)
+		return nil, errkind.Wrap(errkind.Config, fmt.Errorf("failed to load legacy env config: %w", err))
 	}
 
 	// Override with environment variables
 	loadFromEnv(config)
 
+	// Discover identifiers still missing on Latitude hardware. Off it the
+	// lookup fails, which only matters if required identifiers are missing.
+	metadataErr := applyMetadata(config)
+
 	// Validate required fields
 	if err := validateConfig(config); err != nil {
-		return nil, fmt.Errorf("config validation failed: %w", err)
+		if metadataErr != nil {
+			err = fmt.Errorf("%w (metadata discovery failed: %v)", err, metadataErr)
+		}
+		return nil, errkind.Wrap(errkind.Config, fmt.Errorf("config validation failed: %w", err))
 	}
 
 	return config, nil
@@ -155,6 +1131,12 @@ func loadFromEnv(config *Config) {
 	if val := os.Getenv("PUBLIC_IP"); val != "" {
 		config.Latitude.PublicIP = val
 	}
+	if val := os.Getenv("SERVER_ID"); val != "" {
+		config.Latitude.ServerID = val
+	}
+	if val, ok := os.LookupEnv("METADATA_URL"); ok {
+		config.Latitude.MetadataURL = val
+	}
 	if val := os.Getenv("AGENT_INTERVAL"); val != "" {
 		config.Agent.Interval = val
 	}
@@ -162,9 +1144,258 @@ func loadFromEnv(config *Config) {
 		config.Agent.LogLevel = val
 		config.Logging.Level = val
 	}
+	if val := os.Getenv("AGENT_STATE_DIR"); val != "" {
+		config.Agent.StateDir = val
+	}
+	if val := os.Getenv("AGENT_FAILURE_POLICY"); val != "" {
+		config.Agent.FailurePolicy = val
+	}
+	if val := os.Getenv("AGENT_MAX_CONSECUTIVE_FAILURES"); val != "" {
+		if max, err := strconv.Atoi(val); err == nil {
+			config.Agent.MaxConsecutiveFailures = max
+		}
+	}
+	if val := os.Getenv("AGENT_BACKEND"); val != "" {
+		config.Agent.Backend = val
+	}
+	if val := os.Getenv("AGENT_SUDO"); val != "" {
+		config.Agent.Sudo = val
+	}
 	if val := os.Getenv("UFW_BINARY"); val != "" {
 		config.Firewall.UFWBinary = val
 	}
+	if val := os.Getenv("FIREWALL_BACKEND"); val != "" {
+		config.Firewall.Backend = val
+	}
+	if val := os.Getenv("FIREWALL_MODE"); val != "" {
+		config.Firewall.Mode = val
+	}
+	if val := os.Getenv("CONTAINER_MODE"); val != "" {
+		config.Container.Mode = val
+	}
+	if val := os.Getenv("CONTAINER_HOST_ROOT"); val != "" {
+		config.Container.HostRoot = val
+	}
+	if val := os.Getenv("ACTIONS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Actions.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("ACTIONS_PUBLIC_KEY"); val != "" {
+		config.Actions.PublicKey = val
+	}
+	if val := os.Getenv("USERS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Users.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("WIREGUARD_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.WireGuard.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("NETWORK_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Network.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("NETWORK_DRY_RUN"); val != "" {
+		if dryRun, err := strconv.ParseBool(val); err == nil {
+			config.Network.DryRun = dryRun
+		}
+	}
+	if val := os.Getenv("DNS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.DNS.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("DNS_HOSTNAME"); val != "" {
+		config.DNS.Hostname = val
+	}
+	if val := os.Getenv("TAGS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Tags.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("ALERTS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Alerts.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("BMC_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.BMC.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("BMC_HOST"); val != "" {
+		config.BMC.Host = val
+	}
+	if val := os.Getenv("BMC_USERNAME"); val != "" {
+		config.BMC.Username = val
+	}
+	if val := os.Getenv("BMC_PASSWORD"); val != "" {
+		config.BMC.Password = val
+	}
+	if val := os.Getenv("CRASH_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Crash.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("TASKS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Tasks.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("USER_DATA_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.UserData.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("FILES_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Files.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("SECURITY_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Security.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("DDOS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.DDoS.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("BACKUP_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Backup.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("BGP_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.BGP.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("SNMP_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.SNMP.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("PLUGINS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Plugins.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("LOCAL_API_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.LocalAPI.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("RECONCILE_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Reconcile.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("IDENTITY_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Identity.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("COMPLIANCE_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Compliance.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("HISTORY_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.History.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("RELAY_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Relay.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("REPUTATION_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Reputation.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("PROFILES_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Profiles.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("DNS_HEALTH_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.DNSHealth.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("NEIGHBORS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Neighbors.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("SCHEDULED_RULESETS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Rulesets.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("HEARTBEAT_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Heartbeat.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("AIR_GAPPED_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.AirGapped.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("FAULT_INJECTION_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Faults.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("DEVICE_EVENTS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Devices.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("HARDWARE_TRENDS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Trends.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("SMART_SELF_TESTS_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.SelfTests.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("MEMORY_TEST_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.MemoryTest.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("DURATION_SLO_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Durations.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("EVENT_QUEUE_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.EventQueue.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("DISK_FORECAST_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.DiskForecast.Enabled = enabled
+		}
+	}
+	if val := os.Getenv("ATTESTATION_ENABLED"); val != "" {
+		if enabled, err := strconv.ParseBool(val); err == nil {
+			config.Attestation.Enabled = enabled
+		}
+	}
 	if val := os.Getenv("FIREWALL_ENABLED"); val != "" {
 		if enabled, err := strconv.ParseBool(val); err == nil {
 			config.Firewall.Enabled = enabled
@@ -182,10 +1413,671 @@ func validateConfig(config *Config) error {
 	}
 	// Bearer token is optional since /ping API is unauthenticated
 
-	// Validate UFW binary exists
-	if config.Firewall.Enabled {
-		if _, err := os.Stat(config.Firewall.UFWBinary); os.IsNotExist(err) {
-			return fmt.Errorf("UFW binary not found at %s", config.Firewall.UFWBinary)
+	if config.Latitude.RelayURL != "" {
+		u, err := url.Parse(config.Latitude.RelayURL)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("invalid relay_url %q: expected http://host:port", config.Latitude.RelayURL)
+		}
+	}
+
+	switch config.Agent.FailurePolicy {
+	case "retry":
+	case "exit":
+		if config.Agent.MaxConsecutiveFailures < 1 {
+			return fmt.Errorf("max_consecutive_failures must be at least 1 when failure_policy is exit")
+		}
+	default:
+		return fmt.Errorf("invalid failure_policy %q (expected retry or exit)", config.Agent.FailurePolicy)
+	}
+
+	if config.Agent.MaxCommands < 1 {
+		return fmt.Errorf("agent.max_commands must be at least 1")
+	}
+	if interval, err := time.ParseDuration(config.Agent.Interval); err != nil || interval <= 0 {
+		return fmt.Errorf("invalid agent.interval %q: expected a positive duration", config.Agent.Interval)
+	}
+	if _, err := time.ParseDuration(config.Agent.CommandTimeout); err != nil {
+		return fmt.Errorf("invalid agent.command_timeout %q: %w", config.Agent.CommandTimeout, err)
+	}
+	if config.Agent.Backend != "host" && config.Agent.Backend != "mock" {
+		return fmt.Errorf("invalid agent.backend %q, must be host or mock", config.Agent.Backend)
+	}
+	switch config.Agent.Sudo {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("invalid agent.sudo %q, must be auto, always or never", config.Agent.Sudo)
+	}
+	if config.Agent.SudoPath == "" {
+		return fmt.Errorf("agent.sudo_path is required")
+	}
+	if filepath.Base(config.Agent.SudoPath) != "sudo" {
+		return fmt.Errorf("agent.sudo_path must name a sudo binary")
+	}
+	for name, path := range config.Agent.Tools {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid tool name %q in agent.tools", name)
+		}
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("agent.tools.%s must be an absolute path, got %q", name, path)
+		}
+	}
+
+	switch config.Container.Mode {
+	case "auto", "enabled", "disabled":
+	default:
+		return fmt.Errorf("invalid container mode %q (expected auto, enabled or disabled)", config.Container.Mode)
+	}
+
+	if config.Actions.Enabled {
+		if config.Actions.PublicKey == "" {
+			return fmt.Errorf("actions.public_key is required when remote actions are enabled")
+		}
+		if _, err := time.ParseDuration(config.Actions.Timeout); err != nil {
+			return fmt.Errorf("invalid actions.timeout %q: %w", config.Actions.Timeout, err)
+		}
+		if interval, err := time.ParseDuration(config.Actions.PollInterval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid actions.poll_interval %q: expected a positive duration", config.Actions.PollInterval)
+		}
+	}
+
+	if config.Users.Enabled {
+		if interval, err := time.ParseDuration(config.Users.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid users.interval %q: expected a positive duration", config.Users.Interval)
+		}
+	}
+
+	if _, err := schedule.ParseWindows(config.Power.Windows); err != nil {
+		return fmt.Errorf("invalid power.windows: %w", err)
+	}
+	if _, err := time.ParseDuration(config.Power.Delay); err != nil {
+		return fmt.Errorf("invalid power.delay %q: %w", config.Power.Delay, err)
+	}
+
+	if config.Patch.Enabled {
+		if len(config.Patch.Windows) == 0 {
+			return fmt.Errorf("patch.windows must define at least one maintenance window when patching is enabled")
+		}
+		if _, err := schedule.ParseWindows(config.Patch.Windows); err != nil {
+			return fmt.Errorf("invalid patch.windows: %w", err)
+		}
+		if interval, err := time.ParseDuration(config.Patch.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid patch.interval %q: expected a positive duration", config.Patch.Interval)
+		}
+		if _, err := time.ParseDuration(config.Patch.Timeout); err != nil {
+			return fmt.Errorf("invalid patch.timeout %q: %w", config.Patch.Timeout, err)
+		}
+	}
+
+	if config.WireGuard.Enabled {
+		if interval, err := time.ParseDuration(config.WireGuard.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid wireguard.interval %q: expected a positive duration", config.WireGuard.Interval)
+		}
+		wgPath := config.Container.HostPath(config.WireGuard.WGBinary)
+		if _, err := os.Stat(wgPath); os.IsNotExist(err) {
+			return fmt.Errorf("wg binary not found at %s", wgPath)
+		}
+	}
+
+	if config.Network.Enabled {
+		if interval, err := time.ParseDuration(config.Network.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid network.interval %q: expected a positive duration", config.Network.Interval)
+		}
+		if _, err := time.ParseDuration(config.Network.RollbackAfter); err != nil {
+			return fmt.Errorf("invalid network.rollback_after %q: %w", config.Network.RollbackAfter, err)
+		}
+	}
+
+	if config.DNS.Enabled {
+		if config.DNS.Hostname == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("dns.hostname is not set and the system hostname is unavailable: %w", err)
+			}
+			config.DNS.Hostname = hostname
+		}
+		if !validHostname.MatchString(config.DNS.Hostname) {
+			return fmt.Errorf("invalid dns.hostname %q", config.DNS.Hostname)
+		}
+		switch config.DNS.Provider {
+		case "latitude":
+		case "nsupdate":
+			if config.DNS.NSUpdate.Server == "" {
+				return fmt.Errorf("dns.nsupdate.server is required when dns.provider is nsupdate")
+			}
+		default:
+			return fmt.Errorf("invalid dns.provider %q (must be latitude or nsupdate)", config.DNS.Provider)
+		}
+		if config.DNS.TTL <= 0 {
+			return fmt.Errorf("dns.ttl must be positive")
+		}
+		if interval, err := time.ParseDuration(config.DNS.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid dns.interval %q: expected a positive duration", config.DNS.Interval)
+		}
+		if _, err := time.ParseDuration(config.DNS.Refresh); err != nil {
+			return fmt.Errorf("invalid dns.refresh %q: %w", config.DNS.Refresh, err)
+		}
+	}
+
+	if config.Tags.Enabled {
+		if interval, err := time.ParseDuration(config.Tags.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid tags.interval %q: expected a positive duration", config.Tags.Interval)
+		}
+	}
+
+	if _, err := time.ParseDuration(config.Notify.RepeatInterval); err != nil {
+		return fmt.Errorf("invalid notify.repeat_interval %q: %w", config.Notify.RepeatInterval, err)
+	}
+	for i := range config.Notify.Webhooks {
+		webhook := &config.Notify.Webhooks[i]
+		if !strings.HasPrefix(webhook.URL, "https://") && !strings.HasPrefix(webhook.URL, "http://") {
+			return fmt.Errorf("invalid notify.webhooks url %q", webhook.URL)
+		}
+		if webhook.Format == "" {
+			webhook.Format = notify.FormatGeneric
+		}
+		if webhook.Format != notify.FormatGeneric && webhook.Format != notify.FormatSlack {
+			return fmt.Errorf("invalid webhook format %q (must be generic or slack)", webhook.Format)
+		}
+		for _, event := range webhook.Events {
+			if !slices.Contains(notify.Events, event) {
+				return fmt.Errorf("unknown webhook event %q (must be one of %s)", event, strings.Join(notify.Events, ", "))
+			}
+		}
+	}
+
+	if config.Alerts.Enabled {
+		if interval, err := time.ParseDuration(config.Alerts.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid alerts.interval %q: expected a positive duration", config.Alerts.Interval)
+		}
+		names := make(map[string]bool)
+		for i := range config.Alerts.Rules {
+			rule := &config.Alerts.Rules[i]
+			if rule.Name == "" || names[rule.Name] {
+				return fmt.Errorf("alert rules must have unique, non-empty names")
+			}
+			names[rule.Name] = true
+			if rule.For == "" {
+				rule.For = "5m"
+			}
+			if rule.Severity == "" {
+				rule.Severity = "warning"
+			}
+			duration, err := time.ParseDuration(rule.For)
+			if err != nil {
+				return fmt.Errorf("invalid for %q in alert rule %s: %w", rule.For, rule.Name, err)
+			}
+			if _, err := alerts.ParseRule(rule.Name, rule.Expr, duration, rule.Severity); err != nil {
+				return fmt.Errorf("alert rule %s: %w", rule.Name, err)
+			}
+		}
+	}
+
+	if _, err := time.ParseDuration(config.Speedtest.Duration); err != nil {
+		return fmt.Errorf("invalid speedtest.duration %q: %w", config.Speedtest.Duration, err)
+	}
+
+	if runtime, err := time.ParseDuration(config.DiskBench.Runtime); err != nil || runtime < time.Second {
+		return fmt.Errorf("invalid disk_benchmark.runtime %q: must be at least 1s", config.DiskBench.Runtime)
+	}
+
+	if config.BMC.Enabled {
+		if config.BMC.Host == "" || config.BMC.Username == "" || config.BMC.Password == "" {
+			return fmt.Errorf("bmc.host, bmc.username and bmc.password are required when BMC checks are enabled")
+		}
+		if interval, err := time.ParseDuration(config.BMC.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid bmc.interval %q: expected a positive duration", config.BMC.Interval)
+		}
+		if _, err := os.Stat(config.BMC.IPMIToolBinary); os.IsNotExist(err) {
+			return fmt.Errorf("ipmitool binary not found at %s", config.BMC.IPMIToolBinary)
+		}
+	}
+
+	if config.Crash.Enabled {
+		if interval, err := time.ParseDuration(config.Crash.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid crash.interval %q: expected a positive duration", config.Crash.Interval)
+		}
+	}
+
+	if config.Tasks.Enabled {
+		if interval, err := time.ParseDuration(config.Tasks.RefreshInterval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid tasks.refresh_interval %q: expected a positive duration", config.Tasks.RefreshInterval)
+		}
+		defaultTimeout, err := time.ParseDuration(config.Tasks.DefaultTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid tasks.default_timeout %q: %w", config.Tasks.DefaultTimeout, err)
+		}
+		names := make(map[string]bool)
+		for _, t := range config.Tasks.Tasks {
+			task := tasks.Task{Name: t.Name, Command: t.Command, Args: t.Args, Schedule: t.Schedule, Timeout: t.Timeout}
+			if err := task.Prepare(defaultTimeout); err != nil {
+				return fmt.Errorf("invalid tasks entry: %w", err)
+			}
+			if names[t.Name] {
+				return fmt.Errorf("duplicate task name %q", t.Name)
+			}
+			names[t.Name] = true
+		}
+	}
+
+	if config.UserData.Enabled {
+		if _, err := time.ParseDuration(config.UserData.Timeout); err != nil {
+			return fmt.Errorf("invalid user_data.timeout %q: %w", config.UserData.Timeout, err)
+		}
+	}
+
+	if config.Files.Enabled {
+		if interval, err := time.ParseDuration(config.Files.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid files.interval %q: expected a positive duration", config.Files.Interval)
+		}
+		for _, path := range config.Files.AllowedPaths {
+			if !filepath.IsAbs(path) || path == "/" {
+				return fmt.Errorf("invalid files.allowed_paths entry %q: must be an absolute directory other than /", path)
+			}
+		}
+	}
+
+	if config.Security.Enabled {
+		if interval, err := time.ParseDuration(config.Security.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid security.interval %q: expected a positive duration", config.Security.Interval)
+		}
+		for _, path := range config.Security.ScanPaths {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("invalid security.scan_paths entry %q: must be absolute", path)
+			}
+		}
+	}
+
+	if config.DDoS.Enabled {
+		if interval, err := time.ParseDuration(config.DDoS.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid ddos.interval %q: expected a positive duration", config.DDoS.Interval)
+		}
+		if _, err := time.ParseDuration(config.DDoS.Warmup); err != nil {
+			return fmt.Errorf("invalid ddos.warmup %q: %w", config.DDoS.Warmup, err)
+		}
+		if _, err := time.ParseDuration(config.DDoS.Cooldown); err != nil {
+			return fmt.Errorf("invalid ddos.cooldown %q: %w", config.DDoS.Cooldown, err)
+		}
+		if config.DDoS.Multiplier <= 1 {
+			return fmt.Errorf("ddos.multiplier must be greater than 1")
+		}
+		if config.DDoS.Mitigate && !config.Firewall.Enabled {
+			return fmt.Errorf("ddos.mitigate requires firewall.enabled, mitigation rules are applied with UFW")
+		}
+	}
+
+	if config.Backup.Enabled {
+		if interval, err := time.ParseDuration(config.Backup.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid backup.interval %q: expected a positive duration", config.Backup.Interval)
+		}
+		if _, err := time.ParseDuration(config.Backup.MaxAge); err != nil {
+			return fmt.Errorf("invalid backup.max_age %q: %w", config.Backup.MaxAge, err)
+		}
+		if _, err := time.ParseDuration(config.Backup.Timeout); err != nil {
+			return fmt.Errorf("invalid backup.timeout %q: %w", config.Backup.Timeout, err)
+		}
+	}
+
+	if config.BGP.Enabled {
+		if interval, err := time.ParseDuration(config.BGP.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid bgp.interval %q: expected a positive duration", config.BGP.Interval)
+		}
+	}
+
+	if config.SNMP.Enabled {
+		if _, err := snmp.ParseOID(config.SNMP.BaseOID); err != nil {
+			return fmt.Errorf("invalid snmp.base_oid: %w", err)
+		}
+		if config.SNMP.AgentXAddress == "" {
+			return fmt.Errorf("snmp.agentx_address is required when SNMP is enabled")
+		}
+	}
+
+	if config.Plugins.Enabled {
+		if interval, err := time.ParseDuration(config.Plugins.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid plugins.interval %q: expected a positive duration", config.Plugins.Interval)
+		}
+		if _, err := time.ParseDuration(config.Plugins.Timeout); err != nil {
+			return fmt.Errorf("invalid plugins.timeout %q: %w", config.Plugins.Timeout, err)
+		}
+	}
+
+	if config.LocalAPI.Enabled {
+		host, _, err := net.SplitHostPort(config.LocalAPI.Listen)
+		if err != nil {
+			return fmt.Errorf("invalid local_api.listen %q: %w", config.LocalAPI.Listen, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("local_api.listen must be a loopback address, got %q", config.LocalAPI.Listen)
+		}
+	}
+
+	if config.Reconcile.Enabled {
+		if interval, err := time.ParseDuration(config.Reconcile.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid reconcile.interval %q: expected a positive duration", config.Reconcile.Interval)
+		}
+	}
+
+	if config.Identity.Enabled {
+		if interval, err := time.ParseDuration(config.Identity.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid identity.interval %q: expected a positive duration", config.Identity.Interval)
+		}
+	}
+
+	if config.Compliance.Enabled {
+		if interval, err := time.ParseDuration(config.Compliance.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid compliance.interval %q: expected a positive duration", config.Compliance.Interval)
+		}
+		for key := range config.Compliance.Sysctls {
+			if !collectors.ValidSysctlKey(key) {
+				return fmt.Errorf("invalid compliance.sysctls key %q", key)
+			}
+		}
+		for _, module := range config.Compliance.ForbiddenModules {
+			if !collectors.ValidModuleName(module) {
+				return fmt.Errorf("invalid compliance.forbidden_modules entry %q", module)
+			}
+		}
+	}
+
+	if config.History.Enabled {
+		interval, err := time.ParseDuration(config.History.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid history.interval %q", config.History.Interval)
+		}
+		retention, err := time.ParseDuration(config.History.Retention)
+		if err != nil || retention < interval {
+			return fmt.Errorf("invalid history.retention %q: must be at least history.interval", config.History.Retention)
+		}
+	}
+
+	if config.Relay.Enabled {
+		if _, _, err := net.SplitHostPort(config.Relay.Listen); err != nil {
+			return fmt.Errorf("invalid relay.listen %q: %w", config.Relay.Listen, err)
+		}
+		// An open relay would let anyone reach the allowed hosts through this server
+		if len(config.Relay.AllowedSources) == 0 {
+			return fmt.Errorf("relay.allowed_sources is required when the relay is enabled")
+		}
+		for _, source := range config.Relay.AllowedSources {
+			if _, _, err := net.ParseCIDR(source); err != nil {
+				return fmt.Errorf("invalid relay.allowed_sources entry %q: %w", source, err)
+			}
+		}
+		for _, host := range config.Relay.AllowedHosts {
+			if _, _, err := net.SplitHostPort(host); err != nil {
+				return fmt.Errorf("invalid relay.allowed_hosts entry %q: %w", host, err)
+			}
+		}
+	}
+
+	if config.Reputation.Enabled {
+		if interval, err := time.ParseDuration(config.Reputation.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid reputation.interval %q: expected a positive duration", config.Reputation.Interval)
+		}
+		if !config.Reputation.LatitudeFeed && len(config.Reputation.Feeds) == 0 {
+			return fmt.Errorf("reputation requires latitude_feed or at least one entry in feeds")
+		}
+		for _, feed := range config.Reputation.Feeds {
+			if u, err := url.Parse(feed.URL); feed.Name == "" || err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+				return fmt.Errorf("invalid reputation feed %q: name and an http(s) url are required", feed.Name)
+			}
+		}
+		// ipset names are limited to 31 characters, including the -v6 and -new suffixes
+		if config.Reputation.SetName == "" || len(config.Reputation.SetName) > 24 {
+			return fmt.Errorf("invalid reputation.set_name %q: must be 1 to 24 characters", config.Reputation.SetName)
+		}
+		if config.Reputation.MaxEntries < 1 {
+			return fmt.Errorf("reputation.max_entries must be positive")
+		}
+	}
+
+	if config.Profiles.Enabled {
+		if interval, err := time.ParseDuration(config.Profiles.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid profiles.interval %q: expected a positive duration", config.Profiles.Interval)
+		}
+	}
+
+	if config.DNSHealth.Enabled {
+		if interval, err := time.ParseDuration(config.DNSHealth.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid dns_health.interval %q: expected a positive duration", config.DNSHealth.Interval)
+		}
+		if d, err := time.ParseDuration(config.DNSHealth.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid dns_health.timeout %q", config.DNSHealth.Timeout)
+		}
+		if config.DNSHealth.Probes < 1 {
+			return fmt.Errorf("dns_health.probes must be positive")
+		}
+		if config.DNSHealth.Query == "" {
+			return fmt.Errorf("dns_health.query is required")
+		}
+	}
+
+	if config.Neighbors.Enabled {
+		if interval, err := time.ParseDuration(config.Neighbors.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid neighbors.interval %q: expected a positive duration", config.Neighbors.Interval)
+		}
+		if config.Neighbors.OverflowPercent <= 0 || config.Neighbors.OverflowPercent > 100 {
+			return fmt.Errorf("neighbors.overflow_percent must be between 0 and 100")
+		}
+		for _, bad := range config.Neighbors.KnownBadDrivers {
+			if bad.Driver == "" {
+				return fmt.Errorf("neighbors.known_bad_drivers entries require a driver")
+			}
+		}
+	}
+
+	if _, err := schedule.ParseWindows(config.Maintenance.Windows); err != nil {
+		return fmt.Errorf("invalid maintenance.windows: %w", err)
+	}
+
+	if config.Firewall.Canary.Enabled {
+		if grace, err := time.ParseDuration(config.Firewall.Canary.Grace); err != nil || grace <= 0 {
+			return fmt.Errorf("invalid firewall.canary.grace %q: expected a positive duration", config.Firewall.Canary.Grace)
+		}
+		if config.Firewall.Canary.MaxRemovals < 0 {
+			return fmt.Errorf("firewall.canary.max_removals must not be negative")
+		}
+		if config.Firewall.Canary.SSHPort < 1 || config.Firewall.Canary.SSHPort > 65535 {
+			return fmt.Errorf("invalid firewall.canary.ssh_port %d", config.Firewall.Canary.SSHPort)
+		}
+	}
+
+	switch config.Firewall.Backend {
+	case "ufw":
+	case "nftables":
+		if !validNftTable.MatchString(config.Firewall.NftTable) {
+			return fmt.Errorf("invalid firewall.nft_table %q", config.Firewall.NftTable)
+		}
+		if config.DDoS.Enabled && config.DDoS.Mitigate {
+			return fmt.Errorf("ddos.mitigate requires the ufw firewall backend, nftables has no rate limits")
+		}
+		if config.Firewall.Watch {
+			return fmt.Errorf("firewall.watch requires the ufw firewall backend")
+		}
+	case "iptables":
+		if !validIptablesChain.MatchString(config.Firewall.IptablesChain) {
+			return fmt.Errorf("invalid firewall.iptables_chain %q", config.Firewall.IptablesChain)
+		}
+		if config.DDoS.Enabled && config.DDoS.Mitigate {
+			return fmt.Errorf("ddos.mitigate requires the ufw firewall backend, iptables has no rate limits")
+		}
+		if config.Firewall.Watch {
+			return fmt.Errorf("firewall.watch requires the ufw firewall backend")
+		}
+	default:
+		return fmt.Errorf("invalid firewall.backend %q: expected ufw, nftables or iptables", config.Firewall.Backend)
+	}
+
+	switch config.Firewall.Mode {
+	case "enforce":
+	case "readonly":
+		if config.DDoS.Enabled && config.DDoS.Mitigate {
+			return fmt.Errorf("ddos.mitigate cannot be used with firewall.mode readonly, mitigation adds UFW rules")
+		}
+		if config.Rulesets.Enabled {
+			return fmt.Errorf("scheduled_rulesets cannot be used with firewall.mode readonly, rulesets change UFW rules")
+		}
+	default:
+		return fmt.Errorf("invalid firewall.mode %q: expected enforce or readonly", config.Firewall.Mode)
+	}
+
+	seenTenants := map[string]bool{config.Latitude.FirewallID: true}
+	for _, tenant := range config.Firewall.Tenants {
+		if tenant.FirewallID == "" {
+			return fmt.Errorf("firewall.tenants entries require a firewall_id")
+		}
+		if seenTenants[tenant.FirewallID] {
+			return fmt.Errorf("firewall.tenants: firewall %s is configured more than once", tenant.FirewallID)
+		}
+		seenTenants[tenant.FirewallID] = true
+		if tenant.PublicIP != "" && net.ParseIP(tenant.PublicIP) == nil {
+			return fmt.Errorf("firewall.tenants: invalid public_ip %q for firewall %s", tenant.PublicIP, tenant.FirewallID)
+		}
+		// Unscoped tenant rules would be indistinguishable from the host's
+		if tenant.Interface == "" && tenant.To == "" {
+			return fmt.Errorf("firewall.tenants: firewall %s requires an interface or to", tenant.FirewallID)
+		}
+		if tenant.Interface != "" && !validInterface.MatchString(tenant.Interface) {
+			return fmt.Errorf("firewall.tenants: invalid interface %q for firewall %s", tenant.Interface, tenant.FirewallID)
+		}
+		if tenant.To != "" && net.ParseIP(tenant.To) == nil {
+			if _, _, err := net.ParseCIDR(tenant.To); err != nil {
+				return fmt.Errorf("firewall.tenants: invalid to %q for firewall %s: expected an IP or CIDR", tenant.To, tenant.FirewallID)
+			}
+		}
+	}
+
+	if config.Rulesets.Enabled && !config.Firewall.Enabled {
+		return fmt.Errorf("scheduled_rulesets.enabled requires firewall.enabled, rulesets are applied with UFW")
+	}
+
+	if config.Heartbeat.Enabled {
+		// The platform expects a heartbeat at least every 30s to consider
+		// the agent alive
+		interval, err := time.ParseDuration(config.Heartbeat.Interval)
+		if err != nil || interval < 10*time.Second || interval > 30*time.Second {
+			return fmt.Errorf("invalid heartbeat.interval %q: expected a duration from 10s to 30s", config.Heartbeat.Interval)
+		}
+	}
+
+	if config.AirGapped.Enabled {
+		if config.AirGapped.PublicKey == "" {
+			return fmt.Errorf("air_gapped.public_key is required in air-gapped mode")
+		}
+		if _, err := bundle.ParsePublicKey(config.AirGapped.PublicKey); err != nil {
+			return err
+		}
+		if config.AirGapped.BundlePath == "" {
+			return fmt.Errorf("air_gapped.bundle_path is required in air-gapped mode")
+		}
+	}
+
+	if config.Faults.Enabled {
+		if config.Faults.APIDropPercent < 0 || config.Faults.APIDropPercent > 100 {
+			return fmt.Errorf("fault_injection.api_drop_percent must be from 0 to 100")
+		}
+		if delay, err := time.ParseDuration(config.Faults.UFWDelay); err != nil || delay < 0 {
+			return fmt.Errorf("invalid fault_injection.ufw_delay %q", config.Faults.UFWDelay)
+		}
+	}
+
+	if config.Devices.Enabled && config.Devices.Endpoint == "" {
+		return fmt.Errorf("device_events.endpoint is required when device events are enabled")
+	}
+
+	if config.Trends.Enabled {
+		if interval, err := time.ParseDuration(config.Trends.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid hardware_trends.interval %q: expected a positive duration", config.Trends.Interval)
+		}
+		// A slope needs a day of samples
+		if window, err := time.ParseDuration(config.Trends.Window); err != nil || window < 24*time.Hour {
+			return fmt.Errorf("invalid hardware_trends.window %q: expected a duration of at least 24h", config.Trends.Window)
+		}
+	}
+
+	if config.SelfTests.Enabled {
+		if interval, err := time.ParseDuration(config.SelfTests.PollInterval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid smart_self_tests.poll_interval %q", config.SelfTests.PollInterval)
+		}
+	}
+
+	if config.MemoryTest.Enabled {
+		// Testing most of the free memory would push the host into swap or
+		// the OOM killer
+		if config.MemoryTest.FreeFraction <= 0 || config.MemoryTest.FreeFraction > 0.9 {
+			return fmt.Errorf("memory_test.free_fraction must be above 0 and at most 0.9")
+		}
+		if config.MemoryTest.Loops < 1 {
+			return fmt.Errorf("memory_test.loops must be at least 1")
+		}
+		if timeout, err := time.ParseDuration(config.MemoryTest.Timeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid memory_test.timeout %q", config.MemoryTest.Timeout)
+		}
+	}
+
+	if window, err := time.ParseDuration(config.Durations.Window); err != nil || window < time.Minute {
+		return fmt.Errorf("invalid duration_slo.window %q: expected a duration of at least 1m", config.Durations.Window)
+	}
+	if config.Durations.Enabled && config.Durations.RegressionFactor <= 1 {
+		return fmt.Errorf("duration_slo.regression_factor must be greater than 1")
+	}
+
+	if config.EventQueue.Enabled {
+		if config.EventQueue.MaxEvents <= 0 {
+			return fmt.Errorf("event_queue.max_events must be positive")
+		}
+		if config.EventQueue.MaxAttempts <= 0 {
+			return fmt.Errorf("event_queue.max_attempts must be positive")
+		}
+		if maxAge, err := time.ParseDuration(config.EventQueue.MaxAge); err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid event_queue.max_age %q", config.EventQueue.MaxAge)
+		}
+		if interval, err := time.ParseDuration(config.EventQueue.RetryInterval); err != nil || interval < time.Second {
+			return fmt.Errorf("invalid event_queue.retry_interval %q: expected a duration of at least 1s", config.EventQueue.RetryInterval)
+		}
+	}
+
+	if config.DiskForecast.Enabled {
+		if interval, err := time.ParseDuration(config.DiskForecast.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid disk_forecast.interval %q: expected a positive duration", config.DiskForecast.Interval)
+		}
+		// Growth is only projected from a day of history
+		if window, err := time.ParseDuration(config.DiskForecast.Window); err != nil || window < 24*time.Hour {
+			return fmt.Errorf("invalid disk_forecast.window %q: expected a duration of at least 24h", config.DiskForecast.Window)
+		}
+		if config.DiskForecast.HorizonDays <= 0 {
+			return fmt.Errorf("invalid disk_forecast.horizon_days %v: must be positive", config.DiskForecast.HorizonDays)
+		}
+	}
+
+	if config.Attestation.Enabled {
+		// Persistent handles of the owner hierarchy
+		if handle, err := strconv.ParseUint(strings.TrimPrefix(config.Attestation.KeyHandle, "0x"), 16, 32); err != nil || handle < 0x81000000 || handle > 0x817fffff {
+			return fmt.Errorf("invalid attestation.key_handle %q: expected a persistent handle from 0x81000000 to 0x817fffff", config.Attestation.KeyHandle)
+		}
+		if !validPCRSelection.MatchString(config.Attestation.PCRs) {
+			return fmt.Errorf("invalid attestation.pcrs %q: expected a bank and indexes, e.g. sha256:0,1,2,3,4,5,6,7", config.Attestation.PCRs)
+		}
+	}
+
+	// Validate the firewall binary exists, unless UFW is simulated
+	if config.Firewall.Enabled && config.Agent.Backend != "mock" {
+		switch config.Firewall.Backend {
+		case "nftables":
+			nftPath := config.Container.HostPath(config.Firewall.NftBinary)
+			if _, err := os.Stat(nftPath); os.IsNotExist(err) {
+				return errkind.Wrap(errkind.ToolMissing, fmt.Errorf("nft binary not found at %s", nftPath))
+			}
+		case "iptables":
+			iptablesPath := config.Container.HostPath(config.Firewall.IptablesBinary)
+			if _, err := os.Stat(iptablesPath); os.IsNotExist(err) {
+				return errkind.Wrap(errkind.ToolMissing, fmt.Errorf("iptables binary not found at %s", iptablesPath))
+			}
+		default:
+			ufwPath := config.Container.HostPath(config.Firewall.UFWBinary)
+			if _, err := os.Stat(ufwPath); os.IsNotExist(err) {
+				return errkind.Wrap(errkind.ToolMissing, fmt.Errorf("UFW binary not found at %s", ufwPath))
+			}
 		}
 	}
 
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/latitudesh/agent/internal/state"
+)
+
+// metadataFile caches the identifiers discovered from the metadata service,
+// so they are only fetched at first boot
+const metadataFile = "metadata.json"
+
+// metadataTimeout bounds the metadata request; off Latitude hardware there
+// is no service to answer and startup must not hang on it
+const metadataTimeout = 3 * time.Second
+
+// Metadata is the identity of a server as published by the provisioning
+// metadata service
+type Metadata struct {
+	ProjectID  string `json:"project_id"`
+	FirewallID string `json:"firewall_id"`
+	ServerID   string `json:"server_id"`
+	PublicIP   string `json:"public_ip"`
+}
+
+// applyMetadata fills the identifiers missing from the configuration from
+// the metadata cache, so the agent runs without any arguments on Latitude
+// hardware. Identifiers set in the configuration or environment win. The
+// metadata service is only queried when the cache is missing and the
+// required project or firewall ID is too, so CLI commands and reloads of a
+// configured agent never wait on it.
+func applyMetadata(config *Config) error {
+	latitude := &config.Latitude
+	if latitude.MetadataURL == "" ||
+		(latitude.ProjectID != "" && latitude.FirewallID != "" && latitude.ServerID != "" && latitude.PublicIP != "") {
+		return nil
+	}
+
+	metadata, err := cachedMetadata(config.Agent.StateDir)
+	if metadata == nil {
+		if latitude.ProjectID != "" && latitude.FirewallID != "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if metadata, err = fetchMetadata(config.Agent.StateDir, latitude.MetadataURL); err != nil {
+			return err
+		}
+	}
+	for _, field := range []struct {
+		value      *string
+		discovered string
+	}{
+		{&latitude.ProjectID, metadata.ProjectID},
+		{&latitude.FirewallID, metadata.FirewallID},
+		{&latitude.ServerID, metadata.ServerID},
+		{&latitude.PublicIP, metadata.PublicIP},
+	} {
+		if *field.value == "" {
+			*field.value = field.discovered
+		}
+	}
+	return nil
+}
+
+// cachedMetadata returns the cached metadata, nil when there is none yet
+func cachedMetadata(stateDir string) (*Metadata, error) {
+	var metadata Metadata
+	err := state.Load(stateDir, metadataFile, &metadata)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached metadata: %w", err)
+	}
+	return &metadata, nil
+}
+
+// fetchMetadata fetches the metadata from the service and caches it
+func fetchMetadata(stateDir, metadataURL string) (*Metadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata_url: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service returned status %d", resp.StatusCode)
+	}
+	var metadata Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+
+	if err := state.Save(stateDir, metadataFile, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to cache metadata: %w", err)
+	}
+	return &metadata, nil
+}
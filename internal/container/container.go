@@ -0,0 +1,130 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/latitudesh/agent/internal/lines"
+)
+
+// Linux capability bits checked at startup
+const (
+	capNetAdmin  = 12
+	capNetRaw    = 13
+	capSysChroot = 18
+)
+
+// Running the agent in a container requires:
+//
+//   - the host root filesystem bind-mounted (recursively) at the configured
+//     host root, e.g. -v /:/host, so UFW rules and binaries are the host's
+//   - the host network namespace, e.g. --network host, so rules apply to
+//     the host's interfaces instead of the container's
+//   - CAP_NET_ADMIN and CAP_NET_RAW to manage iptables, and CAP_SYS_CHROOT
+//     to run host tools inside the host root
+
+// Detect reports whether the agent is running inside a container
+func Detect() bool {
+	for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+
+	if os.Getenv("container") != "" {
+		return true
+	}
+
+	data, err := os.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return false
+	}
+	cgroups := string(data)
+	for _, runtime := range []string{"docker", "kubepods", "containerd", "libpod", "lxc"} {
+		if strings.Contains(cgroups, runtime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks that the container has the mounts and privileges needed to
+// manage the host firewall. It returns an error describing every missing
+// requirement, and warnings for checks that could not be performed.
+func Validate(hostRoot string) ([]string, error) {
+	var problems, warnings []string
+
+	// Host filesystem
+	if info, err := os.Stat(hostRoot); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("host root filesystem not mounted at %s (run with -v /:%s)", hostRoot, hostRoot))
+	} else if _, err := os.Stat(filepath.Join(hostRoot, "etc")); err != nil {
+		problems = append(problems, fmt.Sprintf("%s does not look like a root filesystem (missing /etc)", hostRoot))
+	}
+
+	// Capabilities
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("could not read capabilities: %v", err))
+	} else {
+		for bit, name := range map[uint]string{
+			capNetAdmin:  "NET_ADMIN",
+			capNetRaw:    "NET_RAW",
+			capSysChroot: "SYS_CHROOT",
+		} {
+			if caps&(1<<bit) == 0 {
+				problems = append(problems, fmt.Sprintf("missing capability CAP_%s (run with --cap-add %s)", name, name))
+			}
+		}
+	}
+
+	// Host network namespace
+	shared, err := sharesHostNetwork(hostRoot)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("could not verify host network namespace: %v", err))
+	} else if !shared {
+		problems = append(problems, "not running in the host network namespace (run with --network host)")
+	}
+
+	if len(problems) > 0 {
+		return warnings, fmt.Errorf("container is missing required privileges:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+
+	return warnings, nil
+}
+
+// effectiveCapabilities returns the effective capability mask of this process
+func effectiveCapabilities() (uint64, error) {
+	var mask string
+	err := lines.ScanFile("/proc/self/status", func(line string) {
+		if value, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			mask = strings.TrimSpace(value)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if mask == "" {
+		return 0, fmt.Errorf("CapEff not found in /proc/self/status")
+	}
+	return strconv.ParseUint(mask, 16, 64)
+}
+
+// sharesHostNetwork compares this process's network namespace with the one
+// of the host's init process, visible through the host /proc mount
+func sharesHostNetwork(hostRoot string) (bool, error) {
+	self, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		return false, err
+	}
+
+	host, err := os.Readlink(filepath.Join(hostRoot, "proc", "1", "ns", "net"))
+	if err != nil {
+		return false, err
+	}
+
+	return self == host, nil
+}
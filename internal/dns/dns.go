@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const registrationFile = "dns.json"
+
+// Record is an address record published for the server
+type Record struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl"`
+}
+
+// Registrar publishes the address records for a hostname, replacing any
+// records of the same types
+type Registrar interface {
+	Register(ctx context.Context, hostname string, records []Record) error
+}
+
+// registration is the last successful registration, persisted in the state dir
+type registration struct {
+	Hostname     string    `json:"hostname"`
+	Records      []Record  `json:"records"`
+	RegisteredAt time.Time `json:"registered_at"`
+}
+
+// Updater registers the server's public addresses whenever they change and
+// refreshes the registration periodically
+type Updater struct {
+	registrar Registrar
+	hostname  string
+	ttl       int
+	refresh   time.Duration
+	staticIP  string
+	stateDir  string
+	logger    *logrus.Logger
+}
+
+// NewUpdater creates a new DNS updater. staticIP, when set, is used as the
+// IPv4 address instead of the one detected on local interfaces.
+func NewUpdater(registrar Registrar, hostname string, ttl int, refresh time.Duration, staticIP, stateDir string, logger *logrus.Logger) *Updater {
+	return &Updater{
+		registrar: registrar,
+		hostname:  hostname,
+		ttl:       ttl,
+		refresh:   refresh,
+		staticIP:  staticIP,
+		stateDir:  stateDir,
+		logger:    logger,
+	}
+}
+
+// Update registers the current addresses if they differ from the last
+// registration or the registration is due for a refresh
+func (u *Updater) Update(ctx context.Context) error {
+	records, err := u.currentRecords()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no public IP address found to register")
+	}
+
+	var last registration
+	if err := state.Load(u.stateDir, registrationFile, &last); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load DNS registration state: %w", err)
+	}
+
+	changed := last.Hostname != u.hostname || !reflect.DeepEqual(last.Records, records)
+	if !changed && time.Since(last.RegisteredAt) < u.refresh {
+		return nil
+	}
+
+	if changed {
+		u.logger.Infof("Public addresses for %s changed, registering %s", u.hostname, describeRecords(records))
+	}
+	if err := u.registrar.Register(ctx, u.hostname, records); err != nil {
+		return fmt.Errorf("failed to register DNS records for %s: %w", u.hostname, err)
+	}
+
+	return state.Save(u.stateDir, registrationFile, registration{
+		Hostname:     u.hostname,
+		Records:      records,
+		RegisteredAt: time.Now(),
+	})
+}
+
+// currentRecords builds A/AAAA records from the server's public addresses
+func (u *Updater) currentRecords() ([]Record, error) {
+	addresses, err := PublicAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	if u.staticIP != "" {
+		records = append(records, Record{Type: "A", Value: u.staticIP, TTL: u.ttl})
+	}
+	for _, ip := range addresses {
+		if ip.To4() != nil {
+			if u.staticIP == "" {
+				records = append(records, Record{Type: "A", Value: ip.String(), TTL: u.ttl})
+			}
+			continue
+		}
+		records = append(records, Record{Type: "AAAA", Value: ip.String(), TTL: u.ttl})
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Type != records[j].Type {
+			return records[i].Type < records[j].Type
+		}
+		return records[i].Value < records[j].Value
+	})
+	return records, nil
+}
+
+// PublicAddresses returns the globally routable unicast addresses configured
+// on the server's interfaces
+func PublicAddresses() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+
+	var public []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		public = append(public, ip)
+	}
+	return public, nil
+}
+
+// describeRecords formats records for logging
+func describeRecords(records []Record) string {
+	parts := make([]string, len(records))
+	for i, record := range records {
+		parts[i] = record.Type + " " + record.Value
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LatitudeRegistrar registers records through the Latitude.sh API
+type LatitudeRegistrar struct {
+	client   *client.LatitudeClient
+	endpoint string
+}
+
+// NewLatitudeRegistrar creates a registrar backed by the Latitude.sh API
+func NewLatitudeRegistrar(latitudeClient *client.LatitudeClient, endpoint string) *LatitudeRegistrar {
+	return &LatitudeRegistrar{client: latitudeClient, endpoint: endpoint}
+}
+
+// Register sends the records to the API
+func (r *LatitudeRegistrar) Register(ctx context.Context, hostname string, records []Record) error {
+	return r.client.SendReport(ctx, r.endpoint, map[string]interface{}{
+		"hostname": hostname,
+		"records":  records,
+	})
+}
+
+// NSUpdateRegistrar registers records with an RFC 2136 dynamic update
+// through nsupdate(1)
+type NSUpdateRegistrar struct {
+	server  string
+	zone    string
+	keyFile string
+}
+
+// NewNSUpdateRegistrar creates a registrar that sends dynamic updates to server.
+// keyFile is an optional TSIG key file passed to nsupdate -k.
+func NewNSUpdateRegistrar(server, zone, keyFile string) *NSUpdateRegistrar {
+	return &NSUpdateRegistrar{server: server, zone: zone, keyFile: keyFile}
+}
+
+// Register replaces the A and AAAA records for hostname
+func (r *NSUpdateRegistrar) Register(ctx context.Context, hostname string, records []Record) error {
+	fqdn := strings.TrimSuffix(hostname, ".") + "."
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "server %s\n", r.server)
+	if r.zone != "" {
+		fmt.Fprintf(&script, "zone %s\n", r.zone)
+	}
+	fmt.Fprintf(&script, "update delete %s A\n", fqdn)
+	fmt.Fprintf(&script, "update delete %s AAAA\n", fqdn)
+	for _, record := range records {
+		fmt.Fprintf(&script, "update add %s %d %s %s\n", fqdn, record.TTL, record.Type, record.Value)
+	}
+	script.WriteString("send\n")
+
+	args := []string{}
+	if r.keyFile != "" {
+		args = append(args, "-k", r.keyFile)
+	}
+	nsupdate := command.Cmd{Argv: append([]string{"nsupdate"}, args...), Stdin: script.String()}
+	if output, err := command.CombinedOutput(ctx, nsupdate); err != nil {
+		return fmt.Errorf("nsupdate failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package errkind classifies agent errors by what it takes to resolve them.
+//
+// Collectors and the API client tag the errors they return with a Kind, and
+// errors from the standard library that are unambiguous, such as a missing
+// executable, are recognized without a tag. Logs, exit codes and reports to
+// the API use the kind to tell errors that need an operator from those the
+// agent recovers from on its own.
+package errkind
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os/exec"
+	"syscall"
+)
+
+// Kind is the category of an error
+type Kind string
+
+// Error kinds
+const (
+	// Config is an invalid or incomplete configuration
+	Config Kind = "config"
+	// Network is a failure to reach the API or a transient API error, such
+	// as a timeout, 429 or 5xx, that resolves by retrying
+	Network Kind = "transient_network"
+	// APIAuth is the API rejecting the agent's credentials
+	APIAuth Kind = "api_auth"
+	// Privilege is the agent lacking the permissions an operation needs,
+	// e.g. a missing sudo rule
+	Privilege Kind = "privilege"
+	// ToolMissing is an external tool the agent needs that is not installed
+	ToolMissing Kind = "external_tool_missing"
+	// Unknown is any other error
+	Unknown Kind = "unknown"
+)
+
+// Exit codes by kind, following sysexits.h so service managers and scripts
+// can tell them apart
+const (
+	exitUnknown     = 1
+	exitUnavailable = 69 // EX_UNAVAILABLE
+	exitTempFail    = 75 // EX_TEMPFAIL
+	exitNoPerm      = 77 // EX_NOPERM
+	exitConfig      = 78 // EX_CONFIG
+)
+
+// Error is an error tagged with its kind
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap tags err with a kind. It returns nil for a nil error.
+func Wrap(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// Of returns the kind of err: the innermost tag in its chain, or the kind
+// of a recognized standard library error. It returns an empty kind for nil.
+func Of(err error) Kind {
+	if err == nil {
+		return ""
+	}
+
+	var tagged *Error
+	if errors.As(err, &tagged) {
+		// A more specific tag further down the chain wins, e.g. a missing
+		// tool behind a collector's failure
+		if inner := Of(tagged.Err); inner != Unknown {
+			return inner
+		}
+		return tagged.Kind
+	}
+
+	var pathErr *fs.PathError
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return ToolMissing
+	case errors.As(err, &pathErr) && pathErr.Op == "fork/exec" && errors.Is(err, fs.ErrNotExist):
+		// An executable given by its full path that is not there
+		return ToolMissing
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, syscall.EPERM):
+		return Privilege
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &opErr), errors.As(err, &dnsErr):
+		return Network
+	}
+	return Unknown
+}
+
+// NeedsOperator reports whether err persists until someone intervenes, as
+// opposed to errors the agent recovers from by retrying
+func NeedsOperator(err error) bool {
+	switch Of(err) {
+	case Config, APIAuth, Privilege, ToolMissing:
+		return true
+	}
+	return false
+}
+
+// ExitCode returns the process exit code for err
+func ExitCode(err error) int {
+	switch Of(err) {
+	case "":
+		return 0
+	case Config, APIAuth:
+		return exitConfig
+	case Privilege:
+		return exitNoPerm
+	case ToolMissing:
+		return exitUnavailable
+	case Network:
+		return exitTempFail
+	}
+	return exitUnknown
+}
@@ -0,0 +1,228 @@
+// Package history keeps recent metric samples in a fixed-size ring file, so
+// trends can be inspected on the server without the central dashboard.
+//
+// The file starts with a header holding the metric names, the number of
+// slots and the ring position, followed by one fixed-size record per slot:
+// a Unix timestamp and one float32 per metric. Once every slot is used the
+// oldest sample is overwritten.
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FileName is the ring file's name in the state directory
+const FileName = "metrics.ring"
+
+var magic = []byte("LSHTS1\n")
+
+// Sample is the value of each metric at one point in time
+type Sample struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// header is the fixed part of the file before the records
+type header struct {
+	names []string
+	slots uint32
+	next  uint32
+	count uint32
+}
+
+// size returns the header's encoded length
+func (h *header) size() int64 {
+	n := int64(len(magic)) + 4*3 + 2
+	for _, name := range h.names {
+		n += 1 + int64(len(name))
+	}
+	return n
+}
+
+// recordSize returns the length of one record
+func (h *header) recordSize() int64 {
+	return 8 + 4*int64(len(h.names))
+}
+
+// Store is a ring file open for writing
+type Store struct {
+	mu     sync.Mutex
+	file   *os.File
+	header header
+}
+
+// Open opens the ring file at path, creating it if needed. A file with
+// different metrics or capacity is recreated, discarding its samples.
+func Open(path string, names []string, slots int) (*Store, error) {
+	if slots <= 0 || slots > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid number of slots %d", slots)
+	}
+	for _, name := range names {
+		if name == "" || len(name) > math.MaxUint8 {
+			return nil, fmt.Errorf("invalid metric name %q", name)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	s := &Store{file: file}
+
+	existing, err := readHeader(file)
+	if err == nil && slices.Equal(existing.names, names) && existing.slots == uint32(slots) {
+		s.header = *existing
+		return s, nil
+	}
+
+	s.header = header{names: append([]string{}, names...), slots: uint32(slots)}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to reset %s: %w", path, err)
+	}
+	if err := file.Truncate(s.header.size() + s.header.recordSize()*int64(slots)); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to size %s: %w", path, err)
+	}
+	if err := s.writeHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the file
+func (s *Store) Close() error {
+	return s.file.Close()
+}
+
+// Append records a sample. Metrics missing from the sample are stored as NaN
+// and left out when read back.
+func (s *Store) Append(sample Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := make([]byte, s.header.recordSize())
+	binary.LittleEndian.PutUint64(record, uint64(sample.Time.Unix()))
+	for i, name := range s.header.names {
+		value, ok := sample.Values[name]
+		if !ok {
+			value = math.NaN()
+		}
+		binary.LittleEndian.PutUint32(record[8+4*i:], math.Float32bits(float32(value)))
+	}
+
+	offset := s.header.size() + int64(s.header.next)*s.header.recordSize()
+	if _, err := s.file.WriteAt(record, offset); err != nil {
+		return fmt.Errorf("failed to write sample: %w", err)
+	}
+	s.header.next = (s.header.next + 1) % s.header.slots
+	if s.header.count < s.header.slots {
+		s.header.count++
+	}
+	return s.writeHeader()
+}
+
+// writeHeader encodes the header at the start of the file
+func (s *Store) writeHeader() error {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.LittleEndian, s.header.slots)
+	binary.Write(&buf, binary.LittleEndian, s.header.next)
+	binary.Write(&buf, binary.LittleEndian, s.header.count)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(s.header.names)))
+	for _, name := range s.header.names {
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+	}
+	if _, err := s.file.WriteAt(buf.Bytes(), 0); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	return nil
+}
+
+// readHeader decodes the header of a ring file
+func readHeader(r io.ReaderAt) (*header, error) {
+	reader := io.NewSectionReader(r, 0, math.MaxInt64)
+
+	prefix := make([]byte, len(magic))
+	if _, err := io.ReadFull(reader, prefix); err != nil || !bytes.Equal(prefix, magic) {
+		return nil, errors.New("not a metrics ring file")
+	}
+
+	var h header
+	var nameCount uint16
+	for _, v := range []interface{}{&h.slots, &h.next, &h.count, &nameCount} {
+		if err := binary.Read(reader, binary.LittleEndian, v); err != nil {
+			return nil, fmt.Errorf("truncated header: %w", err)
+		}
+	}
+	for i := 0; i < int(nameCount); i++ {
+		var length [1]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, fmt.Errorf("truncated header: %w", err)
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, fmt.Errorf("truncated header: %w", err)
+		}
+		h.names = append(h.names, string(name))
+	}
+	if h.slots == 0 || h.next >= h.slots || h.count > h.slots {
+		return nil, errors.New("corrupt header")
+	}
+	return &h, nil
+}
+
+// Query reads the samples taken at or after since from the ring file at
+// path, oldest first. names limits the metrics returned; empty means all.
+// The file is only read, so the agent can keep writing it.
+func Query(path string, since time.Time, names []string) ([]Sample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h, err := readHeader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	samples := []Sample{}
+	record := make([]byte, h.recordSize())
+	// The oldest sample is at next once the ring has wrapped, else at 0
+	start := (h.next + h.slots - h.count) % h.slots
+	for i := uint32(0); i < h.count; i++ {
+		slot := (start + i) % h.slots
+		if _, err := file.ReadAt(record, h.size()+int64(slot)*h.recordSize()); err != nil {
+			return nil, fmt.Errorf("failed to read sample: %w", err)
+		}
+		t := time.Unix(int64(binary.LittleEndian.Uint64(record)), 0)
+		if t.Before(since) {
+			continue
+		}
+
+		sample := Sample{Time: t, Values: make(map[string]float64)}
+		for j, name := range h.names {
+			if len(names) > 0 && !slices.Contains(names, name) {
+				continue
+			}
+			value := float64(math.Float32frombits(binary.LittleEndian.Uint32(record[8+4*j:])))
+			if !math.IsNaN(value) {
+				sample.Values[name] = value
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
@@ -0,0 +1,33 @@
+// Package lines scans text one line at a time, so command output and /proc
+// files are parsed without holding them in memory or splitting them into
+// slices of strings.
+package lines
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// maxLineSize bounds a single line; longer lines end the scan with an error
+const maxLineSize = 1024 * 1024
+
+// Scan calls fn for each line of r, without the line terminator
+func Scan(r io.Reader, fn func(line string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// ScanFile calls fn for each line of the file at path
+func ScanFile(path string, fn func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return Scan(f, fn)
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/latitudesh/agent/internal/errkind"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,9 +43,29 @@ func New(level, format string) (*Logger, error) {
 	// Set output to stdout
 	log.SetOutput(os.Stdout)
 
+	log.AddHook(errorKindHook{})
+
 	return &Logger{Logger: log}, nil
 }
 
+// errorKindHook adds the kind of an entry's error, so logs tell errors that
+// need an operator from those that will pass on their own
+type errorKindHook struct{}
+
+func (errorKindHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (errorKindHook) Fire(entry *logrus.Entry) error {
+	if err, ok := entry.Data[logrus.ErrorKey].(error); ok {
+		entry.Data["error_kind"] = errkind.Of(err)
+		if errkind.NeedsOperator(err) {
+			entry.Data["needs_operator"] = true
+		}
+	}
+	return nil
+}
+
 // WithFields creates a new logger entry with the given fields
 func (l *Logger) WithFields(fields map[string]interface{}) *logrus.Entry {
 	return l.Logger.WithFields(fields)
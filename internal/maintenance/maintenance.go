@@ -0,0 +1,63 @@
+package maintenance
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/schedule"
+)
+
+// Tracker knows whether the server is in a planned maintenance window,
+// either a recurring window from the configuration or one announced by the
+// API. Health degradations during maintenance are still collected but
+// flagged as suppressed instead of paging anyone.
+type Tracker struct {
+	windows []*schedule.Window
+
+	mu        sync.Mutex
+	apiUntil  time.Time
+	apiReason string
+}
+
+// NewTracker creates a tracker for the configured recurring windows
+func NewTracker(windows []*schedule.Window) *Tracker {
+	return &Tracker{windows: windows}
+}
+
+// SetAPIWindow records the maintenance window announced by the API, which
+// ends at until. A nil until clears it.
+func (t *Tracker) SetAPIWindow(until *time.Time, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until == nil {
+		t.apiUntil, t.apiReason = time.Time{}, ""
+		return
+	}
+	t.apiUntil, t.apiReason = *until, reason
+}
+
+// Active reports whether now falls inside a maintenance window and describes
+// the window. A nil Tracker is never in maintenance.
+func (t *Tracker) Active(now time.Time) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	t.mu.Lock()
+	until, reason := t.apiUntil, t.apiReason
+	t.mu.Unlock()
+	if now.Before(until) {
+		if reason != "" {
+			return fmt.Sprintf("%s until %s", reason, until.Format(time.RFC3339)), true
+		}
+		return fmt.Sprintf("maintenance until %s", until.Format(time.RFC3339)), true
+	}
+
+	for _, w := range t.windows {
+		if w.Contains(now) {
+			return fmt.Sprintf("maintenance window %s", w), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,229 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Event types that webhooks can subscribe to
+const (
+	HealthChanged = "health_changed"
+	FirewallDrift = "firewall_drift"
+	SyncFailed    = "sync_failed"
+	AgentUpdated  = "agent_updated"
+	Alert         = "alert"
+	Security      = "security_finding"
+	Traffic       = "traffic_anomaly"
+	Identity      = "identity_changed"
+	Network       = "network_changed"
+)
+
+// Events lists every event type
+var Events = []string{HealthChanged, FirewallDrift, SyncFailed, AgentUpdated, Alert, Security, Traffic, Identity, Network}
+
+// healthEvents are the event types withheld during maintenance windows
+var healthEvents = map[string]bool{HealthChanged: true, Alert: true}
+
+// Webhook formats
+const (
+	FormatGeneric = "generic"
+	FormatSlack   = "slack"
+)
+
+// webhookTimeout bounds a single webhook delivery
+const webhookTimeout = 10 * time.Second
+
+// Event is a notable local event delivered to webhooks
+type Event struct {
+	Type      string            `json:"type"`
+	Message   string            `json:"message"`
+	Hostname  string            `json:"hostname"`
+	Timestamp time.Time         `json:"timestamp"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// Webhook is a configured notification target
+type Webhook struct {
+	URL    string
+	Format string
+	// Events limits delivery to the listed event types; empty means all
+	Events []string
+}
+
+// wants reports whether the webhook subscribes to an event type
+func (w Webhook) wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Sink receives every event in addition to the webhooks, e.g. a notifier plugin
+type Sink interface {
+	Name() string
+	Deliver(ctx context.Context, event Event) error
+}
+
+// Notifier delivers events to webhooks. A nil Notifier discards all events.
+type Notifier struct {
+	webhooks       []Webhook
+	sinks          []Sink
+	repeatInterval time.Duration
+	httpClient     *http.Client
+	logger         *logrus.Logger
+
+	mu          sync.Mutex
+	lastSent    map[string]time.Time
+	maintenance func(time.Time) (string, bool)
+}
+
+// NewNotifier creates a notifier. Identical events are not repeated within
+// repeatInterval so a persistent failure does not flood the channel.
+func NewNotifier(webhooks []Webhook, repeatInterval time.Duration, logger *logrus.Logger) *Notifier {
+	return &Notifier{
+		webhooks:       webhooks,
+		repeatInterval: repeatInterval,
+		httpClient:     &http.Client{Timeout: webhookTimeout},
+		logger:         logger,
+		lastSent:       make(map[string]time.Time),
+	}
+}
+
+// AddSink registers a sink that receives every event
+func (n *Notifier) AddSink(sink Sink) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sinks = append(n.sinks, sink)
+}
+
+// SetMaintenance registers a check for planned maintenance. Health events
+// raised while it reports a window are logged but not delivered, so planned
+// work such as load tests does not page anyone.
+func (n *Notifier) SetMaintenance(active func(time.Time) (string, bool)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.maintenance = active
+}
+
+// Wants reports whether any webhook or sink subscribes to an event type, so
+// callers can skip work needed only to produce that event
+func (n *Notifier) Wants(eventType string) bool {
+	if n == nil {
+		return false
+	}
+	n.mu.Lock()
+	hasSinks := len(n.sinks) > 0
+	n.mu.Unlock()
+	if hasSinks {
+		return true
+	}
+	for _, w := range n.webhooks {
+		if w.wants(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify delivers an event to all subscribed webhooks in the background
+func (n *Notifier) Notify(eventType, message string, fields map[string]string) {
+	if !n.Wants(eventType) {
+		return
+	}
+
+	key := eventType + "\x00" + message
+	n.mu.Lock()
+	if n.maintenance != nil && healthEvents[eventType] {
+		if window, ok := n.maintenance(time.Now()); ok {
+			n.mu.Unlock()
+			n.logger.Infof("Suppressed %s notification during %s: %s", eventType, window, message)
+			return
+		}
+	}
+	if last, ok := n.lastSent[key]; ok && time.Since(last) < n.repeatInterval {
+		n.mu.Unlock()
+		return
+	}
+	n.lastSent[key] = time.Now()
+	sinks := n.sinks
+	n.mu.Unlock()
+
+	hostname, _ := os.Hostname()
+	event := Event{
+		Type:      eventType,
+		Message:   message,
+		Hostname:  hostname,
+		Timestamp: time.Now(),
+		Fields:    fields,
+	}
+
+	for _, w := range n.webhooks {
+		if !w.wants(eventType) {
+			continue
+		}
+		go func(w Webhook) {
+			if err := n.deliver(w, event); err != nil {
+				n.logger.WithError(err).Warnf("Failed to deliver %s webhook", eventType)
+			}
+		}(w)
+	}
+	for _, sink := range sinks {
+		go func(sink Sink) {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+			defer cancel()
+			if err := sink.Deliver(ctx, event); err != nil {
+				n.logger.WithError(err).Warnf("Failed to deliver %s event to %s", eventType, sink.Name())
+			}
+		}(sink)
+	}
+}
+
+// deliver posts an event to a single webhook
+func (n *Notifier) deliver(w Webhook, event Event) error {
+	var payload interface{} = event
+	if w.Format == FormatSlack {
+		text := fmt.Sprintf("*[%s] %s*: %s", event.Hostname, event.Type, event.Message)
+		for key, value := range event.Fields {
+			text += fmt.Sprintf("\n• %s: %s", key, value)
+		}
+		payload = map[string]string{"text": text}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
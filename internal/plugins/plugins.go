@@ -0,0 +1,367 @@
+// Package plugins runs external plugin processes that extend the agent.
+//
+// A plugin is an executable in the plugin directory. The agent starts it
+// once and talks to it over stdio with one JSON object per line: requests
+// are {"id": 1, "method": "...", "params": ...} and every request gets a
+// response {"id": 1, "result": ...} or {"id": 1, "error": "..."}. Anything
+// the plugin writes to stderr is logged.
+//
+// Methods, in plugin API version 1:
+//
+//	handshake  params {"api_version": 1, "agent_version": "..."}
+//	           result {"name", "version", "api_version", "kinds", "interval"}
+//	collect    (collector) result: any JSON, reported to the API
+//	apply      (applier) params: configuration from the API
+//	           result {"changed": bool, "message": "..."}
+//	notify     (notifier) params: an agent event, result ignored
+//	shutdown   sent before the agent stops; the plugin should exit
+//
+// A plugin whose api_version differs from the agent's is not loaded.
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/notify"
+	"github.com/sirupsen/logrus"
+)
+
+// APIVersion is the plugin API version implemented by this agent
+const APIVersion = 1
+
+// Plugin kinds
+const (
+	KindCollector = "collector"
+	KindApplier   = "applier"
+	KindNotifier  = "notifier"
+)
+
+// Kinds lists every plugin kind
+var Kinds = []string{KindCollector, KindApplier, KindNotifier}
+
+// maxResponse bounds a single response line
+const maxResponse = 4 << 20
+
+// Manifest describes a plugin, as returned by its handshake
+type Manifest struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version"`
+	APIVersion int      `json:"api_version"`
+	Kinds      []string `json:"kinds"`
+	// Interval overrides how often collectors and appliers run
+	Interval string `json:"interval,omitempty"`
+}
+
+// ApplyResult is an applier's outcome
+type ApplyResult struct {
+	Changed bool   `json:"changed"`
+	Message string `json:"message,omitempty"`
+}
+
+type request struct {
+	ID     uint64      `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+type response struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Discover returns the plugin executables in dir. Files that other users
+// could modify are skipped, since plugins run with the agent's privileges.
+func Discover(dir string, logger *logrus.Logger) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read plugin directory: %w", err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || int(stat.Uid) != os.Geteuid() || info.Mode().Perm()&0022 != 0 {
+			logger.Warnf("Skipping plugin %s: it must be owned by the agent's user and not group or world writable", path)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// Plugin is a running plugin process. Calls are serialized; a plugin that
+// exits or times out is restarted on the next call.
+type Plugin struct {
+	path         string
+	agentVersion string
+	timeout      time.Duration
+	logger       *logrus.Logger
+
+	Manifest Manifest
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+	stdin  io.WriteCloser
+	lines  *bufio.Scanner
+	nextID uint64
+}
+
+// Start starts a plugin and performs the handshake
+func Start(path, agentVersion string, timeout time.Duration, logger *logrus.Logger) (*Plugin, error) {
+	p := &Plugin{path: path, agentVersion: agentVersion, timeout: timeout, logger: logger}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Name returns the plugin's name
+func (p *Plugin) Name() string {
+	return p.Manifest.Name
+}
+
+// Has reports whether the plugin implements a kind
+func (p *Plugin) Has(kind string) bool {
+	return slices.Contains(p.Manifest.Kinds, kind)
+}
+
+// Collect runs a collector plugin and returns its data
+func (p *Plugin) Collect(ctx context.Context) (json.RawMessage, error) {
+	return p.call(ctx, "collect", nil)
+}
+
+// Apply passes configuration from the API to an applier plugin
+func (p *Plugin) Apply(ctx context.Context, config json.RawMessage) (*ApplyResult, error) {
+	result, err := p.call(ctx, "apply", config)
+	if err != nil {
+		return nil, err
+	}
+	var applied ApplyResult
+	if err := json.Unmarshal(result, &applied); err != nil {
+		return nil, fmt.Errorf("invalid apply result from plugin %s: %w", p.Name(), err)
+	}
+	return &applied, nil
+}
+
+// Deliver passes an event to a notifier plugin
+func (p *Plugin) Deliver(ctx context.Context, event notify.Event) error {
+	_, err := p.call(ctx, "notify", event)
+	return err
+}
+
+// Close asks the plugin to shut down and kills it if it does not exit
+func (p *Plugin) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	p.roundTrip(ctx, "shutdown", nil)
+	p.stop()
+}
+
+// start launches the process and checks its manifest
+func (p *Plugin) start() error {
+	cmd := exec.Command(p.path)
+	// Plugins get the scrubbed environment of every other command, never
+	// the agent's own with its API token
+	cmd.Env = command.Env()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := p.logger.WithField("plugin", filepath.Base(p.path)).WriterLevel(logrus.WarnLevel)
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		stderr.Close()
+		return fmt.Errorf("failed to start plugin %s: %w", p.path, err)
+	}
+
+	exited := make(chan struct{})
+	p.cmd = cmd
+	p.exited = exited
+	p.stdin = stdin
+	p.lines = bufio.NewScanner(stdout)
+	p.lines.Buffer(make([]byte, 64*1024), maxResponse)
+	go func() {
+		cmd.Wait()
+		stderr.Close()
+		close(exited)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	result, err := p.roundTrip(ctx, "handshake", map[string]interface{}{
+		"api_version":   APIVersion,
+		"agent_version": p.agentVersion,
+	})
+	if err != nil {
+		p.stop()
+		return fmt.Errorf("handshake with plugin %s failed: %w", p.path, err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(result, &manifest); err != nil {
+		p.stop()
+		return fmt.Errorf("invalid manifest from plugin %s: %w", p.path, err)
+	}
+	switch {
+	case manifest.APIVersion != APIVersion:
+		err = fmt.Errorf("plugin %s uses API version %d, agent supports %d", p.path, manifest.APIVersion, APIVersion)
+	case manifest.Name == "":
+		err = fmt.Errorf("plugin %s did not report a name", p.path)
+	case p.Manifest.Name != "" && manifest.Name != p.Manifest.Name:
+		err = fmt.Errorf("plugin %s changed its name from %s to %s", p.path, p.Manifest.Name, manifest.Name)
+	}
+	for _, kind := range manifest.Kinds {
+		if err == nil && !slices.Contains(Kinds, kind) {
+			err = fmt.Errorf("plugin %s reported unknown kind %q", p.path, kind)
+		}
+	}
+	if err != nil {
+		p.stop()
+		return err
+	}
+	// The manifest is fixed by the first start; a restarted plugin keeps it
+	if p.Manifest.Name == "" {
+		p.Manifest = manifest
+	}
+	return nil
+}
+
+// stop kills the process
+func (p *Plugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd = nil
+}
+
+// running reports whether the process is still alive
+func (p *Plugin) running() bool {
+	if p.cmd == nil {
+		return false
+	}
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// call sends a request, restarting the plugin first if it is not running
+func (p *Plugin) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.running() {
+		p.logger.Infof("Restarting plugin %s", p.Name())
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	result, err := p.roundTrip(ctx, method, params)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s %s failed: %w", p.Name(), method, err)
+	}
+	return result, nil
+}
+
+// roundTrip writes a request and reads its response. A plugin that does not
+// answer in time is killed, as its output can no longer be trusted to line
+// up with requests.
+func (p *Plugin) roundTrip(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	p.nextID++
+	id := p.nextID
+	data, err := json.Marshal(request{ID: id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.stdin.Write(append(data, '\n')); err != nil {
+		p.stop()
+		return nil, err
+	}
+
+	type line struct {
+		data []byte
+		err  error
+	}
+	read := make(chan line, 1)
+	go func() {
+		if p.lines.Scan() {
+			read <- line{data: p.lines.Bytes()}
+			return
+		}
+		err := p.lines.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		read <- line{err: err}
+	}()
+
+	var l line
+	select {
+	case l = <-read:
+	case <-ctx.Done():
+		p.stop()
+		<-read
+		return nil, fmt.Errorf("no response: %w", ctx.Err())
+	}
+	if l.err != nil {
+		p.stop()
+		return nil, fmt.Errorf("plugin exited: %w", l.err)
+	}
+
+	var resp response
+	if err := json.Unmarshal(l.data, &resp); err != nil {
+		p.stop()
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.ID != id {
+		p.stop()
+		return nil, fmt.Errorf("response id %d does not match request id %d", resp.ID, id)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,216 @@
+package power
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/schedule"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+// Supported power operations
+const (
+	Reboot   = "reboot"
+	Shutdown = "shutdown"
+)
+
+const (
+	confirmationTTL  = 10 * time.Minute
+	snapshotFileName = "power-snapshot.json"
+)
+
+// Snapshot captures host state right before a power operation so it can be
+// compared with the state after the server comes back
+type Snapshot struct {
+	Timestamp      time.Time     `json:"timestamp"`
+	Operation      string        `json:"operation"`
+	ScheduledFor   time.Time     `json:"scheduled_for"`
+	Hostname       string        `json:"hostname"`
+	Uptime         string        `json:"uptime"`
+	Load1          float64       `json:"load1"`
+	MemUsedPercent float64       `json:"mem_used_percent"`
+	LastCycle      *state.Status `json:"last_cycle,omitempty"`
+	UFWStatus      string        `json:"ufw_status,omitempty"`
+}
+
+// pendingRequest is a power request awaiting confirmation
+type pendingRequest struct {
+	operation string
+	expiresAt time.Time
+}
+
+// Controller performs API-initiated reboots and shutdowns behind a
+// confirmation step and the configured maintenance windows
+type Controller struct {
+	stateDir          string
+	windows           []*schedule.Window
+	delay             time.Duration
+	firewallCollector *collectors.FirewallCollector
+	commandWrapper    []string
+	pending           map[string]pendingRequest
+	mu                sync.Mutex
+	logger            *logrus.Logger
+}
+
+// NewController creates a new power controller
+func NewController(stateDir string, windows []*schedule.Window, delay time.Duration, firewallCollector *collectors.FirewallCollector, logger *logrus.Logger) *Controller {
+	return &Controller{
+		stateDir:          stateDir,
+		windows:           windows,
+		delay:             delay,
+		firewallCollector: firewallCollector,
+		commandWrapper:    []string{"sudo"},
+		pending:           make(map[string]pendingRequest),
+		logger:            logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run shutdown with privileges
+func (c *Controller) SetCommandWrapper(wrapper ...string) {
+	c.commandWrapper = wrapper
+}
+
+// Request handles a power operation. The first request returns a one-time
+// confirmation token; the operation is only scheduled when the same request
+// is repeated with args["confirmation_token"] set to that token. An optional
+// args["at"] (RFC3339) schedules the operation for a later time, which must
+// fall inside one of the configured windows.
+func (c *Controller) Request(ctx context.Context, operation string, args map[string]string) (string, error) {
+	if operation != Reboot && operation != Shutdown {
+		return "", fmt.Errorf("unsupported power operation %q", operation)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expirePending(now)
+
+	token := args["confirmation_token"]
+	if token == "" {
+		token, err := newToken()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate confirmation token: %w", err)
+		}
+		c.pending[token] = pendingRequest{operation: operation, expiresAt: now.Add(confirmationTTL)}
+		c.logger.Infof("Power %s requested, awaiting confirmation", operation)
+		return fmt.Sprintf("Confirmation required: resubmit the %s action with confirmation_token=%s within %s",
+			operation, token, confirmationTTL), nil
+	}
+
+	request, ok := c.pending[token]
+	if !ok || request.operation != operation {
+		return "", fmt.Errorf("invalid or expired confirmation token")
+	}
+	delete(c.pending, token)
+
+	at := now.Add(c.delay)
+	if value := args["at"]; value != "" {
+		requested, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return "", fmt.Errorf("invalid scheduled time %q: %w", value, err)
+		}
+		if requested.Before(now) {
+			return "", fmt.Errorf("scheduled time %s is in the past", value)
+		}
+		at = requested
+	}
+
+	if !schedule.InAny(c.windows, at) {
+		next, found := schedule.NextStart(c.windows, now)
+		if found {
+			return "", fmt.Errorf("%s at %s is outside the allowed power windows; next window opens at %s",
+				operation, at.Format(time.RFC3339), next.Format(time.RFC3339))
+		}
+		return "", fmt.Errorf("%s at %s is outside the allowed power windows", operation, at.Format(time.RFC3339))
+	}
+
+	snapshot := c.takeSnapshot(ctx, operation, at)
+	if err := state.Save(c.stateDir, snapshotFileName, snapshot); err != nil {
+		c.logger.WithError(err).Warn("Failed to save pre-power snapshot")
+	}
+
+	if err := c.schedule(ctx, operation, at); err != nil {
+		return "", err
+	}
+
+	c.logger.Warnf("Power %s scheduled for %s", operation, at.Format(time.RFC3339))
+	return fmt.Sprintf("%s scheduled for %s (host uptime %s, load %.2f, memory %.1f%% used)",
+		operation, at.Format(time.RFC3339), snapshot.Uptime, snapshot.Load1, snapshot.MemUsedPercent), nil
+}
+
+// schedule hands the operation to shutdown(8) so it runs gracefully and
+// survives an agent restart
+func (c *Controller) schedule(ctx context.Context, operation string, at time.Time) error {
+	flag := "-r"
+	if operation == Shutdown {
+		flag = "-h"
+	}
+	minutes := int(math.Ceil(time.Until(at).Minutes()))
+	if minutes < 0 {
+		minutes = 0
+	}
+
+	argv := append(append([]string{}, c.commandWrapper...), "shutdown", flag, "+"+strconv.Itoa(minutes),
+		fmt.Sprintf("Latitude.sh %s requested", operation))
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return fmt.Errorf("shutdown command failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// takeSnapshot records host state before the power operation
+func (c *Controller) takeSnapshot(ctx context.Context, operation string, at time.Time) *Snapshot {
+	snapshot := &Snapshot{
+		Timestamp:    time.Now(),
+		Operation:    operation,
+		ScheduledFor: at,
+	}
+	snapshot.Hostname, _ = os.Hostname()
+
+	if stats, err := collectors.GetSystemStats(); err == nil {
+		snapshot.Uptime = stats.Uptime.String()
+		snapshot.Load1 = stats.Load1
+		snapshot.MemUsedPercent = stats.MemUsedPercent()
+	}
+	if status, err := state.LoadStatus(c.stateDir); err == nil {
+		snapshot.LastCycle = status
+	}
+	if c.firewallCollector != nil {
+		if ufwStatus, err := c.firewallCollector.GetFirewallStatus(ctx); err == nil {
+			snapshot.UFWStatus = ufwStatus
+		}
+	}
+
+	return snapshot
+}
+
+// expirePending drops confirmation tokens that are no longer valid
+func (c *Controller) expirePending(now time.Time) {
+	for token, request := range c.pending {
+		if now.After(request.expiresAt) {
+			delete(c.pending, token)
+		}
+	}
+}
+
+// newToken generates a random confirmation token
+func newToken() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,416 @@
+// Package profiles applies workload profiles: named bundles of firewall
+// rules, sysctls and service checks defined in the Latitude.sh API, such as
+// opening the NCCL ports of GPU servers to the private VLAN only.
+//
+// A profile is applied as one unit. Its service checks must pass before
+// anything is changed, and if a sysctl or firewall rule cannot be applied,
+// the changes already made are reverted. Sysctl values from before a profile
+// was applied are kept so they can be restored when it is removed.
+package profiles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/collectors"
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const stateFileName = "profiles.json"
+
+// Profile states reported to the API
+const (
+	// StateApplied means every part of the profile is in place
+	StateApplied = "applied"
+	// StateDegraded means the profile is applied but a service check fails
+	StateDegraded = "degraded"
+	// StateFailed means the profile could not be applied or removed
+	StateFailed = "failed"
+	// StateRemoved means the profile was unassigned and has been removed
+	StateRemoved = "removed"
+)
+
+var (
+	validProfileName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	validServiceName = regexp.MustCompile(`^[a-zA-Z0-9:_.@-]+$`)
+	validPort        = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+)
+
+// Profile is a named bundle of host settings
+type Profile struct {
+	Name     string                    `json:"name"`
+	Rules    []collectors.FirewallRule `json:"firewall_rules"`
+	Sysctls  map[string]string         `json:"sysctls"`
+	Services []string                  `json:"services"`
+}
+
+// ProfilesResponse represents the profiles assigned to the server
+type ProfilesResponse struct {
+	Profiles []Profile `json:"profiles"`
+}
+
+// Parse parses the profiles returned by the API
+func Parse(profilesJSON string) ([]Profile, error) {
+	var response ProfilesResponse
+	if err := json.Unmarshal([]byte(profilesJSON), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles: %w", err)
+	}
+	return response.Profiles, nil
+}
+
+// Validate checks that every part of the profile is well formed, so nothing
+// is applied from a profile that would fail halfway
+func (p *Profile) Validate() error {
+	if !validProfileName.MatchString(p.Name) {
+		return fmt.Errorf("invalid profile name %q", p.Name)
+	}
+	for _, rule := range p.Rules {
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return fmt.Errorf("rule %s: protocol must be tcp or udp", rule)
+		}
+		if !validPort.MatchString(rule.Port) {
+			return fmt.Errorf("rule %s: invalid port", rule)
+		}
+		if rule.From != "any" && net.ParseIP(rule.From) == nil {
+			if _, _, err := net.ParseCIDR(rule.From); err != nil {
+				return fmt.Errorf("rule %s: invalid source", rule)
+			}
+		}
+	}
+	for key := range p.Sysctls {
+		if !collectors.ValidSysctlKey(key) {
+			return fmt.Errorf("invalid sysctl name %q", key)
+		}
+	}
+	for _, service := range p.Services {
+		if !validServiceName.MatchString(service) {
+			return fmt.Errorf("invalid service name %q", service)
+		}
+	}
+	return nil
+}
+
+// ServiceCheck is the result of checking one service of a profile
+type ServiceCheck struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Active bool   `json:"active"`
+}
+
+// Status is the outcome of a profile reported to the API
+type Status struct {
+	Name      string         `json:"name"`
+	State     string         `json:"state"`
+	Error     string         `json:"error,omitempty"`
+	Services  []ServiceCheck `json:"services,omitempty"`
+	AppliedAt *time.Time     `json:"applied_at,omitempty"`
+}
+
+// Report represents the status of all profiles reported to the API
+type Report struct {
+	Timestamp time.Time `json:"timestamp"`
+	Profiles  []Status  `json:"profiles"`
+}
+
+// applied is the local record of an applied profile
+type applied struct {
+	Profile Profile `json:"profile"`
+	// Original holds the sysctl values from before the profile was applied
+	Original  map[string]string `json:"original"`
+	AppliedAt time.Time         `json:"applied_at"`
+}
+
+// Manager applies profiles and keeps track of what they changed
+type Manager struct {
+	firewall       *collectors.FirewallCollector
+	stateDir       string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewManager creates a new profile manager. firewall may be nil when the
+// agent does not manage UFW, in which case profiles with rules fail. The
+// rules of profiles applied by a previous run are registered with the
+// firewall right away, so synchronization does not remove them.
+func NewManager(firewall *collectors.FirewallCollector, stateDir string, logger *logrus.Logger) *Manager {
+	m := &Manager{
+		firewall:       firewall,
+		stateDir:       stateDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+	m.setLocalRules(m.load())
+	return m
+}
+
+// SetCommandWrapper sets the command used to run sysctl and systemctl
+func (m *Manager) SetCommandWrapper(wrapper ...string) {
+	m.commandWrapper = wrapper
+}
+
+// Sync applies the assigned profiles, removes the ones no longer assigned
+// and reports the state of each. Callers must not change UFW concurrently.
+func (m *Manager) Sync(ctx context.Context, profiles []Profile) *Report {
+	current := m.load()
+	report := &Report{Timestamp: time.Now(), Profiles: []Status{}}
+
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	assigned := make(map[string]bool)
+	for _, profile := range profiles {
+		assigned[profile.Name] = true
+		report.Profiles = append(report.Profiles, m.syncProfile(ctx, profile, current))
+	}
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		if !assigned[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := Status{Name: name, State: StateRemoved}
+		if err := m.remove(ctx, current[name], current); err != nil {
+			status.State = StateFailed
+			status.Error = err.Error()
+		} else {
+			m.logger.Infof("Removed profile %s", name)
+			delete(current, name)
+		}
+		report.Profiles = append(report.Profiles, status)
+	}
+
+	if err := state.Save(m.stateDir, stateFileName, current); err != nil {
+		m.logger.WithError(err).Warn("Failed to save applied profiles")
+	}
+	m.setLocalRules(current)
+	return report
+}
+
+// syncProfile applies a single profile if it is new or changed
+func (m *Manager) syncProfile(ctx context.Context, profile Profile, current map[string]*applied) Status {
+	status := Status{Name: profile.Name}
+	fail := func(err error) Status {
+		status.State = StateFailed
+		status.Error = err.Error()
+		m.logger.Warnf("Profile %s failed: %v", profile.Name, err)
+		return status
+	}
+
+	if err := profile.Validate(); err != nil {
+		return fail(err)
+	}
+
+	var inactive []string
+	for _, service := range profile.Services {
+		check := m.checkService(ctx, service)
+		status.Services = append(status.Services, check)
+		if !check.Active {
+			inactive = append(inactive, service)
+		}
+	}
+
+	previous := current[profile.Name]
+	if previous != nil && reflect.DeepEqual(previous.Profile, profile) {
+		status.State = StateApplied
+		status.AppliedAt = &previous.AppliedAt
+		if len(inactive) > 0 {
+			status.State = StateDegraded
+			status.Error = fmt.Sprintf("services not active: %s", strings.Join(inactive, ", "))
+		}
+		return status
+	}
+
+	if len(inactive) > 0 {
+		return fail(fmt.Errorf("services not active: %s", strings.Join(inactive, ", ")))
+	}
+
+	record, err := m.apply(ctx, profile, previous, current)
+	if err != nil {
+		return fail(err)
+	}
+	current[profile.Name] = record
+	m.logger.Infof("Applied profile %s", profile.Name)
+
+	status.State = StateApplied
+	status.AppliedAt = &record.AppliedAt
+	return status
+}
+
+// apply sets the sysctls and firewall rules of a profile, replacing the
+// previously applied version if there is one. On failure, the sysctls
+// changed so far are restored.
+func (m *Manager) apply(ctx context.Context, profile Profile, previous *applied, current map[string]*applied) (*applied, error) {
+	record := &applied{Profile: profile, Original: make(map[string]string), AppliedAt: time.Now()}
+	changed := make(map[string]string)
+	rollback := func(cause error) error {
+		m.restoreSysctls(ctx, changed)
+		return cause
+	}
+
+	keys := make([]string, 0, len(profile.Sysctls))
+	for key := range profile.Sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := collectors.ReadSysctl(key)
+		if err != nil {
+			return nil, rollback(err)
+		}
+		record.Original[key] = value
+		if previous != nil {
+			if original, ok := previous.Original[key]; ok {
+				record.Original[key] = original
+			}
+		}
+
+		expected := strings.Join(strings.Fields(profile.Sysctls[key]), " ")
+		if value == expected {
+			continue
+		}
+		if err := m.run(ctx, "sysctl", "-w", key+"="+expected); err != nil {
+			return nil, rollback(err)
+		}
+		changed[key] = value
+	}
+
+	var oldRules []collectors.FirewallRule
+	if previous != nil {
+		oldRules = previous.Profile.Rules
+	}
+	others := m.otherRules(profile.Name, current)
+	add := ruleDifference(profile.Rules, oldRules, nil)
+	remove := ruleDifference(oldRules, profile.Rules, others)
+	if len(add)+len(remove) > 0 {
+		if m.firewall == nil {
+			return nil, rollback(fmt.Errorf("profile has firewall rules but firewall management is disabled"))
+		}
+		if err := m.firewall.ApplyRules(ctx, add, remove); err != nil {
+			return nil, rollback(err)
+		}
+	}
+
+	// Sysctls dropped from the profile go back to their original values
+	if previous != nil {
+		dropped := make(map[string]string)
+		for key, original := range previous.Original {
+			if _, ok := profile.Sysctls[key]; !ok {
+				dropped[key] = original
+			}
+		}
+		m.restoreSysctls(ctx, dropped)
+	}
+
+	return record, nil
+}
+
+// remove reverts the firewall rules and sysctls of an applied profile
+func (m *Manager) remove(ctx context.Context, record *applied, current map[string]*applied) error {
+	remove := ruleDifference(record.Profile.Rules, nil, m.otherRules(record.Profile.Name, current))
+	if len(remove) > 0 {
+		if m.firewall == nil {
+			return fmt.Errorf("profile has firewall rules but firewall management is disabled")
+		}
+		if err := m.firewall.ApplyRules(ctx, nil, remove); err != nil {
+			return err
+		}
+	}
+	m.restoreSysctls(ctx, record.Original)
+	return nil
+}
+
+// restoreSysctls writes back sysctl values, logging failures since there is
+// nothing better to fall back to
+func (m *Manager) restoreSysctls(ctx context.Context, values map[string]string) {
+	for key, value := range values {
+		if err := m.run(ctx, "sysctl", "-w", key+"="+value); err != nil {
+			m.logger.Errorf("Failed to restore sysctl %s to %q: %v", key, value, err)
+		}
+	}
+}
+
+// checkService reports whether a systemd unit is active
+func (m *Manager) checkService(ctx context.Context, service string) ServiceCheck {
+	argv := append(append([]string{}, m.commandWrapper...), "systemctl", "is-active", service)
+	// is-active exits non-zero for any state but active, so the output is
+	// what tells the states apart
+	output, _ := command.Output(ctx, command.Cmd{Argv: argv})
+	serviceState := strings.TrimSpace(string(output))
+	if serviceState == "" {
+		serviceState = "unknown"
+	}
+	return ServiceCheck{Name: service, State: serviceState, Active: serviceState == "active"}
+}
+
+// otherRules returns the rule keys used by applied profiles other than name
+func (m *Manager) otherRules(name string, current map[string]*applied) map[string]bool {
+	keys := make(map[string]bool)
+	for other, record := range current {
+		if other == name {
+			continue
+		}
+		for _, rule := range record.Profile.Rules {
+			keys[rule.String()] = true
+		}
+	}
+	return keys
+}
+
+// ruleDifference returns the rules in a that are neither in b nor keep
+func ruleDifference(a, b []collectors.FirewallRule, keep map[string]bool) []collectors.FirewallRule {
+	exclude := make(map[string]bool)
+	for _, rule := range b {
+		exclude[rule.String()] = true
+	}
+	var diff []collectors.FirewallRule
+	for _, rule := range a {
+		if !exclude[rule.String()] && !keep[rule.String()] {
+			exclude[rule.String()] = true
+			diff = append(diff, rule)
+		}
+	}
+	return diff
+}
+
+// load reads the applied profiles from the state dir
+func (m *Manager) load() map[string]*applied {
+	current := make(map[string]*applied)
+	if err := state.Load(m.stateDir, stateFileName, &current); err != nil && !os.IsNotExist(err) {
+		m.logger.WithError(err).Warn("Failed to read applied profiles")
+	}
+	return current
+}
+
+// setLocalRules registers the rules of the applied profiles with the firewall
+func (m *Manager) setLocalRules(current map[string]*applied) {
+	if m.firewall == nil {
+		return
+	}
+	var rules []collectors.FirewallRule
+	for _, record := range current {
+		rules = append(rules, record.Profile.Rules...)
+	}
+	m.firewall.SetLocalRules(rules)
+}
+
+// run executes a privileged command
+func (m *Manager) run(ctx context.Context, name string, args ...string) error {
+	argv := append(append(append([]string{}, m.commandWrapper...), name), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv})
+	if err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+// Package queue keeps outbound events in a journal file until the API has
+// accepted them, so events survive API outages and agent restarts.
+//
+// The journal is a file of JSON lines: a put record per enqueued event and
+// an ack record per delivered or dropped one. Opening the journal replays
+// it, and it is rewritten with only the pending events once enough acks
+// accumulate. A line cut short by a crash is ignored.
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileName is the journal's name in the state directory
+const FileName = "events.journal"
+
+// compactAfter is how many acks accumulate before the journal is rewritten
+const compactAfter = 1000
+
+// Event is an outbound event waiting for delivery
+type Event struct {
+	Seq uint64 `json:"seq"`
+	// Kind tells the sender how to deliver the event, e.g. "security"
+	Kind     string `json:"kind"`
+	Endpoint string `json:"endpoint"`
+	// Key identifies the event for deduplication: an event whose key is
+	// already pending is not enqueued again, and the API can drop
+	// redeliveries with the same key
+	Key        string          `json:"key,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+}
+
+// record is a line of the journal
+type record struct {
+	Op    string `json:"op"`
+	Event *Event `json:"event,omitempty"`
+	Seq   uint64 `json:"seq,omitempty"`
+}
+
+// rejectedError marks a delivery the API refused, as opposed to one that
+// failed to reach it
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// Rejected marks err as the API refusing an event. Rejected events are
+// dropped after the queue's maximum attempts, while other failures are
+// retried until the event expires.
+func Rejected(err error) error {
+	return &rejectedError{err: err}
+}
+
+// Queue is a persistent FIFO of outbound events, delivered at least once
+// and in order
+type Queue struct {
+	mu          sync.Mutex
+	flushMu     sync.Mutex
+	path        string
+	file        *os.File
+	pending     []Event
+	attempts    map[uint64]int
+	nextSeq     uint64
+	acks        int
+	maxEvents   int
+	maxAge      time.Duration
+	maxAttempts int
+	logger      *logrus.Logger
+}
+
+// Open opens the journal at path, creating it if needed, and loads the
+// pending events. At most maxEvents are kept, dropping the oldest, and
+// events older than maxAge are dropped instead of delivered.
+func Open(path string, maxEvents int, maxAge time.Duration, logger *logrus.Logger) (*Queue, error) {
+	if maxEvents <= 0 {
+		return nil, fmt.Errorf("invalid maximum of %d events", maxEvents)
+	}
+	q := &Queue{
+		path:        path,
+		attempts:    make(map[uint64]int),
+		nextSeq:     1,
+		maxEvents:   maxEvents,
+		maxAge:      maxAge,
+		maxAttempts: 5,
+		logger:      logger,
+	}
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if len(q.pending) > maxEvents {
+		q.logger.Warnf("Dropping %d queued events over the limit of %d", len(q.pending)-maxEvents, maxEvents)
+		q.pending = q.pending[len(q.pending)-maxEvents:]
+	}
+	// Rewriting on open drops acked events and any torn last line
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetMaxAttempts sets how many times delivery of an event may be rejected
+// before it is dropped
+func (q *Queue) SetMaxAttempts(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.maxAttempts = n
+}
+
+// replay reads the journal into the pending events
+func (q *Queue) replay() error {
+	file, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open event journal: %w", err)
+	}
+	defer file.Close()
+
+	index := make(map[uint64]int)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		switch {
+		case r.Op == "put" && r.Event != nil:
+			index[r.Event.Seq] = len(q.pending)
+			q.pending = append(q.pending, *r.Event)
+			q.nextSeq = max(q.nextSeq, r.Event.Seq+1)
+		case r.Op == "ack":
+			if i, ok := index[r.Seq]; ok {
+				q.pending[i].Seq = 0
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read event journal: %w", err)
+	}
+
+	kept := q.pending[:0]
+	for _, event := range q.pending {
+		if event.Seq != 0 {
+			kept = append(kept, event)
+		}
+	}
+	q.pending = kept
+	return nil
+}
+
+// compact rewrites the journal with only the pending events and reopens it
+// for appending
+func (q *Queue) compact() error {
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to rewrite event journal: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for i := range q.pending {
+		if err := encoder.Encode(record{Op: "put", Event: &q.pending[i]}); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("failed to rewrite event journal: %w", err)
+		}
+	}
+	if err := writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rewrite event journal: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to rewrite event journal: %w", err)
+	}
+
+	q.file, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open event journal: %w", err)
+	}
+	q.acks = 0
+	return nil
+}
+
+// append writes a record to the journal and syncs it to disk
+func (q *Queue) append(r record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := q.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write event journal: %w", err)
+	}
+	return q.file.Sync()
+}
+
+// ack removes the first pending event from the journal
+func (q *Queue) ack() error {
+	event := q.pending[0]
+	q.pending = q.pending[1:]
+	delete(q.attempts, event.Seq)
+	if err := q.append(record{Op: "ack", Seq: event.Seq}); err != nil {
+		return err
+	}
+	q.acks++
+	if q.acks >= compactAfter {
+		return q.compact()
+	}
+	return nil
+}
+
+// Enqueue adds an event to the end of the queue. payload is encoded as
+// JSON. An event whose key matches a pending event is ignored.
+func (q *Queue) Enqueue(kind, endpoint, key string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", kind, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if key != "" {
+		for _, event := range q.pending {
+			if event.Key == key {
+				return nil
+			}
+		}
+	}
+	for len(q.pending) >= q.maxEvents {
+		q.logger.Warnf("Event queue is full, dropping %s event %d from %s", q.pending[0].Kind, q.pending[0].Seq, q.pending[0].EnqueuedAt.Format(time.RFC3339))
+		if err := q.ack(); err != nil {
+			return err
+		}
+	}
+
+	event := Event{Seq: q.nextSeq, Kind: kind, Endpoint: endpoint, Key: key, Payload: data, EnqueuedAt: time.Now()}
+	if err := q.append(record{Op: "put", Event: &event}); err != nil {
+		return err
+	}
+	q.nextSeq++
+	q.pending = append(q.pending, event)
+	return nil
+}
+
+// Len returns the number of pending events
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Flush delivers pending events in order with send until the queue is
+// empty or a delivery fails, which stops the flush so later events are not
+// delivered ahead of it. Events can be enqueued while one is being sent.
+// It returns the number of events delivered.
+func (q *Queue) Flush(ctx context.Context, send func(context.Context, Event) error) (int, error) {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	delivered := 0
+	for {
+		event, ok, err := q.head()
+		if !ok || err != nil {
+			return delivered, err
+		}
+
+		err = send(ctx, event)
+		var rejected *rejectedError
+		if err != nil && !errors.As(err, &rejected) {
+			return delivered, err
+		}
+
+		q.mu.Lock()
+		if err != nil {
+			q.attempts[event.Seq]++
+			if q.attempts[event.Seq] < q.maxAttempts {
+				q.mu.Unlock()
+				return delivered, err
+			}
+			q.logger.Errorf("Dropping %s event %d after %d rejected deliveries: %v", event.Kind, event.Seq, q.attempts[event.Seq], err)
+		} else {
+			delivered++
+		}
+		// The event may have been dropped to make room while it was sent
+		var ackErr error
+		if len(q.pending) > 0 && q.pending[0].Seq == event.Seq {
+			ackErr = q.ack()
+		}
+		q.mu.Unlock()
+		if ackErr != nil {
+			return delivered, ackErr
+		}
+	}
+}
+
+// head returns the first pending event, dropping expired ones
+func (q *Queue) head() (Event, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 {
+		event := q.pending[0]
+		if q.maxAge <= 0 || time.Since(event.EnqueuedAt) <= q.maxAge {
+			return event, true, nil
+		}
+		q.logger.Warnf("Dropping %s event %d queued at %s, older than %s", event.Kind, event.Seq, event.EnqueuedAt.Format(time.RFC3339), q.maxAge)
+		if err := q.ack(); err != nil {
+			return Event{}, false, err
+		}
+	}
+	return Event{}, false, nil
+}
+
+// Close closes the journal
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file == nil {
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
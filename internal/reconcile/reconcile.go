@@ -0,0 +1,151 @@
+// Package reconcile compares the state observed on a server with the state
+// recorded for it in the Latitude.sh API.
+package reconcile
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Compared fields
+const (
+	FieldHostname = "hostname"
+	FieldIPs      = "ip_addresses"
+	FieldFirewall = "firewall_rules"
+	FieldTags     = "tags"
+)
+
+// Record is the server as the API knows it
+type Record struct {
+	Hostname    string   `json:"hostname"`
+	IPAddresses []string `json:"ip_addresses"`
+	Tags        []string `json:"tags"`
+}
+
+// ParseRecord parses the server record returned by the API
+func ParseRecord(recordJSON string) (*Record, error) {
+	var record Record
+	if err := json.Unmarshal([]byte(recordJSON), &record); err != nil {
+		return nil, fmt.Errorf("failed to parse server record: %w", err)
+	}
+	return &record, nil
+}
+
+// Observed is the server as seen locally. Tags and firewall rules are nil
+// when they are not managed by the agent.
+type Observed struct {
+	Hostname    string
+	IPAddresses []string
+	Tags        []string
+	// MissingRules and UnexpectedRules are the differences between UFW and
+	// the firewall in the API
+	MissingRules    []string
+	UnexpectedRules []string
+}
+
+// Mismatch is one field that differs between the server and the API.
+// Missing lists values the API has that the server lacks; Unexpected lists
+// values on the server the API does not know about.
+type Mismatch struct {
+	Field      string   `json:"field"`
+	Local      string   `json:"local,omitempty"`
+	API        string   `json:"api,omitempty"`
+	Missing    []string `json:"missing,omitempty"`
+	Unexpected []string `json:"unexpected,omitempty"`
+}
+
+// Report is the reconciliation report sent to the API
+type Report struct {
+	Timestamp  time.Time  `json:"timestamp"`
+	InSync     bool       `json:"in_sync"`
+	Mismatches []Mismatch `json:"mismatches"`
+	// Skipped lists fields that could not be compared, with the reason
+	Skipped map[string]string `json:"skipped,omitempty"`
+}
+
+// Compare returns the fields where the observed state differs from the record
+func Compare(observed *Observed, record *Record) []Mismatch {
+	mismatches := []Mismatch{}
+
+	if record.Hostname != "" && !sameHost(observed.Hostname, record.Hostname) {
+		mismatches = append(mismatches, Mismatch{Field: FieldHostname, Local: observed.Hostname, API: record.Hostname})
+	}
+
+	// Private addresses are left out of the unexpected side: bridges,
+	// containers and VPNs add them without the API being involved
+	missing, unexpected := diff(normalizeIPs(record.IPAddresses), normalizeIPs(observed.IPAddresses))
+	var unexpectedPublic []string
+	for _, ip := range unexpected {
+		if addr := net.ParseIP(ip); addr != nil && !addr.IsPrivate() {
+			unexpectedPublic = append(unexpectedPublic, ip)
+		}
+	}
+	if len(missing) > 0 || len(unexpectedPublic) > 0 {
+		mismatches = append(mismatches, Mismatch{Field: FieldIPs, Missing: missing, Unexpected: unexpectedPublic})
+	}
+
+	if len(observed.MissingRules) > 0 || len(observed.UnexpectedRules) > 0 {
+		mismatches = append(mismatches, Mismatch{Field: FieldFirewall, Missing: observed.MissingRules, Unexpected: observed.UnexpectedRules})
+	}
+
+	if observed.Tags != nil {
+		missing, unexpected := diff(record.Tags, observed.Tags)
+		if len(missing) > 0 || len(unexpected) > 0 {
+			mismatches = append(mismatches, Mismatch{Field: FieldTags, Missing: missing, Unexpected: unexpected})
+		}
+	}
+
+	return mismatches
+}
+
+// sameHost matches hostnames case-insensitively, accepting a short name
+// against its FQDN
+func sameHost(local, api string) bool {
+	local, api = strings.ToLower(strings.TrimSuffix(local, ".")), strings.ToLower(strings.TrimSuffix(api, "."))
+	if local == api {
+		return true
+	}
+	return strings.HasPrefix(api, local+".") || strings.HasPrefix(local, api+".")
+}
+
+// normalizeIPs strips prefix lengths and canonicalizes IPv6 notation
+func normalizeIPs(addresses []string) []string {
+	var normalized []string
+	for _, address := range addresses {
+		address, _, _ = strings.Cut(address, "/")
+		if ip := net.ParseIP(address); ip != nil {
+			address = ip.String()
+		}
+		normalized = append(normalized, address)
+	}
+	return normalized
+}
+
+// diff returns the values only in want and the values only in have, sorted
+func diff(want, have []string) (missing, unexpected []string) {
+	wantSet := make(map[string]bool)
+	for _, v := range want {
+		wantSet[v] = true
+	}
+	haveSet := make(map[string]bool)
+	for _, v := range have {
+		haveSet[v] = true
+	}
+	for v := range wantSet {
+		if !haveSet[v] {
+			missing = append(missing, v)
+		}
+	}
+	for v := range haveSet {
+		if !wantSet[v] {
+			unexpected = append(unexpected, v)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	return missing, unexpected
+}
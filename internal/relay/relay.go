@@ -0,0 +1,145 @@
+// Package relay forwards API traffic for agents on private networks without
+// internet access.
+//
+// The relay is an HTTP proxy that only supports CONNECT to an allowlist of
+// upstream hosts. Peers keep talking TLS end to end with the API through the
+// tunnel, so the relay never sees their tokens, rules or health reports.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dialTimeout bounds connecting to an upstream host
+const dialTimeout = 10 * time.Second
+
+// Server relays connections from peer agents to the API
+type Server struct {
+	listen         string
+	allowedSources []*net.IPNet
+	allowedHosts   []string
+	logger         *logrus.Logger
+}
+
+// NewServer creates a relay listening on listen. Only peers within
+// allowedSources may connect, and only to allowedHosts ("host:port").
+func NewServer(listen string, allowedSources, allowedHosts []string, logger *logrus.Logger) (*Server, error) {
+	s := &Server{listen: listen, allowedHosts: allowedHosts, logger: logger}
+	for _, source := range allowedSources {
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed source %q: %w", source, err)
+		}
+		s.allowedSources = append(s.allowedSources, network)
+	}
+	return s, nil
+}
+
+// Run serves peers until the context is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.listen,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	s.logger.Infof("Relaying API traffic for peers on %s", s.listen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP handles a CONNECT request from a peer
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	peer, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !s.sourceAllowed(peer) {
+		s.logger.Warnf("Relay refused connection from %s: not an allowed source", peer)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !slices.Contains(s.allowedHosts, r.Host) {
+		s.logger.Warnf("Relay refused tunnel from %s to %s: not an allowed host", peer, r.Host)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", r.Host, dialTimeout)
+	if err != nil {
+		s.logger.WithError(err).Warnf("Relay failed to connect to %s for %s", r.Host, peer)
+		http.Error(w, "upstream unreachable", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		s.logger.WithError(err).Warn("Relay failed to take over connection")
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	s.logger.Debugf("Relaying %s to %s", peer, r.Host)
+
+	// Bytes the peer sent after the request headers are already buffered
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, buffered)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+// sourceAllowed reports whether a peer address may use the relay
+func (s *Server) sourceAllowed(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.allowedSources {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeWrite half-closes a TCP connection so the other side sees EOF
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
@@ -0,0 +1,244 @@
+// Package reputation blocks traffic from networks listed in threat
+// intelligence feeds.
+//
+// The entries of every feed are loaded into an ipset per address family,
+// and a single managed iptables rule drops traffic from the set. Sets are
+// replaced atomically with ipset swap, so refreshing never leaves a gap.
+package reputation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/lines"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const stateFileName = "reputation.json"
+
+// Shortest prefixes accepted from a feed, so a bad entry cannot block large
+// parts of the internet
+const (
+	minPrefixV4 = 8
+	minPrefixV6 = 19
+)
+
+// FetchFunc downloads a feed, sending etag so an unchanged feed can be
+// answered with notModified
+type FetchFunc func(ctx context.Context, etag string) (body, newETag string, notModified bool, err error)
+
+// Feed is a named source of CIDRs to block
+type Feed struct {
+	Name  string
+	Fetch FetchFunc
+}
+
+// feedState is the cached copy of a feed, persisted in the state dir
+type feedState struct {
+	ETag      string    `json:"etag"`
+	Entries   []string  `json:"entries"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Manager keeps the ipsets and the deny rule in line with the feeds
+type Manager struct {
+	feeds          []Feed
+	setName        string
+	chain          string
+	maxEntries     int
+	stateDir       string
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewManager creates a new reputation manager. The IPv4 set is named
+// setName and the IPv6 set setName-v6; the deny rules are inserted at the
+// top of chain.
+func NewManager(feeds []Feed, setName, chain string, maxEntries int, stateDir string, logger *logrus.Logger) *Manager {
+	return &Manager{
+		feeds:          feeds,
+		setName:        setName,
+		chain:          chain,
+		maxEntries:     maxEntries,
+		stateDir:       stateDir,
+		commandWrapper: []string{"sudo"},
+		logger:         logger,
+	}
+}
+
+// SetCommandWrapper sets the command used to run ipset and iptables
+func (m *Manager) SetCommandWrapper(wrapper ...string) {
+	m.commandWrapper = wrapper
+}
+
+// Refresh downloads changed feeds, reloads the sets and makes sure the deny
+// rules are in place. A feed that cannot be downloaded keeps its last entries.
+func (m *Manager) Refresh(ctx context.Context) error {
+	cache := make(map[string]*feedState)
+	if err := state.Load(m.stateDir, stateFileName, &cache); err != nil && !os.IsNotExist(err) {
+		m.logger.WithError(err).Warn("Failed to read cached reputation feeds")
+	}
+
+	var errs []string
+	current := make(map[string]*feedState)
+	for _, feed := range m.feeds {
+		cached := cache[feed.Name]
+		etag := ""
+		if cached != nil {
+			etag = cached.ETag
+		}
+
+		body, newETag, notModified, err := feed.Fetch(ctx, etag)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Sprintf("%s: %v", feed.Name, err))
+			if cached != nil {
+				current[feed.Name] = cached
+			}
+		case notModified && cached != nil:
+			current[feed.Name] = cached
+		default:
+			entries, skipped := ParseFeed(body)
+			if skipped > 0 {
+				m.logger.Warnf("Skipped %d invalid or too broad entries in reputation feed %s", skipped, feed.Name)
+			}
+			current[feed.Name] = &feedState{ETag: newETag, Entries: entries, UpdatedAt: time.Now()}
+		}
+	}
+
+	if err := state.Save(m.stateDir, stateFileName, current); err != nil {
+		m.logger.WithError(err).Warn("Failed to cache reputation feeds")
+	}
+
+	var v4, v6 []string
+	seen := make(map[string]bool)
+	for _, feed := range current {
+		for _, entry := range feed.Entries {
+			if seen[entry] {
+				continue
+			}
+			seen[entry] = true
+			if strings.Contains(entry, ":") {
+				v6 = append(v6, entry)
+			} else {
+				v4 = append(v4, entry)
+			}
+		}
+	}
+	if len(v4)+len(v6) > m.maxEntries {
+		return fmt.Errorf("reputation feeds have %d entries, more than the maximum of %d", len(v4)+len(v6), m.maxEntries)
+	}
+	sort.Strings(v4)
+	sort.Strings(v6)
+
+	if err := m.loadSet(ctx, m.setName, "inet", v4); err != nil {
+		return err
+	}
+	if err := m.loadSet(ctx, m.setName+"-v6", "inet6", v6); err != nil {
+		return err
+	}
+	if err := m.ensureRule(ctx, "iptables", m.setName); err != nil {
+		return err
+	}
+	if err := m.ensureRule(ctx, "ip6tables", m.setName+"-v6"); err != nil {
+		return err
+	}
+	m.logger.Infof("Blocking %d IPv4 and %d IPv6 networks from %d reputation feeds", len(v4), len(v6), len(current))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to refresh reputation feeds: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ParseFeed extracts the networks from a feed with one IP or CIDR per line.
+// Comments starting with # or ; and anything after the first field are
+// ignored. It returns the normalized networks and the number skipped.
+func ParseFeed(body string) ([]string, int) {
+	var entries []string
+	skipped := 0
+
+	lines.Scan(strings.NewReader(body), func(line string) {
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+
+		entry := fields[0]
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			skipped++
+			return
+		}
+		ones, bits := network.Mask.Size()
+		if (bits == 32 && ones < minPrefixV4) || (bits == 128 && ones < minPrefixV6) {
+			skipped++
+			return
+		}
+		entries = append(entries, network.String())
+	})
+	return entries, skipped
+}
+
+// loadSet replaces the contents of a set by loading a temporary set and
+// swapping it in
+func (m *Manager) loadSet(ctx context.Context, name, family string, entries []string) error {
+	maxElem := fmt.Sprint(max(m.maxEntries, 1024))
+	if _, err := m.run(ctx, "", "ipset", "create", name, "hash:net", "family", family, "maxelem", maxElem, "-exist"); err != nil {
+		return err
+	}
+
+	staging := name + "-new"
+	var restore strings.Builder
+	fmt.Fprintf(&restore, "create %s hash:net family %s maxelem %s -exist\n", staging, family, maxElem)
+	fmt.Fprintf(&restore, "flush %s\n", staging)
+	for _, entry := range entries {
+		fmt.Fprintf(&restore, "add %s %s -exist\n", staging, entry)
+	}
+	if _, err := m.run(ctx, restore.String(), "ipset", "restore"); err != nil {
+		return err
+	}
+	if _, err := m.run(ctx, "", "ipset", "swap", staging, name); err != nil {
+		return err
+	}
+	_, err := m.run(ctx, "", "ipset", "destroy", staging)
+	return err
+}
+
+// ensureRule inserts the deny rule for a set unless it is already present.
+// UFW rebuilds its chains on reload, so the rule is checked on every refresh.
+func (m *Manager) ensureRule(ctx context.Context, binary, set string) error {
+	rule := []string{m.chain, "-m", "set", "--match-set", set, "src", "-j", "DROP"}
+	if _, err := m.run(ctx, "", binary, append([]string{"-C"}, rule...)...); err == nil {
+		return nil
+	}
+	_, err := m.run(ctx, "", binary, append([]string{"-I"}, rule...)...)
+	return err
+}
+
+// run executes a privileged command, passing stdin if it is not empty
+func (m *Manager) run(ctx context.Context, stdin, name string, args ...string) (string, error) {
+	argv := append(append(append([]string{}, m.commandWrapper...), name), args...)
+	output, err := command.CombinedOutput(ctx, command.Cmd{Argv: argv, Stdin: stdin})
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %w, output: %s", name, args[0], err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
@@ -0,0 +1,147 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring weekly time window in local time, written as
+// "<days> HH:MM-HH:MM" where days is "*" or a comma-separated list of
+// weekday names, e.g. "Sat,Sun 02:00-06:00" or "* 03:00-04:00". A window
+// whose end is before its start wraps past midnight.
+type Window struct {
+	days  map[time.Weekday]bool
+	start time.Duration
+	end   time.Duration
+	spec  string
+}
+
+// ParseWindow parses a window specification
+func ParseWindow(spec string) (*Window, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid window %q: expected \"<days> HH:MM-HH:MM\"", spec)
+	}
+
+	w := &Window{days: make(map[time.Weekday]bool), spec: spec}
+	if fields[0] == "*" {
+		for _, day := range weekdays {
+			w.days[day] = true
+		}
+	} else {
+		for _, name := range strings.Split(fields[0], ",") {
+			day, ok := weekdays[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("invalid window %q: unknown day %q", spec, name)
+			}
+			w.days[day] = true
+		}
+	}
+
+	startStr, endStr, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid window %q: expected HH:MM-HH:MM", spec)
+	}
+	var err error
+	if w.start, err = parseClock(startStr); err != nil {
+		return nil, fmt.Errorf("invalid window %q: %w", spec, err)
+	}
+	if w.end, err = parseClock(endStr); err != nil {
+		return nil, fmt.Errorf("invalid window %q: %w", spec, err)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid window %q: start and end are equal", spec)
+	}
+
+	return w, nil
+}
+
+// ParseWindows parses a list of window specifications
+func ParseWindows(specs []string) ([]*Window, error) {
+	var windows []*Window
+	for _, spec := range specs {
+		w, err := ParseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// Contains reports whether t falls inside the window
+func (w *Window) Contains(t time.Time) bool {
+	t = t.Local()
+	offset := clockOffset(t)
+
+	if w.start < w.end {
+		return w.days[t.Weekday()] && offset >= w.start && offset < w.end
+	}
+
+	// Wrapping window: the evening part belongs to the listed day, the
+	// early-morning part to the day after it
+	if offset >= w.start {
+		return w.days[t.Weekday()]
+	}
+	if offset < w.end {
+		return w.days[(t.Weekday()+6)%7]
+	}
+	return false
+}
+
+// String returns the window specification
+func (w *Window) String() string {
+	return w.spec
+}
+
+// InAny reports whether t falls inside any of the windows. An empty list
+// places no restriction and always returns true.
+func InAny(windows []*Window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStart returns the earliest time at or after t that falls inside one of
+// the windows, searching up to a week ahead with minute resolution
+func NextStart(windows []*Window, t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for i := 0; i <= 7*24*60; i++ {
+		candidate := t.Add(time.Duration(i) * time.Minute)
+		if InAny(windows, candidate) {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseClock parses HH:MM into an offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// clockOffset returns the time elapsed since local midnight
+func clockOffset(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
@@ -0,0 +1,504 @@
+package snmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AgentX PDU types (RFC 2741 section 6.1)
+const (
+	pduOpen       = 1
+	pduClose      = 2
+	pduRegister   = 3
+	pduGet        = 5
+	pduGetNext    = 6
+	pduGetBulk    = 7
+	pduTestSet    = 8
+	pduCleanupSet = 11
+	pduResponse   = 18
+)
+
+// AgentX header flags
+const (
+	flagNonDefaultContext = 0x08
+	flagNetworkByteOrder  = 0x10
+)
+
+// Variable types
+const (
+	TypeInteger     = 2
+	TypeOctetString = 4
+	TypeGauge32     = 66
+	TypeTimeTicks   = 67
+	TypeCounter64   = 70
+
+	typeNoSuchObject = 128
+	typeEndOfMIBView = 130
+)
+
+// Response errors
+const (
+	errNone        = 0
+	errGenErr      = 5
+	errNotWritable = 17
+)
+
+const (
+	headerSize = 20
+	// maxPayload guards against a corrupt length field
+	maxPayload = 1 << 20
+	// reconnectInterval is how long to wait before reconnecting to the master
+	reconnectInterval = 30 * time.Second
+)
+
+// OID is an SNMP object identifier
+type OID []uint32
+
+// ParseOID parses a dotted OID such as ".1.3.6.1.4.1.8072"
+func ParseOID(s string) (OID, error) {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" {
+		return nil, fmt.Errorf("empty OID")
+	}
+	var oid OID
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, uint32(n))
+	}
+	return oid, nil
+}
+
+// String returns the dotted form of the OID
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return "." + strings.Join(parts, ".")
+}
+
+// compare orders OIDs lexicographically
+func (o OID) compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+// Variable is a single exposed value. Value must be an int for TypeInteger,
+// a string for TypeOctetString, a uint32 for TypeGauge32 and TypeTimeTicks
+// and a uint64 for TypeCounter64.
+type Variable struct {
+	OID   OID
+	Type  uint16
+	Value interface{}
+}
+
+// SubAgent is an AgentX sub-agent that serves a subtree of variables through
+// the local SNMP master agent, e.g. snmpd with "master agentx"
+type SubAgent struct {
+	network     string
+	address     string
+	base        OID
+	description string
+	collect     func() []Variable
+	logger      *logrus.Logger
+
+	mu       sync.Mutex
+	packetID uint32
+}
+
+// NewSubAgent creates a sub-agent that registers base with the master agent
+// at address, either a unix socket path or "tcp:host:port". collect returns
+// the variables to serve, with OIDs relative to base.
+func NewSubAgent(address string, base OID, description string, collect func() []Variable, logger *logrus.Logger) *SubAgent {
+	network := "unix"
+	if rest, ok := strings.CutPrefix(address, "tcp:"); ok {
+		network, address = "tcp", rest
+	} else {
+		address = strings.TrimPrefix(address, "unix:")
+	}
+	return &SubAgent{
+		network:     network,
+		address:     address,
+		base:        base,
+		description: description,
+		collect:     collect,
+		logger:      logger,
+	}
+}
+
+// Run serves requests until the context is cancelled, reconnecting when the
+// master agent restarts or is not running yet
+func (a *SubAgent) Run(ctx context.Context) {
+	for {
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		a.logger.Warnf("AgentX session with %s ended: %v", a.address, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// serve opens a session, registers the subtree and answers requests until
+// the connection fails
+func (a *SubAgent) serve(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, a.network, a.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock reads when the agent stops
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Open: timeout, reserved, null subagent OID, description
+	var open bytes.Buffer
+	open.Write([]byte{0, 0, 0, 0})
+	writeOID(&open, nil, false)
+	writeOctetString(&open, a.description)
+	sessionID, err := a.request(conn, pduOpen, 0, open.Bytes())
+	if err != nil {
+		return fmt.Errorf("open failed: %w", err)
+	}
+
+	// Register: timeout, priority, range_subid, reserved, subtree
+	var register bytes.Buffer
+	register.Write([]byte{0, 127, 0, 0})
+	writeOID(&register, a.base, false)
+	if _, err := a.request(conn, pduRegister, sessionID, register.Bytes()); err != nil {
+		return fmt.Errorf("register of %s failed: %w", a.base, err)
+	}
+	a.logger.Infof("Registered AgentX subtree %s with %s", a.base, a.address)
+
+	for {
+		header, payload, err := readPDU(conn)
+		if err != nil {
+			return err
+		}
+		if header.pduType == pduClose {
+			return fmt.Errorf("master agent closed the session")
+		}
+		if header.pduType == pduCleanupSet {
+			continue
+		}
+
+		response := a.handle(header, payload)
+		if _, err := conn.Write(response); err != nil {
+			return err
+		}
+	}
+}
+
+// request sends a PDU and waits for its response, returning the session ID
+func (a *SubAgent) request(conn net.Conn, pduType byte, sessionID uint32, payload []byte) (uint32, error) {
+	a.mu.Lock()
+	a.packetID++
+	packetID := a.packetID
+	a.mu.Unlock()
+
+	if _, err := conn.Write(encodePDU(pduType, sessionID, 0, packetID, payload)); err != nil {
+		return 0, err
+	}
+	header, body, err := readPDU(conn)
+	if err != nil {
+		return 0, err
+	}
+	if header.pduType != pduResponse || len(body) < 8 {
+		return 0, fmt.Errorf("unexpected PDU type %d", header.pduType)
+	}
+	if code := header.order.Uint16(body[4:6]); code != errNone {
+		return 0, fmt.Errorf("master agent returned error %d", code)
+	}
+	return header.sessionID, nil
+}
+
+// handle answers a request from the master agent
+func (a *SubAgent) handle(header pduHeader, payload []byte) []byte {
+	r := &reader{data: payload, order: header.order}
+	if header.flags&flagNonDefaultContext != 0 {
+		r.octetString()
+	}
+
+	var response bytes.Buffer
+	response.Write([]byte{0, 0, 0, 0}) // sysUpTime
+	code := uint16(errNone)
+	var bindings bytes.Buffer
+
+	switch header.pduType {
+	case pduGet, pduGetNext, pduGetBulk:
+		variables := a.variables()
+		var nonRepeaters, maxRepetitions int
+		if header.pduType == pduGetBulk {
+			nonRepeaters, maxRepetitions = int(r.uint16()), int(r.uint16())
+		}
+
+		var ranges []searchRange
+		for r.err == nil && r.remaining() > 0 {
+			start, include := r.oid()
+			end, _ := r.oid()
+			ranges = append(ranges, searchRange{start: start, end: end, include: include})
+		}
+		if r.err != nil {
+			code = errGenErr
+			break
+		}
+
+		switch header.pduType {
+		case pduGet:
+			for _, sr := range ranges {
+				writeVarBind(&bindings, lookup(variables, sr.start))
+			}
+		case pduGetNext:
+			for _, sr := range ranges {
+				writeVarBind(&bindings, next(variables, sr))
+			}
+		default:
+			for i := 0; i < nonRepeaters && i < len(ranges); i++ {
+				writeVarBind(&bindings, next(variables, ranges[i]))
+			}
+			repeaters := ranges[min(nonRepeaters, len(ranges)):]
+			for rep := 0; rep < maxRepetitions; rep++ {
+				for i, sr := range repeaters {
+					v := next(variables, sr)
+					writeVarBind(&bindings, v)
+					repeaters[i] = searchRange{start: v.OID, end: sr.end}
+				}
+			}
+		}
+	case pduTestSet:
+		code = errNotWritable
+	default:
+		code = errGenErr
+	}
+
+	binary.Write(&response, binary.BigEndian, code)
+	response.Write([]byte{0, 0}) // index
+	if code == errNone {
+		response.Write(bindings.Bytes())
+	}
+	return encodePDU(pduResponse, header.sessionID, header.transactionID, header.packetID, response.Bytes())
+}
+
+// variables returns the collected variables with absolute OIDs, sorted
+func (a *SubAgent) variables() []Variable {
+	variables := a.collect()
+	for i := range variables {
+		variables[i].OID = append(append(OID{}, a.base...), variables[i].OID...)
+	}
+	sort.Slice(variables, func(i, j int) bool { return variables[i].OID.compare(variables[j].OID) < 0 })
+	return variables
+}
+
+// searchRange is a GetNext/GetBulk range; an empty end means unbounded
+type searchRange struct {
+	start   OID
+	end     OID
+	include bool
+}
+
+// lookup returns the variable with an exact OID, or noSuchObject
+func lookup(variables []Variable, oid OID) Variable {
+	for _, v := range variables {
+		if v.OID.compare(oid) == 0 {
+			return v
+		}
+	}
+	return Variable{OID: oid, Type: typeNoSuchObject}
+}
+
+// next returns the first variable in a search range, or endOfMibView
+func next(variables []Variable, sr searchRange) Variable {
+	for _, v := range variables {
+		c := v.OID.compare(sr.start)
+		if c < 0 || (c == 0 && !sr.include) {
+			continue
+		}
+		if len(sr.end) > 0 && v.OID.compare(sr.end) >= 0 {
+			break
+		}
+		return v
+	}
+	return Variable{OID: sr.start, Type: typeEndOfMIBView}
+}
+
+// pduHeader is a decoded AgentX header
+type pduHeader struct {
+	pduType       byte
+	flags         byte
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+	order         binary.ByteOrder
+}
+
+// readPDU reads a single PDU
+func readPDU(r io.Reader) (pduHeader, []byte, error) {
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return pduHeader{}, nil, err
+	}
+	if buf[0] != 1 {
+		return pduHeader{}, nil, fmt.Errorf("unsupported AgentX version %d", buf[0])
+	}
+
+	h := pduHeader{pduType: buf[1], flags: buf[2], order: binary.LittleEndian}
+	if h.flags&flagNetworkByteOrder != 0 {
+		h.order = binary.BigEndian
+	}
+	h.sessionID = h.order.Uint32(buf[4:8])
+	h.transactionID = h.order.Uint32(buf[8:12])
+	h.packetID = h.order.Uint32(buf[12:16])
+	length := h.order.Uint32(buf[16:20])
+	if length > maxPayload {
+		return pduHeader{}, nil, fmt.Errorf("AgentX payload of %d bytes is too large", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return pduHeader{}, nil, err
+	}
+	return h, payload, nil
+}
+
+// encodePDU builds a PDU in network byte order
+func encodePDU(pduType byte, sessionID, transactionID, packetID uint32, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{1, pduType, flagNetworkByteOrder, 0})
+	binary.Write(&buf, binary.BigEndian, sessionID)
+	binary.Write(&buf, binary.BigEndian, transactionID)
+	binary.Write(&buf, binary.BigEndian, packetID)
+	binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// internetPrefix is the 1.3.6.1 prefix AgentX encodes in a single byte
+var internetPrefix = OID{1, 3, 6, 1}
+
+// writeOID encodes an OID, compressing the internet prefix when possible
+func writeOID(buf *bytes.Buffer, oid OID, include bool) {
+	prefix := byte(0)
+	if len(oid) > 5 && oid[:4].compare(internetPrefix) == 0 && oid[4] <= 255 {
+		prefix = byte(oid[4])
+		oid = oid[5:]
+	}
+	inc := byte(0)
+	if include {
+		inc = 1
+	}
+	buf.Write([]byte{byte(len(oid)), prefix, inc, 0})
+	for _, n := range oid {
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// writeOctetString encodes a string padded to a multiple of four bytes
+func writeOctetString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	buf.WriteString(s)
+	if pad := (4 - len(s)%4) % 4; pad > 0 {
+		buf.Write(make([]byte, pad))
+	}
+}
+
+// writeVarBind encodes a variable binding
+func writeVarBind(buf *bytes.Buffer, v Variable) {
+	binary.Write(buf, binary.BigEndian, v.Type)
+	buf.Write([]byte{0, 0})
+	writeOID(buf, v.OID, false)
+
+	switch v.Type {
+	case TypeInteger:
+		value, _ := v.Value.(int)
+		binary.Write(buf, binary.BigEndian, int32(value))
+	case TypeOctetString:
+		value, _ := v.Value.(string)
+		writeOctetString(buf, value)
+	case TypeGauge32, TypeTimeTicks:
+		value, _ := v.Value.(uint32)
+		binary.Write(buf, binary.BigEndian, value)
+	case TypeCounter64:
+		value, _ := v.Value.(uint64)
+		binary.Write(buf, binary.BigEndian, value)
+	}
+}
+
+// reader decodes AgentX payload fields, recording the first error
+type reader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *reader) remaining() int {
+	return len(r.data) - r.pos
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil || n < 0 || r.remaining() < n {
+		r.err = errors.New("truncated AgentX payload")
+		return make([]byte, max(n, 0))
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	return r.order.Uint16(r.take(2))
+}
+
+func (r *reader) uint32() uint32 {
+	return r.order.Uint32(r.take(4))
+}
+
+func (r *reader) octetString() string {
+	n := int(r.uint32())
+	s := string(r.take(n))
+	r.take((4 - n%4) % 4)
+	return s
+}
+
+func (r *reader) oid() (OID, bool) {
+	head := r.take(4)
+	count, prefix, include := int(head[0]), head[1], head[2] == 1
+
+	var oid OID
+	if prefix != 0 {
+		oid = append(append(oid, internetPrefix...), uint32(prefix))
+	}
+	for i := 0; i < count && r.err == nil; i++ {
+		oid = append(oid, r.uint32())
+	}
+	return oid, include
+}
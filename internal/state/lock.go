@@ -0,0 +1,84 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const pidFileName = "agent.pid"
+
+// ErrAlreadyRunning is returned when another agent instance holds the lock
+var ErrAlreadyRunning = errors.New("another agent instance is already running")
+
+// Lock is an exclusive lock on the agent PID file
+type Lock struct {
+	file *os.File
+}
+
+// AcquireLock takes an exclusive, non-blocking lock on the PID file in the
+// state directory and records the current process ID in it. The lock is
+// released automatically by the kernel if the process dies.
+func AcquireLock(stateDir string) (*Lock, error) {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	path := filepath.Join(stateDir, pidFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PID file %s: %w", path, err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := readPID(file)
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if pid > 0 {
+				return nil, fmt.Errorf("%w (pid %d, lock %s)", ErrAlreadyRunning, pid, path)
+			}
+			return nil, fmt.Errorf("%w (lock %s)", ErrAlreadyRunning, path)
+		}
+		return nil, fmt.Errorf("failed to lock PID file %s: %w", path, err)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate PID file: %w", err)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write PID file: %w", err)
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release clears the PID and releases the lock. The PID file is left in
+// place: unlinking it would let a new agent lock a fresh file at the same
+// path while another waiter still holds the unlinked one.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// readPID returns the process ID recorded in the PID file, or 0 if unknown
+func readPID(file *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := file.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,48 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const pauseFileName = "pause.json"
+
+// Pause represents a request to suspend firewall enforcement
+type Pause struct {
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+	Source string    `json:"source"`
+}
+
+// Active reports whether the pause is still in effect at the given time
+func (p *Pause) Active(now time.Time) bool {
+	return p != nil && now.Before(p.Until)
+}
+
+// SavePause writes a pause request to the state directory
+func SavePause(stateDir string, pause *Pause) error {
+	return Save(stateDir, pauseFileName, pause)
+}
+
+// LoadPause reads the pause request from the state directory.
+// It returns nil without error if no pause has been requested.
+func LoadPause(stateDir string) (*Pause, error) {
+	var pause Pause
+	if err := Load(stateDir, pauseFileName, &pause); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &pause, nil
+}
+
+// ClearPause removes any pause request from the state directory
+func ClearPause(stateDir string) error {
+	err := os.Remove(filepath.Join(stateDir, pauseFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const statusFileName = "status.json"
+
+// Status represents the outcome of the most recent collection cycle
+type Status struct {
+	Timestamp time.Time `json:"timestamp"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	// ErrorKind classifies Error, and NeedsOperator tells whether it will
+	// persist until someone intervenes rather than pass on its own
+	ErrorKind     string     `json:"error_kind,omitempty"`
+	NeedsOperator bool       `json:"needs_operator,omitempty"`
+	Duration      string     `json:"duration"`
+	APIRules      int        `json:"api_rules"`
+	PausedUntil   *time.Time `json:"paused_until,omitempty"`
+	// RulesHash identifies the API rules last applied to UFW. It is carried
+	// across cycles and restarts so drift on the host can be told apart from
+	// rule changes in the API.
+	RulesHash string `json:"rules_hash,omitempty"`
+	// LastSynced is when UFW last matched the API after a synchronization
+	// without failures, carried across cycles like RulesHash
+	LastSynced *time.Time `json:"last_synced,omitempty"`
+	// Sync is the outcome of the cycle's firewall synchronization, unset
+	// when none ran
+	Sync *SyncResult `json:"sync,omitempty"`
+	// Drift is how UFW differs from the API rules when the firewall is in
+	// readonly mode, where differences are reported instead of corrected
+	Drift *DriftResult `json:"drift,omitempty"`
+	// Tenants are the outcomes for the additional firewalls of a shared
+	// host, by firewall ID
+	Tenants map[string]*TenantStatus `json:"tenants,omitempty"`
+}
+
+// TenantStatus is the outcome of a cycle for one additional firewall
+type TenantStatus struct {
+	Success    bool        `json:"success"`
+	Error      string      `json:"error,omitempty"`
+	APIRules   int         `json:"api_rules"`
+	LastSynced *time.Time  `json:"last_synced,omitempty"`
+	Sync       *SyncResult `json:"sync,omitempty"`
+}
+
+// DriftResult lists the rules UFW lacks and those it has in excess of the
+// API rules, in their normalized string form
+type DriftResult struct {
+	Missing    []string `json:"missing"`
+	Unexpected []string `json:"unexpected"`
+	// Policy lists the default policy and logging settings that differ
+	Policy []string `json:"policy,omitempty"`
+}
+
+// SyncResult describes what a firewall synchronization changed. Rules are
+// in their normalized string form.
+type SyncResult struct {
+	Added   []string      `json:"added"`
+	Removed []string      `json:"removed"`
+	Failed  []SyncFailure `json:"failed"`
+	// Unchanged counts the UFW rules that already matched the API
+	Unchanged int    `json:"unchanged"`
+	Duration  string `json:"duration"`
+	// Canary is why the changes were applied in canary mode, and RolledBack
+	// whether they were reverted after failing verification
+	Canary     string `json:"canary,omitempty"`
+	RolledBack bool   `json:"rolled_back,omitempty"`
+	// Policy lists the default policy and logging changes applied after
+	// the rules
+	Policy []string `json:"policy,omitempty"`
+}
+
+// SyncFailure is a rule change that could not be applied
+type SyncFailure struct {
+	Rule string `json:"rule"`
+	// Operation is "add" or "remove"
+	Operation string `json:"operation"`
+	Error     string `json:"error"`
+}
+
+// Changed reports whether the synchronization modified UFW
+func (r *SyncResult) Changed() bool {
+	return len(r.Added)+len(r.Removed)+len(r.Policy) > 0
+}
+
+// String summarizes the result for logging
+func (r *SyncResult) String() string {
+	return fmt.Sprintf("added %d, removed %d, failed %d, unchanged %d in %s",
+		len(r.Added), len(r.Removed), len(r.Failed), r.Unchanged, r.Duration)
+}
+
+// SaveStatus writes the collection status to the state directory
+func SaveStatus(stateDir string, status *Status) error {
+	return Save(stateDir, statusFileName, status)
+}
+
+// LoadStatus reads the last collection status from the state directory
+func LoadStatus(stateDir string) (*Status, error) {
+	var status Status
+	if err := Load(stateDir, statusFileName, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Save writes a value as JSON to the named file in the state directory
+func Save(stateDir, name string, v interface{}) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", name, err)
+	}
+
+	return writeFileAtomic(filepath.Join(stateDir, name), data, 0644)
+}
+
+// Load reads the named JSON file from the state directory into v. The error
+// satisfies os.IsNotExist if the file has not been written yet.
+func Load(stateDir, name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(stateDir, name))
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid state file %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Remove deletes the named file from the state directory, if it exists
+func Remove(stateDir, name string) error {
+	err := os.Remove(filepath.Join(stateDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
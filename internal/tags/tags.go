@@ -0,0 +1,134 @@
+package tags
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/client"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Set is a collection of tags and key/value metadata for a server
+type Set struct {
+	Tags     []string          `json:"tags" yaml:"tags"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+// merge adds the tags and metadata of other to s. Metadata in other wins.
+func (s *Set) merge(other Set) {
+	s.Tags = append(s.Tags, other.Tags...)
+	for key, value := range other.Metadata {
+		if s.Metadata == nil {
+			s.Metadata = make(map[string]string)
+		}
+		s.Metadata[key] = value
+	}
+}
+
+// normalize trims, deduplicates and sorts the tags
+func (s *Set) normalize() {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range s.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	s.Tags = tags
+}
+
+// File is the well-known JSON file written for local tooling
+type File struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	Local     Set       `json:"local"`
+	Remote    Set       `json:"remote"`
+}
+
+// Syncer reports local tags to the API and writes API-side tags to a file
+type Syncer struct {
+	client     *client.LatitudeClient
+	endpoint   string
+	configured Set
+	dropInDir  string
+	outputFile string
+	logger     *logrus.Logger
+}
+
+// NewSyncer creates a new tag syncer. configured holds the tags from the
+// agent configuration; dropInDir holds additional YAML files with the same shape.
+func NewSyncer(latitudeClient *client.LatitudeClient, endpoint string, configured Set, dropInDir, outputFile string, logger *logrus.Logger) *Syncer {
+	return &Syncer{
+		client:     latitudeClient,
+		endpoint:   endpoint,
+		configured: configured,
+		dropInDir:  dropInDir,
+		outputFile: outputFile,
+		logger:     logger,
+	}
+}
+
+// Sync sends the local tags to the API and writes the tags defined on the
+// API side to the output file
+func (s *Syncer) Sync(ctx context.Context) error {
+	local, err := s.Local()
+	if err != nil {
+		return err
+	}
+
+	var remote Set
+	if err := s.client.ExchangeReport(ctx, s.endpoint, local, &remote); err != nil {
+		return fmt.Errorf("failed to sync tags: %w", err)
+	}
+	remote.normalize()
+
+	file := File{UpdatedAt: time.Now(), Local: *local, Remote: remote}
+	if err := state.Save(filepath.Dir(s.outputFile), filepath.Base(s.outputFile), file); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.outputFile, err)
+	}
+
+	s.logger.Debugf("Synced %d local and %d remote tags", len(local.Tags), len(remote.Tags))
+	return nil
+}
+
+// Local returns the configured tags merged with those from drop-in files.
+// Drop-in files are read in lexical order, so later files override metadata
+// from earlier ones.
+func (s *Syncer) Local() (*Set, error) {
+	local := Set{}
+	local.merge(s.configured)
+
+	entries, err := os.ReadDir(s.dropInDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read tag drop-in directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (!strings.HasSuffix(name, ".yaml") && !strings.HasSuffix(name, ".yml")) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dropInDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tag file %s: %w", name, err)
+		}
+		var dropIn Set
+		if err := yaml.Unmarshal(data, &dropIn); err != nil {
+			return nil, fmt.Errorf("failed to parse tag file %s: %w", name, err)
+		}
+		local.merge(dropIn)
+	}
+
+	local.normalize()
+	return &local, nil
+}
@@ -0,0 +1,208 @@
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/schedule"
+	"github.com/sirupsen/logrus"
+)
+
+// maxOutput limits how much task output is kept in results
+const maxOutput = 16 * 1024
+
+// Task is a recurring command run by the agent
+type Task struct {
+	Name     string   `json:"name"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Schedule string   `json:"schedule"`
+	Timeout  string   `json:"timeout"`
+
+	cron    *schedule.Cron
+	timeout time.Duration
+}
+
+// TasksResponse represents the API response structure for scheduled tasks
+type TasksResponse struct {
+	Tasks []Task `json:"tasks"`
+}
+
+// Result is the outcome of a task run reported to the API
+type Result struct {
+	Task       string    `json:"task"`
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	ExitCode   int       `json:"exit_code"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Prepare validates the task and parses its schedule and timeout.
+// defaultTimeout is used when the task does not set one.
+func (t *Task) Prepare(defaultTimeout time.Duration) error {
+	if t.Name == "" {
+		return fmt.Errorf("task name is required")
+	}
+	if !filepath.IsAbs(t.Command) {
+		return fmt.Errorf("task %s: command must be an absolute path", t.Name)
+	}
+
+	var err error
+	if t.cron, err = schedule.ParseCron(t.Schedule); err != nil {
+		return fmt.Errorf("task %s: %w", t.Name, err)
+	}
+
+	t.timeout = defaultTimeout
+	if t.Timeout != "" {
+		if t.timeout, err = time.ParseDuration(t.Timeout); err != nil {
+			return fmt.Errorf("task %s: invalid timeout %q: %w", t.Name, t.Timeout, err)
+		}
+	}
+	return nil
+}
+
+// ParseTasks parses the tasks returned by the API. API tasks may only run
+// scripts inside scriptDir, so the API cannot run arbitrary host binaries.
+func ParseTasks(tasksJSON, scriptDir string, defaultTimeout time.Duration) ([]*Task, error) {
+	var response TasksResponse
+	if err := json.Unmarshal([]byte(tasksJSON), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse tasks JSON: %w", err)
+	}
+
+	var tasks []*Task
+	for i := range response.Tasks {
+		task := &response.Tasks[i]
+		if err := task.Prepare(defaultTimeout); err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(scriptDir, filepath.Clean(task.Command)); err != nil || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("task %s: command %s is outside %s", task.Name, task.Command, scriptDir)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// Scheduler runs tasks on their cron schedules and reports each run
+type Scheduler struct {
+	commandWrapper []string
+	report         func(context.Context, Result) error
+	logger         *logrus.Logger
+
+	mu      sync.Mutex
+	tasks   []*Task
+	running map[string]bool
+}
+
+// NewScheduler creates a task scheduler. report delivers each result.
+func NewScheduler(report func(context.Context, Result) error, logger *logrus.Logger) *Scheduler {
+	return &Scheduler{
+		report:  report,
+		logger:  logger,
+		running: make(map[string]bool),
+	}
+}
+
+// SetCommandWrapper sets a command prefix for running tasks, e.g. a chroot
+// into the host filesystem
+func (s *Scheduler) SetCommandWrapper(wrapper ...string) {
+	s.commandWrapper = wrapper
+}
+
+// SetTasks replaces the scheduled tasks
+func (s *Scheduler) SetTasks(tasks []*Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = tasks
+}
+
+// Run checks the schedules at the start of every minute until the context
+// is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		s.runDue(ctx, next)
+	}
+}
+
+// runDue starts every task scheduled for the minute containing t. A task
+// still running from a previous run is skipped rather than run twice.
+func (s *Scheduler) runDue(ctx context.Context, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, task := range s.tasks {
+		if !task.cron.Matches(t) {
+			continue
+		}
+		if s.running[task.Name] {
+			s.logger.Warnf("Task %s is still running, skipping scheduled run", task.Name)
+			continue
+		}
+		s.running[task.Name] = true
+		go s.execute(ctx, task)
+	}
+}
+
+// execute runs a task, captures its output and reports the result
+func (s *Scheduler) execute(ctx context.Context, task *Task) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, task.Name)
+		s.mu.Unlock()
+	}()
+
+	result := Result{Task: task.Name, Command: task.Command, StartedAt: time.Now()}
+	s.logger.Infof("Running task %s", task.Name)
+
+	runCtx, cancel := context.WithTimeout(ctx, task.timeout)
+	defer cancel()
+
+	argv := append(append(append([]string{}, s.commandWrapper...), task.Command), task.Args...)
+	output, err := command.CombinedOutput(runCtx, command.Cmd{Argv: argv})
+
+	result.FinishedAt = time.Now()
+	result.Output = truncate(string(output))
+	if err != nil {
+		result.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		}
+		if runCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", task.timeout)
+		}
+		result.Error = err.Error()
+		s.logger.Errorf("Task %s failed: %v", task.Name, err)
+	} else {
+		s.logger.Infof("Task %s completed in %s", task.Name, result.FinishedAt.Sub(result.StartedAt).Round(time.Millisecond))
+	}
+
+	if err := s.report(ctx, result); err != nil {
+		s.logger.WithError(err).Warnf("Failed to report result of task %s", task.Name)
+	}
+}
+
+// truncate keeps the last maxOutput bytes of task output
+func truncate(output string) string {
+	if len(output) <= maxOutput {
+		return output
+	}
+	return "...(truncated)\n" + output[len(output)-maxOutput:]
+}
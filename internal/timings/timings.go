@@ -0,0 +1,109 @@
+package timings
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSamples bounds the samples kept per operation, dropping the oldest
+// first, so chatty operations do not grow memory over long windows
+const maxSamples = 10000
+
+// Percentiles summarizes the durations of an operation, in milliseconds
+type Percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// sample is one observed duration
+type sample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+var (
+	mu      sync.Mutex
+	window  = time.Hour
+	samples = make(map[string][]sample)
+)
+
+// SetWindow sets how long observed durations count towards percentiles
+func SetWindow(d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	window = d
+}
+
+// Window returns how long observed durations count towards percentiles
+func Window() time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	return window
+}
+
+// Observe records how long an operation took. Names group operations, e.g.
+// "api", "ufw" or "collector:firewall".
+func Observe(name string, d time.Duration) {
+	now := time.Now()
+	mu.Lock()
+	defer mu.Unlock()
+	kept := prune(samples[name], now)
+	if len(kept) >= maxSamples {
+		kept = kept[len(kept)-maxSamples+1:]
+	}
+	samples[name] = append(kept, sample{at: now, duration: d})
+}
+
+// Since records the duration of an operation that started at start
+func Since(name string, start time.Time) {
+	Observe(name, time.Since(start))
+}
+
+// prune drops samples older than the window. Samples are in time order.
+func prune(list []sample, now time.Time) []sample {
+	cutoff := now.Add(-window)
+	i := sort.Search(len(list), func(i int) bool { return list[i].at.After(cutoff) })
+	return list[i:]
+}
+
+// Summary returns the percentiles of every operation observed within the
+// window
+func Summary() map[string]Percentiles {
+	now := time.Now()
+	mu.Lock()
+	durations := make(map[string][]time.Duration, len(samples))
+	for name, list := range samples {
+		list = prune(list, now)
+		if len(list) == 0 {
+			delete(samples, name)
+			continue
+		}
+		samples[name] = list
+		for _, s := range list {
+			durations[name] = append(durations[name], s.duration)
+		}
+	}
+	mu.Unlock()
+
+	summary := make(map[string]Percentiles, len(durations))
+	for name, list := range durations {
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		summary[name] = Percentiles{
+			Count: len(list),
+			P50:   percentile(list, 50),
+			P95:   percentile(list, 95),
+			P99:   percentile(list, 99),
+		}
+	}
+	return summary
+}
+
+// percentile returns the nearest-rank percentile of sorted durations in
+// milliseconds
+func percentile(sorted []time.Duration, p int) float64 {
+	rank := (p*len(sorted) + 99) / 100
+	return float64(sorted[max(rank, 1)-1]) / float64(time.Millisecond)
+}
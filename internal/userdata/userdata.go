@@ -0,0 +1,188 @@
+package userdata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/latitudesh/agent/internal/command"
+	"github.com/latitudesh/agent/internal/state"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	completedFile = "user-data.json"
+	// maxOutput limits how much script output is kept in reports
+	maxOutput = 16 * 1024
+)
+
+// validScriptName keeps script names usable as file names
+var validScriptName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Script is a provisioning script defined for the project
+type Script struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// Response represents the API response structure for user-data
+type Response struct {
+	Scripts []Script `json:"scripts"`
+}
+
+// ScriptResult is the outcome of running one script
+type ScriptResult struct {
+	Name       string    `json:"name"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	ExitCode   int       `json:"exit_code"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Report is the first-boot provisioning outcome, also kept in the state
+// directory to mark provisioning as done
+type Report struct {
+	CompletedAt time.Time      `json:"completed_at"`
+	Success     bool           `json:"success"`
+	Scripts     []ScriptResult `json:"scripts"`
+}
+
+// Completed returns the recorded first-boot report, or nil if provisioning
+// has not run on this server yet
+func Completed(stateDir string) (*Report, error) {
+	var report Report
+	if err := state.Load(stateDir, completedFile, &report); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Runner executes user-data scripts in order, stopping at the first failure
+// like cloud-init's runcmd
+type Runner struct {
+	rootDir        string
+	scriptDir      string
+	logFile        string
+	stateDir       string
+	timeout        time.Duration
+	commandWrapper []string
+	logger         *logrus.Logger
+}
+
+// NewRunner creates a user-data runner. Scripts are written to scriptDir and
+// their output appended to logFile, both paths on the host filesystem whose
+// root is rootDir.
+func NewRunner(rootDir, scriptDir, logFile, stateDir string, timeout time.Duration, logger *logrus.Logger) *Runner {
+	return &Runner{
+		rootDir:   rootDir,
+		scriptDir: scriptDir,
+		logFile:   logFile,
+		stateDir:  stateDir,
+		timeout:   timeout,
+		logger:    logger,
+	}
+}
+
+// SetCommandWrapper sets a command prefix for running scripts, e.g. a chroot
+// into the host filesystem
+func (r *Runner) SetCommandWrapper(wrapper ...string) {
+	r.commandWrapper = wrapper
+}
+
+// Run executes the user-data scripts and records completion so they never
+// run again on this server
+func (r *Runner) Run(ctx context.Context, userDataJSON string) (*Report, error) {
+	var response Response
+	if err := json.Unmarshal([]byte(userDataJSON), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse user-data JSON: %w", err)
+	}
+	for _, script := range response.Scripts {
+		if !validScriptName.MatchString(script.Name) {
+			return nil, fmt.Errorf("invalid user-data script name %q", script.Name)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(r.rootDir, r.scriptDir), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create user-data directory: %w", err)
+	}
+	log, err := os.OpenFile(filepath.Join(r.rootDir, r.logFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user-data log: %w", err)
+	}
+	defer log.Close()
+
+	report := &Report{Success: true, Scripts: []ScriptResult{}}
+	for i, script := range response.Scripts {
+		// Number scripts so the on-disk order matches the execution order
+		path := filepath.Join(r.scriptDir, fmt.Sprintf("%02d-%s", i, script.Name))
+		result := r.runScript(ctx, script, path, log)
+		report.Scripts = append(report.Scripts, result)
+		if result.Error != "" {
+			report.Success = false
+			break
+		}
+	}
+	report.CompletedAt = time.Now()
+
+	// Record completion even after a failure: re-running a half-applied
+	// bootstrap on every restart is worse than reporting the failure once
+	if err := state.Save(r.stateDir, completedFile, report); err != nil {
+		return report, fmt.Errorf("failed to record user-data completion: %w", err)
+	}
+	return report, nil
+}
+
+// runScript writes a script to disk and executes it
+func (r *Runner) runScript(ctx context.Context, script Script, path string, log *os.File) ScriptResult {
+	result := ScriptResult{Name: script.Name, StartedAt: time.Now()}
+	r.logger.Infof("Running user-data script %s", script.Name)
+
+	content := script.Content
+	if !strings.HasPrefix(content, "#!") {
+		content = "#!/bin/sh\n" + content
+	}
+	if err := os.WriteFile(filepath.Join(r.rootDir, path), []byte(content), 0700); err != nil {
+		result.FinishedAt = time.Now()
+		result.ExitCode = -1
+		result.Error = fmt.Sprintf("failed to write script: %v", err)
+		return result
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	argv := append(append([]string{}, r.commandWrapper...), path)
+	output, err := command.CombinedOutput(runCtx, command.Cmd{Argv: argv})
+	result.FinishedAt = time.Now()
+
+	fmt.Fprintf(log, "=== %s %s ===\n%s\n", result.StartedAt.Format(time.RFC3339), script.Name, output)
+
+	result.Output = string(output)
+	if len(result.Output) > maxOutput {
+		result.Output = "...(truncated)\n" + result.Output[len(result.Output)-maxOutput:]
+	}
+	if err != nil {
+		result.ExitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+		}
+		if runCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", r.timeout)
+		}
+		result.Error = err.Error()
+		r.logger.Errorf("User-data script %s failed: %v", script.Name, err)
+	}
+	return result
+}